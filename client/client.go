@@ -2,8 +2,10 @@ package client
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -44,8 +46,44 @@ const agentVersionHeader = "x-agent-version"
 const contentTypeHeader = "Content-Type"
 const userAgentHeader = "User-Agent"
 const uploadFileHash = "x-upload-file"
+const uploadFileSHA256 = "x-upload-file-sha256"
 const contentMD5 = "Content-MD5"
 const proxyAuthHeader = "Proxy-Authorization"
+const protocolVersionHeader = "x-protocol-version"
+const maxPayloadSizeHeader = "x-max-payload-size"
+const supportedEncodingsHeader = "x-supported-encodings"
+const capabilitiesHeader = "x-capabilities"
+const fileClassesHeader = "x-file-classes"
+
+// cycleIDHeader is the cycle ID of the latest poll held by the metric sample, which links the upload to the
+// agent logs and sample manifest of the poll
+const cycleIDHeader = "x-cycle-id"
+const contentEncodingHeader = "Content-Encoding"
+
+// ProtocolVersion is the version of the upload protocol spoken by this client
+const ProtocolVersion = "1"
+
+// CapabilityUnchangedNodeData is advertised by upload endpoints that accept a marker in place of node
+// data that is unchanged from its baseline
+const CapabilityUnchangedNodeData = "unchanged-node-data"
+
+// upload content encodings, the archive is sent with a Content-Encoding so the upload endpoint does not
+// compress it again
+const (
+	// EncodingAuto negotiates the content encoding with the upload endpoint
+	EncodingAuto = "auto"
+	// EncodingNone sends the archive without a Content-Encoding
+	EncodingNone = "none"
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// archiveEncodings are the encodings the metric sample archive can be produced in, most preferred first.
+// zstd is negotiated once the agent is able to produce zstd archives.
+var archiveEncodings = []string{EncodingGzip}
+
+// ErrUnauthorized is returned from Handshake when the upload endpoint rejects the API key
+var ErrUnauthorized = errors.New("the metrics collection API rejected the API key")
 
 var /* const */ validToken = regexp.MustCompile(`^\w+$`)
 
@@ -60,6 +98,8 @@ type Configuration struct {
 	ProxyInsecure bool
 	Verbose       bool
 	Region        string
+	// ContentEncoding is the Content-Encoding of the metric sample archive, it is sent without one if empty
+	ContentEncoding string
 }
 
 // NewHTTPMetricClient will configure a new instance of a Cloudability client.
@@ -125,12 +165,13 @@ func NewHTTPMetricClient(cfg Configuration) (MetricClient, error) {
 	userAgent := fmt.Sprintf("cldy-client/%v", version.VERSION)
 
 	return httpMetricClient{
-		httpClient: httpClient,
-		userAgent:  userAgent,
-		baseURL:    cfg.BaseURL,
-		token:      cfg.Token,
-		verbose:    cfg.Verbose,
-		maxRetries: cfg.MaxRetries,
+		httpClient:      httpClient,
+		userAgent:       userAgent,
+		baseURL:         cfg.BaseURL,
+		token:           cfg.Token,
+		verbose:         cfg.Verbose,
+		maxRetries:      cfg.MaxRetries,
+		contentEncoding: cfg.ContentEncoding,
 	}, nil
 
 }
@@ -139,6 +180,108 @@ func NewHTTPMetricClient(cfg Configuration) (MetricClient, error) {
 type MetricClient interface {
 	SendMetricSample(*os.File, string, string) error
 	GetUploadURL(*os.File, string, string, string, int) (string, string, error)
+	Handshake(*os.File, string, string) (UploadLimits, error)
+}
+
+// UploadLimits are the limits advertised by the upload endpoint. Zero values mean the endpoint did not
+// advertise a limit.
+type UploadLimits struct {
+	ProtocolVersion    string
+	MaxPayloadBytes    int64
+	SupportedEncodings []string
+	Capabilities       []string
+	// FileClasses are the sample file classes accepted beyond the core classes every endpoint accepts
+	FileClasses []string
+}
+
+// Allows returns true if a payload of the given size is within the advertised limits
+func (l UploadLimits) Allows(size int64) bool {
+	return l.MaxPayloadBytes <= 0 || size <= l.MaxPayloadBytes
+}
+
+// SupportsEncoding returns true if the upload endpoint advertised support for the content encoding
+func (l UploadLimits) SupportsEncoding(encoding string) bool {
+	for _, e := range l.SupportedEncodings {
+		if strings.EqualFold(e, encoding) {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsCapability returns true if the upload endpoint advertised the capability
+func (l UploadLimits) SupportsCapability(capability string) bool {
+	for _, c := range l.Capabilities {
+		if strings.EqualFold(c, capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateContentEncoding returns the Content-Encoding to upload the metric sample archive with for the
+// configured preference, and the reason for the decision. An empty encoding means the archive is sent
+// without a Content-Encoding, as it is when the upload endpoint did not advertise its supported encodings.
+func NegotiateContentEncoding(preference string, limits UploadLimits) (string, string) {
+	preference = strings.ToLower(strings.TrimSpace(preference))
+	switch preference {
+	case EncodingNone:
+		return "", "disabled by configuration"
+	case "", EncodingAuto:
+		if len(limits.SupportedEncodings) == 0 {
+			return "", "upload endpoint did not advertise supported encodings"
+		}
+		for _, e := range archiveEncodings {
+			if limits.SupportsEncoding(e) {
+				return e, "negotiated with upload endpoint"
+			}
+		}
+		return "", fmt.Sprintf("no encoding supported by the agent is among those supported by the upload "+
+			"endpoint %v", limits.SupportedEncodings)
+	}
+
+	supported := false
+	for _, e := range archiveEncodings {
+		supported = supported || e == preference
+	}
+	switch {
+	case !supported:
+		return "", fmt.Sprintf("configured encoding %s is not supported by the agent", preference)
+	case len(limits.SupportedEncodings) > 0 && !limits.SupportsEncoding(preference):
+		return "", fmt.Sprintf("configured encoding %s is not supported by the upload endpoint", preference)
+	}
+	return preference, "configured"
+}
+
+// parseUploadLimits reads the limits advertised in the upload endpoint response headers
+func parseUploadLimits(header http.Header) UploadLimits {
+	limits := UploadLimits{
+		ProtocolVersion: header.Get(protocolVersionHeader),
+	}
+	if v := header.Get(maxPayloadSizeHeader); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			log.Warnf("Ignoring invalid max payload size advertised by upload endpoint: %s", v)
+		} else {
+			limits.MaxPayloadBytes = size
+		}
+	}
+	for _, e := range strings.Split(header.Get(supportedEncodingsHeader), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			limits.SupportedEncodings = append(limits.SupportedEncodings, strings.ToLower(e))
+		}
+	}
+	for _, c := range strings.Split(header.Get(capabilitiesHeader), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			limits.Capabilities = append(limits.Capabilities, strings.ToLower(c))
+		}
+	}
+	for _, c := range strings.Split(header.Get(fileClassesHeader), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			limits.FileClasses = append(limits.FileClasses, strings.ToLower(c))
+		}
+	}
+	return limits
 }
 
 type httpMetricClient struct {
@@ -148,6 +291,8 @@ type httpMetricClient struct {
 	token      string
 	verbose    bool
 	maxRetries int
+	// contentEncoding is the Content-Encoding the metric sample archive is sent with, if not empty
+	contentEncoding string
 }
 
 // MetricSampleResponse represents the response from the uploadmetrics endpoint
@@ -295,7 +440,13 @@ func (c httpMetricClient) buildAndDoRequest(
 		return nil, nil, err
 	}
 
-	req.Header.Set(contentTypeHeader, "multipart/form-data")
+	if c.contentEncoding != "" {
+		// the archive is a tar compressed with the content encoding
+		req.Header.Set(contentTypeHeader, "application/x-tar")
+		req.Header.Set(contentEncodingHeader, c.contentEncoding)
+	} else {
+		req.Header.Set(contentTypeHeader, "multipart/form-data")
+	}
 	req.Header.Set(contentMD5, hash)
 	req.ContentLength = size
 
@@ -314,6 +465,33 @@ func getSleepDuration(tries int) time.Duration {
 	return time.Duration(seconds) * time.Second
 }
 
+// Handshake requests an upload location for a small health check file to verify connectivity and
+// authentication with the upload endpoint, and returns the limits the endpoint advertises
+func (c httpMetricClient) Handshake(healthCheckFile *os.File, agentVersion, UID string) (UploadLimits, error) {
+	r, err := c.requestUploadURL(healthCheckFile, c.baseURL, agentVersion, UID, 0)
+	if r.statusCode == http.StatusUnauthorized || r.statusCode == http.StatusForbidden {
+		return UploadLimits{}, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	if err != nil {
+		return UploadLimits{}, err
+	}
+
+	limits := parseUploadLimits(r.header)
+	if limits.ProtocolVersion != "" && limits.ProtocolVersion != ProtocolVersion {
+		log.Warnf("Upload endpoint speaks protocol version %s, agent speaks version %s",
+			limits.ProtocolVersion, ProtocolVersion)
+	}
+	return limits, nil
+}
+
+// uploadURLResponse is the result of requesting an upload location
+type uploadURLResponse struct {
+	location   string
+	hash       string
+	statusCode int
+	header     http.Header
+}
+
 func (c httpMetricClient) GetUploadURL(
 	metricFile *os.File,
 	metricSampleURL,
@@ -321,18 +499,29 @@ func (c httpMetricClient) GetUploadURL(
 	UID string,
 	attempt int,
 ) (string, string, error) {
+	r, err := c.requestUploadURL(metricFile, metricSampleURL, agentVersion, UID, attempt)
+	return r.location, r.hash, err
+}
+
+func (c httpMetricClient) requestUploadURL(
+	metricFile *os.File,
+	metricSampleURL,
+	agentVersion,
+	UID string,
+	attempt int,
+) (uploadURLResponse, error) {
 	var rerr error
-	hash, err := GetB64MD5Hash(metricFile.Name())
+	hash, sha, err := GetArchiveHashes(metricFile.Name())
 	if err != nil {
 		log.Errorf("error encountered generating upload check sum: %v", err)
-		return "", "", err
+		return uploadURLResponse{}, err
 	}
 
 	d := MetricSampleResponse{}
 
 	req, err := http.NewRequest(http.MethodPost, metricSampleURL, nil)
 	if err != nil {
-		return "", "", err
+		return uploadURLResponse{}, err
 	}
 
 	req.Header.Set(contentTypeHeader, "application/json")
@@ -342,6 +531,11 @@ func (c httpMetricClient) GetUploadURL(
 	req.Header.Set(agentVersionHeader, agentVersion)
 	req.Header.Set(clusterUIDHeader, UID)
 	req.Header.Set(uploadFileHash, hash)
+	req.Header.Set(uploadFileSHA256, sha)
+	req.Header.Set(protocolVersionHeader, ProtocolVersion)
+	if cycleID := util.ArchiveCycleID(metricFile.Name()); cycleID != "" {
+		req.Header.Set(cycleIDHeader, cycleID)
+	}
 
 	if c.verbose {
 		requestDump, requestErr := httputil.DumpRequest(req, true)
@@ -370,16 +564,21 @@ func (c httpMetricClient) GetUploadURL(
 		if resp != nil {
 			log.Debugln(string(responseDump))
 		}
-		return "", "", fmt.Errorf("Unable to retrieve upload URI: %v", err)
+		return uploadURLResponse{}, fmt.Errorf("Unable to retrieve upload URI: %v", err)
 	}
 
 	defer util.SafeClose(resp.Body.Close, &rerr)
 
+	r := uploadURLResponse{
+		statusCode: resp.StatusCode,
+		header:     resp.Header,
+	}
+
 	if resp.StatusCode != 200 {
 		log.Errorf("GetURL Retry %d: Failed to acquire s3 url, Status: %s X-Amzn-Requestid: %s", attempt,
 			statusMessage, awsRequestID)
 		log.Debugln(string(responseDump))
-		return "", d.Location, errors.New("Error retrieving upload URI: " + strconv.Itoa(resp.StatusCode))
+		return r, errors.New("Error retrieving upload URI: " + strconv.Itoa(resp.StatusCode))
 	}
 
 	data, err := io.ReadAll(resp.Body)
@@ -388,7 +587,9 @@ func (c httpMetricClient) GetUploadURL(
 	}
 
 	log.Infof("GetURL Retry %d: Successfully acquired s3 url, X-Amzn-Requestid: %s", attempt, awsRequestID)
-	return d.Location, hash, err
+	r.location = d.Location
+	r.hash = hash
+	return r, err
 }
 
 // GetB64MD5Hash returns base64 encoded MD5 Hash
@@ -411,6 +612,27 @@ func GetB64MD5Hash(name string) (b64Hash string, rerr error) {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil)), err
 }
 
+// GetArchiveHashes returns the base64 encoded MD5 hash and the hex encoded sha256 of a file, reading it once
+func GetArchiveHashes(name string) (b64MD5, hexSHA256 string, rerr error) {
+	//nolint gosec
+	f, err := os.Open(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	defer util.SafeClose(f.Close, &rerr)
+
+	//nolint gas
+	m := md5.New()
+	s := sha256.New()
+
+	if _, err := io.Copy(io.MultiWriter(m, s), f); err != nil {
+		return "", "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(m.Sum(nil)), hex.EncodeToString(s.Sum(nil)), nil
+}
+
 // GetUploadURLByRegion returns the correct base url depending on the env variable CLOUDABILITY_UPLOAD_REGION.
 // If value is not supported, default to us-west-2 (original) URL
 func GetUploadURLByRegion(region string) string {
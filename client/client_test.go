@@ -5,11 +5,13 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -182,6 +184,137 @@ func TestSendMetricSample(t *testing.T) {
 
 }
 
+func TestSendMetricSampleContentEncoding(t *testing.T) {
+	f, err := os.Open("testdata/test-cluster-1510159016.tgz")
+	if err != nil {
+		t.Fatal("unable to open testdata: ", err)
+	}
+	defer f.Close()
+
+	send := func(contentEncoding string) http.Header {
+		var header http.Header
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"location":"http://` + r.Host + `/upload"}`))
+				return
+			}
+			header = r.Header
+			if _, err := gzip.NewReader(r.Body); err != nil {
+				t.Errorf("expected the archive to be sent unchanged: %v", err)
+			}
+		}))
+		defer ts.Close()
+
+		c, err := client.NewHTTPMetricClient(client.Configuration{
+			Timeout:         10 * time.Second,
+			Token:           test.SecureRandomAlphaString(20),
+			MaxRetries:      1,
+			BaseURL:         ts.URL + metricsSuffix,
+			ContentEncoding: contentEncoding,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SendMetricSample(f, "0.0.1", "uid"); err != nil {
+			t.Fatal(err)
+		}
+		return header
+	}
+
+	t.Run("Ensure the archive is sent with the content encoding", func(t *testing.T) {
+		header := send(client.EncodingGzip)
+		if header.Get(client.ContentEncodingHeader) != "gzip" || header.Get(client.ContentTypeHeader) != "application/x-tar" {
+			t.Errorf("unexpected upload headers %v", header)
+		}
+	})
+
+	t.Run("Ensure the archive is sent without a content encoding by default", func(t *testing.T) {
+		header := send("")
+		if header.Get(client.ContentEncodingHeader) != "" ||
+			header.Get(client.ContentTypeHeader) != "multipart/form-data" {
+			t.Errorf("unexpected upload headers %v", header)
+		}
+	})
+}
+
+func TestSendMetricSampleCycleID(t *testing.T) {
+	data, err := os.ReadFile("testdata/test-cluster-1510159016.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(name string) string {
+		archive := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(archive, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var cycleID string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				cycleID = r.Header.Get(client.CycleIDHeader)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"location":"http://` + r.Host + `/upload"}`))
+			}
+		}))
+		defer ts.Close()
+		c, err := client.NewHTTPMetricClient(client.Configuration{
+			Timeout:    10 * time.Second,
+			Token:      test.SecureRandomAlphaString(20),
+			MaxRetries: 1,
+			BaseURL:    ts.URL + metricsSuffix,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SendMetricSample(f, "0.0.1", "uid"); err != nil {
+			t.Fatal(err)
+		}
+		return cycleID
+	}
+
+	if id := send("uid_20240102030405_01ARYZ6S41TSV4RRFFQ69G5FAV.tgz"); id != "01ARYZ6S41TSV4RRFFQ69G5FAV" {
+		t.Errorf("expected the cycle ID of the archive to be sent, got %q", id)
+	}
+	if id := send("uid_20240102030405.tgz"); id != "" {
+		t.Errorf("expected no cycle ID for an archive without one, got %q", id)
+	}
+}
+
+func TestNegotiateContentEncoding(t *testing.T) {
+	advertised := client.UploadLimits{SupportedEncodings: []string{"zstd", "gzip"}}
+	zstdOnly := client.UploadLimits{SupportedEncodings: []string{"zstd"}}
+
+	tests := []struct {
+		name       string
+		preference string
+		limits     client.UploadLimits
+		expected   string
+	}{
+		{name: "auto negotiates a shared encoding", preference: client.EncodingAuto, limits: advertised,
+			expected: client.EncodingGzip},
+		{name: "unset preference negotiates", preference: "", limits: advertised, expected: client.EncodingGzip},
+		{name: "auto without negotiation data", preference: client.EncodingAuto},
+		{name: "auto without a shared encoding", preference: client.EncodingAuto, limits: zstdOnly},
+		{name: "disabled", preference: client.EncodingNone, limits: advertised},
+		{name: "configured without negotiation data", preference: "GZIP", expected: client.EncodingGzip},
+		{name: "configured but not supported by the endpoint", preference: client.EncodingGzip, limits: zstdOnly},
+		{name: "configured but not supported by the agent", preference: client.EncodingZstd, limits: advertised},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			encoding, reason := client.NegotiateContentEncoding(tc.preference, tc.limits)
+			if encoding != tc.expected || reason == "" {
+				t.Errorf("expected encoding %q, got %q (%s)", tc.expected, encoding, reason)
+			}
+		})
+	}
+}
+
 // nolint: gocyclo
 func TestSendMetricSample_ErrorState(t *testing.T) {
 	testAgentVersion := "0.0.1"
@@ -517,6 +650,89 @@ func TestGetUploadURL(t *testing.T) {
 	}
 }
 
+func TestHandshake(t *testing.T) {
+	token := test.SecureRandomAlphaString(20)
+
+	f, err := os.Open("testdata/random-test-data.txt")
+	if err != nil {
+		t.Error("unable to open testdata: ", err)
+	}
+
+	newClient := func(url string) client.MetricClient {
+		c, err := client.NewHTTPMetricClient(client.Configuration{
+			Timeout:    10 * time.Second,
+			Token:      token,
+			MaxRetries: 2,
+			BaseURL:    url,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	t.Run("Ensure advertised limits are returned", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(client.ProtocolVersionHeader) != client.ProtocolVersion {
+				t.Error("Expected protocol version to be set on request")
+			}
+			w.Header().Set(client.ProtocolVersionHeader, client.ProtocolVersion)
+			w.Header().Set(client.MaxPayloadSizeHeader, "1048576")
+			w.Header().Set(client.SupportedEncodingsHeader, "gzip, ZSTD")
+			w.Header().Set(client.CapabilitiesHeader, "Unchanged-Node-Data")
+			w.Header().Set(client.FileClassesHeader, "node-probes, Node-Resource")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"location":"http://tj"}`))
+		}))
+		defer ts.Close()
+
+		limits, err := newClient(ts.URL).Handshake(f, "0.0.1", "uid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limits.MaxPayloadBytes != 1048576 || !limits.SupportsEncoding("zstd") || limits.SupportsEncoding("br") {
+			t.Errorf("unexpected upload limits %+v", limits)
+		}
+		if !limits.Allows(1048576) || limits.Allows(1048577) {
+			t.Error("expected payload size to be checked against the advertised limit")
+		}
+		if !limits.SupportsCapability(client.CapabilityUnchangedNodeData) {
+			t.Errorf("expected advertised capabilities to be returned, got %v", limits.Capabilities)
+		}
+		if strings.Join(limits.FileClasses, ",") != "node-probes,node-resource" {
+			t.Errorf("expected advertised file classes to be returned, got %v", limits.FileClasses)
+		}
+	})
+
+	t.Run("Ensure missing limits allow any payload", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"location":"http://tj"}`))
+		}))
+		defer ts.Close()
+
+		limits, err := newClient(ts.URL).Handshake(f, "0.0.1", "uid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limits.MaxPayloadBytes != 0 || !limits.Allows(1<<40) ||
+			limits.SupportsCapability(client.CapabilityUnchangedNodeData) || len(limits.FileClasses) != 0 {
+			t.Errorf("unexpected upload limits %+v", limits)
+		}
+	})
+
+	t.Run("Ensure auth failures return ErrUnauthorized", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer ts.Close()
+
+		_, err := newClient(ts.URL).Handshake(f, "0.0.1", "uid")
+		if !errors.Is(err, client.ErrUnauthorized) {
+			t.Errorf("expected ErrUnauthorized, got %v", err)
+		}
+	})
+}
+
 func Test_getB64MD5Hash(t *testing.T) {
 	f, err := os.Open("testdata/random-test-data.txt")
 	if err != nil {
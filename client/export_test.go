@@ -7,5 +7,12 @@ var AgentVersionHeader = agentVersionHeader
 var ContentTypeHeader = contentTypeHeader
 var UploadFileHash = uploadFileHash
 var ContentMD5 = contentMD5
+var ProtocolVersionHeader = protocolVersionHeader
+var MaxPayloadSizeHeader = maxPayloadSizeHeader
+var SupportedEncodingsHeader = supportedEncodingsHeader
+var CapabilitiesHeader = capabilitiesHeader
+var FileClassesHeader = fileClassesHeader
+var ContentEncodingHeader = contentEncodingHeader
+var CycleIDHeader = cycleIDHeader
 
 var ToJSONLines = toJSONLines
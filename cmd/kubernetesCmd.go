@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"github.com/cloudability/metrics-agent/client"
 	"github.com/cloudability/metrics-agent/kubernetes"
 	"github.com/cloudability/metrics-agent/util"
 
@@ -21,6 +22,8 @@ var (
 			return util.CheckRequiredSettings(requiredArgs)
 		},
 		Run: func(cmd *cobra.Command, args []string) {
+			// settings set by flag or env var take precedence over the endpoint config file
+			config.SettingOverridden = viper.IsSet
 			kubernetes.CollectKubeMetrics(config)
 		},
 	}
@@ -95,6 +98,13 @@ func init() {
 		false,
 		"When true, disables direct node connection and forces proxy use.",
 	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.ForceDirect,
+		"force_direct",
+		false,
+		"When true, disables proxy node connection and forces direct connection, failing rather than falling "+
+			"back to proxy.",
+	)
 	kubernetesCmd.PersistentFlags().StringVar(
 		&config.Namespace,
 		"namespace",
@@ -150,6 +160,587 @@ func init() {
 		"",
 		"The AWS region that the custom s3 bucket is in",
 	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.DiagnosticLogLines,
+		"diagnostic_log_lines",
+		0,
+		"Number of recent agent log lines to include in each metric sample. Default 0 (disabled)",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.ExtraKubeletEndpoints,
+		"extra_kubelet_endpoints",
+		"",
+		"JSON list of additional kubelet endpoints to collect from each node, "+
+			`eg: [{"name":"healthz","path":"/healthz","method":"GET"}] - Optional`,
+	)
+	kubernetesCmd.PersistentFlags().Int64Var(
+		&config.ExtraEndpointMaxBytes,
+		"extra_kubelet_endpoints_max_bytes",
+		kubernetes.DefaultExtraEndpointMaxBytes,
+		"Maximum combined size (in bytes) of extra kubelet endpoint responses collected from each node per poll",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.DisableEndpointsAnnotation,
+		"disable_endpoints_annotation",
+		kubernetes.DefaultDisableEndpointsAnnotation,
+		"Node annotation listing the endpoints not collected from the node, eg: container,probes. Empty "+
+			"ignores the annotation",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.ProbeNodeMinAge,
+		"probe_node_min_age",
+		kubernetes.DefaultProbeNodeMinAge,
+		"Minimum age (in seconds) of a node before it is preferred for startup endpoint probes",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.PollOverrunThreshold,
+		"poll_overrun_threshold",
+		kubernetes.DefaultPollOverrunThreshold,
+		"Number of consecutive polls exceeding the poll interval before collection is degraded one level. "+
+			"0 disables degradation",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.PollRecoveryThreshold,
+		"poll_recovery_threshold",
+		kubernetes.DefaultPollRecoveryThreshold,
+		"Number of consecutive polls within the poll interval before one level of degradation is reversed",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.FailedNodeLogLimit,
+		"failed_node_log_limit",
+		kubernetes.DefaultFailedNodeLogLimit,
+		"Number of failed nodes logged with their full error each poll, the rest are aggregated by error",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.FailedNodeReportLimit,
+		"failed_node_report_limit",
+		kubernetes.DefaultFailedNodeReportLimit,
+		"Number of failed nodes reported with their full error in each sample, the rest are aggregated by error",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.MaxOpenFiles,
+		"max_open_files",
+		kubernetes.DefaultMaxOpenFiles,
+		"Maximum number of node metric files open at once, independent of the number of concurrent node pollers",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.BackfillMaxIntervals,
+		"backfill_max_intervals",
+		kubernetes.DefaultBackfillMaxIntervals,
+		"Maximum number of missed polls to backfill from kubelet container stats history, 0 disables backfill",
+	)
+	kubernetesCmd.PersistentFlags().Float64Var(
+		&config.NodeSizeSpikeFactor,
+		"node_size_spike_factor",
+		kubernetes.DefaultNodeSizeSpikeFactor,
+		"Factor by which a node's data for an endpoint must exceed its trailing average to be reported as a size "+
+			"spike, 0 disables size spike detection",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.LateNodeBudget,
+		"late_node_budget",
+		kubernetes.DefaultLateNodeBudget,
+		"Time (in seconds) each poll may spend collecting nodes that joined the cluster during the poll, "+
+			"0 disables late node collection",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.UploadContentEncoding,
+		"upload_content_encoding",
+		client.EncodingAuto,
+		"Content encoding of uploaded metric samples: auto to negotiate with the upload endpoint, none, or gzip",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.MigrationUploadURL,
+		"migration_upload_url",
+		"",
+		"HTTPS upload endpoint metric samples are also uploaded to during a backend migration, until the "+
+			"migration end date. Empty uploads only to the upload region",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.MigrationAPIKey,
+		"migration_api_key",
+		"",
+		"API key of the migration upload endpoint",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.MigrationEndDate,
+		"migration_end_date",
+		"",
+		"Date (YYYY-MM-DD, UTC) or RFC 3339 time metric samples are no longer uploaded to the migration upload "+
+			"endpoint from",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.MigrationAuthoritative,
+		"migration_authoritative_destination",
+		kubernetes.PrimaryDestination,
+		"Upload destination whose failures fail the agent during a migration: primary or secondary",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.DebugCaptureFile,
+		"debug_capture_file",
+		"",
+		"File listing the nodes, separated by commas or newlines, whose raw and collected data is retained by "+
+			"the next collection for debugging. Read before each collection",
+	)
+	kubernetesCmd.PersistentFlags().Int64Var(
+		&config.DebugCaptureMaxBytes,
+		"debug_capture_max_bytes",
+		kubernetes.DefaultDebugCaptureMaxBytes,
+		"Cap on the size of the data retained by debug captures",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.DebugCaptureRetention,
+		"debug_capture_retention",
+		kubernetes.DefaultDebugCaptureRetention,
+		"Time (in seconds) the data of a debug capture is retained",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.StrictPermissions,
+		"strict_permissions",
+		false,
+		"When true, the agent fails to start if it is not permitted to collect every resource",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.StatsRelaySelector,
+		"stats_relay_selector",
+		"",
+		"Label selector of stats relay pods serving the kubelet endpoints of their node, used via the pod proxy "+
+			"when nodes are not reachable otherwise",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.StatsRelayNamespace,
+		"stats_relay_namespace",
+		"",
+		"Namespace of the stats relay pods, defaults to the agent namespace",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.StatsRelayPort,
+		"stats_relay_port",
+		kubernetes.DefaultStatsRelayPort,
+		"Port of the stats relay pods, 0 uses the default port of the pod proxy",
+	)
+	kubernetesCmd.PersistentFlags().Int64Var(
+		&config.MaxSampleBytes,
+		"max_sample_bytes",
+		kubernetes.DefaultMaxSampleBytes,
+		"Maximum total size (in bytes) of a sample, data is shed as it is approached and the sample is "+
+			"discarded if it is exceeded. 0 disables the cap",
+	)
+	kubernetesCmd.PersistentFlags().Float64Var(
+		&config.NodeFetchPacing,
+		"node_fetch_pacing",
+		kubernetes.DefaultNodeFetchPacing,
+		"Fraction of the poll interval node fetches are spread evenly across, at most 0.8. 0 fetches nodes as "+
+			"fast as possible",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.BearerTokenFile,
+		"bearer_token_file",
+		"",
+		"File holding the bearer token used instead of the token of the cluster config, re-read when it is rotated",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.BearerToken,
+		"bearer_token",
+		"",
+		"Bearer token used instead of the token of the cluster config",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.TokenFileTTL,
+		"token_file_ttl",
+		kubernetes.DefaultTokenFileTTL,
+		"Time (in seconds) a token read from a file is used before the file is read again. 0 reads it again "+
+			"only when it is modified or the token is rejected",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.ProxyCredentials.TokenFile,
+		"proxy_token_file",
+		"",
+		"File holding the bearer token used via the API server proxy, replacing the cluster credentials",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.ProxyCredentials.Token,
+		"proxy_token",
+		"",
+		"Bearer token used via the API server proxy, replacing the cluster credentials",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.ProxyCredentials.CertFile,
+		"proxy_cert_file",
+		"",
+		"Client certificate presented via the API server proxy, replacing the cluster credentials",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.ProxyCredentials.KeyFile,
+		"proxy_key_file",
+		"",
+		"Key of the client certificate presented via the API server proxy",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.DirectCredentials.TokenFile,
+		"direct_token_file",
+		"",
+		"File holding the bearer token used to connect directly to the kubelets, replacing the cluster credentials",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.DirectCredentials.Token,
+		"direct_token",
+		"",
+		"Bearer token used to connect directly to the kubelets, replacing the cluster credentials",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.DirectCredentials.CertFile,
+		"direct_cert_file",
+		"",
+		"Client certificate presented to the kubelets when connecting directly, replacing the cluster credentials",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.DirectCredentials.KeyFile,
+		"direct_key_file",
+		"",
+		"Key of the client certificate presented to the kubelets when connecting directly",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.ResponseStallTimeout,
+		"response_stall_timeout",
+		kubernetes.DefaultResponseStallTimeout,
+		"Time (in seconds) a kubelet response may receive no bytes mid-body before it is abandoned and the "+
+			"node is collected via the next connection. 0 disables stall detection",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.NodeNameAllowlist,
+		"node_name_allowlist",
+		"",
+		"Comma separated node names or glob patterns, eg: canary-*, restricting collection to the matching "+
+			"nodes. Samples are marked as partial collections. Empty collects every node",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.NodeLabelSelector,
+		"node_label_selector",
+		"",
+		"Label selector, eg: team=payments, restricting collection to the matching nodes. Empty collects "+
+			"every node",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.IncludeNotReadyGracePeriod,
+		"include_not_ready_grace_period",
+		0,
+		"Time (in seconds) nodes are still collected after becoming NotReady, 0 only collects ready nodes",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.MaxNodesPerCycle,
+		"max_nodes_per_cycle",
+		0,
+		"Maximum number of nodes collected each collection, the other nodes are collected in turn by later "+
+			"collections. 0 collects every node",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.NodeSource,
+		"node_source",
+		"list",
+		"Source the ready nodes are served from each collection: list (from the API server) or informer (from "+
+			"the cache of a node informer)",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.NodeWatchOutageThreshold,
+		"node_watch_outage_threshold",
+		kubernetes.DefaultNodeWatchOutageThreshold,
+		"Time (in seconds) the watch of the node informer may be broken before the nodes are listed from the "+
+			"API server rather than served from its cache",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.NodeListPageSize,
+		"node_list_page_size",
+		kubernetes.DefaultNodeListPageSize,
+		"Number of nodes listed by each request to the API server, 0 lists every node with a single request",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.MaxHeartbeatAge,
+		"max_heartbeat_age",
+		0,
+		"Time (in seconds) after which ready nodes whose last heartbeat is older are not collected, 0 collects "+
+			"ready nodes regardless of their heartbeat",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.SkipUnschedulableNodes,
+		"skip_unschedulable_nodes",
+		false,
+		"When true, does not collect nodes that are cordoned (unschedulable), eg: while they are drained. "+
+			"Default: False",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.NodeAddressTypes,
+		"node_address_types",
+		"",
+		"Comma separated order the address types of a node are tried in to connect to its kubelet directly, eg: "+
+			"ExternalIP,InternalIP,Hostname. Empty uses InternalIP,Hostname,ExternalIP",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.KubeletPortOverride,
+		"kubelet_port_override",
+		0,
+		"Port to connect to every kubelet on directly, in place of the port each node reports. 0 uses the "+
+			"reported port, or 10250 if a node reports none",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.AcceptedFileClasses,
+		"accepted_file_classes",
+		"",
+		"Comma separated sample file classes, eg: node-probes, the upload endpoint accepts beyond the core "+
+			"classes, replacing those it advertises. * accepts every class. Empty uses those advertised",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.NodeFetchTimeout,
+		"node_fetch_timeout",
+		kubernetes.DefaultNodeFetchTimeout,
+		"Time (in seconds) allowed to fetch every endpoint of a node, via any connection and including "+
+			"retries, before the node is reported as failed. 0 disables the timeout",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.LoadEstimateChangePercent,
+		"load_estimate_change_percent",
+		kubernetes.DefaultLoadEstimateChangePercent,
+		"Change (in percent) in the number of nodes after which the requests and bytes of each poll are "+
+			"estimated and logged again. 0 only estimates them at startup",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.CollectionProfile,
+		"collection_profile",
+		"full",
+		"Granularity of the node data collected, full or namespace. The namespace profile rolls pod stats up to "+
+			"namespace totals within the agent and exports no pod or container level detail",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.RetrieveProbeMetrics,
+		"retrieve_probe_metrics",
+		false,
+		"When true, the liveness and readiness probe metrics of each kubelet are collected with each sample",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.SmallCluster,
+		"small_cluster",
+		false,
+		"When true, every request to the API server shares a conservative rate limit suited to single node "+
+			"control planes. Default: False",
+	)
+	kubernetesCmd.PersistentFlags().Float64Var(
+		&config.APIServerQPS,
+		"api_server_qps",
+		kubernetes.DefaultAPIServerQPS,
+		"Requests per second shared by every request to the API server, replacing that of the small cluster "+
+			"profile. 0 leaves requests unlimited outside the small cluster profile",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.APIServerBurst,
+		"api_server_burst",
+		0,
+		"Requests to the API server allowed above the rate limit, replacing that of the small cluster profile. "+
+			"0 uses the default",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.APIServerJSON,
+		"api_server_json",
+		false,
+		"Request JSON rather than protobuf from the API server, for clusters and proxies that mishandle protobuf",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.RetrieveKubeletPods,
+		"retrieve_kubelet_pods",
+		false,
+		"When true, the pods bound to each node as seen by its kubelet are collected with each sample",
+	)
+	kubernetesCmd.PersistentFlags().Int64Var(
+		&config.KubeletPodsMaxBytes,
+		"kubelet_pods_max_bytes",
+		kubernetes.DefaultKubeletPodsMaxBytes,
+		"Maximum size (in bytes) of the kubelet pods collected from each node per poll",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.RetrieveNodeSpec,
+		"retrieve_node_spec",
+		false,
+		"When true, the machine spec of each node is collected from its kubelet",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.NodeSpecInterval,
+		"node_spec_interval",
+		kubernetes.DefaultNodeSpecInterval,
+		"Number of polls between collections of the node machine specs, they are always collected on the first poll",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.RetrieveKubeletConfigz,
+		"retrieve_kubelet_configz",
+		false,
+		"When true, the running configuration of each kubelet is collected with each sample",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.RetrieveKubeletMetrics,
+		"retrieve_kubelet_metrics",
+		false,
+		"When true, the runtime metrics of each kubelet, such as PLEG latency and evictions, are collected with "+
+			"each sample",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.CadvisorLabelAllowlist,
+		"cadvisor_label_allowlist",
+		"",
+		"Comma separated labels kept on the cadvisor metrics collected by extra kubelet endpoints, all are kept "+
+			"when unset",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.CadvisorLabelDenylist,
+		"cadvisor_label_denylist",
+		"",
+		"Comma separated labels dropped from the cadvisor metrics collected by extra kubelet endpoints",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.CadvisorMaxSeriesPerFamily,
+		"cadvisor_max_series_per_family",
+		0,
+		"Maximum number of series of each cadvisor metric family collected from a node, 0 disables the limit",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.Dev,
+		"dev",
+		false,
+		"When true, runs for development against a local cluster such as kind or minikube: samples are kept "+
+			"locally rather than uploaded, polls are more frequent and logging is verbose. Refuses to run with "+
+			"an API key configured",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.NodeIdleConnTimeout,
+		"node_idle_conn_timeout",
+		0,
+		"Time in seconds idle direct kubelet connections are kept open, 0 keeps them until after the next poll",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.ReprobeInterval,
+		"reprobe_interval",
+		kubernetes.DefaultReprobeInterval,
+		"Interval in minutes between probes of the kubelet endpoints, 0 only probes them at startup",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.EndpointConfigFile,
+		"endpoint_config_file",
+		"",
+		"YAML file of per endpoint collection settings, overridden by the flags and env vars of the same settings",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.WarmUp,
+		"warm_up",
+		false,
+		"When true, the first collection establishes the node baselines and its sample is not uploaded",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.SampleIntervalLock,
+		"sample_interval_lock",
+		true,
+		"When true, a lock in the scratch directory ensures only one agent instance samples each upload interval",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.KubeletTLSVerify,
+		"kubelet_tls_verify",
+		false,
+		"When true, direct kubelet connections verify the kubelet serving certificates, falling back to proxy",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.KubeletCAFile,
+		"kubelet_ca_file",
+		"",
+		"CA bundle kubelet serving certificates are verified against, defaults to the in-cluster CA bundle",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.KubeletTLSRenegotiation,
+		"kubelet_tls_renegotiation",
+		"",
+		"TLS renegotiation policy of direct kubelet connections: never, once or freely. Empty never renegotiates",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.KubeletTLSMaxVersion,
+		"kubelet_tls_max_version",
+		"",
+		"Highest TLS version offered to the kubelets on direct connections: 1.2 or 1.3. Empty offers TLS 1.3",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.KubeletTLSCurves,
+		"kubelet_tls_curves",
+		"",
+		"Comma separated curves offered to the kubelets on direct connections in order, of X25519, P256, P384 "+
+			"and P521. Empty offers the default curves",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.ImageRewrite,
+		"image_rewrite",
+		"",
+		"How image references of collected resources are rewritten: strip_registry, repository_tag or "+
+			"hash_registry, empty keeps them as they are",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.ImageKeepDigests,
+		"image_keep_digests",
+		true,
+		"When true, the digests of rewritten image references are kept",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.TagSelf,
+		"tag_self",
+		false,
+		"When true, the agent's own pod and namespace are annotated in exported resources so downstream can "+
+			"exclude their usage",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.PodName,
+		"pod_name",
+		"",
+		"Name of the agent's own pod, set from the downward API",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.PodNamespace,
+		"pod_namespace",
+		"",
+		"Namespace of the agent's own pod, set from the downward API. Defaults to the agent namespace",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.PostCollectionHook,
+		"post_collection_hook",
+		"",
+		"Command run on each sample directory, passed as its argument, before the sample is archived. It "+
+			"must exit 0 within the hook timeout. Empty runs no hook",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.PostCollectionHookTimeout,
+		"post_collection_hook_timeout",
+		kubernetes.DefaultPostCollectionHookTimeout,
+		"Time (in seconds) the post collection hook may run, it is also stopped at the end of the poll interval",
+	)
+	kubernetesCmd.PersistentFlags().BoolVar(
+		&config.PostCollectionHookFatal,
+		"post_collection_hook_fatal",
+		false,
+		"When true, a sample is discarded if the post collection hook fails, otherwise it is kept as the hook "+
+			"left it",
+	)
+	kubernetesCmd.PersistentFlags().IntVar(
+		&config.MissedIntervalThreshold,
+		"missed_interval_threshold",
+		kubernetes.DefaultMissedIntervalThreshold,
+		"Number of consecutive poll intervals without a sample after which the agent reports itself not ready. "+
+			"0 never does",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.VirtualKubeletNodes,
+		"virtual_kubelet_nodes",
+		kubernetes.DefaultVirtualKubeletNodes,
+		"How nodes registered by a virtual kubelet are collected: skip leaves them out, proxy collects them via "+
+			"the API server proxy only and collect treats them like any other node",
+	)
+	kubernetesCmd.PersistentFlags().StringVar(
+		&config.MinKubernetesVersion,
+		"min_kubernetes_version",
+		kubernetes.DefaultMinKubernetesVersion,
+		"Recommended minimum Kubernetes version, as major.minor. Older clusters are collected with a warning "+
+			"and without the features they do not support",
+	)
 
 	//nolint gas
 	_ = viper.BindPFlag("api_key", kubernetesCmd.PersistentFlags().Lookup("api_key"))
@@ -166,6 +757,7 @@ func init() {
 	_ = viper.BindPFlag("retrieve_node_summaries", kubernetesCmd.PersistentFlags().Lookup("retrieve_node_summaries"))
 	_ = viper.BindPFlag("get_all_container_stats", kubernetesCmd.PersistentFlags().Lookup("get_all_container_stats"))
 	_ = viper.BindPFlag("force_kube_proxy", kubernetesCmd.PersistentFlags().Lookup("force_kube_proxy"))
+	_ = viper.BindPFlag("force_direct", kubernetesCmd.PersistentFlags().Lookup("force_direct"))
 	_ = viper.BindPFlag("namespace", kubernetesCmd.PersistentFlags().Lookup("namespace"))
 	_ = viper.BindPFlag("collect_heapster_export", kubernetesCmd.PersistentFlags().Lookup("collect_heapster_export"))
 	_ = viper.BindPFlag("scratch_dir", kubernetesCmd.PersistentFlags().Lookup("scratch_dir"))
@@ -177,32 +769,229 @@ func init() {
 	_ = viper.BindPFlag("upload_region", kubernetesCmd.PersistentFlags().Lookup("upload_region"))
 	_ = viper.BindPFlag("custom_s3_bucket", kubernetesCmd.PersistentFlags().Lookup("custom_s3_bucket"))
 	_ = viper.BindPFlag("custom_s3_region", kubernetesCmd.PersistentFlags().Lookup("custom_s3_region"))
+	_ = viper.BindPFlag("diagnostic_log_lines", kubernetesCmd.PersistentFlags().Lookup("diagnostic_log_lines"))
+	_ = viper.BindPFlag("extra_kubelet_endpoints", kubernetesCmd.PersistentFlags().Lookup("extra_kubelet_endpoints"))
+	_ = viper.BindPFlag("disable_endpoints_annotation",
+		kubernetesCmd.PersistentFlags().Lookup("disable_endpoints_annotation"))
+	_ = viper.BindPFlag("extra_kubelet_endpoints_max_bytes",
+		kubernetesCmd.PersistentFlags().Lookup("extra_kubelet_endpoints_max_bytes"))
+	_ = viper.BindPFlag("probe_node_min_age", kubernetesCmd.PersistentFlags().Lookup("probe_node_min_age"))
+	_ = viper.BindPFlag("poll_overrun_threshold", kubernetesCmd.PersistentFlags().Lookup("poll_overrun_threshold"))
+	_ = viper.BindPFlag("poll_recovery_threshold", kubernetesCmd.PersistentFlags().Lookup("poll_recovery_threshold"))
+	_ = viper.BindPFlag("failed_node_log_limit", kubernetesCmd.PersistentFlags().Lookup("failed_node_log_limit"))
+	_ = viper.BindPFlag("failed_node_report_limit", kubernetesCmd.PersistentFlags().Lookup("failed_node_report_limit"))
+	_ = viper.BindPFlag("max_open_files", kubernetesCmd.PersistentFlags().Lookup("max_open_files"))
+	_ = viper.BindPFlag("backfill_max_intervals", kubernetesCmd.PersistentFlags().Lookup("backfill_max_intervals"))
+	_ = viper.BindPFlag("node_size_spike_factor", kubernetesCmd.PersistentFlags().Lookup("node_size_spike_factor"))
+	_ = viper.BindPFlag("late_node_budget", kubernetesCmd.PersistentFlags().Lookup("late_node_budget"))
+	_ = viper.BindPFlag("upload_content_encoding", kubernetesCmd.PersistentFlags().Lookup("upload_content_encoding"))
+	_ = viper.BindPFlag("migration_upload_url", kubernetesCmd.PersistentFlags().Lookup("migration_upload_url"))
+	_ = viper.BindPFlag("migration_api_key", kubernetesCmd.PersistentFlags().Lookup("migration_api_key"))
+	_ = viper.BindPFlag("migration_end_date", kubernetesCmd.PersistentFlags().Lookup("migration_end_date"))
+	_ = viper.BindPFlag("migration_authoritative_destination",
+		kubernetesCmd.PersistentFlags().Lookup("migration_authoritative_destination"))
+	_ = viper.BindPFlag("debug_capture_file", kubernetesCmd.PersistentFlags().Lookup("debug_capture_file"))
+	_ = viper.BindPFlag("debug_capture_max_bytes", kubernetesCmd.PersistentFlags().Lookup("debug_capture_max_bytes"))
+	_ = viper.BindPFlag("debug_capture_retention", kubernetesCmd.PersistentFlags().Lookup("debug_capture_retention"))
+	_ = viper.BindPFlag("strict_permissions", kubernetesCmd.PersistentFlags().Lookup("strict_permissions"))
+	_ = viper.BindPFlag("stats_relay_selector", kubernetesCmd.PersistentFlags().Lookup("stats_relay_selector"))
+	_ = viper.BindPFlag("stats_relay_namespace", kubernetesCmd.PersistentFlags().Lookup("stats_relay_namespace"))
+	_ = viper.BindPFlag("stats_relay_port", kubernetesCmd.PersistentFlags().Lookup("stats_relay_port"))
+	_ = viper.BindPFlag("max_sample_bytes", kubernetesCmd.PersistentFlags().Lookup("max_sample_bytes"))
+	_ = viper.BindPFlag("node_fetch_pacing", kubernetesCmd.PersistentFlags().Lookup("node_fetch_pacing"))
+	_ = viper.BindPFlag("bearer_token_file", kubernetesCmd.PersistentFlags().Lookup("bearer_token_file"))
+	_ = viper.BindPFlag("bearer_token", kubernetesCmd.PersistentFlags().Lookup("bearer_token"))
+	_ = viper.BindPFlag("token_file_ttl", kubernetesCmd.PersistentFlags().Lookup("token_file_ttl"))
+	_ = viper.BindPFlag("proxy_token_file", kubernetesCmd.PersistentFlags().Lookup("proxy_token_file"))
+	_ = viper.BindPFlag("proxy_token", kubernetesCmd.PersistentFlags().Lookup("proxy_token"))
+	_ = viper.BindPFlag("proxy_cert_file", kubernetesCmd.PersistentFlags().Lookup("proxy_cert_file"))
+	_ = viper.BindPFlag("proxy_key_file", kubernetesCmd.PersistentFlags().Lookup("proxy_key_file"))
+	_ = viper.BindPFlag("direct_token_file", kubernetesCmd.PersistentFlags().Lookup("direct_token_file"))
+	_ = viper.BindPFlag("direct_token", kubernetesCmd.PersistentFlags().Lookup("direct_token"))
+	_ = viper.BindPFlag("direct_cert_file", kubernetesCmd.PersistentFlags().Lookup("direct_cert_file"))
+	_ = viper.BindPFlag("direct_key_file", kubernetesCmd.PersistentFlags().Lookup("direct_key_file"))
+	_ = viper.BindPFlag("response_stall_timeout", kubernetesCmd.PersistentFlags().Lookup("response_stall_timeout"))
+	_ = viper.BindPFlag("node_name_allowlist", kubernetesCmd.PersistentFlags().Lookup("node_name_allowlist"))
+	_ = viper.BindPFlag("node_label_selector", kubernetesCmd.PersistentFlags().Lookup("node_label_selector"))
+	_ = viper.BindPFlag("include_not_ready_grace_period",
+		kubernetesCmd.PersistentFlags().Lookup("include_not_ready_grace_period"))
+	_ = viper.BindPFlag("max_heartbeat_age", kubernetesCmd.PersistentFlags().Lookup("max_heartbeat_age"))
+	_ = viper.BindPFlag("node_source", kubernetesCmd.PersistentFlags().Lookup("node_source"))
+	_ = viper.BindPFlag("node_watch_outage_threshold",
+		kubernetesCmd.PersistentFlags().Lookup("node_watch_outage_threshold"))
+	_ = viper.BindPFlag("node_list_page_size", kubernetesCmd.PersistentFlags().Lookup("node_list_page_size"))
+	_ = viper.BindPFlag("max_nodes_per_cycle", kubernetesCmd.PersistentFlags().Lookup("max_nodes_per_cycle"))
+	_ = viper.BindPFlag("skip_unschedulable_nodes",
+		kubernetesCmd.PersistentFlags().Lookup("skip_unschedulable_nodes"))
+	_ = viper.BindPFlag("node_address_types", kubernetesCmd.PersistentFlags().Lookup("node_address_types"))
+	_ = viper.BindPFlag("kubelet_port_override", kubernetesCmd.PersistentFlags().Lookup("kubelet_port_override"))
+	_ = viper.BindPFlag("accepted_file_classes", kubernetesCmd.PersistentFlags().Lookup("accepted_file_classes"))
+	_ = viper.BindPFlag("node_fetch_timeout", kubernetesCmd.PersistentFlags().Lookup("node_fetch_timeout"))
+	_ = viper.BindPFlag("load_estimate_change_percent",
+		kubernetesCmd.PersistentFlags().Lookup("load_estimate_change_percent"))
+	_ = viper.BindPFlag("collection_profile", kubernetesCmd.PersistentFlags().Lookup("collection_profile"))
+	_ = viper.BindPFlag("retrieve_probe_metrics", kubernetesCmd.PersistentFlags().Lookup("retrieve_probe_metrics"))
+	_ = viper.BindPFlag("small_cluster", kubernetesCmd.PersistentFlags().Lookup("small_cluster"))
+	_ = viper.BindPFlag("api_server_qps", kubernetesCmd.PersistentFlags().Lookup("api_server_qps"))
+	_ = viper.BindPFlag("api_server_burst", kubernetesCmd.PersistentFlags().Lookup("api_server_burst"))
+	_ = viper.BindPFlag("api_server_json", kubernetesCmd.PersistentFlags().Lookup("api_server_json"))
+	_ = viper.BindPFlag("retrieve_kubelet_pods", kubernetesCmd.PersistentFlags().Lookup("retrieve_kubelet_pods"))
+	_ = viper.BindPFlag("kubelet_pods_max_bytes", kubernetesCmd.PersistentFlags().Lookup("kubelet_pods_max_bytes"))
+	_ = viper.BindPFlag("retrieve_node_spec", kubernetesCmd.PersistentFlags().Lookup("retrieve_node_spec"))
+	_ = viper.BindPFlag("node_spec_interval", kubernetesCmd.PersistentFlags().Lookup("node_spec_interval"))
+	_ = viper.BindPFlag("retrieve_kubelet_configz", kubernetesCmd.PersistentFlags().Lookup("retrieve_kubelet_configz"))
+	_ = viper.BindPFlag("retrieve_kubelet_metrics", kubernetesCmd.PersistentFlags().Lookup("retrieve_kubelet_metrics"))
+	_ = viper.BindPFlag("cadvisor_label_allowlist", kubernetesCmd.PersistentFlags().Lookup("cadvisor_label_allowlist"))
+	_ = viper.BindPFlag("cadvisor_label_denylist", kubernetesCmd.PersistentFlags().Lookup("cadvisor_label_denylist"))
+	_ = viper.BindPFlag("cadvisor_max_series_per_family",
+		kubernetesCmd.PersistentFlags().Lookup("cadvisor_max_series_per_family"))
+	_ = viper.BindPFlag("dev", kubernetesCmd.PersistentFlags().Lookup("dev"))
+	_ = viper.BindPFlag("node_idle_conn_timeout", kubernetesCmd.PersistentFlags().Lookup("node_idle_conn_timeout"))
+	_ = viper.BindPFlag("reprobe_interval", kubernetesCmd.PersistentFlags().Lookup("reprobe_interval"))
+	_ = viper.BindPFlag("endpoint_config_file", kubernetesCmd.PersistentFlags().Lookup("endpoint_config_file"))
+	_ = viper.BindPFlag("warm_up", kubernetesCmd.PersistentFlags().Lookup("warm_up"))
+	_ = viper.BindPFlag("sample_interval_lock", kubernetesCmd.PersistentFlags().Lookup("sample_interval_lock"))
+	_ = viper.BindPFlag("kubelet_tls_verify", kubernetesCmd.PersistentFlags().Lookup("kubelet_tls_verify"))
+	_ = viper.BindPFlag("kubelet_ca_file", kubernetesCmd.PersistentFlags().Lookup("kubelet_ca_file"))
+	_ = viper.BindPFlag("kubelet_tls_renegotiation",
+		kubernetesCmd.PersistentFlags().Lookup("kubelet_tls_renegotiation"))
+	_ = viper.BindPFlag("kubelet_tls_max_version", kubernetesCmd.PersistentFlags().Lookup("kubelet_tls_max_version"))
+	_ = viper.BindPFlag("kubelet_tls_curves", kubernetesCmd.PersistentFlags().Lookup("kubelet_tls_curves"))
+	_ = viper.BindPFlag("image_rewrite", kubernetesCmd.PersistentFlags().Lookup("image_rewrite"))
+	_ = viper.BindPFlag("image_keep_digests", kubernetesCmd.PersistentFlags().Lookup("image_keep_digests"))
+	_ = viper.BindPFlag("tag_self", kubernetesCmd.PersistentFlags().Lookup("tag_self"))
+	_ = viper.BindPFlag("pod_name", kubernetesCmd.PersistentFlags().Lookup("pod_name"))
+	_ = viper.BindPFlag("pod_namespace", kubernetesCmd.PersistentFlags().Lookup("pod_namespace"))
+	_ = viper.BindPFlag("post_collection_hook", kubernetesCmd.PersistentFlags().Lookup("post_collection_hook"))
+	_ = viper.BindPFlag("post_collection_hook_timeout",
+		kubernetesCmd.PersistentFlags().Lookup("post_collection_hook_timeout"))
+	_ = viper.BindPFlag("post_collection_hook_fatal",
+		kubernetesCmd.PersistentFlags().Lookup("post_collection_hook_fatal"))
+	_ = viper.BindPFlag("missed_interval_threshold",
+		kubernetesCmd.PersistentFlags().Lookup("missed_interval_threshold"))
+	_ = viper.BindPFlag("virtual_kubelet_nodes", kubernetesCmd.PersistentFlags().Lookup("virtual_kubelet_nodes"))
+	_ = viper.BindPFlag("min_kubernetes_version", kubernetesCmd.PersistentFlags().Lookup("min_kubernetes_version"))
 	viper.SetEnvPrefix("cloudability")
 	viper.AutomaticEnv()
 
 	RootCmd.AddCommand(kubernetesCmd)
 
 	config = kubernetes.KubeAgentConfig{
-		APIKey:                 viper.GetString("api_key"),
-		ClusterName:            viper.GetString("cluster_name"),
-		PollInterval:           viper.GetInt("poll_interval"),
-		CollectionRetryLimit:   viper.GetUint("collection_retry_limit"),
-		OutboundProxy:          viper.GetString("outbound_proxy"),
-		OutboundProxyAuth:      viper.GetString("outbound_proxy_auth"),
-		OutboundProxyInsecure:  viper.GetBool("outbound_proxy_insecure"),
-		Insecure:               viper.GetBool("insecure"),
-		Cert:                   viper.GetString("certificate_file"),
-		Key:                    viper.GetString("key_file"),
-		ConcurrentPollers:      viper.GetInt("number_of_concurrent_node_pollers"),
-		ForceKubeProxy:         viper.GetBool("force_kube_proxy"),
-		Namespace:              viper.GetString("namespace"),
-		ScratchDir:             viper.GetString("scratch_dir"),
-		InformerResyncInterval: viper.GetInt("informer_resync_interval"),
-		ParseMetricData:        viper.GetBool("parse_metric_data"),
-		HTTPSTimeout:           viper.GetInt("https_client_timeout"),
-		UploadRegion:           viper.GetString("upload_region"),
-		CustomS3UploadBucket:   viper.GetString("custom_s3_bucket"),
-		CustomS3Region:         viper.GetString("custom_s3_region"),
+		APIKey:                     viper.GetString("api_key"),
+		ClusterName:                viper.GetString("cluster_name"),
+		PollInterval:               viper.GetInt("poll_interval"),
+		CollectionRetryLimit:       viper.GetUint("collection_retry_limit"),
+		OutboundProxy:              viper.GetString("outbound_proxy"),
+		OutboundProxyAuth:          viper.GetString("outbound_proxy_auth"),
+		OutboundProxyInsecure:      viper.GetBool("outbound_proxy_insecure"),
+		Insecure:                   viper.GetBool("insecure"),
+		Cert:                       viper.GetString("certificate_file"),
+		Key:                        viper.GetString("key_file"),
+		ConcurrentPollers:          viper.GetInt("number_of_concurrent_node_pollers"),
+		ForceKubeProxy:             viper.GetBool("force_kube_proxy"),
+		ForceDirect:                viper.GetBool("force_direct"),
+		Namespace:                  viper.GetString("namespace"),
+		ScratchDir:                 viper.GetString("scratch_dir"),
+		InformerResyncInterval:     viper.GetInt("informer_resync_interval"),
+		ParseMetricData:            viper.GetBool("parse_metric_data"),
+		HTTPSTimeout:               viper.GetInt("https_client_timeout"),
+		UploadRegion:               viper.GetString("upload_region"),
+		CustomS3UploadBucket:       viper.GetString("custom_s3_bucket"),
+		CustomS3Region:             viper.GetString("custom_s3_region"),
+		DiagnosticLogLines:         viper.GetInt("diagnostic_log_lines"),
+		ExtraKubeletEndpoints:      viper.GetString("extra_kubelet_endpoints"),
+		ExtraEndpointMaxBytes:      viper.GetInt64("extra_kubelet_endpoints_max_bytes"),
+		DisableEndpointsAnnotation: viper.GetString("disable_endpoints_annotation"),
+		ProbeNodeMinAge:            viper.GetInt("probe_node_min_age"),
+		PollOverrunThreshold:       viper.GetInt("poll_overrun_threshold"),
+		PollRecoveryThreshold:      viper.GetInt("poll_recovery_threshold"),
+		FailedNodeLogLimit:         viper.GetInt("failed_node_log_limit"),
+		FailedNodeReportLimit:      viper.GetInt("failed_node_report_limit"),
+		MaxOpenFiles:               viper.GetInt("max_open_files"),
+		BackfillMaxIntervals:       viper.GetInt("backfill_max_intervals"),
+		NodeSizeSpikeFactor:        viper.GetFloat64("node_size_spike_factor"),
+		LateNodeBudget:             viper.GetInt("late_node_budget"),
+		UploadContentEncoding:      viper.GetString("upload_content_encoding"),
+		MigrationUploadURL:         viper.GetString("migration_upload_url"),
+		MigrationAPIKey:            viper.GetString("migration_api_key"),
+		MigrationEndDate:           viper.GetString("migration_end_date"),
+		MigrationAuthoritative:     viper.GetString("migration_authoritative_destination"),
+		DebugCaptureFile:           viper.GetString("debug_capture_file"),
+		DebugCaptureMaxBytes:       viper.GetInt64("debug_capture_max_bytes"),
+		DebugCaptureRetention:      viper.GetInt("debug_capture_retention"),
+		StrictPermissions:          viper.GetBool("strict_permissions"),
+		StatsRelaySelector:         viper.GetString("stats_relay_selector"),
+		StatsRelayNamespace:        viper.GetString("stats_relay_namespace"),
+		StatsRelayPort:             viper.GetInt("stats_relay_port"),
+		MaxSampleBytes:             viper.GetInt64("max_sample_bytes"),
+		NodeFetchPacing:            viper.GetFloat64("node_fetch_pacing"),
+		BearerTokenFile:            viper.GetString("bearer_token_file"),
+		BearerToken:                viper.GetString("bearer_token"),
+		TokenFileTTL:               viper.GetInt("token_file_ttl"),
+		ProxyCredentials: kubernetes.PathCredentials{
+			TokenFile: viper.GetString("proxy_token_file"),
+			Token:     viper.GetString("proxy_token"),
+			CertFile:  viper.GetString("proxy_cert_file"),
+			KeyFile:   viper.GetString("proxy_key_file"),
+		},
+		DirectCredentials: kubernetes.PathCredentials{
+			TokenFile: viper.GetString("direct_token_file"),
+			Token:     viper.GetString("direct_token"),
+			CertFile:  viper.GetString("direct_cert_file"),
+			KeyFile:   viper.GetString("direct_key_file"),
+		},
+		ResponseStallTimeout:       viper.GetInt("response_stall_timeout"),
+		NodeNameAllowlist:          viper.GetString("node_name_allowlist"),
+		NodeLabelSelector:          viper.GetString("node_label_selector"),
+		SkipUnschedulableNodes:     viper.GetBool("skip_unschedulable_nodes"),
+		IncludeNotReadyGracePeriod: viper.GetInt("include_not_ready_grace_period"),
+		MaxHeartbeatAge:            viper.GetInt("max_heartbeat_age"),
+		MaxNodesPerCycle:           viper.GetInt("max_nodes_per_cycle"),
+		NodeListPageSize:           viper.GetInt("node_list_page_size"),
+		NodeSource:                 viper.GetString("node_source"),
+		NodeWatchOutageThreshold:   viper.GetInt("node_watch_outage_threshold"),
+		NodeAddressTypes:           viper.GetString("node_address_types"),
+		KubeletPortOverride:        viper.GetInt("kubelet_port_override"),
+		AcceptedFileClasses:        viper.GetString("accepted_file_classes"),
+		NodeFetchTimeout:           viper.GetInt("node_fetch_timeout"),
+		LoadEstimateChangePercent:  viper.GetInt("load_estimate_change_percent"),
+		CollectionProfile:          viper.GetString("collection_profile"),
+		RetrieveProbeMetrics:       viper.GetBool("retrieve_probe_metrics"),
+		SmallCluster:               viper.GetBool("small_cluster"),
+		APIServerQPS:               viper.GetFloat64("api_server_qps"),
+		APIServerBurst:             viper.GetInt("api_server_burst"),
+		APIServerJSON:              viper.GetBool("api_server_json"),
+		RetrieveKubeletPods:        viper.GetBool("retrieve_kubelet_pods"),
+		KubeletPodsMaxBytes:        viper.GetInt64("kubelet_pods_max_bytes"),
+		RetrieveNodeSpec:           viper.GetBool("retrieve_node_spec"),
+		NodeSpecInterval:           viper.GetInt("node_spec_interval"),
+		RetrieveKubeletConfigz:     viper.GetBool("retrieve_kubelet_configz"),
+		RetrieveKubeletMetrics:     viper.GetBool("retrieve_kubelet_metrics"),
+		CadvisorLabelAllowlist:     viper.GetString("cadvisor_label_allowlist"),
+		CadvisorLabelDenylist:      viper.GetString("cadvisor_label_denylist"),
+		CadvisorMaxSeriesPerFamily: viper.GetInt("cadvisor_max_series_per_family"),
+		Dev:                        viper.GetBool("dev"),
+		NodeIdleConnTimeout:        viper.GetInt("node_idle_conn_timeout"),
+		ReprobeInterval:            viper.GetInt("reprobe_interval"),
+		EndpointConfigFile:         viper.GetString("endpoint_config_file"),
+		WarmUp:                     viper.GetBool("warm_up"),
+		SampleIntervalLock:         viper.GetBool("sample_interval_lock"),
+		KubeletTLSVerify:           viper.GetBool("kubelet_tls_verify"),
+		KubeletCAFile:              viper.GetString("kubelet_ca_file"),
+		KubeletTLSRenegotiation:    viper.GetString("kubelet_tls_renegotiation"),
+		KubeletTLSMaxVersion:       viper.GetString("kubelet_tls_max_version"),
+		KubeletTLSCurves:           viper.GetString("kubelet_tls_curves"),
+		ImageRewrite:               viper.GetString("image_rewrite"),
+		ImageKeepDigests:           viper.GetBool("image_keep_digests"),
+		TagSelf:                    viper.GetBool("tag_self"),
+		PodName:                    viper.GetString("pod_name"),
+		PodNamespace:               viper.GetString("pod_namespace"),
+		PostCollectionHook:         viper.GetString("post_collection_hook"),
+		PostCollectionHookTimeout:  viper.GetInt("post_collection_hook_timeout"),
+		PostCollectionHookFatal:    viper.GetBool("post_collection_hook_fatal"),
+		MissedIntervalThreshold:    viper.GetInt("missed_interval_threshold"),
+		MinKubernetesVersion:       viper.GetString("min_kubernetes_version"),
+		VirtualKubeletNodes:        viper.GetString("virtual_kubelet_nodes"),
 	}
 
 }
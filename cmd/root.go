@@ -36,12 +36,19 @@ func init() {
 		"Format for log output (JSON,TXT)",
 	)
 
+	RootCmd.PersistentFlags().Int(
+		"log_buffer_size",
+		util.DefaultLogBufferSize,
+		"Number of recent log records retained in memory for diagnostics. 0 disables the buffer",
+	)
+
 	// set version flag
 	RootCmd.Version = cldyVersion.VERSION
 
 	//nolint gosec
 	_ = viper.BindPFlag("log_level", RootCmd.PersistentFlags().Lookup("log_level"))
 	_ = viper.BindPFlag("log_format", RootCmd.PersistentFlags().Lookup("log_format"))
+	_ = viper.BindPFlag("log_buffer_size", RootCmd.PersistentFlags().Lookup("log_buffer_size"))
 
 }
 
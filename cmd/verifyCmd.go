@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <sample directory or archive>",
+	Short: "Verify a metric sample against its manifest",
+	Long: "Command to verify the files of a metric sample directory, or of each sample in an uploaded archive, " +
+		"against the sha256 recorded in the sample manifest when they were collected",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		info, err := os.Stat(args[0])
+		if err != nil {
+			return err
+		}
+		var problems map[string][]string
+		if info.IsDir() {
+			var p []string
+			if p, err = sample.VerifyDir(args[0]); err != nil {
+				return err
+			}
+			problems = map[string][]string{args[0]: p}
+		} else if problems, err = verifyArchive(cmd.OutOrStdout(), args[0]); err != nil {
+			return err
+		}
+
+		dirs := make([]string, 0, len(problems))
+		for dir := range problems {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+		failed := false
+		for _, dir := range dirs {
+			for _, p := range problems[dir] {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s: %s\n", dir, p)
+				failed = true
+			}
+		}
+		if failed {
+			return fmt.Errorf("%s does not match its manifest", args[0])
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%s matches its manifest\n", args[0])
+		return nil
+	},
+}
+
+// verifyArchive verifies the samples in an archive, printing the sha256 of the archive to compare with the
+// checksum sent with its upload. The archive is hashed as it is read.
+func verifyArchive(out io.Writer, name string) (problems map[string][]string, rerr error) {
+	//nolint gosec
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer util.SafeClose(f.Close, &rerr)
+
+	h := sha256.New()
+	problems, err = sample.VerifyArchive(io.TeeReader(f, h))
+	if err != nil {
+		return nil, err
+	}
+	// any trailing bytes the archive reader did not consume are part of the uploaded checksum
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "archive sha256: %s\n", hex.EncodeToString(h.Sum(nil)))
+	return problems, nil
+}
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+}
@@ -0,0 +1,135 @@
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientauthv1 "k8s.io/client-go/pkg/apis/clientauthentication/v1"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// DefaultExecRefreshBefore is how long before expiry a token from an exec plugin is refreshed
+const DefaultExecRefreshBefore = time.Minute
+
+// defaultExecTokenTTL is how long a token is cached when the exec plugin does not return an expiry
+const defaultExecTokenTTL = 5 * time.Minute
+
+// execTimeout bounds how long an exec plugin may run
+const execTimeout = time.Minute
+
+// execInfoEnv is the environment variable the exec credential request is passed to the plugin in
+const execInfoEnv = "KUBERNETES_EXEC_INFO"
+
+// ExecProvider supplies tokens minted by a client-go exec credential plugin, such as
+// aws eks get-token or gke-gcloud-auth-plugin. Tokens are cached and refreshed before they expire.
+type ExecProvider struct {
+	config        *clientcmdapi.ExecConfig
+	refreshBefore time.Duration
+	now           func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewExecProvider returns a provider that runs the configured exec plugin to mint tokens
+func NewExecProvider(config *clientcmdapi.ExecConfig) *ExecProvider {
+	return &ExecProvider{
+		config:        config,
+		refreshBefore: DefaultExecRefreshBefore,
+		now:           time.Now,
+	}
+}
+
+// Token returns the cached token, running the exec plugin if there is no token or it is about to expire
+func (p *ExecProvider) Token() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && p.now().Add(p.refreshBefore).Before(p.expiry) {
+		return p.token, nil
+	}
+
+	token, expiry, err := p.run()
+	if err != nil {
+		return "", &ProviderError{Provider: p.Type(), Err: err}
+	}
+	p.token = token
+	p.expiry = expiry
+	return p.token, nil
+}
+
+// Type returns "exec"
+func (p *ExecProvider) Type() string {
+	return "exec"
+}
+
+// Invalidate discards the token so the exec plugin is run again by the next call to Token
+func (p *ExecProvider) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.token = ""
+}
+
+// run executes the plugin and parses the ExecCredential it writes to stdout
+func (p *ExecProvider) run() (string, time.Time, error) {
+	apiVersion := p.config.APIVersion
+	if apiVersion == "" {
+		apiVersion = clientauthv1.SchemeGroupVersion.String()
+	}
+	request, err := json.Marshal(clientauthv1.ExecCredential{
+		TypeMeta: metav1.TypeMeta{APIVersion: apiVersion, Kind: "ExecCredential"},
+		Spec:     clientauthv1.ExecCredentialSpec{Interactive: false},
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to build exec credential request: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+
+	//nolint gosec
+	cmd := exec.CommandContext(ctx, p.config.Command, p.config.Args...)
+	cmd.Env = append(os.Environ(), execInfoEnv+"="+string(request))
+	for _, e := range p.config.Env {
+		cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) && p.config.InstallHint != "" {
+			return "", time.Time{}, fmt.Errorf("%s not found: %s", p.config.Command, p.config.InstallHint)
+		}
+		return "", time.Time{}, fmt.Errorf("running %s failed: %v: %s", p.config.Command, err,
+			bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var cred clientauthv1.ExecCredential
+	if err := json.Unmarshal(stdout.Bytes(), &cred); err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to parse output of %s: %v", p.config.Command, err)
+	}
+	if cred.APIVersion != apiVersion {
+		return "", time.Time{}, fmt.Errorf("%s returned apiVersion %q, expected %q", p.config.Command,
+			cred.APIVersion, apiVersion)
+	}
+	if cred.Status == nil || cred.Status.Token == "" {
+		return "", time.Time{}, fmt.Errorf("%s did not return a token, only token credentials are supported",
+			p.config.Command)
+	}
+
+	expiry := p.now().Add(defaultExecTokenTTL)
+	if cred.Status.ExpirationTimestamp != nil {
+		expiry = cred.Status.ExpirationTimestamp.Time
+	}
+	return cred.Status.Token, expiry, nil
+}
@@ -0,0 +1,135 @@
+// Package credentials supplies the bearer tokens used to authenticate with the API server and kubelets.
+package credentials
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Provider supplies a bearer token, refreshing it as needed
+type Provider interface {
+	// Token returns the current bearer token
+	Token() (string, error)
+	// Type names the kind of provider, eg: static, file or exec
+	Type() string
+	// Invalidate discards any cached token so the next call to Token supplies a fresh one, eg: after the
+	// token was rejected
+	Invalidate()
+}
+
+// ProviderError is returned when a provider is unable to supply a token
+type ProviderError struct {
+	Provider string
+	Err      error
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s credential provider: %v", e.Provider, e.Err)
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultTokenFileTTL is how long a token read from a file is used before the file is read again
+const DefaultTokenFileTTL = time.Minute
+
+// FromConfig returns the provider for the credentials of a cluster config, preferring an exec plugin,
+// then a token file, then a static token. A token file is read again once its token is older than
+// tokenFileTTL. It returns nil when no credentials are configured.
+func FromConfig(token, tokenFile string, tokenFileTTL time.Duration, execConfig *clientcmdapi.ExecConfig) Provider {
+	switch {
+	case execConfig != nil:
+		return NewExecProvider(execConfig)
+	case tokenFile != "":
+		return NewFileProvider(tokenFile, tokenFileTTL)
+	case token != "":
+		return NewStaticProvider(token)
+	}
+	return nil
+}
+
+// StaticProvider supplies a fixed token
+type StaticProvider struct {
+	token string
+}
+
+// NewStaticProvider returns a provider that always supplies the given token
+func NewStaticProvider(token string) *StaticProvider {
+	return &StaticProvider{token: token}
+}
+
+// Token returns the fixed token
+func (p *StaticProvider) Token() (string, error) {
+	return p.token, nil
+}
+
+// Type returns "static"
+func (p *StaticProvider) Type() string {
+	return "static"
+}
+
+// Invalidate does nothing, the token is fixed
+func (p *StaticProvider) Invalidate() {}
+
+// FileProvider supplies a token read from a file, such as a projected service account token. The
+// file is re-read whenever it is modified, its token is older than the ttl or the token was invalidated,
+// so rotated tokens are picked up even when the modification time of the file is unchanged.
+type FileProvider struct {
+	path string
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	readAt  time.Time
+}
+
+// NewFileProvider returns a provider that reads the token from the given file, reading it again once the
+// token is older than ttl. A ttl of 0 or less reads the file again only when it is modified or invalidated.
+func NewFileProvider(path string, ttl time.Duration) *FileProvider {
+	return &FileProvider{path: path, ttl: ttl, now: time.Now}
+}
+
+// Token returns the token in the file, reading it again if the file has been modified or the token is
+// older than the ttl
+func (p *FileProvider) Token() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fi, err := os.Stat(p.path)
+	if err != nil {
+		return "", &ProviderError{Provider: p.Type(), Err: fmt.Errorf("could not read bearer token: %v", err)}
+	}
+	expired := p.ttl > 0 && !p.now().Before(p.readAt.Add(p.ttl))
+	if p.token != "" && fi.ModTime().Equal(p.modTime) && !expired {
+		return p.token, nil
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return "", &ProviderError{Provider: p.Type(), Err: fmt.Errorf("could not read bearer token: %v", err)}
+	}
+	p.token = strings.TrimSpace(string(data))
+	p.modTime = fi.ModTime()
+	p.readAt = p.now()
+	return p.token, nil
+}
+
+// Type returns "file"
+func (p *FileProvider) Type() string {
+	return "file"
+}
+
+// Invalidate discards the token so the file is read again by the next call to Token
+func (p *FileProvider) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.token = ""
+}
@@ -0,0 +1,179 @@
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestFromConfig(t *testing.T) {
+	if p := FromConfig("token", "", 0, nil); p == nil || p.Type() != "static" {
+		t.Errorf("expected static provider, got %v", p)
+	}
+	if p := FromConfig("token", "/token", 0, nil); p == nil || p.Type() != "file" {
+		t.Errorf("expected file provider, got %v", p)
+	}
+	if p := FromConfig("token", "/token", 0, &clientcmdapi.ExecConfig{Command: "true"}); p == nil || p.Type() != "exec" {
+		t.Errorf("expected exec provider, got %v", p)
+	}
+	if p := FromConfig("", "", 0, nil); p != nil {
+		t.Errorf("expected no provider, got %v", p)
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestFileProvider")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+
+	t.Run("Ensure a missing file returns an error naming the provider", func(t *testing.T) {
+		_, err := NewFileProvider(path, 0).Token()
+		var perr *ProviderError
+		if !errors.As(err, &perr) || perr.Provider != "file" || !strings.HasPrefix(err.Error(), "file ") {
+			t.Errorf("expected file provider error, got %v", err)
+		}
+	})
+
+	t.Run("Ensure rotated tokens are read again", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte("first\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		p := NewFileProvider(path, 0)
+		if token, err := p.Token(); err != nil || token != "first" {
+			t.Fatalf("expected first token, got %s: %v", token, err)
+		}
+		if err := os.WriteFile(path, []byte("second"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+		if token, err := p.Token(); err != nil || token != "second" {
+			t.Errorf("expected second token, got %s: %v", token, err)
+		}
+	})
+
+	t.Run("Ensure tokens are read again once older than the ttl or invalidated", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte("first"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the modification time is kept, eg: the file was replaced by a copy preserving it
+		rotate := func(token string) {
+			if err := os.WriteFile(path, []byte(token), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		p := NewFileProvider(path, time.Minute)
+		p.now = func() time.Time { return now }
+		if token, err := p.Token(); err != nil || token != "first" {
+			t.Fatalf("expected first token, got %s: %v", token, err)
+		}
+
+		rotate("second")
+		now = now.Add(30 * time.Second)
+		if token, err := p.Token(); err != nil || token != "first" {
+			t.Errorf("expected the cached token within the ttl, got %s: %v", token, err)
+		}
+		now = now.Add(30 * time.Second)
+		if token, err := p.Token(); err != nil || token != "second" {
+			t.Errorf("expected second token after the ttl, got %s: %v", token, err)
+		}
+
+		rotate("third")
+		p.Invalidate()
+		if token, err := p.Token(); err != nil || token != "third" {
+			t.Errorf("expected third token after invalidation, got %s: %v", token, err)
+		}
+	})
+}
+
+func TestExecProvider(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestExecProvider")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	counter := filepath.Join(dir, "count")
+
+	// the plugin appends to a file each time it runs so the number of invocations can be checked
+	plugin := func(apiVersion, expiry string) *clientcmdapi.ExecConfig {
+		status := `{"token":"minted-$TOKEN_SUFFIX"}`
+		if expiry != "" {
+			status = fmt.Sprintf(`{"token":"minted-$TOKEN_SUFFIX","expirationTimestamp":"%s"}`, expiry)
+		}
+		script := fmt.Sprintf(`echo run >> %s; echo '{"apiVersion":"%s","kind":"ExecCredential","status":'"%s"'}'`,
+			counter, apiVersion, strings.ReplaceAll(status, `"`, `\"`))
+		return &clientcmdapi.ExecConfig{
+			Command:    "sh",
+			Args:       []string{"-c", script},
+			Env:        []clientcmdapi.ExecEnvVar{{Name: "TOKEN_SUFFIX", Value: "abc"}},
+			APIVersion: "client.authentication.k8s.io/v1",
+		}
+	}
+	runs := func() int {
+		data, _ := os.ReadFile(counter)
+		return strings.Count(string(data), "run")
+	}
+
+	t.Run("Ensure tokens are cached until shortly before expiry", func(t *testing.T) {
+		defer os.Remove(counter)
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		p := NewExecProvider(plugin("client.authentication.k8s.io/v1", "2023-01-01T00:10:00Z"))
+		p.now = func() time.Time { return now }
+
+		for i := 0; i < 3; i++ {
+			token, err := p.Token()
+			if err != nil || token != "minted-abc" {
+				t.Fatalf("expected minted token, got %s: %v", token, err)
+			}
+		}
+		if runs() != 1 {
+			t.Errorf("expected the plugin to run once, ran %d times", runs())
+		}
+
+		now = now.Add(9*time.Minute + 30*time.Second)
+		if _, err := p.Token(); err != nil {
+			t.Fatal(err)
+		}
+		if runs() != 2 {
+			t.Errorf("expected the token to be refreshed before expiry, ran %d times", runs())
+		}
+	})
+
+	t.Run("Ensure mismatched api versions return an error naming the provider", func(t *testing.T) {
+		defer os.Remove(counter)
+		config := plugin("client.authentication.k8s.io/v1beta1", "")
+		_, err := NewExecProvider(config).Token()
+		if err == nil || !strings.HasPrefix(err.Error(), "exec credential provider") {
+			t.Errorf("expected exec provider error, got %v", err)
+		}
+	})
+
+	t.Run("Ensure plugin failures include the install hint", func(t *testing.T) {
+		_, err := NewExecProvider(&clientcmdapi.ExecConfig{
+			Command:     "metrics-agent-missing-auth-plugin",
+			InstallHint: "install the plugin",
+		}).Token()
+		if err == nil || !strings.Contains(err.Error(), "install the plugin") {
+			t.Errorf("expected install hint in error, got %v", err)
+		}
+	})
+}
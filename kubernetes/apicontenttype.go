@@ -0,0 +1,22 @@
+package kubernetes
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+)
+
+// protobufAcceptContentTypes prefers protobuf responses from the API server, falling back to JSON for the
+// resources that are not served as protobuf
+const protobufAcceptContentTypes = runtime.ContentTypeProtobuf + "," + runtime.ContentTypeJSON
+
+// applyContentType configures the cluster config of the typed clientset to request protobuf from the API
+// server, as decoding the large node and pod lists of big clusters from JSON is a measurable CPU cost, unless
+// the config falls back to JSON. Only the wire format changes, the resources written to samples are still
+// JSON.
+func applyContentType(config KubeAgentConfig, restConfig *rest.Config) {
+	if config.APIServerJSON {
+		return
+	}
+	restConfig.AcceptContentTypes = protobufAcceptContentTypes
+	restConfig.ContentType = runtime.ContentTypeProtobuf
+}
@@ -0,0 +1,116 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+// encodeNodeList encodes the node list in the media type, as the API server serves it
+func encodeNodeList(t testing.TB, list *v1.NodeList, mediaType string) []byte {
+	info, ok := runtime.SerializerInfoForMediaType(scheme.Codecs.SupportedMediaTypes(), mediaType)
+	if !ok {
+		t.Fatalf("no serializer for %s", mediaType)
+	}
+	data, err := runtime.Encode(scheme.Codecs.EncoderForVersion(info.Serializer, v1.SchemeGroupVersion), list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// largeNodeList returns a list of n nodes, each with the labels, conditions and images of a typical node
+func largeNodeList(n int) *v1.NodeList {
+	list := &v1.NodeList{}
+	for i := 0; i < n; i++ {
+		node := addressedNode(fmt.Sprintf("node%d", i), fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		node.Labels = map[string]string{"kubernetes.io/hostname": node.Name, "topology.kubernetes.io/zone": "a",
+			"node.kubernetes.io/instance-type": "m5.xlarge", "kubernetes.io/os": "linux"}
+		for _, c := range []v1.NodeConditionType{v1.NodeMemoryPressure, v1.NodeDiskPressure, v1.NodePIDPressure} {
+			node.Status.Conditions = append(node.Status.Conditions, v1.NodeCondition{Type: c,
+				Status: v1.ConditionFalse, Reason: "KubeletHasSufficient" + string(c)})
+		}
+		for j := 0; j < 20; j++ {
+			node.Status.Images = append(node.Status.Images, v1.ContainerImage{
+				Names:     []string{fmt.Sprintf("registry.example.com/team/image%d@sha256:%064d", j, j)},
+				SizeBytes: int64(j) << 20,
+			})
+		}
+		list.Items = append(list.Items, node)
+	}
+	return list
+}
+
+func TestAPIServerContentType(t *testing.T) {
+	list := largeNodeList(2)
+	for _, tc := range []struct {
+		config    KubeAgentConfig
+		mediaType string
+	}{
+		{config: KubeAgentConfig{}, mediaType: runtime.ContentTypeProtobuf},
+		{config: KubeAgentConfig{APIServerJSON: true}, mediaType: runtime.ContentTypeJSON},
+	} {
+		var accepted string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			accepted = r.Header.Get("Accept")
+			mediaType := runtime.ContentTypeJSON
+			if strings.HasPrefix(accepted, runtime.ContentTypeProtobuf) {
+				mediaType = runtime.ContentTypeProtobuf
+			}
+			w.Header().Set("Content-Type", mediaType)
+			_, _ = w.Write(encodeNodeList(t, list, mediaType))
+		}))
+
+		restConfig := &rest.Config{Host: ts.URL}
+		applyContentType(tc.config, restConfig)
+		clientset, err := newLimitedClientset(restConfig, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes, err := clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(accepted, tc.mediaType) || len(nodes.Items) != 2 ||
+			len(nodes.Items[1].Status.Images) != 20 {
+			t.Errorf("expected the nodes to be served as %s, accepted %s and got %d nodes", tc.mediaType, accepted,
+				len(nodes.Items))
+		}
+		// the resources written to samples are JSON whatever the wire format
+		data, err := json.Marshal(nodes.Items[0])
+		if err != nil || !strings.Contains(string(data), `"name":"node0"`) {
+			t.Errorf("expected the node to be written as JSON, got %s %v", data, err)
+		}
+	}
+}
+
+// BenchmarkDecodeNodeList compares the CPU and allocations of decoding the node list of a large cluster
+// served as JSON and as protobuf
+func BenchmarkDecodeNodeList(b *testing.B) {
+	list := largeNodeList(5000)
+	for name, mediaType := range map[string]string{"json": runtime.ContentTypeJSON,
+		"protobuf": runtime.ContentTypeProtobuf} {
+		data := encodeNodeList(b, list, mediaType)
+		decoder := scheme.Codecs.UniversalDeserializer()
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := runtime.Decode(decoder, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
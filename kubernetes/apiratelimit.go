@@ -0,0 +1,81 @@
+package kubernetes
+
+import (
+	"net/http"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// requests to the API server are not limited by the agent by default, beyond the client-go defaults of
+// the clientset
+const (
+	// DefaultAPIServerQPS is the default rate of requests to the API server, 0 leaves them unlimited unless
+	// the small cluster profile is selected
+	DefaultAPIServerQPS = 0
+	// DefaultAPIServerBurst is the default number of requests to the API server allowed above the rate
+	DefaultAPIServerBurst = 10
+)
+
+// the small cluster profile bounds the total load of the agent for single node control planes, eg: k3s
+// edge clusters, where startup probing and the first poll together have overwhelmed the API server
+const (
+	smallClusterAPIServerQPS   = 2
+	smallClusterAPIServerBurst = 4
+)
+
+// newAPIServerLimiter returns the token bucket shared by every request the agent sends to the API server,
+// or nil if they are not limited
+func newAPIServerLimiter(config KubeAgentConfig) flowcontrol.RateLimiter {
+	qps, burst := apiServerRateLimit(config)
+	if qps <= 0 {
+		return nil
+	}
+	return flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+}
+
+// apiServerRateLimit returns the rate and burst of requests to the API server, an explicitly configured
+// limit takes precedence over that of the small cluster profile
+func apiServerRateLimit(config KubeAgentConfig) (float32, int) {
+	qps := float32(config.APIServerQPS)
+	burst := config.APIServerBurst
+	if config.SmallCluster {
+		if qps <= 0 {
+			qps = smallClusterAPIServerQPS
+		}
+		if burst <= 0 {
+			burst = smallClusterAPIServerBurst
+		}
+	}
+	if burst <= 0 {
+		burst = DefaultAPIServerBurst
+	}
+	return qps, burst
+}
+
+// rateLimitedTransport waits for the shared limiter before each request, so requests that do not pass
+// through the clientset count against the same budget
+type rateLimitedTransport struct {
+	limiter flowcontrol.RateLimiter
+	next    http.RoundTripper
+}
+
+func (t rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// limitAPIServerClient returns the client with its requests limited by the shared limiter, unchanged if
+// requests are not limited
+func limitAPIServerClient(client http.Client, limiter flowcontrol.RateLimiter) http.Client {
+	if limiter == nil {
+		return client
+	}
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	client.Transport = rateLimitedTransport{limiter: limiter, next: next}
+	return client
+}
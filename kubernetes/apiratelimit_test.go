@@ -0,0 +1,102 @@
+package kubernetes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+func TestAPIServerRateLimit(t *testing.T) {
+	tests := []struct {
+		config KubeAgentConfig
+		qps    float32
+		burst  int
+	}{
+		{config: KubeAgentConfig{}, qps: 0, burst: DefaultAPIServerBurst},
+		{config: KubeAgentConfig{SmallCluster: true}, qps: smallClusterAPIServerQPS,
+			burst: smallClusterAPIServerBurst},
+		{config: KubeAgentConfig{SmallCluster: true, APIServerQPS: 5}, qps: 5, burst: smallClusterAPIServerBurst},
+		{config: KubeAgentConfig{APIServerQPS: 5, APIServerBurst: 1}, qps: 5, burst: 1},
+	}
+	for _, tc := range tests {
+		if qps, burst := apiServerRateLimit(tc.config); qps != tc.qps || burst != tc.burst {
+			t.Errorf("expected %v qps with a burst of %d for %+v, got %v %d", tc.qps, tc.burst, tc.config, qps,
+				burst)
+		}
+	}
+	if newAPIServerLimiter(KubeAgentConfig{}) != nil {
+		t.Error("expected requests not to be limited by default")
+	}
+}
+
+func TestSmallClusterRequestRate(t *testing.T) {
+	var mu sync.Mutex
+	var requests []time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, time.Now())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"kind":"NodeList","apiVersion":"v1","items":[]}`))
+	}))
+	defer ts.Close()
+
+	limiter := newAPIServerLimiter(KubeAgentConfig{SmallCluster: true})
+	clientset, err := newLimitedClientset(&rest.Config{Host: ts.URL}, limiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyClient := limitAPIServerClient(http.Client{}, limiter)
+
+	// the clientset and the proxied requests draw on the same bucket
+	const perClient = 4
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < perClient; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{}); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			resp, err := proxyClient.Get(ts.URL + "/api/v1/nodes/node0/proxy/stats/summary")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if len(requests) != 2*perClient {
+		t.Fatalf("expected %d requests, got %d", 2*perClient, len(requests))
+	}
+	// the requests beyond the burst are spread at the rate of the profile
+	minElapsed := time.Duration(2*perClient-smallClusterAPIServerBurst-1) * time.Second / smallClusterAPIServerQPS
+	if elapsed < minElapsed {
+		t.Errorf("expected %d requests to take at least %v, took %v", len(requests), minElapsed, elapsed)
+	}
+	for i := range requests {
+		var inSecond int
+		for _, r := range requests[i:] {
+			if r.Sub(requests[i]) < time.Second {
+				inSecond++
+			}
+		}
+		if inSecond > smallClusterAPIServerBurst+smallClusterAPIServerQPS {
+			t.Errorf("expected at most %d requests in any second, got %d",
+				smallClusterAPIServerBurst+smallClusterAPIServerQPS, inSecond)
+		}
+	}
+}
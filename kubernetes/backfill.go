@@ -0,0 +1,356 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	cldyVersion "github.com/cloudability/metrics-agent/version"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// DefaultBackfillMaxIntervals is the default maximum number of missed polls to backfill, backfill is
+// disabled by default
+const DefaultBackfillMaxIntervals = 0
+
+// bounds on how far back a backfill is attempted, regardless of configuration. The kubelet only retains a
+// few minutes of container stats so older polls can not be reconstructed.
+const (
+	maxBackfillIntervals = 10
+	maxBackfillWindow    = 10 * time.Minute
+)
+
+// cadvisorHousekeepingInterval is the interval at which the kubelet records container stats, used to
+// estimate how many retained stats cover the missed polls
+const cadvisorHousekeepingInterval = 10 * time.Second
+
+// lastCollectionFile is kept in the scratch directory so gaps spanning an agent restart are detected
+const lastCollectionFile = "agent-last-collection.json"
+
+// lastCollection records the most recent successful collection
+type lastCollection struct {
+	AgentVersion string    `json:"agentVersion"`
+	Time         time.Time `json:"time"`
+	// Profile is the collection profile of the collection, empty for the full profile
+	Profile string `json:"profile,omitempty"`
+}
+
+// readLastCollection reads the most recent successful collection recorded in the scratch directory
+func readLastCollection(scratchDir string) (lastCollection, error) {
+	var c lastCollection
+	data, err := os.ReadFile(filepath.Join(scratchDir, lastCollectionFile))
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// writeLastCollection records a successful collection in the scratch directory
+func writeLastCollection(scratchDir string, c lastCollection) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filepath.Join(scratchDir, lastCollectionFile), 0644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// missedPolls returns the times of the polls missed between the last successful collection and a
+// collection at now, oldest first. At most maxIntervals polls within maxBackfillWindow of now are
+// returned, and none if the last collection was made by a different agent version.
+func missedPolls(last lastCollection, now time.Time, interval time.Duration, maxIntervals int) []time.Time {
+	if maxIntervals <= 0 || interval <= 0 || last.Time.IsZero() {
+		return nil
+	}
+	if last.AgentVersion != cldyVersion.VERSION {
+		log.Infof("Last collection was made by agent version %s, missed polls will not be backfilled",
+			last.AgentVersion)
+		return nil
+	}
+	if maxIntervals > maxBackfillIntervals {
+		maxIntervals = maxBackfillIntervals
+	}
+
+	oldest := now.Add(-maxBackfillWindow)
+	first := last.Time.Add(interval)
+	if first.Before(oldest) {
+		skip := (oldest.Sub(first) + interval - 1) / interval
+		first = first.Add(skip * interval)
+	}
+
+	var polls []time.Time
+	// allow half an interval of jitter so the poll being made now is not counted as missed
+	for t := first; now.Sub(t) >= interval/2; t = t.Add(interval) {
+		polls = append(polls, t.UTC())
+	}
+	if len(polls) > maxIntervals {
+		polls = polls[len(polls)-maxIntervals:]
+	}
+	return polls
+}
+
+// backfillMissedPolls records a successful collection and, if polls were missed since the previous one,
+// reconstructs them from the container stats retained by the kubelets. Backfill is best effort, failures
+// are logged.
+func (ka KubeAgentConfig) backfillMissedPolls(ctx context.Context, state *AgentState, nodeSource NodeSource,
+	collected time.Time) {
+	if ka.BackfillMaxIntervals <= 0 {
+		return
+	}
+	current := lastCollection{AgentVersion: cldyVersion.VERSION, Time: collected.UTC()}
+	if ka.namespaceRollup() {
+		current.Profile = ka.CollectionProfile
+	}
+	previous := state.recordCollection(current)
+	if err := writeLastCollection(ka.ScratchDir, current); err != nil {
+		log.Warnf("Warning: unable to record last collection, a restart will not be backfilled: %s", err)
+	}
+
+	if state.DegradationLevel() != DegradationNone {
+		// polls missed while overrunning were dropped to reduce load, do not add to it
+		return
+	}
+	if ka.namespaceRollup() {
+		// container stats are container level detail
+		return
+	}
+	interval := time.Duration(ka.PollInterval) * time.Second
+	polls := missedPolls(previous, collected, interval, ka.BackfillMaxIntervals)
+	if len(polls) == 0 {
+		return
+	}
+	if previous.Profile != current.Profile {
+		// a sample of another granularity would be mixed into the collections of this profile
+		log.Infof("Last collection used the %s collection profile, missed polls will not be backfilled",
+			previous.Profile)
+		return
+	}
+
+	log.Infof("Detected %d missed polls since %s, backfilling from kubelet container stats",
+		len(polls), previous.Time.Format(time.RFC3339))
+	if err := backfillNodeStats(ctx, ka, state.Nodes(), nodeSource, polls, interval, collected); err != nil {
+		log.Warnf("Warning: unable to backfill missed polls: %s", err)
+	}
+}
+
+// backfillNodeStats fetches the container stats retained by each node and writes those for each missed
+// poll to a backfilled sample in the sample directory of that poll
+func backfillNodeStats(ctx context.Context, config KubeAgentConfig, nodes NodeConnection, nodeSource NodeSource,
+	polls []time.Time, interval time.Duration, now time.Time) error {
+	readyNodes, err := nodeSource.GetReadyNodes(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get a list of nodes: %v", err)
+	}
+	readyNodes, _ = withoutVirtualNodes(config, readyNodes)
+	readyNodes, _ = withoutOptedOutNodes(readyNodes)
+
+	numStats := int(now.Sub(polls[0].Add(-interval))/cadvisorHousekeepingInterval) + 1
+	if maxStats := int(maxBackfillWindow / cadvisorHousekeepingInterval); numStats > maxStats {
+		numStats = maxStats
+	}
+	containersRequest, err := buildContainersRequest(numStats)
+	if err != nil {
+		return err
+	}
+
+	// retained stats are downloaded outside the sample as only the stats of each missed poll are kept
+	downloadDir, err := os.MkdirTemp(config.ScratchDir, "cldy-backfill")
+	if err != nil {
+		return fmt.Errorf("unable to create backfill directory: %v", err)
+	}
+	workDir := util.NewWorkDir(downloadDir)
+	defer workDir.RemoveAll(ctx)
+
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	backfilled := make(map[time.Time]bool)
+	limiter := make(chan struct{}, config.ConcurrentPollers)
+
+	for _, n := range readyNodes {
+		limiter <- struct{}{}
+		wg.Add(1)
+		go func(n v1.Node) {
+			defer wg.Done()
+			defer func() { <-limiter }()
+
+			nd := nodeFetchData{
+				nodeName:          n.Name,
+				prefix:            sample.StatsPrefix,
+				workDir:           workDir,
+				ClusterHostURL:    config.ClusterHostURL,
+				containersRequest: containersRequest,
+			}
+			written, err := backfillNode(ctx, nd, config, nodes, nodeSource, n, polls, interval)
+			if err != nil {
+				log.Warnf("Unable to backfill node %s: %v", n.Name, err)
+			}
+			m.Lock()
+			for _, p := range written {
+				backfilled[p] = true
+			}
+			m.Unlock()
+		}(n)
+	}
+	wg.Wait()
+
+	for _, p := range polls {
+		if !backfilled[p] {
+			continue
+		}
+		dir := sample.Dir(config.msExportDirectory.Name(), p)
+		// backfilled samples are processed by the hook within the cycle of the collection backfilling them
+		if err := runPostCollectionHook(ctx, config, dir, now); err != nil {
+			log.Warnf("Unable to backfill poll %s: %v", p.Format(time.RFC3339), discardSample(dir, err))
+			delete(backfilled, p)
+			continue
+		}
+		err := sample.WriteBackfillManifest(dir, cldyVersion.VERSION, now)
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Backfilled %d of %d missed polls", len(backfilled), len(polls))
+	return nil
+}
+
+// backfillNode fetches the container stats retained by a node and writes them to the backfilled samples,
+// returning the polls that stats were written for
+func backfillNode(ctx context.Context, nd nodeFetchData, config KubeAgentConfig, nodes NodeConnection, ns NodeSource,
+	n v1.Node, polls []time.Time, interval time.Duration) ([]time.Time, error) {
+	source := sourceName{prefix: nd.prefix, nodeName: nd.nodeName}
+	if annotationDisabledEndpoints(config, n)[sample.ContainerSource] {
+		log.Debugf("Node %s: container stats are disabled by annotation, the node is not backfilled", n.Name)
+		return nil, nil
+	}
+
+	// stats/container is not probed at startup, use the connections that reach the node summary
+	filename, err := "", errors.New("no connection method available")
+	for _, cm := range connectionOptions(config, nodes, n, nd, ns) {
+		if !nodes.NodeMetrics.Available(NodeStatsSummaryEndpoint, cm.ConnType) {
+			continue
+		}
+		filename, err = cm.client.GetRawEndPoint(ctx, http.MethodPost, source.container(), nd.workDir,
+			cm.API.statsContainer(), nd.containersRequest, false)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	split, err := splitContainerStatsFile(filename, polls, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	var written []time.Time
+	for i, containers := range split {
+		if len(containers) == 0 {
+			continue
+		}
+		dir := sample.Dir(config.msExportDirectory.Name(), polls[i])
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return written, err
+		}
+		out, err := json.Marshal(containers)
+		if err != nil {
+			return written, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, source.container()+".json"), out, 0644); err != nil {
+			return written, err
+		}
+		written = append(written, polls[i])
+	}
+	return written, nil
+}
+
+// splitContainerStatsFile splits the stats/container response in the named file into one response per poll
+func splitContainerStatsFile(filename string, polls []time.Time, interval time.Duration) (
+	split []map[string]containerInfo, rerr error) {
+	//nolint gosec
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer util.SafeClose(f.Close, &rerr)
+	return splitContainerStats(f, polls, interval)
+}
+
+// containerInfo is a cadvisor container info, only the stats are interpreted the remaining fields are
+// kept as returned by the kubelet
+type containerInfo map[string]json.RawMessage
+
+// splitContainerStats splits a stats/container response into one response per poll, holding for each
+// container the most recent stat recorded in the interval ending at the poll. Containers with no stat in
+// the interval are left out. The response is decoded one container at a time, so only the stats selected
+// are held rather than the whole response.
+func splitContainerStats(r io.Reader, polls []time.Time, interval time.Duration) ([]map[string]containerInfo,
+	error) {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("unable to parse container stats: not a JSON object")
+	}
+
+	split := make([]map[string]containerInfo, len(polls))
+	for i := range split {
+		split[i] = make(map[string]containerInfo)
+	}
+
+	for dec.More() {
+		var name string
+		var info containerInfo
+		t, err := dec.Token()
+		if err == nil {
+			name, _ = t.(string)
+			err = dec.Decode(&info)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse container stats: %v", err)
+		}
+		var stats []json.RawMessage
+		if err := json.Unmarshal(info["stats"], &stats); err != nil {
+			return nil, fmt.Errorf("unable to parse stats of container %s: %v", name, err)
+		}
+		for i, poll := range polls {
+			var selected json.RawMessage
+			var selectedAt time.Time
+			for _, stat := range stats {
+				var ts struct {
+					Timestamp time.Time `json:"timestamp"`
+				}
+				if err := json.Unmarshal(stat, &ts); err != nil {
+					return nil, fmt.Errorf("unable to parse stat timestamp of container %s: %v", name, err)
+				}
+				if !ts.Timestamp.After(poll.Add(-interval)) || ts.Timestamp.After(poll) ||
+					ts.Timestamp.Before(selectedAt) {
+					continue
+				}
+				selected, selectedAt = stat, ts.Timestamp
+			}
+			if selected == nil {
+				continue
+			}
+			pollInfo := make(containerInfo, len(info))
+			for k, v := range info {
+				pollInfo[k] = v
+			}
+			pollInfo["stats"] = json.RawMessage("[" + string(selected) + "]")
+			split[i][name] = pollInfo
+		}
+	}
+	return split, nil
+}
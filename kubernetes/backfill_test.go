@@ -0,0 +1,237 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	cldyVersion "github.com/cloudability/metrics-agent/version"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMissedPolls(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	interval := time.Minute
+	last := func(ago time.Duration) lastCollection {
+		return lastCollection{AgentVersion: cldyVersion.VERSION, Time: now.Add(-ago)}
+	}
+
+	tests := []struct {
+		name         string
+		last         lastCollection
+		maxIntervals int
+		expected     []time.Time
+	}{
+		{name: "disabled", last: last(3 * time.Minute), maxIntervals: 0},
+		{name: "no previous collection", last: lastCollection{}, maxIntervals: 5},
+		{name: "no gap", last: last(interval), maxIntervals: 5},
+		{name: "jitter is not a gap", last: last(interval + 20*time.Second), maxIntervals: 5},
+		{
+			name:         "missed polls",
+			last:         last(3 * interval),
+			maxIntervals: 5,
+			expected:     []time.Time{now.Add(-2 * interval), now.Add(-interval)},
+		},
+		{
+			name:         "most recent polls are kept",
+			last:         last(4 * interval),
+			maxIntervals: 2,
+			expected:     []time.Time{now.Add(-2 * interval), now.Add(-interval)},
+		},
+		{
+			name:         "bounded by the backfill window",
+			last:         last(24 * time.Hour),
+			maxIntervals: 100,
+			expected: func() []time.Time {
+				var polls []time.Time
+				for i := maxBackfillIntervals; i > 0; i-- {
+					polls = append(polls, now.Add(-time.Duration(i)*interval))
+				}
+				return polls
+			}(),
+		},
+		{
+			name:         "agent version changed",
+			last:         lastCollection{AgentVersion: "0.0.1", Time: now.Add(-3 * interval)},
+			maxIntervals: 5,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			polls := missedPolls(tc.last, now, interval, tc.maxIntervals)
+			if len(polls) != len(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, polls)
+			}
+			for i := range polls {
+				if !polls[i].Equal(tc.expected[i]) {
+					t.Errorf("expected %v, got %v", tc.expected, polls)
+				}
+			}
+		})
+	}
+}
+
+// containerStatsResponse builds a stats/container response for a container with a stat at each time
+func containerStatsResponse(times ...time.Time) []byte {
+	stats := make([]map[string]interface{}, 0, len(times))
+	for i, ts := range times {
+		stats = append(stats, map[string]interface{}{"timestamp": ts, "cpu": map[string]int{"usage": i}})
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"/kubepods/pod0": map[string]interface{}{"name": "/kubepods/pod0", "stats": stats},
+	})
+	return data
+}
+
+func TestSplitContainerStats(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	interval := time.Minute
+	polls := []time.Time{now.Add(-2 * interval), now.Add(-interval)}
+
+	// no stat is retained for the first poll
+	data := containerStatsResponse(now.Add(-80*time.Second), now.Add(-70*time.Second), now.Add(-10*time.Second))
+	split, err := splitContainerStats(bytes.NewReader(data), polls, interval)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(split) != 2 || len(split[0]) != 0 || len(split[1]) != 1 {
+		t.Fatalf("unexpected split %v", split)
+	}
+
+	info := split[1]["/kubepods/pod0"]
+	if string(info["name"]) != `"/kubepods/pod0"` {
+		t.Errorf("expected container fields to be kept, got %s", info["name"])
+	}
+	var stats []struct {
+		Timestamp time.Time `json:"timestamp"`
+	}
+	if err := json.Unmarshal(info["stats"], &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || !stats[0].Timestamp.Equal(now.Add(-70*time.Second)) {
+		t.Errorf("expected the most recent stat of the interval, got %v", stats)
+	}
+
+	if _, err := splitContainerStats(strings.NewReader("not json"), polls, interval); err == nil {
+		t.Error("expected an error for an invalid response")
+	}
+}
+
+func TestBackfillMissedPolls(t *testing.T) {
+	interval := time.Minute
+	collected := time.Now().UTC()
+	var requests []cadvisorStatsRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req cadvisorStatsRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(containerStatsResponse(collected.Add(-2*interval), collected.Add(-interval)))
+	}))
+	defer ts.Close()
+
+	root, err := os.MkdirTemp("", "TestBackfillMissedPolls")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	exportDir, err := os.Open(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exportDir.Close()
+
+	cs := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node0"},
+		Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}},
+	})
+	config := KubeAgentConfig{
+		ClusterHostURL:       ts.URL,
+		ForceKubeProxy:       true,
+		ConcurrentPollers:    1,
+		PollInterval:         int(interval.Seconds()),
+		ScratchDir:           root,
+		BackfillMaxIntervals: 5,
+		msExportDirectory:    exportDir,
+	}
+	nodes := NodeConnection{
+		InClusterClient: raw.NewClient(http.Client{}, true, nil, 0, false),
+		NodeMetrics:     NewEndpointMask(),
+	}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	state := newAgentState(config, nodes)
+	state.recordCollection(lastCollection{AgentVersion: cldyVersion.VERSION, Time: collected.Add(-3 * interval)})
+
+	config.backfillMissedPolls(context.TODO(), state, NewClientsetNodeSource(cs), collected)
+
+	t.Run("Ensure retained stats are requested", func(t *testing.T) {
+		if len(requests) != 1 || requests[0].NumStats <= 1 || !requests[0].Subcontainers {
+			t.Errorf("unexpected stats/container requests %+v", requests)
+		}
+	})
+
+	t.Run("Ensure each missed poll is written to a backfilled sample", func(t *testing.T) {
+		for _, poll := range []time.Time{collected.Add(-2 * interval), collected.Add(-interval)} {
+			dir := sample.Dir(root, poll)
+			data, err := os.ReadFile(filepath.Join(dir, sample.ManifestFile))
+			if err != nil {
+				t.Fatalf("expected a manifest for the poll at %v: %v", poll, err)
+			}
+			var m sample.Manifest
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatal(err)
+			}
+			expected := sample.NodeSourceName(sample.StatsPrefix, sample.ContainerSource, "node0") + ".json"
+			if !m.Backfilled || m.BackfilledAt == nil || len(m.Files) != 1 || m.Files[0] != expected {
+				t.Errorf("unexpected backfill manifest %+v", m)
+			}
+		}
+	})
+
+	t.Run("Ensure the collection is recorded for a restart", func(t *testing.T) {
+		last, err := readLastCollection(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !last.Time.Equal(collected) || last.AgentVersion != cldyVersion.VERSION {
+			t.Errorf("unexpected last collection %+v", last)
+		}
+	})
+
+	t.Run("Ensure the next poll without a gap is not backfilled", func(t *testing.T) {
+		config.backfillMissedPolls(context.TODO(), state, NewClientsetNodeSource(cs), collected.Add(interval))
+		if len(requests) != 1 {
+			t.Errorf("expected no further requests, got %d", len(requests))
+		}
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), "cldy-backfill") {
+				t.Errorf("backfill download directory %s was left behind", e.Name())
+			}
+		}
+	})
+
+	t.Run("Ensure a gap spanning a collection profile switch is not backfilled", func(t *testing.T) {
+		next := collected.Add(5 * interval)
+		state.recordCollection(lastCollection{AgentVersion: cldyVersion.VERSION, Time: next.Add(-3 * interval),
+			Profile: sample.ProfileNamespace})
+		config.backfillMissedPolls(context.TODO(), state, NewClientsetNodeSource(cs), next)
+		if len(requests) != 1 {
+			t.Errorf("expected no further requests, got %d", len(requests))
+		}
+	})
+}
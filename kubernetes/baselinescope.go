@@ -0,0 +1,203 @@
+package kubernetes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// baselineScopeFile is the file in the scratch dir recording the scope the node baselines were collected with
+const baselineScopeFile = "baseline-scope.json"
+
+// baselineScope is the configuration defining the scope of the node data of a sample. Deltas computed
+// against baselines collected with a different scope are misleading, so its change resets them.
+type baselineScope struct {
+	// Hash is the hex encoded sha256 of the settings
+	Hash     string            `json:"hash"`
+	Settings map[string]string `json:"settings"`
+}
+
+// nodeScopeSettings select the nodes collected, so a change of these alone only affects the nodes entering
+// or leaving the collection
+var nodeScopeSettings = map[string]bool{
+	"node_name_allowlist":      true,
+	"node_label_selector":      true,
+	"skip_unschedulable_nodes": true,
+	"virtual_kubelet_nodes":    true,
+}
+
+// newBaselineScope returns the scope defined by the configuration, keyed by the flag name of each setting
+func newBaselineScope(config KubeAgentConfig) baselineScope {
+	scope := baselineScope{Settings: map[string]string{
+		"node_name_allowlist":            config.NodeNameAllowlist,
+		"node_label_selector":            config.NodeLabelSelector,
+		"skip_unschedulable_nodes":       strconv.FormatBool(config.SkipUnschedulableNodes),
+		"virtual_kubelet_nodes":          config.VirtualKubeletNodes,
+		"collection_profile":             config.CollectionProfile,
+		"retrieve_probe_metrics":         strconv.FormatBool(config.RetrieveProbeMetrics),
+		"retrieve_kubelet_pods":          strconv.FormatBool(config.RetrieveKubeletPods),
+		"retrieve_node_spec":             strconv.FormatBool(config.RetrieveNodeSpec),
+		"retrieve_kubelet_configz":       strconv.FormatBool(config.RetrieveKubeletConfigz),
+		"retrieve_kubelet_metrics":       strconv.FormatBool(config.RetrieveKubeletMetrics),
+		"extra_kubelet_endpoints":        config.ExtraKubeletEndpoints,
+		"cadvisor_label_allowlist":       config.CadvisorLabelAllowlist,
+		"cadvisor_label_denylist":        config.CadvisorLabelDenylist,
+		"cadvisor_max_series_per_family": strconv.Itoa(config.CadvisorMaxSeriesPerFamily),
+	}}
+	// the map keys are marshalled sorted, so the hash is stable for the same settings
+	data, _ := json.Marshal(scope.Settings)
+	hash := sha256.Sum256(data)
+	scope.Hash = hex.EncodeToString(hash[:])
+	return scope
+}
+
+// changed returns the names of the settings that differ from the previous scope, sorted
+func (s baselineScope) changed(previous baselineScope) []string {
+	var changed []string
+	for name, value := range s.Settings {
+		if old, ok := previous.Settings[name]; !ok || old != value {
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous.Settings {
+		if _, ok := s.Settings[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// collects returns true if a node is collected with the scope
+func (s baselineScope) collects(n v1.Node) bool {
+	names, err := parseNodeNameAllowlist(s.Settings["node_name_allowlist"])
+	if err != nil || !names.allows(n.Name) {
+		return false
+	}
+	selector, err := parseNodeLabelSelector(s.Settings["node_label_selector"])
+	if err != nil || (selector != nil && !selector.Matches(labels.Set(n.Labels))) {
+		return false
+	}
+	if s.Settings["skip_unschedulable_nodes"] == "true" && n.Spec.Unschedulable {
+		return false
+	}
+	mode, err := parseVirtualKubeletNodes(s.Settings["virtual_kubelet_nodes"])
+	return err == nil && !(mode == VirtualKubeletSkip && isVirtualKubeletNode(n))
+}
+
+func readBaselineScope(scratchDir string) (baselineScope, error) {
+	var scope baselineScope
+	data, err := os.ReadFile(filepath.Join(scratchDir, baselineScopeFile))
+	if err != nil {
+		return scope, err
+	}
+	return scope, json.Unmarshal(data, &scope)
+}
+
+func writeBaselineScope(scratchDir string, scope baselineScope) error {
+	data, err := json.Marshal(scope)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filepath.Join(scratchDir, baselineScopeFile), 0644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// checkBaselineScope compares the scope of the configuration with the scope recorded by the previous run. If
+// it changed, the changed settings are logged, the affected baselines in baselineDir are removed and the
+// change is returned to mark the next sample. Only the baselines of the nodes entering or leaving the
+// collection are affected when just the node selection changed, otherwise every baseline is. The current
+// scope is recorded for the next run.
+func checkBaselineScope(config KubeAgentConfig, baselineDir string, nodes []v1.Node) *sample.ScopeChange {
+	scope := newBaselineScope(config)
+	previous, err := readBaselineScope(config.ScratchDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Warning: unable to read the baseline scope of the previous run, assuming it is unchanged: %v",
+			err)
+	}
+	defer func() {
+		if err := writeBaselineScope(config.ScratchDir, scope); err != nil {
+			log.Warnf("Warning: unable to record the baseline scope: %v", err)
+		}
+	}()
+	if err != nil || previous.Hash == scope.Hash {
+		return nil
+	}
+
+	change := &sample.ScopeChange{Reason: sample.ScopeChangedBaselinesReset, Settings: scope.changed(previous)}
+	nodesOnly := true
+	for _, name := range change.Settings {
+		log.Infof("Collection scope setting %s changed from %q to %q since the previous run", name,
+			previous.Settings[name], scope.Settings[name])
+		nodesOnly = nodesOnly && nodeScopeSettings[name]
+	}
+	if nodesOnly {
+		for _, n := range nodes {
+			if previous.collects(n) != scope.collects(n) {
+				change.Nodes = append(change.Nodes, n.Name)
+			}
+		}
+		sort.Strings(change.Nodes)
+	}
+
+	removed, err := invalidateBaselines(baselineDir, change.Nodes, nodesOnly)
+	if err != nil {
+		log.Warnf("Warning: unable to reset node baselines after the collection scope changed: %v", err)
+	}
+	if nodesOnly {
+		log.Warnf("Collection scope changed, baselines of nodes [%s] are reset, %d baseline files removed",
+			strings.Join(change.Nodes, ", "), removed)
+	} else {
+		log.Warnf("Collection scope changed, baselines of every node are reset, %d baseline files removed",
+			removed)
+	}
+	return change
+}
+
+// invalidateBaselines removes the baselines of the nodes from baselineDir, or every baseline if nodesOnly
+// is false, and returns the number of files removed
+func invalidateBaselines(baselineDir string, nodes []string, nodesOnly bool) (int, error) {
+	entries, err := os.ReadDir(baselineDir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() || !isBaselineSource(sample.BaselinePrefix, e.Name()) {
+			continue
+		}
+		if nodesOnly && !baselineOfNodes(e.Name(), nodes) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(baselineDir, e.Name())); err != nil {
+			return removed, fmt.Errorf("unable to remove baseline %s: %v", e.Name(), err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// baselineOfNodes returns true if a baseline file holds the data of one of the nodes
+func baselineOfNodes(fileName string, nodes []string) bool {
+	for _, node := range nodes {
+		if _, _, ok := nodeBaselineFile(fileName, node); ok {
+			return true
+		}
+	}
+	return false
+}
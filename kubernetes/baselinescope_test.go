@@ -0,0 +1,139 @@
+package kubernetes
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/sample"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckBaselineScope(t *testing.T) {
+	nodes := []v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "pool-a-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pool-a-2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pool-b-1"}, Spec: v1.NodeSpec{Unschedulable: true}},
+	}
+	base := KubeAgentConfig{
+		CollectionProfile:    sample.ProfileFull,
+		VirtualKubeletNodes:  VirtualKubeletSkip,
+		RetrieveProbeMetrics: true,
+	}
+
+	tests := []struct {
+		name         string
+		change       func(*KubeAgentConfig)
+		wantSettings []string
+		wantNodes    []string
+		wantRemoved  []string
+	}{
+		{
+			name:   "unchanged",
+			change: func(*KubeAgentConfig) {},
+		},
+		{
+			name:         "node selector changed",
+			change:       func(c *KubeAgentConfig) { c.NodeNameAllowlist = "pool-a-*" },
+			wantSettings: []string{"node_name_allowlist"},
+			wantNodes:    []string{"pool-b-1"},
+			wantRemoved:  []string{"baseline-summary-pool-b-1.json"},
+		},
+		{
+			name:         "node label selector set",
+			change:       func(c *KubeAgentConfig) { c.NodeLabelSelector = "team=payments" },
+			wantSettings: []string{"node_label_selector"},
+			wantNodes:    []string{"pool-a-1", "pool-a-2", "pool-b-1"},
+			wantRemoved: []string{"baseline-summary-pool-a-1.json", "baseline-summary-pool-a-2.json",
+				"baseline-summary-pool-b-1.json"},
+		},
+		{
+			name:         "unschedulable nodes skipped",
+			change:       func(c *KubeAgentConfig) { c.SkipUnschedulableNodes = true },
+			wantSettings: []string{"skip_unschedulable_nodes"},
+			wantNodes:    []string{"pool-b-1"},
+			wantRemoved:  []string{"baseline-summary-pool-b-1.json"},
+		},
+		{
+			name:         "endpoint disabled",
+			change:       func(c *KubeAgentConfig) { c.RetrieveProbeMetrics = false },
+			wantSettings: []string{"retrieve_probe_metrics"},
+			wantRemoved: []string{"baseline-summary-pool-a-1.json", "baseline-summary-pool-a-2.json",
+				"baseline-summary-pool-b-1.json"},
+		},
+		{
+			name:         "namespace profile enabled",
+			change:       func(c *KubeAgentConfig) { c.CollectionProfile = sample.ProfileNamespace },
+			wantSettings: []string{"collection_profile"},
+			wantRemoved: []string{"baseline-summary-pool-a-1.json", "baseline-summary-pool-a-2.json",
+				"baseline-summary-pool-b-1.json"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scratch := t.TempDir()
+			baselines := t.TempDir()
+			for _, n := range nodes {
+				name := filepath.Join(baselines, "baseline-summary-"+n.Name+".json")
+				if err := os.WriteFile(name, []byte(`{}`), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(baselines, "other.json"), []byte(`{}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			previous := base
+			previous.ScratchDir = scratch
+			if change := checkBaselineScope(previous, baselines, nodes); change != nil {
+				t.Fatalf("expected no change without a previous scope, got %+v", change)
+			}
+			current := previous
+			tt.change(&current)
+			change := checkBaselineScope(current, baselines, nodes)
+
+			if tt.wantSettings == nil {
+				if change != nil {
+					t.Fatalf("expected no change, got %+v", change)
+				}
+			} else {
+				if change == nil || change.Reason != sample.ScopeChangedBaselinesReset {
+					t.Fatalf("expected the scope change to be marked, got %+v", change)
+				}
+				if !reflect.DeepEqual(change.Settings, tt.wantSettings) {
+					t.Errorf("expected changed settings %v, got %v", tt.wantSettings, change.Settings)
+				}
+				if !reflect.DeepEqual(change.Nodes, tt.wantNodes) {
+					t.Errorf("expected nodes reset %v, got %v", tt.wantNodes, change.Nodes)
+				}
+			}
+			for _, n := range nodes {
+				name := "baseline-summary-" + n.Name + ".json"
+				_, err := os.Stat(filepath.Join(baselines, name))
+				removed := false
+				for _, r := range tt.wantRemoved {
+					removed = removed || r == name
+				}
+				if removed != os.IsNotExist(err) {
+					t.Errorf("expected baseline %s removed %v, got %v", name, removed, err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(baselines, "other.json")); err != nil {
+				t.Errorf("expected files other than baselines to be kept: %v", err)
+			}
+
+			// the scope is recorded, so the change is only reported once
+			if change := checkBaselineScope(current, baselines, nodes); change != nil {
+				t.Errorf("expected the change to be recorded, got %+v", change)
+			}
+		})
+	}
+
+	state := newAgentState(KubeAgentConfig{}, NodeConnection{})
+	state.recordScopeChange(&sample.ScopeChange{Reason: sample.ScopeChangedBaselinesReset})
+	if state.takeScopeChange() == nil || state.takeScopeChange() != nil {
+		t.Error("expected the scope change to mark only the first sample")
+	}
+}
@@ -0,0 +1,83 @@
+package kubernetes
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudability/metrics-agent/sample"
+	log "github.com/sirupsen/logrus"
+)
+
+// cadvisorMetricsPath is the kubelet path of the cadvisor metrics, collected by extra kubelet endpoints
+const cadvisorMetricsPath = "/metrics/cadvisor"
+
+// newCadvisorFilter returns a transform limiting the label cardinality of the cadvisor metrics of a node,
+// recording truncated families in the series truncations of the poll, or nil if the config does not limit it
+func newCadvisorFilter(config KubeAgentConfig, cycle pollCycle, nodeName, source string) *prometheusFilter {
+	labels := newLabelFilter(config.CadvisorLabelAllowlist, config.CadvisorLabelDenylist)
+	if labels.empty() && config.CadvisorMaxSeriesPerFamily <= 0 {
+		return nil
+	}
+	return &prometheusFilter{
+		labels:    labels,
+		maxSeries: config.CadvisorMaxSeriesPerFamily,
+		truncated: func(dropped map[string]int) {
+			cycle.seriesTruncations.record(nodeName, source, dropped)
+		},
+	}
+}
+
+// seriesTruncationLog collects the metric families truncated to the series limit during a collection. It is
+// safe for concurrent use, and a nil log records nothing.
+type seriesTruncationLog struct {
+	mu          sync.Mutex
+	truncations []sample.SeriesTruncation
+}
+
+func newSeriesTruncationLog() *seriesTruncationLog {
+	return &seriesTruncationLog{}
+}
+
+// record records the series dropped of each family truncated in the source of the node
+func (l *seriesTruncationLog) record(nodeName, source string, dropped map[string]int) {
+	for family, n := range dropped {
+		log.Warnf("Metric family %s of %s on node %s exceeded the series limit, %d series were dropped", family,
+			source, nodeName, n)
+	}
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for family, n := range dropped {
+		l.truncations = append(l.truncations, sample.SeriesTruncation{Node: nodeName, Source: source,
+			Family: family, Dropped: n})
+	}
+}
+
+// report returns the truncations recorded, sorted by node, source and family
+func (l *seriesTruncationLog) report() []sample.SeriesTruncation {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	truncations := append([]sample.SeriesTruncation{}, l.truncations...)
+	sort.Slice(truncations, func(i, j int) bool {
+		a, b := truncations[i], truncations[j]
+		if a.Node != b.Node {
+			return a.Node < b.Node
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Family < b.Family
+	})
+	return truncations
+}
+
+// isCadvisorEndpoint returns true if the extra kubelet endpoint collects the cadvisor metrics
+func isCadvisorEndpoint(e ExtraEndpoint) bool {
+	return strings.HasPrefix(e.Path, cadvisorMetricsPath)
+}
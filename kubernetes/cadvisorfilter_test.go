@@ -0,0 +1,164 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+)
+
+func TestLabelFilter(t *testing.T) {
+	tests := []struct {
+		allow, deny string
+		line        string
+		expected    string
+	}{
+		{line: `m{a="1",hash="x"} 1` + "\n", expected: `m{a="1",hash="x"} 1` + "\n"},
+		{deny: "hash", line: `m{a="1",hash="x"} 1` + "\n", expected: `m{a="1"} 1` + "\n"},
+		{deny: "hash", line: `m{hash="x"} 1 1700000000`, expected: `m 1 1700000000`},
+		{allow: "a", line: `m{a="1",b="2",le="0.5"} 1`, expected: `m{a="1",le="0.5"} 1`},
+		{allow: "a, c", deny: "c", line: `m{ a = "1" , c="3",} 1`, expected: `m{a = "1"} 1`},
+		// quotes, commas and braces within label values
+		{deny: "b", line: `m{b="x\",}{=y",a="q\\"} 1`, expected: `m{a="q\\"} 1`},
+		{deny: "a", line: `m 1`, expected: `m 1`},
+		// labels that can not be parsed leave the line unchanged
+		{deny: "a", line: `m{a=1} 1`, expected: `m{a=1} 1`},
+		{deny: "a", line: `m{a="1`, expected: `m{a="1`},
+	}
+	for _, tc := range tests {
+		if filtered := newLabelFilter(tc.allow, tc.deny).apply(tc.line); filtered != tc.expected {
+			t.Errorf("expected %q with allow %q and deny %q, got %q", tc.expected, tc.allow, tc.deny, filtered)
+		}
+	}
+}
+
+func TestPrometheusFilterSeriesLimit(t *testing.T) {
+	body := `# HELP container_cpu_usage_seconds_total Cumulative cpu time consumed
+# TYPE container_cpu_usage_seconds_total counter
+container_cpu_usage_seconds_total{container="a",hash="1"} 1
+container_cpu_usage_seconds_total{container="b",hash="2"} 2
+container_cpu_usage_seconds_total{container="c",hash="3"} 3
+# TYPE machine_cpu_cores gauge
+machine_cpu_cores 4
+`
+	var dropped map[string]int
+	filter := &prometheusFilter{labels: newLabelFilter("", "hash"), maxSeries: 2,
+		truncated: func(d map[string]int) { dropped = d }}
+	var out bytes.Buffer
+	if _, err := filter.Wrap(&out).Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.Finish(nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP container_cpu_usage_seconds_total Cumulative cpu time consumed
+# TYPE container_cpu_usage_seconds_total counter
+container_cpu_usage_seconds_total{container="a"} 1
+container_cpu_usage_seconds_total{container="b"} 2
+# TYPE machine_cpu_cores gauge
+machine_cpu_cores 4
+`
+	if out.String() != expected {
+		t.Errorf("expected the family truncated to 2 series without the hash label, got:\n%s", out.String())
+	}
+	if len(dropped) != 1 || dropped["container_cpu_usage_seconds_total"] != 1 {
+		t.Errorf("expected one series dropped of the truncated family, got %v", dropped)
+	}
+
+	// a retried request starts counting afresh
+	out.Reset()
+	dropped = nil
+	if _, err := filter.Wrap(&out).Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.Finish(nil); err != nil || out.String() != expected || len(dropped) != 1 {
+		t.Errorf("expected the same output for a retried request, got %v %v:\n%s", err, dropped, out.String())
+	}
+}
+
+func TestCadvisorExtraEndpointFilter(t *testing.T) {
+	var series strings.Builder
+	series.WriteString("# TYPE container_memory_working_set_bytes gauge\n")
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(&series, "container_memory_working_set_bytes{container=\"c%d\",pod_template_hash=\"%x\"} 1\n",
+			i, i)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, series.String())
+	}))
+	defer ts.Close()
+
+	endpoints, err := ParseExtraEndpoints(`[{"name":"cadvisor","path":"/metrics/cadvisor"},` +
+		`{"name":"other","path":"/metrics/other"}]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mask := NewEndpointMask()
+	for _, e := range endpoints {
+		mask.SetAvailability(e.endpoint(), Proxy, true)
+	}
+	cms := []ConnectionMethod{{
+		ConnType:     Proxy,
+		API:          setupProxyAPI(ts.URL, "node0"),
+		client:       raw.NewClient(http.Client{}, true, nil, 0, false),
+		FriendlyName: proxy,
+	}}
+	source := sourceName{prefix: sample.StatsPrefix, nodeName: "node0"}
+
+	t.Run("Ensure cadvisor metrics are unchanged by default", func(t *testing.T) {
+		workDir := tempWorkDir(t)
+		config := KubeAgentConfig{extraEndpoints: endpoints}
+		nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir}
+		retrieveExtraEndpoints(context.TODO(), nd, config, pollCycle{}, mask, cms, source)
+
+		data, err := os.ReadFile(workDir.Name() + "/stats-cadvisor-node0.txt")
+		if err != nil || string(data) != series.String() {
+			t.Errorf("expected the cadvisor metrics unchanged, got %v:\n%s", err, data)
+		}
+	})
+
+	t.Run("Ensure cadvisor label cardinality is limited", func(t *testing.T) {
+		workDir := tempWorkDir(t)
+		config := KubeAgentConfig{extraEndpoints: endpoints, CadvisorLabelDenylist: "pod_template_hash",
+			CadvisorMaxSeriesPerFamily: 3}
+		cycle := pollCycle{seriesTruncations: newSeriesTruncationLog()}
+		nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir}
+		retrieveExtraEndpoints(context.TODO(), nd, config, cycle, mask, cms, source)
+
+		data, err := os.ReadFile(workDir.Name() + "/stats-cadvisor-node0.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "pod_template_hash") || strings.Count(string(data), "\n") != 4 {
+			t.Errorf("expected 3 series without the denied label, got:\n%s", data)
+		}
+		// only extra endpoints of the cadvisor metrics are filtered
+		other, err := os.ReadFile(workDir.Name() + "/stats-other-node0.txt")
+		if err != nil || string(other) != series.String() {
+			t.Errorf("expected other extra endpoints unchanged, got %v:\n%s", err, other)
+		}
+		expected := []sample.SeriesTruncation{{Node: "node0", Source: "cadvisor",
+			Family: "container_memory_working_set_bytes", Dropped: 2}}
+		if report := cycle.seriesTruncations.report(); fmt.Sprint(report) != fmt.Sprint(expected) {
+			t.Errorf("expected truncation %+v, got %+v", expected, report)
+		}
+	})
+}
+
+func tempWorkDir(t *testing.T) *util.WorkDir {
+	dir, err := os.MkdirTemp("", "TestCadvisorExtraEndpointFilter")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return util.NewWorkDir(dir)
+}
@@ -0,0 +1,93 @@
+package kubernetes
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// summarizeCluster computes the cluster summary from the resource exports in the sample directory, so the
+// summary always agrees with the sample even when exports were trimmed to stay within the size cap.
+// Resources not exported, such as those the agent is not permitted to list, are counted as zero.
+func summarizeCluster(msd string) (summary sample.ClusterSummary, err error) {
+	err = forEachRecord(filepath.Join(msd, sample.ResourceFile("nodes")), func(record []byte) error {
+		var node v1.Node
+		if err := json.Unmarshal(record, &node); err != nil {
+			return err
+		}
+		summary.Nodes++
+		summary.AllocatableCPUMillicores += node.Status.Allocatable.Cpu().MilliValue()
+		summary.AllocatableMemoryBytes += node.Status.Allocatable.Memory().Value()
+		return nil
+	})
+	if err != nil {
+		return summary, fmt.Errorf("unable to summarize nodes: %v", err)
+	}
+	if summary.Pods, err = countRecords(filepath.Join(msd, sample.ResourceFile("pods"))); err != nil {
+		return summary, fmt.Errorf("unable to summarize pods: %v", err)
+	}
+	if summary.Namespaces, err = countRecords(filepath.Join(msd, sample.ResourceFile("namespaces"))); err != nil {
+		return summary, fmt.Errorf("unable to summarize namespaces: %v", err)
+	}
+	return summary, nil
+}
+
+// writeClusterSummary writes the cluster summary to the sample
+func writeClusterSummary(workDir *util.WorkDir, summary sample.ClusterSummary) error {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Cluster summary: %d nodes, %d pods, %d namespaces", summary.Nodes, summary.Pods,
+		summary.Namespaces)
+	return os.WriteFile(filepath.Join(workDir.Name(), sample.ClusterSummaryFile), data, 0644)
+}
+
+// countRecords returns the number of records in a resource export, 0 if it does not exist
+func countRecords(path string) (int, error) {
+	count := 0
+	err := forEachRecord(path, func([]byte) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// forEachRecord calls fn with each newline terminated record of a resource export, a missing export has
+// no records
+func forEachRecord(path string, fn func(record []byte) error) (rerr error) {
+	//nolint gosec
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer util.SafeClose(f.Close, &rerr)
+
+	r := bufio.NewReader(f)
+	for {
+		record, err := r.ReadBytes('\n')
+		if len(record) > 1 {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestClusterSummary(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestClusterSummary")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	nodes := ""
+	for _, cpu := range []string{"1500m", "2"} {
+		node := v1.Node{Status: v1.NodeStatus{Allocatable: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse(cpu),
+			v1.ResourceMemory: resource.MustParse("1Gi"),
+		}}}
+		data, err := json.Marshal(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes += string(data) + "\n"
+	}
+	writeSampleFiles(t, dir, map[string]string{
+		sample.ResourceFile("nodes"): nodes,
+		sample.ResourceFile("pods"):  "{}\n{}\n{}\n",
+	})
+
+	summary, err := summarizeCluster(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := sample.ClusterSummary{
+		Nodes:                    2,
+		AllocatableCPUMillicores: 3500,
+		AllocatableMemoryBytes:   2 << 30,
+		Pods:                     3,
+	}
+	if summary != expected {
+		t.Errorf("expected %+v, got %+v", expected, summary)
+	}
+
+	workDir := util.NewWorkDir(dir)
+	if err := writeClusterSummary(workDir, summary); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if read, err := sample.ReadClusterSummary(dir); err != nil || read != summary {
+		t.Errorf("expected the written summary to be read back, got %+v %v", read, err)
+	}
+}
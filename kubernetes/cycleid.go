@@ -0,0 +1,80 @@
+package kubernetes
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cycleLogField is the field the log lines emitted during a poll are tagged with the cycle ID of the poll in
+const cycleLogField = "cycle_id"
+
+// crockfordBase32 is the alphabet cycle IDs are encoded in
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newCycleID returns the ID of a poll started at now, a ULID: 48 bits of milliseconds since the epoch
+// followed by 80 random bits, encoded as 26 characters of Crockford base32 so the IDs sort by start time.
+// The ID links the logs, the sample manifest and the upload of the poll.
+func newCycleID(now time.Time) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(now.UnixMilli())<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		// the ID only needs to be unique, not unpredictable
+		binary.BigEndian.PutUint64(b[8:], uint64(now.UnixNano()))
+	}
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	// 26 characters of 5 bits hold the 128 bits of the ID, the top 2 bits are always 0
+	id := make([]byte, 26)
+	for i := len(id) - 1; i >= 0; i-- {
+		id[i] = crockfordBase32[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id)
+}
+
+// cycleLogHook tags every log line emitted while a poll is in progress with the cycle ID of the poll, so the
+// log lines of a poll can be found from the ID of its sample
+type cycleLogHook struct {
+	id atomic.Pointer[string]
+}
+
+// cycleLog is the hook of the standard logger tagging the log lines of the poll in progress
+var cycleLog = &cycleLogHook{}
+
+// begin tags the log lines emitted from now on with the cycle ID
+func (h *cycleLogHook) begin(id string) {
+	h.id.Store(&id)
+}
+
+// end stops tagging the log lines once the poll has ended
+func (h *cycleLogHook) end() {
+	h.id.Store(nil)
+}
+
+func (h *cycleLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *cycleLogHook) Fire(entry *log.Entry) error {
+	if id := h.id.Load(); id != nil {
+		if _, ok := entry.Data[cycleLogField]; !ok {
+			entry.Data[cycleLogField] = *id
+		}
+	}
+	return nil
+}
+
+// installCycleLogHook adds the cycle log hook to the standard logger ahead of its other hooks, so the log
+// lines retained by them, eg: the recent log buffer written to samples, are tagged too
+func installCycleLogHook() {
+	hooks := make(log.LevelHooks)
+	hooks.Add(cycleLog)
+	for level, h := range log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) {
+		hooks[level] = append(hooks[level], h...)
+	}
+	log.StandardLogger().ReplaceHooks(hooks)
+}
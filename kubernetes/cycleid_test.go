@@ -0,0 +1,92 @@
+package kubernetes
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestNewCycleID(t *testing.T) {
+	// the timestamp of the example of the ULID specification
+	start := time.UnixMilli(1469918176385)
+	id := newCycleID(start)
+	if len(id) != 26 || !strings.HasPrefix(id, "01ARYZ6S41") {
+		t.Errorf("expected a ULID of the start time, got %s", id)
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(crockfordBase32, c) {
+			t.Errorf("expected the ID to be Crockford base32, got %s", id)
+		}
+	}
+
+	ids := make([]string, 0, 100)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := newCycleID(start.Add(time.Duration(i) * time.Millisecond))
+		if seen[id] {
+			t.Fatalf("expected unique IDs, got %s twice", id)
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if !sort.StringsAreSorted(ids) {
+		t.Errorf("expected the IDs to sort by start time, got %v", ids)
+	}
+}
+
+func TestCycleLogHook(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	cycle := &cycleLogHook{}
+	logger.AddHook(cycle)
+
+	logger.Info("before the poll")
+	cycle.begin("01ARYZ6S41TSV4RRFFQ69G5FAV")
+	logger.Info("during the poll")
+	logger.WithField(cycleLogField, "other").Info("tagged already")
+	cycle.end()
+	logger.Info("after the poll")
+
+	entries := hook.AllEntries()
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 log lines, got %d", len(entries))
+	}
+	for i, want := range []interface{}{nil, "01ARYZ6S41TSV4RRFFQ69G5FAV", "other", nil} {
+		if got := entries[i].Data[cycleLogField]; got != want {
+			t.Errorf("expected line %q to be tagged %v, got %v", entries[i].Message, want, got)
+		}
+	}
+}
+
+// cycleTagHook records the cycle ID each log line is tagged with as it fires
+type cycleTagHook struct {
+	tags []interface{}
+}
+
+func (h *cycleTagHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *cycleTagHook) Fire(entry *log.Entry) error {
+	h.tags = append(h.tags, entry.Data[cycleLogField])
+	return nil
+}
+
+func TestInstallCycleLogHook(t *testing.T) {
+	previous := log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	defer log.StandardLogger().ReplaceHooks(previous)
+	recorded := &cycleTagHook{}
+	log.AddHook(recorded)
+
+	installCycleLogHook()
+	cycleLog.begin("01ARYZ6S41TSV4RRFFQ69G5FAV")
+	defer cycleLog.end()
+	log.Info("during the poll")
+	// the hooks installed before see the tag as the cycle log hook fires first
+	if len(recorded.tags) != 1 || recorded.tags[0] != "01ARYZ6S41TSV4RRFFQ69G5FAV" {
+		t.Errorf("expected the line to be tagged before the other hooks fire, got %v", recorded.tags)
+	}
+}
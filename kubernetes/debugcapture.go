@@ -0,0 +1,385 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultDebugCaptureMaxBytes is the default cap on the size of the data retained by debug captures
+	DefaultDebugCaptureMaxBytes = 64 << 20
+	// DefaultDebugCaptureRetention is the default time (in seconds) the data of a debug capture is retained
+	DefaultDebugCaptureRetention = 24 * 60 * 60
+)
+
+// debugCapturesDir is the directory within the scratch dir the data of the nodes captured for debugging is
+// retained in, so it can be collected for a support escalation
+const debugCapturesDir = "debug-captures"
+
+// debugCaptureIndexFile lists the captures retained in the debug captures directory
+const debugCaptureIndexFile = "captures.json"
+
+// directories of a capture holding the raw responses of the node and the files written for it to the sample
+const (
+	rawCaptureDir      = "raw"
+	filteredCaptureDir = "filtered"
+)
+
+// debugCaptureTimeLayout is the layout of the capture time prefixing the directory of a capture
+const debugCaptureTimeLayout = "20060102T150405Z"
+
+// errDebugCaptureFull stops the copy of a file once the retained data reaches its size cap
+var errDebugCaptureFull = errors.New("debug capture size cap reached")
+
+// debugCaptureMaxBytes returns the cap on the size of the data retained by debug captures
+func debugCaptureMaxBytes(config KubeAgentConfig) int64 {
+	if config.DebugCaptureMaxBytes <= 0 {
+		return DefaultDebugCaptureMaxBytes
+	}
+	return config.DebugCaptureMaxBytes
+}
+
+// debugCaptureRetention returns the time the data of a debug capture is retained
+func debugCaptureRetention(config KubeAgentConfig) time.Duration {
+	if config.DebugCaptureRetention <= 0 {
+		return DefaultDebugCaptureRetention * time.Second
+	}
+	return time.Duration(config.DebugCaptureRetention) * time.Second
+}
+
+// logDebugCapture logs where the nodes to capture are listed and where their data is retained
+func logDebugCapture(config KubeAgentConfig) {
+	if config.DebugCaptureFile == "" {
+		return
+	}
+	log.Infof("Nodes listed in %s are captured for debugging by the next collection, their data is retained in "+
+		"%s for %v, up to %d bytes", config.DebugCaptureFile, filepath.Join(config.ScratchDir, debugCapturesDir),
+		debugCaptureRetention(config), debugCaptureMaxBytes(config))
+}
+
+// readDebugCaptureNodes reads the node names listed in the debug capture file, separated by commas or
+// whitespace. A missing file lists no nodes, eg: a config map key only set while a node is captured.
+func readDebugCaptureNodes(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.FieldsFunc(string(data), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}), nil
+}
+
+// readDebugCaptureIndex reads the captures retained in the debug captures directory
+func readDebugCaptureIndex(dir string) ([]sample.DebugCapture, error) {
+	data, err := os.ReadFile(filepath.Join(dir, debugCaptureIndexFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var index []sample.DebugCapture
+	if err = json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", debugCaptureIndexFile, err)
+	}
+	return index, nil
+}
+
+// writeDebugCaptureIndex replaces the captures retained in the debug captures directory
+func writeDebugCaptureIndex(dir string, index []sample.DebugCapture) error {
+	return util.WriteFileAtomic(filepath.Join(dir, debugCaptureIndexFile), 0644, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(index)
+	})
+}
+
+// pruneDebugCaptures removes the captures that expired by now, returning the captures still retained
+func pruneDebugCaptures(dir string, now time.Time) []sample.DebugCapture {
+	index, err := readDebugCaptureIndex(dir)
+	if err != nil {
+		log.Warnf("Warning: unable to read the retained debug captures: %v", err)
+		return nil
+	}
+	var retained []sample.DebugCapture
+	for _, c := range index {
+		if now.Before(c.Expires) {
+			retained = append(retained, c)
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, c.Dir)); err != nil {
+			log.Warnf("Warning: unable to remove the expired debug capture of node %s: %v", c.Node, err)
+			retained = append(retained, c)
+			continue
+		}
+		log.Infof("Removed the debug capture of node %s taken at %s, it expired at %s", c.Node,
+			c.Time.Format(time.RFC3339), c.Expires.Format(time.RFC3339))
+	}
+	if len(retained) != len(index) {
+		if err := writeDebugCaptureIndex(dir, retained); err != nil {
+			log.Warnf("Warning: unable to update the retained debug captures: %v", err)
+		}
+	}
+	return retained
+}
+
+// debugCaptures retains the data of the nodes listed for debug capture during a collection. A listed node is
+// captured by the first collection it is collected in, and again only once it is listed anew. It is safe
+// for concurrent use, and nil captures nothing.
+type debugCaptures struct {
+	dir       string
+	now       time.Time
+	retention time.Duration
+	maxBytes  int64
+	mu        sync.Mutex
+	// remaining is the size of the data that can still be retained before the size cap is reached
+	remaining int64
+	// pending are the listed nodes not yet captured
+	pending map[string]bool
+	nodes   map[string]*nodeCapture
+}
+
+// newDebugCaptures removes the expired debug captures and returns the captures of the listed nodes not yet
+// captured, nil if there are none
+func newDebugCaptures(config KubeAgentConfig, state *AgentState, now time.Time) *debugCaptures {
+	if config.DebugCaptureFile == "" {
+		return nil
+	}
+	dir := filepath.Join(config.ScratchDir, debugCapturesDir)
+	retained := pruneDebugCaptures(dir, now)
+	listed, err := readDebugCaptureNodes(config.DebugCaptureFile)
+	if err != nil {
+		log.Warnf("Warning: unable to read the nodes listed for debug capture: %v", err)
+		return nil
+	}
+	pending := state.pendingDebugCaptures(listed)
+	if len(pending) == 0 {
+		return nil
+	}
+	d := &debugCaptures{
+		dir:       dir,
+		now:       now,
+		retention: debugCaptureRetention(config),
+		maxBytes:  debugCaptureMaxBytes(config),
+		pending:   pending,
+		nodes:     map[string]*nodeCapture{},
+	}
+	d.remaining = d.maxBytes
+	for _, c := range retained {
+		d.remaining -= c.Bytes
+	}
+	if d.remaining < 0 {
+		d.remaining = 0
+	}
+	return d
+}
+
+// forNode returns the capture of the node, nil if it is not captured
+func (d *debugCaptures) forNode(nodeName string) *nodeCapture {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.pending[nodeName] {
+		return nil
+	}
+	if c, ok := d.nodes[nodeName]; ok {
+		return c
+	}
+	c := &nodeCapture{
+		captures: d,
+		dir:      d.now.UTC().Format(debugCaptureTimeLayout) + "-" + nodeName,
+		raw:      map[string]int64{},
+		filtered: map[string]int64{},
+	}
+	for _, sub := range []string{rawCaptureDir, filteredCaptureDir} {
+		if err := os.MkdirAll(filepath.Join(d.dir, c.dir, sub), 0755); err != nil {
+			log.Warnf("Warning: unable to capture node %s for debugging: %v", nodeName, err)
+			return nil
+		}
+	}
+	d.nodes[nodeName] = c
+	return c
+}
+
+// reserve reserves n bytes of the retained data, returning false if the size cap would be exceeded
+func (d *debugCaptures) reserve(n int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if n > d.remaining {
+		return false
+	}
+	d.remaining -= n
+	return true
+}
+
+// release returns n reserved bytes, eg: of a file replaced by a later attempt
+func (d *debugCaptures) release(n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remaining += n
+}
+
+// finish records the nodes captured during the collection in state and in the index of the debug captures
+// directory, and returns them sorted by node
+func (d *debugCaptures) finish(state *AgentState) []sample.DebugCapture {
+	if d == nil {
+		return nil
+	}
+	// the node captures are reported without holding the lock, as they take it to release the reserved bytes
+	d.mu.Lock()
+	nodes := make(map[string]*nodeCapture, len(d.nodes))
+	for nodeName, c := range d.nodes {
+		nodes[nodeName] = c
+	}
+	d.mu.Unlock()
+	var captures []sample.DebugCapture
+	for nodeName := range d.pending {
+		c, ok := nodes[nodeName]
+		if !ok {
+			log.Infof("Node %s listed for debug capture was not collected, it is captured once it is collected",
+				nodeName)
+			continue
+		}
+		capture := c.report(nodeName, d.now, d.retention)
+		captures = append(captures, capture)
+		state.recordDebugCapture(nodeName)
+		log.Infof("Debug capture: retained %d files (%d bytes) of node %s in %s until %s", len(capture.Files),
+			capture.Bytes, nodeName, filepath.Join(d.dir, capture.Dir), capture.Expires.Format(time.RFC3339))
+		if capture.Truncated {
+			log.Warnf("Warning: the debug capture of node %s is incomplete as the retained debug captures "+
+				"reached their size cap of %d bytes", nodeName, d.maxBytes)
+		}
+	}
+	if len(captures) == 0 {
+		return nil
+	}
+	sort.Slice(captures, func(i, j int) bool { return captures[i].Node < captures[j].Node })
+
+	index, err := readDebugCaptureIndex(d.dir)
+	if err == nil {
+		err = writeDebugCaptureIndex(d.dir, append(index, captures...))
+	}
+	if err != nil {
+		log.Warnf("Warning: unable to record the debug captures in %s: %v", debugCaptureIndexFile, err)
+	}
+	return captures
+}
+
+// nodeCapture retains the raw responses of a node and the files written for it to the sample. It implements
+// raw.BodyCapture so is set on the clients the node is fetched with.
+type nodeCapture struct {
+	captures *debugCaptures
+	// dir is the directory of the capture, relative to the debug captures directory
+	dir string
+	mu  sync.Mutex
+	// raw and filtered are the sizes of the captured files, by file name
+	raw       map[string]int64
+	filtered  map[string]int64
+	truncated bool
+}
+
+// Capture copies a raw response of the node into the raw directory of the capture
+func (c *nodeCapture) Capture(filename string) io.WriteCloser {
+	return c.create(rawCaptureDir, c.raw, filename)
+}
+
+// create creates a captured file in the sub directory of the capture, replacing the file of an earlier
+// attempt
+func (c *nodeCapture) create(sub string, sizes map[string]int64, filename string) io.WriteCloser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.captures.release(sizes[filename])
+	sizes[filename] = 0
+	f, err := os.Create(filepath.Join(c.captures.dir, c.dir, sub, filepath.Base(filename)))
+	if err != nil {
+		log.Warnf("Warning: unable to capture %s for debugging: %v", filename, err)
+		return nil
+	}
+	return &capturedFile{capture: c, sizes: sizes, name: filename, f: f}
+}
+
+// retainFiltered copies the files written to workDir for the raw responses captured into the filtered
+// directory of the capture
+func (c *nodeCapture) retainFiltered(workDir string) {
+	c.mu.Lock()
+	var names []string
+	for name := range c.raw {
+		names = append(names, name)
+	}
+	c.mu.Unlock()
+	for _, name := range names {
+		src, err := os.Open(filepath.Join(workDir, name))
+		if err != nil {
+			// the response was rejected or replaced, eg: by the namespace rollup of the summary
+			continue
+		}
+		if w := c.create(filteredCaptureDir, c.filtered, name); w != nil {
+			if _, err := io.Copy(w, src); err != nil && !errors.Is(err, errDebugCaptureFull) {
+				log.Warnf("Warning: unable to capture %s for debugging: %v", name, err)
+			}
+			_ = w.Close()
+		}
+		_ = src.Close()
+	}
+}
+
+// report returns the record of the capture
+func (c *nodeCapture) report(nodeName string, now time.Time, retention time.Duration) sample.DebugCapture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	capture := sample.DebugCapture{
+		Node:      nodeName,
+		Time:      now.UTC(),
+		Dir:       c.dir,
+		Truncated: c.truncated,
+		Expires:   now.UTC().Add(retention),
+	}
+	for name, size := range c.raw {
+		capture.Files = append(capture.Files, name)
+		capture.Bytes += size + c.filtered[name]
+	}
+	sort.Strings(capture.Files)
+	return capture
+}
+
+// capturedFile is a file of a capture, written within the size cap of the retained data
+type capturedFile struct {
+	capture *nodeCapture
+	sizes   map[string]int64
+	name    string
+	f       *os.File
+}
+
+func (w *capturedFile) Write(p []byte) (int, error) {
+	c := w.capture
+	if !c.captures.reserve(int64(len(p))) {
+		c.mu.Lock()
+		c.truncated = true
+		c.mu.Unlock()
+		return 0, errDebugCaptureFull
+	}
+	c.mu.Lock()
+	w.sizes[w.name] += int64(len(p))
+	c.mu.Unlock()
+	return w.f.Write(p)
+}
+
+func (w *capturedFile) Close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,159 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestReadDebugCaptureNodes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "debug-capture")
+	if nodes, err := readDebugCaptureNodes(file); nodes != nil || err != nil {
+		t.Errorf("expected a missing file to list no nodes, got %v %v", nodes, err)
+	}
+	if err := os.WriteFile(file, []byte("node0, node1\nnode2\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := readDebugCaptureNodes(file)
+	if err != nil || strings.Join(nodes, ",") != "node0,node1,node2" {
+		t.Errorf("unexpected nodes %v %v", nodes, err)
+	}
+}
+
+// debugCaptureConfig returns a config capturing the nodes listed in a file of the scratch dir
+func debugCaptureConfig(t *testing.T, listed string) KubeAgentConfig {
+	config := KubeAgentConfig{ScratchDir: t.TempDir()}
+	config.DebugCaptureFile = filepath.Join(config.ScratchDir, "debug-capture")
+	if err := os.WriteFile(config.DebugCaptureFile, []byte(listed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestDebugCaptures(t *testing.T) {
+	t.Run("Ensure the raw and filtered data of listed nodes is retained once", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			node := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/nodes/"), "/")[0]
+			_, _ = w.Write([]byte(`{"node":{"nodeName":"` + node + `"}}`))
+		}))
+		defer ts.Close()
+		dir := t.TempDir()
+		workDir := util.NewWorkDir(dir)
+		c := http.Client{Transport: &http.Transport{
+			// nolint gosec
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		nodes := NodeConnection{InClusterClient: raw.NewClient(c, true, nil, 0, false), NodeMetrics: NewEndpointMask()}
+		nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+		ns := testNodeSource{Nodes: []v1.Node{addressedNode("node0", "10.0.0.1"),
+			addressedNode("node1", "10.0.0.2")}}
+
+		config := debugCaptureConfig(t, "node0\nnode9")
+		config.ClusterHostURL, config.ConcurrentPollers, config.ForceKubeProxy, config.Dev = ts.URL, 2, true, true
+		state := newAgentState(config, nodes)
+		now := time.Now()
+		cycle := pollCycle{debugCaptures: newDebugCaptures(config, state, now)}
+
+		failed, err := downloadNodeData(context.TODO(), sample.StatsPrefix, config, cycle, nodes, workDir, ns, nil, nil,
+			newNodeHealthSnapshot())
+		if err != nil || len(failed) != 0 {
+			t.Fatalf("unexpected failure: %v %v", failed, err)
+		}
+		captures := cycle.debugCaptures.finish(state)
+		if len(captures) != 1 || captures[0].Node != "node0" || len(captures[0].Files) != 1 ||
+			captures[0].Truncated || !captures[0].Expires.Equal(now.UTC().Add(24*time.Hour)) {
+			t.Fatalf("expected only node0 to be captured, got %+v", captures)
+		}
+
+		captureDir := filepath.Join(config.ScratchDir, debugCapturesDir, captures[0].Dir)
+		written, _ := os.ReadFile(filepath.Join(dir, captures[0].Files[0]))
+		for _, sub := range []string{rawCaptureDir, filteredCaptureDir} {
+			data, err := os.ReadFile(filepath.Join(captureDir, sub, captures[0].Files[0]))
+			if err != nil || string(data) != string(written) {
+				t.Errorf("expected the %s summary to be captured, got %q %v", sub, data, err)
+			}
+		}
+		if captures[0].Bytes != int64(2*len(written)) {
+			t.Errorf("expected the raw and filtered bytes to be counted, got %d", captures[0].Bytes)
+		}
+		index, err := readDebugCaptureIndex(filepath.Join(config.ScratchDir, debugCapturesDir))
+		if err != nil || len(index) != 1 || index[0].Dir != captures[0].Dir {
+			t.Errorf("expected the capture to be indexed, got %+v %v", index, err)
+		}
+
+		// the node is not captured again while it is listed, but is once it is listed anew
+		if d := newDebugCaptures(config, state, now); d.forNode("node0") != nil || !d.pending["node9"] {
+			t.Errorf("expected only the uncollected node to still be pending, got %+v", d)
+		}
+		if err := os.WriteFile(config.DebugCaptureFile, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if d := newDebugCaptures(config, state, now); d != nil {
+			t.Errorf("expected no captures without listed nodes, got %+v", d)
+		}
+		if err := os.WriteFile(config.DebugCaptureFile, []byte("node0"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if d := newDebugCaptures(config, state, now); !d.pending["node0"] {
+			t.Errorf("expected the node listed anew to be captured again, got %+v", d)
+		}
+	})
+
+	t.Run("Ensure captures are cut short at the size cap", func(t *testing.T) {
+		config := debugCaptureConfig(t, "node0")
+		config.DebugCaptureMaxBytes = 10
+		state := newAgentState(config, NodeConnection{})
+		d := newDebugCaptures(config, state, time.Now())
+
+		w := d.forNode("node0").Capture("stats-summary-node0.json")
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("expected the capture to fit the cap, got %v", err)
+		}
+		if _, err := w.Write([]byte("a")); err != errDebugCaptureFull {
+			t.Errorf("expected the capture to be full, got %v", err)
+		}
+		_ = w.Close()
+		captures := d.finish(state)
+		if len(captures) != 1 || !captures[0].Truncated || captures[0].Bytes != 10 {
+			t.Errorf("expected a truncated capture, got %+v", captures)
+		}
+	})
+
+	t.Run("Ensure expired captures are removed", func(t *testing.T) {
+		config := debugCaptureConfig(t, "node0")
+		config.DebugCaptureRetention = 60
+		state := newAgentState(config, NodeConnection{})
+		taken := time.Now()
+		d := newDebugCaptures(config, state, taken)
+		w := d.forNode("node0").Capture("stats-summary-node0.json")
+		_, _ = w.Write([]byte("{}"))
+		_ = w.Close()
+		captures := d.finish(state)
+
+		dir := filepath.Join(config.ScratchDir, debugCapturesDir)
+		if retained := pruneDebugCaptures(dir, taken.Add(59*time.Second)); len(retained) != 1 {
+			t.Errorf("expected the capture to be retained until it expires, got %+v", retained)
+		}
+		if retained := pruneDebugCaptures(dir, taken.Add(time.Minute)); len(retained) != 0 {
+			t.Errorf("expected the expired capture to be removed, got %+v", retained)
+		}
+		if _, err := os.Stat(filepath.Join(dir, captures[0].Dir)); !os.IsNotExist(err) {
+			t.Errorf("expected the expired capture data to be removed, got %v", err)
+		}
+		if index, err := readDebugCaptureIndex(dir); err != nil || len(index) != 0 {
+			t.Errorf("expected the expired capture to be removed from the index, got %+v %v", index, err)
+		}
+	})
+}
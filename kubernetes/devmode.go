@@ -0,0 +1,40 @@
+package kubernetes
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// devPollInterval is the poll interval, in seconds, of development mode unless a shorter one is configured
+const devPollInterval = 30
+
+// applyDevMode returns the config for developing against a local cluster, eg: kind or minikube. Samples
+// are kept in the scratch directory rather than uploaded, nodes without a provider ID are collected without
+// warnings, the API server certificate is not verified, polls are more frequent and logging is verbose.
+// It returns an error if an upload destination is configured, so the mode is not used in a real cluster
+// by accident.
+func applyDevMode(config KubeAgentConfig) (KubeAgentConfig, error) {
+	if config.APIKey != "" {
+		return config, errors.New("development mode refuses to run with a Cloudability API key configured, " +
+			"unset CLOUDABILITY_API_KEY")
+	}
+	if config.MigrationUploadURL != "" {
+		return config, errors.New("development mode refuses to run with a migration upload URL configured, " +
+			"unset CLOUDABILITY_MIGRATION_UPLOAD_URL")
+	}
+	if config.CustomS3UploadBucket != "" || config.CustomS3Region != "" {
+		return config, errors.New("development mode refuses to run with a custom S3 bucket configured, unset " +
+			"CLOUDABILITY_CUSTOM_S3_BUCKET and CLOUDABILITY_CUSTOM_S3_REGION")
+	}
+	// the kubelets are always reached without verifying their certificates, which local clusters issue for
+	// node names rather than addresses
+	config.Insecure = true
+	if config.PollInterval <= 0 || config.PollInterval > devPollInterval {
+		config.PollInterval = devPollInterval
+	}
+	log.SetLevel(log.DebugLevel)
+	log.Warnf("Running in development mode, metric samples are kept in %s and never uploaded. Development "+
+		"mode must not be used in production clusters.", config.ScratchDir)
+	return config, nil
+}
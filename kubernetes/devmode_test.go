@@ -0,0 +1,41 @@
+package kubernetes
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestApplyDevMode(t *testing.T) {
+	level := log.GetLevel()
+	defer log.SetLevel(level)
+
+	t.Run("Ensure development mode refuses an upload destination", func(t *testing.T) {
+		for _, config := range []KubeAgentConfig{
+			{APIKey: "production-key"},
+			{CustomS3UploadBucket: "bucket"},
+			{CustomS3Region: "us-west-2"},
+			{MigrationUploadURL: "https://metrics-collector.example.com/metricsample"},
+		} {
+			if _, err := applyDevMode(config); err == nil {
+				t.Errorf("expected an error for %+v", config)
+			}
+		}
+	})
+
+	t.Run("Ensure development mode relaxes the configuration", func(t *testing.T) {
+		config, err := applyDevMode(KubeAgentConfig{PollInterval: 180, ScratchDir: "/tmp"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !config.Insecure || config.PollInterval != devPollInterval {
+			t.Errorf("expected an insecure config polling every %ds, got %+v", devPollInterval, config)
+		}
+		if log.GetLevel() != log.DebugLevel {
+			t.Errorf("expected debug logging, got %v", log.GetLevel())
+		}
+		if config, _ = applyDevMode(KubeAgentConfig{PollInterval: 10}); config.PollInterval != 10 {
+			t.Errorf("expected a shorter poll interval to be kept, got %d", config.PollInterval)
+		}
+	})
+}
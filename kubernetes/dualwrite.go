@@ -0,0 +1,249 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloudability/metrics-agent/client"
+	cldyVersion "github.com/cloudability/metrics-agent/version"
+	log "github.com/sirupsen/logrus"
+)
+
+// upload destinations of a dual-write migration, the primary is the upload endpoint of the upload region
+const (
+	PrimaryDestination   = "primary"
+	SecondaryDestination = "secondary"
+)
+
+// migrationEndDateLayout is the layout of a migration end date given without a time, the secondary
+// destination is dropped at the start of the day in UTC
+const migrationEndDateLayout = "2006-01-02"
+
+// uploadMigration sends identical metric samples to the secondary upload destination alongside the primary
+// until the end of a backend migration
+type uploadMigration struct {
+	url    string
+	apiKey string
+	end    time.Time
+	// authoritative is the destination whose upload failures fail the agent, failures of the other
+	// destination are only logged
+	authoritative string
+}
+
+// uploadDestination is an upload endpoint the metric samples are sent to
+type uploadDestination struct {
+	name   string
+	url    string
+	apiKey string
+	// authoritative is true if a failed upload to the destination fails the agent
+	authoritative bool
+}
+
+// parseUploadMigration returns the dual-write migration of the config, nil if no secondary upload URL is set
+func parseUploadMigration(config KubeAgentConfig) (*uploadMigration, error) {
+	if config.MigrationUploadURL == "" {
+		return nil, nil
+	}
+	if config.CustomS3UploadBucket != "" || config.CustomS3Region != "" {
+		return nil, errors.New("samples uploaded to a custom S3 bucket can not be dual-written")
+	}
+	u, err := url.Parse(config.MigrationUploadURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid migration upload URL %q, an https URL is required", config.MigrationUploadURL)
+	}
+	if config.MigrationAPIKey == "" {
+		return nil, errors.New("a migration API key is required with the migration upload URL")
+	}
+	if _, err := client.NewHTTPMetricClient(client.Configuration{Token: config.MigrationAPIKey,
+		BaseURL: config.MigrationUploadURL}); err != nil {
+		return nil, fmt.Errorf("invalid migration API key: %v", err)
+	}
+	primary := client.GetUploadURLByRegion(config.UploadRegion)
+	if sameUploadURL(primary, config.MigrationUploadURL) {
+		return nil, fmt.Errorf("the migration upload URL %s is the primary upload URL of region %s, the "+
+			"destinations must differ", config.MigrationUploadURL, config.UploadRegion)
+	}
+	if config.MigrationAPIKey == config.APIKey {
+		return nil, errors.New("the migration API key is the API key of the primary destination, the API keys " +
+			"must differ")
+	}
+	end, err := parseMigrationEndDate(config.MigrationEndDate)
+	if err != nil {
+		return nil, err
+	}
+	m := &uploadMigration{url: config.MigrationUploadURL, apiKey: config.MigrationAPIKey, end: end}
+	switch strings.ToLower(strings.TrimSpace(config.MigrationAuthoritative)) {
+	case "", PrimaryDestination:
+		m.authoritative = PrimaryDestination
+	case SecondaryDestination:
+		m.authoritative = SecondaryDestination
+	default:
+		return nil, fmt.Errorf("invalid authoritative destination %q, expected %s or %s",
+			config.MigrationAuthoritative, PrimaryDestination, SecondaryDestination)
+	}
+	return m, nil
+}
+
+// parseMigrationEndDate parses a migration end date, a date or an RFC 3339 time
+func parseMigrationEndDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, errors.New("a migration end date is required with the migration upload URL, so " +
+			"the secondary destination is not written to indefinitely")
+	}
+	if t, err := time.Parse(migrationEndDateLayout, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid migration end date %q, expected YYYY-MM-DD or an RFC 3339 time",
+			value)
+	}
+	return t.UTC(), nil
+}
+
+// sameUploadURL returns true if two upload URLs name the same endpoint, ignoring the case of the scheme and
+// host and any trailing slash
+func sameUploadURL(a, b string) bool {
+	normalize := func(s string) string {
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil {
+			return s
+		}
+		u.Scheme = strings.ToLower(u.Scheme)
+		u.Host = strings.ToLower(u.Host)
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		return u.String()
+	}
+	return normalize(a) == normalize(b)
+}
+
+// active returns true if samples are still dual-written at now
+func (m *uploadMigration) active(now time.Time) bool {
+	return m != nil && now.Before(m.end)
+}
+
+// logUploadMigration logs the destinations of the dual-write migration and which is authoritative
+func logUploadMigration(config KubeAgentConfig, now time.Time) {
+	m := config.uploadMigration
+	if m == nil {
+		return
+	}
+	if !m.active(now) {
+		log.Warnf("Dual-write migration ended at %s, metric samples are only uploaded to the primary destination",
+			m.end.Format(time.RFC3339))
+		return
+	}
+	log.Infof("Dual-write migration: metric samples are uploaded to the primary destination %s and the "+
+		"secondary destination %s until %s", client.GetUploadURLByRegion(config.UploadRegion), m.url,
+		m.end.Format(time.RFC3339))
+	log.Infof("The %s destination is authoritative: a failed upload to it fails the agent, failed uploads to "+
+		"the other destination are only logged and counted", m.authoritative)
+}
+
+// uploadDestinations returns the destinations metric samples are uploaded to at now. The secondary
+// destination of a migration is dropped once the migration ends, the primary is then authoritative.
+func (ka KubeAgentConfig) uploadDestinations(state *AgentState, now time.Time) []uploadDestination {
+	m := ka.uploadMigration
+	primary := uploadDestination{
+		name:          PrimaryDestination,
+		url:           client.GetUploadURLByRegion(ka.UploadRegion),
+		apiKey:        ka.APIKey,
+		authoritative: true,
+	}
+	if m == nil {
+		return []uploadDestination{primary}
+	}
+	if !m.active(now) {
+		if state.endMigration() {
+			log.Infof("Dual-write migration ended at %s, metric samples are no longer uploaded to the "+
+				"secondary destination %s, the primary destination is authoritative", m.end.Format(time.RFC3339),
+				m.url)
+		}
+		return []uploadDestination{primary}
+	}
+	primary.authoritative = m.authoritative == PrimaryDestination
+	return []uploadDestination{primary, {
+		name:          SecondaryDestination,
+		url:           m.url,
+		apiKey:        m.apiKey,
+		authoritative: m.authoritative == SecondaryDestination,
+	}}
+}
+
+// newDestinationClient returns the client uploading to the destination with the content encoding
+func (ka KubeAgentConfig) newDestinationClient(d uploadDestination, encoding string) (client.MetricClient,
+	error) {
+	return client.NewHTTPMetricClient(client.Configuration{
+		Token:           d.apiKey,
+		BaseURL:         d.url,
+		Verbose:         false,
+		ProxyURL:        ka.OutboundProxyURL,
+		ProxyAuth:       ka.OutboundProxyAuth,
+		ProxyInsecure:   ka.OutboundProxyInsecure,
+		Timeout:         time.Duration(ka.HTTPSTimeout) * time.Second,
+		Region:          ka.UploadRegion,
+		ContentEncoding: encoding,
+	})
+}
+
+// uploadToDestinations uploads the metric sample to every destination, recording the outcome of each upload
+// in state. The error of the authoritative destination is returned once every destination was attempted,
+// failed uploads to the other destination are only logged.
+func (ka KubeAgentConfig) uploadToDestinations(metricSample *os.File, destinations []uploadDestination,
+	state *AgentState, newClient func(d uploadDestination, encoding string) client.MetricClient) error {
+	var authoritativeErr error
+	for _, d := range destinations {
+		// falls back to sending the archive without a content encoding when the handshake did not succeed
+		encoding, _ := client.NegotiateContentEncoding(ka.UploadContentEncoding, state.destinationLimits(d.name))
+		err := SendData(metricSample, ka.clusterUID, newClient(d, encoding))
+		state.recordUpload(d.name, err, time.Now())
+		if err == nil {
+			if len(destinations) > 1 {
+				log.Infof("Uploaded metric sample to the %s destination %s", d.name, d.url)
+			}
+			continue
+		}
+		if !d.authoritative {
+			log.Warnf("Warning: metric sample upload to the non-authoritative %s destination %s failed: %v",
+				d.name, d.url, err)
+			continue
+		}
+		if d.name == PrimaryDestination {
+			if warnErr := handleError(err, ka.UploadRegion); warnErr != "" {
+				log.Warnf(warnErr)
+			}
+		}
+		authoritativeErr = fmt.Errorf("%s destination %s: %w", d.name, d.url, err)
+	}
+	return authoritativeErr
+}
+
+// handshakeSecondary checks connectivity with the secondary destination of an active migration and records
+// the limits it advertises. An error is only returned if the secondary destination is authoritative.
+func handshakeSecondary(ka KubeAgentConfig, state *AgentState, healthCheckFile *os.File) error {
+	m := ka.uploadMigration
+	if !m.active(time.Now()) {
+		return nil
+	}
+	d := ka.uploadDestinations(state, time.Now())[1]
+	c, err := ka.newDestinationClient(d, "")
+	if err == nil {
+		var limits client.UploadLimits
+		limits, err = c.Handshake(healthCheckFile, cldyVersion.VERSION, ka.clusterUID)
+		state.setDestinationLimits(SecondaryDestination, limits)
+	}
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("secondary upload destination %s: %w", m.url, err)
+	if d.authoritative {
+		return err
+	}
+	log.Warnf("Warning: connectivity check of the non-authoritative %v", err)
+	return nil
+}
@@ -0,0 +1,213 @@
+package kubernetes
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/client"
+)
+
+// fakeMetricClient records the samples sent to it and fails with err if it is set
+type fakeMetricClient struct {
+	client.MetricClient
+	sent *[]string
+	err  error
+}
+
+func (c fakeMetricClient) SendMetricSample(f *os.File, _, _ string) error {
+	if c.err != nil {
+		return c.err
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	*c.sent = append(*c.sent, string(data))
+	return nil
+}
+
+func migrationConfig() KubeAgentConfig {
+	return KubeAgentConfig{
+		APIKey:                 "primarykey",
+		UploadRegion:           "eu-central-1",
+		MigrationUploadURL:     "https://metrics-collector.example.com/metricsample",
+		MigrationAPIKey:        "secondarykey",
+		MigrationEndDate:       "2026-10-23",
+		MigrationAuthoritative: PrimaryDestination,
+	}
+}
+
+func TestParseUploadMigration(t *testing.T) {
+	t.Run("Ensure a valid migration is parsed", func(t *testing.T) {
+		m, err := parseUploadMigration(migrationConfig())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !m.end.Equal(time.Date(2026, 10, 23, 0, 0, 0, 0, time.UTC)) || m.authoritative != PrimaryDestination {
+			t.Errorf("unexpected migration %+v", m)
+		}
+		if m, err := parseUploadMigration(KubeAgentConfig{}); m != nil || err != nil {
+			t.Errorf("expected no migration without a migration upload URL, got %+v %v", m, err)
+		}
+	})
+
+	t.Run("Ensure misconfigured migrations are rejected", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			change func(*KubeAgentConfig)
+			want   string
+		}{
+			{
+				name: "identical destinations",
+				change: func(c *KubeAgentConfig) {
+					c.MigrationUploadURL = "https://METRICS-COLLECTOR-EU.cloudability.com/metricsample/"
+				},
+				want: "destinations must differ",
+			},
+			{
+				name:   "identical API keys",
+				change: func(c *KubeAgentConfig) { c.MigrationAPIKey = c.APIKey },
+				want:   "API keys must differ",
+			},
+			{
+				name:   "plain http",
+				change: func(c *KubeAgentConfig) { c.MigrationUploadURL = "http://metrics-collector.example.com" },
+				want:   "an https URL is required",
+			},
+			{
+				name:   "no API key",
+				change: func(c *KubeAgentConfig) { c.MigrationAPIKey = "" },
+				want:   "API key is required",
+			},
+			{
+				name:   "invalid API key",
+				change: func(c *KubeAgentConfig) { c.MigrationAPIKey = "not-a-key" },
+				want:   "invalid migration API key",
+			},
+			{
+				name:   "no end date",
+				change: func(c *KubeAgentConfig) { c.MigrationEndDate = "" },
+				want:   "end date is required",
+			},
+			{
+				name:   "invalid end date",
+				change: func(c *KubeAgentConfig) { c.MigrationEndDate = "next week" },
+				want:   "invalid migration end date",
+			},
+			{
+				name:   "invalid authoritative destination",
+				change: func(c *KubeAgentConfig) { c.MigrationAuthoritative = "both" },
+				want:   "invalid authoritative destination",
+			},
+			{
+				name:   "custom S3 bucket",
+				change: func(c *KubeAgentConfig) { c.CustomS3UploadBucket = "bucket" },
+				want:   "custom S3 bucket",
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				config := migrationConfig()
+				tt.change(&config)
+				if _, err := parseUploadMigration(config); err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("expected an error containing %q, got %v", tt.want, err)
+				}
+			})
+		}
+	})
+}
+
+func TestUploadDestinations(t *testing.T) {
+	config := migrationConfig()
+	config.MigrationAuthoritative = SecondaryDestination
+	m, err := parseUploadMigration(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.uploadMigration = m
+	state := newAgentState(config, NodeConnection{})
+
+	t.Run("Ensure both destinations are written until the end date", func(t *testing.T) {
+		destinations := config.uploadDestinations(state, m.end.Add(-time.Minute))
+		if len(destinations) != 2 || destinations[0].name != PrimaryDestination ||
+			destinations[0].url != client.EUBaseURL || destinations[0].authoritative ||
+			destinations[1].apiKey != "secondarykey" || !destinations[1].authoritative {
+			t.Errorf("unexpected destinations %+v", destinations)
+		}
+	})
+
+	t.Run("Ensure the secondary is dropped after the end date", func(t *testing.T) {
+		destinations := config.uploadDestinations(state, m.end)
+		if len(destinations) != 1 || destinations[0].name != PrimaryDestination || !destinations[0].authoritative {
+			t.Errorf("expected only the authoritative primary destination, got %+v", destinations)
+		}
+	})
+}
+
+func TestUploadToDestinations(t *testing.T) {
+	sample := filepath.Join(t.TempDir(), "sample.tgz")
+	if err := os.WriteFile(sample, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	destinations := []uploadDestination{
+		{name: PrimaryDestination, url: client.DefaultBaseURL, authoritative: true},
+		{name: SecondaryDestination, url: "https://metrics-collector.example.com"},
+	}
+	upload := func(state *AgentState, failed string) ([]string, error) {
+		var sent []string
+		err := KubeAgentConfig{}.uploadToDestinations(f, destinations, state,
+			func(d uploadDestination, _ string) client.MetricClient {
+				c := fakeMetricClient{sent: &sent}
+				if d.name == failed {
+					c.err = errors.New("Request received 500 response")
+				}
+				return c
+			})
+		return sent, err
+	}
+
+	t.Run("Ensure identical archives are sent to each destination", func(t *testing.T) {
+		state := newAgentState(KubeAgentConfig{}, NodeConnection{})
+		sent, err := upload(state, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(sent) != 2 || sent[0] != "archive" || sent[1] != "archive" {
+			t.Errorf("expected the archive to be sent to both destinations, sent %v", sent)
+		}
+		uploads := state.status().uploads
+		if uploads[PrimaryDestination].succeeded != 1 || uploads[SecondaryDestination].succeeded != 1 {
+			t.Errorf("unexpected uploads %+v", uploads)
+		}
+	})
+
+	t.Run("Ensure only failures of the authoritative destination are returned", func(t *testing.T) {
+		state := newAgentState(KubeAgentConfig{}, NodeConnection{})
+		if sent, err := upload(state, SecondaryDestination); err != nil || len(sent) != 1 {
+			t.Errorf("expected the secondary failure to be ignored, got %v %v", sent, err)
+		}
+		sent, err := upload(state, PrimaryDestination)
+		if err == nil || !strings.Contains(err.Error(), "primary destination") {
+			t.Errorf("expected the primary failure to be returned, got %v", err)
+		}
+		if len(sent) != 1 {
+			t.Errorf("expected the secondary to be uploaded to despite the primary failure, sent %v", sent)
+		}
+		uploads := state.status().uploads
+		primary, secondary := uploads[PrimaryDestination], uploads[SecondaryDestination]
+		if primary.succeeded != 1 || primary.failed != 1 || secondary.succeeded != 1 || secondary.failed != 1 ||
+			secondary.lastError != "Request received 500 response" {
+			t.Errorf("expected the uploads to be tracked independently, got %+v", uploads)
+		}
+	})
+}
@@ -1,7 +1,10 @@
 package kubernetes
 
 import (
+	"fmt"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/cloudability/metrics-agent/retrieval/raw"
 )
@@ -12,8 +15,9 @@ type Connection uint8
 
 const (
 	// By bitshifting each constant with iota we can use Connection as a bitmask
-	Direct Connection = 1 << iota // 0001 = 1
-	Proxy                         // 0010 = 2
+	Direct   Connection = 1 << iota // 0001 = 1
+	Proxy                           // 0010 = 2
+	PodProxy                        // 0100 = 4
 	// Unreachable defined at end to avoid affecting iota,
 	// as it should always be set to 0
 	Unreachable Connection = 0
@@ -41,6 +45,9 @@ func (c Connection) String() string {
 	if c.hasMethod(Direct) {
 		options = append(options, direct)
 	}
+	if c.hasMethod(PodProxy) {
+		options = append(options, podProxy)
+	}
 	return strings.Join(options, ",")
 }
 
@@ -57,46 +64,152 @@ type Endpoint string
 const (
 	// NodeStatsSummaryEndpoint the /stats/summary endpoint
 	NodeStatsSummaryEndpoint Endpoint = "/stats/summary"
+	// NodeResourceMetricsEndpoint the /metrics/resource endpoint, collected in place of the summary
+	// on kubelets where it is unavailable
+	NodeResourceMetricsEndpoint Endpoint = "/metrics/resource"
+	// NodeProbeMetricsEndpoint the /metrics/probes endpoint
+	NodeProbeMetricsEndpoint Endpoint = "/metrics/probes"
+	// NodePodsEndpoint the /pods endpoint
+	NodePodsEndpoint Endpoint = "/pods"
+	// NodeSpecEndpoint the /spec endpoint
+	NodeSpecEndpoint Endpoint = "/spec"
+	// NodeConfigzEndpoint the /configz endpoint
+	NodeConfigzEndpoint Endpoint = "/configz"
+	// NodeKubeletMetricsEndpoint the /metrics endpoint
+	NodeKubeletMetricsEndpoint Endpoint = "/metrics"
 )
 
-// EndpointMask a map representing the currently active endpoints.
-// The keys of the map are the currently active endpoints.
-type EndpointMask map[Endpoint]Connection
+// EndpointMask represents the currently active endpoints and the connection methods available for each.
+// It is safe for concurrent use, as nodes are collected concurrently.
+type EndpointMask struct {
+	mu        sync.RWMutex
+	endpoints map[Endpoint]Connection
+}
+
+// NewEndpointMask returns a mask with no endpoints available
+func NewEndpointMask() *EndpointMask {
+	return &EndpointMask{endpoints: map[Endpoint]Connection{}}
+}
 
 // SetAvailability sets an endpoint availability state according to the supplied boolean
-func (m EndpointMask) SetAvailability(endpoint Endpoint, method Connection, available bool) {
-	e := m[endpoint]
+func (m *EndpointMask) SetAvailability(endpoint Endpoint, method Connection, available bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.endpoints[endpoint]
 	if available {
 		e.AddMethod(method)
 	} else {
 		e.ClearMethod(method)
 	}
-	m[endpoint] = e
+	m.endpoints[endpoint] = e
 }
 
-func (m EndpointMask) SetUnreachable(endpoint Endpoint) {
-	e := m[endpoint]
+func (m *EndpointMask) SetUnreachable(endpoint Endpoint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.endpoints[endpoint]
 	e.SetUnreachable()
-	m[endpoint] = e
+	m.endpoints[endpoint] = e
+}
+
+// connection returns the methods available for the endpoint, a nil mask has no endpoints available
+func (m *EndpointMask) connection(endpoint Endpoint) Connection {
+	if m == nil {
+		return Unreachable
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.endpoints[endpoint]
+}
+
+// clone returns a copy of the mask
+func (m *EndpointMask) clone() *EndpointMask {
+	c := NewEndpointMask()
+	for _, e := range m.Endpoints() {
+		c.endpoints[e] = m.connection(e)
+	}
+	return c
+}
+
+// replace sets the connection methods of every endpoint to those of the other mask
+func (m *EndpointMask) replace(from *EndpointMask) {
+	endpoints := from.clone().endpoints
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.endpoints = endpoints
 }
 
 // Available gets the availability of an endpoint for the specified connection method
-func (m EndpointMask) Available(endpoint Endpoint, method Connection) bool {
-	return m[endpoint].hasMethod(method)
+func (m *EndpointMask) Available(endpoint Endpoint, method Connection) bool {
+	return m.connection(endpoint).hasMethod(method)
+}
+
+func (m *EndpointMask) Unreachable(endpoint Endpoint) bool {
+	return m.connection(endpoint) == Unreachable
 }
 
-func (m EndpointMask) Unreachable(endpoint Endpoint) bool {
-	return m[endpoint] == Unreachable
+func (m *EndpointMask) DirectAllowed(endpoint Endpoint) bool {
+	return m.connection(endpoint).hasMethod(Direct)
 }
 
-func (m EndpointMask) DirectAllowed(endpoint Endpoint) bool {
-	return m[endpoint].hasMethod(Direct)
+func (m *EndpointMask) ProxyAllowed(endpoint Endpoint) bool {
+	return m.connection(endpoint).hasMethod(Proxy)
 }
 
-func (m EndpointMask) ProxyAllowed(endpoint Endpoint) bool {
-	return m[endpoint].hasMethod(Proxy)
+func (m *EndpointMask) Options(endpoint Endpoint) string {
+	return m.connection(endpoint).String()
+}
+
+// Endpoints returns the endpoints tracked by the mask in sorted order
+func (m *EndpointMask) Endpoints() []Endpoint {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	endpoints := make([]Endpoint, 0, len(m.endpoints))
+	for e := range m.endpoints {
+		endpoints = append(endpoints, e)
+	}
+	m.mu.RUnlock()
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i] < endpoints[j] })
+	return endpoints
+}
+
+// String lists the connection methods of each endpoint tracked by the mask,
+// eg: "/pods:unreachable /stats/summary:proxy,direct"
+func (m *EndpointMask) String() string {
+	var endpoints []string
+	for _, e := range m.Endpoints() {
+		endpoints = append(endpoints, fmt.Sprintf("%s:%s", e, m.Options(e)))
+	}
+	return strings.Join(endpoints, " ")
+}
+
+// reasons an endpoint may be unavailable over a connection method
+const (
+	reasonProbeFailed      = "probe failed at startup"
+	reasonForceKubeProxy   = "disabled by config (force_kube_proxy)"
+	reasonForceDirect      = "disabled by config (force_direct)"
+	reasonProxyOnlyNodes   = "not possible to Fargate and virtual kubelet nodes"
+	reasonAutopilot        = "not possible to GKE Autopilot nodes"
+	reasonProxyPreferred   = "not used as some nodes are only reachable via proxy"
+	reasonDirectSufficient = "not used as every node is reachable directly"
+	reasonRelayUnneeded    = "not used as every node is reachable without the stats relay"
+)
+
+// EndpointReasons records why an endpoint is unavailable over a given connection method,
+// so that missing data can be explained from the sample alone
+type EndpointReasons map[Endpoint]map[Connection]string
+
+// SetReason records the reason the endpoint is unavailable over the connection method
+func (r EndpointReasons) SetReason(endpoint Endpoint, method Connection, reason string) {
+	if r[endpoint] == nil {
+		r[endpoint] = map[Connection]string{}
+	}
+	r[endpoint][method] = reason
 }
 
-func (m EndpointMask) Options(endpoint Endpoint) string {
-	return m[endpoint].String()
+// Reason returns the reason the endpoint is unavailable over the connection method, if one was recorded
+func (r EndpointReasons) Reason(endpoint Endpoint, method Connection) string {
+	return r[endpoint][method]
 }
@@ -1,6 +1,8 @@
 package kubernetes
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -96,7 +98,7 @@ func TestConnection(t *testing.T) {
 
 func TestEndpointMask(t *testing.T) {
 	t.Run("endpoint should report Unreachable correctly", func(t *testing.T) {
-		mask := EndpointMask{}
+		mask := NewEndpointMask()
 		if !mask.Unreachable(NodeStatsSummaryEndpoint) {
 			t.Error("empty mask should return all endpoints as unreachable")
 		}
@@ -118,7 +120,7 @@ func TestEndpointMask(t *testing.T) {
 		}
 	})
 	t.Run("endpoint should set availability correctly", func(t *testing.T) {
-		mask := EndpointMask{}
+		mask := NewEndpointMask()
 		// set as available
 		mask.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
 		if !mask.DirectAllowed(NodeStatsSummaryEndpoint) {
@@ -139,7 +141,7 @@ func TestEndpointMask(t *testing.T) {
 		}
 	})
 	t.Run("should be able to set multiple connection methods per endpoint", func(t *testing.T) {
-		mask := EndpointMask{}
+		mask := NewEndpointMask()
 		if mask.ProxyAllowed(NodeStatsSummaryEndpoint) {
 			t.Errorf("expected the availability of an endpoint to default to false")
 		}
@@ -164,3 +166,37 @@ func TestEndpointMask(t *testing.T) {
 
 	})
 }
+
+func TestEndpointMaskString(t *testing.T) {
+	mask := NewEndpointMask()
+	if s := mask.String(); s != "" {
+		t.Errorf("expected an empty mask to print nothing, got %q", s)
+	}
+	mask.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+	mask.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	mask.SetUnreachable(NodePodsEndpoint)
+	if s, expected := mask.String(), "/pods:unreachable /stats/summary:proxy,direct"; s != expected {
+		t.Errorf("expected %q, got %q", expected, s)
+	}
+}
+
+func TestEndpointMaskConcurrency(t *testing.T) {
+	mask := NewEndpointMask()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			endpoint := Endpoint(fmt.Sprintf("/endpoint%d", i))
+			for j := 0; j < 100; j++ {
+				mask.SetAvailability(endpoint, Proxy, j%2 == 0)
+				mask.Available(NodeStatsSummaryEndpoint, Proxy)
+				_ = mask.String()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := len(mask.Endpoints()); n != 10 {
+		t.Errorf("expected 10 endpoints, got %d", n)
+	}
+}
@@ -0,0 +1,130 @@
+package kubernetes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudability/metrics-agent/sample"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultDisableEndpointsAnnotation is the default node annotation listing the endpoints not collected from
+// the node, eg: "container,probes" to shed a pathological endpoint of a single node without redeploying
+const DefaultDisableEndpointsAnnotation = "cloudability.com/disable-endpoints"
+
+// annotationEndpoints are the node sources of the built in endpoints that can be disabled by annotation,
+// extra kubelet endpoints are disabled by their name
+var annotationEndpoints = map[string]bool{
+	sample.SummarySource:         true,
+	sample.ContainerSource:       true,
+	sample.ResourceMetricsSource: true,
+	sample.ProbesSource:          true,
+	sample.KubeletPodsSource:     true,
+	sample.NodeSpecSource:        true,
+	sample.KubeletConfigzSource:  true,
+	sample.KubeletMetricsSource:  true,
+}
+
+// validateDisableEndpointsAnnotation checks the annotation key is a valid annotation name, empty disables
+// the annotation
+func validateDisableEndpointsAnnotation(key string) error {
+	if key == "" {
+		return nil
+	}
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		return fmt.Errorf("invalid annotation %q: %s", key, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// annotationDisabledEndpoints returns the endpoints disabled by the annotation of the node, by node source
+// or extra endpoint name. Unknown names are logged and ignored.
+func annotationDisabledEndpoints(config KubeAgentConfig, n v1.Node) map[string]bool {
+	if config.DisableEndpointsAnnotation == "" {
+		return nil
+	}
+	value, ok := n.Annotations[config.DisableEndpointsAnnotation]
+	if !ok {
+		return nil
+	}
+	known := func(name string) bool {
+		if annotationEndpoints[name] {
+			return true
+		}
+		for _, e := range config.extraEndpoints {
+			if e.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	var disabled map[string]bool
+	var unknown []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known(name) {
+			unknown = append(unknown, name)
+			continue
+		}
+		if disabled == nil {
+			disabled = map[string]bool{}
+		}
+		disabled[name] = true
+	}
+	if len(unknown) > 0 {
+		log.Warnf("Node %s: ignoring unknown endpoints [%s] in the %s annotation", n.Name,
+			strings.Join(unknown, ", "), config.DisableEndpointsAnnotation)
+	}
+	return disabled
+}
+
+// disabledEndpointLog collects the node endpoints disabled during a collection. It is safe for concurrent
+// use, and a nil log records nothing.
+type disabledEndpointLog struct {
+	mu       sync.Mutex
+	disabled map[sample.DisabledEndpoint]bool
+}
+
+func newDisabledEndpointLog() *disabledEndpointLog {
+	return &disabledEndpointLog{disabled: map[sample.DisabledEndpoint]bool{}}
+}
+
+// record records the endpoints of the node disabled for the reason
+func (l *disabledEndpointLog) record(nodeName string, endpoints map[string]bool, reason string) {
+	if l == nil || len(endpoints) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for e := range endpoints {
+		l.disabled[sample.DisabledEndpoint{Node: nodeName, Endpoint: e, Reason: reason}] = true
+	}
+}
+
+// report returns the disabled endpoints recorded, sorted by node and endpoint
+func (l *disabledEndpointLog) report() []sample.DisabledEndpoint {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var disabled []sample.DisabledEndpoint
+	for d := range l.disabled {
+		disabled = append(disabled, d)
+	}
+	sort.Slice(disabled, func(i, j int) bool {
+		if disabled[i].Node != disabled[j].Node {
+			return disabled[i].Node < disabled[j].Node
+		}
+		return disabled[i].Endpoint < disabled[j].Endpoint
+	})
+	return disabled
+}
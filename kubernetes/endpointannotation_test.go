@@ -0,0 +1,130 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+)
+
+func disableEndpointsNode(name, value string) v1.Node {
+	n := addressedNode(name, "10.0.0.1")
+	n.Annotations = map[string]string{DefaultDisableEndpointsAnnotation: value}
+	return n
+}
+
+func TestDisableEndpointsAnnotation(t *testing.T) {
+	t.Run("Ensure known endpoints are disabled and unknown ones ignored", func(t *testing.T) {
+		hook := test.NewGlobal()
+		defer hook.Reset()
+		extra, err := ParseExtraEndpoints(`[{"name":"checkpoints","path":"/checkpoints"}]`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := KubeAgentConfig{DisableEndpointsAnnotation: DefaultDisableEndpointsAnnotation,
+			extraEndpoints: extra}
+
+		disabled := annotationDisabledEndpoints(config,
+			disableEndpointsNode("node0", " probes, checkpoints,,cadvisor "))
+		if len(disabled) != 2 || !disabled[sample.ProbesSource] || !disabled["checkpoints"] {
+			t.Errorf("unexpected disabled endpoints %v", disabled)
+		}
+		if len(hook.Entries) != 1 || !strings.Contains(hook.LastEntry().Message, "[cadvisor]") {
+			t.Errorf("expected the unknown endpoint to be logged, got %+v", hook.Entries)
+		}
+	})
+
+	t.Run("Ensure the annotation key is configurable and may be ignored", func(t *testing.T) {
+		n := disableEndpointsNode("node0", "probes")
+		if disabled := annotationDisabledEndpoints(KubeAgentConfig{}, n); disabled != nil {
+			t.Errorf("expected an empty annotation key to disable nothing, got %v", disabled)
+		}
+		config := KubeAgentConfig{DisableEndpointsAnnotation: "example.com/shed"}
+		if disabled := annotationDisabledEndpoints(config, n); disabled != nil {
+			t.Errorf("expected only the configured annotation to be read, got %v", disabled)
+		}
+		n.Annotations["example.com/shed"] = "pods"
+		if disabled := annotationDisabledEndpoints(config, n); len(disabled) != 1 ||
+			!disabled[sample.KubeletPodsSource] {
+			t.Errorf("unexpected disabled endpoints %v", disabled)
+		}
+	})
+
+	t.Run("Ensure the annotation key is validated", func(t *testing.T) {
+		for _, key := range []string{"", DefaultDisableEndpointsAnnotation, "shed"} {
+			if err := validateDisableEndpointsAnnotation(key); err != nil {
+				t.Errorf("unexpected error for %q: %v", key, err)
+			}
+		}
+		for _, key := range []string{"cloudability.com/", "not a key", "a/b/c"} {
+			if err := validateDisableEndpointsAnnotation(key); err == nil {
+				t.Errorf("expected an error for %q", key)
+			}
+		}
+	})
+
+	t.Run("Ensure disabled endpoints are not requested and are recorded", func(t *testing.T) {
+		var mu sync.Mutex
+		requested := map[string]bool{}
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requested[r.URL.Path] = true
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			if strings.HasSuffix(r.URL.Path, "/stats/summary") {
+				_, _ = w.Write([]byte(`{"node":{"nodeName":"node0"}}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"items":[]}`))
+		}))
+		defer ts.Close()
+
+		dir, err := os.MkdirTemp("", "TestDisableEndpointsAnnotation")
+		if err != nil {
+			t.Fatalf("error creating temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		workDir := util.NewWorkDir(dir)
+
+		ns := testNodeSource{Nodes: []v1.Node{disableEndpointsNode("node0", "probes")}}
+		c := http.Client{Transport: &http.Transport{
+			// nolint gosec
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		nodes := NodeConnection{InClusterClient: raw.NewClient(c, true, nil, 0, false), NodeMetrics: NewEndpointMask()}
+		for _, e := range []Endpoint{NodeStatsSummaryEndpoint, NodeProbeMetricsEndpoint, NodePodsEndpoint} {
+			nodes.NodeMetrics.SetAvailability(e, Proxy, true)
+		}
+		config := KubeAgentConfig{ClusterHostURL: ts.URL, ConcurrentPollers: 1, ForceKubeProxy: true, Dev: true,
+			RetrieveProbeMetrics: true, RetrieveKubeletPods: true,
+			DisableEndpointsAnnotation: DefaultDisableEndpointsAnnotation}
+		cycle := pollCycle{disabledEndpoints: newDisabledEndpointLog()}
+
+		failed, err := downloadNodeData(context.TODO(), sample.StatsPrefix, config, cycle, nodes, workDir, ns, nil, nil,
+			newNodeHealthSnapshot())
+		if err != nil || len(failed) != 0 {
+			t.Fatalf("unexpected failure: %v %v", failed, err)
+		}
+		if !requested["/api/v1/nodes/node0/proxy/stats/summary"] || !requested["/api/v1/nodes/node0/proxy/pods"] {
+			t.Errorf("expected the enabled endpoints to be requested, requested %v", requested)
+		}
+		if requested["/api/v1/nodes/node0/proxy/metrics/probes"] {
+			t.Errorf("expected the disabled probes endpoint not to be requested")
+		}
+		report := cycle.disabledEndpoints.report()
+		if len(report) != 1 || report[0] != (sample.DisabledEndpoint{Node: "node0", Endpoint: sample.ProbesSource,
+			Reason: sample.EndpointDisabledByAnnotation}) {
+			t.Errorf("unexpected disabled endpoint report %+v", report)
+		}
+	})
+}
@@ -0,0 +1,311 @@
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudability/metrics-agent/sample"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// extraEndpointsConfigName is the name of the endpoint config section of the extra kubelet endpoints
+const extraEndpointsConfigName = "extra"
+
+// where the effective value of an endpoint setting comes from
+const (
+	settingSourceDefault = "default"
+	settingSourceFile    = "file"
+	settingSourceEnv     = "env"
+)
+
+// endpointSetting is a setting of an endpoint that may be configured in the endpoint config file
+type endpointSetting struct {
+	// key is the flag and env var, without its prefix, that overrides the setting
+	key string
+	// parse validates a value from the file and applies it to the config
+	parse func(config *KubeAgentConfig, value interface{}) error
+	// value returns the effective value of the setting
+	value func(config KubeAgentConfig) string
+}
+
+// endpointConfigSchema are the settings of each endpoint that may be configured in the endpoint config file,
+// keyed by the name of the endpoint's node source
+var endpointConfigSchema = map[string]map[string]endpointSetting{
+	sample.ProbesSource: {
+		"enabled": boolSetting("retrieve_probe_metrics", func(c *KubeAgentConfig) *bool {
+			return &c.RetrieveProbeMetrics
+		}),
+	},
+	sample.KubeletPodsSource: {
+		"enabled": boolSetting("retrieve_kubelet_pods", func(c *KubeAgentConfig) *bool {
+			return &c.RetrieveKubeletPods
+		}),
+		"max_bytes": int64Setting("kubelet_pods_max_bytes", 0, math.MaxInt64, func(c *KubeAgentConfig) *int64 {
+			return &c.KubeletPodsMaxBytes
+		}),
+	},
+	sample.NodeSpecSource: {
+		"enabled": boolSetting("retrieve_node_spec", func(c *KubeAgentConfig) *bool {
+			return &c.RetrieveNodeSpec
+		}),
+		"interval": intSetting("node_spec_interval", 1, math.MaxInt32, func(c *KubeAgentConfig) *int {
+			return &c.NodeSpecInterval
+		}),
+	},
+	sample.KubeletConfigzSource: {
+		"enabled": boolSetting("retrieve_kubelet_configz", func(c *KubeAgentConfig) *bool {
+			return &c.RetrieveKubeletConfigz
+		}),
+	},
+	sample.KubeletMetricsSource: {
+		"enabled": boolSetting("retrieve_kubelet_metrics", func(c *KubeAgentConfig) *bool {
+			return &c.RetrieveKubeletMetrics
+		}),
+	},
+	sample.CadvisorMetricsSource: {
+		"label_allowlist": listSetting("cadvisor_label_allowlist", func(c *KubeAgentConfig) *string {
+			return &c.CadvisorLabelAllowlist
+		}),
+		"label_denylist": listSetting("cadvisor_label_denylist", func(c *KubeAgentConfig) *string {
+			return &c.CadvisorLabelDenylist
+		}),
+		"max_series_per_family": intSetting("cadvisor_max_series_per_family", 0, math.MaxInt32,
+			func(c *KubeAgentConfig) *int {
+				return &c.CadvisorMaxSeriesPerFamily
+			}),
+	},
+	extraEndpointsConfigName: {
+		"max_bytes": int64Setting("extra_kubelet_endpoints_max_bytes", 0, math.MaxInt64,
+			func(c *KubeAgentConfig) *int64 {
+				return &c.ExtraEndpointMaxBytes
+			}),
+	},
+}
+
+func boolSetting(key string, field func(*KubeAgentConfig) *bool) endpointSetting {
+	return endpointSetting{
+		key: key,
+		parse: func(config *KubeAgentConfig, value interface{}) error {
+			b, ok := value.(bool)
+			if !ok {
+				return fmt.Errorf("must be true or false, got %v", value)
+			}
+			*field(config) = b
+			return nil
+		},
+		value: func(config KubeAgentConfig) string { return strconv.FormatBool(*field(&config)) },
+	}
+}
+
+// parseInteger returns the value as an integer within the range
+func parseInteger(value interface{}, min, max int64) (int64, error) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("must be an integer, got %v", value)
+	}
+	i, err := n.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("must be an integer, got %v", value)
+	}
+	if i < min || i > max {
+		return 0, fmt.Errorf("must be between %d and %d, got %d", min, max, i)
+	}
+	return i, nil
+}
+
+func intSetting(key string, min, max int64, field func(*KubeAgentConfig) *int) endpointSetting {
+	return endpointSetting{
+		key: key,
+		parse: func(config *KubeAgentConfig, value interface{}) error {
+			i, err := parseInteger(value, min, max)
+			if err != nil {
+				return err
+			}
+			*field(config) = int(i)
+			return nil
+		},
+		value: func(config KubeAgentConfig) string { return strconv.Itoa(*field(&config)) },
+	}
+}
+
+func int64Setting(key string, min, max int64, field func(*KubeAgentConfig) *int64) endpointSetting {
+	return endpointSetting{
+		key: key,
+		parse: func(config *KubeAgentConfig, value interface{}) error {
+			i, err := parseInteger(value, min, max)
+			if err != nil {
+				return err
+			}
+			*field(config) = i
+			return nil
+		},
+		value: func(config KubeAgentConfig) string { return strconv.FormatInt(*field(&config), 10) },
+	}
+}
+
+// listSetting is a list of strings in the file, applied to a comma separated config field
+func listSetting(key string, field func(*KubeAgentConfig) *string) endpointSetting {
+	return endpointSetting{
+		key: key,
+		parse: func(config *KubeAgentConfig, value interface{}) error {
+			list, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("must be a list, got %v", value)
+			}
+			items := make([]string, 0, len(list))
+			for i, item := range list {
+				s, ok := item.(string)
+				if !ok || s == "" || strings.Contains(s, ",") {
+					return fmt.Errorf("item %d must be a non empty string without commas, got %v", i, item)
+				}
+				items = append(items, s)
+			}
+			*field(config) = strings.Join(items, ",")
+			return nil
+		},
+		value: func(config KubeAgentConfig) string { return *field(&config) },
+	}
+}
+
+// endpointConfigSources records where the effective value of each endpoint setting comes from, keyed by
+// "<endpoint>.<setting>"
+type endpointConfigSources map[string]string
+
+// loadEndpointConfig applies the endpoint config file to the config. Settings overridden by their env var or
+// flag keep the overriding value. It returns where each setting in the file came from.
+func loadEndpointConfig(config KubeAgentConfig) (KubeAgentConfig, endpointConfigSources, error) {
+	sources := endpointConfigSources{}
+	if config.EndpointConfigFile == "" {
+		return config, sources, nil
+	}
+	data, err := os.ReadFile(config.EndpointConfigFile)
+	if err != nil {
+		return config, nil, fmt.Errorf("unable to read endpoint config file: %v", err)
+	}
+	config, sources, err = parseEndpointConfig(config, data)
+	if err != nil {
+		return config, nil, fmt.Errorf("invalid endpoint config file %s: %v", config.EndpointConfigFile, err)
+	}
+	return config, sources, nil
+}
+
+// parseEndpointConfig validates the endpoint config against the schema and applies it to the config. Errors
+// name the path of the offending key.
+func parseEndpointConfig(config KubeAgentConfig, data []byte) (KubeAgentConfig, endpointConfigSources, error) {
+	sources := endpointConfigSources{}
+	j, err := yaml.YAMLToJSONStrict(data)
+	if err != nil {
+		return config, nil, err
+	}
+	var file map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(j))
+	d.UseNumber()
+	if err := d.Decode(&file); err != nil {
+		return config, nil, fmt.Errorf("must be a mapping with an endpoints key: %v", err)
+	}
+	for _, key := range sortedKeys(file) {
+		if key != "endpoints" {
+			return config, nil, fmt.Errorf("%s: unknown key, expected endpoints", key)
+		}
+	}
+	endpoints, ok := file["endpoints"].(map[string]interface{})
+	if !ok && file["endpoints"] != nil {
+		return config, nil, fmt.Errorf("endpoints: must be a mapping of endpoint names to settings")
+	}
+
+	for _, name := range sortedKeys(endpoints) {
+		schema, ok := endpointConfigSchema[name]
+		if !ok {
+			return config, nil, fmt.Errorf("endpoints.%s: unknown endpoint, expected one of %v", name,
+				endpointConfigNames())
+		}
+		settings, ok := endpoints[name].(map[string]interface{})
+		if !ok {
+			return config, nil, fmt.Errorf("endpoints.%s: must be a mapping of settings", name)
+		}
+		for _, key := range sortedKeys(settings) {
+			setting, ok := schema[key]
+			if !ok {
+				return config, nil, fmt.Errorf("endpoints.%s.%s: unknown setting, expected one of %v", name, key,
+					settingNames(schema))
+			}
+			// the file is validated in full even where a setting is overridden
+			parsed := config
+			if err := setting.parse(&parsed, settings[key]); err != nil {
+				return config, nil, fmt.Errorf("endpoints.%s.%s: %v", name, key, err)
+			}
+			path := name + "." + key
+			if config.SettingOverridden != nil && config.SettingOverridden(setting.key) {
+				sources[path] = settingSourceEnv
+				continue
+			}
+			config = parsed
+			sources[path] = settingSourceFile
+		}
+	}
+	return config, sources, nil
+}
+
+// logEndpointConfig logs the effective settings of each endpoint and where they come from. Extra endpoint
+// bodies are redacted as they may hold credentials.
+func logEndpointConfig(config KubeAgentConfig, sources endpointConfigSources) {
+	for _, name := range endpointConfigNames() {
+		schema := endpointConfigSchema[name]
+		var settings []string
+		for _, key := range settingNames(schema) {
+			source, ok := sources[name+"."+key]
+			if !ok {
+				source = settingSourceDefault
+				if config.SettingOverridden != nil && config.SettingOverridden(schema[key].key) {
+					source = settingSourceEnv
+				}
+			}
+			settings = append(settings, fmt.Sprintf("%s=%q (%s)", key, schema[key].value(config), source))
+		}
+		log.Infof("Endpoint %s settings: %s", name, strings.Join(settings, " "))
+	}
+	for _, e := range config.extraEndpoints {
+		body := ""
+		if e.Body != "" {
+			body = "<redacted>"
+		}
+		log.Infof("Extra kubelet endpoint %s settings: path=%q method=%q body=%q", e.Name, e.Path, e.Method, body)
+	}
+}
+
+// sortedKeys returns the keys of the map in sorted order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// endpointConfigNames returns the names of the endpoints in the schema in sorted order
+func endpointConfigNames() []string {
+	names := make([]string, 0, len(endpointConfigSchema))
+	for name := range endpointConfigSchema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// settingNames returns the names of the settings of an endpoint in sorted order
+func settingNames(schema map[string]endpointSetting) []string {
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
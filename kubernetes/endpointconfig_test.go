@@ -0,0 +1,120 @@
+package kubernetes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEndpointConfig(t *testing.T) {
+	t.Run("Ensure settings in the file are applied", func(t *testing.T) {
+		config, sources, err := parseEndpointConfig(KubeAgentConfig{NodeSpecInterval: 1}, []byte(`
+endpoints:
+  pods:
+    enabled: true
+    max_bytes: 1024
+  spec:
+    interval: 4
+  cadvisor_metrics:
+    label_allowlist: [container, pod]
+  extra:
+    max_bytes: 2048
+`))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !config.RetrieveKubeletPods || config.KubeletPodsMaxBytes != 1024 || config.NodeSpecInterval != 4 ||
+			config.CadvisorLabelAllowlist != "container,pod" || config.ExtraEndpointMaxBytes != 2048 {
+			t.Errorf("expected the file settings to be applied, got %+v", config)
+		}
+		if sources["pods.max_bytes"] != settingSourceFile || len(sources) != 5 {
+			t.Errorf("expected the settings to come from the file, got %v", sources)
+		}
+	})
+
+	t.Run("Ensure env vars take precedence over the file", func(t *testing.T) {
+		config := KubeAgentConfig{
+			KubeletPodsMaxBytes: 512,
+			SettingOverridden:   func(key string) bool { return key == "kubelet_pods_max_bytes" },
+		}
+		config, sources, err := parseEndpointConfig(config, []byte("endpoints:\n  pods:\n    enabled: true\n"+
+			"    max_bytes: 1024\n"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !config.RetrieveKubeletPods || config.KubeletPodsMaxBytes != 512 {
+			t.Errorf("expected the env var to take precedence, got %+v", config)
+		}
+		if sources["pods.max_bytes"] != settingSourceEnv || sources["pods.enabled"] != settingSourceFile {
+			t.Errorf("unexpected sources %v", sources)
+		}
+	})
+
+	t.Run("Ensure invalid files are rejected with the path of the offending key", func(t *testing.T) {
+		for _, c := range []struct{ file, path string }{
+			{"endpoint:\n  pods: {}\n",
+				"endpoint: unknown key"},
+			{"endpoints:\n  cadvisor: {}\n",
+				"endpoints.cadvisor: unknown endpoint"},
+			{"endpoints:\n  pods:\n    max_byte: 1\n",
+				"endpoints.pods.max_byte: unknown setting"},
+			{"endpoints:\n  pods:\n    max_bytes: -1\n",
+				"endpoints.pods.max_bytes: must be between"},
+			{"endpoints:\n  pods:\n    max_bytes: 1.5\n",
+				"endpoints.pods.max_bytes: must be an integer"},
+			{"endpoints:\n  spec:\n    interval: 0\n",
+				"endpoints.spec.interval: must be between"},
+			{"endpoints:\n  spec:\n    enabled: yes please\n",
+				"endpoints.spec.enabled: must be true or false"},
+			{"endpoints:\n  cadvisor_metrics:\n    label_denylist: id\n",
+				"endpoints.cadvisor_metrics.label_denylist: must be a list"},
+			{"endpoints:\n  cadvisor_metrics:\n    label_denylist: [a,b]\n",
+				""},
+			{"endpoints:\n  configz: true\n",
+				"endpoints.configz: must be a mapping"},
+			// an overridden setting is still validated
+			{"endpoints:\n  extra:\n    max_bytes: many\n",
+				"endpoints.extra.max_bytes: must be an integer"},
+		} {
+			file, path := c.file, c.path
+			_, _, err := parseEndpointConfig(KubeAgentConfig{SettingOverridden: func(string) bool { return true }},
+				[]byte(file))
+			if path == "" {
+				if err != nil {
+					t.Errorf("unexpected error for %q: %v", file, err)
+				}
+				continue
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), path) {
+				t.Errorf("expected an error starting %q for %q, got %v", path, file, err)
+			}
+		}
+	})
+}
+
+func TestLoadEndpointConfig(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestLoadEndpointConfig")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if config, sources, err := loadEndpointConfig(KubeAgentConfig{}); err != nil || len(sources) != 0 ||
+		config.RetrieveKubeletConfigz {
+		t.Errorf("expected no settings without a file, got %v %v", sources, err)
+	}
+
+	file := filepath.Join(dir, "endpoints.yaml")
+	if err := os.WriteFile(file, []byte("endpoints:\n  configz:\n    enabled: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := loadEndpointConfig(KubeAgentConfig{EndpointConfigFile: file})
+	if err != nil || !config.RetrieveKubeletConfigz {
+		t.Errorf("expected configz to be enabled by the file, got %v", err)
+	}
+
+	if _, _, err := loadEndpointConfig(KubeAgentConfig{EndpointConfigFile: filepath.Join(dir, "missing")}); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
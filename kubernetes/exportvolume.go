@@ -0,0 +1,134 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// conditions of an export volume that can not be written to
+const (
+	exportVolumeReadOnly = "read_only"
+	exportVolumeFull     = "no_space"
+)
+
+// exportVolumeProbeFile prefixes the file written to probe whether the export volume is writable
+const exportVolumeProbeFile = ".write-probe-"
+
+// errExportVolumeUnwritable fails the collections attempted while the export volume can not be written to
+var errExportVolumeUnwritable = errors.New("the export volume is not writable")
+
+// exportVolume is the condition of the export volume, tracking the outage while it can not be written to and
+// the most recent recovery
+type exportVolume struct {
+	// condition is exportVolumeReadOnly or exportVolumeFull while the volume can not be written to, empty
+	// while it is writable
+	condition string
+	since     time.Time
+	// lastError is the error the volume was found unwritable with
+	lastError string
+	// recovered is when the volume last became writable again, recoveredFrom the condition it recovered from
+	recovered     time.Time
+	recoveredFrom string
+}
+
+// exportVolumeCondition returns the condition of the export volume the error reveals, empty if the error
+// is not one of a volume that can not be written to
+func exportVolumeCondition(err error) string {
+	switch {
+	case errors.Is(err, syscall.EROFS):
+		return exportVolumeReadOnly
+	case errors.Is(err, syscall.ENOSPC):
+		return exportVolumeFull
+	}
+	return ""
+}
+
+// probeExportVolume writes and removes a probe file in the export directory, returning the error if it
+// can not be written
+func probeExportVolume(exportDir string) (rerr error) {
+	f, err := os.CreateTemp(exportDir, exportVolumeProbeFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(f.Name()); err != nil && rerr == nil {
+			rerr = err
+		}
+	}()
+	defer util.SafeClose(f.Close, &rerr)
+	if _, err = f.Write([]byte("probe\n")); err != nil {
+		return err
+	}
+	// space is only allocated for the write when it is flushed on some file systems
+	return f.Sync()
+}
+
+// checkExportVolume probes the export volume before a collection. Nothing is collected while the volume can
+// not be written to, as the data could never be stored, and only a heartbeat is logged each poll until a
+// probe succeeds again. The outage is recorded in the diagnostics of the next sample once it recovers.
+func checkExportVolume(config KubeAgentConfig, state *AgentState, now time.Time) error {
+	exportDir := config.msExportDirectory.Name()
+	err := probeExportVolume(exportDir)
+	if err == nil {
+		if outage, ok := state.recoverExportVolume(now); ok {
+			log.Infof("The export volume is writable again after being %s since %s, collection resumes",
+				outage.condition, outage.since.Format(time.RFC3339))
+			if err := appendExportVolumeDiagnostics(exportDir, outage, now); err != nil {
+				log.Warnf("Warning: unable to write export volume diagnostics: %s", err)
+			}
+		}
+		return nil
+	}
+	if exportVolumeCondition(err) == "" {
+		// other errors are left to the collection to report
+		return nil
+	}
+	return exportVolumeUnwritable(config, state, err, now)
+}
+
+// exportVolumeUnwritable records that the export volume can not be written to as err revealed, returning an
+// error wrapping errExportVolumeUnwritable. Readiness is withdrawn as the condition is first detected.
+func exportVolumeUnwritable(config KubeAgentConfig, state *AgentState, err error, now time.Time) error {
+	v, detected := state.exportVolumeUnwritable(exportVolumeCondition(err), err, now)
+	if detected {
+		log.Errorf("The export volume is %s: %v. Collection is paused until it is writable again", v.condition,
+			err)
+		reportNotReady(config.ScratchDir, fmt.Sprintf("the export volume is %s", v.condition))
+	} else {
+		log.Infof("Collection paused: the export volume is %s since %s", v.condition, v.since.Format(time.RFC3339))
+	}
+	return fmt.Errorf("%w: %s since %s", errExportVolumeUnwritable, v.condition, v.since.Format(time.RFC3339))
+}
+
+// unwritableNodeError returns the first node error revealing that the export volume can not be written to,
+// nil if there is none
+func unwritableNodeError(failed map[string]error) error {
+	for _, err := range failed {
+		if exportVolumeCondition(err) != "" {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendExportVolumeDiagnostics appends an outage of the export volume to the diagnostics file of the export
+// directory
+func appendExportVolumeDiagnostics(exportDir string, outage exportVolume, recovered time.Time) (rerr error) {
+	//nolint gosec
+	f, err := os.OpenFile(filepath.Join(exportDir, sample.DiagnosticsFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer util.SafeClose(f.Close, &rerr)
+	_, err = fmt.Fprintf(f, "Export volume not writable:\n %s %s until %s: %s\n", outage.since.UTC().Format(time.RFC3339),
+		outage.condition, recovered.UTC().Format(time.RFC3339), outage.lastError)
+	return err
+}
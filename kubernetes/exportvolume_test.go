@@ -0,0 +1,116 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+)
+
+func TestExportVolumeCondition(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "read-only", err: &os.PathError{Op: "open", Path: "/tmp/x", Err: syscall.EROFS},
+			want: exportVolumeReadOnly},
+		{name: "wrapped no space", err: fmt.Errorf("unable to create raw metric file: %w",
+			&os.PathError{Op: "write", Path: "/tmp/x", Err: syscall.ENOSPC}), want: exportVolumeFull},
+		{name: "permission denied", err: &os.PathError{Op: "open", Path: "/tmp/x", Err: syscall.EACCES}},
+		{name: "no error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exportVolumeCondition(tt.err); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	failed := map[string]error{
+		"node0": errors.New("invalid response 500"),
+		"node1": fmt.Errorf("node metrics retrieval problem occurred: %w", syscall.EROFS),
+	}
+	if err := unwritableNodeError(failed); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("expected the read-only node error, got %v", err)
+	}
+	delete(failed, "node1")
+	if err := unwritableNodeError(failed); err != nil {
+		t.Errorf("expected no unwritable error, got %v", err)
+	}
+}
+
+func TestExportVolumeOutage(t *testing.T) {
+	scratchDir := t.TempDir()
+	exportDir := filepath.Join(scratchDir, "export")
+	if err := os.Mkdir(exportDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(exportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	config := KubeAgentConfig{ScratchDir: scratchDir, msExportDirectory: f, PollInterval: 180}
+	state := newAgentState(config, NodeConnection{})
+	ready := filepath.Join(scratchDir, readinessFile)
+	if err := os.WriteFile(ready, []byte("ready\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	readOnly := &os.PathError{Op: "open", Path: exportDir, Err: syscall.EROFS}
+
+	t.Run("Ensure the outage withdraws readiness and pauses collection", func(t *testing.T) {
+		err := exportVolumeUnwritable(config, state, readOnly, start)
+		if !errors.Is(err, errExportVolumeUnwritable) {
+			t.Fatalf("expected the collection to be paused, got %v", err)
+		}
+		if _, err := os.Stat(ready); !os.IsNotExist(err) {
+			t.Errorf("expected the agent not to be ready: %v", err)
+		}
+		err = exportVolumeUnwritable(config, state, readOnly, start.Add(3*time.Minute))
+		if err == nil || !strings.Contains(err.Error(), "read_only since 2026-10-16T09:00:00Z") {
+			t.Errorf("expected the outage to keep its start time, got %v", err)
+		}
+		v := state.status().exportVolume
+		if v.condition != exportVolumeReadOnly || !v.since.Equal(start) || !strings.Contains(v.lastError,
+			"read-only file system") {
+			t.Errorf("unexpected export volume %+v", v)
+		}
+
+		recordPollInterval(config, state, start.Add(3*time.Minute), err, DegradationNone)
+		if _, err := os.Stat(filepath.Join(scratchDir, sampleRateFile)); !os.IsNotExist(err) {
+			t.Errorf("expected nothing to be written during the outage: %v", err)
+		}
+	})
+
+	t.Run("Ensure a successful probe recovers and records the outage", func(t *testing.T) {
+		recovered := start.Add(time.Hour)
+		if err := checkExportVolume(config, state, recovered); err != nil {
+			t.Fatalf("expected the writable volume to recover, got %v", err)
+		}
+		v := state.status().exportVolume
+		if v.condition != "" || !v.recovered.Equal(recovered) || v.recoveredFrom != exportVolumeReadOnly {
+			t.Errorf("expected the recovery to be recorded, got %+v", v)
+		}
+		entries, err := os.ReadDir(exportDir)
+		if err != nil || len(entries) != 1 || entries[0].Name() != sample.DiagnosticsFile {
+			t.Fatalf("expected only the diagnostics file to remain, got %v %v", entries, err)
+		}
+		diag, _ := os.ReadFile(filepath.Join(exportDir, sample.DiagnosticsFile))
+		if !strings.Contains(string(diag), "2026-10-16T09:00:00Z read_only until 2026-10-16T10:00:00Z") {
+			t.Errorf("expected the outage in the diagnostics, got %q", diag)
+		}
+		if err := checkExportVolume(config, state, recovered.Add(time.Minute)); err != nil {
+			t.Errorf("unexpected error probing the writable volume: %v", err)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+)
+
+// DefaultExtraEndpointMaxBytes is the default limit on the combined size of all extra endpoint
+// responses collected from a single node each cycle
+const DefaultExtraEndpointMaxBytes int64 = 10 * 1024 * 1024
+
+// reservedSourceNames are used by the built in node sources and may not be used by extra endpoints
+var reservedSourceNames = []string{sample.SummarySource, sample.ContainerSource, sample.CadvisorMetricsSource,
+	sample.ResourceMetricsSource, sample.ProbesSource, sample.KubeletMetricsSource}
+
+// builtInEndpoints are the kubelet paths collected by the built in node sources, which extra endpoints may not
+// collect again
+var builtInEndpoints = []Endpoint{NodeStatsSummaryEndpoint, NodeKubeletMetricsEndpoint, NodePodsEndpoint,
+	NodeSpecEndpoint, NodeConfigzEndpoint, NodeProbeMetricsEndpoint, NodeResourceMetricsEndpoint}
+
+// ExtraEndpoint describes an additional kubelet path that is probed at startup and collected
+// from every node, written to a "<prefix>-<name>-<node>" file in the sample
+type ExtraEndpoint struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Method string `json:"method,omitempty"`
+	// Body is an optional text/template rendered per node, eg: {"node":"{{.NodeName}}"}
+	Body string `json:"body,omitempty"`
+
+	bodyTemplate *template.Template
+}
+
+// extraEndpointBodyData is the data available to an extra endpoint body template
+type extraEndpointBodyData struct {
+	NodeName string
+}
+
+// ParseExtraEndpoints parses and validates a JSON list of extra endpoint definitions
+func ParseExtraEndpoints(definitions string) ([]ExtraEndpoint, error) {
+	if strings.TrimSpace(definitions) == "" {
+		return nil, nil
+	}
+
+	var endpoints []ExtraEndpoint
+	if err := json.Unmarshal([]byte(definitions), &endpoints); err != nil {
+		return nil, fmt.Errorf("unable to parse extra kubelet endpoints: %v", err)
+	}
+
+	names, paths := map[string]bool{}, map[string]bool{}
+	for i := range endpoints {
+		if err := endpoints[i].init(); err != nil {
+			return nil, err
+		}
+		if names[endpoints[i].Name] {
+			return nil, fmt.Errorf("extra kubelet endpoint name %q is defined more than once", endpoints[i].Name)
+		}
+		names[endpoints[i].Name] = true
+
+		path := strings.TrimSuffix(endpoints[i].Path, "/")
+		for _, builtIn := range builtInEndpoints {
+			if path == string(builtIn) {
+				return nil, fmt.Errorf("extra kubelet endpoint %q path %s is collected by a built in source",
+					endpoints[i].Name, endpoints[i].Path)
+			}
+		}
+		if paths[path] {
+			return nil, fmt.Errorf("extra kubelet endpoint path %s is defined more than once", endpoints[i].Path)
+		}
+		paths[path] = true
+	}
+	return endpoints, nil
+}
+
+// optionalSources returns the optional node sources that are retrieved, their names are only reserved while
+// they are retrieved as extra endpoints have long collected the same kubelet paths under them
+func (ka KubeAgentConfig) optionalSources() []string {
+	var sources []string
+	if ka.RetrieveKubeletPods {
+		sources = append(sources, sample.KubeletPodsSource)
+	}
+	if ka.RetrieveNodeSpec {
+		sources = append(sources, sample.NodeSpecSource)
+	}
+	if ka.RetrieveKubeletConfigz {
+		sources = append(sources, sample.KubeletConfigzSource)
+	}
+	return sources
+}
+
+// checkOptionalSources returns an error if an extra endpoint is written to the files of a retrieved
+// optional node source
+func checkOptionalSources(endpoints []ExtraEndpoint, sources []string) error {
+	for _, e := range endpoints {
+		for _, source := range sources {
+			if e.Name == source {
+				return fmt.Errorf("extra kubelet endpoint name %q conflicts with the built in source retrieving "+
+					"the same data, remove the extra endpoint as it is collected in its place", e.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// init validates the endpoint definition, applies defaults and compiles the body template
+func (e *ExtraEndpoint) init() error {
+	if e.Name == "" || util.SanitizeFileName(e.Name) != e.Name || strings.Contains(e.Name, "-") {
+		return fmt.Errorf("extra kubelet endpoint name %q must only contain letters, numbers, '.' or '_'", e.Name)
+	}
+	for _, reserved := range reservedSourceNames {
+		if e.Name == reserved {
+			return fmt.Errorf("extra kubelet endpoint name %q conflicts with built in source %q", e.Name, reserved)
+		}
+	}
+	if !strings.HasPrefix(e.Path, "/") {
+		return fmt.Errorf("extra kubelet endpoint %q path must start with /", e.Name)
+	}
+
+	e.Method = strings.ToUpper(e.Method)
+	switch e.Method {
+	case "":
+		e.Method = http.MethodGet
+	case http.MethodGet, http.MethodPost:
+	default:
+		return fmt.Errorf("extra kubelet endpoint %q method must be GET or POST", e.Name)
+	}
+
+	if e.Body != "" {
+		t, err := template.New(e.Name).Option("missingkey=error").Parse(e.Body)
+		if err != nil {
+			return fmt.Errorf("extra kubelet endpoint %q has an invalid body template: %v", e.Name, err)
+		}
+		e.bodyTemplate = t
+	}
+	return nil
+}
+
+// endpoint returns the Endpoint used to track availability of the extra endpoint, keyed by its name so it
+// never shares the availability of a built in endpoint or of another extra endpoint
+func (e ExtraEndpoint) endpoint() Endpoint {
+	return Endpoint("extra:" + e.Name)
+}
+
+// requestBody renders the body template for the given node
+func (e ExtraEndpoint) requestBody(nodeName string) ([]byte, error) {
+	if e.bodyTemplate == nil {
+		return nil, nil
+	}
+	var b bytes.Buffer
+	if err := e.bodyTemplate.Execute(&b, extraEndpointBodyData{NodeName: nodeName}); err != nil {
+		return nil, fmt.Errorf("unable to render body for extra kubelet endpoint %q: %v", e.Name, err)
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,160 @@
+package kubernetes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/util"
+)
+
+func TestParseExtraEndpoints(t *testing.T) {
+	t.Run("Ensure valid definitions are parsed with defaults applied", func(t *testing.T) {
+		endpoints, err := ParseExtraEndpoints(`[{"name":"pods","path":"/runningpods"},` +
+			`{"name":"node_stats","path":"/stats/","method":"post","body":"{\"node\":\"{{.NodeName}}\"}"}]`)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(endpoints) != 2 {
+			t.Fatalf("expected 2 endpoints, got %d", len(endpoints))
+		}
+		if endpoints[0].Method != http.MethodGet || endpoints[1].Method != http.MethodPost {
+			t.Errorf("unexpected methods: %s, %s", endpoints[0].Method, endpoints[1].Method)
+		}
+		body, err := endpoints[1].requestBody("node0")
+		if err != nil || string(body) != `{"node":"node0"}` {
+			t.Errorf("unexpected rendered body %s: %v", body, err)
+		}
+		if e := endpoints[0].endpoint(); e != "extra:pods" {
+			t.Errorf("expected the endpoint to be keyed by its name, got %s", e)
+		}
+	})
+
+	t.Run("Ensure names only extending a reserved name are allowed", func(t *testing.T) {
+		endpoints, err := ParseExtraEndpoints(`[{"name":"summary_v2","path":"/stats/summary/v2"},` +
+			`{"name":"probes_v2","path":"/metrics/probes/v2"}]`)
+		if err != nil || len(endpoints) != 2 {
+			t.Errorf("expected the endpoints to be parsed, got %+v: %v", endpoints, err)
+		}
+	})
+
+	t.Run("Ensure empty definitions are allowed", func(t *testing.T) {
+		endpoints, err := ParseExtraEndpoints("")
+		if err != nil || len(endpoints) != 0 {
+			t.Errorf("expected no endpoints and no error, got %+v: %v", endpoints, err)
+		}
+	})
+
+	invalid := map[string]string{
+		"path without leading slash": `[{"name":"pods","path":"pods"}]`,
+		"name with separator":        `[{"name":"my-pods","path":"/runningpods"}]`,
+		"name with path characters":  `[{"name":"../pods","path":"/runningpods"}]`,
+		"reserved name":              `[{"name":"summary","path":"/stats/summary/v2"}]`,
+		"duplicate name":             `[{"name":"pods","path":"/runningpods"},{"name":"pods","path":"/checkpoint"}]`,
+		"unsupported method":         `[{"name":"pods","path":"/runningpods","method":"DELETE"}]`,
+		"invalid body template":      `[{"name":"pods","path":"/runningpods","body":"{{.NodeName"}]`,
+		"invalid json":               `{"name":"pods"}`,
+		"built in path":              `[{"name":"kubelet_pods","path":"/pods"}]`,
+		"built in path with slash":   `[{"name":"machine","path":"/spec/"}]`,
+		"duplicate path":             `[{"name":"healthz","path":"/healthz"},{"name":"health","path":"/healthz/"}]`,
+	}
+	for name, definitions := range invalid {
+		t.Run("Ensure invalid definition is rejected: "+name, func(t *testing.T) {
+			if _, err := ParseExtraEndpoints(definitions); err == nil {
+				t.Errorf("expected an error for %s", definitions)
+			}
+		})
+	}
+}
+
+func TestRetrieveExtraEndpoints(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"path":"` + r.URL.Path + `"}`))
+	}))
+	defer ts.Close()
+
+	endpoints, err := ParseExtraEndpoints(`[{"name":"pods","path":"/runningpods"}]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	setup := func(maxBytes int64) (*util.WorkDir, KubeAgentConfig, *EndpointMask, []ConnectionMethod) {
+		dir, err := os.MkdirTemp("", "TestRetrieveExtraEndpoints")
+		if err != nil {
+			t.Fatalf("error creating temp dir: %v", err)
+		}
+		workDir := util.NewWorkDir(dir)
+		config := KubeAgentConfig{
+			ExtraEndpointMaxBytes: maxBytes,
+			extraEndpoints:        endpoints,
+		}
+		mask := NewEndpointMask()
+		mask.SetAvailability(endpoints[0].endpoint(), Proxy, true)
+		cms := []ConnectionMethod{{
+			ConnType:     Proxy,
+			API:          setupProxyAPI(ts.URL, "node0"),
+			client:       raw.NewClient(http.Client{}, true, nil, 0, false),
+			FriendlyName: proxy,
+		}}
+		return workDir, config, mask, cms
+	}
+
+	t.Run("Ensure extra endpoints are written to per node files", func(t *testing.T) {
+		workDir, config, mask, cms := setup(0)
+		defer os.RemoveAll(workDir.Name())
+		nd := nodeFetchData{nodeName: "node0", prefix: "stats", workDir: workDir}
+		retrieveExtraEndpoints(context.TODO(), nd, config, pollCycle{}, mask, cms,
+			sourceName{prefix: "stats", nodeName: "node0"})
+
+		data, err := os.ReadFile(workDir.Name() + "/stats-pods-node0.json")
+		if err != nil {
+			t.Fatalf("expected extra endpoint file to be written: %v", err)
+		}
+		if !strings.Contains(string(data), "/api/v1/nodes/node0/proxy/runningpods") {
+			t.Errorf("unexpected extra endpoint content: %s", data)
+		}
+	})
+
+	t.Run("Ensure responses over the size limit are discarded", func(t *testing.T) {
+		workDir, config, mask, cms := setup(5)
+		defer os.RemoveAll(workDir.Name())
+		nd := nodeFetchData{nodeName: "node0", prefix: "stats", workDir: workDir}
+		retrieveExtraEndpoints(context.TODO(), nd, config, pollCycle{}, mask, cms,
+			sourceName{prefix: "stats", nodeName: "node0"})
+
+		if _, err := os.Stat(workDir.Name() + "/stats-pods-node0.json"); !os.IsNotExist(err) {
+			t.Errorf("expected oversized extra endpoint file to be removed: %v", err)
+		}
+	})
+}
+
+func TestCheckOptionalSources(t *testing.T) {
+	endpoints, err := ParseExtraEndpoints(`[{"name":"pods","path":"/runningpods"},{"name":"spec","path":"/stats/spec"},` +
+		`{"name":"pods_v2","path":"/checkpoint"}]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		config   KubeAgentConfig
+		conflict bool
+	}{
+		{config: KubeAgentConfig{}, conflict: false},
+		{config: KubeAgentConfig{RetrieveKubeletPods: true}, conflict: true},
+		{config: KubeAgentConfig{RetrieveNodeSpec: true}, conflict: true},
+	}
+	for _, tc := range tests {
+		err := checkOptionalSources(endpoints, tc.config.optionalSources())
+		if (err != nil) != tc.conflict {
+			t.Errorf("expected conflict %v for %+v, got %v", tc.conflict, tc.config, err)
+		}
+	}
+	sources := KubeAgentConfig{RetrieveKubeletPods: true, RetrieveNodeSpec: true}.optionalSources()
+	if err := checkOptionalSources(endpoints[2:], sources); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
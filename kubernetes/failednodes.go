@@ -0,0 +1,180 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultFailedNodeLogLimit is the default number of failed nodes logged with their full error
+const DefaultFailedNodeLogLimit = 20
+
+// DefaultFailedNodeReportLimit is the default number of failed nodes reported with their full error
+// in the agent status measurement of each sample
+const DefaultFailedNodeReportLimit = 500
+
+// maxFailedNodeLogRecordBytes bounds the size of each failed node log record
+const maxFailedNodeLogRecordBytes = 8 * 1024
+
+// maxFailedNodeLogErrorBytes bounds the size of a single error within a failed node log record
+const maxFailedNodeLogErrorBytes = 1024
+
+// maxErrorClassLength bounds the length of the error class used to aggregate failures
+const maxErrorClassLength = 256
+
+var (
+	errorClassURL    = regexp.MustCompile(`https?://[^\s"']+`)
+	errorClassNumber = regexp.MustCompile(`[0-9]+`)
+)
+
+// failedNode is a single node that failed collection
+type failedNode struct {
+	name string
+	err  string
+}
+
+// failedNodeClass is a count of failed nodes beyond the detail limit sharing the same class of error
+type failedNodeClass struct {
+	class string
+	count int
+}
+
+// failedNodeSummary holds up to a limited number of failed nodes in detail, sorted by node name, with
+// the remaining failures aggregated by error class
+type failedNodeSummary struct {
+	detailed   []failedNode
+	aggregated []failedNodeClass
+}
+
+// summarizeFailedNodes retains the full error for up to limit failed nodes and aggregates the rest by
+// error class. A limit below 0 retains every failed node in detail.
+func summarizeFailedNodes(failed map[string]error, limit int) failedNodeSummary {
+	names := make([]string, 0, len(failed))
+	for name := range failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var s failedNodeSummary
+	counts := map[string]int{}
+	for _, name := range names {
+		if limit < 0 || len(s.detailed) < limit {
+			s.detailed = append(s.detailed, failedNode{name: name, err: failed[name].Error()})
+			continue
+		}
+		counts[errorClass(failed[name])]++
+	}
+
+	for class, count := range counts {
+		s.aggregated = append(s.aggregated, failedNodeClass{class: class, count: count})
+	}
+	sort.Slice(s.aggregated, func(i, j int) bool {
+		if s.aggregated[i].count != s.aggregated[j].count {
+			return s.aggregated[i].count > s.aggregated[j].count
+		}
+		return s.aggregated[i].class < s.aggregated[j].class
+	})
+	return s
+}
+
+// errorClass normalizes an error so errors that differ only by node address or numbers share a class
+func errorClass(err error) string {
+	class := strings.SplitN(err.Error(), "\n", 2)[0]
+	class = errorClassURL.ReplaceAllString(class, "<url>")
+	class = errorClassNumber.ReplaceAllString(class, "#")
+	return truncate(class, maxErrorClassLength)
+}
+
+// truncate shortens s to at most n bytes, marking that it was truncated
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "...(truncated)"
+}
+
+// countStalledNodes returns the number of failed nodes whose kubelet response stalled
+func countStalledNodes(failed map[string]error) int {
+	count := 0
+	for _, err := range failed {
+		if errors.Is(err, raw.ErrResponseStalled) {
+			count++
+		}
+	}
+	return count
+}
+
+// logFailedNodes warns about failed nodes, splitting the detail into bounded size log records so large
+// failure events cannot produce a single enormous log line
+func logFailedNodes(message string, failed map[string]error, limit int) {
+	if len(failed) == 0 {
+		return
+	}
+	s := summarizeFailedNodes(failed, limit)
+
+	var records []string
+	var b strings.Builder
+	for _, n := range s.detailed {
+		entry := fmt.Sprintf("[%s: %s] ", n.name,
+			truncate(strings.Join(strings.Fields(n.err), " "), maxFailedNodeLogErrorBytes))
+		if b.Len() > 0 && b.Len()+len(entry) > maxFailedNodeLogRecordBytes {
+			records = append(records, b.String())
+			b.Reset()
+		}
+		b.WriteString(entry)
+	}
+	if b.Len() > 0 {
+		records = append(records, b.String())
+	}
+
+	log.Warnf("%s: %d nodes failed", message, len(failed))
+	for i, r := range records {
+		log.Warnf("%s (%d/%d): %s", message, i+1, len(records), strings.TrimSpace(r))
+	}
+	for _, c := range s.aggregated {
+		log.Warnf("%s: %d additional nodes failed with: %s", message, c.count, c.class)
+	}
+}
+
+// logNodeReadiness logs the number of ready and not ready nodes, naming up to notReadyNodeLimit of the not
+// ready nodes
+func logNodeReadiness(message string, r *sample.NodeReadiness) {
+	if r == nil {
+		return
+	}
+	if r.NotReady == 0 {
+		log.Infof("%s: %d nodes, %d ready", message, r.Total, r.Ready)
+		return
+	}
+	names := r.NotReadyNodes
+	more := ""
+	if len(names) > notReadyNodeLimit {
+		names, more = names[:notReadyNodeLimit], fmt.Sprintf(" and %d more", len(names)-notReadyNodeLimit)
+	}
+	log.Infof("%s: %d nodes, %d ready, %d not ready [%s]%s", message, r.Total, r.Ready, r.NotReady,
+		strings.Join(names, ", "), more)
+}
+
+// logSkippedNodes logs the number of nodes intentionally left out of collection by reason, apart from the
+// failed nodes as they are not failures
+func logSkippedNodes(message string, skipped map[string]string) {
+	if len(skipped) == 0 {
+		return
+	}
+	counts := map[string]int{}
+	for _, reason := range skipped {
+		counts[reason]++
+	}
+	reasons := make([]string, 0, len(counts))
+	for reason, count := range counts {
+		reasons = append(reasons, fmt.Sprintf("%s: %d", reason, count))
+	}
+	sort.Strings(reasons)
+	log.Infof("%s: %d nodes skipped (%s)", message, len(skipped), strings.Join(reasons, ", "))
+}
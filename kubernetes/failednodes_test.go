@@ -0,0 +1,72 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestSummarizeFailedNodes(t *testing.T) {
+	failed := map[string]error{}
+	for i := 0; i < 10; i++ {
+		failed[fmt.Sprintf("node%d", i)] = fmt.Errorf("Get https://10.0.0.%d:10250/stats/summary: "+
+			"x509: certificate has expired\nretried %d times", i, i)
+	}
+	failed["proxy0"] = errors.New("provider ID for node does not exist")
+
+	t.Run("Ensure failures beyond the limit are aggregated by error class", func(t *testing.T) {
+		s := summarizeFailedNodes(failed, 3)
+		if len(s.detailed) != 3 || s.detailed[0].name != "node0" || s.detailed[2].name != "node2" {
+			t.Fatalf("unexpected detailed failures: %+v", s.detailed)
+		}
+		if len(s.aggregated) != 2 {
+			t.Fatalf("expected 2 error classes, got %+v", s.aggregated)
+		}
+		if s.aggregated[0].count != 7 || s.aggregated[0].class != "Get <url> x#: certificate has expired" {
+			t.Errorf("unexpected aggregate: %+v", s.aggregated[0])
+		}
+		if s.aggregated[1].count != 1 {
+			t.Errorf("unexpected aggregate: %+v", s.aggregated[1])
+		}
+	})
+
+	t.Run("Ensure a negative limit retains every failure", func(t *testing.T) {
+		s := summarizeFailedNodes(failed, -1)
+		if len(s.detailed) != len(failed) || len(s.aggregated) != 0 {
+			t.Errorf("expected all failures in detail, got %d detailed and %d aggregated",
+				len(s.detailed), len(s.aggregated))
+		}
+	})
+}
+
+func TestLogFailedNodes(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	failed := map[string]error{}
+	for i := 0; i < 100; i++ {
+		failed[fmt.Sprintf("node%03d", i)] = errors.New(strings.Repeat("certificate has expired\n", 200))
+	}
+
+	logFailedNodes("failed to get node metrics", failed, 50)
+
+	if len(hook.Entries) < 3 {
+		t.Fatalf("expected the failures to be split across log records, got %d", len(hook.Entries))
+	}
+	for _, e := range hook.Entries {
+		if len(e.Message) > maxFailedNodeLogRecordBytes+256 {
+			t.Errorf("expected bounded log records, got %d bytes", len(e.Message))
+		}
+		if e.Level != log.WarnLevel {
+			t.Errorf("expected warning level, got %s", e.Level)
+		}
+	}
+	last := hook.LastEntry().Message
+	if !strings.Contains(last, "50 additional nodes failed") {
+		t.Errorf("expected aggregated overflow to be logged, got %s", last)
+	}
+}
@@ -0,0 +1,53 @@
+package kubernetes
+
+import (
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMaxOpenFiles is the default maximum number of node metric files open at once
+const DefaultMaxOpenFiles = 256
+
+// baseOpenFiles estimates the descriptors held outside of node collection: logs, the sample directories,
+// informer watches and API server connections
+const baseOpenFiles = 64
+
+// openFileWarnPercent is the percentage of the open file limit the estimated peak must reach to warn
+const openFileWarnPercent = 80
+
+// estimateOpenFiles estimates the peak number of descriptors used during a collection. Each concurrent
+// node poll holds a connection and an output file for each endpoint it collects.
+func estimateOpenFiles(config KubeAgentConfig, nodeCount int) int {
+	concurrent := config.ConcurrentPollers
+	if nodeCount < concurrent {
+		concurrent = nodeCount
+	}
+	endpoints := 1 + len(config.extraEndpoints)
+
+	connections := concurrent * endpoints
+	files := connections
+	if config.MaxOpenFiles > 0 && files > config.MaxOpenFiles {
+		files = config.MaxOpenFiles
+	}
+	return baseOpenFiles + connections + files
+}
+
+// checkOpenFileBudget logs the open file limit of the process and warns when a collection of the given
+// number of nodes may approach it
+func checkOpenFileBudget(config KubeAgentConfig, nodeCount int) {
+	limit, err := util.OpenFileLimit()
+	if err != nil {
+		log.Debugf("Unable to determine the open file limit: %v", err)
+		return
+	}
+	estimate := estimateOpenFiles(config, nodeCount)
+	log.Infof("Open file limit (RLIMIT_NOFILE) is %d, estimated peak use collecting %d nodes is %d",
+		limit, nodeCount, estimate)
+
+	if uint64(estimate)*100 >= limit*openFileWarnPercent {
+		log.Warnf("Collecting %d nodes with %d concurrent pollers may use %d of the %d open files allowed, "+
+			"collection may fail with \"too many open files\". Raise the open file limit or lower "+
+			"CLOUDABILITY_NUMBER_OF_CONCURRENT_NODE_POLLERS or CLOUDABILITY_MAX_OPEN_FILES",
+			nodeCount, config.ConcurrentPollers, estimate, limit)
+	}
+}
@@ -0,0 +1,23 @@
+package kubernetes
+
+import "testing"
+
+func TestEstimateOpenFiles(t *testing.T) {
+	config := KubeAgentConfig{
+		ConcurrentPollers: 100,
+		extraEndpoints:    []ExtraEndpoint{{Name: "pods", Path: "/pods"}, {Name: "spec", Path: "/spec"}},
+	}
+
+	t.Run("Ensure concurrency is bounded by the number of nodes", func(t *testing.T) {
+		if n := estimateOpenFiles(config, 10); n != baseOpenFiles+30+30 {
+			t.Errorf("unexpected estimate %d", n)
+		}
+	})
+
+	t.Run("Ensure open output files are capped", func(t *testing.T) {
+		config.MaxOpenFiles = 50
+		if n := estimateOpenFiles(config, 3000); n != baseOpenFiles+300+50 {
+			t.Errorf("unexpected estimate %d", n)
+		}
+	})
+}
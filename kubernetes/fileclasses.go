@@ -0,0 +1,81 @@
+package kubernetes
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cloudability/metrics-agent/client"
+	"github.com/cloudability/metrics-agent/sample"
+)
+
+// allFileClasses configures a destination to accept every file class
+const allFileClasses = "*"
+
+// fileClassFilter restricts a sample to the file classes accepted by its destination. An empty filter
+// accepts every class, as local and export only destinations do.
+type fileClassFilter []string
+
+// acceptedFileClasses returns the filter for the file classes accepted by the upload endpoint: the core
+// classes and those it advertised, or those in the comma separated allowlist when configured
+func acceptedFileClasses(allowlist string, limits client.UploadLimits) fileClassFilter {
+	classes := limits.FileClasses
+	if strings.TrimSpace(allowlist) != "" {
+		classes = nil
+		for _, class := range strings.Split(allowlist, ",") {
+			class = strings.ToLower(strings.TrimSpace(class))
+			if class == allFileClasses {
+				return nil
+			}
+			if class != "" {
+				classes = append(classes, class)
+			}
+		}
+	}
+	return append(append(fileClassFilter{}, sample.CoreFileClasses...), classes...)
+}
+
+// accepts returns true if the files of the class are included in the sample, files outside the layout are
+// always included
+func (f fileClassFilter) accepts(class string) bool {
+	if len(f) == 0 || class == "" {
+		return true
+	}
+	for _, accepted := range f {
+		if accepted == class {
+			return true
+		}
+	}
+	return false
+}
+
+// exclude removes the files of classes not accepted from the sample directory, returning the classes
+// excluded
+func (f fileClassFilter) exclude(msd string) ([]string, error) {
+	if len(f) == 0 {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(msd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list sample directory: %v", err)
+	}
+	excluded := map[string]bool{}
+	for _, e := range entries {
+		class := sample.FileClass(e.Name())
+		if e.IsDir() || f.accepts(class) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(msd, e.Name())); err != nil {
+			return nil, fmt.Errorf("unable to remove %s: %v", e.Name(), err)
+		}
+		excluded[class] = true
+	}
+	classes := make([]string, 0, len(excluded))
+	for class := range excluded {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes, nil
+}
@@ -0,0 +1,77 @@
+package kubernetes
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/client"
+	"github.com/cloudability/metrics-agent/sample"
+)
+
+func TestAcceptedFileClasses(t *testing.T) {
+	limits := client.UploadLimits{FileClasses: []string{"node-probes"}}
+
+	f := acceptedFileClasses("", limits)
+	if !f.accepts(sample.ResourcesClass) || !f.accepts("node-probes") || f.accepts("node-resource") {
+		t.Errorf("expected the core and advertised classes to be accepted, got %v", f)
+	}
+	if !f.accepts("") {
+		t.Error("expected files outside the layout to be accepted")
+	}
+
+	f = acceptedFileClasses(" Node-Resource, ", limits)
+	if !f.accepts(sample.ClusterSummaryClass) || !f.accepts("node-resource") || f.accepts("node-probes") {
+		t.Errorf("expected the allowlist to replace the advertised classes, got %v", f)
+	}
+
+	if f := acceptedFileClasses("node-probes,*", limits); len(f) != 0 || !f.accepts("node-resource") {
+		t.Errorf("expected * to accept every class, got %v", f)
+	}
+}
+
+func TestExcludeFileClasses(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestExcludeFileClasses")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeSampleFiles(t, dir, map[string]string{
+		sample.AgentMeasurementFile:         "{}",
+		"pods.jsonl":                        "{}",
+		"stats-summary-node0.json":          "{}",
+		"stats-probes-node0.txt":            "probes",
+		"stats-probes-node1.txt.unchanged":  "{}",
+		"stats-resource-node0.txt":          "resource",
+		"baseline-resource-node0.txt":       "resource",
+		"stats-cadvisor_metrics-node0.txt":  "cadvisor",
+		"baseline-summary-node0.json":       "{}",
+		"stats-container-node0.json":        "{}",
+		"baseline-cadvisor_metrics-node0.x": "cadvisor",
+	})
+
+	excluded, err := acceptedFileClasses("node-resource", client.UploadLimits{}).exclude(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(excluded, ",") != "node-probes" {
+		t.Errorf("expected node-probes to be excluded, got %v", excluded)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "stats-probes-") {
+			t.Errorf("expected %s to be removed", e.Name())
+		}
+	}
+	if len(entries) != 9 {
+		t.Errorf("expected the accepted files to remain, got %d files", len(entries))
+	}
+
+	if excluded, err := fileClassFilter(nil).exclude(dir); err != nil || len(excluded) != 0 {
+		t.Errorf("expected an empty filter to exclude nothing, got %v %v", excluded, err)
+	}
+}
@@ -0,0 +1,115 @@
+package kubernetes
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+)
+
+// sampleFreshness records when the data of a sample was collected and where from, as node stats, resources
+// and baselines are gathered at different times within a collection
+type sampleFreshness struct {
+	// stats is the collection of the node stats, reported for the class of each node source in the sample
+	stats   *sample.ClassFreshness
+	classes map[string]sample.ClassFreshness
+}
+
+func newSampleFreshness() *sampleFreshness {
+	return &sampleFreshness{classes: map[string]sample.ClassFreshness{}}
+}
+
+// recordNodeStats records the collection of the node stats, which are listed live from the kubelets
+func (f *sampleFreshness) recordNodeStats(start, end time.Time) {
+	f.stats = &sample.ClassFreshness{Source: sample.FreshnessLiveList, Start: start.UTC(), End: end.UTC()}
+}
+
+// record records the collection of the data of a file class
+func (f *sampleFreshness) record(class, source string, start, end time.Time) {
+	f.classes[class] = sample.ClassFreshness{Class: class, Source: source, Start: start.UTC(), End: end.UTC()}
+}
+
+// spread returns the time between the start of the earliest and the end of the latest data collected for
+// the sample. Node baselines are not included as they are the node stats of the previous sample by design.
+func (f *sampleFreshness) spread() time.Duration {
+	var earliest, latest time.Time
+	include := func(c sample.ClassFreshness) {
+		if earliest.IsZero() || c.Start.Before(earliest) {
+			earliest = c.Start
+		}
+		if c.End.After(latest) {
+			latest = c.End
+		}
+	}
+	if f.stats != nil {
+		include(*f.stats)
+	}
+	for _, c := range f.classes {
+		include(c)
+	}
+	return latest.Sub(earliest)
+}
+
+// report returns the freshness of each recorded file class with files in the sample directory, and of the
+// node baselines in it, which are dated by when they were written at the end of the previous collection.
+// It is sorted by class, with the baselines of a class following its stats.
+func (f *sampleFreshness) report(msd string) ([]sample.ClassFreshness, error) {
+	entries, err := os.ReadDir(msd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list sample directory: %v", err)
+	}
+	classes := map[string]sample.ClassFreshness{}
+	baselines := map[string]sample.ClassFreshness{}
+	for _, e := range entries {
+		class := sample.FileClass(e.Name())
+		if e.IsDir() || class == "" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(e.Name(), sample.BaselinePrefix+"-"):
+			info, err := e.Info()
+			if err != nil {
+				return nil, fmt.Errorf("unable to stat sample file: %v", err)
+			}
+			written := info.ModTime().UTC()
+			b, ok := baselines[class]
+			if !ok {
+				b = sample.ClassFreshness{Class: class, Baseline: true, Source: sample.FreshnessPreviousSample,
+					Start: written, End: written}
+			}
+			if written.Before(b.Start) {
+				b.Start = written
+			}
+			if written.After(b.End) {
+				b.End = written
+			}
+			baselines[class] = b
+		case strings.HasPrefix(e.Name(), sample.StatsPrefix+"-") && f.stats != nil:
+			c := *f.stats
+			c.Class = class
+			classes[class] = c
+		default:
+			if c, ok := f.classes[class]; ok {
+				classes[class] = c
+			}
+		}
+	}
+
+	freshness := make([]sample.ClassFreshness, 0, len(classes)+len(baselines))
+	for _, c := range classes {
+		freshness = append(freshness, c)
+	}
+	for _, b := range baselines {
+		freshness = append(freshness, b)
+	}
+	sort.Slice(freshness, func(i, j int) bool {
+		if freshness[i].Class != freshness[j].Class {
+			return freshness[i].Class < freshness[j].Class
+		}
+		return !freshness[i].Baseline && freshness[j].Baseline
+	})
+	return freshness, nil
+}
@@ -0,0 +1,77 @@
+package kubernetes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+)
+
+func TestSampleFreshness(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestSampleFreshness")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []string{"stats-summary-node0.json", "stats-summary-node1.json", "stats-cadvisor_metrics-node0.txt",
+		"baseline-summary-node0.json", "baseline-summary-node1.json", "pods.jsonl", sample.NodeMetadataFile,
+		sample.AgentMeasurementFile}
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// baselines are dated by when the previous collection wrote them
+	for i, name := range []string{"baseline-summary-node0.json", "baseline-summary-node1.json"} {
+		written := start.Add(time.Duration(i-60) * time.Second)
+		if err := os.Chtimes(filepath.Join(dir, name), written, written); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := newSampleFreshness()
+	f.recordNodeStats(start, start.Add(40*time.Second))
+	f.record(sample.ResourcesClass, sample.FreshnessInformerCache, start.Add(41*time.Second),
+		start.Add(42*time.Second))
+	f.record(sample.NodeMetadataClass, sample.FreshnessCachedNodeList, start.Add(42*time.Second),
+		start.Add(43*time.Second))
+	// a class recorded without files in the sample, eg: excluded by its destination, is not reported
+	f.record(sample.LogTailClass, sample.FreshnessLiveList, start, start.Add(time.Minute))
+
+	report, err := f.report(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []sample.ClassFreshness{
+		{Class: sample.NodeSourceClass(sample.CadvisorMetricsSource), Source: sample.FreshnessLiveList, Start: start,
+			End: start.Add(40 * time.Second)},
+		{Class: sample.NodeMetadataClass, Source: sample.FreshnessCachedNodeList, Start: start.Add(42 * time.Second),
+			End: start.Add(43 * time.Second)},
+		{Class: sample.NodeSourceClass(sample.SummarySource), Source: sample.FreshnessLiveList, Start: start,
+			End: start.Add(40 * time.Second)},
+		{Class: sample.NodeSourceClass(sample.SummarySource), Baseline: true, Source: sample.FreshnessPreviousSample,
+			Start: start.Add(-60 * time.Second), End: start.Add(-59 * time.Second)},
+		{Class: sample.ResourcesClass, Source: sample.FreshnessInformerCache, Start: start.Add(41 * time.Second),
+			End: start.Add(42 * time.Second)},
+	}
+	if len(report) != len(expected) {
+		t.Fatalf("expected %d classes, got %+v", len(expected), report)
+	}
+	for i := range expected {
+		if report[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], report[i])
+		}
+	}
+
+	// the spread runs from the start of the node stats to the end of the log tail, baselines aside
+	if spread := f.spread(); spread != time.Minute {
+		t.Errorf("expected a spread of %v, got %v", time.Minute, spread)
+	}
+	if spread := newSampleFreshness().spread(); spread != 0 {
+		t.Errorf("expected no spread without data, got %v", spread)
+	}
+}
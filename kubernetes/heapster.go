@@ -117,7 +117,7 @@ func getHeapsterURL(ctx context.Context, clientset kubernetes.Interface, cluster
 
 func validateHeapster(config KubeAgentConfig, client rest.HTTPClient) error {
 	outerTest, body, err := util.TestHTTPConnection(
-		client, config.HeapsterURL, http.MethodGet, config.BearerToken, retryCount, true)
+		client, config.HeapsterURL, http.MethodGet, config.Credentials, retryCount, true)
 	if err != nil {
 		return err
 	}
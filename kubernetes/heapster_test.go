@@ -89,7 +89,6 @@ func TestValidateHeapster(t *testing.T) {
 			Clientset:          cs,
 			HeapsterURL:        ts.URL,
 			Insecure:           true,
-			BearerToken:        "",
 		}
 
 		err := validateHeapster(kac, &kac.HTTPClient)
@@ -0,0 +1,242 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// sources the ready nodes can be served from
+const (
+	// nodeSourceList lists the nodes from the API server each collection
+	nodeSourceList = "list"
+	// nodeSourceInformer serves the nodes from the cache of a node informer
+	nodeSourceInformer = "informer"
+)
+
+// DefaultNodeWatchOutageThreshold is the default time (in seconds) the watch of the node informer may be
+// broken before the nodes are listed from the API server rather than served from its cache
+const DefaultNodeWatchOutageThreshold = 300
+
+// parseNodeSource parses the source the ready nodes are served from, the API server list by default
+func parseNodeSource(source string) (string, error) {
+	switch s := strings.ToLower(strings.TrimSpace(source)); s {
+	case "", nodeSourceList:
+		return nodeSourceList, nil
+	case nodeSourceInformer:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown node source %q, expected %s or %s", source, nodeSourceList,
+		nodeSourceInformer)
+}
+
+// InformerNodeSource implements the NodeSource interface, serving the ready nodes from the cache of a node
+// informer rather than listing them from the API server each collection. The nodes are filtered as by the
+// ClientsetNodeSource it wraps, which lists them from the API server instead while the cache has not synced or
+// the watch of the informer has been broken longer than the max watch outage, so stale nodes are never served
+// silently.
+type InformerNodeSource struct {
+	ClientsetNodeSource
+	informer cache.SharedIndexInformer
+	// synced returns whether the cache has synced and its nodes were delivered to the watch tracking
+	synced         cache.InformerSynced
+	maxWatchOutage time.Duration
+	watch          *nodeWatch
+}
+
+// nodeWatch tracks the outages of the watch of a node informer
+type nodeWatch struct {
+	mu sync.Mutex
+	// brokenSince is when the watch first failed since it last delivered an event, zero while it is healthy
+	brokenSince time.Time
+	lastError   error
+}
+
+// broken records that the watch failed with err at now
+func (w *nodeWatch) broken(err error, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.brokenSince.IsZero() {
+		w.brokenSince = now
+	}
+	w.lastError = err
+}
+
+// delivered records that the watch delivered an event, so it is healthy again
+func (w *nodeWatch) delivered() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.brokenSince, w.lastError = time.Time{}, nil
+}
+
+// outage returns when the watch broke and the last error it failed with, a zero time if it is healthy
+func (w *nodeWatch) outage() (time.Time, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.brokenSince, w.lastError
+}
+
+// NewInformerNodeSource returns an InformerNodeSource filtering the nodes as source does, served from the cache
+// of a node informer started with the resync interval and stopped by stopCh. The informer watches the nodes
+// matching the label selector of source.
+func NewInformerNodeSource(source ClientsetNodeSource, resync, maxWatchOutage time.Duration,
+	stopCh <-chan struct{}) InformerNodeSource {
+	factory := informers.NewSharedInformerFactoryWithOptions(source.clientSet, resync,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = source.labelSelector
+		}))
+	ins := newInformerNodeSource(source, factory.Core().V1().Nodes().Informer(), maxWatchOutage)
+	factory.Start(stopCh)
+	return ins
+}
+
+// newInformerNodeSource returns an InformerNodeSource serving the nodes from the cache of informer, which must
+// not have been started yet
+func newInformerNodeSource(source ClientsetNodeSource, informer cache.SharedIndexInformer,
+	maxWatchOutage time.Duration) InformerNodeSource {
+	watch := &nodeWatch{}
+	if err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		watch.broken(err, time.Now())
+		cache.DefaultWatchErrorHandler(r, err)
+	}); err != nil {
+		log.Warnf("Warning: unable to track the watch of the node informer: %s", err)
+	}
+	// nodes heartbeat at least every few minutes, so a working watch delivers events regularly
+	synced := informer.HasSynced
+	if r, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { watch.delivered() },
+		UpdateFunc: func(old, cur interface{}) {
+			// a resync replays the cache without the watch
+			if o, ok := old.(*v1.Node); !ok || o.ResourceVersion != cur.(*v1.Node).ResourceVersion {
+				watch.delivered()
+			}
+		},
+		DeleteFunc: func(interface{}) { watch.delivered() },
+	}); err != nil {
+		log.Warnf("Warning: unable to track the watch of the node informer: %s", err)
+	} else {
+		synced = r.HasSynced
+	}
+	return InformerNodeSource{
+		ClientsetNodeSource: source,
+		informer:            informer,
+		synced:              synced,
+		maxWatchOutage:      maxWatchOutage,
+		watch:               watch,
+	}
+}
+
+// GetReadyNodes returns the ready nodes of the informer cache, filtered as by ClientsetNodeSource. The nodes
+// are listed from the API server instead while the cache has not synced or its watch has been broken longer
+// than the max watch outage.
+func (ins InformerNodeSource) GetReadyNodes(ctx context.Context) ([]v1.Node, error) {
+	nodes, _, err := ins.GetReadyNodesWithStats(ctx)
+	return nodes, err
+}
+
+// GetReadyNodesWithStats returns the ready nodes as GetReadyNodes does, along with the readiness of the
+// nodes of the cache, or of the nodes listed from the API server instead
+func (ins InformerNodeSource) GetReadyNodesWithStats(ctx context.Context) ([]v1.Node, sample.NodeReadiness,
+	error) {
+	if !ins.synced() {
+		log.Warnf("Warning: the node informer has not synced, nodes are listed from the API server")
+		return ins.ClientsetNodeSource.GetReadyNodesWithStats(ctx)
+	}
+	if since, err := ins.watch.outage(); !since.IsZero() && time.Since(since) > ins.maxWatchOutage {
+		log.Warnf("Warning: the watch of the node informer is broken since %s: %v. Nodes are listed from the "+
+			"API server", since.Format(time.RFC3339), err)
+		return ins.ClientsetNodeSource.GetReadyNodesWithStats(ctx)
+	}
+	return ins.readyNodes(func(visit func(page []v1.Node)) error {
+		visit(cachedNodes(ins.informer))
+		return nil
+	})
+}
+
+// nodeSubscriptionBuffer is the number of node events buffered for a subscriber between collections
+const nodeSubscriptionBuffer = 64
+
+// Subscribe returns a subscription delivering the changes to the nodes watched by the informer, starting
+// with an initial addition of each node of the cache. Resyncs of the cache are not delivered as updates.
+// Events are queued by the informer while the subscriber is busy, eg: collecting, so none is lost.
+func (ins InformerNodeSource) Subscribe() NodeSubscription {
+	events, done := make(chan NodeEvent, nodeSubscriptionBuffer), make(chan struct{})
+	deliver := func(e NodeEvent) {
+		select {
+		case events <- e:
+		case <-done:
+		}
+	}
+	r, err := ins.informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, initial bool) {
+			if n, ok := obj.(*v1.Node); ok {
+				deliver(NodeEvent{Type: NodeAdded, Node: n, Initial: initial})
+			}
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			o, ok := old.(*v1.Node)
+			n, curOK := cur.(*v1.Node)
+			if ok && curOK && o.ResourceVersion != n.ResourceVersion {
+				deliver(NodeEvent{Type: NodeUpdated, Node: n})
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			// a deletion missed while the watch was broken is only seen once the informer lists again
+			if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = d.Obj
+			}
+			if n, ok := obj.(*v1.Node); ok {
+				deliver(NodeEvent{Type: NodeDeleted, Node: n})
+			}
+		},
+	})
+	if err != nil {
+		log.Warnf("Warning: unable to subscribe to the node informer, node changes are seen by collections "+
+			"only: %s", err)
+		return NodeSubscription{}
+	}
+	var once sync.Once
+	return NodeSubscription{Events: events, close: func() {
+		once.Do(func() {
+			close(done)
+			if err := ins.informer.RemoveEventHandler(r); err != nil {
+				log.Warnf("Warning: unable to unsubscribe from the node informer: %s", err)
+			}
+		})
+	}}
+}
+
+// cachedNodes returns the nodes of the informer cache sorted by name, as the API server lists them
+func cachedNodes(informer cache.SharedIndexInformer) []v1.Node {
+	objs := informer.GetStore().List()
+	nodes := make([]v1.Node, 0, len(objs))
+	for _, obj := range objs {
+		if n, ok := obj.(*v1.Node); ok {
+			nodes = append(nodes, *n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
+
+// newNodeSource returns the source of the ready nodes chosen by the config, the informer of an informer node
+// source being stopped by stopCh
+func newNodeSource(config KubeAgentConfig, stopCh <-chan struct{}) NodeSource {
+	source := newConfiguredNodeSource(config)
+	if config.NodeSource != nodeSourceInformer {
+		return source
+	}
+	log.Infof("Ready nodes are served from the cache of a node informer")
+	return NewInformerNodeSource(source, time.Duration(config.InformerResyncInterval)*time.Hour,
+		time.Duration(config.NodeWatchOutageThreshold)*time.Second, stopCh)
+}
@@ -0,0 +1,116 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestParseNodeSource(t *testing.T) {
+	for in, want := range map[string]string{"": nodeSourceList, "list": nodeSourceList,
+		" Informer ": nodeSourceInformer} {
+		if got, err := parseNodeSource(in); err != nil || got != want {
+			t.Errorf("expected %q to parse to %q, got %q %v", in, want, got, err)
+		}
+	}
+	if _, err := parseNodeSource("watch"); err == nil {
+		t.Error("expected an unknown node source to be an error")
+	}
+}
+
+// countNodeLists returns the number of node lists made with the clientset
+func countNodeLists(cs *fake.Clientset) int {
+	lists := 0
+	for _, a := range cs.Actions() {
+		if a.GetVerb() == "list" && a.GetResource().Resource == "nodes" {
+			lists++
+		}
+	}
+	return lists
+}
+
+// readyNodeNames returns the names of the ready nodes of the node source
+func readyNodeNames(t *testing.T, ns NodeSource) string {
+	nodes, err := ns.GetReadyNodes(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestInformerNodeSource(t *testing.T) {
+	node0, node1 := addressedNode("node0", "10.0.0.1"), addressedNode("node1", "10.0.0.2")
+	notReady := notReadyNode("node2", v1.ConditionFalse, time.Now())
+	objects := []runtime.Object{&node1, &node0, &notReady}
+
+	t.Run("Ensure ready nodes are served from the synced cache", func(t *testing.T) {
+		cs := fake.NewSimpleClientset(objects...)
+		stopCh := make(chan struct{})
+		defer close(stopCh)
+		ns := NewInformerNodeSource(NewClientsetNodeSource(cs), 0, time.Minute, stopCh)
+		if !cache.WaitForCacheSync(stopCh, ns.synced) {
+			t.Fatal("expected the node informer to sync")
+		}
+		cs.ClearActions()
+		if names := readyNodeNames(t, ns); names != "node0,node1" {
+			t.Errorf("expected the ready nodes of the cache, got %s", names)
+		}
+		if lists := countNodeLists(cs); lists != 0 {
+			t.Errorf("expected no node list, got %d", lists)
+		}
+	})
+
+	t.Run("Ensure nodes are listed until the cache has synced", func(t *testing.T) {
+		cs := fake.NewSimpleClientset(objects...)
+		informer := informers.NewSharedInformerFactory(cs, 0).Core().V1().Nodes().Informer()
+		ns := newInformerNodeSource(NewClientsetNodeSource(cs), informer, time.Minute)
+		if names := readyNodeNames(t, ns); names != "node0,node1" || countNodeLists(cs) != 1 {
+			t.Errorf("expected the ready nodes to be listed, got %s with %d lists", names, countNodeLists(cs))
+		}
+	})
+
+	t.Run("Ensure nodes are listed while the watch is broken longer than the max outage", func(t *testing.T) {
+		cs := fake.NewSimpleClientset(objects...)
+		stopCh := make(chan struct{})
+		defer close(stopCh)
+		ns := NewInformerNodeSource(NewClientsetNodeSource(cs), 0, time.Minute, stopCh)
+		if !cache.WaitForCacheSync(stopCh, ns.synced) {
+			t.Fatal("expected the node informer to sync")
+		}
+		cs.ClearActions()
+
+		// a short outage is tolerated
+		ns.watch.broken(errors.New("connection reset"), time.Now())
+		_ = readyNodeNames(t, ns)
+		if lists := countNodeLists(cs); lists != 0 {
+			t.Errorf("expected the cache to be served during a short outage, got %d lists", lists)
+		}
+		ns.watch.broken(errors.New("connection reset"), time.Now().Add(-time.Hour))
+		if since, _ := ns.watch.outage(); time.Since(since) > time.Minute {
+			t.Errorf("expected the outage to start when the watch first broke, got %v", since)
+		}
+
+		ns.watch.delivered()
+		ns.watch.broken(errors.New("connection refused"), time.Now().Add(-2*time.Minute))
+		if names := readyNodeNames(t, ns); names != "node0,node1" || countNodeLists(cs) != 1 {
+			t.Errorf("expected the ready nodes to be listed, got %s with %d lists", names, countNodeLists(cs))
+		}
+		ns.watch.delivered()
+		_ = readyNodeNames(t, ns)
+		if lists := countNodeLists(cs); lists != 1 {
+			t.Errorf("expected the cache to be served once the watch delivers again, got %d lists", lists)
+		}
+	})
+}
@@ -0,0 +1,435 @@
+//go:build integration
+
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeKubelet serves the kubelet stats endpoints of a single node, directly and via the fake API server
+type fakeKubelet struct {
+	name   string
+	server *httptest.Server
+	// failing kubelets answer every request after the startup probe with an error
+	failing        atomic.Bool
+	directRequests int32
+	proxyRequests  int32
+	// onRequest is called on every request if set
+	onRequest func()
+}
+
+func (k *fakeKubelet) serve(w http.ResponseWriter, r *http.Request, proxied bool) {
+	if proxied {
+		atomic.AddInt32(&k.proxyRequests, 1)
+	} else {
+		atomic.AddInt32(&k.directRequests, 1)
+	}
+	if k.onRequest != nil {
+		k.onRequest()
+	}
+	if k.failing.Load() {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Path != "/stats/summary" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"node":{"nodeName":%q,"cpu":{"usageNanoCores":1}},"pods":[]}`, k.name)
+}
+
+// fakeCluster is a fake API server, with the node proxy, and a kubelet for each of its nodes
+type fakeCluster struct {
+	apiserver *httptest.Server
+	kubelets  map[string]*fakeKubelet
+	clientset *fake.Clientset
+	root      string
+	exportDir *os.File
+}
+
+// newFakeCluster starts a cluster of n ready nodes, customize modifies each node before it is created
+func newFakeCluster(t *testing.T, n int, customize func(i int, node *v1.Node)) *fakeCluster {
+	t.Helper()
+	c := &fakeCluster{kubelets: make(map[string]*fakeKubelet)}
+
+	c.apiserver = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /api/v1/nodes/<node>/proxy/<kubelet path>
+		rest := strings.TrimPrefix(r.URL.Path, "/api/v1/nodes/")
+		name, kubeletPath, ok := strings.Cut(rest, "/proxy")
+		k, found := c.kubelets[name]
+		if !ok || !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r.URL.Path = kubeletPath
+		k.serve(w, r, true)
+	}))
+	t.Cleanup(c.apiserver.Close)
+
+	var nodes []v1.Node
+	for i := 0; i < n; i++ {
+		k := &fakeKubelet{name: "node" + strconv.Itoa(i)}
+		k.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k.serve(w, r, false)
+		}))
+		t.Cleanup(k.server.Close)
+		c.kubelets[k.name] = k
+
+		host, port, _ := strings.Cut(k.server.Listener.Addr().String(), ":")
+		p, _ := strconv.Atoi(port)
+		node := v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: k.name, Labels: map[string]string{}},
+			Spec:       v1.NodeSpec{ProviderID: "aws:///" + k.name},
+			Status: v1.NodeStatus{
+				Addresses:       []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: host}},
+				Conditions:      []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+				DaemonEndpoints: v1.NodeDaemonEndpoints{KubeletEndpoint: v1.DaemonEndpoint{Port: int32(p)}},
+			},
+		}
+		if customize != nil {
+			customize(i, &node)
+		}
+		nodes = append(nodes, node)
+	}
+	c.clientset = fake.NewSimpleClientset(&v1.NodeList{Items: nodes})
+
+	var err error
+	c.root, err = os.MkdirTemp("", "TestClusterCollection")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(c.root) })
+	export := filepath.Join(c.root, "export")
+	if err := os.MkdirAll(export, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if c.exportDir, err = os.Open(export); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.exportDir.Close() })
+	return c
+}
+
+func (c *fakeCluster) config() KubeAgentConfig {
+	return KubeAgentConfig{
+		Clientset: c.clientset,
+		HTTPClient: http.Client{Transport: &http.Transport{
+			// nolint gosec
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}},
+		ClusterHostURL:    c.apiserver.URL,
+		Insecure:          true,
+		ConcurrentPollers: 2,
+		msExportDirectory: c.exportDir,
+	}
+}
+
+// kubeletRequests returns the number of direct and proxied requests made to every kubelet
+func (c *fakeCluster) kubeletRequests() (direct, proxied int32) {
+	for _, k := range c.kubelets {
+		direct += atomic.LoadInt32(&k.directRequests)
+		proxied += atomic.LoadInt32(&k.proxyRequests)
+	}
+	return direct, proxied
+}
+
+// cycleResult is the outcome of a collection cycle
+type cycleResult struct {
+	nodes    NodeConnection
+	failed   map[string]error
+	files    []string
+	manifest sample.Manifest
+}
+
+// collect establishes the node connection then collects node summaries into a new sample directory, as
+// a collection cycle does
+func (c *fakeCluster) collect(t *testing.T, ctx context.Context, config KubeAgentConfig,
+	beforeCycle func()) cycleResult {
+	t.Helper()
+	nodes, err := ensureNodeSource(ctx, config, nil)
+	if err != nil {
+		t.Fatalf("unexpected error establishing the node connection: %v", err)
+	}
+	if beforeCycle != nil {
+		beforeCycle()
+	}
+
+	msd, metricSampleDir, err := createMSD(config.msExportDirectory.Name(), time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metricSampleDir.Close(ctx)
+
+	failed, late, err := retrieveNodeSummaries(ctx, config, pollCycle{}, nodes, msd, metricSampleDir,
+		NewClientsetNodeSource(config.Clientset), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving node summaries: %v", err)
+	}
+	details := sample.CollectionDetails{LateAddedNodes: late}
+	if err := sample.WriteCollectionManifest(msd, "integration", details); err != nil {
+		t.Fatal(err)
+	}
+
+	result := cycleResult{nodes: nodes, failed: failed}
+	entries, err := os.ReadDir(msd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		result.files = append(result.files, e.Name())
+	}
+	data, err := os.ReadFile(filepath.Join(msd, sample.ManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &result.manifest); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// summaries returns the names of the summary files expected for the nodes
+func summaries(prefix string, nodes ...string) []string {
+	var files []string
+	for _, n := range nodes {
+		files = append(files, sample.NodeSourceName(prefix, sample.SummarySource, n)+".json")
+	}
+	return files
+}
+
+// expectFiles checks the sample holds exactly the expected files, and that the manifest lists them
+func expectFiles(t *testing.T, result cycleResult, expected ...string) {
+	t.Helper()
+	sort.Strings(expected)
+	withManifest := append(append([]string{}, expected...), sample.ManifestFile)
+	sort.Strings(withManifest)
+	if strings.Join(result.files, ",") != strings.Join(withManifest, ",") {
+		t.Errorf("expected sample files %v, got %v", withManifest, result.files)
+	}
+	if strings.Join(result.manifest.Files, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected manifest files %v, got %v", expected, result.manifest.Files)
+	}
+}
+
+// expectFailed checks the failure report holds exactly the expected nodes
+func expectFailed(t *testing.T, result cycleResult, expected ...string) {
+	t.Helper()
+	var failed []string
+	for n := range result.failed {
+		failed = append(failed, n)
+	}
+	sort.Strings(failed)
+	sort.Strings(expected)
+	if strings.Join(failed, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected failed nodes %v, got %v", expected, result.failed)
+	}
+}
+
+func TestClusterCollection(t *testing.T) {
+	t.Run("all healthy", func(t *testing.T) {
+		c := newFakeCluster(t, 3, nil)
+		// the baseline collected in the previous cycle is moved into the sample
+		baseline := summaries(sample.BaselinePrefix, "node0")[0]
+		if err := os.WriteFile(filepath.Join(c.root, baseline), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		result := c.collect(t, context.TODO(), c.config(), nil)
+
+		if !result.nodes.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) ||
+			result.nodes.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
+			t.Errorf("expected direct connections only, got %s",
+				result.nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint))
+		}
+		expectFiles(t, result, append(summaries(sample.StatsPrefix, "node0", "node1", "node2"), baseline)...)
+		expectFailed(t, result)
+		for _, b := range summaries(sample.BaselinePrefix, "node0", "node1", "node2") {
+			if _, err := os.Stat(filepath.Join(c.root, b)); err != nil {
+				t.Errorf("expected baseline %s to be kept for the next cycle: %v", b, err)
+			}
+		}
+		if _, proxied := c.kubeletRequests(); proxied != 0 {
+			t.Errorf("expected no proxied requests, got %d", proxied)
+		}
+	})
+
+	t.Run("partial kubelet failures", func(t *testing.T) {
+		c := newFakeCluster(t, 3, nil)
+		config := c.config()
+
+		result := c.collect(t, context.TODO(), config, func() {
+			c.kubelets["node1"].failing.Store(true)
+		})
+
+		expectFiles(t, result, summaries(sample.StatsPrefix, "node0", "node2")...)
+		expectFailed(t, result, "node1")
+		if err := result.failed["node1"]; !strings.Contains(err.Error(), "node metrics retrieval problem") {
+			t.Errorf("unexpected failure for node1: %v", err)
+		}
+	})
+
+	t.Run("proxy only", func(t *testing.T) {
+		c := newFakeCluster(t, 3, nil)
+		config := c.config()
+		config.ForceKubeProxy = true
+
+		result := c.collect(t, context.TODO(), config, nil)
+
+		if result.nodes.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) ||
+			!result.nodes.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
+			t.Errorf("expected proxy connections only, got %s",
+				result.nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint))
+		}
+		expectFiles(t, result, summaries(sample.StatsPrefix, "node0", "node1", "node2")...)
+		expectFailed(t, result)
+		if direct, _ := c.kubeletRequests(); direct != 0 {
+			t.Errorf("expected no direct requests, got %d", direct)
+		}
+	})
+
+	t.Run("Fargate mixed", func(t *testing.T) {
+		c := newFakeCluster(t, 3, func(i int, node *v1.Node) {
+			if i == 2 {
+				node.Labels["eks.amazonaws.com/compute-type"] = "fargate"
+			}
+		})
+
+		result := c.collect(t, context.TODO(), c.config(), nil)
+
+		if !result.nodes.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) ||
+			!result.nodes.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
+			t.Errorf("expected direct and proxy connections with a Fargate node in the cluster, got %s",
+				result.nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint))
+		}
+		expectFiles(t, result, summaries(sample.StatsPrefix, "node0", "node1", "node2")...)
+		expectFailed(t, result)
+		for name, k := range c.kubelets {
+			direct, proxied := atomic.LoadInt32(&k.directRequests), atomic.LoadInt32(&k.proxyRequests)
+			if name == "node2" && direct != 0 {
+				t.Errorf("expected the Fargate node not to be requested directly, got %d requests", direct)
+			}
+			if name != "node2" && proxied != 0 {
+				t.Errorf("expected %s not to be requested via proxy, got %d requests", name, proxied)
+			}
+		}
+	})
+
+	t.Run("virtual kubelet nodes", func(t *testing.T) {
+		c := newFakeCluster(t, 3, func(i int, node *v1.Node) {
+			if i == 1 {
+				node.Labels["type"] = "virtual-kubelet"
+			}
+			if i == 2 {
+				node.Annotations = map[string]string{"virtual-kubelet.io/provider": "azure"}
+			}
+		})
+		config := c.config()
+		config.VirtualKubeletNodes = VirtualKubeletSkip
+
+		result := c.collect(t, context.TODO(), config, nil)
+
+		expectFiles(t, result, summaries(sample.StatsPrefix, "node0")...)
+		expectFailed(t, result)
+		for _, name := range []string{"node1", "node2"} {
+			k := c.kubelets[name]
+			if requests := atomic.LoadInt32(&k.directRequests) + atomic.LoadInt32(&k.proxyRequests); requests != 0 {
+				t.Errorf("expected skipped node %s not to be requested, got %d requests", name, requests)
+			}
+		}
+	})
+
+	t.Run("opted out nodes", func(t *testing.T) {
+		c := newFakeCluster(t, 3, func(i int, node *v1.Node) {
+			if i == 1 {
+				node.Annotations = map[string]string{NodeCollectAnnotation: "false"}
+			}
+		})
+
+		result := c.collect(t, context.TODO(), c.config(), nil)
+
+		expectFiles(t, result, summaries(sample.StatsPrefix, "node0", "node2")...)
+		expectFailed(t, result)
+		k := c.kubelets["node1"]
+		if requests := atomic.LoadInt32(&k.directRequests) + atomic.LoadInt32(&k.proxyRequests); requests != 0 {
+			t.Errorf("expected the opted out node not to be probed or collected, got %d requests", requests)
+		}
+	})
+
+	t.Run("node added mid-cycle", func(t *testing.T) {
+		c := newFakeCluster(t, 3, nil)
+		// node2 joins the cluster once the collection has started
+		added, err := c.clientset.CoreV1().Nodes().Get(context.TODO(), "node2", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.clientset.CoreV1().Nodes().Delete(context.TODO(), "node2", metav1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		config := c.config()
+		config.PollInterval = 60
+		config.LateNodeBudget = 10
+		config.ScratchDir = c.root
+
+		var once sync.Once
+		result := c.collect(t, context.TODO(), config, func() {
+			c.kubelets["node0"].onRequest = func() {
+				once.Do(func() {
+					_, _ = c.clientset.CoreV1().Nodes().Create(context.TODO(), added, metav1.CreateOptions{})
+				})
+			}
+		})
+
+		expectFiles(t, result, summaries(sample.StatsPrefix, "node0", "node1", "node2")...)
+		expectFailed(t, result)
+		if len(result.manifest.LateAddedNodes) != 1 || result.manifest.LateAddedNodes[0] != "node2" {
+			t.Errorf("expected node2 to be marked late added, got %v", result.manifest.LateAddedNodes)
+		}
+	})
+
+	t.Run("cancellation mid-cycle", func(t *testing.T) {
+		c := newFakeCluster(t, 3, nil)
+		config := c.config()
+		config.ConcurrentPollers = 1
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// the cycle is cancelled while the first node is being collected, abandoning its request as well as
+		// the nodes not started
+		result := c.collect(t, ctx, config, func() {
+			for _, k := range c.kubelets {
+				k.onRequest = cancel
+			}
+		})
+
+		if len(result.failed) != 3 {
+			t.Fatalf("expected every node to fail, got %v", result.failed)
+		}
+		for n, err := range result.failed {
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("expected node %s to fail as cancelled, got %v", n, err)
+			}
+		}
+		expectFiles(t, result)
+	})
+}
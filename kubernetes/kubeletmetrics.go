@@ -0,0 +1,29 @@
+package kubernetes
+
+// kubeletMetricFamilies are the metric families kept from the kubelet /metrics endpoint, those explaining
+// why the kubelet, and so stats collection, is slow. The endpoint serves several thousand series, most of
+// them of no use to diagnosing collection.
+var kubeletMetricFamilies = []string{
+	"kubelet_pleg_relist_duration_seconds",
+	"kubelet_pleg_relist_interval_seconds",
+	"kubelet_pleg_last_seen_seconds",
+	"kubelet_pod_start_duration_seconds",
+	"kubelet_pod_worker_duration_seconds",
+	"kubelet_evictions",
+	"kubelet_running_pods",
+	"kubelet_running_containers",
+	"kubelet_runtime_operations_duration_seconds",
+	"kubelet_runtime_operations_errors_total",
+	"kubelet_http_requests_duration_seconds",
+	"kubelet_http_inflight_requests",
+}
+
+// newMetricFamilyFilter returns a transform keeping only the given metric families of a prometheus text
+// format body
+func newMetricFamilyFilter(families []string) *prometheusFilter {
+	allowed := make(map[string]bool, len(families))
+	for _, f := range families {
+		allowed[f] = true
+	}
+	return &prometheusFilter{families: allowed}
+}
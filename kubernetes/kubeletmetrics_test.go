@@ -0,0 +1,118 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const kubeletMetricsBody = `# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 312
+# HELP kubelet_pleg_relist_duration_seconds [ALPHA] Duration in seconds for relisting pods in PLEG.
+# TYPE kubelet_pleg_relist_duration_seconds histogram
+kubelet_pleg_relist_duration_seconds_bucket{le="0.005"} 10
+kubelet_pleg_relist_duration_seconds_bucket{le="+Inf"} 12
+kubelet_pleg_relist_duration_seconds_sum 0.25
+kubelet_pleg_relist_duration_seconds_count 12
+# HELP kubelet_volume_stats_used_bytes [ALPHA] Number of used bytes in the volume
+# TYPE kubelet_volume_stats_used_bytes gauge
+kubelet_volume_stats_used_bytes{namespace="ns",persistentvolumeclaim="data"} 1024
+# some other comment
+# HELP kubelet_evictions [ALPHA] Cumulative number of pod evictions by eviction signal
+# TYPE kubelet_evictions counter
+kubelet_evictions{eviction_signal="memory.available"} 3
+kubelet_running_pods 42`
+
+const filteredKubeletMetrics = `# HELP kubelet_pleg_relist_duration_seconds [ALPHA] Duration in seconds for relisting pods in PLEG.
+# TYPE kubelet_pleg_relist_duration_seconds histogram
+kubelet_pleg_relist_duration_seconds_bucket{le="0.005"} 10
+kubelet_pleg_relist_duration_seconds_bucket{le="+Inf"} 12
+kubelet_pleg_relist_duration_seconds_sum 0.25
+kubelet_pleg_relist_duration_seconds_count 12
+# HELP kubelet_evictions [ALPHA] Cumulative number of pod evictions by eviction signal
+# TYPE kubelet_evictions counter
+kubelet_evictions{eviction_signal="memory.available"} 3
+kubelet_running_pods 42`
+
+func TestMetricFamilyFilter(t *testing.T) {
+	filter := newMetricFamilyFilter(kubeletMetricFamilies)
+	for _, chunk := range []int{1, 7, len(kubeletMetricsBody)} {
+		var out bytes.Buffer
+		w := filter.Wrap(&out)
+		body := kubeletMetricsBody
+		for len(body) > 0 {
+			n := chunk
+			if n > len(body) {
+				n = len(body)
+			}
+			if _, err := w.Write([]byte(body[:n])); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			body = body[n:]
+		}
+		if err := filter.Finish(nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if out.String() != filteredKubeletMetrics {
+			t.Errorf("expected the allowed families written in %d byte chunks, got:\n%s", chunk, out.String())
+		}
+	}
+}
+
+func TestRetrieveKubeletMetrics(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/proxy/metrics") {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			fmt.Fprint(w, kubeletMetricsBody)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"node":{"nodeName":"node0"}}`)
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestRetrieveKubeletMetrics")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 0, false)
+	nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	nodes.NodeMetrics.SetAvailability(NodeKubeletMetricsEndpoint, Proxy, true)
+	n := addressedNode("node0", "10.0.0.1")
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir}
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, ForceKubeProxy: true, RetrieveKubeletMetrics: true,
+		CollectionProfile: sample.ProfileNamespace}
+
+	if err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, n); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "stats-kubelet_metrics-node0.txt"))
+	if err != nil {
+		t.Fatalf("expected the kubelet metrics to be written with the namespace profile: %v", err)
+	}
+	if string(data) != filteredKubeletMetrics {
+		t.Errorf("expected only the allowed kubelet metric families, got:\n%s", data)
+	}
+}
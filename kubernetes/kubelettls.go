@@ -0,0 +1,232 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// inClusterCAFile is the CA bundle of the cluster mounted into every pod with a service account, used to
+// verify the kubelets unless another bundle is configured
+const inClusterCAFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+// loadKubeletCAs returns the CA bundle direct kubelet connections are verified against
+func loadKubeletCAs(config KubeAgentConfig) (*x509.CertPool, error) {
+	file := config.KubeletCAFile
+	if file == "" {
+		file = inClusterCAFile
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read kubelet CA bundle: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("kubelet CA bundle %s holds no PEM encoded certificates", file)
+	}
+	log.Infof("Direct kubelet connections will be verified against the CA bundle %s", file)
+	return roots, nil
+}
+
+// nodeServerNames maps the kubelet address of each node to its hostname, which its serving certificate is
+// verified for. It is safe for concurrent use.
+type nodeServerNames struct {
+	mu    sync.RWMutex
+	names map[string]string
+}
+
+func newNodeServerNames() *nodeServerNames {
+	return &nodeServerNames{names: map[string]string{}}
+}
+
+// record replaces the hostnames with those of the nodes, nodes without a hostname address are verified
+// for their IP address. Nodes connected to via their hostname address are verified for it.
+func (s *nodeServerNames) record(nodes []v1.Node, ns NodeSource) {
+	if s == nil {
+		return
+	}
+	names := make(map[string]string, len(nodes))
+	for i := range nodes {
+		ip, port, _, err := ns.NodeAddress(&nodes[i])
+		if err != nil {
+			continue
+		}
+		for _, addr := range nodes[i].Status.Addresses {
+			if addr.Type == v1.NodeHostName && addr.Address != "" {
+				names[net.JoinHostPort(ip, strconv.Itoa(int(port)))] = addr.Address
+				break
+			}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.names = names
+}
+
+// lookup returns the hostname of the node at the address, empty if it has none
+func (s *nodeServerNames) lookup(addr string) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.names[addr]
+}
+
+// verifyKubeletTLS makes the transport verify kubelet serving certificates against roots, for the hostname
+// of the node being connected to where it has one. It is applied once any client certificate has been set
+// on the transport's TLS config.
+func verifyKubeletTLS(transport *http.Transport, roots *x509.CertPool, names *nodeServerNames) {
+	base := transport.TLSClientConfig.Clone()
+	base.InsecureSkipVerify = false
+	base.RootCAs = roots
+	transport.TLSClientConfig = base
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// the clone shares the session cache of the base config
+		config := base.Clone()
+		config.ServerName = names.lookup(addr)
+		d := tls.Dialer{Config: config}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// isCertificateError returns true if the error is caused by a kubelet serving certificate that could not
+// be verified
+func isCertificateError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &verificationErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+// fallBackToProxy moves the endpoints of a node available directly to its proxy connection, used once its
+// kubelet serving certificate could not be verified
+func fallBackToProxy(mask *EndpointMask) {
+	for _, e := range mask.Endpoints() {
+		if mask.DirectAllowed(e) {
+			mask.SetAvailability(e, Direct, false)
+			mask.SetAvailability(e, Proxy, true)
+		}
+	}
+}
+
+// nodeTLSOptions are the TLS settings of direct kubelet connections for kubelets the default settings can not
+// connect to, eg: legacy appliances demanding renegotiation or TLS 1.3-only kubelets with restricted curves
+type nodeTLSOptions struct {
+	renegotiation tls.RenegotiationSupport
+	// maxVersion is the highest TLS version offered, 0 for the default
+	maxVersion uint16
+	// curves are the curves offered in order, the default curves if empty
+	curves []tls.CurveID
+}
+
+// kubeletTLSRenegotiation maps the accepted renegotiation policies to their support
+var kubeletTLSRenegotiation = map[string]tls.RenegotiationSupport{
+	"never":  tls.RenegotiateNever,
+	"once":   tls.RenegotiateOnceAsClient,
+	"freely": tls.RenegotiateFreelyAsClient,
+}
+
+// kubeletTLSVersions maps the accepted maximum TLS versions to their version
+var kubeletTLSVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// kubeletTLSCurves maps the accepted curve names to their curve
+var kubeletTLSCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// parseNodeTLSOptions returns the TLS settings of direct kubelet connections from the renegotiation policy,
+// maximum TLS version and comma separated curves, the defaults for each that is empty
+func parseNodeTLSOptions(renegotiation, maxVersion, curves string) (nodeTLSOptions, error) {
+	var o nodeTLSOptions
+	if renegotiation != "" {
+		support, ok := kubeletTLSRenegotiation[strings.ToLower(renegotiation)]
+		if !ok {
+			return o, fmt.Errorf("unknown TLS renegotiation policy %q, expected never, once or freely",
+				renegotiation)
+		}
+		o.renegotiation = support
+	}
+	if maxVersion != "" {
+		version, ok := kubeletTLSVersions[maxVersion]
+		if !ok {
+			return o, fmt.Errorf("unsupported maximum TLS version %q, expected 1.2 or 1.3", maxVersion)
+		}
+		o.maxVersion = version
+	}
+	for _, c := range strings.Split(curves, ",") {
+		name := strings.TrimSpace(c)
+		if name == "" {
+			continue
+		}
+		curve, ok := kubeletTLSCurves[strings.ToUpper(name)]
+		if !ok {
+			return o, fmt.Errorf("unknown TLS curve %q, expected X25519, P256, P384 or P521", name)
+		}
+		o.curves = append(o.curves, curve)
+	}
+	return o, nil
+}
+
+// apply sets the TLS settings on the TLS config of direct kubelet connections
+func (o nodeTLSOptions) apply(c *tls.Config) {
+	c.Renegotiation = o.renegotiation
+	if o.maxVersion != 0 {
+		c.MaxVersion = o.maxVersion
+	}
+	if len(o.curves) > 0 {
+		c.CurvePreferences = o.curves
+	}
+}
+
+// tlsFailureDetail describes a failed TLS connection to a kubelet from its handshake or alert, with the
+// setting that may resolve it, so it can be identified from the failure report alone. Empty if the error is
+// not a TLS failure.
+func tlsFailureDetail(err error) string {
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) || (err != nil && strings.Contains(err.Error(), "HTTP response to HTTPS client")) {
+		return "TLS handshake failed: the kubelet did not answer with TLS"
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return ""
+	}
+	var detail string
+	switch opErr.Op {
+	case "remote error":
+		detail = fmt.Sprintf("TLS alert from the kubelet: %v", opErr.Err)
+	case "local error":
+		detail = fmt.Sprintf("TLS connection aborted by the agent: %v", opErr.Err)
+	default:
+		return ""
+	}
+	msg := opErr.Err.Error()
+	switch {
+	case strings.Contains(msg, "no renegotiation"):
+		detail += ", the kubelet requested renegotiation (see CLOUDABILITY_KUBELET_TLS_RENEGOTIATION)"
+	case strings.Contains(msg, "protocol version"):
+		detail += ", no TLS version in common (see CLOUDABILITY_KUBELET_TLS_MAX_VERSION)"
+	case strings.Contains(msg, "handshake failure"), strings.Contains(msg, "insufficient security"):
+		detail += ", no cipher suite or curve in common (see CLOUDABILITY_KUBELET_TLS_CURVES)"
+	}
+	return detail
+}
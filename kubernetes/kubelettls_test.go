@@ -0,0 +1,244 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// kubeletNode returns a node whose kubelet is the test server, with the hostname address if not empty
+func kubeletNode(ts *httptest.Server, name, hostname string) v1.Node {
+	host, port, _ := strings.Cut(ts.Listener.Addr().String(), ":")
+	n := addressedNode(name, host)
+	p, _ := strconv.Atoi(port)
+	n.Status.DaemonEndpoints.KubeletEndpoint.Port = int32(p)
+	if hostname != "" {
+		n.Status.Addresses = append(n.Status.Addresses, v1.NodeAddress{Type: v1.NodeHostName, Address: hostname})
+	}
+	return n
+}
+
+func TestLoadKubeletCAs(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.crt")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(bundle, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.crt")
+	if err := os.WriteFile(invalid, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadKubeletCAs(KubeAgentConfig{KubeletCAFile: bundle}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, file := range []string{invalid, filepath.Join(dir, "missing.crt")} {
+		if _, err := loadKubeletCAs(KubeAgentConfig{KubeletCAFile: file}); err == nil {
+			t.Errorf("expected an error loading %s", file)
+		}
+	}
+}
+
+func TestVerifyKubeletTLS(t *testing.T) {
+	// the test server certificate is valid for 127.0.0.1 and example.com
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	trusted := x509.NewCertPool()
+	trusted.AddCert(ts.Certificate())
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+
+	tests := []struct {
+		name      string
+		roots     *x509.CertPool
+		hostname  string
+		expectErr bool
+	}{
+		{name: "ip address", roots: trusted},
+		{name: "hostname", roots: trusted, hostname: "example.com"},
+		{name: "mismatched hostname", roots: trusted, hostname: "node0.internal", expectErr: true},
+		{name: "untrusted", roots: x509.NewCertPool(), expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handshakes := &tlsHandshakeCounter{}
+			transport := newNodeTransport(KubeAgentConfig{ConcurrentPollers: 1}, handshakes)
+			names := newNodeServerNames()
+			names.record([]v1.Node{kubeletNode(ts, "node0", tt.hostname)}, ns)
+			verifyKubeletTLS(transport, tt.roots, names)
+
+			resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tt.expectErr {
+				if !isCertificateError(err) {
+					t.Errorf("expected a certificate error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if full, _ := handshakes.take(); full != 1 {
+				t.Errorf("expected the handshake to be counted, got %d", full)
+			}
+		})
+	}
+}
+
+func TestKubeletCertificateFallback(t *testing.T) {
+	var proxied int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/v1/nodes/") {
+			proxied++
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"node":{"nodeName":"node0"}}`)
+	}))
+	defer ts.Close()
+
+	// the kubelet certificate is not signed by the configured CA bundle
+	nodeTransport := newNodeTransport(KubeAgentConfig{ConcurrentPollers: 1}, &tlsHandshakeCounter{})
+	verifyKubeletTLS(nodeTransport, x509.NewCertPool(), newNodeServerNames())
+	proxyClient := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	nodes := NodeConnection{
+		NodeClient:      raw.NewClient(http.Client{Transport: nodeTransport}, true, nil, 0, false),
+		InClusterClient: raw.NewClient(proxyClient, true, nil, 0, false),
+		NodeMetrics:     NewEndpointMask(),
+	}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, KubeletTLSVerify: true}
+
+	dir := t.TempDir()
+	workDir := util.NewWorkDir(dir)
+	nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir}
+	err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, kubeletNode(ts, "node0", ""))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proxied != 1 {
+		t.Errorf("expected the summary to be collected via proxy, got %d proxied requests", proxied)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stats-summary-node0.json")); err != nil {
+		t.Errorf("expected the summary to be written: %v", err)
+	}
+	if !nodes.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
+		t.Error("expected the fallback to be limited to the node")
+	}
+}
+
+func TestKubeletTLSOptions(t *testing.T) {
+	if _, err := parseNodeTLSOptions("sometimes", "", ""); err == nil {
+		t.Error("expected an unknown renegotiation policy to be rejected")
+	}
+	if _, err := parseNodeTLSOptions("", "1.1", ""); err == nil {
+		t.Error("expected an unsupported TLS version to be rejected")
+	}
+	if _, err := parseNodeTLSOptions("", "", "P256,brainpool"); err == nil {
+		t.Error("expected an unknown curve to be rejected")
+	}
+	o, err := parseNodeTLSOptions("Once", "1.2", "p384, X25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := newNodeTransport(KubeAgentConfig{ConcurrentPollers: 1, nodeTLS: o}, &tlsHandshakeCounter{})
+	c := transport.TLSClientConfig
+	if c.Renegotiation != tls.RenegotiateOnceAsClient || c.MaxVersion != tls.VersionTLS12 ||
+		len(c.CurvePreferences) != 2 || c.CurvePreferences[0] != tls.CurveP384 {
+		t.Errorf("expected the TLS options on the node transport, got %v %d %v", c.Renegotiation, c.MaxVersion,
+			c.CurvePreferences)
+	}
+
+	// a TLS 1.3-only kubelet with a restricted curve set
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{}`)
+	}))
+	ts.TLS = &tls.Config{MinVersion: tls.VersionTLS13, CurvePreferences: []tls.CurveID{tls.CurveP384}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		maxVersion string
+		curves     string
+		detail     string
+	}{
+		{name: "default settings connect"},
+		{name: "matching curve connects", maxVersion: "1.3", curves: "P384"},
+		{name: "TLS 1.2 is refused", maxVersion: "1.2", detail: "CLOUDABILITY_KUBELET_TLS_MAX_VERSION"},
+		{name: "no curve in common is refused", curves: "P256", detail: "CLOUDABILITY_KUBELET_TLS_CURVES"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseNodeTLSOptions("", tt.maxVersion, tt.curves)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := raw.NewClient(http.Client{Transport: newNodeTransport(
+				KubeAgentConfig{ConcurrentPollers: 1, nodeTLS: o}, &tlsHandshakeCounter{})}, true, nil, 0, false)
+			success, err := checkEndpointConnections(client, Direct, http.MethodGet, ts.URL+"/stats/summary")
+			if tt.detail == "" {
+				if !success || err != nil {
+					t.Errorf("expected to connect, got %v", err)
+				}
+				return
+			}
+			if success {
+				t.Fatal("expected the connection to be refused")
+			}
+			detail := tlsFailureDetail(err)
+			if !strings.Contains(detail, "TLS alert from the kubelet") || !strings.Contains(detail, tt.detail) {
+				t.Errorf("expected the TLS alert and %s in the failure detail, got %q from %v", tt.detail, detail,
+					err)
+			}
+			if a := connectionAttempt(Direct, err); !strings.Contains(a, detail) {
+				t.Errorf("expected the failure detail in the connection attempt, got %q", a)
+			}
+		})
+	}
+
+	t.Run("a plain HTTP kubelet is described", func(t *testing.T) {
+		plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer plain.Close()
+		client := raw.NewClient(http.Client{Transport: newNodeTransport(KubeAgentConfig{ConcurrentPollers: 1},
+			&tlsHandshakeCounter{})}, true, nil, 0, false)
+		_, err := checkEndpointConnections(client, Direct, http.MethodGet,
+			strings.Replace(plain.URL, "http://", "https://", 1))
+		if detail := tlsFailureDetail(err); !strings.Contains(detail, "did not answer with TLS") {
+			t.Errorf("expected a plain HTTP kubelet to be described, got %q from %v", detail, err)
+		}
+	})
+
+	t.Run("a renegotiation request is described", func(t *testing.T) {
+		// the agent aborts a renegotiation request with a local alert, Go TLS servers can not request one
+		err := fmt.Errorf("Get \"https://10.0.0.1:10250/stats/summary\": %w",
+			&net.OpError{Op: "local error", Err: errors.New("tls: no renegotiation")})
+		if detail := tlsFailureDetail(err); !strings.Contains(detail, "CLOUDABILITY_KUBELET_TLS_RENEGOTIATION") {
+			t.Errorf("expected the renegotiation setting in the failure detail, got %q", detail)
+		}
+	})
+}
@@ -14,11 +14,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -26,19 +28,22 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/cloudability/metrics-agent/client"
+	"github.com/cloudability/metrics-agent/credentials"
 	"github.com/cloudability/metrics-agent/measurement"
 	k8s_stats "github.com/cloudability/metrics-agent/retrieval/k8s"
-	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
 	"github.com/cloudability/metrics-agent/util"
 	cldyVersion "github.com/cloudability/metrics-agent/version"
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/version"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/flowcontrol"
 )
 
 // ClusterVersion contains a concatenated version number as well as the k8s version discovery info
@@ -47,58 +52,317 @@ type ClusterVersion struct {
 	versionInfo *version.Info
 }
 
-// KubeAgentConfig K8s agent configuration
+// KubeAgentConfig K8s agent configuration. It is not modified once the agent is initialized, state that
+// changes while the agent runs is held in AgentState.
 type KubeAgentConfig struct {
-	APIKey                 string
-	BearerToken            string
-	BearerTokenPath        string
-	Cert                   string
-	ClusterName            string
-	ClusterHostURL         string
-	clusterUID             string
-	HeapsterURL            string
-	Key                    string
-	OutboundProxyAuth      string
-	OutboundProxy          string
-	provisioningID         string
-	ForceKubeProxy         bool
-	Insecure               bool
-	OutboundProxyInsecure  bool
-	UseInClusterConfig     bool
-	PollInterval           int
-	ConcurrentPollers      int
-	CollectionRetryLimit   uint
-	failedNodeList         map[string]error
-	AgentStartTime         time.Time
-	Clientset              kubernetes.Interface
-	ClusterVersion         ClusterVersion
-	HeapsterProxyURL       url.URL
-	OutboundProxyURL       url.URL
-	HTTPClient             http.Client
-	NodeClient             raw.Client
-	InClusterClient        raw.Client
-	msExportDirectory      *os.File
-	TLSClientConfig        rest.TLSClientConfig
-	Namespace              string
-	ScratchDir             string
-	NodeMetrics            EndpointMask
-	Informers              map[string]*cache.SharedIndexInformer
+	// APIKey is the Cloudability API key metric samples are uploaded with
+	APIKey string
+	// Credentials provides the bearer token of the cluster config, refreshed before each collection
+	Credentials credentials.Provider
+	// Cert and Key are the client certificate and key files of the cluster config, empty if it has none
+	Cert string
+	Key  string
+	// ClusterName is the name the cluster is reported under
+	ClusterName string
+	// ClusterHostURL is the URL of the API server
+	ClusterHostURL string
+	// clusterUID identifies the cluster in the sample and working directory names, found at startup
+	clusterUID string
+	// HeapsterURL is the URL of the heapster service of clusters still running heapster
+	HeapsterURL string
+	// OutboundProxyAuth and OutboundProxy are the basic authentication credentials and URL of the proxy
+	// metric samples are uploaded through, empty if there is none
+	OutboundProxyAuth string
+	OutboundProxy     string
+	// provisioningID identifies the agent to the upload endpoint, derived from the APIKey at startup
+	provisioningID string
+	// ForceKubeProxy connects to every kubelet via the API server proxy, never directly
+	ForceKubeProxy bool
+	// ForceDirect connects to every kubelet directly, never via the API server proxy
+	ForceDirect bool
+	// Insecure does not verify the certificate of the API server
+	Insecure bool
+	// OutboundProxyInsecure does not verify the certificate of the outbound proxy
+	OutboundProxyInsecure bool
+	// UseInClusterConfig is true if the cluster config is the in-cluster config of the agent pod
+	UseInClusterConfig bool
+	// PollInterval is the time (in seconds) between polls
+	PollInterval int
+	// ConcurrentPollers is the number of nodes collected concurrently
+	ConcurrentPollers int
+	// CollectionRetryLimit is the number of times a failed request to a node is retried
+	CollectionRetryLimit uint
+	// AgentStartTime is when the agent started, for the uptime reported in the agent status
+	AgentStartTime time.Time
+	// Clientset is the client of the API server, limited by the API server rate limit if one is set
+	Clientset kubernetes.Interface
+	// ClusterVersion is the Kubernetes version of the cluster, found at startup
+	ClusterVersion ClusterVersion
+	// HeapsterProxyURL is no longer used by the agent
+	HeapsterProxyURL url.URL
+	// OutboundProxyURL is the parsed OutboundProxy, empty if there is none
+	OutboundProxyURL url.URL
+	// HTTPClient is the TLS client of the cluster config, with its client certificate and CA, unless Insecure
+	HTTPClient http.Client
+	// msExportDirectory is the working directory the metric samples are written to and exported from
+	msExportDirectory *os.File
+	// TLSClientConfig is the TLS configuration of the cluster config
+	TLSClientConfig rest.TLSClientConfig
+	// Namespace is the namespace the agent runs in
+	Namespace string
+	// ScratchDir is the directory the working directory of the metric samples is created in
+	ScratchDir string
+	// Informers are the informers of the exported Kubernetes resources, by resource name
+	Informers map[string]*cache.SharedIndexInformer
+	// InformerResyncInterval is the time (in hours) between full resyncs of the informers, 0 never resyncs them
 	InformerResyncInterval int
-	ParseMetricData        bool
-	HTTPSTimeout           int
-	UploadRegion           string
-	CustomS3UploadBucket   string
-	CustomS3Region         string
+	// ParseMetricData removes the data not used downstream from the node data before it is uploaded
+	ParseMetricData bool
+	// HTTPSTimeout is the time (in seconds) a request to a kubelet or the API server may take
+	HTTPSTimeout int
+	// UploadRegion is the region of the upload endpoint metric samples are uploaded to
+	UploadRegion string
+	// CustomS3UploadBucket and CustomS3Region are the S3 bucket, and its region, metric samples are uploaded
+	// to in place of the upload endpoint, empty uploads to the upload endpoint
+	CustomS3UploadBucket string
+	CustomS3Region       string
+	// DiagnosticLogLines is the number of the most recent log records written to each sample, 0 writes none
+	DiagnosticLogLines int
+	// ExtraKubeletEndpoints is the JSON list of extra kubelet endpoints collected from every node
+	ExtraKubeletEndpoints string
+	// ExtraEndpointMaxBytes caps the combined size of the extra endpoint responses of a node each poll
+	ExtraEndpointMaxBytes int64
+	// extraEndpoints is the parsed ExtraKubeletEndpoints
+	extraEndpoints []ExtraEndpoint
+	// ProbeNodeMinAge is the age (in seconds) a node must reach before it is preferred for startup endpoint probes
+	ProbeNodeMinAge int
+	// PollOverrunThreshold is the number of consecutive overrunning polls after which collection is degraded
+	// one level, 0 never degrades it
+	PollOverrunThreshold int
+	// PollRecoveryThreshold is the number of consecutive polls within the interval after which one level of
+	// degradation is reversed
+	PollRecoveryThreshold int
+	// FailedNodeLogLimit and FailedNodeReportLimit are the number of failed nodes logged, and reported in each
+	// sample, with their full error, the others are counted per error
+	FailedNodeLogLimit    int
+	FailedNodeReportLimit int
+	// MaxOpenFiles caps the number of node metric files open at once
+	MaxOpenFiles int
+	// BackfillMaxIntervals is the number of missed polls reconstructed from the kubelet stats history, 0
+	// disables backfill
+	BackfillMaxIntervals int
+	// NodeSizeSpikeFactor is the factor by which node data must exceed its trailing average to be a size spike
+	NodeSizeSpikeFactor float64
+	// LateNodeBudget is the time (in seconds) each poll may spend collecting the nodes that joined during it
+	LateNodeBudget int
+	// UploadContentEncoding is the content encoding metric samples are uploaded with, auto negotiates one
+	UploadContentEncoding string
+	// StrictPermissions fails the agent at startup if it is not permitted to collect every resource
+	StrictPermissions bool
+	// StatsRelaySelector, StatsRelayNamespace and StatsRelayPort select the stats relay pods nodes are
+	// collected from when they can not be reached otherwise, empty StatsRelaySelector uses no relay
+	StatsRelaySelector  string
+	StatsRelayNamespace string
+	StatsRelayPort      int
+	// MaxSampleBytes caps the total size of each sample, data is shed as the sample approaches it. 0 does not
+	// cap it.
+	MaxSampleBytes int64
+	// NodeFetchPacing is the fraction of the poll interval node fetches are spread across, 0 starts them at
+	// once
+	NodeFetchPacing float64
+	// ResponseStallTimeout is the time (in seconds) a kubelet response may receive no bytes before it is
+	// abandoned, 0 disables stall detection
+	ResponseStallTimeout int
+	// NodeFetchTimeout is the time (in seconds) allowed to fetch every endpoint of a node, 0 does not limit it
+	NodeFetchTimeout int
+	// LoadEstimateChangePercent is the change in the number of nodes after which the load of a poll is
+	// estimated again, 0 only estimates it at startup
+	LoadEstimateChangePercent int
+	// CollectionProfile is the granularity of the node data collected, the namespace profile omits pod and
+	// container level detail
+	CollectionProfile string
+	// SmallCluster bounds every request to the API server with conservative defaults for single node
+	// control planes, APIServerQPS and APIServerBurst replace them when set
+	SmallCluster   bool
+	APIServerQPS   float64
+	APIServerBurst int
+	// APIServerJSON requests JSON rather than protobuf from the API server, for clusters and proxies that
+	// mishandle protobuf
+	APIServerJSON bool
+	// RetrieveProbeMetrics collects the liveness and readiness probe metrics of each kubelet with each sample
+	RetrieveProbeMetrics bool
+	// RetrieveKubeletPods collects the pods bound to each node as seen by its kubelet with each sample, each
+	// response limited to KubeletPodsMaxBytes
+	RetrieveKubeletPods bool
+	KubeletPodsMaxBytes int64
+	// RetrieveNodeSpec collects the machine spec of each kubelet on the first collection after startup and
+	// every NodeSpecInterval collections after
+	RetrieveNodeSpec bool
+	NodeSpecInterval int
+	// RetrieveKubeletConfigz collects the running configuration of each kubelet with each sample
+	RetrieveKubeletConfigz bool
+	// RetrieveKubeletMetrics collects a small set of the runtime metrics of each kubelet with each sample
+	RetrieveKubeletMetrics bool
+	// CadvisorLabelAllowlist and CadvisorLabelDenylist are comma separated labels kept on, and dropped from,
+	// the cadvisor metrics collected by extra kubelet endpoints
+	CadvisorLabelAllowlist string
+	CadvisorLabelDenylist  string
+	// CadvisorMaxSeriesPerFamily truncates each cadvisor metric family of a node to the number of series
+	CadvisorMaxSeriesPerFamily int
+	// DisableEndpointsAnnotation is the node annotation listing the endpoints not collected from the node, by
+	// node source or extra endpoint name, eg: "cadvisor,container". Empty ignores the annotation.
+	DisableEndpointsAnnotation string
+	// NodeIdleConnTimeout is how long idle direct kubelet connections are kept open in seconds, 0 keeps them
+	// until shortly after the next poll
+	NodeIdleConnTimeout int
+	// ReprobeInterval is the interval in minutes between probes of the kubelet endpoints, 0 only probes them
+	// at startup
+	ReprobeInterval int
+	// EndpointConfigFile is a YAML file of per endpoint collection settings, see endpointConfigSchema
+	EndpointConfigFile string
+	// SettingOverridden returns true if the setting with the given flag name was set by its flag or env var,
+	// which then takes precedence over the endpoint config file. Nil if no setting is overridden.
+	SettingOverridden func(key string) bool
+	// WarmUp discards the sample of the first collection, which establishes the node baselines, see
+	// collectWarmUp
+	WarmUp bool
+	// SampleIntervalLock ensures only one agent instance samples each upload interval, see sampleLock
+	SampleIntervalLock bool
+	// KubeletTLSVerify verifies the serving certificates of direct kubelet connections, nodes failing
+	// verification are collected via proxy
+	KubeletTLSVerify bool
+	// KubeletCAFile is the CA bundle kubelet serving certificates are verified against, the in-cluster CA
+	// bundle if empty
+	KubeletCAFile string
+	// KubeletTLSRenegotiation, KubeletTLSMaxVersion and KubeletTLSCurves are the renegotiation policy,
+	// highest TLS version and comma separated curves of direct kubelet connections, the defaults if empty
+	KubeletTLSRenegotiation string
+	KubeletTLSMaxVersion    string
+	KubeletTLSCurves        string
+	// nodeTLS are the parsed TLS settings of direct kubelet connections
+	nodeTLS nodeTLSOptions
+	// ImageRewrite is how image references of collected resources are rewritten, one of
+	// k8s_stats.ImageRewriteModes, empty to keep them as they are
+	ImageRewrite string
+	// ImageKeepDigests keeps the digests of rewritten image references
+	ImageKeepDigests bool
+	// imageRewriter rewrites the image references as set by ImageRewrite, nil if they are kept
+	imageRewriter *k8s_stats.ImageRewriter
+	// TagSelf annotates the agent's own pod and namespace in exported resources, identified by PodName and
+	// PodNamespace, so downstream can exclude their usage
+	TagSelf      bool
+	PodName      string
+	PodNamespace string
+	// selfTagger annotates the resources of the agent, nil unless TagSelf
+	selfTagger *k8s_stats.SelfTagger
+	// PostCollectionHook is a command run on each sample directory before it is archived, eg: for extra
+	// redaction. It must exit 0 within PostCollectionHookTimeout seconds and the poll interval.
+	PostCollectionHook        string
+	PostCollectionHookTimeout int
+	// PostCollectionHookFatal discards the sample when the hook fails rather than keeping it
+	PostCollectionHookFatal bool
+	// MissedIntervalThreshold is the number of consecutive poll intervals without a sample after which the
+	// agent reports itself not ready, 0 never does
+	MissedIntervalThreshold int
+	// Dev runs the agent for development against a local cluster, eg: kind, see applyDevMode
+	Dev bool
+	// NodeNameAllowlist restricts collection to the nodes matching its comma separated names or glob
+	// patterns, samples are then marked partial. Empty collects every node.
+	NodeNameAllowlist string
+	// NodeLabelSelector restricts collection to the nodes matching the label selector, in the standard
+	// Kubernetes syntax, eg: team=payments. Empty collects every node.
+	NodeLabelSelector string
+	// nodeLabels is the parsed NodeLabelSelector
+	nodeLabels labels.Selector
+	// IncludeNotReadyGracePeriod is the time (in seconds) nodes are still collected after becoming NotReady,
+	// 0 only collects ready nodes
+	IncludeNotReadyGracePeriod int
+	// MaxHeartbeatAge is the time (in seconds) after which a ready node whose NodeReady condition was not
+	// heartbeated is not collected, 0 collects ready nodes regardless of their heartbeat
+	MaxHeartbeatAge int
+	// NodeSource is the source the ready nodes are served from each collection, a list from the API server
+	// (list) or the cache of a node informer (informer)
+	NodeSource string
+	// NodeWatchOutageThreshold is the time (in seconds) the watch of the node informer may be broken before
+	// the nodes are listed from the API server rather than served from its cache
+	NodeWatchOutageThreshold int
+	// NodeListPageSize is the number of nodes listed by each request to the API server, 0 lists every node
+	// with a single request
+	NodeListPageSize int
+	// MaxNodesPerCycle caps the number of nodes collected each collection, the other nodes are deferred to
+	// later collections so every node is collected in turn. 0 collects every node.
+	MaxNodesPerCycle int
+	// SkipUnschedulableNodes leaves the nodes that are cordoned (unschedulable) out of collection, as they
+	// are often being drained
+	SkipUnschedulableNodes bool
+	// NodeAddressTypes is the comma separated order the address types of a node are tried in to connect to
+	// its kubelet directly, eg: "ExternalIP,InternalIP,Hostname". Empty uses InternalIP, Hostname, ExternalIP.
+	NodeAddressTypes string
+	// nodeAddressTypes is the parsed NodeAddressTypes
+	nodeAddressTypes []v1.NodeAddressType
+	// VirtualKubeletNodes is how nodes registered by a virtual kubelet are collected, one of
+	// VirtualKubeletSkip, VirtualKubeletProxy or VirtualKubeletCollect
+	VirtualKubeletNodes string
+	// KubeletPortOverride replaces the kubelet port reported by every node for direct connections, 0 uses the
+	// reported port
+	KubeletPortOverride int
+	// AcceptedFileClasses replaces the sample file classes the upload endpoint advertises it accepts beyond
+	// the core classes with its comma separated classes, "*" accepts every class. Empty uses those advertised.
+	AcceptedFileClasses string
+	// MigrationUploadURL is the upload endpoint metric samples are also sent to during a backend migration,
+	// with MigrationAPIKey, until MigrationEndDate. MigrationAuthoritative is the destination whose upload
+	// failures fail the agent, primary or secondary. Empty uploads only to the upload region.
+	MigrationUploadURL     string
+	MigrationAPIKey        string
+	MigrationEndDate       string
+	MigrationAuthoritative string
+	// uploadMigration is the parsed migration settings, nil unless MigrationUploadURL is set
+	uploadMigration *uploadMigration
+	// DebugCaptureFile lists the nodes, separated by commas or newlines, whose raw and collected data is
+	// retained by the next collection for a support escalation. It is read again before each collection.
+	// Empty captures no nodes.
+	DebugCaptureFile string
+	// DebugCaptureMaxBytes caps the size of the data retained by debug captures
+	DebugCaptureMaxBytes int64
+	// DebugCaptureRetention is the time (in seconds) the data of a debug capture is retained
+	DebugCaptureRetention int
+	// BearerToken and BearerTokenFile replace the token of the cluster config when set. The file is re-read
+	// when it is rotated and takes precedence over the token.
+	BearerToken     string
+	BearerTokenFile string
+	// TokenFileTTL is the time (in seconds) a token read from a file is used before the file is read again,
+	// 0 reads it again only when it is modified or the token is rejected
+	TokenFileTTL int
+	// ProxyCredentials and DirectCredentials replace the cluster credentials on the API server proxy and
+	// direct kubelet connection paths when set
+	ProxyCredentials  PathCredentials
+	DirectCredentials PathCredentials
+	// MinKubernetesVersion is the recommended minimum Kubernetes version, older clusters down to
+	// lowestKubernetesVersion are collected with a warning and without the features they do not support
+	MinKubernetesVersion string
+	// minKubeVersion is the parsed MinKubernetesVersion
+	minKubeVersion kubeVersion
+	// versionGated are the features disabled as the cluster version does not support them, see versionGates
+	versionGated []string
+	// nodeNames matches the node names of the NodeNameAllowlist
+	nodeNames nodeNameFilter
+	// fileClasses are the file classes accepted by the destination of the samples, found at startup
+	fileClasses fileClassFilter
 }
 
 const uploadInterval time.Duration = 10
 const retryCount uint = 10
 const DefaultCollectionRetry = 1
+
+// DefaultTokenFileTTL is the default time (in seconds) a token read from a file is used before the file is
+// read again, projected service account tokens may be rotated well before they expire
+const DefaultTokenFileTTL = 60
 const DefaultInformerResync = 24
 
 // node connection methods
 const proxy = "proxy"
 const direct = "direct"
+const podProxy = "pod_proxy"
 const unreachable = "unreachable"
 
 const kbTroubleShootingURL string = "https://help.apptio.com/en-us/cloudability/product/k8s-metrics-agent.htm"
@@ -124,24 +388,32 @@ const rbacError string = `RBAC role in the Cloudability namespace may need to be
 // nolint: gocyclo
 func CollectKubeMetrics(config KubeAgentConfig) {
 
+	installCycleLogHook()
 	log.Infof("Starting Cloudability Kubernetes Metric Agent version: %v", cldyVersion.VERSION)
+	if config.Dev {
+		var err error
+		if config, err = applyDevMode(config); err != nil {
+			log.Fatalf("Invalid agent configuration: %v", err)
+		}
+	}
 	log.Infof("Metric collection retry limit set to %d (default is %d)",
 		config.CollectionRetryLimit, DefaultCollectionRetry)
 	log.Debugf("Informer resync interval is set to %d (default is %d)",
 		config.InformerResyncInterval, DefaultInformerResync)
 
-	ctx := context.Background()
+	// a collection in progress is abandoned when the agent is asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
 	// Create k8s agent
-	kubeAgent := newKubeAgent(ctx, config)
+	kubeAgent, state := newKubeAgent(ctx, config)
 
-	customS3Mode := isCustomS3UploadEnvsSet(&kubeAgent)
+	// samples are never uploaded in development mode, so no upload destination is required
+	customS3Mode := !kubeAgent.Dev && isCustomS3UploadEnvsSet(&kubeAgent)
 
 	// Log start time
 	kubeAgent.AgentStartTime = time.Now()
 
-	clientSetNodeSource := NewClientsetNodeSource(kubeAgent.Clientset)
-
 	// run , sleep etc..
 	doneChan := make(chan bool)
 
@@ -157,40 +429,97 @@ func CollectKubeMetrics(config KubeAgentConfig) {
 		log.Warnf("For more information see: %v", kbTroubleShootingURL)
 	}
 
+	notPermitted, err := ensurePermissions(ctx, kubeAgent)
+	if err != nil {
+		log.Fatalf("Agent permissions check failed: %s. %s", err, rbacError)
+	}
+	state.recordNotPermitted(notPermitted)
+
 	// informer channel, closes only if metrics-agent stops executing
 	// closing this will kill all informers
 	informerStopCh := make(chan struct{})
 	// start up informers for each of the k8s resources that metrics are being collected on
+	skippedInformers := append(kubeAgent.gatedInformers(), notPermitted...)
 	kubeAgent.Informers, err = k8s_stats.StartUpInformers(kubeAgent.Clientset, kubeAgent.ClusterVersion.version,
-		config.InformerResyncInterval, informerStopCh)
+		config.InformerResyncInterval, skippedInformers, informerStopCh)
 	if err != nil {
 		log.Warnf("Warning: Informers failed to start up: %s", err)
 	}
 	defer close(informerStopCh)
+	nodeSource := newNodeSource(kubeAgent, informerStopCh)
+	// nodes deleted between polls have their baselines and endpoint mask removed before the next poll
+	nodeEvents := subscribeNodes(nodeSource)
+	defer nodeEvents.Close()
+
+	// intervals missed while the agent was stopped are counted by the first poll
+	restoreSampleRate(kubeAgent, state)
+
+	if kubeAgent.BackfillMaxIntervals > 0 {
+		// a gap spanning a restart is detected from the last collection recorded before it
+		if last, err := readLastCollection(kubeAgent.ScratchDir); err == nil {
+			state.recordCollection(last)
+		} else if !os.IsNotExist(err) {
+			log.Warnf("Warning: unable to read last collection, missed polls will not be backfilled: %s", err)
+		}
+	}
+
+	// baselines collected with a different scope are reset before the baselines of this run are downloaded
+	state.recordScopeChange(checkBaselineScope(kubeAgent, path.Dir(kubeAgent.msExportDirectory.Name()),
+		informerNodes(kubeAgent.Informers)))
 
-	err = downloadBaselineMetricExport(ctx, kubeAgent, clientSetNodeSource)
+	err = downloadBaselineMetricExport(ctx, kubeAgent, state, nodeSource)
 
 	if err != nil {
 		log.Warnf("Warning: Non-fatal error occurred retrieving baseline metrics: %s", err)
 	}
+	logStartupLoadEstimate(kubeAgent, state)
 
-	if !customS3Mode {
-		err = performConnectionChecks(&kubeAgent)
+	if !customS3Mode && !kubeAgent.Dev {
+		err = performConnectionChecks(kubeAgent, state)
+		if errors.Is(err, client.ErrUnauthorized) {
+			log.Fatalf("%v: %s", err, fmt.Sprintf(apiKeyError, kbProvisionURL))
+		}
 		if err != nil {
 			log.Warnf("WARNING: failed to retrieve S3 URL in connectivity test, agent will fail to "+
 				"upload metrics to Cloudability with error: %v", err)
 		}
+		encoding, reason := client.NegotiateContentEncoding(kubeAgent.UploadContentEncoding, state.UploadLimits())
+		log.Infof("Metric samples will be uploaded with content encoding %q: %s", encoding, reason)
+		kubeAgent.fileClasses = acceptedFileClasses(kubeAgent.AcceptedFileClasses, state.UploadLimits())
+		if len(kubeAgent.fileClasses) > 0 {
+			log.Infof("Metric samples will only include the file classes %v", kubeAgent.fileClasses)
+		}
 	}
 
+	if kubeAgent.ReprobeInterval > 0 {
+		go reprobeEndpointsPeriodically(ctx, kubeAgent, state)
+	}
+
+	var lock *sampleLock
+	if kubeAgent.SampleIntervalLock {
+		lock = newSampleLock(kubeAgent, path.Dir(kubeAgent.msExportDirectory.Name()), time.Now())
+	}
+
+	// samples collected before a restart are uploaded rather than collected again
+	for _, metricSample := range recoverInterruptedSamples(kubeAgent, time.Now()) {
+		kubeAgent.sendMetricsBasedOnUploadMode(customS3Mode, metricSample, state)
+	}
+
+	updateReadiness(kubeAgent.ScratchDir, state.status().sampleRate, kubeAgent.MissedIntervalThreshold)
 	log.Info("Cloudability Metrics Agent successfully started.")
 
 	for {
 		select {
 
 		case <-sendChan.C:
+			warnUnsupportedVersion(kubeAgent)
+			if state.status().exportVolume.condition != "" {
+				// the sample can not be bundled onto the volume, the pending data is sent once it recovers
+				continue
+			}
 			// Bundle raw metrics
-			metricSample, err := util.CreateMetricSample(
-				*kubeAgent.msExportDirectory, kubeAgent.clusterUID, true, kubeAgent.ScratchDir)
+			metricSample, err := util.CreateMetricSample(*kubeAgent.msExportDirectory, kubeAgent.clusterUID, true,
+				kubeAgent.ScratchDir, state.LastSampleCycleID())
 			if err != nil {
 				switch err {
 				case util.ErrEmptyDataDir:
@@ -200,17 +529,66 @@ func CollectKubeMetrics(config KubeAgentConfig) {
 					log.Fatalf("Error creating metric sample: %s", err)
 				}
 			}
+			if fi, err := metricSample.Stat(); err == nil && !state.UploadLimits().Allows(fi.Size()) {
+				log.Warnf("Metric sample is %d bytes which exceeds the %d byte limit advertised by the upload "+
+					"endpoint, upload may be rejected", fi.Size(), state.UploadLimits().MaxPayloadBytes)
+			}
 			// Send metric sample
-			kubeAgent.sendMetricsBasedOnUploadMode(customS3Mode, metricSample)
+			kubeAgent.sendMetricsBasedOnUploadMode(customS3Mode, metricSample, state)
 
 		case <-pollChan.C:
-			err := kubeAgent.collectMetrics(ctx, kubeAgent, kubeAgent.Clientset, clientSetNodeSource)
-			if err != nil {
+			pollStart := time.Now()
+			if ok, lost := lock.claim(pollStart); !ok {
+				// the instance holding the lock produces the samples meanwhile
+				state.pauseInterval(pollStart)
+				if lost {
+					log.Warn("Another agent took over the sample lock, samples not yet uploaded are discarded")
+					if err := discardPendingSamples(kubeAgent.msExportDirectory.Name()); err != nil {
+						log.Warnf("Warning: unable to discard samples: %s", err)
+					}
+				}
+				continue
+			}
+			var err error
+			level := state.DegradationLevel()
+			cycleConfig, cycle := level.apply(kubeAgent)
+			cycle.id = newCycleID(pollStart)
+			cycleLog.begin(cycle.id)
+			if state.startWarmUp() {
+				kubeAgent.collectWarmUp(ctx, cycleConfig, cycle, state, kubeAgent.Clientset, nodeSource)
+				state.pauseInterval(pollStart)
+			} else {
+				err = kubeAgent.collectMetrics(ctx, cycleConfig, cycle, state, kubeAgent.Clientset, nodeSource)
+				recordPollInterval(kubeAgent, state, pollStart, err, level)
+			}
+			if errors.Is(err, errSampleTooLarge) || errors.Is(err, errPostCollectionHook) {
+				// the sample could never be delivered, so only this poll fails
+				log.Errorf("Error retrieving metrics, the sample was discarded: %v", err)
+			} else if err != nil && !errors.Is(err, errExportVolumeUnwritable) {
 				log.Fatalf("Error retrieving metrics %v", err)
 			}
+			// polls only probe the export volume until it is writable again
+			if !errors.Is(err, errExportVolumeUnwritable) {
+				kubeAgent.backfillMissedPolls(ctx, state, nodeSource, pollStart)
+			}
+			if state.recordPoll(time.Since(pollStart), time.Duration(config.PollInterval)*time.Second) {
+				// never queue a poll behind one that overran, drop any tick that fired meanwhile
+				select {
+				case <-pollChan.C:
+				default:
+				}
+			}
+			cycleLog.end()
+
+		case e := <-nodeEvents.Events:
+			// handled between polls, so baselines are never removed while a poll moves them
+			handleNodeEvent(state, path.Dir(kubeAgent.msExportDirectory.Name()), e)
+
+		case <-ctx.Done():
+			log.Info("Cloudability Metrics Agent stopping.")
+			return
 
 		case <-doneChan:
-			ctx.Done()
 			return
 		}
 	}
@@ -237,7 +615,10 @@ func isCustomS3UploadEnvsSet(ka *KubeAgentConfig) bool {
 	return true
 }
 
-func performConnectionChecks(ka *KubeAgentConfig) error {
+// connectivityCheckFile prefixes the file uploaded by the connectivity check
+const connectivityCheckFile = "connectivity-check-"
+
+func performConnectionChecks(ka KubeAgentConfig, state *AgentState) error {
 
 	log.Info("Performing connectivity checks. Checking that the agent can retrieve S3 URL")
 
@@ -254,29 +635,41 @@ func performConnectionChecks(ka *KubeAgentConfig) error {
 		return err
 	}
 
-	metricSampleURL := client.GetUploadURLByRegion(ka.UploadRegion)
-
-	file, err := os.Create("/tmp/temp.txt")
+	// written to the scratch directory, as the root filesystem may be read-only
+	file, err := os.CreateTemp(ka.ScratchDir, connectivityCheckFile)
 	if err != nil {
-		return errors.New("failed to create temp.txt file in connectivity test")
+		return fmt.Errorf("failed to create %s file in connectivity test: %v", connectivityCheckFile, err)
 	}
 	defer os.Remove(file.Name())
+	defer file.Close()
 
 	_, err = file.WriteString("Health Check")
 	if err != nil {
-		return errors.New("failed to write in file temp.txt in connectivity test")
+		return fmt.Errorf("failed to write in file %s in connectivity test: %v", file.Name(), err)
 	}
 
-	_, _, err = cldyMetricClient.GetUploadURL(file, metricSampleURL, cldyVersion.VERSION, ka.clusterUID, 0)
+	// the secondary destination of a migration is checked even if the primary is unreachable
+	secondaryErr := handshakeSecondary(ka, state, file)
+	limits, err := cldyMetricClient.Handshake(file, cldyVersion.VERSION, ka.clusterUID)
 	if err != nil {
 		return err
 	}
-	log.Info("Connectivity check succeeded")
-	return nil
+	state.setUploadLimits(limits)
+	log.Infof("Connectivity check succeeded, upload endpoint limits: protocol version %q, max payload bytes %d, "+
+		"supported encodings %v, capabilities %v", limits.ProtocolVersion, limits.MaxPayloadBytes,
+		limits.SupportedEncodings, limits.Capabilities)
+	return secondaryErr
 }
 
-func newKubeAgent(ctx context.Context, config KubeAgentConfig) KubeAgentConfig {
-	config, err := createClusterConfig(config)
+func newKubeAgent(ctx context.Context, config KubeAgentConfig) (KubeAgentConfig, *AgentState) {
+	// the limiter is shared by every request to the API server, including those of later endpoint probes
+	apiLimiter := newAPIServerLimiter(config)
+	if apiLimiter != nil {
+		qps, burst := apiServerRateLimit(config)
+		log.Infof("Requests to the API server are limited to %v per second with a burst of %d", qps, burst)
+	}
+
+	config, err := createClusterConfig(config, apiLimiter)
 	if err != nil {
 		log.Fatalf("cloudability metric agent is unable to initialize cluster configuration: %v", err)
 	}
@@ -287,7 +680,7 @@ func newKubeAgent(ctx context.Context, config KubeAgentConfig) KubeAgentConfig {
 	}
 
 	// launch local services if we can't connect to them
-	config, err = ensureMetricServicesAvailable(ctx, config)
+	nodes, err := ensureMetricServicesAvailable(ctx, config, apiLimiter)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -303,66 +696,253 @@ func newKubeAgent(ctx context.Context, config KubeAgentConfig) KubeAgentConfig {
 	if err != nil {
 		log.Fatalf("cloudability metric agent is unable to create a temporary working directory: %v", err)
 	}
+	// nothing is written outside of the scratch directory, so a read-only root filesystem only fails here
+	if err = checkWritableDirs(config); err != nil {
+		log.Fatalf("cloudability metric agent is unable to write its files: %v", err)
+	}
 
-	return config
+	state := newAgentState(config, nodes)
+	state.apiLimiter = apiLimiter
+	return config, state
 }
 
-func (ka KubeAgentConfig) collectMetrics(ctx context.Context, config KubeAgentConfig,
-	clientset kubernetes.Interface, nodeSource NodeSource) (rerr error) {
+func (ka KubeAgentConfig) collectMetrics(ctx context.Context, config KubeAgentConfig, cycle pollCycle,
+	state *AgentState, clientset kubernetes.Interface, nodeSource NodeSource) (rerr error) {
 
 	sampleStartTime := time.Now().UTC()
+	if cycle.id == "" {
+		cycle.id = newCycleID(sampleStartTime)
+	}
 
-	// refresh client token before each collection
-	token, err := getBearerToken(config.BearerTokenPath)
-	if err != nil {
-		log.Warnf("Warning: Unable to update service account token for cloudability-metrics-agent. If this"+
-			" token is not refreshed in clusters >=1.21, the metrics-agent won't be able to collect data once"+
-			" token is expired. %s", err)
+	// refresh client credentials before each collection, the clients share the provider so pick up the
+	// refreshed token
+	if config.Credentials != nil {
+		if _, err := config.Credentials.Token(); err != nil {
+			log.Warnf("Warning: Unable to refresh credentials for cloudability-metrics-agent. If the"+
+				" token is not refreshed in clusters >=1.21, the metrics-agent won't be able to collect data once"+
+				" token is expired. %s", err)
+		}
 	}
 
-	config.BearerToken = token
-	config.InClusterClient.BearerToken = token
-	config.NodeClient.BearerToken = token
+	// nothing is collected while the export volume can not be written to
+	if err := checkExportVolume(config, state, sampleStartTime); err != nil {
+		return err
+	}
 
 	// create metric sample directory
 	msd, metricSampleDir, err := createMSD(config.msExportDirectory.Name(), sampleStartTime)
+	if exportVolumeCondition(err) != "" {
+		return exportVolumeUnwritable(config, state, err, time.Now())
+	}
 	if err != nil {
 		return err
 	}
-
-	err = retrieveNodeSummaries(ctx, config, msd, metricSampleDir, nodeSource)
+	// the sample is not closed while node data is still being written to it, unless the collection is cancelled
+	defer util.SafeClose(func() error { return metricSampleDir.Close(ctx) }, &rerr)
+
+	// the node connection and the results of this collection are reported together, even if the state is
+	// updated by another collection meanwhile
+	status := state.status()
+	status.cycleID = cycle.id
+
+	// the size of the sample is tracked as it is written, so data is shed before it is fetched once the
+	// sample approaches its size cap
+	sizeLimit := newSampleSizeLimit(config)
+	metricSampleDir.SetWriteLimit(sizeLimit)
+
+	// node data is hashed as it is written, for the manifest and to find data unchanged from its baseline
+	hashes := newNodeDataHashes()
+	// the warm-up sample is discarded, so the node specs are left to the first uploaded sample
+	if !cycle.warmUp {
+		cycle.collection = state.startCollection()
+		cycle.nodeSpecDue = nodeSpecDue(config, cycle.collection)
+	}
+	cycle.seriesTruncations = newSeriesTruncationLog()
+	cycle.disabledEndpoints = newDisabledEndpointLog()
+	cycle.debugCaptures = newDebugCaptures(config, state, sampleStartTime)
+	state.publishCycleStart(cycle, sampleStartTime)
+	pacer := newNodePacer(config)
+	health := newNodeHealthSnapshot()
+	freshness := newSampleFreshness()
+	// handshakes since the last collection, eg: by the baseline, are not counted against this one
+	status.nodes.handshakes.take()
+	statsStart := time.Now()
+	status.failedNodeList, status.lateAddedNodes, err = retrieveNodeSummaries(ctx, config, cycle, status.nodes,
+		msd, metricSampleDir, nodeSource, hashes, pacer, health)
+	freshness.recordNodeStats(statsStart, time.Now())
+	if nodeErr := unwritableNodeError(status.failedNodeList); nodeErr != nil {
+		// the volume became unwritable during the collection, so the rest of it could not be stored either
+		return discardSample(msd, exportVolumeUnwritable(config, state, nodeErr, time.Now()))
+	}
+	status.deferredNodes = countDeferredNodes(health.skippedNodes())
+	state.publishNodesCollected(health, status.failedNodeList)
+	status.seriesTruncations = cycle.seriesTruncations.report()
+	status.disabledEndpoints = cycle.disabledEndpoints.report()
+	status.debugCaptures = cycle.debugCaptures.finish(state)
+	status.tlsHandshakes, status.tlsResumedHandshakes = status.nodes.handshakes.take()
+	log.Debugf("Kubelet TLS handshakes: %d full, %d resumed", status.tlsHandshakes, status.tlsResumedHandshakes)
 	if err != nil {
 		log.Warnf("Warning: %s", err)
 	}
+	status.nodeFetchPace = pacer.effectivePace()
+	// sizes are checked before unchanged node data is replaced by a marker
+	status.nodeSizes = checkNodeDataSizes(msd, config, state)
+	status.loadEstimate = reestimatePollLoad(config, state, status.nodeSizes)
+	// node data unchanged from its baseline is only replaced by a marker if the upload endpoint accepts it
+	if status.uploadLimits.SupportsCapability(client.CapabilityUnchangedNodeData) {
+		status.unchangedNodeFiles = replaceUnchangedNodeData(msd, state, hashes, err == nil)
+	}
+	state.recordFailedNodes(status.failedNodeList)
+
+	// node data is checked before resources are exported so a runaway sample fails early
+	if err = sizeLimit.enforce(msd); err != nil {
+		return discardSample(msd, err)
+	}
 
 	// export k8s resource metrics (ex: pods.jsonl) using informers to the metric sample directory
-	err = k8s_stats.GetK8sMetricsFromInformer(config.Informers, metricSampleDir, config.ParseMetricData)
+	resourcesStart := time.Now()
+	redactions := k8s_stats.NewRedactions()
+	err = k8s_stats.GetK8sMetricsFromInformer(config.Informers, metricSampleDir, config.ParseMetricData,
+		config.imageRewriter, config.selfTagger, redactions)
 	if err != nil {
 		return fmt.Errorf("unable to export k8s metrics: %s", err)
 	}
+	freshness.record(sample.ResourcesClass, sample.FreshnessInformerCache, resourcesStart, time.Now())
+
+	// export normalized node metadata, such as whether each node is spot capacity
+	metadataStart := time.Now()
+	status.nodeCapacityTypes, err = writeNodeMetadata(metricSampleDir, informerNodes(config.Informers))
+	if err != nil {
+		log.Warnf("Warning: unable to export node metadata: %s", err)
+	}
+	freshness.record(sample.NodeMetadataClass, sample.FreshnessCachedNodeList, metadataStart, time.Now())
+	state.recordNodeCapacityTypes(status.nodeCapacityTypes)
+	status.freshnessSpread = freshness.spread()
+	log.Infof("Sample data freshness spread: %v", status.freshnessSpread)
+
+	if err = sizeLimit.enforce(msd); err != nil {
+		return discardSample(msd, err)
+	}
+	status.sampleShedBytes = sizeLimit.shedBytes()
+
+	// the cluster summary is computed from the sample after shedding so it can not disagree with it
+	status.clusterSummary, err = summarizeCluster(msd)
+	if err == nil {
+		err = writeClusterSummary(metricSampleDir, status.clusterSummary)
+	}
+	if err != nil {
+		log.Warnf("Warning: unable to write cluster summary: %s", err)
+	}
+
+	// pod level resources are only counted for the cluster summary with the namespace profile
+	if config.namespaceRollup() {
+		if err = removePodDetail(msd, redactions); err != nil {
+			return fmt.Errorf("unable to remove pod detail from sample: %s", err)
+		}
+	}
+
+	if cycle.warmUp {
+		log.Debugf("Discarding warm-up sample %s", msd)
+		return discardSample(msd, nil)
+	}
 
 	// create agent measurement and add it to measurements
-	err = createAgentStatusMetric(metricSampleDir, config, sampleStartTime)
+	err = createAgentStatusMetric(metricSampleDir, config, status, sampleStartTime)
 	if err != nil {
 		return fmt.Errorf("unable to create cldy measurement: %s", err)
 	}
 
+	// the report is written with every sample, even if nothing was redacted, so the rules in effect are known
+	report, err := newRedactionReport(config, redactions)
+	if err == nil {
+		err = writeRedactionReport(metricSampleDir, config.ScratchDir, report, sampleStartTime)
+	}
+	if err != nil {
+		log.Warnf("Warning: unable to write redaction report: %s", err)
+	}
+
+	if config.DiagnosticLogLines > 0 {
+		err = writeLogTail(metricSampleDir, util.RecentLogs(), config.DiagnosticLogLines)
+		if err != nil {
+			log.Warnf("Warning: unable to write agent log tail: %s", err)
+		}
+		err = writeNodeSizeHistory(metricSampleDir, status.nodeSizes)
+		if err != nil {
+			log.Warnf("Warning: unable to write node size history: %s", err)
+		}
+	}
+
+	// the hook runs before files are excluded and the manifest is written, so both reflect its changes. The
+	// hook may rewrite node data, so it is hashed again for the manifest.
+	fileHashes := hashes.allWritten()
+	if config.PostCollectionHook != "" {
+		fileHashes = nil
+	}
+	if err = runPostCollectionHook(ctx, config, msd, sampleStartTime); err != nil {
+		return discardSample(msd, err)
+	}
+
+	// files the destination does not accept are left out, older destinations may reject unknown files
+	excludedClasses, err := config.fileClasses.exclude(msd)
+	if err != nil {
+		return fmt.Errorf("unable to exclude file classes from sample: %s", err)
+	}
+	if len(excludedClasses) > 0 {
+		log.Debugf("Excluded file classes %v not accepted by the upload endpoint from sample", excludedClasses)
+	}
+
+	classFreshness, err := freshness.report(msd)
+	if err != nil {
+		log.Warnf("Warning: unable to report sample data freshness: %s", err)
+	}
+
+	// the manifest lists the sample contents so must be written last
+	err = sample.WriteCollectionManifest(msd, cldyVersion.VERSION, sample.CollectionDetails{
+		LateAddedNodes:      status.lateAddedNodes,
+		NotPermitted:        status.notPermitted,
+		NodeCapacityTypes:   manifestCapacityTypes(status.nodeCapacityTypes),
+		MaxSampleBytes:      config.MaxSampleBytes,
+		Shed:                sizeLimit.shed,
+		NodeNames:           config.nodeNames,
+		NodeLabelSelector:   config.nodeLabelSelector(),
+		ExcludedFileClasses: excludedClasses,
+		Profile:             config.CollectionProfile,
+		NodeHealth:          health.report(status.failedNodeList),
+		NodeReadiness:       health.readiness(),
+		Freshness:           classFreshness,
+		FreshnessSpread:     status.freshnessSpread,
+		SeriesTruncations:   status.seriesTruncations,
+		DisabledEndpoints:   status.disabledEndpoints,
+		FileHashes:          fileHashes,
+		NodeRejoins:         status.nodes.machines.take(),
+		VersionGated:        config.versionGated,
+		ScopeChanged:        state.takeScopeChange(),
+		DebugCaptures:       status.debugCaptures,
+		CycleID:             cycle.id,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write sample manifest: %s", err)
+	}
+	state.recordSampleCycleID(cycle.id)
+
+	return nil
+}
+
+// discardSample removes a sample that can not be completed, returning the error that caused it
+func discardSample(msd string, err error) error {
+	if rmErr := os.RemoveAll(msd); rmErr != nil {
+		log.Warnf("Warning: unable to remove discarded sample %s: %v", msd, rmErr)
+	}
 	return err
 }
 
-func createMSD(exportDir string, sampleStartTime time.Time) (string, *os.File, error) {
-	msd := exportDir + "/" + sampleStartTime.Format(
-		"20060102150405") + "/" + strconv.FormatInt(sampleStartTime.Unix(), 10)
+func createMSD(exportDir string, sampleStartTime time.Time) (string, *util.WorkDir, error) {
+	msd := sample.Dir(exportDir, sampleStartTime)
 	err := os.MkdirAll(msd, os.ModePerm)
 	if err != nil {
-		return msd, nil, fmt.Errorf("error creating metric sample directory : %v", err)
+		return msd, nil, fmt.Errorf("error creating metric sample directory : %w", err)
 	}
-	//nolint gosec
-	metricSampleDir, err := os.Open(msd)
-	if err != nil {
-		return msd, metricSampleDir, fmt.Errorf("unable to open metric sample export directory")
-	}
-	return msd, metricSampleDir, nil
+	return msd, util.NewWorkDir(msd), nil
 }
 
 func fetchNodeBaselines(msd, exportDirectory string) error {
@@ -380,9 +960,7 @@ func fetchNodeBaselines(msd, exportDirectory string) error {
 		if info.IsDir() && filePath != path.Dir(exportDirectory) {
 			return filepath.SkipDir
 		}
-		if strings.HasPrefix(info.Name(), "baseline-summary") ||
-			strings.HasPrefix(info.Name(), "baseline-container") ||
-			strings.HasPrefix(info.Name(), "baseline-cadvisor") {
+		if isBaselineSource(sample.BaselinePrefix, info.Name()) {
 			err = os.Rename(filePath, filepath.Join(msd, info.Name()))
 			if err != nil {
 				return err
@@ -401,9 +979,9 @@ func updateNodeBaselines(msd, exportDirectory string) error {
 		if err != nil {
 			return err
 		}
-		if strings.HasPrefix(info.Name(), "stats-") {
-			nodeName, extension := extractNodeNameAndExtension("stats", info.Name())
-			baselineNodeMetric := path.Dir(exportDirectory) + fmt.Sprintf("/baseline%s%s", nodeName, extension)
+		if isBaselineSource(sample.StatsPrefix, info.Name()) {
+			nodeName, extension := extractNodeNameAndExtension(sample.StatsPrefix, info.Name())
+			baselineNodeMetric := path.Dir(exportDirectory) + "/" + sample.BaselinePrefix + nodeName + extension
 
 			// update baseline metric for this node with most recent sample from this collection
 			err = util.CopyFileContents(baselineNodeMetric, filePath)
@@ -419,41 +997,58 @@ func updateNodeBaselines(msd, exportDirectory string) error {
 	return nil
 }
 
-func (ka KubeAgentConfig) sendMetrics(metricSample *os.File) {
-	cldyMetricClient, err := client.NewHTTPMetricClient(client.Configuration{
-		Token:         ka.APIKey,
-		Verbose:       false,
-		ProxyURL:      ka.OutboundProxyURL,
-		ProxyAuth:     ka.OutboundProxyAuth,
-		ProxyInsecure: ka.OutboundProxyInsecure,
-		Timeout:       time.Duration(ka.HTTPSTimeout) * time.Second,
-		Region:        ka.UploadRegion,
-	})
-
-	if err != nil {
-		log.Fatalf("error creating Cloudability Metric client: %v ", err)
+// isBaselineSource reports whether a node source file is one that has a baseline maintained between samples
+func isBaselineSource(prefix, fileName string) bool {
+	for _, source := range reservedSourceNames {
+		if strings.HasPrefix(fileName, prefix+"-"+source) {
+			return true
+		}
 	}
+	return false
+}
 
-	err = SendData(metricSample, ka.clusterUID, cldyMetricClient)
+// sendMetrics uploads the metric sample to each upload destination, identical archives to each during a
+// migration. A failed upload to the authoritative destination fails the agent, the sample is removed once
+// uploaded to it.
+func (ka KubeAgentConfig) sendMetrics(metricSample *os.File, state *AgentState) {
+	defer metricSample.Close()
+
+	err := ka.uploadToDestinations(metricSample, ka.uploadDestinations(state, time.Now()), state,
+		func(d uploadDestination, encoding string) client.MetricClient {
+			cldyMetricClient, err := ka.newDestinationClient(d, encoding)
+			if err != nil {
+				log.Fatalf("error creating Cloudability Metric client: %v ", err)
+			}
+			return cldyMetricClient
+		})
+	state.publishUploaded()
 	if err != nil {
-		if warnErr := handleError(err, ka.UploadRegion); warnErr != "" {
-			log.Warnf(warnErr)
-		}
 		log.Fatalf("error sending metrics: %v", err)
 	}
+	if err := os.Remove(metricSample.Name()); err != nil {
+		log.Warnf("Warning: Unable to cleanup after metric sample upload: %v", err)
+	}
 }
 
-func (ka KubeAgentConfig) sendMetricsBasedOnUploadMode(customS3Mode bool, metricSample *os.File) {
+func (ka KubeAgentConfig) sendMetricsBasedOnUploadMode(customS3Mode bool, metricSample *os.File,
+	state *AgentState) {
+	if ka.Dev {
+		log.Infof("Development mode, metric sample kept at %s", metricSample.Name())
+		_ = metricSample.Close()
+		return
+	}
 	if customS3Mode {
 		log.Infof("Uploading Metrics to Custom S3 Bucket %s", ka.CustomS3UploadBucket)
 		go ka.sendMetricsToCustomS3(metricSample)
 	} else {
 		log.Info("Uploading Metrics")
-		go ka.sendMetrics(metricSample)
+		go ka.sendMetrics(metricSample, state)
 	}
 }
 
 func (ka KubeAgentConfig) sendMetricsToCustomS3(metricSample *os.File) {
+	defer metricSample.Close()
+
 	sess, err := session.NewSession(&aws.Config{
 		Region:     aws.String(ka.CustomS3Region),
 		MaxRetries: aws.Int(3)},
@@ -512,7 +1107,8 @@ func handleError(err error, region string) string {
 	return ""
 }
 
-// SendData takes Cloudability metric sample and sends data to Cloudability via go client
+// SendData takes Cloudability metric sample and sends data to Cloudability via go client. The sample is kept,
+// as it may be sent to more than one destination.
 func SendData(ms *os.File, uid string, mc client.MetricClient) (err error) {
 	err = mc.SendMetricSample(ms, cldyVersion.VERSION, uid)
 	if err != nil {
@@ -520,16 +1116,12 @@ func SendData(ms *os.File, uid string, mc client.MetricClient) (err error) {
 	} else {
 		sn := strings.Split(ms.Name(), "/")
 		log.Infof("Exported metric sample %s to cloudability", strings.TrimSuffix(sn[len(sn)-1], ".tgz"))
-		err = os.Remove(ms.Name())
-		if err != nil {
-			log.Warnf("Warning: Unable to cleanup after metric sample upload: %v", err)
-		}
-
 	}
 	return err
 }
 
-func createClusterConfig(config KubeAgentConfig) (KubeAgentConfig, error) {
+// createClusterConfig connects the config to the cluster, the clientset limited by apiLimiter if it is not nil
+func createClusterConfig(config KubeAgentConfig, apiLimiter flowcontrol.RateLimiter) (KubeAgentConfig, error) {
 	// try and connect to the cluster using in-cluster-config
 	thisConfig, err := rest.InClusterConfig()
 
@@ -550,9 +1142,11 @@ func createClusterConfig(config KubeAgentConfig) (KubeAgentConfig, error) {
 			config.Cert = thisConfig.CertFile
 			config.Key = thisConfig.KeyFile
 			config.TLSClientConfig = thisConfig.TLSClientConfig
-			config.Clientset, err = kubernetes.NewForConfig(thisConfig)
-			config.BearerToken = thisConfig.BearerToken
-			config.BearerTokenPath = thisConfig.BearerTokenFile
+			applyBearerToken(config, thisConfig)
+			applyContentType(config, thisConfig)
+			config.Clientset, err = newLimitedClientset(thisConfig, apiLimiter)
+			config.Credentials = credentials.FromConfig(thisConfig.BearerToken, thisConfig.BearerTokenFile,
+				config.tokenFileTTL(), thisConfig.ExecProvider)
 			return config, err
 		}
 		log.Warn(
@@ -568,8 +1162,11 @@ func createClusterConfig(config KubeAgentConfig) (KubeAgentConfig, error) {
 		config.Cert = thisConfig.CertFile
 		config.Key = thisConfig.KeyFile
 		config.TLSClientConfig = thisConfig.TLSClientConfig
-		config.Clientset, err = kubernetes.NewForConfig(thisConfig)
-		config.BearerTokenPath = thisConfig.BearerTokenFile
+		applyBearerToken(config, thisConfig)
+		applyContentType(config, thisConfig)
+		config.Clientset, err = newLimitedClientset(thisConfig, apiLimiter)
+		config.Credentials = credentials.FromConfig(config.BearerToken, thisConfig.BearerTokenFile,
+			config.tokenFileTTL(), nil)
 		return config, err
 
 	}
@@ -578,31 +1175,53 @@ func createClusterConfig(config KubeAgentConfig) (KubeAgentConfig, error) {
 	config.Cert = thisConfig.CertFile
 	config.Key = thisConfig.KeyFile
 	config.TLSClientConfig.CAFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
-	config.BearerToken = thisConfig.BearerToken
-	config.BearerTokenPath = thisConfig.BearerTokenFile
+	applyBearerToken(config, thisConfig)
+	config.Credentials = credentials.FromConfig(thisConfig.BearerToken, thisConfig.BearerTokenFile,
+		config.tokenFileTTL(), nil)
 	if config.Namespace == "" {
 		config.Namespace = "cloudability"
 	}
 
-	config.Clientset, err = kubernetes.NewForConfig(thisConfig)
+	applyContentType(config, thisConfig)
+	config.Clientset, err = newLimitedClientset(thisConfig, apiLimiter)
 	return config, err
 
 }
 
+// applyBearerToken replaces the credentials of the cluster config with the configured bearer token, if any
+func applyBearerToken(config KubeAgentConfig, restConfig *rest.Config) {
+	if config.BearerToken == "" && config.BearerTokenFile == "" {
+		return
+	}
+	restConfig.BearerToken = config.BearerToken
+	restConfig.BearerTokenFile = config.BearerTokenFile
+	restConfig.ExecProvider = nil
+	restConfig.AuthProvider = nil
+}
+
+// tokenFileTTL returns how long a token read from a file is used before the file is read again
+func (ka KubeAgentConfig) tokenFileTTL() time.Duration {
+	return time.Duration(ka.TokenFileTTL) * time.Second
+}
+
+// newLimitedClientset returns a clientset whose requests wait for the shared API server limiter, if any
+func newLimitedClientset(c *rest.Config, limiter flowcontrol.RateLimiter) (*kubernetes.Clientset, error) {
+	if limiter != nil {
+		c.RateLimiter = limiter
+	}
+	return kubernetes.NewForConfig(c)
+}
+
 func updateConfig(ctx context.Context, config KubeAgentConfig) (KubeAgentConfig, error) {
 	updatedConfig, err := updateConfigurationForServices(ctx, config)
 	if err != nil {
 		log.Fatalf("cloudability metric agent is unable set internal configuration options: %v", err)
 	}
 
-	updatedConfig.NodeMetrics = EndpointMask{}
-
 	updatedConfig, err = createKubeHTTPClient(updatedConfig)
 	if err != nil {
 		return updatedConfig, err
 	}
-	updatedConfig.InClusterClient = raw.NewClient(updatedConfig.HTTPClient, config.Insecure,
-		config.BearerToken, config.BearerTokenPath, config.CollectionRetryLimit, config.ParseMetricData)
 
 	updatedConfig.clusterUID, err = getNamespaceUID(ctx, updatedConfig.Clientset, "default")
 	if err != nil {
@@ -613,6 +1232,10 @@ func updateConfig(ctx context.Context, config KubeAgentConfig) (KubeAgentConfig,
 	if err != nil {
 		log.Warnf("cloudability metric agent is unable to determine the cluster version: %v", err)
 	}
+	updatedConfig, err = applyVersionGates(updatedConfig)
+	if err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while checking the cluster version: %v", err)
+	}
 
 	updatedConfig.provisioningID, err = getProvisioningID(updatedConfig.APIKey)
 
@@ -630,9 +1253,135 @@ func updateConfigurationForServices(ctx context.Context, config KubeAgentConfig)
 
 	config.OutboundProxyURL = proxyRef
 
+	config, endpointSources, err := loadEndpointConfig(config)
+	if err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while loading the endpoint config: %v", err)
+	}
+
+	config.extraEndpoints, err = ParseExtraEndpoints(config.ExtraKubeletEndpoints)
+	if err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while setting extra kubelet endpoints: %v", err)
+	}
+	if err = checkOptionalSources(config.extraEndpoints, config.optionalSources()); err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while setting extra kubelet endpoints: %v", err)
+	}
+	logEndpointConfig(config, endpointSources)
+	config.uploadMigration, err = parseUploadMigration(config)
+	if err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while setting the upload migration: %v", err)
+	}
+	logUploadMigration(config, time.Now())
+	logDebugCapture(config)
+	if err = validateDisableEndpointsAnnotation(config.DisableEndpointsAnnotation); err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while setting the disable endpoints "+
+			"annotation: %v", err)
+	}
+
+	config.nodeNames, err = parseNodeNameAllowlist(config.NodeNameAllowlist)
+	if err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while setting the node name allowlist: %v", err)
+	}
+	if len(config.nodeNames) > 0 {
+		log.Infof("Collecting only nodes matching %v, samples are marked as partial collections", config.nodeNames)
+	}
+	config.nodeLabels, err = parseNodeLabelSelector(config.NodeLabelSelector)
+	if err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while setting the node label selector: %v", err)
+	}
+	if config.nodeLabels != nil {
+		log.Infof("Collecting only nodes matching the label selector %q", config.nodeLabels)
+	}
+
+	config.VirtualKubeletNodes, err = parseVirtualKubeletNodes(config.VirtualKubeletNodes)
+	if err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while setting the virtual kubelet node "+
+			"handling: %v", err)
+	}
+
+	if config.ForceDirect && config.ForceKubeProxy {
+		log.Fatalf("cloudability metric agent encountered an error while setting the node connection method: " +
+			"force_direct and force_kube_proxy can not both be set")
+	}
+
+	config.nodeAddressTypes, err = parseNodeAddressTypes(config.NodeAddressTypes)
+	if err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while setting the node address types: %v", err)
+	}
+	if len(config.nodeAddressTypes) > 0 {
+		log.Infof("Nodes are connected to directly via their %s address, in that order",
+			joinAddressTypes(config.nodeAddressTypes, ", "))
+	}
+
+	config.nodeTLS, err = parseNodeTLSOptions(config.KubeletTLSRenegotiation, config.KubeletTLSMaxVersion,
+		config.KubeletTLSCurves)
+	if err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while setting the kubelet TLS options: %v", err)
+	}
+
+	config.NodeSource, err = parseNodeSource(config.NodeSource)
+	if err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while setting the node source: %v", err)
+	}
+
+	if config.NodeListPageSize < 0 {
+		log.Fatalf("cloudability metric agent encountered an error while setting the node list page size: "+
+			"%d is negative", config.NodeListPageSize)
+	}
+
+	if config.KubeletPortOverride < 0 || config.KubeletPortOverride > 65535 {
+		log.Fatalf("cloudability metric agent encountered an error while setting the kubelet port override: "+
+			"port %d is out of range", config.KubeletPortOverride)
+	}
+	if config.KubeletPortOverride > 0 {
+		log.Infof("Kubelets are connected to directly on port %d", config.KubeletPortOverride)
+	}
+
+	config.CollectionProfile, err = parseCollectionProfile(config.CollectionProfile)
+	if err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while setting the collection profile: %v", err)
+	}
+	if config.namespaceRollup() {
+		log.Info("Collecting with the namespace profile, pod stats are rolled up to namespace totals and pod " +
+			"level detail is not exported")
+	}
+
+	config.imageRewriter, err = k8s_stats.NewImageRewriter(config.ImageRewrite, config.ImageKeepDigests)
+	if err != nil {
+		log.Fatalf("cloudability metric agent encountered an error while setting the image rewrite: %v", err)
+	}
+	if config.imageRewriter != nil {
+		log.Infof("Image references of collected resources are rewritten with %s, digests kept: %v",
+			config.ImageRewrite, config.ImageKeepDigests)
+	}
+
+	if config.TagSelf {
+		config.selfTagger = newSelfTagger(config)
+	}
+
 	return config, err
 }
 
+// selfNamespace returns the namespace of the agent's own pod, the agent namespace unless it is set
+func selfNamespace(config KubeAgentConfig) string {
+	if config.PodNamespace != "" {
+		return config.PodNamespace
+	}
+	return config.Namespace
+}
+
+// newSelfTagger returns the tagger of the agent's own pod and namespace in exported resources
+func newSelfTagger(config KubeAgentConfig) *k8s_stats.SelfTagger {
+	namespace := selfNamespace(config)
+	if config.PodName == "" {
+		log.Warnf("The name of the agent pod is not set, only its namespace %s is tagged in exported resources. "+
+			"Set CLOUDABILITY_POD_NAME from the downward API to tag the pod", namespace)
+	} else {
+		log.Infof("The agent pod %s/%s and its namespace are tagged in exported resources", namespace,
+			config.PodName)
+	}
+	return k8s_stats.NewSelfTagger(config.PodName, namespace)
+}
+
 func setProxyURL(op string) (u url.URL, err error) {
 	if op != "" {
 		u, err := url.ParseRequestURI(op)
@@ -687,41 +1436,43 @@ func getProvisioningID(s string) (string, error) {
 	return sha1Hash, err
 }
 
-func downloadBaselineMetricExport(ctx context.Context, config KubeAgentConfig, nodeSource NodeSource) (rerr error) {
-	ed, err := os.Open(path.Dir(config.msExportDirectory.Name()))
-	if err != nil {
-		log.Fatalln("Unable to open metric sample export directory")
-	}
-
-	defer util.SafeClose(ed.Close, &rerr)
+func downloadBaselineMetricExport(ctx context.Context, config KubeAgentConfig, state *AgentState,
+	nodeSource NodeSource) (rerr error) {
+	ed := util.NewWorkDir(path.Dir(config.msExportDirectory.Name()))
+	defer util.SafeClose(func() error { return ed.Close(ctx) }, &rerr)
 
 	// get baseline metric sample
-	config.failedNodeList, err = downloadNodeData(ctx, "baseline", config, ed, nodeSource)
-	if len(config.failedNodeList) > 0 {
-		log.Warnf("Warning failed to retrieve metric data from %v nodes. Metric samples may be incomplete: %+v %v",
-			len(config.failedNodeList), config.failedNodeList, err)
-	}
+	failedNodeList, err := downloadNodeData(ctx, sample.BaselinePrefix, config, pollCycle{}, state.Nodes(), ed,
+		nodeSource, nil, nil, nil)
+	logFailedNodes("Warning failed to retrieve baseline metric data, metric samples may be incomplete",
+		failedNodeList, config.FailedNodeLogLimit)
+	state.recordFailedNodes(failedNodeList)
 
 	return err
 }
 
-func ensureMetricServicesAvailable(ctx context.Context, config KubeAgentConfig) (KubeAgentConfig, error) {
-	config, err := ensureNodeSource(ctx, config)
+func ensureMetricServicesAvailable(ctx context.Context, config KubeAgentConfig,
+	apiLimiter flowcontrol.RateLimiter) (NodeConnection, error) {
+	nodes, err := ensureNodeSource(ctx, config, apiLimiter)
 	if err != nil {
 		log.Warnf(handleNodeSourceError(err))
 	} else {
-		log.Infof("Node summaries connection method: %s", config.NodeMetrics.Options(NodeStatsSummaryEndpoint))
+		log.Infof("Node summaries connection method: %s", nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint))
+		if !nodes.NodeMetrics.Unreachable(NodeResourceMetricsEndpoint) {
+			log.Infof("Node resource metrics connection method: %s",
+				nodes.NodeMetrics.Options(NodeResourceMetricsEndpoint))
+		}
 	}
 
-	if err == FatalNodeError {
+	if errors.Is(err, FatalNodeError) {
 		//nolint lll
 		log.Debugf(`Unable to retrieve data due to metrics-agent configuration.
 			May be caused by cluster security mis-configurations or the RBAC role in the Cloudability namespace needs to be updated.
 			Please confirm with your cluster security administrators that the RBAC role is able to work within your cluster's security configurations.`)
-		return config, fmt.Errorf("unable to retrieve node summaries: %s", err)
+		return nodes, fmt.Errorf("unable to retrieve node summaries: %s", err)
 	}
 
-	return config, nil
+	return nodes, nil
 }
 
 func handleNodeSourceError(err error) string {
@@ -795,7 +1546,8 @@ func createKubeHTTPClient(config KubeAgentConfig) (KubeAgentConfig, error) {
 }
 
 // CreateAgentStatusMetric creates a agent status measurement and returns a Cloudability Measurement
-func createAgentStatusMetric(workDir *os.File, config KubeAgentConfig, sampleStartTime time.Time) error {
+func createAgentStatusMetric(workDir *util.WorkDir, config KubeAgentConfig, status agentStatus,
+	sampleStartTime time.Time) error {
 	var err error
 
 	m := measurement.Measurement{
@@ -809,45 +1561,212 @@ func createAgentStatusMetric(workDir *os.File, config KubeAgentConfig, sampleSta
 
 	now := time.Now()
 
-	exportFile := workDir.Name() + "/agent-measurement.json"
+	exportFile := filepath.Join(workDir.Name(), sample.AgentMeasurementFile)
 
 	m.Tags["cluster_uid"] = config.clusterUID
 	m.Values["agent_version"] = cldyVersion.VERSION
+	m.Values["sample_format_version"] = strconv.Itoa(sample.FormatVersion)
+	m.Values["cycle_id"] = status.cycleID
 	m.Values["cluster_name"] = config.ClusterName
 	m.Values["cluster_version_git"] = config.ClusterVersion.versionInfo.GitVersion
 	m.Values["cluster_version_major"] = config.ClusterVersion.versionInfo.Major
 	m.Values["cluster_version_minor"] = config.ClusterVersion.versionInfo.Minor
+	m.Values["min_kubernetes_version"] = config.MinKubernetesVersion
+	m.Values["version_gated"] = strings.Join(config.versionGated, ",")
 	m.Values["heapster_url"] = config.HeapsterURL
 	m.Values["incluster_config"] = strconv.FormatBool(config.UseInClusterConfig)
 	m.Values["insecure"] = strconv.FormatBool(config.Insecure)
+	m.Values["dev"] = strconv.FormatBool(config.Dev)
+	m.Values["node_idle_conn_timeout"] = strconv.Itoa(config.NodeIdleConnTimeout)
+	m.Values["reprobe_interval"] = strconv.Itoa(config.ReprobeInterval)
+	m.Values["endpoint_config_file"] = config.EndpointConfigFile
+	m.Values["warm_up"] = strconv.FormatBool(config.WarmUp)
+	m.Values["sample_interval_lock"] = strconv.FormatBool(config.SampleIntervalLock)
+	m.Values["kubelet_tls_verify"] = strconv.FormatBool(config.KubeletTLSVerify)
+	m.Values["kubelet_ca_file"] = config.KubeletCAFile
+	m.Values["kubelet_tls_renegotiation"] = config.KubeletTLSRenegotiation
+	m.Values["kubelet_tls_max_version"] = config.KubeletTLSMaxVersion
+	m.Values["kubelet_tls_curves"] = config.KubeletTLSCurves
+	m.Values["image_rewrite"] = config.ImageRewrite
+	m.Values["image_keep_digests"] = strconv.FormatBool(config.ImageKeepDigests)
+	m.Values["tag_self"] = strconv.FormatBool(config.TagSelf)
+	if config.selfTagger != nil {
+		m.Values["self_pod"] = config.PodName
+		m.Values["self_namespace"] = selfNamespace(config)
+	}
+	m.Values["post_collection_hook"] = strconv.FormatBool(config.PostCollectionHook != "")
+	m.Values["post_collection_hook_timeout"] = strconv.Itoa(config.PostCollectionHookTimeout)
+	m.Values["post_collection_hook_fatal"] = strconv.FormatBool(config.PostCollectionHookFatal)
+	m.Values["missed_interval_threshold"] = strconv.Itoa(config.MissedIntervalThreshold)
+	m.Metrics["expected_intervals"] = status.sampleRate.Expected
+	m.Metrics["missed_intervals"] = status.sampleRate.missed()
+	m.Metrics["consecutive_missed_intervals"] = status.sampleRate.ConsecutiveMissed
+	if !status.warmUpCompleted.IsZero() {
+		m.Values["warm_up_completed"] = status.warmUpCompleted.UTC().Format(time.RFC3339)
+	}
 	m.Values["poll_interval"] = strconv.Itoa(config.PollInterval)
 	m.Values["provisioning_id"] = config.provisioningID
 	m.Values["outbound_proxy_url"] = config.OutboundProxyURL.String()
-	m.Values["stats_summary_retrieval_method"] = config.NodeMetrics.Options(NodeStatsSummaryEndpoint)
+	m.Values["stats_summary_retrieval_method"] = status.nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint)
 	m.Values["retrieve_node_summaries"] = "true"
+	for _, e := range status.nodes.NodeMetrics.Endpoints() {
+		m.Values["retrieval_method:"+string(e)] = status.nodes.NodeMetrics.Options(e)
+		for _, method := range []Connection{Direct, Proxy, PodProxy} {
+			if reason := status.nodes.NodeMetricsReasons.Reason(e, method); reason != "" {
+				m.Errors = append(m.Errors, measurement.ErrorDetail{
+					Name:    string(e),
+					Message: fmt.Sprintf("%s connection unavailable: %s", method, reason),
+					Type:    "endpoint_unavailable",
+				})
+			}
+		}
+	}
 	m.Values["informer_resync_interval"] = strconv.Itoa(config.InformerResyncInterval)
 	m.Values["force_kube_proxy"] = strconv.FormatBool(config.ForceKubeProxy)
+	m.Values["force_direct"] = strconv.FormatBool(config.ForceDirect)
+	m.Values["virtual_kubelet_nodes"] = config.VirtualKubeletNodes
 	m.Values["number_of_concurrent_node_pollers"] = strconv.Itoa(config.ConcurrentPollers)
 	m.Values["parse_metric_data"] = strconv.FormatBool(config.ParseMetricData)
 	m.Values["https_client_timeout"] = strconv.Itoa(config.HTTPSTimeout)
 	m.Values["upload_region"] = config.UploadRegion
 	m.Values["custom_s3_bucket"] = config.CustomS3UploadBucket
 	m.Values["custom_s3_region"] = config.CustomS3Region
+	m.Values["diagnostic_log_lines"] = strconv.Itoa(config.DiagnosticLogLines)
+	m.Values["probe_node_min_age"] = strconv.Itoa(config.ProbeNodeMinAge)
+	m.Values["max_open_files"] = strconv.Itoa(config.MaxOpenFiles)
+	m.Values["backfill_max_intervals"] = strconv.Itoa(config.BackfillMaxIntervals)
+	m.Values["node_size_spike_factor"] = strconv.FormatFloat(config.NodeSizeSpikeFactor, 'f', -1, 64)
+	for source, count := range status.nodeSizes.spikes {
+		m.Metrics["node_size_spikes:"+source] = count
+	}
+	m.Values["late_node_budget"] = strconv.Itoa(config.LateNodeBudget)
+	m.Metrics["late_added_nodes"] = uint64(len(status.lateAddedNodes))
+	m.Values["strict_permissions"] = strconv.FormatBool(config.StrictPermissions)
+	m.Values["not_permitted"] = strings.Join(status.notPermitted, ",")
+	m.Values["stats_relay_selector"] = config.StatsRelaySelector
+	m.Values["max_sample_bytes"] = strconv.FormatInt(config.MaxSampleBytes, 10)
+	m.Values["node_fetch_pacing"] = strconv.FormatFloat(config.NodeFetchPacing, 'f', -1, 64)
+	m.Metrics["node_fetch_pace_ms"] = uint64(status.nodeFetchPace.Milliseconds())
+	m.Values["bearer_token_override"] = strconv.FormatBool(config.BearerToken != "" || config.BearerTokenFile != "")
+	m.Values["token_file_ttl"] = strconv.Itoa(config.TokenFileTTL)
+	m.Values["proxy_path_credentials"] = strconv.FormatBool(config.ProxyCredentials.configured())
+	m.Values["direct_path_credentials"] = strconv.FormatBool(config.DirectCredentials.configured())
+	m.Metrics["sample_shed_bytes"] = uint64(status.sampleShedBytes)
+	m.Metrics["freshness_spread_ms"] = uint64(status.freshnessSpread.Milliseconds())
+	m.Metrics["truncated_metric_families"] = uint64(len(status.seriesTruncations))
+	m.Metrics["tls_handshakes"] = uint64(status.tlsHandshakes)
+	m.Metrics["tls_resumed_handshakes"] = uint64(status.tlsResumedHandshakes)
+	var truncatedSeries int
+	for _, t := range status.seriesTruncations {
+		truncatedSeries += t.Dropped
+	}
+	m.Metrics["truncated_metric_series"] = uint64(truncatedSeries)
+	m.Values["disable_endpoints_annotation"] = config.DisableEndpointsAnnotation
+	m.Metrics["disabled_node_endpoints"] = uint64(len(status.disabledEndpoints))
+	m.Metrics["estimated_poll_api_server_requests"] = uint64(status.loadEstimate.APIServerRequests)
+	m.Metrics["estimated_poll_payload_bytes"] = uint64(status.loadEstimate.PayloadBytes)
+	m.Values["collection_profile"] = config.CollectionProfile
+	qps, burst := apiServerRateLimit(config)
+	m.Values["small_cluster"] = strconv.FormatBool(config.SmallCluster)
+	m.Values["api_server_qps"] = strconv.FormatFloat(float64(qps), 'f', -1, 32)
+	m.Values["api_server_burst"] = strconv.Itoa(burst)
+	m.Values["api_server_json"] = strconv.FormatBool(config.APIServerJSON)
+	m.Values["retrieve_probe_metrics"] = strconv.FormatBool(config.RetrieveProbeMetrics)
+	m.Values["retrieve_kubelet_pods"] = strconv.FormatBool(config.RetrieveKubeletPods)
+	m.Values["retrieve_node_spec"] = strconv.FormatBool(config.RetrieveNodeSpec)
+	m.Values["node_spec_interval"] = strconv.Itoa(config.NodeSpecInterval)
+	m.Values["retrieve_kubelet_configz"] = strconv.FormatBool(config.RetrieveKubeletConfigz)
+	m.Values["retrieve_kubelet_metrics"] = strconv.FormatBool(config.RetrieveKubeletMetrics)
+	m.Values["cadvisor_label_allowlist"] = config.CadvisorLabelAllowlist
+	m.Values["cadvisor_label_denylist"] = config.CadvisorLabelDenylist
+	m.Values["cadvisor_max_series_per_family"] = strconv.Itoa(config.CadvisorMaxSeriesPerFamily)
+	m.Values["node_fetch_timeout"] = strconv.Itoa(config.NodeFetchTimeout)
+	m.Values["response_stall_timeout"] = strconv.Itoa(config.ResponseStallTimeout)
+	m.Values["node_name_allowlist"] = config.NodeNameAllowlist
+	m.Values["node_label_selector"] = config.nodeLabelSelector()
+	m.Values["skip_unschedulable_nodes"] = strconv.FormatBool(config.SkipUnschedulableNodes)
+	m.Values["include_not_ready_grace_period"] = strconv.Itoa(config.IncludeNotReadyGracePeriod)
+	m.Values["max_heartbeat_age"] = strconv.Itoa(config.MaxHeartbeatAge)
+	m.Values["node_list_page_size"] = strconv.Itoa(config.NodeListPageSize)
+	m.Values["node_source"] = config.NodeSource
+	m.Values["node_watch_outage_threshold"] = strconv.Itoa(config.NodeWatchOutageThreshold)
+	m.Values["max_nodes_per_cycle"] = strconv.Itoa(config.MaxNodesPerCycle)
+	m.Values["node_address_types"] = config.NodeAddressTypes
+	m.Values["kubelet_port_override"] = strconv.Itoa(config.KubeletPortOverride)
+	m.Values["partial_collection"] = strconv.FormatBool(len(config.nodeNames) > 0)
+	m.Metrics["cluster_nodes"] = uint64(status.clusterSummary.Nodes)
+	m.Metrics["cluster_pods"] = uint64(status.clusterSummary.Pods)
+	m.Metrics["cluster_namespaces"] = uint64(status.clusterSummary.Namespaces)
+	m.Metrics["cluster_allocatable_cpu_millicores"] = uint64(status.clusterSummary.AllocatableCPUMillicores)
+	m.Metrics["cluster_allocatable_memory_bytes"] = uint64(status.clusterSummary.AllocatableMemoryBytes)
+	m.Values["degradation_level"] = status.pollOverruns.level.String()
+	m.Values["upload_protocol_version"] = status.uploadLimits.ProtocolVersion
+	m.Metrics["upload_max_payload_bytes"] = uint64(status.uploadLimits.MaxPayloadBytes)
+	encoding, _ := client.NegotiateContentEncoding(config.UploadContentEncoding, status.uploadLimits)
+	m.Values["upload_content_encoding"] = encoding
+	m.Values["upload_capabilities"] = strings.Join(status.uploadLimits.Capabilities, ",")
+	m.Values["upload_file_classes"] = strings.Join(status.uploadLimits.FileClasses, ",")
+	m.Values["migration_upload_url"] = config.MigrationUploadURL
+	m.Values["debug_capture_file"] = config.DebugCaptureFile
+	m.Metrics["debug_captured_nodes"] = uint64(len(status.debugCaptures))
+	m.Values["migration_end_date"] = config.MigrationEndDate
+	if config.uploadMigration != nil {
+		m.Values["migration_authoritative_destination"] = config.uploadMigration.authoritative
+	}
+	for d, u := range status.uploads {
+		m.Metrics["uploads_succeeded_"+d] = uint64(u.succeeded)
+		m.Metrics["uploads_failed_"+d] = uint64(u.failed)
+		if !u.lastSuccess.IsZero() {
+			m.Values["last_upload_"+d] = u.lastSuccess.Format(time.RFC3339)
+		}
+		if u.lastError != "" {
+			m.Values["last_upload_error_"+d] = u.lastError
+		}
+	}
+	m.Values["accepted_file_classes"] = strings.Join(config.fileClasses, ",")
+	m.Metrics["unchanged_node_files"] = uint64(status.unchangedNodeFiles)
+	m.Metrics["deferred_nodes"] = uint64(status.deferredNodes)
+	m.Values["export_volume_condition"] = "writable"
+	if v := status.exportVolume; v.condition != "" {
+		m.Values["export_volume_condition"] = v.condition
+		m.Values["export_volume_unwritable_since"] = v.since.Format(time.RFC3339)
+		m.Values["export_volume_error"] = v.lastError
+	}
+	if v := status.exportVolume; !v.recovered.IsZero() {
+		m.Values["export_volume_recovered_at"] = v.recovered.Format(time.RFC3339)
+		m.Values["export_volume_recovered_from"] = v.recoveredFrom
+	}
+	m.Metrics["poll_overruns"] = uint64(status.pollOverruns.totalOverruns)
+	m.Metrics["poll_consecutive_overruns"] = uint64(status.pollOverruns.consecutiveOverruns)
+	m.Values["extra_kubelet_endpoints"] = strconv.Itoa(len(config.extraEndpoints))
 	if len(config.OutboundProxyAuth) > 0 {
 		m.Values["outbound_proxy_auth"] = "true"
 	} else {
 		m.Values["outbound_proxy_auth"] = "false"
 	}
 	m.Metrics["uptime"] = uint64(now.Sub(config.AgentStartTime).Seconds())
-	if len(config.failedNodeList) > 0 {
-
-		for k, v := range config.failedNodeList {
+	for ct, count := range status.nodeCapacityTypes {
+		m.Metrics["nodes_capacity_type_"+strings.ReplaceAll(string(ct), "-", "_")] = uint64(count)
+	}
+	if len(status.failedNodeList) > 0 {
+		failed := summarizeFailedNodes(status.failedNodeList, config.FailedNodeReportLimit)
+		for _, n := range failed.detailed {
 			m.Errors = append(m.Errors, measurement.ErrorDetail{
-				Name:    k,
-				Message: v.Error(),
+				Name:    n.name,
+				Message: n.err,
 				Type:    "node_error",
 			})
 		}
+		for _, c := range failed.aggregated {
+			m.Errors = append(m.Errors, measurement.ErrorDetail{
+				Name:    strconv.Itoa(c.count),
+				Message: c.class,
+				Type:    "node_error_aggregate",
+			})
+		}
+		m.Metrics["failed_nodes"] = uint64(len(status.failedNodeList))
+		m.Metrics["stalled_nodes"] = uint64(countStalledNodes(status.failedNodeList))
+		m.Metrics["not_ready_failed_nodes"] = uint64(countNotReadyNodes(status.failedNodeList))
 	}
 
 	cldyMetric, err := json.Marshal(m)
@@ -903,23 +1822,7 @@ func fetchDiagnostics(ctx context.Context, clientset kubernetes.Interface, names
 	for _, pod := range pods.Items {
 		if strings.Contains(pod.Name, "metrics-agent") && time.Since(pod.Status.StartTime.Time) > (time.Minute*3) {
 			for _, c := range pod.Status.ContainerStatuses {
-
-				f, err := os.Create(msExportDirectory.Name() + "/agent.diag")
-				if err != nil {
-					return err
-				}
-
-				defer util.SafeClose(f.Close, &err)
-
-				_, err = f.WriteString(
-					fmt.Sprintf(
-						"Agent Diagnostics for Pod: %v container: %v restarted %v times \n state: %+v \n Previous runtime log: \n",
-						pod.Name, c.Name, c.RestartCount, c.LastTerminationState))
-				if err != nil {
-					return err
-				}
-
-				err = getPodLogs(ctx, clientset, namespace, pod.Name, c.Name, false, f)
+				err = writeContainerDiagnostics(ctx, clientset, namespace, pod.Name, c, msExportDirectory)
 				if err != nil {
 					return err
 				}
@@ -931,11 +1834,41 @@ func fetchDiagnostics(ctx context.Context, clientset kubernetes.Interface, names
 
 }
 
-// getBearerToken reads the service account token
-func getBearerToken(bearerTokenPath string) (string, error) {
-	token, err := os.ReadFile(bearerTokenPath)
+// writeContainerDiagnostics writes the state and log of an agent container to the diagnostics file,
+// closing the file before returning
+func writeContainerDiagnostics(ctx context.Context, clientset kubernetes.Interface, namespace, podName string,
+	c v1.ContainerStatus, msExportDirectory *os.File) (rerr error) {
+
+	f, err := os.Create(filepath.Join(msExportDirectory.Name(), sample.DiagnosticsFile))
+	if err != nil {
+		return err
+	}
+
+	defer util.SafeClose(f.Close, &rerr)
+
+	_, err = f.WriteString(
+		fmt.Sprintf(
+			"Agent Diagnostics for Pod: %v container: %v restarted %v times \n state: %+v \n Previous runtime log: \n",
+			podName, c.Name, c.RestartCount, c.LastTerminationState))
+	if err != nil {
+		return err
+	}
+
+	return getPodLogs(ctx, clientset, namespace, podName, c.Name, false, f)
+}
+
+// writeLogTail writes the most recent buffered agent log records into the sample directory
+func writeLogTail(workDir *util.WorkDir, logs *util.LogRingBuffer, lines int) (rerr error) {
+	if logs == nil || logs.Len() == 0 {
+		return nil
+	}
+
+	f, err := os.Create(filepath.Join(workDir.Name(), sample.LogTailFile))
 	if err != nil {
-		return "", errors.New("could not read bearer token from file")
+		return err
 	}
-	return string(token), nil
+
+	defer util.SafeClose(f.Close, &rerr)
+
+	return logs.WriteTail(f, lines)
 }
@@ -3,10 +3,12 @@ package kubernetes
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -16,10 +18,15 @@ import (
 
 	fcache "k8s.io/client-go/tools/cache/testing"
 
+	"github.com/cloudability/metrics-agent/credentials"
 	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
 	v1apps "k8s.io/api/apps/v1"
 	v1batch "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
+	v1node "k8s.io/api/node/v1"
+	v1scheduling "k8s.io/api/scheduling/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
 )
@@ -32,7 +39,7 @@ func TestCreateClusterConfig(t *testing.T) {
 		Insecure:     false,
 	}
 	t.Run("ensure that a clientset and agentConfig are returned", func(t *testing.T) {
-		config, err := createClusterConfig(config)
+		config, err := createClusterConfig(config, nil)
 		if config.UseInClusterConfig || err != nil {
 			t.Errorf("Expected clientset and agentConfig to successfully create / update %v ", err)
 		}
@@ -114,17 +121,16 @@ func TestEnsureMetricServicesAvailable(t *testing.T) {
 		)
 		config := KubeAgentConfig{
 			Clientset:         cs,
-			NodeMetrics:       EndpointMask{},
 			ConcurrentPollers: 10,
 		}
-		config, err := ensureMetricServicesAvailable(context.TODO(), config)
+		nodes, err := ensureMetricServicesAvailable(context.TODO(), config, nil)
 		if err == nil {
 			t.Errorf("expected an error for ensureMetricServicesAvailable")
 			return
 		}
-		if !config.NodeMetrics.Unreachable(NodeStatsSummaryEndpoint) {
+		if !nodes.NodeMetrics.Unreachable(NodeStatsSummaryEndpoint) {
 			t.Errorf("expected connection to be unreachable, instead was %s",
-				config.NodeMetrics.Options(NodeStatsSummaryEndpoint))
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint))
 		}
 	})
 
@@ -142,11 +148,10 @@ func TestEnsureMetricServicesAvailable(t *testing.T) {
 			HeapsterURL:       ts.URL,
 			HTTPClient:        client,
 			ConcurrentPollers: 10,
-			InClusterClient:   raw.NewClient(client, true, "", "", 0, false),
 		}
 
 		var err error
-		_, err = ensureMetricServicesAvailable(context.TODO(), config)
+		_, err = ensureMetricServicesAvailable(context.TODO(), config, nil)
 		if err != nil {
 			t.Errorf("Unexpected error fetching node summaries: %s", err)
 		}
@@ -163,7 +168,7 @@ func TestUpdateConfigWithOverrideNamespace(t *testing.T) {
 		Namespace:    "testing-namespace",
 	}
 	t.Run("ensure that namespace is set correctly", func(t *testing.T) {
-		config, _ := createClusterConfig(config)
+		config, _ := createClusterConfig(config, nil)
 		if config.Namespace != "testing-namespace" {
 			t.Errorf("Expected Namespace to be \"testing-namespace\" but received \"%v\" ", config.Namespace)
 		}
@@ -175,7 +180,7 @@ func TestCreateAgentStatusMetric(t *testing.T) {
 	AgentStartTime := time.Now()
 	exportDir := os.TempDir() + "/" + strconv.FormatInt(time.Now().Unix(), 10)
 	_ = os.MkdirAll(exportDir, os.ModePerm)
-	tD, _ := os.Open(exportDir)
+	tD := util.NewWorkDir(exportDir)
 
 	cs := fake.NewSimpleClientset()
 	sv, _ := cs.Discovery().ServerVersion()
@@ -191,7 +196,7 @@ func TestCreateAgentStatusMetric(t *testing.T) {
 	}
 
 	t.Run("Ensure that a cloudability Status metric is created", func(t *testing.T) {
-		err := createAgentStatusMetric(tD, config, AgentStartTime)
+		err := createAgentStatusMetric(tD, config, newAgentState(config, NodeConnection{}).status(), AgentStartTime)
 
 		if err != nil {
 			t.Errorf("Error creating agent Status Metric: %v", err)
@@ -255,17 +260,15 @@ func TestCollectMetrics(t *testing.T) {
 		ClusterHostURL:     ts.URL,
 		HeapsterURL:        ts.URL,
 		Insecure:           true,
-		BearerToken:        "",
-		BearerTokenPath:    "",
 		ForceKubeProxy:     false,
 		ConcurrentPollers:  10,
 		ParseMetricData:    false,
 	}
-	ka.NodeMetrics = EndpointMask{}
+	nodes := NodeConnection{NodeMetrics: NewEndpointMask()}
 	// set Proxy method available
-	ka.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
 	// set Direct as option as well
-	ka.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
 
 	stopCh := make(chan struct{})
 	ka.Informers, err = getMockInformers(ka.ClusterVersion.version, stopCh)
@@ -290,8 +293,6 @@ func TestCollectMetrics(t *testing.T) {
 		ClusterHostURL:     ts.URL,
 		HeapsterURL:        ts.URL,
 		Insecure:           true,
-		BearerToken:        "",
-		BearerTokenPath:    "",
 		ForceKubeProxy:     false,
 		ConcurrentPollers:  10,
 		ParseMetricData:    true,
@@ -302,18 +303,19 @@ func TestCollectMetrics(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	ka.BearerTokenPath = wd + "/testdata/mockToken"
+	ka.Credentials = credentials.NewFileProvider(wd+"/testdata/mockToken", 0)
 
-	ka.InClusterClient = raw.NewClient(ka.HTTPClient, ka.Insecure, ka.BearerToken, ka.BearerTokenPath, 0, false)
+	nodes.InClusterClient = raw.NewClient(ka.HTTPClient, ka.Insecure, ka.Credentials, 0, false)
+	state := newAgentState(ka, nodes)
 	fns := NewClientsetNodeSource(cs)
 
 	t.Run("Ensure that a collection occurs", func(t *testing.T) {
 		// download the initial baseline...like a typical CollectKubeMetrics would
-		err := downloadBaselineMetricExport(context.TODO(), ka, fns)
+		err := downloadBaselineMetricExport(context.TODO(), ka, state, fns)
 		if err != nil {
 			t.Error(err)
 		}
-		err = ka.collectMetrics(context.TODO(), ka, cs, fns)
+		err = ka.collectMetrics(context.TODO(), ka, pollCycle{}, state, cs, fns)
 		if err != nil {
 			t.Error(err)
 		}
@@ -363,6 +365,44 @@ func TestCollectMetrics(t *testing.T) {
 			}
 		}
 	})
+	t.Run("Ensure the sample manifest records the cycle ID of the poll", func(t *testing.T) {
+		manifests, err := filepath.Glob(filepath.Join(ka.msExportDirectory.Name(), "*", "*", sample.ManifestFile))
+		if err != nil || len(manifests) != 1 {
+			t.Fatalf("expected a sample manifest, got %v %v", manifests, err)
+		}
+		manifest, err := sample.ReadManifest(filepath.Dir(manifests[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.CycleID) != 26 || manifest.CycleID != state.LastSampleCycleID() {
+			t.Errorf("expected the manifest to record the cycle ID %q, got %q", state.LastSampleCycleID(),
+				manifest.CycleID)
+		}
+		if r := manifest.NodeReadiness; r == nil || r.Total != 3 || r.Ready != 3 || r.NotReady != 0 {
+			t.Errorf("expected the manifest to count the 3 ready nodes, got %+v", r)
+		}
+	})
+	t.Run("Ensure the sample directory layout matches the snapshot for the sample format version",
+		func(t *testing.T) {
+			layout, err := sampleLayout(ka.msExportDirectory.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			snapshot := fmt.Sprintf("testdata/sample-layout-v%d.txt", sample.FormatVersion)
+			if os.Getenv("UPDATE_SAMPLE_LAYOUT") != "" {
+				if err := os.WriteFile(snapshot, []byte(layout), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(snapshot)
+			if err != nil {
+				t.Fatalf("unable to read layout snapshot, a new sample format version needs a new snapshot: %v", err)
+			}
+			if layout != string(expected) {
+				t.Errorf("sample layout changed without a sample format version change.\nexpected:\n%s\ngot:\n%s",
+					expected, layout)
+			}
+		})
 	t.Run("Ensure collection occurs with parseMetrics is disabled"+
 		" ensure sensitive data is not stripped", func(t *testing.T) {
 
@@ -402,7 +442,8 @@ func TestCollectMetrics(t *testing.T) {
 	})
 	t.Run("Ensure collection occurs with parseMetrics enabled"+
 		"ensure sensitive data is stripped", func(t *testing.T) {
-		err = kubeAgentParseMetrics.collectMetrics(context.TODO(), kubeAgentParseMetrics, cs, fns)
+		err = kubeAgentParseMetrics.collectMetrics(context.TODO(), kubeAgentParseMetrics, pollCycle{},
+			newAgentState(kubeAgentParseMetrics, NodeConnection{}), cs, fns)
 		if err != nil {
 			t.Error(err)
 		}
@@ -443,6 +484,29 @@ func TestCollectMetrics(t *testing.T) {
 
 }
 
+// sampleLayout lists the files in an export directory, one per line, with the timestamped sample
+// directories replaced by placeholders so the layout can be compared between runs
+func sampleLayout(exportDir string) (string, error) {
+	var files []string
+	err := filepath.Walk(exportDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(exportDir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		if len(parts) == 3 {
+			parts[0], parts[1] = "<timestamp>", "<unix>"
+		}
+		files = append(files, strings.Join(parts, "/"))
+		return nil
+	})
+	sort.Strings(files)
+	return strings.Join(files, "\n") + "\n", err
+}
+
 // isRequiredFile checks if the filename matches one of the filenames
 // we require to be in a metrics payload
 // ex: baseline-summary
@@ -566,6 +630,12 @@ func getMockInformers(clusterVersion float64, stopCh chan struct{}) (map[string]
 		cjinformer = cache.NewSharedInformer(cronJobs, &v1batch.CronJob{}, 1*time.Second).(cache.SharedIndexInformer)
 	}
 
+	priorityClasses := fcache.NewFakeControllerSource()
+	pcinformer := cache.NewSharedInformer(priorityClasses, &v1scheduling.PriorityClass{}, 1*time.Second).(cache.SharedIndexInformer)
+
+	runtimeClasses := fcache.NewFakeControllerSource()
+	rtcinformer := cache.NewSharedInformer(runtimeClasses, &v1node.RuntimeClass{}, 1*time.Second).(cache.SharedIndexInformer)
+
 	mockInformers := map[string]*cache.SharedIndexInformer{
 		"replicationcontrollers": &rcinformer,
 		"services":               &sinformer,
@@ -579,6 +649,8 @@ func getMockInformers(clusterVersion float64, stopCh chan struct{}) (map[string]
 		"namespaces":             &nainformer,
 		"jobs":                   &jinformer,
 		"cronjobs":               &cjinformer,
+		"priorityclasses":        &pcinformer,
+		"runtimeclasses":         &rtcinformer,
 	}
 	// Call the Run function for each Informer, allowing the informers to listen for Add events
 	startMockInformers(mockInformers, stopCh)
@@ -597,6 +669,8 @@ func getMockInformers(clusterVersion float64, stopCh chan struct{}) (map[string]
 	replicaSets.Add(&v1apps.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "rs1", Annotations: annotation}})
 	daemonSets.Add(&v1apps.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "ds1", Annotations: annotation}})
 	jobs.Add(&v1batch.Job{ObjectMeta: metav1.ObjectMeta{Name: "job1", Annotations: annotation}})
+	priorityClasses.Add(&v1scheduling.PriorityClass{ObjectMeta: metav1.ObjectMeta{Name: "pc1", Annotations: annotation}, Value: 1000})
+	runtimeClasses.Add(&v1node.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: "rtc1", Annotations: annotation}, Handler: "runsc"})
 	if clusterVersion > 1.20 {
 		cronJobs.Add(&v1batch.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "cj1", Annotations: annotation}})
 	}
@@ -0,0 +1,220 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// DefaultLateNodeBudget is the default time (in seconds) a collection may spend collecting nodes that
+// joined the cluster after its node list was taken, late node collection is disabled by default
+const DefaultLateNodeBudget = 0
+
+// errLateNodeBudget is reported for late nodes that could not be collected within the late node budget
+var errLateNodeBudget = errors.New("node joined the cluster during collection and could not be collected " +
+	"within the late node budget")
+
+// lateNodeDeadline returns when the collection of late nodes must be complete, the earlier of the end of
+// the late node budget and the end of the poll interval of a collection started at start
+func lateNodeDeadline(config KubeAgentConfig, start, now time.Time) time.Time {
+	deadline := now.Add(time.Duration(config.LateNodeBudget) * time.Second)
+	if cycleEnd := start.Add(time.Duration(config.PollInterval) * time.Second); cycleEnd.Before(deadline) {
+		return cycleEnd
+	}
+	return deadline
+}
+
+// collectedNodes returns the names of the nodes that were collected into the sample directory or failed
+func collectedNodes(msd string, failedNodeList map[string]error) (map[string]bool, error) {
+	entries, err := os.ReadDir(msd)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(failedNodeList))
+	for _, e := range entries {
+		if key, ok := parseNodeSourceFile(e.Name()); ok {
+			known[key.node] = true
+		}
+	}
+	for name := range failedNodeList {
+		known[name] = true
+	}
+	return known, nil
+}
+
+// collectLateNodes lists the ready nodes again and collects those that are not known, as they joined the
+// cluster after the node list was taken. Collection stops at the deadline, late nodes not collected by
+// then are reported as failed and any data they return afterwards is discarded. Returns the late nodes
+// that were collected and those that failed.
+func collectLateNodes(ctx context.Context, config KubeAgentConfig, cycle pollCycle, nodes NodeConnection,
+	workDir *util.WorkDir, nodeSource NodeSource, known map[string]bool,
+	deadline time.Time) ([]string, map[string]error) {
+	failedNodeList := make(map[string]error)
+	budget := time.Until(deadline)
+	if budget <= 0 {
+		log.Debugf("No time remains in the poll interval to check for nodes added during collection")
+		return nil, failedNodeList
+	}
+
+	readyNodes, err := nodeSource.GetReadyNodes(ctx)
+	if err != nil {
+		log.Warnf("Warning: unable to check for nodes added during collection: %v", err)
+		return nil, failedNodeList
+	}
+	readyNodes, _ = withoutVirtualNodes(config, readyNodes)
+	readyNodes, _ = withoutOptedOutNodes(readyNodes)
+	var lateNodes []v1.Node
+	for _, n := range readyNodes {
+		if !known[n.Name] {
+			lateNodes = append(lateNodes, n)
+		}
+	}
+	if len(lateNodes) == 0 {
+		return nil, failedNodeList
+	}
+	log.Infof("Collecting %d nodes added during collection within %v", len(lateNodes), budget.Round(time.Second))
+	// relay pods for the late nodes are scheduled as they join
+	refreshStatsRelay(ctx, nodes)
+
+	containersRequest, err := buildContainersRequest(1)
+	if err != nil {
+		log.Warnf("Warning: unable to collect nodes added during collection: %v", err)
+		return nil, failedNodeList
+	}
+
+	// late nodes are downloaded outside the sample and only moved into it if collected by the deadline
+	lateDir, err := os.MkdirTemp(config.ScratchDir, "cldy-late-nodes")
+	if err != nil {
+		log.Warnf("Warning: unable to create late node directory: %v", err)
+		return nil, failedNodeList
+	}
+	// requests still running at the deadline are abandoned
+	lateCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	closed := false
+	var collected []string
+	done := make(map[string]bool, len(lateNodes))
+	limiter := make(chan struct{}, config.ConcurrentPollers)
+
+	for _, n := range lateNodes {
+		wg.Add(1)
+		go func(n v1.Node) {
+			defer wg.Done()
+			limiter <- struct{}{}
+			defer func() { <-limiter }()
+
+			m.Lock()
+			expired := closed
+			m.Unlock()
+			if expired {
+				return
+			}
+
+			nodeDir, err := downloadLateNode(lateCtx, n, lateDir, config, cycle, nodes, nodeSource,
+				containersRequest)
+			m.Lock()
+			defer m.Unlock()
+			if closed {
+				return
+			}
+			done[n.Name] = true
+			if err == nil {
+				err = moveDir(nodeDir, workDir.Name())
+			}
+			if err != nil && ctx.Err() != nil {
+				failedNodeList[n.Name] = fmt.Errorf("node metrics retrieval cancelled: %w", err)
+				return
+			}
+			if err != nil && lateCtx.Err() != nil {
+				failedNodeList[n.Name] = errLateNodeBudget
+				return
+			}
+			if err != nil {
+				failedNodeList[n.Name] = nodeFetchError(n, err)
+				return
+			}
+			collected = append(collected, n.Name)
+		}(n)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+		// abandoned nodes may still be writing to the late node directory until their requests are cancelled
+		os.RemoveAll(lateDir)
+	}()
+
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	select {
+	case <-finished:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	closed = true
+	for _, n := range lateNodes {
+		if done[n.Name] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			failedNodeList[n.Name] = fmt.Errorf("node metrics retrieval cancelled: %w", err)
+		} else {
+			failedNodeList[n.Name] = errLateNodeBudget
+		}
+	}
+	sort.Strings(collected)
+	return collected, failedNodeList
+}
+
+// downloadLateNode downloads the data of a late node into its own directory within lateDir, returning
+// the directory
+func downloadLateNode(ctx context.Context, n v1.Node, lateDir string, config KubeAgentConfig, cycle pollCycle,
+	nodes NodeConnection, nodeSource NodeSource, containersRequest []byte) (string, error) {
+	nodeDir, err := os.MkdirTemp(lateDir, "node")
+	if err != nil {
+		return "", err
+	}
+	nodeWorkDir := util.NewWorkDir(nodeDir)
+	// the directory is only moved into the sample once the files of the node are closed
+	defer nodeWorkDir.Close(ctx)
+
+	nd := nodeFetchData{
+		nodeName:          n.Name,
+		prefix:            sample.StatsPrefix,
+		workDir:           nodeWorkDir,
+		ClusterHostURL:    config.ClusterHostURL,
+		containersRequest: containersRequest,
+	}
+	return nodeDir, retrieveNodeData(ctx, nd, config, cycle, nodes, nodeSource, n)
+}
+
+// moveDir moves the files in the src directory into the dst directory
+func moveDir(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.Rename(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
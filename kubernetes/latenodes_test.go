@@ -0,0 +1,146 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLateNodeDeadline(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	config := KubeAgentConfig{PollInterval: 180, LateNodeBudget: 30}
+
+	if d := lateNodeDeadline(config, start, start.Add(time.Minute)); !d.Equal(start.Add(90 * time.Second)) {
+		t.Errorf("expected the late node budget to bound the deadline, got %v", d)
+	}
+	if d := lateNodeDeadline(config, start, start.Add(170*time.Second)); !d.Equal(start.Add(180 * time.Second)) {
+		t.Errorf("expected the poll interval to bound the deadline, got %v", d)
+	}
+}
+
+func TestCollectLateNodes(t *testing.T) {
+	release := make(chan struct{})
+	var requests int32
+	var knownRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/nodes/"), "/")
+		switch name {
+		case "node0":
+			atomic.AddInt32(&knownRequests, 1)
+		case "slowNode":
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"node":{"nodeName":%q}}`, name)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	dir, err := os.MkdirTemp("", "TestCollectLateNodes")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	readyNode := func(name string) v1.Node {
+		return v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       v1.NodeSpec{ProviderID: "aws:///" + name},
+		}
+	}
+	ns := testNodeSource{Nodes: []v1.Node{readyNode("node0"), readyNode("node1"), readyNode("slowNode")}}
+	config := KubeAgentConfig{
+		ClusterHostURL:    ts.URL,
+		ForceKubeProxy:    true,
+		ConcurrentPollers: 2,
+		ScratchDir:        dir,
+		LateNodeBudget:    1,
+	}
+	nodes := NodeConnection{
+		InClusterClient: raw.NewClient(http.Client{}, true, nil, 0, false),
+		NodeMetrics:     NewEndpointMask(),
+	}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+
+	t.Run("Ensure nodes added after the node list are collected until the deadline", func(t *testing.T) {
+		start := time.Now()
+		late, failed := collectLateNodes(context.TODO(), config, pollCycle{}, nodes, workDir, ns,
+			map[string]bool{"node0": true}, time.Now().Add(500*time.Millisecond))
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected late node collection to stop at the deadline, took %v", elapsed)
+		}
+
+		if len(late) != 1 || late[0] != "node1" {
+			t.Errorf("expected node1 to be collected late, got %v", late)
+		}
+		if len(failed) != 1 || failed["slowNode"] != errLateNodeBudget {
+			t.Errorf("expected slowNode to fail the late node budget, got %v", failed)
+		}
+		if atomic.LoadInt32(&knownRequests) != 0 {
+			t.Error("expected known nodes not to be collected again")
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, e.Name())
+			}
+		}
+		expected := sample.NodeSourceName(sample.StatsPrefix, sample.SummarySource, "node1") + ".json"
+		if len(files) != 1 || files[0] != expected {
+			t.Errorf("expected only %s in the sample, got %v", expected, files)
+		}
+		if _, err := os.Stat(filepath.Join(dir, expected)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Ensure nothing is collected once the deadline has passed", func(t *testing.T) {
+		before := atomic.LoadInt32(&requests)
+		late, failed := collectLateNodes(context.TODO(), config, pollCycle{}, nodes, workDir, ns, map[string]bool{},
+			time.Now().Add(-time.Second))
+		if len(late) != 0 || len(failed) != 0 || atomic.LoadInt32(&requests) != before {
+			t.Errorf("expected no late node collection, got %v %v", late, failed)
+		}
+	})
+}
+
+func TestCollectedNodes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestCollectedNodes")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"stats-summary-node0.json", "pods.jsonl", "baseline-summary-node2.json"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	known, err := collectedNodes(dir, map[string]error{"node1": fmt.Errorf("unreachable")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(known) != 2 || !known["node0"] || !known["node1"] {
+		t.Errorf("unexpected collected nodes %v", known)
+	}
+}
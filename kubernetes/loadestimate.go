@@ -0,0 +1,161 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultLoadEstimateChangePercent is the default change (in percent) in the number of nodes after which
+// the load a poll puts on the cluster is estimated again
+const DefaultLoadEstimateChangePercent = 20
+
+// loadEstimateSampleNodes is the number of nodes whose collected data is extrapolated to every node
+const loadEstimateSampleNodes = 3
+
+// pollLoadEstimate is the expected load of a poll on the cluster, so operators of a shared API server know
+// what the agent will cost before it is enabled everywhere
+type pollLoadEstimate struct {
+	Nodes int `json:"nodes"`
+	// Endpoints is the number of endpoints fetched from each node
+	Endpoints int `json:"endpoints"`
+	// DirectRequests are made to the kubelets without passing through the API server
+	DirectRequests int `json:"directRequests"`
+	// APIServerRequests are the node list and every node request proxied through the API server
+	APIServerRequests int `json:"apiServerRequests"`
+	ProxyRequests     int `json:"proxyRequests"`
+	// PayloadBytes is the node data collected, extrapolated from the data of SampledNodes nodes
+	PayloadBytes int64 `json:"payloadBytes"`
+	SampledNodes int   `json:"sampledNodes"`
+}
+
+func (e pollLoadEstimate) String() string {
+	return fmt.Sprintf("%d nodes, %d endpoints per node, %d direct kubelet requests, %d API server requests "+
+		"(%d proxied node requests), ~%d bytes of node data extrapolated from %d nodes", e.Nodes, e.Endpoints,
+		e.DirectRequests, e.APIServerRequests, e.ProxyRequests, e.PayloadBytes, e.SampledNodes)
+}
+
+// estimatePollLoad estimates the load of a poll of nodeCount nodes from the connection to each endpoint
+// found by the probe and the size of the data collected from a few of the nodes
+func estimatePollLoad(nodes NodeConnection, nodeCount int, sizes map[nodeSourceKey]int64) pollLoadEstimate {
+	e := pollLoadEstimate{Nodes: nodeCount}
+	var direct, proxied int
+	for _, endpoint := range nodes.NodeMetrics.Endpoints() {
+		switch {
+		case nodes.NodeMetrics.Unreachable(endpoint):
+			continue
+		case nodes.NodeMetrics.DirectAllowed(endpoint):
+			direct++
+		default:
+			proxied++
+		}
+	}
+	e.Endpoints = direct + proxied
+	e.DirectRequests = direct * nodeCount
+	e.ProxyRequests = proxied * nodeCount
+	// the ready nodes are listed once each poll
+	e.APIServerRequests = e.ProxyRequests + 1
+
+	perNode := map[string]int64{}
+	for key, size := range sizes {
+		perNode[key.node] += size
+	}
+	names := make([]string, 0, len(perNode))
+	for name := range perNode {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > loadEstimateSampleNodes {
+		names = names[:loadEstimateSampleNodes]
+	}
+	var sampled int64
+	for _, name := range names {
+		sampled += perNode[name]
+	}
+	e.SampledNodes = len(names)
+	if e.SampledNodes > 0 {
+		e.PayloadBytes = sampled / int64(e.SampledNodes) * int64(nodeCount)
+	}
+	return e
+}
+
+// exceedsChange returns true if the number of nodes differs from that of the estimate by more than
+// percent, a percent of 0 or less never re-estimates
+func (e pollLoadEstimate) exceedsChange(nodeCount, percent int) bool {
+	if percent <= 0 {
+		return false
+	}
+	diff := nodeCount - e.Nodes
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff*100 > percent*e.Nodes
+}
+
+// logStartupLoadEstimate estimates the load of a poll from the baselines collected at startup, logging
+// it and recording it in the diagnostics file
+func logStartupLoadEstimate(config KubeAgentConfig, state *AgentState) {
+	exportDir := path.Dir(config.msExportDirectory.Name())
+	sizes, err := prefixedNodeDataSizes(exportDir, sample.BaselinePrefix)
+	if err != nil {
+		log.Warnf("Warning: unable to determine node data sizes for the poll load estimate: %s", err)
+	}
+	nodeCount := len(config.selectNodes(informerNodes(config.Informers)))
+	e := estimatePollLoad(state.Nodes(), nodeCount, sizes)
+	state.recordLoadEstimate(e)
+
+	log.Infof("Estimated load of each poll: %s", e)
+	if e.ProxyRequests > 0 {
+		log.Warnf("Each poll will make %d requests through the API server, %d of them proxied to the nodes",
+			e.APIServerRequests, e.ProxyRequests)
+	}
+	if err := writeLoadEstimate(config.msExportDirectory, e); err != nil {
+		log.Warnf("Warning: unable to write the poll load estimate to the diagnostics file: %s", err)
+	}
+}
+
+// reestimatePollLoad estimates the load of a poll again from the node data sizes of the collection, once
+// the number of nodes changed by more than the configured percent since the last estimate. Returns the
+// current estimate.
+func reestimatePollLoad(config KubeAgentConfig, state *AgentState, history nodeSizeHistory) pollLoadEstimate {
+	nodeCount := len(config.selectNodes(informerNodes(config.Informers)))
+	previous := state.LoadEstimate()
+	if !previous.exceedsChange(nodeCount, config.LoadEstimateChangePercent) {
+		return previous
+	}
+	e := estimatePollLoad(state.Nodes(), nodeCount, history.latest())
+	state.recordLoadEstimate(e)
+
+	log.Infof("Node count changed from %d to %d, estimated load of each poll: %s (%+d API server requests, "+
+		"%+d bytes of node data)", previous.Nodes, e.Nodes, e, e.APIServerRequests-previous.APIServerRequests,
+		e.PayloadBytes-previous.PayloadBytes)
+	if err := writeLoadEstimate(config.msExportDirectory, e); err != nil {
+		log.Warnf("Warning: unable to write the poll load estimate to the diagnostics file: %s", err)
+	}
+	return e
+}
+
+// writeLoadEstimate appends the estimate to the diagnostics file in the export directory, which is
+// included in the next upload
+func writeLoadEstimate(exportDir *os.File, e pollLoadEstimate) (rerr error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(exportDir.Name(), sample.DiagnosticsFile),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer util.SafeClose(f.Close, &rerr)
+
+	_, err = fmt.Fprintf(f, "Estimated poll load: %s\n", data)
+	return err
+}
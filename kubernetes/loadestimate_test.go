@@ -0,0 +1,94 @@
+package kubernetes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/sample"
+)
+
+func TestEstimatePollLoad(t *testing.T) {
+	nodes := NodeConnection{NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	nodes.NodeMetrics.SetAvailability("/metrics/probes", Proxy, true)
+	nodes.NodeMetrics.SetUnreachable("/metrics/resource")
+
+	// only the first three nodes by name are extrapolated
+	sizes := map[nodeSourceKey]int64{
+		{source: sample.SummarySource, node: "node0"}: 100,
+		{source: "probes", node: "node0"}:             20,
+		{source: sample.SummarySource, node: "node1"}: 300,
+		{source: sample.SummarySource, node: "node2"}: 200,
+		{source: sample.SummarySource, node: "node3"}: 10000,
+	}
+	e := estimatePollLoad(nodes, 10, sizes)
+	expected := pollLoadEstimate{
+		Nodes:             10,
+		Endpoints:         2,
+		DirectRequests:    10,
+		ProxyRequests:     10,
+		APIServerRequests: 11,
+		PayloadBytes:      2060,
+		SampledNodes:      3,
+	}
+	if e != expected {
+		t.Errorf("expected %+v, got %+v", expected, e)
+	}
+
+	if e := estimatePollLoad(nodes, 10, nil); e.PayloadBytes != 0 || e.SampledNodes != 0 {
+		t.Errorf("expected no payload estimate without node data, got %+v", e)
+	}
+}
+
+func TestLoadEstimateExceedsChange(t *testing.T) {
+	e := pollLoadEstimate{Nodes: 10}
+	tests := []struct {
+		nodes   int
+		percent int
+		changed bool
+	}{
+		{nodes: 12, percent: 20, changed: false},
+		{nodes: 13, percent: 20, changed: true},
+		{nodes: 7, percent: 20, changed: true},
+		{nodes: 100, percent: 0, changed: false},
+	}
+	for _, tc := range tests {
+		if changed := e.exceedsChange(tc.nodes, tc.percent); changed != tc.changed {
+			t.Errorf("expected a change from 10 to %d nodes with %d%% to be %v", tc.nodes, tc.percent, tc.changed)
+		}
+	}
+	if !(pollLoadEstimate{}).exceedsChange(1, 20) {
+		t.Error("expected nodes joining an empty cluster to be a change")
+	}
+}
+
+func TestWriteLoadEstimate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestWriteLoadEstimate")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	exportDir, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exportDir.Close()
+
+	writeSampleFiles(t, dir, map[string]string{sample.DiagnosticsFile: "Agent Diagnostics\n"})
+	for _, nodes := range []int{10, 20} {
+		if err := writeLoadEstimate(exportDir, pollLoadEstimate{Nodes: nodes}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, sample.DiagnosticsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || lines[0] != "Agent Diagnostics" || !strings.Contains(lines[2], `"nodes":20`) {
+		t.Errorf("expected each estimate to be appended to the diagnostics file, got %q", data)
+	}
+}
@@ -0,0 +1,134 @@
+package kubernetes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	k8s_stats "github.com/cloudability/metrics-agent/retrieval/k8s"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	statsapi "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+)
+
+// parseCollectionProfile returns the collection profile, the full profile if none is configured
+func parseCollectionProfile(profile string) (string, error) {
+	switch profile {
+	case "", sample.ProfileFull:
+		return sample.ProfileFull, nil
+	case sample.ProfileNamespace:
+		return profile, nil
+	}
+	return "", fmt.Errorf("unknown collection profile %q, must be %s or %s", profile, sample.ProfileFull,
+		sample.ProfileNamespace)
+}
+
+// namespaceRollup returns true if the pod stats of node summaries are rolled up to namespace totals
+func (ka KubeAgentConfig) namespaceRollup() bool {
+	return ka.CollectionProfile == sample.ProfileNamespace
+}
+
+// rolledUpSummary is the part of a kubelet summary read to roll it up, the node stats are kept as received
+type rolledUpSummary struct {
+	Node json.RawMessage     `json:"node"`
+	Pods []statsapi.PodStats `json:"pods"`
+}
+
+// rollupSummary returns the summary with its pods replaced by the total usage of each namespace
+func rollupSummary(r io.Reader) (sample.NamespaceSummary, error) {
+	var summary rolledUpSummary
+	if err := json.NewDecoder(r).Decode(&summary); err != nil {
+		return sample.NamespaceSummary{}, fmt.Errorf("unable to decode node summary: %v", err)
+	}
+	usage := map[string]*sample.NamespaceUsage{}
+	for _, p := range summary.Pods {
+		u, ok := usage[p.PodRef.Namespace]
+		if !ok {
+			u = &sample.NamespaceUsage{Namespace: p.PodRef.Namespace}
+			usage[p.PodRef.Namespace] = u
+		}
+		u.Pods++
+		if p.CPU != nil {
+			u.CPUUsageNanoCores += valueOf(p.CPU.UsageNanoCores)
+			u.CPUUsageCoreNanoSeconds += valueOf(p.CPU.UsageCoreNanoSeconds)
+		}
+		if p.Memory != nil {
+			u.MemoryWorkingSetBytes += valueOf(p.Memory.WorkingSetBytes)
+		}
+		if p.EphemeralStorage != nil {
+			u.EphemeralStorageUsedBytes += valueOf(p.EphemeralStorage.UsedBytes)
+		}
+	}
+
+	rollup := sample.NamespaceSummary{Node: summary.Node, Namespaces: make([]sample.NamespaceUsage, 0, len(usage))}
+	for _, u := range usage {
+		rollup.Namespaces = append(rollup.Namespaces, *u)
+	}
+	sort.Slice(rollup.Namespaces, func(i, j int) bool {
+		return rollup.Namespaces[i].Namespace < rollup.Namespaces[j].Namespace
+	})
+	return rollup, nil
+}
+
+func valueOf(v *uint64) uint64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// rollupSummaryFile replaces the node summary in the file with its namespace rollup, so pod level detail
+// is never kept on disk past the fetch, and returns the hash of the rollup. The summary is a per sample
+// scratch file so it is replaced without syncing.
+func rollupSummaryFile(filename string) (string, error) {
+	f, err := os.Open(filepath.Clean(filename))
+	if err != nil {
+		return "", err
+	}
+	rollup, err := rollupSummary(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	err = util.ReplaceFile(filename, 0644, func(w io.Writer) error {
+		return json.NewEncoder(io.MultiWriter(w, h)).Encode(rollup)
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to write namespace rollup: %v", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// removeSummaryWithPods removes a summary that could not be rolled up, so its pod level detail is not
+// exported, returning the error that caused it
+func removeSummaryWithPods(filename string, err error) error {
+	if rmErr := os.Remove(filename); rmErr != nil && !os.IsNotExist(rmErr) {
+		return fmt.Errorf("%v, unable to remove summary: %v", err, rmErr)
+	}
+	return err
+}
+
+// removePodDetail removes the resource exports holding pod level detail from the sample directory, counting
+// the records removed in redactions
+func removePodDetail(msd string, redactions *k8s_stats.Redactions) error {
+	pods := filepath.Join(msd, sample.ResourceFile("pods"))
+	removed, err := countRecords(pods)
+	if err != nil {
+		return err
+	}
+	redactions.Add(redactPodDetail, removed)
+	err = os.Remove(pods)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const podSummary = `{"node":{"nodeName":"node0","cpu":{"usageNanoCores":900}},"pods":[
+{"podRef":{"name":"a","namespace":"team-a"},"cpu":{"usageNanoCores":100,"usageCoreNanoSeconds":1000},
+ "memory":{"workingSetBytes":10},"ephemeral-storage":{"usedBytes":5},"containers":[{"name":"c"}]},
+{"podRef":{"name":"b","namespace":"team-a"},"cpu":{"usageNanoCores":200},"memory":{"workingSetBytes":20}},
+{"podRef":{"name":"c","namespace":"kube-system"}}]}`
+
+func TestRollupSummary(t *testing.T) {
+	rollup, err := rollupSummary(strings.NewReader(podSummary))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []sample.NamespaceUsage{
+		{Namespace: "kube-system", Pods: 1},
+		{Namespace: "team-a", Pods: 2, CPUUsageNanoCores: 300, CPUUsageCoreNanoSeconds: 1000,
+			MemoryWorkingSetBytes: 30, EphemeralStorageUsedBytes: 5},
+	}
+	if fmt.Sprint(rollup.Namespaces) != fmt.Sprint(expected) {
+		t.Errorf("expected %+v, got %+v", expected, rollup.Namespaces)
+	}
+	if string(rollup.Node) != `{"nodeName":"node0","cpu":{"usageNanoCores":900}}` {
+		t.Errorf("expected the node stats to be kept as received, got %s", rollup.Node)
+	}
+
+	if _, err := rollupSummary(strings.NewReader(`{"pods":`)); err == nil {
+		t.Error("expected a truncated summary to be an error")
+	}
+}
+
+func TestParseCollectionProfile(t *testing.T) {
+	for profile, expected := range map[string]string{
+		"":                      sample.ProfileFull,
+		sample.ProfileFull:      sample.ProfileFull,
+		sample.ProfileNamespace: sample.ProfileNamespace,
+	} {
+		if p, err := parseCollectionProfile(profile); err != nil || p != expected {
+			t.Errorf("expected profile %q to parse as %s, got %s %v", profile, expected, p, err)
+		}
+	}
+	if _, err := parseCollectionProfile("pod"); err == nil {
+		t.Error("expected an unknown profile to be rejected")
+	}
+}
+
+func TestRetrieveNodeDataNamespaceProfile(t *testing.T) {
+	var extraRequests int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/healthz") {
+			extraRequests++
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, podSummary)
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestRetrieveNodeDataNamespaceProfile")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 0, false)
+	nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+	nodes.NodeMetrics.SetAvailability("/healthz", Direct, true)
+
+	host, port, _ := strings.Cut(ts.Listener.Addr().String(), ":")
+	n := addressedNode("node0", host)
+	p, _ := strconv.Atoi(port)
+	n.Status.DaemonEndpoints.KubeletEndpoint.Port = int32(p)
+	extra, err := ParseExtraEndpoints(`[{"name":"healthz","path":"/healthz"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, CollectionProfile: sample.ProfileNamespace,
+		extraEndpoints: extra}
+	hashes := newNodeDataHashes()
+	nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir, hashes: hashes}
+
+	err = retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes,
+		NewClientsetNodeSource(fake.NewSimpleClientset()), n)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Run("Ensure the summary is replaced by its namespace rollup", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join(dir, "stats-summary-node0.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rollup sample.NamespaceSummary
+		if err := json.Unmarshal(data, &rollup); err != nil {
+			t.Fatal(err)
+		}
+		if len(rollup.Namespaces) != 2 || strings.Contains(string(data), "podRef") {
+			t.Errorf("expected only namespace totals, got %s", data)
+		}
+		if hashes.all()["stats-summary-node0.json"] == "" {
+			t.Error("expected the rollup to be hashed")
+		}
+	})
+
+	t.Run("Ensure extra endpoints are not collected", func(t *testing.T) {
+		if extraRequests != 0 {
+			t.Errorf("expected no extra endpoint requests, got %d", extraRequests)
+		}
+	})
+}
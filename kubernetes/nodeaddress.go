@@ -0,0 +1,192 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// defaultNodeAddressTypes is the order the address types of a node are tried in unless configured, some
+// bare-metal and edge clusters publish only hostname or external addresses
+var defaultNodeAddressTypes = []v1.NodeAddressType{v1.NodeInternalIP, v1.NodeHostName, v1.NodeExternalIP}
+
+// acceptedNodeAddressTypes are the node address types that may be configured
+var acceptedNodeAddressTypes = []v1.NodeAddressType{v1.NodeInternalIP, v1.NodeExternalIP, v1.NodeHostName,
+	v1.NodeInternalDNS, v1.NodeExternalDNS}
+
+// DefaultKubeletPort is the port the kubelet serves on unless configured otherwise, it is used for nodes that
+// report no kubelet port
+const DefaultKubeletPort int32 = 10250
+
+// kubeletPort returns the port to connect to the kubelet of a node on: the override if set, otherwise the
+// port the node reports, or the default kubelet port if the node reports none. Nodes reporting no port are
+// warned about once, recorded in warned.
+func kubeletPort(node *v1.Node, override int32, warned *sync.Map) int32 {
+	if override > 0 {
+		return override
+	}
+	port := node.Status.DaemonEndpoints.KubeletEndpoint.Port
+	if port != 0 {
+		return port
+	}
+	if _, loaded := warned.LoadOrStore(node.Name, true); !loaded {
+		log.Warnf("Node %s reports kubelet port 0, using port %d. Set CLOUDABILITY_KUBELET_PORT_OVERRIDE if "+
+			"the kubelet serves on another port", node.Name, DefaultKubeletPort)
+	}
+	return DefaultKubeletPort
+}
+
+// withoutZeroPortNodes returns the nodes reporting a kubelet port, so the connection probe is decided by them
+// rather than by a kubelet that may not serve on the default port. All nodes are returned when the port is
+// overridden or no node reports one.
+func withoutZeroPortNodes(nodes []v1.Node, override int32) []v1.Node {
+	if override > 0 {
+		return nodes
+	}
+	var reporting []v1.Node
+	var skipped []string
+	for _, n := range nodes {
+		if n.Status.DaemonEndpoints.KubeletEndpoint.Port == 0 {
+			skipped = append(skipped, n.Name)
+			continue
+		}
+		reporting = append(reporting, n)
+	}
+	if len(skipped) == 0 || len(reporting) == 0 {
+		return nodes
+	}
+	log.Warnf("Nodes [%s] report kubelet port 0 and are left out of the connection probe, they are collected "+
+		"on port %d", strings.Join(skipped, ", "), DefaultKubeletPort)
+	return reporting
+}
+
+// parseNodeAddressTypes returns the comma separated node address types in order, or nil for the default
+// order if none are listed
+func parseNodeAddressTypes(types string) ([]v1.NodeAddressType, error) {
+	var parsed []v1.NodeAddressType
+	seen := make(map[v1.NodeAddressType]bool)
+	for _, t := range strings.Split(types, ",") {
+		addrType := v1.NodeAddressType(strings.TrimSpace(t))
+		if addrType == "" {
+			continue
+		}
+		accepted := false
+		for _, a := range acceptedNodeAddressTypes {
+			accepted = accepted || addrType == a
+		}
+		if !accepted {
+			return nil, fmt.Errorf("unknown node address type %q, expected one of %s", addrType,
+				joinAddressTypes(acceptedNodeAddressTypes, ", "))
+		}
+		if seen[addrType] {
+			return nil, fmt.Errorf("node address type %q is listed more than once", addrType)
+		}
+		seen[addrType] = true
+		parsed = append(parsed, addrType)
+	}
+	return parsed, nil
+}
+
+// joinAddressTypes joins the address types with the separator
+func joinAddressTypes(types []v1.NodeAddressType, sep string) string {
+	names := make([]string, 0, len(types))
+	for _, t := range types {
+		names = append(names, string(t))
+	}
+	return strings.Join(names, sep)
+}
+
+// sharedAddress is a kubelet address reported by more than one ready node
+type sharedAddress struct {
+	address string
+	// nodes reporting the address, the first is the one collected
+	nodes []v1.Node
+}
+
+// names returns the names of the nodes reporting the address
+func (s sharedAddress) names() []string {
+	names := make([]string, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
+// dedupeNodeAddresses returns the ready nodes with only the first of the nodes reporting each kubelet
+// address, and the addresses that are shared keyed by the name of the node that will be collected. Nodes
+// reporting the same address, as may happen briefly during a subnet migration, would otherwise have the
+// same kubelet collected under each of their names.
+func dedupeNodeAddresses(nodes []v1.Node, ns NodeSource) ([]v1.Node, map[string]sharedAddress) {
+	byAddress := make(map[string]*sharedAddress)
+	unique := make([]v1.Node, 0, len(nodes))
+	for i := range nodes {
+		ip, port, _, err := ns.NodeAddress(&nodes[i])
+		if err != nil || ip == "" {
+			// nodes without an address can only be collected via proxy, by name
+			unique = append(unique, nodes[i])
+			continue
+		}
+		address := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+		if s, ok := byAddress[address]; ok {
+			s.nodes = append(s.nodes, nodes[i])
+			continue
+		}
+		byAddress[address] = &sharedAddress{address: address, nodes: []v1.Node{nodes[i]}}
+		unique = append(unique, nodes[i])
+	}
+
+	shared := make(map[string]sharedAddress)
+	for _, s := range byAddress {
+		if len(s.nodes) > 1 {
+			log.Warnf("Nodes %s report the same kubelet address %s, collecting it once",
+				strings.Join(s.names(), ", "), s.address)
+			shared[s.nodes[0].Name] = *s
+		}
+	}
+	return unique, shared
+}
+
+// collectSharedAddress completes the collection of a shared kubelet address, given the error collecting
+// it as the first of its nodes. When the kubelet answered as another of the nodes sharing the address it
+// is collected as that node. Returns the failures to report for the other nodes sharing the address.
+func collectSharedAddress(s sharedAddress, err error, collect func(n v1.Node) error) map[string]error {
+	failed := make(map[string]error)
+	owner := ""
+	if err == nil {
+		owner = s.nodes[0].Name
+	}
+
+	var identityErr nodeIdentityError
+	if errors.As(err, &identityErr) {
+		for _, n := range s.nodes[1:] {
+			if n.Name != identityErr.answered {
+				continue
+			}
+			if collectErr := collect(n); collectErr != nil {
+				failed[n.Name] = fmt.Errorf("node metrics retrieval problem occurred: %w", collectErr)
+			} else {
+				owner = n.Name
+			}
+		}
+	}
+
+	for _, n := range s.nodes[1:] {
+		if n.Name == owner || failed[n.Name] != nil {
+			continue
+		}
+		if owner != "" {
+			failed[n.Name] = fmt.Errorf("kubelet address %s is also reported by node %s whose kubelet answered, "+
+				"not collected to avoid double counting", s.address, owner)
+		} else {
+			failed[n.Name] = fmt.Errorf("kubelet address %s is shared with nodes %s and could not be collected: %v",
+				s.address, strings.Join(s.names(), ", "), err)
+		}
+	}
+	return failed
+}
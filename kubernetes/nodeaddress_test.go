@@ -0,0 +1,255 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// addressedNode returns a ready node with the given internal IP
+func addressedNode(name, ip string) v1.Node {
+	return v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{ProviderID: "aws:///" + name},
+		Status: v1.NodeStatus{
+			Addresses:       []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+			Conditions:      []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+			DaemonEndpoints: v1.NodeDaemonEndpoints{KubeletEndpoint: v1.DaemonEndpoint{Port: 10250}},
+		},
+	}
+}
+
+func TestNodeAddress(t *testing.T) {
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	node := func(addrs ...v1.NodeAddress) *v1.Node {
+		n := addressedNode("node0", "")
+		n.Status.Addresses = addrs
+		return &n
+	}
+	internal := v1.NodeAddress{Type: v1.NodeInternalIP, Address: "10.0.0.1"}
+	hostname := v1.NodeAddress{Type: v1.NodeHostName, Address: "node0.example.com"}
+	external := v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.1"}
+
+	tests := []struct {
+		name     string
+		node     *v1.Node
+		address  string
+		addrType v1.NodeAddressType
+	}{
+		{name: "internal ip preferred", node: node(external, hostname, internal), address: "10.0.0.1",
+			addrType: v1.NodeInternalIP},
+		{name: "hostname before external ip", node: node(external, hostname), address: "node0.example.com",
+			addrType: v1.NodeHostName},
+		{name: "external ip", node: node(external), address: "203.0.113.1", addrType: v1.NodeExternalIP},
+		{name: "empty addresses skipped", node: node(v1.NodeAddress{Type: v1.NodeInternalIP}, external),
+			address: "203.0.113.1", addrType: v1.NodeExternalIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address, port, addrType, err := ns.NodeAddress(tt.node)
+			if err != nil || address != tt.address || port != 10250 || addrType != tt.addrType {
+				t.Errorf("expected %s address %s, got %s %s:%d: %v", tt.addrType, tt.address, addrType, address,
+					port, err)
+			}
+		})
+	}
+
+	if _, _, _, err := ns.NodeAddress(node()); err == nil {
+		t.Error("expected an error for a node without addresses")
+	}
+
+	// nodes reporting no kubelet port are connected to on the default port, unless overridden
+	zeroPort := node(internal)
+	zeroPort.Status.DaemonEndpoints.KubeletEndpoint.Port = 0
+	if address, port, _, err := ns.NodeAddress(zeroPort); err != nil || port != DefaultKubeletPort {
+		t.Errorf("expected the default kubelet port for a node reporting port 0, got %s:%d: %v", address, port,
+			err)
+	}
+	if api := directNodeEndpoints("10.0.0.1", DefaultKubeletPort); api.statsSummary() !=
+		"https://10.0.0.1:10250/stats/summary" {
+		t.Errorf("unexpected summary url %s", api.statsSummary())
+	}
+	ns.kubeletPort = 10255
+	for _, n := range []*v1.Node{zeroPort, node(internal)} {
+		if _, port, _, err := ns.NodeAddress(n); err != nil || port != 10255 {
+			t.Errorf("expected the kubelet port override, got %d: %v", port, err)
+		}
+	}
+	ns.kubeletPort = 0
+
+	ns.addressTypes = []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP}
+	if address, _, addrType, err := ns.NodeAddress(node(internal, hostname, external)); err != nil ||
+		address != "203.0.113.1" || addrType != v1.NodeExternalIP {
+		t.Errorf("expected the configured order to prefer the external IP, got %s %s: %v", addrType, address, err)
+	}
+	if _, _, _, err := ns.NodeAddress(node(hostname)); err == nil {
+		t.Error("expected an error for a node without an address of the configured types")
+	}
+	ns.addressTypes = nil
+
+	// a kubelet connected to by hostname has its serving certificate verified for the hostname
+	names := newNodeServerNames()
+	names.record([]v1.Node{*node(hostname)}, ns)
+	if name := names.lookup("node0.example.com:10250"); name != "node0.example.com" {
+		t.Errorf("expected the hostname to be verified, got %q", name)
+	}
+}
+
+func TestParseNodeAddressTypes(t *testing.T) {
+	types, err := parseNodeAddressTypes(" ExternalIP, InternalIP,Hostname,")
+	if err != nil || joinAddressTypes(types, ",") != "ExternalIP,InternalIP,Hostname" {
+		t.Errorf("expected the types in order, got %v: %v", types, err)
+	}
+	if types, err := parseNodeAddressTypes(""); err != nil || types != nil {
+		t.Errorf("expected the default order, got %v: %v", types, err)
+	}
+	_, err = parseNodeAddressTypes("ExternalIP,PublicIP")
+	if err == nil || !strings.Contains(err.Error(), `"PublicIP"`) || !strings.Contains(err.Error(), "InternalDNS") {
+		t.Errorf("expected the unknown type and accepted types in the error, got %v", err)
+	}
+	if _, err := parseNodeAddressTypes("InternalIP,InternalIP"); err == nil {
+		t.Error("expected an error for a repeated type")
+	}
+}
+
+func TestDedupeNodeAddresses(t *testing.T) {
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	nodes := []v1.Node{
+		addressedNode("node0", "10.0.0.1"),
+		addressedNode("node1", "10.0.0.2"),
+		addressedNode("node2", "10.0.0.1"),
+		{ObjectMeta: metav1.ObjectMeta{Name: "node3"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node4"}},
+	}
+
+	unique, shared := dedupeNodeAddresses(nodes, ns)
+	var names []string
+	for _, n := range unique {
+		names = append(names, n.Name)
+	}
+	if strings.Join(names, ",") != "node0,node1,node3,node4" {
+		t.Errorf("unexpected unique nodes %v", names)
+	}
+	s, ok := shared["node0"]
+	if len(shared) != 1 || !ok || s.address != "10.0.0.1:10250" || strings.Join(s.names(), ",") != "node0,node2" {
+		t.Errorf("unexpected shared addresses %+v", shared)
+	}
+}
+
+func TestCollectSharedAddress(t *testing.T) {
+	s := sharedAddress{
+		address: "10.0.0.1:10250",
+		nodes:   []v1.Node{addressedNode("node0", "10.0.0.1"), addressedNode("node1", "10.0.0.1")},
+	}
+	var collected []string
+	collect := func(err error) func(n v1.Node) error {
+		return func(n v1.Node) error {
+			collected = append(collected, n.Name)
+			return err
+		}
+	}
+
+	t.Run("Ensure the other node is flagged when the collected node answered", func(t *testing.T) {
+		collected = nil
+		failed := collectSharedAddress(s, nil, collect(nil))
+		if _, ok := failed["node1"]; !ok || len(failed) != 1 || len(collected) != 0 {
+			t.Errorf("expected node1 to be flagged without collection, got %v %v", failed, collected)
+		}
+	})
+
+	t.Run("Ensure the node that answered is collected", func(t *testing.T) {
+		collected = nil
+		err := nodeIdentityError{requested: "node0", answered: "node1"}
+		failed := collectSharedAddress(s, err, collect(nil))
+		if len(failed) != 0 || len(collected) != 1 || collected[0] != "node1" {
+			t.Errorf("expected node1 to be collected, got %v %v", failed, collected)
+		}
+	})
+
+	t.Run("Ensure a failure collecting the node that answered is reported", func(t *testing.T) {
+		collected = nil
+		err := nodeIdentityError{requested: "node0", answered: "node1"}
+		failed := collectSharedAddress(s, err, collect(errors.New("unable to connect")))
+		if e, ok := failed["node1"]; !ok || !strings.Contains(e.Error(), "unable to connect") {
+			t.Errorf("expected node1 collection failure, got %v", failed)
+		}
+	})
+
+	t.Run("Ensure nodes are flagged when the kubelet answered as an unknown node", func(t *testing.T) {
+		collected = nil
+		err := nodeIdentityError{requested: "node0", answered: "node9"}
+		failed := collectSharedAddress(s, err, collect(nil))
+		if _, ok := failed["node1"]; !ok || len(failed) != 1 || len(collected) != 0 {
+			t.Errorf("expected node1 to be flagged without collection, got %v %v", failed, collected)
+		}
+	})
+}
+
+func TestDownloadNodeDataSharedAddress(t *testing.T) {
+	var requests int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"node":{"nodeName":"node1"}}`))
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestDownloadNodeDataSharedAddress")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	config := KubeAgentConfig{
+		ClusterHostURL:    ts.URL,
+		ForceKubeProxy:    true,
+		ConcurrentPollers: 2,
+	}
+	nodes := NodeConnection{
+		InClusterClient: raw.NewClient(c, true, nil, 0, false),
+		NodeMetrics:     NewEndpointMask(),
+	}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	n0, n1 := addressedNode("node0", "10.0.0.1"), addressedNode("node1", "10.0.0.1")
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset(&n0, &n1))
+
+	failedNodeList, err := downloadNodeData(context.TODO(), sample.StatsPrefix, config, pollCycle{}, nodes, workDir,
+		ns, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// node0 is requested first and discarded as the kubelet answers as node1, which is then collected
+	if requests != 2 {
+		t.Errorf("expected the shared kubelet to be requested as each node once, got %d requests", requests)
+	}
+	var identityErr nodeIdentityError
+	if err := failedNodeList["node0"]; !errors.As(err, &identityErr) || len(failedNodeList) != 1 {
+		t.Errorf("expected only node0 to be flagged with an identity mismatch, got %v", failedNodeList)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stats-summary-node1.json")); err != nil {
+		t.Errorf("expected the summary to be attributed to node1: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stats-summary-node0.json")); err == nil {
+		t.Error("expected no summary attributed to node0")
+	}
+}
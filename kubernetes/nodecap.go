@@ -0,0 +1,57 @@
+package kubernetes
+
+import (
+	"sort"
+
+	"github.com/cloudability/metrics-agent/sample"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// capNodes returns the nodes collected by the collection with the given index since startup and the names of
+// the nodes deferred to a later collection, when more nodes are listed than the limit. The nodes are ordered
+// by name and each collection takes the window of limit nodes following that of the previous collection, so
+// successive collections cover every node. A limit of 0 collects every node.
+func capNodes(nodes []v1.Node, limit, collection int) ([]v1.Node, []string) {
+	if limit <= 0 || len(nodes) <= limit {
+		return nodes, nil
+	}
+	sorted := make([]v1.Node, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	start := (collection % len(sorted)) * limit % len(sorted)
+	collected := make([]v1.Node, 0, limit)
+	deferred := make([]string, 0, len(sorted)-limit)
+	for i := range sorted {
+		// the offset of the node from the start of the window, wrapping around the end of the list
+		offset := (i - start + len(sorted)) % len(sorted)
+		if offset < limit {
+			collected = append(collected, sorted[i])
+		} else {
+			deferred = append(deferred, sorted[i].Name)
+		}
+	}
+	return collected, deferred
+}
+
+// logDeferredNodes logs how many of the listed nodes were collected when the node cap deferred some of them
+func logDeferredNodes(config KubeAgentConfig, skipped map[string]string) {
+	deferred := countDeferredNodes(skipped)
+	if deferred == 0 {
+		return
+	}
+	log.Infof("Collected %d of %d nodes (cap=%d), %d nodes are deferred to later collections",
+		config.MaxNodesPerCycle, config.MaxNodesPerCycle+deferred, config.MaxNodesPerCycle, deferred)
+}
+
+// countDeferredNodes returns the number of skipped nodes that were deferred by the node cap
+func countDeferredNodes(skipped map[string]string) int {
+	count := 0
+	for _, reason := range skipped {
+		if reason == sample.SkipNodeCap {
+			count++
+		}
+	}
+	return count
+}
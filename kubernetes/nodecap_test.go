@@ -0,0 +1,112 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+)
+
+func cappedNodes(n int) []v1.Node {
+	var nodes []v1.Node
+	// listed out of order, the selection must not depend on the order of the node list
+	for i := n - 1; i >= 0; i-- {
+		nodes = append(nodes, addressedNode(fmt.Sprintf("node%d", i), fmt.Sprintf("10.0.0.%d", i)))
+	}
+	return nodes
+}
+
+func nodeNames(nodes []v1.Node) string {
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestCapNodes(t *testing.T) {
+	nodes := cappedNodes(5)
+
+	t.Run("Ensure every node is collected without a cap or below it", func(t *testing.T) {
+		for _, limit := range []int{0, 5, 6} {
+			collected, deferred := capNodes(nodes, limit, 3)
+			if len(collected) != 5 || deferred != nil {
+				t.Errorf("limit %d: expected every node, got %v deferred %v", limit, nodeNames(collected), deferred)
+			}
+		}
+	})
+
+	t.Run("Ensure successive collections take successive windows of nodes", func(t *testing.T) {
+		expected := []string{
+			"node0,node1",
+			"node2,node3",
+			"node0,node4",
+			"node1,node2",
+		}
+		for collection, want := range expected {
+			collected, deferred := capNodes(nodes, 2, collection)
+			if got := nodeNames(collected); got != want || len(deferred) != 3 {
+				t.Errorf("collection %d: expected %s, got %s deferred %v", collection, want, got, deferred)
+			}
+		}
+		if collected, _ := capNodes(nodes, 2, 0); nodeNames(collected) != "node0,node1" {
+			t.Errorf("expected the selection to be deterministic, got %s", nodeNames(collected))
+		}
+	})
+}
+
+func TestDownloadNodeDataNodeCap(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	var mu sync.Mutex
+	requested := map[string]bool{}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/nodes/"), "/")[0]
+		mu.Lock()
+		requested[node] = true
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"node":{"nodeName":"` + node + `"}}`))
+	}))
+	defer ts.Close()
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	nodes := NodeConnection{InClusterClient: raw.NewClient(c, true, nil, 0, false), NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, ConcurrentPollers: 2, ForceKubeProxy: true, Dev: true,
+		MaxNodesPerCycle: 2}
+	health := newNodeHealthSnapshot()
+
+	failed, err := downloadNodeData(context.TODO(), sample.StatsPrefix, config, pollCycle{collection: 1}, nodes,
+		util.NewWorkDir(t.TempDir()), testNodeSource{Nodes: cappedNodes(5)}, nil, nil, health)
+	if err != nil || len(failed) != 0 {
+		t.Fatalf("unexpected failure: %v %v", failed, err)
+	}
+	if len(requested) != 2 || !requested["node2"] || !requested["node3"] {
+		t.Errorf("expected only the nodes of the second window to be collected, requested %v", requested)
+	}
+	skipped := health.skippedNodes()
+	if countDeferredNodes(skipped) != 3 || skipped["node0"] != sample.SkipNodeCap {
+		t.Errorf("expected the other nodes to be recorded as deferred, got %v", skipped)
+	}
+
+	logDeferredNodes(config, skipped)
+	if e := hook.LastEntry(); e == nil || !strings.Contains(e.Message, "Collected 2 of 5 nodes (cap=2)") {
+		t.Errorf("expected the collected nodes to be logged against the cap, got %v", e)
+	}
+}
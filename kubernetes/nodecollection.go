@@ -2,17 +2,24 @@ package kubernetes
 
 import (
 	"context"
-	"crypto/tls"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
 	"github.com/cloudability/metrics-agent/util"
 	log "github.com/sirupsen/logrus"
 
@@ -20,6 +27,7 @@ import (
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/client-go/util/retry"
 )
 
@@ -33,15 +41,72 @@ const (
 	FatalNodeError = nodeError("unable to retrieve required metrics from any node via direct or proxy connection")
 )
 
+// DefaultResponseStallTimeout is the default time (in seconds) a kubelet response may receive no bytes
+// mid-body before it is abandoned, stall detection is disabled by default
+const DefaultResponseStallTimeout = 0
+
+// DefaultNodeFetchTimeout is the default time (in seconds) allowed to fetch every endpoint of a node,
+// whichever connection and however many retries are needed
+const DefaultNodeFetchTimeout = 45
+
+// DefaultNodeSpecInterval is the default number of collections between retrievals of the node machine specs
+const DefaultNodeSpecInterval = 1
+
+// DefaultKubeletPodsMaxBytes is the default limit on the size of the kubelet pods response of each node,
+// dense nodes can serve 5-10MB
+const DefaultKubeletPodsMaxBytes int64 = 32 * 1024 * 1024
+
+// DefaultNodeListPageSize is the default number of nodes listed by each request to the API server, so the
+// nodes of a large cluster are not listed by a single huge response
+const DefaultNodeListPageSize = 500
+
+// errNodeFetchTimeout is returned when the endpoints of a node are not fetched within the node fetch
+// timeout, so a slow kubelet does not hold a collection slot for long
+var errNodeFetchTimeout = errors.New("node fetch timed out")
+
 // NodeSource is an interface to get a list of Nodes
 type NodeSource interface {
 	GetReadyNodes(ctx context.Context) ([]v1.Node, error)
-	NodeAddress(node *v1.Node) (string, int32, error)
+	// NodeAddress returns the address and kubelet port of a node, and the type of the address
+	NodeAddress(node *v1.Node) (string, int32, v1.NodeAddressType, error)
+}
+
+// ReadyNodeStatsSource is implemented by the node sources that count the listed nodes by their readiness
+type ReadyNodeStatsSource interface {
+	GetReadyNodesWithStats(ctx context.Context) ([]v1.Node, sample.NodeReadiness, error)
+}
+
+// getReadyNodesWithStats returns the ready nodes of the node source and the readiness of the nodes listed.
+// A node source that does not count them only reports its ready nodes.
+func getReadyNodesWithStats(ctx context.Context, ns NodeSource) ([]v1.Node, sample.NodeReadiness, error) {
+	if s, ok := ns.(ReadyNodeStatsSource); ok {
+		return s.GetReadyNodesWithStats(ctx)
+	}
+	nodes, err := ns.GetReadyNodes(ctx)
+	return nodes, sample.NodeReadiness{Total: len(nodes), Ready: len(nodes)}, err
 }
 
 // ClientsetNodeSource implements NodeSource interface
 type ClientsetNodeSource struct {
 	clientSet kubernetes.Interface
+	// allowed restricts the nodes returned, eg: to the canary nodes of a second agent
+	allowed nodeNameFilter
+	// labelSelector restricts the nodes listed to those matching it, every node if empty
+	labelSelector string
+	// pageSize is the number of nodes listed by each request, 0 lists every node with a single request
+	pageSize int64
+	// skipUnschedulable leaves the cordoned nodes out of the ready nodes
+	skipUnschedulable bool
+	// notReadyGrace is how long after becoming NotReady a node is still returned with the ready nodes
+	notReadyGrace time.Duration
+	// maxHeartbeatAge leaves the ready nodes whose last heartbeat is older out of the ready nodes, 0 keeps them
+	maxHeartbeatAge time.Duration
+	// addressTypes is the order the address types of a node are tried in, the default order if empty
+	addressTypes []v1.NodeAddressType
+	// kubeletPort replaces the kubelet port reported by every node if not 0
+	kubeletPort int32
+	// zeroPortNodes are the nodes reporting no kubelet port that have been warned about
+	zeroPortNodes *sync.Map
 }
 
 type cadvisorStatsRequest struct {
@@ -53,69 +118,271 @@ type cadvisorStatsRequest struct {
 // NewClientsetNodeSource returns a ClientsetNodeSource with the given clientSet
 func NewClientsetNodeSource(clientSet kubernetes.Interface) ClientsetNodeSource {
 	return ClientsetNodeSource{
-		clientSet: clientSet,
+		clientSet:     clientSet,
+		zeroPortNodes: &sync.Map{},
 	}
 }
 
-// GetReadyNodes fetches the list of nodes from the clientSet and filters down to only ready nodes
+// newConfiguredNodeSource returns a ClientsetNodeSource restricted to the nodes allowed by the config, using
+// the node address types and kubelet port override of the config
+func newConfiguredNodeSource(config KubeAgentConfig) ClientsetNodeSource {
+	return ClientsetNodeSource{
+		clientSet:         config.Clientset,
+		allowed:           config.nodeNames,
+		labelSelector:     config.nodeLabelSelector(),
+		pageSize:          int64(config.NodeListPageSize),
+		skipUnschedulable: config.SkipUnschedulableNodes,
+		notReadyGrace:     time.Duration(config.IncludeNotReadyGracePeriod) * time.Second,
+		maxHeartbeatAge:   time.Duration(config.MaxHeartbeatAge) * time.Second,
+		addressTypes:      config.nodeAddressTypes,
+		kubeletPort:       int32(config.KubeletPortOverride),
+		zeroPortNodes:     &sync.Map{},
+	}
+}
+
+// GetReadyNodes fetches the list of nodes from the clientSet and filters down to only ready nodes allowed
+// by the node source, leaving out cordoned nodes if the node source skips them and nodes whose heartbeat is
+// older than the max heartbeat age of the node source. Nodes that became NotReady within the not ready grace
+// period of the node source are returned with the ready nodes. The nodes are listed a page at a time, and
+// only the ready nodes of each page are kept.
 func (cns ClientsetNodeSource) GetReadyNodes(ctx context.Context) ([]v1.Node, error) {
-	allNodes, err := cns.clientSet.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	nodes, _, err := cns.GetReadyNodesWithStats(ctx)
+	return nodes, err
+}
 
-	if err != nil {
-		return nil, err
-	}
+// GetReadyNodesWithStats returns the ready nodes as GetReadyNodes does, along with the readiness of the
+// nodes listed
+func (cns ClientsetNodeSource) GetReadyNodesWithStats(ctx context.Context) ([]v1.Node, sample.NodeReadiness,
+	error) {
+	return cns.readyNodes(func(visit func(page []v1.Node)) error {
+		return cns.listNodes(ctx, visit)
+	})
+}
+
+// Subscribe returns a subscription that never delivers, as the nodes are listed each collection rather than
+// watched
+func (cns ClientsetNodeSource) Subscribe() NodeSubscription {
+	return NodeSubscription{}
+}
 
+// readyNodes filters the nodes passed to visit by list down to the ready nodes allowed by the node source,
+// as described by GetReadyNodes, and counts the allowed nodes by their readiness
+func (cns ClientsetNodeSource) readyNodes(list func(visit func(page []v1.Node)) error) ([]v1.Node,
+	sample.NodeReadiness, error) {
 	var readyNodes []v1.Node
-	for _, n := range allNodes.Items {
-		i, nc := getNodeCondition(
-			&n.Status,
-			v1.NodeReady)
-		if i >= 0 && nc.Type == v1.NodeReady {
+	var notReadyNodes []string
+	var readiness sample.NodeReadiness
+	// notReadyReasons are the reasons of the Ready condition of the not ready nodes, reported if none is ready
+	notReadyReasons := map[string]string{}
+	listed, unschedulable, stale := 0, 0, 0
+	now := time.Now()
+	err := list(func(page []v1.Node) {
+		listed += len(page)
+		allowedNodes := cns.allowed.apply(page)
+		readiness.Total += len(allowedNodes)
+		for _, n := range allowedNodes {
+			if !nodeReady(n) {
+				readiness.NotReadyNodes = append(readiness.NotReadyNodes, n.Name)
+				notReadyReasons[n.Name] = notReadyReason(n)
+			}
+			switch {
+			case nodeReady(n):
+				// a node whose kubelet died may still be reported ready, its fetch would only exhaust its retries
+				if age, ok := staleHeartbeat(n, cns.maxHeartbeatAge, now); ok {
+					log.Infof("Node %s is ready but its last heartbeat was %v ago, it is not collected", n.Name,
+						age.Round(time.Second))
+					stale++
+					continue
+				}
+			case recentlyNotReady(n, cns.notReadyGrace, now):
+				notReadyNodes = append(notReadyNodes, n.Name)
+			default:
+				_, nc := getNodeCondition(&n.Status, v1.NodeReady)
+				log.Debugf("node, %s, is in a notready state. Node Condition: %+v", n.Name, nc)
+				continue
+			}
+			// cordoned nodes are still ready, but are often being drained
+			if cns.skipUnschedulable && n.Spec.Unschedulable {
+				log.Debugf("node, %s, is unschedulable and not collected", n.Name)
+				unschedulable++
+				continue
+			}
 			readyNodes = append(readyNodes, n)
-		} else {
-			log.Debugf("node, %s, is in a notready state. Node Condition: %+v", n.Name, nc)
 		}
+	})
+	if err != nil {
+		return nil, readiness, err
+	}
+	readiness.NotReady = len(readiness.NotReadyNodes)
+	readiness.Ready = readiness.Total - readiness.NotReady
+	if listed == 0 && cns.labelSelector != "" {
+		return nil, readiness, fmt.Errorf("no nodes match the node label selector %q", cns.labelSelector)
+	}
+	if readiness.Total == 0 && len(cns.allowed) > 0 {
+		return nil, readiness, fmt.Errorf("none of the %d nodes match the node name allowlist", listed)
+	}
+	if unschedulable > 0 {
+		log.Infof("%d ready nodes are unschedulable (cordoned) and not collected", unschedulable)
+	}
+	if len(notReadyNodes) > 0 {
+		log.Infof("Nodes [%s] became NotReady within the not ready grace period and are still collected",
+			strings.Join(notReadyNodes, ", "))
 	}
 
 	if len(readyNodes) == 0 {
-		return nil, fmt.Errorf("there were 0 nodes in a ready state")
+		return nil, readiness, fmt.Errorf("%w%s", cns.noReadyNodesError(stale, unschedulable),
+			describeNotReadyNodes(readiness.NotReadyNodes, notReadyReasons))
 	}
 
-	if len(readyNodes) != len(allNodes.Items) {
-		log.Info("some nodes were in a not ready state when retrieving nodes")
+	// the readiness is logged with the summary of the collection
+	if readiness.NotReady > 0 {
+		log.Debugf("%d of the %d nodes were in a not ready state when retrieving nodes", readiness.NotReady,
+			readiness.Total)
 	}
 
-	return readyNodes, nil
+	return readyNodes, readiness, nil
 }
 
-// NodeAddress returns the internal IP address and kubelet port of a given node
-func (cns ClientsetNodeSource) NodeAddress(node *v1.Node) (string, int32, error) {
+// noReadyNodesError returns why none of the nodes listed is collected
+func (cns ClientsetNodeSource) noReadyNodesError(stale, unschedulable int) error {
+	switch {
+	case stale > 0 && unschedulable == 0:
+		return fmt.Errorf("there were 0 nodes in a ready state with a recent heartbeat, %d ready nodes have "+
+			"a heartbeat older than the max heartbeat age", stale)
+	case unschedulable > 0:
+		return fmt.Errorf("there were 0 schedulable nodes in a ready state, all %d ready nodes are "+
+			"unschedulable (cordoned) and skip_unschedulable_nodes is set", unschedulable)
+	case cns.labelSelector != "":
+		return fmt.Errorf("there were 0 nodes in a ready state matching the node label selector %q",
+			cns.labelSelector)
+	}
+	return errors.New("there were 0 nodes in a ready state")
+}
+
+// notReadyNodeLimit is the number of not ready nodes named when no node is ready
+const notReadyNodeLimit = 10
+
+// describeNotReadyNodes names the not ready nodes with the reason of their Ready condition, up to
+// notReadyNodeLimit of them, or returns an empty string if there are none
+func describeNotReadyNodes(names []string, reasons map[string]string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	described := make([]string, 0, notReadyNodeLimit)
+	for _, name := range names {
+		if len(described) == notReadyNodeLimit {
+			break
+		}
+		described = append(described, fmt.Sprintf("%s (%s)", name, reasons[name]))
+	}
+	more := ""
+	if len(names) > len(described) {
+		more = fmt.Sprintf(" and %d more", len(names)-len(described))
+	}
+	return fmt.Sprintf(", not ready nodes: %s%s", strings.Join(described, ", "), more)
+}
+
+// notReadyReason returns the reason of the Ready condition of a node that is not ready
+func notReadyReason(n v1.Node) string {
+	_, c := getNodeCondition(&n.Status, v1.NodeReady)
+	switch {
+	case c == nil:
+		return "no Ready condition"
+	case c.Reason == "":
+		return "Ready " + string(c.Status)
+	}
+	return c.Reason
+}
+
+// listNodes lists the nodes matching the label selector of the node source a page at a time, following the
+// continue token of each page, and passes each page to visit. A page that conflicts is retried with the
+// default backoff. A continue token expiring mid-list fails the list, as restarting it could visit a node
+// twice.
+func (cns ClientsetNodeSource) listNodes(ctx context.Context, visit func(page []v1.Node)) error {
+	opts := metav1.ListOptions{LabelSelector: cns.labelSelector, Limit: cns.pageSize}
+	for pages := 1; ; pages++ {
+		var page *v1.NodeList
+		err := retry.RetryOnConflict(retry.DefaultBackoff, func() (err error) {
+			page, err = cns.clientSet.CoreV1().Nodes().List(ctx, opts)
+			return
+		})
+		if err != nil {
+			if pages > 1 {
+				return fmt.Errorf("unable to list page %d of the nodes: %w", pages, err)
+			}
+			return err
+		}
+		visit(page.Items)
+		if page.Continue == "" {
+			return nil
+		}
+		opts.Continue = page.Continue
+	}
+}
+
+// NodeAddress returns the address and kubelet port of a given node, and the type of the address returned.
+// The address types of the node source are tried in order, by default its internal IP address, then its
+// hostname, then its external IP address. The port is the kubelet port override of the node source if set.
+func (cns ClientsetNodeSource) NodeAddress(node *v1.Node) (string, int32, v1.NodeAddressType, error) {
+	addressTypes := cns.addressTypes
+	if len(addressTypes) == 0 {
+		addressTypes = defaultNodeAddressTypes
+	}
 	// adapted from k8s.io/kubernetes/pkg/util/node
-	for _, addr := range node.Status.Addresses {
-		if addr.Type == v1.NodeInternalIP {
-			return addr.Address, node.Status.DaemonEndpoints.KubeletEndpoint.Port, nil
+	for _, addrType := range addressTypes {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == addrType && addr.Address != "" {
+				return addr.Address, cns.port(node), addrType, nil
+			}
 		}
 	}
-	return "", 0, fmt.Errorf("Could not find internal IP address for node %s ", node.Name)
+	return "", 0, "", fmt.Errorf("Could not find a %s address for node %s ", joinAddressTypes(addressTypes, " or "),
+		node.Name)
 }
 
-func downloadNodeData(ctx context.Context, prefix string, config KubeAgentConfig,
-	workDir *os.File, nodeSource NodeSource) (map[string]error, error) {
-	var nodes []v1.Node
+// port returns the port to connect to the kubelet of a node on
+func (cns ClientsetNodeSource) port(node *v1.Node) int32 {
+	warned := cns.zeroPortNodes
+	if warned == nil {
+		warned = &sync.Map{}
+	}
+	return kubeletPort(node, cns.kubeletPort, warned)
+}
+
+// downloadNodeData downloads the data of every ready node into workDir, recording the content hash of the
+// node data in hashes if it is not nil. Node fetches are spread across the poll interval by pacer if it is not
+// nil. The conditions of the listed nodes are recorded in health if it is not nil.
+func downloadNodeData(ctx context.Context, prefix string, config KubeAgentConfig, cycle pollCycle,
+	nodes NodeConnection, workDir *util.WorkDir, nodeSource NodeSource, hashes *nodeDataHashes, pacer *nodePacer,
+	health *nodeHealthSnapshot) (map[string]error, error) {
 	failedNodeList := make(map[string]error)
 
-	err := retry.RetryOnConflict(retry.DefaultBackoff, func() (err error) {
-		nodes, err = nodeSource.GetReadyNodes(ctx)
-		return
-	})
+	readyNodes, readiness, err := getReadyNodesWithStats(ctx, nodeSource)
 	if err != nil {
 		return nil, fmt.Errorf("cloudability metric agent is unable to get a list of nodes: %v", err)
 	}
-
-	containersRequest, err := buildContainersRequest()
+	// conditions are reported from the same list the nodes are collected from
+	health.record(readyNodes)
+	health.recordReadiness(readiness)
+	readyNodes, virtualNodes := withoutVirtualNodes(config, readyNodes)
+	health.skip(virtualNodes, sample.SkipVirtualKubelet)
+	readyNodes, optedOutNodes := withoutOptedOutNodes(readyNodes)
+	health.skip(optedOutNodes, sample.SkipOptedOut)
+	// the nodes of very large clusters are collected over several collections rather than timing out
+	readyNodes, deferredNodes := capNodes(readyNodes, config.MaxNodesPerCycle, cycle.collection)
+	health.skip(deferredNodes, sample.SkipNodeCap)
+	nodes.serverNames.record(readyNodes, nodeSource)
+	nodes.machines.record(readyNodes, time.Now())
+
+	containersRequest, err := buildContainersRequest(1)
 	if err != nil {
 		return nil, fmt.Errorf("error occurred requesting container statistics: %v", err)
 	}
+	refreshStatsRelay(ctx, nodes)
+
+	// nodes briefly reporting the same address would have the same kubelet collected twice
+	readyNodes, shared := dedupeNodeAddresses(readyNodes, nodeSource)
+	pacer.schedule(len(readyNodes))
 
 	log.Debugln("Starting node collection loop")
 
@@ -125,13 +392,26 @@ func downloadNodeData(ctx context.Context, prefix string, config KubeAgentConfig
 	// creates a max number of concurrent goroutines that are allowed
 	limiter := make(chan struct{}, config.ConcurrentPollers)
 
-	for _, n := range nodes {
+	for i, n := range readyNodes {
+		pacer.wait(ctx, i)
 		// block if channel is full (limiting number of goroutines)
 		limiter <- struct{}{}
 
+		// nodes not yet started when the collection is cancelled are reported as failed
+		if err := ctx.Err(); err != nil {
+			<-limiter
+			m.Lock()
+			failedNodeList[n.Name] = fmt.Errorf("node metrics retrieval cancelled: %w", err)
+			m.Unlock()
+			continue
+		}
+
 		wg.Add(1)
 		go func(currentNode v1.Node) {
-			if currentNode.Spec.ProviderID == "" {
+			// nodes of local development clusters, eg: kind, have no provider ID
+			if currentNode.Spec.ProviderID == "" && config.Dev {
+				log.Debugf("Node %s has no provider ID", currentNode.Name)
+			} else if currentNode.Spec.ProviderID == "" {
 				errMessage := "Node ProviderID is not set which may be because the node is running in a " +
 					"self managed environment, and this may cause inconsistent gathering of metrics data."
 				log.Warnf(errMessage)
@@ -147,11 +427,29 @@ func downloadNodeData(ctx context.Context, prefix string, config KubeAgentConfig
 				workDir:           workDir,
 				ClusterHostURL:    config.ClusterHostURL,
 				containersRequest: containersRequest,
+				hashes:            hashes,
 			}
-			err := retrieveNodeData(nd, config, nodeSource, currentNode)
+			err := retrieveNodeData(ctx, nd, config, cycle, nodes, nodeSource, currentNode)
 			if err != nil {
 				m.Lock()
-				failedNodeList[currentNode.Name] = fmt.Errorf("node metrics retrieval problem occurred: %v", err)
+				// a cancelled node is told apart from a kubelet failure by the next collection
+				if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+					failedNodeList[currentNode.Name] = fmt.Errorf("node metrics retrieval cancelled: %w", err)
+				} else {
+					failedNodeList[currentNode.Name] = nodeFetchError(currentNode, err)
+				}
+				m.Unlock()
+			}
+			if s, ok := shared[currentNode.Name]; ok {
+				conflicts := collectSharedAddress(s, err, func(n v1.Node) error {
+					answered := nd
+					answered.nodeName = n.Name
+					return retrieveNodeData(ctx, answered, config, cycle, nodes, nodeSource, n)
+				})
+				m.Lock()
+				for name, conflict := range conflicts {
+					failedNodeList[name] = conflict
+				}
 				m.Unlock()
 			}
 			<-limiter
@@ -172,14 +470,18 @@ func downloadNodeData(ctx context.Context, prefix string, config KubeAgentConfig
 type nodeFetchData struct {
 	nodeName          string
 	prefix            string
-	workDir           *os.File
+	workDir           *util.WorkDir
 	ClusterHostURL    string
 	containersRequest []byte
+	// hashes records the content hash of the node data written if it is not nil
+	hashes *nodeDataHashes
+	// disabled are the endpoints of the node disabled by its annotation, by node source or extra endpoint name
+	disabled map[string]bool
 }
 
 // setupDirectNodeAPI retrieves node stats directly from the node api
 func setupDirectNodeAPI(ns NodeSource, config KubeAgentConfig, n *v1.Node, nd nodeFetchData) (directNode, error) {
-	ip, port, err := ns.NodeAddress(n)
+	ip, port, _, err := ns.NodeAddress(n)
 	if err != nil {
 		return directNode{}, fmt.Errorf("problem getting node address: %s", err)
 	}
@@ -190,6 +492,13 @@ type nodeAPI interface {
 	statsSummary() string
 	statsContainer() string
 	mCAdvisor() string
+	metricsResource() string
+	metricsProbes() string
+	statsPods() string
+	spec() string
+	configz() string
+	kubeletMetrics() string
+	path(p string) string
 }
 
 type proxyAPI struct {
@@ -199,17 +508,55 @@ type proxyAPI struct {
 
 // statsSummary formats the proxy api stats/summary endpoint for the node
 func (p proxyAPI) statsSummary() string {
-	return fmt.Sprintf("%s/api/v1/nodes/%s/proxy/stats/summary", p.clusterHostURL, p.nodeName)
+	return p.path("/stats/summary")
 }
 
 // statsContainer formats the proxy api stats/container endpoint for the node
 func (p proxyAPI) statsContainer() string {
-	return fmt.Sprintf("%s/api/v1/nodes/%s/proxy/stats/container/", p.clusterHostURL, p.nodeName)
+	return p.path("/stats/container/")
 }
 
 // mCAdvisor formats the proxy api metrics/mCAdvisor endpoint, which outputs prometheus-format metrics
 func (p proxyAPI) mCAdvisor() string {
-	return fmt.Sprintf("%s/api/v1/nodes/%s/proxy/metrics/cadvisor", p.clusterHostURL, p.nodeName)
+	return p.path("/metrics/cadvisor")
+}
+
+// metricsResource formats the proxy api metrics/resource endpoint, which outputs prometheus-format metrics
+func (p proxyAPI) metricsResource() string {
+	return p.path("/metrics/resource")
+}
+
+// metricsProbes formats the proxy api metrics/probes endpoint, which outputs prometheus-format metrics
+func (p proxyAPI) metricsProbes() string {
+	return p.path("/metrics/probes")
+}
+
+// statsPods formats the proxy api pods endpoint, which outputs the pods bound to the node as seen by the
+// kubelet
+func (p proxyAPI) statsPods() string {
+	return p.path("/pods")
+}
+
+// spec formats the proxy api spec endpoint, which outputs the machine info of the node
+func (p proxyAPI) spec() string {
+	return p.path("/spec/")
+}
+
+// configz formats the proxy api configz endpoint, which outputs the running configuration of the kubelet
+func (p proxyAPI) configz() string {
+	return p.path("/configz")
+}
+
+// kubeletMetrics formats the proxy api metrics endpoint, which outputs the prometheus-format runtime metrics
+// of the kubelet itself
+func (p proxyAPI) kubeletMetrics() string {
+	return p.path("/metrics")
+}
+
+// path formats the proxy api endpoint for an arbitrary kubelet path, the node name is escaped as a single
+// path segment as provisioning systems may name nodes with characters not allowed in a path
+func (p proxyAPI) path(kubeletPath string) string {
+	return fmt.Sprintf("%s/api/v1/nodes/%s/proxy%s", p.clusterHostURL, url.PathEscape(p.nodeName), kubeletPath)
 }
 
 func setupProxyAPI(clusterHostURL, nodeName string) proxyAPI {
@@ -226,17 +573,53 @@ type directNode struct {
 
 // statsSummary formats the direct node stats/summary endpoint
 func (d directNode) statsSummary() string {
-	return fmt.Sprintf("https://%s:%v/stats/summary", d.ip, d.port)
+	return d.path("/stats/summary")
 }
 
 // statsContainer formats the direct node stats/container endpoint
 func (d directNode) statsContainer() string {
-	return fmt.Sprintf("https://%s:%v/stats/container/", d.ip, d.port)
+	return d.path("/stats/container/")
 }
 
 // mCAdvisor formats the direct node metrics/mCAdvisor endpoint
 func (d directNode) mCAdvisor() string {
-	return fmt.Sprintf("https://%s:%v/metrics/cadvisor", d.ip, d.port)
+	return d.path("/metrics/cadvisor")
+}
+
+// metricsResource formats the direct node metrics/resource endpoint
+func (d directNode) metricsResource() string {
+	return d.path("/metrics/resource")
+}
+
+// metricsProbes formats the direct node metrics/probes endpoint
+func (d directNode) metricsProbes() string {
+	return d.path("/metrics/probes")
+}
+
+// statsPods formats the direct node pods endpoint
+func (d directNode) statsPods() string {
+	return d.path("/pods")
+}
+
+// spec formats the direct node spec endpoint
+func (d directNode) spec() string {
+	return d.path("/spec/")
+}
+
+// configz formats the direct node configz endpoint
+func (d directNode) configz() string {
+	return d.path("/configz")
+}
+
+// kubeletMetrics formats the direct node metrics endpoint
+func (d directNode) kubeletMetrics() string {
+	return d.path("/metrics")
+}
+
+// path formats the direct node endpoint for an arbitrary kubelet path
+func (d directNode) path(kubeletPath string) string {
+	// IPv6 addresses are bracketed in the host
+	return "https://" + net.JoinHostPort(d.ip, strconv.FormatInt(d.port, 10)) + kubeletPath
 }
 
 func directNodeEndpoints(ip string, port int32) directNode {
@@ -252,55 +635,406 @@ type sourceName struct {
 }
 
 func (s sourceName) summary() string {
-	return fmt.Sprintf("%s-summary-%s", s.prefix, s.nodeName)
+	return sample.NodeSourceName(s.prefix, sample.SummarySource, s.nodeName)
 }
 
 func (s sourceName) container() string {
-	return fmt.Sprintf("%s-container-%s", s.prefix, s.nodeName)
+	return sample.NodeSourceName(s.prefix, sample.ContainerSource, s.nodeName)
 }
 
 func (s sourceName) cadvisorMetrics() string {
-	return fmt.Sprintf("%s-cadvisor_metrics-%s", s.prefix, s.nodeName)
+	return sample.NodeSourceName(s.prefix, sample.CadvisorMetricsSource, s.nodeName)
+}
+
+func (s sourceName) resourceMetrics() string {
+	return sample.NodeSourceName(s.prefix, sample.ResourceMetricsSource, s.nodeName)
+}
+
+func (s sourceName) probes() string {
+	return sample.NodeSourceName(s.prefix, sample.ProbesSource, s.nodeName)
+}
+
+func (s sourceName) pods() string {
+	return sample.NodeSourceName(s.prefix, sample.KubeletPodsSource, s.nodeName)
+}
+
+func (s sourceName) spec() string {
+	return sample.NodeSourceName(s.prefix, sample.NodeSpecSource, s.nodeName)
+}
+
+func (s sourceName) configz() string {
+	return sample.NodeSourceName(s.prefix, sample.KubeletConfigzSource, s.nodeName)
+}
+
+func (s sourceName) kubeletMetrics() string {
+	return sample.NodeSourceName(s.prefix, sample.KubeletMetricsSource, s.nodeName)
 }
 
-// retrieveNodeData fetches summary and container data for the node
-func retrieveNodeData(nd nodeFetchData, config KubeAgentConfig, ns NodeSource, n v1.Node) error {
-	connectionMethods := connectionOptions(config, n, nd, ns)
+func (s sourceName) extra(name string) string {
+	return sample.NodeSourceName(s.prefix, name, s.nodeName)
+}
+
+// retrieveNodeData fetches summary and container data for the node, abandoning it once the node fetch
+// timeout expires
+func retrieveNodeData(ctx context.Context, nd nodeFetchData, config KubeAgentConfig, cycle pollCycle,
+	nodes NodeConnection, ns NodeSource, n v1.Node) error {
+	if config.NodeFetchTimeout <= 0 {
+		return fetchNodeData(ctx, nd, config, cycle, nodes, ns, n)
+	}
+	timeout := time.Duration(config.NodeFetchTimeout) * time.Second
+	nodeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := fetchNodeData(nodeCtx, nd, config, cycle, nodes, ns, n)
+	// the deadline of the collection is not the node's own
+	if ctx.Err() == nil && nodeCtx.Err() != nil {
+		if err == nil {
+			// the summary was collected but the extra endpoints were abandoned
+			err = nodeCtx.Err()
+		}
+		return fmt.Errorf("%w after %v: %v", errNodeFetchTimeout, timeout, err)
+	}
+	return err
+}
+
+// fetchNodeData fetches the summary and any extra endpoints of a node, via the first connection that
+// succeeds
+func fetchNodeData(ctx context.Context, nd nodeFetchData, config KubeAgentConfig, cycle pollCycle,
+	nodes NodeConnection, ns NodeSource, n v1.Node) error {
+	// the endpoints of this node may differ from those of the node probed at startup
+	nodes.NodeMetrics = nodes.nodeMasks.forNode(n.Name, nodes.NodeMetrics, func(mask *EndpointMask) {
+		probeNodeEndpoints(config, nodes, ns, n, mask)
+	}, time.Now())
+	connectionMethods := connectionOptions(config, nodes, n, nd, ns)
+	// the raw responses of a node listed for debug capture are retained with the files written for them
+	if capture := cycle.debugCaptures.forNode(n.Name); capture != nil {
+		for i := range connectionMethods {
+			connectionMethods[i].client.Capture = capture
+		}
+		defer capture.retainFiltered(nd.workDir.Name())
+	}
 	source := sourceName{
 		prefix:   nd.prefix,
 		nodeName: nd.nodeName,
 	}
+	// endpoints are shed from a node for this poll by annotating it, eg: one emitting a pathological response
+	nd.disabled = annotationDisabledEndpoints(config, n)
+	cycle.disabledEndpoints.record(nd.nodeName, nd.disabled, sample.EndpointDisabledByAnnotation)
 	toFetch := map[Endpoint]bool{
-		NodeStatsSummaryEndpoint: true,
+		NodeStatsSummaryEndpoint: !nd.disabled[sample.SummarySource],
 	}
 	// if we receive an error after the max number of retries when attempting to hit an endpoint that
-	// we had previously verified to work, we fail and assume the node is unreachable at this time
+	// we had previously verified to work, we fail and assume the node is unreachable at this time. A
+	// summary from another node, or a response that stalled, is discarded and retried via any other
+	// connection.
+	var summaryErr, fallbackErr error
 	for _, cm := range connectionMethods {
-		err := fetchEndpoint(toFetch, NodeStatsSummaryEndpoint, config, cm, func() (string, error) {
-			return cm.client.GetRawEndPoint(http.MethodGet, source.summary(),
-				nd.workDir, cm.API.statsSummary(), nil, true)
+		err := fetchEndpoint(toFetch, NodeStatsSummaryEndpoint, nodes.NodeMetrics, cm, func() (string, error) {
+			// the summary is verified and hashed as it is written rather than read back
+			transforms := []raw.Transform{newSummaryNodeCheck(nd.nodeName)}
+			var hash *raw.HashTransform
+			if nd.hashes != nil && !config.namespaceRollup() {
+				hash = raw.NewHashTransform(sha256.New())
+				transforms = append(transforms, hash)
+			}
+			filename, err := cm.client.GetRawEndPointTransformed(ctx, http.MethodGet, source.summary(), nd.workDir,
+				summaryURL(cm.API, cycle.summaryCPUAndMemoryOnly), nil, true, 0, transforms...)
+			if err != nil {
+				return filename, removeMismatchedSummary(filename, err)
+			}
+			if config.namespaceRollup() {
+				// the rollup replaces the summary, so it is what is hashed
+				sum, err := rollupSummaryFile(filename)
+				if err != nil {
+					return filename, removeSummaryWithPods(filename, err)
+				}
+				if nd.hashes != nil {
+					nd.hashes.record(filename, sum)
+				}
+				return filename, nil
+			}
+			if hash != nil {
+				nd.hashes.record(filename, hash.Sum())
+			}
+			return filename, nil
 		})
+		if cm.ConnType == Direct && isCertificateError(err) {
+			// the node is collected via proxy until its endpoints are probed again
+			log.Warnf("Node %s: kubelet serving certificate could not be verified, falling back to proxy: %v",
+				nd.nodeName, err)
+			fallBackToProxy(nodes.NodeMetrics)
+			fallbackErr = err
+			continue
+		}
+		var identityErr nodeIdentityError
+		if errors.As(err, &identityErr) || errors.Is(err, raw.ErrResponseStalled) {
+			log.Warnf("Node %s: %v via %s connection", nd.nodeName, err, cm.FriendlyName)
+			fallbackErr = err
+			continue
+		}
 		if err != nil {
-			return err
+			summaryErr = err
+			break
+		}
+	}
+	if toFetch[NodeStatsSummaryEndpoint] {
+		if summaryErr == nil {
+			summaryErr = fallbackErr
+		}
+		// kubelets without a usable summary may still serve their resource metrics in its place, which
+		// hold pod level detail so are not collected with the namespace profile
+		if !nodes.NodeMetrics.Unreachable(NodeResourceMetricsEndpoint) && !config.namespaceRollup() &&
+			!nd.disabled[sample.ResourceMetricsSource] {
+			err := retrieveResourceMetrics(ctx, nd, nodes.NodeMetrics, connectionMethods, source)
+			if err == nil {
+				log.Debugf("Node %s: collected resource metrics in place of the summary: %v", nd.nodeName,
+					summaryErr)
+				summaryErr = nil
+			} else if summaryErr == nil {
+				summaryErr = err
+			}
+		}
+		if summaryErr != nil {
+			return summaryErr
+		}
+	}
+
+	// probe metrics and extra endpoints have no baseline, so are only collected with each sample. They may
+	// hold pod level detail so are not collected with the namespace profile.
+	if nd.prefix != sample.BaselinePrefix && !config.namespaceRollup() {
+		if config.RetrieveProbeMetrics && !nd.disabled[sample.ProbesSource] {
+			err := retrieveOptionalEndpoint(ctx, nd, nodes.NodeMetrics, connectionMethods, NodeProbeMetricsEndpoint,
+				source.probes(), nodeAPI.metricsProbes, 0)
+			if err != nil {
+				log.Warnf("Unable to fetch probe metrics from node %s: %v", nd.nodeName, err)
+			}
+		}
+		if config.RetrieveKubeletPods && !nd.disabled[sample.KubeletPodsSource] {
+			err := retrieveOptionalEndpoint(ctx, nd, nodes.NodeMetrics, connectionMethods, NodePodsEndpoint,
+				source.pods(), nodeAPI.statsPods, kubeletPodsMaxBytes(config))
+			if err != nil {
+				log.Warnf("Unable to fetch kubelet pods from node %s: %v", nd.nodeName, err)
+			}
+		}
+		retrieveExtraEndpoints(ctx, nd, config, cycle, nodes.NodeMetrics, connectionMethods, source)
+	}
+	// the machine spec rarely changes so is not collected with every sample
+	if nd.prefix != sample.BaselinePrefix && cycle.nodeSpecDue && !nd.disabled[sample.NodeSpecSource] {
+		err := retrieveOptionalEndpoint(ctx, nd, nodes.NodeMetrics, connectionMethods, NodeSpecEndpoint,
+			source.spec(), nodeAPI.spec, 0)
+		if err != nil {
+			log.Warnf("Unable to fetch machine spec from node %s: %v", nd.nodeName, err)
+		}
+	}
+	if nd.prefix != sample.BaselinePrefix && config.RetrieveKubeletConfigz && !nd.disabled[sample.KubeletConfigzSource] {
+		err := retrieveOptionalEndpoint(ctx, nd, nodes.NodeMetrics, connectionMethods, NodeConfigzEndpoint,
+			source.configz(), nodeAPI.configz, 0)
+		if forbiddenOrNotFound(err) {
+			log.Infof("Kubelet configz is unavailable from node %s: %v", nd.nodeName, err)
+		} else if err != nil {
+			log.Warnf("Unable to fetch kubelet configz from node %s: %v", nd.nodeName, err)
+		}
+	}
+	// the kubelet metrics are filtered to families without pod level detail
+	if nd.prefix != sample.BaselinePrefix && config.RetrieveKubeletMetrics && !nd.disabled[sample.KubeletMetricsSource] {
+		err := retrieveOptionalEndpoint(ctx, nd, nodes.NodeMetrics, connectionMethods, NodeKubeletMetricsEndpoint,
+			source.kubeletMetrics(), nodeAPI.kubeletMetrics, 0, newMetricFamilyFilter(kubeletMetricFamilies))
+		if err != nil {
+			log.Warnf("Unable to fetch kubelet metrics from node %s: %v", nd.nodeName, err)
 		}
 	}
 	return nil
 }
 
+// summaryURL returns the node summary endpoint, limited to cpu and memory stats if requested
+func summaryURL(api nodeAPI, cpuAndMemoryOnly bool) string {
+	if cpuAndMemoryOnly {
+		return api.statsSummary() + "?only_cpu_and_memory=true"
+	}
+	return api.statsSummary()
+}
+
+// retrieveResourceMetrics fetches the resource metrics of a node, via the first connection that succeeds
+func retrieveResourceMetrics(ctx context.Context, nd nodeFetchData, nodeMetrics *EndpointMask,
+	connectionMethods []ConnectionMethod, source sourceName) error {
+	toFetch := map[Endpoint]bool{
+		NodeResourceMetricsEndpoint: true,
+	}
+	var err error
+	for _, cm := range connectionMethods {
+		fetchErr := fetchEndpoint(toFetch, NodeResourceMetricsEndpoint, nodeMetrics, cm, func() (string, error) {
+			filename, hash, err := cm.client.GetRawEndPointHashed(ctx, http.MethodGet, source.resourceMetrics(),
+				nd.workDir, cm.API.metricsResource(), nil, true)
+			if err == nil && nd.hashes != nil {
+				nd.hashes.record(filename, hash)
+			}
+			return filename, err
+		})
+		if fetchErr != nil {
+			err = fetchErr
+		}
+	}
+	if toFetch[NodeResourceMetricsEndpoint] {
+		if err == nil {
+			err = fmt.Errorf("no connection to %s available for node %s", NodeResourceMetricsEndpoint, nd.nodeName)
+		}
+		return err
+	}
+	return nil
+}
+
+// nodeSpecDue returns true if the collection with the given index since startup retrieves the node machine
+// specs, the first collection always does
+func nodeSpecDue(config KubeAgentConfig, collection int) bool {
+	if !config.RetrieveNodeSpec {
+		return false
+	}
+	if config.NodeSpecInterval <= 1 {
+		return true
+	}
+	return collection%config.NodeSpecInterval == 0
+}
+
+// kubeletPodsMaxBytes returns the limit on the size of the kubelet pods response of each node
+func kubeletPodsMaxBytes(config KubeAgentConfig) int64 {
+	if config.KubeletPodsMaxBytes <= 0 {
+		return DefaultKubeletPodsMaxBytes
+	}
+	return config.KubeletPodsMaxBytes
+}
+
+// retrieveOptionalEndpoint fetches an optional kubelet endpoint of a node into the source file, via the
+// first connection that succeeds. The response is abandoned once it exceeds maxBytes, 0 disables the limit.
+// It is not fetched once the source is shed from a sample approaching its size cap.
+func retrieveOptionalEndpoint(ctx context.Context, nd nodeFetchData, nodeMetrics *EndpointMask,
+	connectionMethods []ConnectionMethod, endpoint Endpoint, sourceFile string, url func(nodeAPI) string,
+	maxBytes int64, transforms ...raw.Transform) error {
+	toFetch := map[Endpoint]bool{
+		endpoint: true,
+	}
+	var err error
+	for _, cm := range connectionMethods {
+		if shedErr := nd.workDir.Allow(sourceFile); shedErr != nil {
+			log.Debugf("Node %s: skipping %s: %v", nd.nodeName, endpoint, shedErr)
+			return nil
+		}
+		fetchErr := fetchEndpoint(toFetch, endpoint, nodeMetrics, cm, func() (string, error) {
+			return getRawEndPointRecorded(ctx, nd, cm, http.MethodGet, sourceFile, url(cm.API), nil, maxBytes,
+				transforms...)
+		})
+		if fetchErr != nil {
+			err = fetchErr
+		}
+	}
+	if !toFetch[endpoint] {
+		return nil
+	}
+	return err
+}
+
+// getRawEndPointRecorded fetches node data with no baseline into the work directory, recording the hash of
+// the data written in the node data hashes if they are not nil. The hash is computed as the data is written
+// so must follow any other transform.
+func getRawEndPointRecorded(ctx context.Context, nd nodeFetchData, cm ConnectionMethod, method, sourceFile,
+	url string, body []byte, maxBytes int64, transforms ...raw.Transform) (string, error) {
+	var hash *raw.HashTransform
+	if nd.hashes != nil {
+		hash = raw.NewHashTransform(sha256.New())
+		transforms = append(transforms[:len(transforms):len(transforms)], hash)
+	}
+	filename, err := cm.client.GetRawEndPointTransformed(ctx, method, sourceFile, nd.workDir, url, body, true,
+		maxBytes, transforms...)
+	if err == nil && hash != nil {
+		nd.hashes.recordWritten(filename, hash.Sum())
+	}
+	return filename, err
+}
+
+// forbiddenOrNotFound returns true if the kubelet refused or does not serve the requested endpoint, which is
+// expected of optional endpoints that clusters commonly restrict
+func forbiddenOrNotFound(err error) bool {
+	var statusErr raw.StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return statusErr.StatusCode == http.StatusForbidden || statusErr.StatusCode == http.StatusNotFound
+}
+
+// retrieveExtraEndpoints fetches the configured extra kubelet endpoints for the node. Failures are
+// logged rather than returned, as extra endpoints are not required for a usable sample.
+func retrieveExtraEndpoints(ctx context.Context, nd nodeFetchData, config KubeAgentConfig, cycle pollCycle,
+	nodeMetrics *EndpointMask, connectionMethods []ConnectionMethod, source sourceName) {
+	remaining := config.ExtraEndpointMaxBytes
+	if remaining <= 0 {
+		remaining = DefaultExtraEndpointMaxBytes
+	}
+
+	for _, e := range config.extraEndpoints {
+		if ctx.Err() != nil {
+			return
+		}
+		if nd.disabled[e.Name] {
+			continue
+		}
+		body, err := e.requestBody(nd.nodeName)
+		if err != nil {
+			log.Warnf("%s", err)
+			continue
+		}
+		toFetch := map[Endpoint]bool{
+			e.endpoint(): true,
+		}
+		for _, cm := range connectionMethods {
+			if shedErr := nd.workDir.Allow(source.extra(e.Name)); shedErr != nil {
+				log.Debugf("Node %s: skipping extra kubelet endpoint %s: %v", nd.nodeName, e.Name, shedErr)
+				break
+			}
+			if remaining <= 0 {
+				log.Warnf("Extra kubelet endpoint size limit reached for node %s, skipping remaining endpoints",
+					nd.nodeName)
+				return
+			}
+			err := fetchEndpoint(toFetch, e.endpoint(), nodeMetrics, cm, func() (string, error) {
+				var transforms []raw.Transform
+				if isCadvisorEndpoint(e) {
+					if filter := newCadvisorFilter(config, cycle, nd.nodeName, e.Name); filter != nil {
+						transforms = append(transforms, filter)
+					}
+				}
+				filename, err := getRawEndPointRecorded(ctx, nd, cm, e.Method, source.extra(e.Name),
+					cm.API.path(e.Path), body, remaining, transforms...)
+				if err == nil {
+					if fi, statErr := os.Stat(filename); statErr == nil {
+						remaining -= fi.Size()
+					}
+				}
+				return filename, err
+			})
+			if err != nil {
+				log.Warnf("Unable to fetch extra kubelet endpoint %s from node %s: %v", e.Name, nd.nodeName, err)
+			}
+		}
+	}
+}
+
 // fetchEndpoint is a convenience function to provide consistent logging, uniqueness,
 // and error handling around fetching data from metrics endpoints
-func fetchEndpoint(fetch map[Endpoint]bool, endpoint Endpoint, config KubeAgentConfig,
+func fetchEndpoint(fetch map[Endpoint]bool, endpoint Endpoint, nodeMetrics *EndpointMask,
 	cm ConnectionMethod, executeEndpointRequest func() (filename string, err error)) error {
 	// Don't fetch if we already got it once
 	if !fetch[endpoint] {
 		return nil
 	}
-	if config.NodeMetrics.Available(endpoint, cm.ConnType) {
+	if nodeMetrics.Available(endpoint, cm.ConnType) {
 		// fetch metrics from the endpoint
 		log.Debugf("Fetching data from %s endpoint via %s connection", endpoint, cm.FriendlyName)
 		_, err := executeEndpointRequest()
 		if err != nil {
 			log.Debugf("Unable to fetch %s metrics: %v", endpoint, err)
+			// the mask is the node's own, so an endpoint it does not serve is not requested again until
+			// the mask is derived again
+			if forbiddenOrNotFound(err) {
+				nodeMetrics.SetAvailability(endpoint, cm.ConnType, false)
+			}
 			return err
 		}
 		delete(fetch, endpoint)
@@ -310,55 +1044,143 @@ func fetchEndpoint(fetch map[Endpoint]bool, endpoint Endpoint, config KubeAgentC
 
 // connectionOptions returns the connection methods that are allowed for this node based on config
 // settings and cluster composition
-func connectionOptions(config KubeAgentConfig, n v1.Node, nd nodeFetchData, ns NodeSource) []ConnectionMethod {
+func connectionOptions(config KubeAgentConfig, nodes NodeConnection, n v1.Node, nd nodeFetchData,
+	ns NodeSource) []ConnectionMethod {
 	connectionMethods := make([]ConnectionMethod, 1)
-	// The config shouldn't allow direct connection if Fargate nodes were
-	// found in the cluster at startup, but check again here to be safe.
-	if !config.ForceKubeProxy && !isFargateNode(n) {
+	// Fargate and virtual kubelet nodes can not be reached directly, so are only ever collected via proxy
+	if !config.ForceKubeProxy && !proxyOnlyNode(config, n) {
 		directAPI, err := setupDirectNodeAPI(ns, config, &n, nd)
 		if err != nil {
 			log.Debugf("Unable to attempt direct connection to node %s: %v", nd.nodeName, err)
 		} else {
-			connectionMethods = append(connectionMethods, ConnectionMethod{Direct, directAPI, config.NodeClient, direct})
+			connectionMethods = append(connectionMethods, ConnectionMethod{Direct, directAPI, nodes.NodeClient, direct})
 		}
 	}
+	// nodes are never fetched via the API server when direct connection is forced, not even as a fallback
+	if config.ForceDirect {
+		return connectionMethods
+	}
 	proxyAPI := setupProxyAPI(config.ClusterHostURL, nd.nodeName)
-	connectionMethods = append(connectionMethods, ConnectionMethod{Proxy, proxyAPI, config.InClusterClient, proxy})
+	connectionMethods = append(connectionMethods, ConnectionMethod{Proxy, proxyAPI, nodes.InClusterClient, proxy})
+	// the stats relay is only configured when nodes/proxy is forbidden, so it is the last resort
+	if relayAPI, ok := nodes.relay.api(config.ClusterHostURL, nd.nodeName); ok {
+		connectionMethods = append(connectionMethods,
+			ConnectionMethod{PodProxy, relayAPI, nodes.InClusterClient, podProxy})
+	}
 	return connectionMethods
 }
 
 // ensureNodeSource validates connectivity to the kubelet metrics endpoints.
 // Attempts direct connection to the node summary & container stats endpoint
-// if possible and allowed, otherwise attempts to connect via kube-proxy
-func ensureNodeSource(ctx context.Context, config KubeAgentConfig) (KubeAgentConfig, error) {
+// if possible and allowed, otherwise attempts to connect via kube-proxy, and finally via the pod proxy to
+// a stats relay pod when one is configured. It returns the resulting connection to the nodes. Requests
+// proxied through the API server are limited by apiLimiter if it is not nil.
+func ensureNodeSource(ctx context.Context, config KubeAgentConfig, apiLimiter flowcontrol.RateLimiter) (
+	NodeConnection, error) {
+	handshakes := &tlsHandshakeCounter{}
 	nodeHTTPClient := http.Client{
-		Timeout: time.Second * 30,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				// nolint gosec
-				InsecureSkipVerify: true,
-			},
-		}}
+		Timeout:   time.Second * 30,
+		Transport: newNodeTransport(config, handshakes),
+	}
+
+	clientSetNodeSource := newConfiguredNodeSource(config)
+
+	// each path may authenticate differently, eg: a node scoped token for the kubelets and the service
+	// account for the API server
+	nodeHTTPClient, nodeCreds, err := config.DirectCredentials.apply(direct, nodeHTTPClient, config.Credentials,
+		config.tokenFileTTL())
+	if err != nil {
+		return NodeConnection{}, fmt.Errorf("%w: %v", FatalNodeError, err)
+	}
+	proxyHTTPClient, proxyCreds, err := config.ProxyCredentials.apply(proxy, config.HTTPClient, config.Credentials,
+		config.tokenFileTTL())
+	if err != nil {
+		return NodeConnection{}, fmt.Errorf("%w: %v", FatalNodeError, err)
+	}
 
-	clientSetNodeSource := NewClientsetNodeSource(config.Clientset)
+	// requests proxied through the API server share its budget with the clientset
+	proxyHTTPClient = limitAPIServerClient(proxyHTTPClient, apiLimiter)
 
-	nodeClient := raw.NewClient(nodeHTTPClient, true, config.BearerToken, config.BearerTokenPath,
-		config.CollectionRetryLimit, config.ParseMetricData)
+	var serverNames *nodeServerNames
+	if config.KubeletTLSVerify {
+		roots, err := loadKubeletCAs(config)
+		if err != nil {
+			return NodeConnection{}, fmt.Errorf("%w: %v", FatalNodeError, err)
+		}
+		serverNames = newNodeServerNames()
+		if transport, ok := nodeHTTPClient.Transport.(*http.Transport); ok {
+			verifyKubeletTLS(transport, roots, serverNames)
+		}
+	}
 
-	config.NodeClient = nodeClient
+	conn := NodeConnection{
+		NodeClient: raw.NewClient(nodeHTTPClient, true, nodeCreds,
+			config.CollectionRetryLimit, config.ParseMetricData),
+		InClusterClient: raw.NewClient(proxyHTTPClient, config.Insecure, proxyCreds,
+			config.CollectionRetryLimit, config.ParseMetricData),
+		NodeMetrics:        NewEndpointMask(),
+		NodeMetricsReasons: EndpointReasons{},
+		relay:              newStatsRelay(config),
+		handshakes:         handshakes,
+		nodeMasks:          newNodeEndpointMasks(config),
+		serverNames:        serverNames,
+		machines:           newNodeMachines(),
+	}
+	// output files are capped across both clients
+	openFiles := raw.NewOpenFileLimiter(config.MaxOpenFiles)
+	conn.NodeClient.OpenFiles = openFiles
+	conn.InClusterClient.OpenFiles = openFiles
+	stallTimeout := time.Duration(config.ResponseStallTimeout) * time.Second
+	conn.NodeClient.StallTimeout = stallTimeout
+	conn.InClusterClient.StallTimeout = stallTimeout
 
 	nodes, err := clientSetNodeSource.GetReadyNodes(ctx)
 	if err != nil {
-		return config, fmt.Errorf("error retrieving nodes: %s", err)
+		return conn, fmt.Errorf("error retrieving nodes: %s", err)
+	}
+	nodes, virtualNodes := withoutVirtualNodes(config, nodes)
+	if len(virtualNodes) > 0 {
+		log.Infof("Virtual kubelet nodes [%s] have no kubelet endpoints and are not collected, set "+
+			"virtual_kubelet_nodes to proxy or collect to collect them", strings.Join(virtualNodes, ", "))
 	}
+	// opted out nodes are never probed, the scrape is what they opted out of
+	nodes, optedOutNodes := withoutOptedOutNodes(nodes)
+	if len(optedOutNodes) > 0 {
+		log.Infof("Nodes [%s] opted out of collection with the %s annotation and are not collected",
+			strings.Join(optedOutNodes, ", "), NodeCollectAnnotation)
+	}
+	if len(nodes) == 0 {
+		return conn, fmt.Errorf("%w: every ready node is a virtual kubelet node or opted out of collection, "+
+			"none are collected", FatalNodeError)
+	}
+	checkOpenFileBudget(config, len(nodes))
+	refreshStatsRelay(ctx, conn)
+	conn.serverNames.record(nodes, clientSetNodeSource)
 
 	directNodes := int32(0)
 	proxyNodes := int32(0)
+	// proxyOnlyNodes are the Fargate and virtual kubelet nodes connected via proxy, which does not keep other
+	// nodes from connecting directly
+	proxyOnlyNodes := int32(0)
 	failedDirect := int32(0)
 	failedProxy := int32(0)
+	relayNodes := int32(0)
+	resourceDirectNodes := int32(0)
+	resourceProxyNodes := int32(0)
 	directAllowed := allowDirectConnect(config, nodes)
+	if !directAllowed && config.DirectCredentials.configured() {
+		log.Warnf("Direct kubelet credentials are configured but direct node connection is disabled, " +
+			"they will not be used")
+	}
+	// a node reporting no kubelet port would otherwise fail the direct probe and make the whole cluster
+	// connect via proxy
+	nodes = withoutZeroPortNodes(nodes, int32(config.KubeletPortOverride))
 
 	var wg sync.WaitGroup
+	failures := &nodeFailures{}
+	// a kubelet TLS failure is reported with the reason direct connections are not used, as the nodes may
+	// otherwise silently fall back to proxy
+	var directTLSFailure atomic.Value
 
 	limiter := make(chan struct{}, config.ConcurrentPollers)
 
@@ -371,73 +1193,421 @@ func ensureNodeSource(ctx context.Context, config KubeAgentConfig) (KubeAgentCon
 				<-limiter
 				wg.Done()
 			}()
+			var attempts []string
 			directlyConnected := false
-			ip, port, err := clientSetNodeSource.NodeAddress(&currentNode)
+			ip, port, addrType, err := clientSetNodeSource.NodeAddress(&currentNode)
 			if err != nil {
 				log.Warnf("error retrieving node addresses: %s", err)
+				failures.add(currentNode.Name, []string{fmt.Sprintf("address: %v", err)})
 				return
 			}
-			if directAllowed {
+			if addrType != v1.NodeInternalIP {
+				log.Infof("Node %s has no internal IP address, connecting directly via its %s address %s",
+					currentNode.Name, addrType, ip)
+			}
+			// Fargate nodes, and virtual kubelet nodes collected via proxy, are never connected to directly
+			proxyOnly := proxyOnlyNode(config, currentNode)
+			if directAllowed && proxyOnly {
+				attempts = append(attempts, fmt.Sprintf("%s: %s", Direct, reasonProxyOnlyNodes))
+			}
+			if directAllowed && !proxyOnly {
 				// test node direct connectivity
 				d := directNodeEndpoints(ip, port)
-				success, err := checkEndpointConnections(config, &nodeHTTPClient, Direct, d.statsSummary())
+				success, err := checkEndpointConnections(conn.NodeClient, Direct, http.MethodGet,
+					d.statsSummary())
 				if err != nil {
 					log.Warnf("Failed to connect to node [%s] directly with cause [%s]",
 						d.statsSummary(), err.Error())
 					atomic.AddInt32(&failedDirect, 1)
+					if detail := tlsFailureDetail(err); detail != "" {
+						directTLSFailure.CompareAndSwap(nil, detail)
+					}
 				}
 				if success {
 					directlyConnected = true
 					atomic.AddInt32(&directNodes, 1)
+				} else {
+					attempts = append(attempts, connectionAttempt(Direct, err))
 				}
 			}
-			if !directlyConnected {
+			proxyConnected := false
+			if !directlyConnected && !config.ForceDirect {
 				p := setupProxyAPI(config.ClusterHostURL, currentNode.Name)
-				success, err := checkEndpointConnections(config, &config.HTTPClient, Proxy, p.statsSummary())
+				success, err := checkEndpointConnections(conn.InClusterClient, Proxy, http.MethodGet,
+					p.statsSummary())
 				if err != nil {
 					log.Warnf("Failed to connect to node [%s] via proxy with cause [%s]",
 						p.statsSummary(), err.Error())
 					atomic.AddInt32(&failedProxy, 1)
 				}
 				if success {
+					proxyConnected = true
 					atomic.AddInt32(&proxyNodes, 1)
+					if proxyOnly {
+						atomic.AddInt32(&proxyOnlyNodes, 1)
+					}
+				} else {
+					attempts = append(attempts, connectionAttempt(Proxy, err))
 				}
 			}
+			relayConnected := false
+			if r, ok := conn.relay.api(config.ClusterHostURL, currentNode.Name); ok && !directlyConnected &&
+				!proxyConnected && !config.ForceDirect {
+				success, err := checkEndpointConnections(conn.InClusterClient, PodProxy, http.MethodGet,
+					r.statsSummary())
+				if err != nil {
+					log.Warnf("Failed to connect to node [%s] via stats relay with cause [%s]",
+						r.statsSummary(), err.Error())
+				}
+				if success {
+					relayConnected = true
+					atomic.AddInt32(&relayNodes, 1)
+				} else {
+					attempts = append(attempts, connectionAttempt(PodProxy, err))
+				}
+			}
+			if directlyConnected || proxyConnected || relayConnected {
+				return
+			}
+			// the resource metrics are collected in place of the summary of nodes that do not serve it
+			if directAllowed && !proxyOnly {
+				d := directNodeEndpoints(ip, port)
+				success, err := checkEndpointConnections(conn.NodeClient, Direct, http.MethodGet,
+					d.metricsResource())
+				if err != nil {
+					log.Warnf("Failed to connect to node [%s] directly with cause [%s]",
+						d.metricsResource(), err.Error())
+				}
+				if success {
+					atomic.AddInt32(&resourceDirectNodes, 1)
+					return
+				}
+			}
+			if config.ForceDirect {
+				failures.add(currentNode.Name, attempts)
+				return
+			}
+			p := setupProxyAPI(config.ClusterHostURL, currentNode.Name)
+			success, err := checkEndpointConnections(conn.InClusterClient, Proxy, http.MethodGet,
+				p.metricsResource())
+			if err != nil {
+				log.Warnf("Failed to connect to node [%s] via proxy with cause [%s]",
+					p.metricsResource(), err.Error())
+			}
+			if success {
+				atomic.AddInt32(&resourceProxyNodes, 1)
+				return
+			}
+			failures.add(currentNode.Name, attempts)
 		}(n)
 	}
 	log.Debugln("Currently Waiting for all node data to be gathered")
 	wg.Wait()
 	log.Infof("Of %d nodes, %d connected directly, %d connected via proxy, and %d could not be reached",
 		len(nodes), directNodes, proxyNodes, failedProxy)
+	if conn.relay != nil {
+		log.Infof("Of %d nodes, %d connected via stats relay", len(nodes), relayNodes)
+	}
+	resourceNodes := resourceDirectNodes + resourceProxyNodes
+	if resourceNodes > 0 {
+		log.Infof("Of %d nodes without a summary, %d connected directly and %d via proxy for resource metrics",
+			len(nodes)-int(directNodes+proxyNodes+relayNodes), resourceDirectNodes, resourceProxyNodes)
+	}
 
-	if len(nodes) != int(directNodes+proxyNodes) {
-		pct := int(directNodes+proxyNodes) * 100 / len(nodes)
+	if len(nodes) != int(directNodes+proxyNodes+relayNodes+resourceNodes) {
+		pct := int(directNodes+proxyNodes+relayNodes+resourceNodes) * 100 / len(nodes)
 		log.Warnf("Only %d percent of ready nodes could could be connected to, "+
 			"agent will operate in a limited mode.", pct)
 	}
 
-	if (directNodes + proxyNodes) == 0 {
-		return config, FatalNodeError
+	recordSummaryReasons(config, conn.NodeMetricsReasons, directAllowed, len(nodes), proxyNodes, directNodes,
+		proxyOnlyNodes)
+	if detail, ok := directTLSFailure.Load().(string); ok {
+		if reason := conn.NodeMetricsReasons.Reason(NodeStatsSummaryEndpoint, Direct); reason != "" {
+			conn.NodeMetricsReasons.SetReason(NodeStatsSummaryEndpoint, Direct, reason+": "+detail)
+		}
+	}
+	if conn.relay != nil {
+		recordRelayReason(conn.NodeMetricsReasons, len(nodes), proxyNodes+directNodes, relayNodes)
+	}
+
+	if (directNodes + proxyNodes + relayNodes + resourceNodes) == 0 {
+		if config.ForceDirect {
+			return conn, fmt.Errorf("%w: force_direct is set and no node could be reached directly: %s",
+				FatalNodeError, failures)
+		}
+		return conn, fmt.Errorf("%w: %s", FatalNodeError, failures)
+	}
+	if unreachable := len(nodes) - int(directNodes+resourceNodes); config.ForceDirect && unreachable > 0 {
+		log.Errorf("force_direct is set, %d nodes that could not be reached directly will not be collected "+
+			"via proxy: %s", unreachable, failures)
+	}
+
+	validateConfig(conn.NodeMetrics, proxyNodes, directNodes, proxyOnlyNodes)
+	if relayNodes > 0 {
+		conn.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, PodProxy, true)
+	}
+	setEndpointAvailability(conn.NodeMetrics, NodeResourceMetricsEndpoint, resourceProxyNodes, resourceDirectNodes)
+
+	if config.RetrieveProbeMetrics || config.RetrieveKubeletMetrics || len(config.optionalSources()) > 0 ||
+		len(config.extraEndpoints) > 0 {
+		probeNodes, reason := selectProbeNodes(nodes, time.Duration(config.ProbeNodeMinAge)*time.Second, time.Now())
+		log.Infof("Probing optional kubelet endpoints on node [%s]: %s", probeNodes[0].Name, reason)
+		if config.RetrieveProbeMetrics {
+			tried := probeOptionalEndpointOnNodes(config, conn, clientSetNodeSource, probeNodes, NodeProbeMetricsEndpoint,
+				nodeAPI.metricsProbes)
+			if conn.NodeMetrics.Unreachable(NodeProbeMetricsEndpoint) {
+				log.Debugf("Probe metrics are not served by nodes [%s], they will not be collected", tried)
+			} else {
+				log.Infof("Probe metrics connection method: %s", conn.NodeMetrics.Options(NodeProbeMetricsEndpoint))
+			}
+		}
+		if config.RetrieveKubeletPods {
+			tried := probeOptionalEndpointOnNodes(config, conn, clientSetNodeSource, probeNodes, NodePodsEndpoint,
+				nodeAPI.statsPods)
+			if conn.NodeMetrics.Unreachable(NodePodsEndpoint) {
+				log.Warnf("Kubelet pods are not served by nodes [%s], they will not be collected", tried)
+			} else {
+				log.Infof("Kubelet pods connection method: %s", conn.NodeMetrics.Options(NodePodsEndpoint))
+			}
+		}
+		if config.RetrieveNodeSpec {
+			tried := probeOptionalEndpointOnNodes(config, conn, clientSetNodeSource, probeNodes, NodeSpecEndpoint, nodeAPI.spec)
+			if conn.NodeMetrics.Unreachable(NodeSpecEndpoint) {
+				log.Warnf("Machine spec is not served by nodes [%s], it will not be collected", tried)
+			} else {
+				log.Infof("Machine spec connection method: %s", conn.NodeMetrics.Options(NodeSpecEndpoint))
+			}
+		}
+		if config.RetrieveKubeletConfigz {
+			tried := probeOptionalEndpointOnNodes(config, conn, clientSetNodeSource, probeNodes, NodeConfigzEndpoint,
+				nodeAPI.configz)
+			if conn.NodeMetrics.Unreachable(NodeConfigzEndpoint) {
+				log.Infof("Kubelet configz is unavailable from nodes [%s], it will not be collected", tried)
+			} else {
+				log.Infof("Kubelet configz connection method: %s", conn.NodeMetrics.Options(NodeConfigzEndpoint))
+			}
+		}
+		if config.RetrieveKubeletMetrics {
+			tried := probeOptionalEndpointOnNodes(config, conn, clientSetNodeSource, probeNodes, NodeKubeletMetricsEndpoint,
+				nodeAPI.kubeletMetrics)
+			if conn.NodeMetrics.Unreachable(NodeKubeletMetricsEndpoint) {
+				log.Warnf("Kubelet metrics are not served by nodes [%s], they will not be collected", tried)
+			} else {
+				log.Infof("Kubelet metrics connection method: %s",
+					conn.NodeMetrics.Options(NodeKubeletMetricsEndpoint))
+			}
+		}
+		probeExtraEndpoints(config, conn, clientSetNodeSource, probeNodes[0])
+	}
+	log.Infof("Kubelet endpoint connection methods: %s", conn.NodeMetrics)
+	return conn, nil
+}
+
+// probeOptionalEndpointOnNodes probes an optional kubelet endpoint on up to maxProbeNodes of the candidate
+// nodes, in order, until one serves it, so a single unhealthy node does not disable the endpoint. It
+// returns the names of the nodes that were probed.
+func probeOptionalEndpointOnNodes(config KubeAgentConfig, conn NodeConnection, ns NodeSource, candidates []v1.Node,
+	endpoint Endpoint, url func(nodeAPI) string) string {
+	var tried []string
+	for _, n := range candidates {
+		if len(tried) == maxProbeNodes {
+			break
+		}
+		tried = append(tried, n.Name)
+		probeOptionalEndpoint(config, conn, ns, n, endpoint, url)
+		if !conn.NodeMetrics.Unreachable(endpoint) {
+			break
+		}
+		log.Debugf("Optional kubelet endpoint %s is not served by node [%s]", endpoint, n.Name)
+	}
+	return strings.Join(tried, ", ")
+}
+
+// probeOptionalEndpoint checks the availability of an optional kubelet endpoint on the given node for the
+// connection method that was selected for node summaries. A failure leaves the endpoint unavailable, and is
+// only logged at debug as older kubelets may not serve it.
+func probeOptionalEndpoint(config KubeAgentConfig, conn NodeConnection, ns NodeSource, n v1.Node,
+	endpoint Endpoint, url func(nodeAPI) string) {
+	if conn.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) && !proxyOnlyNode(config, n) {
+		ip, port, _, err := ns.NodeAddress(&n)
+		if err == nil {
+			d := directNodeEndpoints(ip, port)
+			success, err := checkEndpointConnections(conn.NodeClient, Direct, http.MethodGet, url(d))
+			if err != nil {
+				log.Debugf("Failed to probe [%s] directly with cause [%s]", url(d), err.Error())
+			}
+			if success {
+				conn.NodeMetrics.SetAvailability(endpoint, Direct, true)
+			}
+		}
+	}
+	if conn.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
+		p := setupProxyAPI(config.ClusterHostURL, n.Name)
+		success, err := checkEndpointConnections(conn.InClusterClient, Proxy, http.MethodGet, url(p))
+		if err != nil {
+			log.Debugf("Failed to probe [%s] via proxy with cause [%s]", url(p), err.Error())
+		}
+		if success {
+			conn.NodeMetrics.SetAvailability(endpoint, Proxy, true)
+		}
+	}
+}
+
+// probeExtraEndpoints checks the availability of each extra kubelet endpoint on the given node for
+// the connection method that was selected for node summaries
+func probeExtraEndpoints(config KubeAgentConfig, conn NodeConnection, ns NodeSource, n v1.Node) {
+	for _, e := range config.extraEndpoints {
+		if conn.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) && !proxyOnlyNode(config, n) {
+			ip, port, _, err := ns.NodeAddress(&n)
+			if err == nil {
+				d := directNodeEndpoints(ip, port)
+				success, err := checkEndpointConnections(conn.NodeClient, Direct, e.Method, d.path(e.Path))
+				if err != nil {
+					log.Warnf("Failed to probe extra kubelet endpoint [%s] directly with cause [%s]",
+						d.path(e.Path), err.Error())
+				}
+				conn.NodeMetrics.SetAvailability(e.endpoint(), Direct, success)
+				if !success {
+					conn.NodeMetricsReasons.SetReason(e.endpoint(), Direct, reasonProbeFailed)
+				}
+			}
+		}
+		if conn.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
+			p := setupProxyAPI(config.ClusterHostURL, n.Name)
+			success, err := checkEndpointConnections(conn.InClusterClient, Proxy, e.Method, p.path(e.Path))
+			if err != nil {
+				log.Warnf("Failed to probe extra kubelet endpoint [%s] via proxy with cause [%s]",
+					p.path(e.Path), err.Error())
+			}
+			conn.NodeMetrics.SetAvailability(e.endpoint(), Proxy, success)
+			if !success {
+				conn.NodeMetricsReasons.SetReason(e.endpoint(), Proxy, reasonProbeFailed)
+			}
+		}
+		if r, ok := conn.relay.api(config.ClusterHostURL, n.Name); ok &&
+			conn.NodeMetrics.Available(NodeStatsSummaryEndpoint, PodProxy) {
+			success, err := checkEndpointConnections(conn.InClusterClient, PodProxy, e.Method, r.path(e.Path))
+			if err != nil {
+				log.Warnf("Failed to probe extra kubelet endpoint [%s] via stats relay with cause [%s]",
+					r.path(e.Path), err.Error())
+			}
+			conn.NodeMetrics.SetAvailability(e.endpoint(), PodProxy, success)
+			if !success {
+				conn.NodeMetricsReasons.SetReason(e.endpoint(), PodProxy, reasonProbeFailed)
+			}
+		}
+		log.Infof("Extra kubelet endpoint %s (%s) connection method: %s",
+			e.Name, e.Path, conn.NodeMetrics.Options(e.endpoint()))
+	}
+}
+
+// recordSummaryReasons records why the node summary endpoint is not retrieved over a connection method.
+// proxyOnlyNodes are the proxyNodes that never connect directly, see proxyOnlyNode.
+func recordSummaryReasons(config KubeAgentConfig, reasons EndpointReasons, directAllowed bool, nodes int,
+	proxyNodes, directNodes, proxyOnlyNodes int32) {
+	switch {
+	case !directAllowed && config.ForceKubeProxy:
+		reasons.SetReason(NodeStatsSummaryEndpoint, Direct, reasonForceKubeProxy)
+	case !directAllowed:
+		reasons.SetReason(NodeStatsSummaryEndpoint, Direct, reasonAutopilot)
+	case directNodes == 0 && int(proxyOnlyNodes) == nodes:
+		reasons.SetReason(NodeStatsSummaryEndpoint, Direct, reasonProxyOnlyNodes)
+	case directNodes == 0:
+		reasons.SetReason(NodeStatsSummaryEndpoint, Direct, reasonProbeFailed)
+	case proxyNodes > proxyOnlyNodes:
+		reasons.SetReason(NodeStatsSummaryEndpoint, Direct, reasonProxyPreferred)
+	}
+
+	if config.ForceDirect {
+		reasons.SetReason(NodeStatsSummaryEndpoint, Proxy, reasonForceDirect)
+	} else if int(directNodes) == nodes {
+		reasons.SetReason(NodeStatsSummaryEndpoint, Proxy, reasonDirectSufficient)
+	} else if proxyNodes == 0 {
+		reasons.SetReason(NodeStatsSummaryEndpoint, Proxy, reasonProbeFailed)
 	}
+}
+
+// recordRelayReason records why the node summary endpoint is not retrieved via the configured stats relay
+func recordRelayReason(reasons EndpointReasons, nodes int, kubeletNodes, relayNodes int32) {
+	if relayNodes > 0 {
+		return
+	}
+	if int(kubeletNodes) == nodes {
+		reasons.SetReason(NodeStatsSummaryEndpoint, PodProxy, reasonRelayUnneeded)
+	} else {
+		reasons.SetReason(NodeStatsSummaryEndpoint, PodProxy, reasonProbeFailed)
+	}
+}
 
-	validateConfig(config, proxyNodes, directNodes)
-	return config, nil
+// validateConfig sets the connection method of the node summaries. Nodes that never connect directly, see
+// proxyOnlyNode, are collected via proxy without keeping the other nodes from being collected directly.
+func validateConfig(nodeMetrics *EndpointMask, proxyNodes, directNodes, proxyOnlyNodes int32) {
+	setEndpointAvailability(nodeMetrics, NodeStatsSummaryEndpoint, proxyNodes-proxyOnlyNodes, directNodes)
+	if proxyOnlyNodes > 0 {
+		nodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	}
 }
 
-func validateConfig(config KubeAgentConfig, proxyNodes, directNodes int32) {
+// setEndpointAvailability sets the connection method of an endpoint from the number of nodes reached over
+// each, proxy is preferred if any node needed it
+func setEndpointAvailability(nodeMetrics *EndpointMask, endpoint Endpoint, proxyNodes, directNodes int32) {
 	if proxyNodes > 0 {
-		config.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+		nodeMetrics.SetAvailability(endpoint, Proxy, true)
 	} else if directNodes > 0 {
-		config.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+		nodeMetrics.SetAvailability(endpoint, Direct, true)
 	} else {
-		config.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, false)
-		config.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, false)
+		nodeMetrics.SetAvailability(endpoint, Proxy, false)
+		nodeMetrics.SetAvailability(endpoint, Direct, false)
 	}
 }
 
-func checkEndpointConnections(config KubeAgentConfig, client *http.Client, method Connection,
-	nodeStatSum string) (success bool, err error) {
-	ns, _, err := util.TestHTTPConnection(client, nodeStatSum, http.MethodGet, config.BearerToken, 0, false)
+// maxReportedNodeFailures is the most nodes whose failed connection attempts are named in an error
+const maxReportedNodeFailures = 10
+
+// nodeFailures collects the failed connection attempts of nodes that could not be reached by any method
+type nodeFailures struct {
+	mu       sync.Mutex
+	failures []string
+}
+
+// add records the failed connection attempts of a node
+func (f *nodeFailures) add(nodeName string, attempts []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, fmt.Sprintf("%s (%s)", nodeName, strings.Join(attempts, ", ")))
+}
+
+// String names the nodes that could not be reached and why, sorted by node name
+func (f *nodeFailures) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	failures := make([]string, len(f.failures))
+	copy(failures, f.failures)
+	sort.Strings(failures)
+	if len(failures) > maxReportedNodeFailures {
+		more := len(failures) - maxReportedNodeFailures
+		failures = append(failures[:maxReportedNodeFailures], fmt.Sprintf("and %d more nodes", more))
+	}
+	return strings.Join(failures, "; ")
+}
+
+// connectionAttempt describes a failed connection attempt, a probe that was answered without success has no
+// error
+func connectionAttempt(method Connection, err error) string {
+	if detail := tlsFailureDetail(err); detail != "" {
+		return fmt.Sprintf("%s: %s: %v", method, detail, err)
+	}
+	if err != nil {
+		return fmt.Sprintf("%s: %v", method, err)
+	}
+	return fmt.Sprintf("%s: not available", method)
+}
+
+// checkEndpointConnections probes an endpoint with the http client and credentials of the connection path
+func checkEndpointConnections(c raw.Client, method Connection, httpMethod string, nodeStatSum string) (success bool,
+	err error) {
+	ns, _, err := util.TestHTTPConnection(c.HTTPClient, nodeStatSum, httpMethod, c.Credentials, 0, false)
 	if err != nil {
 		return false, err
 	}
@@ -457,6 +1627,25 @@ func isFargateNode(n v1.Node) bool {
 	return false
 }
 
+// gkeAutopilotKey is the node label, and taint, identifying the nodes of a GKE Autopilot cluster
+const gkeAutopilotKey = "cloud.google.com/gke-autopilot"
+
+// isAutopilotNode detects whether a node belongs to a GKE Autopilot cluster, whose kubelets are not
+// reachable from pods
+func isAutopilotNode(n v1.Node) bool {
+	if _, ok := n.Labels[gkeAutopilotKey]; ok {
+		log.Debugf("GKE Autopilot node found: %s", n.Name)
+		return true
+	}
+	for _, taint := range n.Spec.Taints {
+		if taint.Key == gkeAutopilotKey {
+			log.Debugf("GKE Autopilot node found: %s", n.Name)
+			return true
+		}
+	}
+	return false
+}
+
 // allowDirectConnect determines whether the client and the
 // type of nodes in the cluster will allow retrieving data directly
 // from the node
@@ -465,55 +1654,101 @@ func allowDirectConnect(config KubeAgentConfig, nodes []v1.Node) bool {
 		log.Infof("ForceKubeProxy is set, direct node connection disabled")
 		return false
 	}
-	// Clusters may be mixed Fargate and non-Fargate.
-	// To simplify handling, we disallow direct connection
-	// if any Fargate nodes are found.
+	// Fargate nodes can not be reached directly, so are reported as unreachable rather than disabling
+	// direct connection
+	if config.ForceDirect {
+		log.Infof("ForceDirect is set, proxy node connection disabled")
+		return true
+	}
+	// Autopilot manages every node of the cluster, so none are reachable directly and probing them only
+	// delays collection
 	for _, n := range nodes {
-		if isFargateNode(n) {
-			//nolint: lll
-			log.Infof(`Direct connection to an AWS Fargate node is not possible, so when a Fargate node is detected in the cluster, the agent switches to using a proxy connection for all node connections in the cluster. 
-				The allocation of EKS Fargate tasks are not currently supported via the containers feature dashboard.
-				Please contact your technical account manager for instructions on how to access EKS Fargate information via the reporting feature.`)
+		if isAutopilotNode(n) {
+			log.Infof("Direct connection to GKE Autopilot nodes is not possible, so the nodes in the cluster " +
+				"are collected via a proxy connection")
 			return false
 		}
 	}
+	// Clusters may be mixed Fargate and non-Fargate, the connection method is decided per node so only the
+	// Fargate nodes are collected via proxy
+	fargateNodes := 0
+	for _, n := range nodes {
+		if isFargateNode(n) {
+			fargateNodes++
+		}
+	}
+	if fargateNodes > 0 {
+		//nolint: lll
+		log.Infof(`Direct connection to an AWS Fargate node is not possible, so the %d Fargate nodes in the cluster are collected via a proxy connection, other nodes are connected to directly when possible.
+			The allocation of EKS Fargate tasks are not currently supported via the containers feature dashboard.
+			Please contact your technical account manager for instructions on how to access EKS Fargate information via the reporting feature.`, fargateNodes)
+	}
 	return true
 }
 
-func retrieveNodeSummaries(ctx context.Context, config KubeAgentConfig, msd string, metricSampleDir *os.File,
-	nodeSource NodeSource) (err error) {
-
-	config.failedNodeList = map[string]error{}
+// retrieveNodeSummaries downloads node data into the sample, paced by pacer if it is not nil and recording
+// the conditions of the listed nodes in health if it is not nil, and returns the nodes that failed, and
+// the nodes collected late because they joined the cluster during collection
+func retrieveNodeSummaries(ctx context.Context, config KubeAgentConfig, cycle pollCycle, nodes NodeConnection,
+	msd string, metricSampleDir *util.WorkDir, nodeSource NodeSource, hashes *nodeDataHashes, pacer *nodePacer,
+	health *nodeHealthSnapshot) (
+	failedNodeList map[string]error, lateNodes []string, err error) {
+	start := time.Now()
 
 	// get node stats data
-	config.failedNodeList, err = downloadNodeData(ctx, "stats", config, metricSampleDir, nodeSource)
+	failedNodeList, err = downloadNodeData(ctx, sample.StatsPrefix, config, cycle, nodes, metricSampleDir,
+		nodeSource, hashes, pacer, health)
 	if err != nil {
-		return fmt.Errorf("error downloading node metrics: %s", err)
+		return nil, nil, fmt.Errorf("error downloading node metrics: %s", err)
 	}
 
-	if len(config.failedNodeList) > 0 {
-		log.Warnf("Warning failed to get node metrics: %+v", config.failedNodeList)
+	// nodes added by a scale up during a long collection would otherwise miss their first minutes of usage
+	if config.LateNodeBudget > 0 {
+		known, err := collectedNodes(msd, failedNodeList)
+		if err != nil {
+			return failedNodeList, nil, fmt.Errorf("error listing collected nodes: %s", err)
+		}
+		// nodes deferred by the node cap did not join the cluster during collection
+		for name := range health.skippedNodes() {
+			known[name] = true
+		}
+		var lateFailed map[string]error
+		lateNodes, lateFailed = collectLateNodes(ctx, config, cycle, nodes, metricSampleDir, nodeSource, known,
+			lateNodeDeadline(config, start, time.Now()))
+		for name, err := range lateFailed {
+			failedNodeList[name] = err
+		}
 	}
 
+	logFailedNodes("Warning failed to get node metrics", failedNodeList, config.FailedNodeLogLimit)
+	logSkippedNodes("Nodes not collected", health.skippedNodes())
+	logNodeReadiness("Nodes listed for collection", health.readiness())
+	logDeferredNodes(config, health.skippedNodes())
+
+	// baselines left under the previous name of a node that rejoined are moved or removed first, so the
+	// previous name does not appear in the sample as a node of its own
+	nodes.machines.relink(path.Dir(config.msExportDirectory.Name()))
+
 	// move baseline metrics for each node into sample directory
 	err = fetchNodeBaselines(msd, config.msExportDirectory.Name())
 	if err != nil {
-		return fmt.Errorf("error fetching node baseline files: %s", err)
+		return failedNodeList, lateNodes, fmt.Errorf("error fetching node baseline files: %s", err)
 	}
 
 	// update node baselines with current sample
 	err = updateNodeBaselines(msd, config.msExportDirectory.Name())
 	if err != nil {
-		return fmt.Errorf("error updating node baseline files: %s", err)
+		return failedNodeList, lateNodes, fmt.Errorf("error updating node baseline files: %s", err)
 	}
-	return nil
+	return failedNodeList, lateNodes, nil
 }
 
-func buildContainersRequest() ([]byte, error) {
-	// Request all containers.
+// buildContainersRequest builds a stats/container request for all containers, with up to numStats of the
+// most recent stats retained for each
+func buildContainersRequest(numStats int) ([]byte, error) {
 	request := &cadvisorStatsRequest{
 		Subcontainers: true,
-		NumStats:      1,
+		NumStats:      numStats,
 	}
 	body, err := json.Marshal(request)
 	if err != nil {
@@ -3,21 +3,32 @@ package kubernetes
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
 
 	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
 	"github.com/onsi/gomega"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestFetchEndpoint(t *testing.T) {
@@ -25,13 +36,9 @@ func TestFetchEndpoint(t *testing.T) {
 		endpointsToFetch := map[Endpoint]bool{
 			NodeStatsSummaryEndpoint: true,
 		}
-		mask := EndpointMask{}
+		mask := NewEndpointMask()
 		// Direct method is enabled
 		mask.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
-		config := KubeAgentConfig{
-			NodeMetrics:       mask,
-			ConcurrentPollers: 10,
-		}
 		// Use Direct method for connection
 		cm := ConnectionMethod{
 			ConnType: Direct,
@@ -39,7 +46,7 @@ func TestFetchEndpoint(t *testing.T) {
 		// returns no error, so endpoint call should "succeed"
 		endpointFetcherMock := func() (filename string, err error) { return "file-name", nil }
 
-		err := fetchEndpoint(endpointsToFetch, NodeStatsSummaryEndpoint, config, cm, endpointFetcherMock)
+		err := fetchEndpoint(endpointsToFetch, NodeStatsSummaryEndpoint, mask, cm, endpointFetcherMock)
 		if err != nil {
 			t.Errorf("unexpected error: %v", err)
 		}
@@ -54,12 +61,8 @@ func TestFetchEndpoint(t *testing.T) {
 		endpointsToFetch := map[Endpoint]bool{
 			NodeStatsSummaryEndpoint: true,
 		}
-		mask := EndpointMask{}
+		mask := NewEndpointMask()
 		mask.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
-		config := KubeAgentConfig{
-			NodeMetrics:       mask,
-			ConcurrentPollers: 10,
-		}
 		cm := ConnectionMethod{
 			ConnType: Direct,
 		}
@@ -68,7 +71,7 @@ func TestFetchEndpoint(t *testing.T) {
 			return "", fmt.Errorf("whoa there buddy you can't fetch that there endpoint pardner")
 		}
 
-		err := fetchEndpoint(endpointsToFetch, NodeStatsSummaryEndpoint, config, cm, endpointFetcherFunc)
+		err := fetchEndpoint(endpointsToFetch, NodeStatsSummaryEndpoint, mask, cm, endpointFetcherFunc)
 		if err == nil {
 			t.Error("expected error to occur when endpointFetcherFunc returns an error")
 		}
@@ -82,13 +85,9 @@ func TestFetchEndpoint(t *testing.T) {
 		endpointsToFetch := map[Endpoint]bool{
 			NodeStatsSummaryEndpoint: true,
 		}
-		mask := EndpointMask{}
+		mask := NewEndpointMask()
 		// only proxy is available
 		mask.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
-		config := KubeAgentConfig{
-			NodeMetrics:       mask,
-			ConcurrentPollers: 10,
-		}
 		// try to fetch via Direct
 		cm := ConnectionMethod{
 			ConnType: Direct,
@@ -98,7 +97,7 @@ func TestFetchEndpoint(t *testing.T) {
 			return "", fmt.Errorf("whoa there buddy you can't fetch that there endpoint pardner")
 		}
 
-		err := fetchEndpoint(endpointsToFetch, NodeStatsSummaryEndpoint, config, cm, endpointFetcherMock)
+		err := fetchEndpoint(endpointsToFetch, NodeStatsSummaryEndpoint, mask, cm, endpointFetcherMock)
 		if err != nil {
 			t.Errorf("should not have error because endpointFetcherMock shouldn't have been called: %v", err)
 		}
@@ -115,6 +114,12 @@ var fargateLabels = map[string]string{
 	"beta.kubernetes.io/os":          "linux",
 }
 
+// labels found on a GKE Autopilot node
+var autopilotLabels = map[string]string{
+	"cloud.google.com/gke-autopilot": "true",
+	"kubernetes.io/os":               "linux",
+}
+
 // labels found on a generic node
 var nodeSampleLabels = map[string]string{
 	"beta.kubernetes.io/os":          "linux",
@@ -179,15 +184,14 @@ func TestEnsureNodeSource(t *testing.T) {
 			HTTPClient:           http.Client{},
 			CollectionRetryLimit: 0,
 			ConcurrentPollers:    10,
-			NodeMetrics:          EndpointMask{},
 		}
-		ka, err := ensureNodeSource(context.TODO(), ka)
+		nodes, err := ensureNodeSource(context.TODO(), ka, nil)
 		if err != nil {
 			t.Errorf("unexpected error: %v", err)
 		}
-		if !ka.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
+		if !nodes.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
 			t.Errorf("Expected direct node retrieval method but got %v: %v",
-				ka.NodeMetrics.Options(NodeStatsSummaryEndpoint),
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint),
 				err)
 			return
 		}
@@ -203,20 +207,52 @@ func TestEnsureNodeSource(t *testing.T) {
 			HTTPClient:           http.Client{},
 			CollectionRetryLimit: 0,
 			ConcurrentPollers:    10,
-			NodeMetrics:          EndpointMask{},
 		}
-		ka, err := ensureNodeSource(context.TODO(), ka)
+		nodes, err := ensureNodeSource(context.TODO(), ka, nil)
 		if err != nil {
 			t.Errorf("unexpected error: %v", err)
 		}
-		if !ka.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
+		if !nodes.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
 			t.Errorf("Expected direct node retrieval method but got %v: %v",
-				ka.NodeMetrics.Options(NodeStatsSummaryEndpoint),
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint),
 				err)
 			return
 		}
 	})
 
+	t.Run("Ensure a node reporting kubelet port 0 does not decide the connection method", func(t *testing.T) {
+		ts := launchTLSTestServer(nil)
+		defer ts.Close()
+		listed, err := NewTestClientWithNodes(ts, nodeSampleLabels, 2).CoreV1().Nodes().List(context.TODO(),
+			metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first node listed reports no port, so it would be probed on a port nothing serves
+		listed.Items[0].Status.DaemonEndpoints.KubeletEndpoint.Port = 0
+		cs := fake.NewSimpleClientset(&listed.Items[0], &listed.Items[1])
+		ka := KubeAgentConfig{
+			Clientset:            cs,
+			CollectionRetryLimit: 0,
+			ConcurrentPollers:    10,
+			// the zero port node is reachable via proxy, which would otherwise be used for every node
+			ClusterHostURL: "https://" + ts.Listener.Addr().String(),
+			HTTPClient: http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				// nolint gosec
+				InsecureSkipVerify: true,
+			},
+			}},
+		}
+		nodes, err := ensureNodeSource(context.TODO(), ka, nil)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint) != "direct" {
+			t.Errorf("Expected direct node retrieval method but got %v",
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint))
+		}
+	})
+
 	t.Run("Ensure proxy on mix of node direct and proxy", func(t *testing.T) {
 		returnCodes := []int{200, 400, 200}
 		ts := launchTLSTestServer(returnCodes)
@@ -226,7 +262,6 @@ func TestEnsureNodeSource(t *testing.T) {
 			Clientset:            cs,
 			CollectionRetryLimit: 0,
 			ConcurrentPollers:    10,
-			NodeMetrics:          EndpointMask{},
 			ClusterHostURL:       "https://" + ts.Listener.Addr().String(),
 			// The proxy connection method uses the config http client
 			HTTPClient: http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
@@ -235,25 +270,88 @@ func TestEnsureNodeSource(t *testing.T) {
 			},
 			}},
 		}
-		ka, err := ensureNodeSource(context.TODO(), ka)
+		nodes, err := ensureNodeSource(context.TODO(), ka, nil)
 		if err != nil {
 			t.Errorf("unexpected error: %v", err)
 		}
-		if ka.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
+		if nodes.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
 			t.Errorf("Expected proxy node retrieval method but got %v: %v",
-				ka.NodeMetrics.Options(NodeStatsSummaryEndpoint),
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint),
 				err)
 			return
 		}
 
-		if !ka.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
+		if !nodes.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
 			t.Errorf("Expected proxy node retrieval method but got %v: %v",
-				ka.NodeMetrics.Options(NodeStatsSummaryEndpoint),
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint),
 				err)
 			return
 		}
 	})
 
+	t.Run("Ensure force direct never falls back to proxy", func(t *testing.T) {
+		// the second node fails directly for its summary and resource metrics, the proxy would succeed
+		returnCodes := []int{200, 400, 400}
+		ts := launchTLSTestServer(returnCodes)
+		cs := NewTestClientWithNodes(ts, nodeSampleLabels, 2)
+		defer ts.Close()
+		ka := KubeAgentConfig{
+			Clientset:         cs,
+			ConcurrentPollers: 10,
+			ForceDirect:       true,
+			ClusterHostURL:    "https://" + ts.Listener.Addr().String(),
+			HTTPClient: http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				// nolint gosec
+				InsecureSkipVerify: true,
+			},
+			}},
+		}
+		nodes, err := ensureNodeSource(context.TODO(), ka, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint) != "direct" {
+			t.Errorf("Expected direct node retrieval method only but got %v",
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint))
+		}
+		if r := nodes.NodeMetricsReasons.Reason(NodeStatsSummaryEndpoint, Proxy); r != reasonForceDirect {
+			t.Errorf("expected proxy to be disabled by config, got %q", r)
+		}
+
+		n, err := cs.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cm := range connectionOptions(ka, nodes, n.Items[0], nodeFetchData{nodeName: n.Items[0].Name},
+			NewClientsetNodeSource(cs)) {
+			if cm.ConnType == Proxy || cm.ConnType == PodProxy {
+				t.Errorf("expected no fallback connection with force direct, got %s", cm.ConnType)
+			}
+		}
+	})
+
+	t.Run("Ensure force direct fails when no node is reachable directly", func(t *testing.T) {
+		returnCodes := []int{400, 400}
+		ts := launchTLSTestServer(returnCodes)
+		cs := NewTestClient(ts, nodeSampleLabels)
+		defer ts.Close()
+		ka := KubeAgentConfig{
+			Clientset:         cs,
+			ConcurrentPollers: 10,
+			ForceDirect:       true,
+			ClusterHostURL:    "https://" + ts.Listener.Addr().String(),
+			HTTPClient: http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				// nolint gosec
+				InsecureSkipVerify: true,
+			},
+			}},
+		}
+		_, err := ensureNodeSource(context.TODO(), ka, nil)
+		if !errors.Is(err, FatalNodeError) || !strings.Contains(err.Error(), "force_direct") {
+			t.Errorf("expected a fatal node error naming force direct, got %v", err)
+		}
+	})
+
 	t.Run("Ensure all needed clients function when multiple methods are set", func(t *testing.T) {
 		// Two endpoints will succeed both times, but stats summary will fail on direct
 		directConnectionAttempts := []int{200}
@@ -272,31 +370,27 @@ func TestEnsureNodeSource(t *testing.T) {
 			}},
 			ClusterHostURL:    "https://" + ts.Listener.Addr().String(),
 			ConcurrentPollers: 10,
-			NodeMetrics:       EndpointMask{},
-			// just populate some dummy fields here to ensure neither client gets unset
-			InClusterClient: raw.NewClient(http.Client{}, true, "token", "", 0, false),
-			NodeClient:      raw.NewClient(http.Client{}, true, "token", "", 0, false),
 		}
 
-		ka, err := ensureNodeSource(context.TODO(), ka)
+		nodes, err := ensureNodeSource(context.TODO(), ka, nil)
 		if err != nil {
 			t.Errorf("unexpected error: %v", err)
 		}
-		if ka.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
+		if nodes.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
 			t.Errorf("Expected /stats/summary to use direct, but proxy was allowed %v: %v",
-				ka.NodeMetrics.Options(NodeStatsSummaryEndpoint), err)
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint), err)
 			return
 		}
-		if !ka.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
+		if !nodes.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
 			t.Errorf("Expected Direct method but got %v: %v",
-				ka.NodeMetrics.Options(NodeStatsSummaryEndpoint), err)
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint), err)
 			return
 		}
 		// ensure that both clients are populated
-		if ka.NodeClient.HTTPClient == nil {
+		if nodes.NodeClient.HTTPClient == nil {
 			t.Errorf("Direct connection client should be populated")
 		}
-		if ka.InClusterClient.HTTPClient == nil {
+		if nodes.InClusterClient.HTTPClient == nil {
 			t.Errorf("Proxy client should be populated")
 		}
 	})
@@ -316,14 +410,13 @@ func TestEnsureNodeSource(t *testing.T) {
 			}},
 			ClusterHostURL:    "https://" + ts.Listener.Addr().String(),
 			ConcurrentPollers: 10,
-			NodeMetrics:       EndpointMask{},
 		}
 
-		ka, err := ensureNodeSource(context.TODO(), ka)
+		nodes, err := ensureNodeSource(context.TODO(), ka, nil)
 
-		if !ka.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
+		if !nodes.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
 			t.Errorf("Expected stats/summary to proxy direct method but got %v: %v",
-				ka.NodeMetrics.Options(NodeStatsSummaryEndpoint), err)
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint), err)
 			return
 		}
 	})
@@ -338,17 +431,38 @@ func TestEnsureNodeSource(t *testing.T) {
 			HTTPClient:           http.Client{},
 			CollectionRetryLimit: 0,
 			ConcurrentPollers:    10,
-			NodeMetrics:          EndpointMask{},
 		}
-		ka, err := ensureNodeSource(context.TODO(), ka)
+		nodes, err := ensureNodeSource(context.TODO(), ka, nil)
 
-		if !ka.NodeMetrics.Unreachable(NodeStatsSummaryEndpoint) {
+		if !nodes.NodeMetrics.Unreachable(NodeStatsSummaryEndpoint) {
 			t.Errorf("Expected Unreachable but got %v: %v",
-				ka.NodeMetrics.Options(NodeStatsSummaryEndpoint), err)
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint), err)
 			return
 		}
 	})
 
+	t.Run("Ensure an unreachable cluster names each node that was tried", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		cs := NewTestClientWithNodes(ts, nodeSampleLabels, 2)
+		defer ts.Close()
+		ka := KubeAgentConfig{
+			Clientset:         cs,
+			HTTPClient:        http.Client{},
+			ConcurrentPollers: 10,
+		}
+		_, err := ensureNodeSource(context.TODO(), ka, nil)
+		if !errors.Is(err, FatalNodeError) {
+			t.Fatalf("expected a fatal node error, got %v", err)
+		}
+		for _, name := range []string{"proxyNode.0 (direct: not available, proxy: ", "proxyNode.1 (direct: "} {
+			if !strings.Contains(err.Error(), name) {
+				t.Errorf("expected the error to contain %q, got %v", name, err)
+			}
+		}
+	})
+
 	t.Run("Ensure Fargate node forces proxy connection", func(t *testing.T) {
 		returnCodes := []int{200, 200}
 		ts := launchTLSTestServer(returnCodes)
@@ -362,22 +476,49 @@ func TestEnsureNodeSource(t *testing.T) {
 			}},
 			ClusterHostURL:    "https://" + ts.Listener.Addr().String(),
 			ConcurrentPollers: 10,
-			NodeMetrics:       EndpointMask{},
 		}
-		ka, err := ensureNodeSource(context.TODO(), ka)
+		nodes, err := ensureNodeSource(context.TODO(), ka, nil)
 
-		if ka.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
+		if nodes.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
 			t.Errorf("Direct connection should not be enabled with fargate nodes present")
 		}
-		if !ka.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) || err != nil {
+		if !nodes.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) || err != nil {
 			t.Errorf("Expected proxy node retrieval method for Fargate node but got %v. Error: %v, Config: %+v",
-				ka.NodeMetrics.Options(NodeStatsSummaryEndpoint),
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint),
 				err,
 				ka)
 			return
 		}
 	})
 
+	t.Run("Ensure GKE Autopilot nodes are collected via proxy without probing them directly", func(t *testing.T) {
+		returnCodes := []int{200, 200}
+		ts := launchTLSTestServer(returnCodes)
+		cs := NewTestClient(ts, autopilotLabels)
+		ka := KubeAgentConfig{
+			Clientset: cs,
+			HTTPClient: http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				// nolint gosec
+				InsecureSkipVerify: true,
+			},
+			}},
+			ClusterHostURL:    "https://" + ts.Listener.Addr().String(),
+			ConcurrentPollers: 10,
+		}
+		nodes, err := ensureNodeSource(context.TODO(), ka, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodes.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) ||
+			!nodes.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
+			t.Errorf("expected only proxy node retrieval on GKE Autopilot, got %v",
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint))
+		}
+		if r := nodes.NodeMetricsReasons.Reason(NodeStatsSummaryEndpoint, Direct); r != reasonAutopilot {
+			t.Errorf("expected direct connection to be reported as not possible, got %q", r)
+		}
+	})
+
 	t.Run("Ensure config flag forces proxy connection", func(t *testing.T) {
 		returnCodes := []int{200, 200}
 		ts := launchTLSTestServer(returnCodes)
@@ -392,15 +533,14 @@ func TestEnsureNodeSource(t *testing.T) {
 			ClusterHostURL:    "https://" + ts.Listener.Addr().String(),
 			ForceKubeProxy:    true,
 			ConcurrentPollers: 10,
-			NodeMetrics:       EndpointMask{},
 		}
-		ka, err := ensureNodeSource(context.TODO(), ka)
-		if ka.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
+		nodes, err := ensureNodeSource(context.TODO(), ka, nil)
+		if nodes.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
 			t.Errorf("Direct connection should not be enabled with force proxy flag set")
 		}
-		if !ka.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) || err != nil {
+		if !nodes.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) || err != nil {
 			t.Errorf("Expected proxy node retrieval method with force_kube_proxy flag set, but got %v. Error: %v, Config: %+v",
-				ka.NodeMetrics.Options(NodeStatsSummaryEndpoint),
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint),
 				err,
 				ka)
 			return
@@ -451,6 +591,41 @@ func TestFargateNodeDetection(t *testing.T) {
 
 }
 
+func TestAutopilotNodeDetection(t *testing.T) {
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		taints    []v1.Taint
+		autopilot bool
+	}{
+		{name: "generic node", labels: nodeSampleLabels},
+		{name: "Fargate node", labels: fargateLabels},
+		{name: "Autopilot label", labels: autopilotLabels, autopilot: true},
+		{name: "Autopilot taint", labels: nodeSampleLabels, autopilot: true,
+			taints: []v1.Taint{{Key: "cloud.google.com/gke-autopilot", Effect: v1.TaintEffectNoSchedule}}},
+		{name: "other taint", labels: nodeSampleLabels,
+			taints: []v1.Taint{{Key: "cloud.google.com/gke-spot", Effect: v1.TaintEffectNoSchedule}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: tt.labels},
+				Spec:       v1.NodeSpec{Taints: tt.taints},
+			}
+			if got := isAutopilotNode(n); got != tt.autopilot {
+				t.Errorf("expected Autopilot node %v, got %v", tt.autopilot, got)
+			}
+			generic := v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "generic", Labels: nodeSampleLabels}}
+			if got := allowDirectConnect(KubeAgentConfig{}, []v1.Node{generic, n}); got == tt.autopilot {
+				t.Errorf("expected direct connection allowed %v, got %v", !tt.autopilot, got)
+			}
+			if !allowDirectConnect(KubeAgentConfig{ForceDirect: true}, []v1.Node{n}) {
+				t.Error("expected force_direct to allow direct connection")
+			}
+		})
+	}
+}
+
 func TestDownloadNodeData(t *testing.T) {
 	returnCodes := []int{200, 200, 200, 400, 400, 400, 200, 200, 200, 400}
 	ts := launchTLSTestServer(returnCodes)
@@ -458,13 +633,18 @@ func TestDownloadNodeData(t *testing.T) {
 	defer ts.Close()
 
 	t.Run("Ensure node added to fail list when providerID doesn't exist", func(t *testing.T) {
-		ed, ns, ka := setupTestNodeDownloaderClients(ts, cs, 1)
+		ed, ns, ka, nodes := setupTestNodeDownloaderClients(ts, cs, 1)
 		failedNodeList, _ := downloadNodeData(
 			context.TODO(),
 			"baseline",
 			ka,
+			pollCycle{},
+			nodes,
 			ed,
 			ns,
+			nil,
+			nil,
+			nil,
 		)
 
 		errFromList, ok := failedNodeList["proxyNode"]
@@ -478,16 +658,35 @@ func TestDownloadNodeData(t *testing.T) {
 		}
 	})
 
+	t.Run("Ensure node without providerID is not failed in development mode", func(t *testing.T) {
+		ts := launchTLSTestServer([]int{200, 200, 200, 200, 200, 200, 200, 200, 200, 200})
+		defer ts.Close()
+		ed, ns, ka, nodes := setupTestNodeDownloaderClients(ts, NewTestClient(ts, nodeSampleLabels), 1)
+		ka.Dev = true
+		failedNodeList, err := downloadNodeData(context.TODO(), "baseline", ka, pollCycle{}, nodes, ed, ns, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if errFromList, ok := failedNodeList["proxyNode"]; ok {
+			t.Errorf("expected proxyNode not to fail, got %v", errFromList)
+		}
+	})
+
 	t.Run("Ensure error is returned when GetReadyNodes returns error", func(t *testing.T) {
-		ed, _, ka := setupTestNodeDownloaderClients(ts, cs, 1)
+		ed, _, ka, nodes := setupTestNodeDownloaderClients(ts, cs, 1)
 		ns := testNodeSource{}
 
 		_, err := downloadNodeData(
 			context.TODO(),
 			"baseline",
 			ka,
+			pollCycle{},
+			nodes,
 			ed,
 			ns,
+			nil,
+			nil,
+			nil,
 		)
 
 		if err == nil {
@@ -518,13 +717,18 @@ func TestDownloadNodeDataRetries(t *testing.T) {
 
 	t.Run("should honor max collection retry limit", func(t *testing.T) {
 		var maxRetry uint = 1
-		ed, ns, ka := setupTestNodeDownloaderClients(ts, cs, maxRetry)
+		ed, ns, ka, nodes := setupTestNodeDownloaderClients(ts, cs, maxRetry)
 		failedNodeList, err := downloadNodeData(
 			context.TODO(),
 			"baseline",
 			ka,
+			pollCycle{},
+			nodes,
 			ed,
 			ns,
+			nil,
+			nil,
+			nil,
 		)
 		g.Expect(err).To(gomega.BeNil())
 		// just one node in the list to attempt fetch from
@@ -554,8 +758,8 @@ func (tns testNodeSource) GetReadyNodes(ctx context.Context) ([]v1.Node, error)
 	return nodes, nil
 }
 
-func (tns testNodeSource) NodeAddress(node *v1.Node) (string, int32, error) {
-	return "", int32(0), nil
+func (tns testNodeSource) NodeAddress(node *v1.Node) (string, int32, v1.NodeAddressType, error) {
+	return "", int32(0), v1.NodeInternalIP, nil
 }
 
 // launchTLSTestServer takes a slice of http status codes (int) to return
@@ -575,7 +779,7 @@ func launchTLSTestServer(responseCodes []int) *httptest.Server {
 // for testing node downloads
 func setupTestNodeDownloaderClients(ts *httptest.Server,
 	cs *fake.Clientset,
-	retries uint) (*os.File, testNodeSource, KubeAgentConfig) {
+	retries uint) (*util.WorkDir, testNodeSource, KubeAgentConfig, NodeConnection) {
 	c := http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
@@ -586,24 +790,25 @@ func setupTestNodeDownloaderClients(ts *httptest.Server,
 	rc := raw.NewClient(
 		c,
 		true,
-		"",
-		"",
+		nil,
 		retries,
 		false,
 	)
 	ka := KubeAgentConfig{
 		Clientset:            cs,
 		HTTPClient:           c,
-		InClusterClient:      rc,
 		ClusterHostURL:       "https://" + ts.Listener.Addr().String(),
 		ConcurrentPollers:    10,
 		CollectionRetryLimit: retries,
 	}
-	ka.NodeMetrics = EndpointMask{}
-	ka.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	nodes := NodeConnection{
+		InClusterClient: rc,
+		NodeMetrics:     NewEndpointMask(),
+	}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
 
 	wd, _ := os.Getwd()
-	ed, _ := os.Open(fmt.Sprintf("%s/testdata", wd))
+	ed := util.NewWorkDir(fmt.Sprintf("%s/testdata", wd))
 
 	ns := testNodeSource{}
 
@@ -635,5 +840,1047 @@ func setupTestNodeDownloaderClients(ts *httptest.Server,
 			},
 		},
 	}
-	return ed, ns, ka
+	return ed, ns, ka, nodes
+}
+
+func TestRecordSummaryReasons(t *testing.T) {
+	tests := []struct {
+		name           string
+		forceKubeProxy bool
+		directAllowed  bool
+		proxyNodes     int32
+		directNodes    int32
+		fargateNodes   int32
+		direct         string
+		proxy          string
+	}{
+		{"force kube proxy", true, false, 2, 0, 0, reasonForceKubeProxy, ""},
+		{"GKE Autopilot", false, false, 2, 0, 0, reasonAutopilot, ""},
+		{"only fargate nodes", false, true, 2, 0, 2, reasonProxyOnlyNodes, ""},
+		{"direct probe failed", false, true, 2, 0, 0, reasonProbeFailed, ""},
+		{"mixed direct and proxy", false, true, 1, 1, 0, reasonProxyPreferred, ""},
+		{"mixed direct and fargate", false, true, 1, 1, 1, "", ""},
+		{"all direct", false, true, 0, 2, 0, "", reasonDirectSufficient},
+		{"nothing reachable", false, true, 0, 0, 0, reasonProbeFailed, reasonProbeFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := KubeAgentConfig{ForceKubeProxy: tt.forceKubeProxy}
+			reasons := EndpointReasons{}
+			recordSummaryReasons(config, reasons, tt.directAllowed, 2, tt.proxyNodes, tt.directNodes,
+				tt.fargateNodes)
+
+			if r := reasons.Reason(NodeStatsSummaryEndpoint, Direct); r != tt.direct {
+				t.Errorf("expected direct reason %q but got %q", tt.direct, r)
+			}
+			if r := reasons.Reason(NodeStatsSummaryEndpoint, Proxy); r != tt.proxy {
+				t.Errorf("expected proxy reason %q but got %q", tt.proxy, r)
+			}
+		})
+	}
+}
+
+func TestRetrieveNodeDataStalledResponse(t *testing.T) {
+	// the direct connection stalls mid-body, the proxy responds promptly
+	var proxyRequests int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(r.URL.Path, "/api/v1/nodes/") {
+			proxyRequests++
+			fmt.Fprint(w, `{"node":{"nodeName":"node0"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"node":`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestRetrieveNodeDataStalledResponse")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 0, false)
+	rc.StallTimeout = 100 * time.Millisecond
+	nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+
+	host, port, _ := strings.Cut(ts.Listener.Addr().String(), ":")
+	n := addressedNode("node0", host)
+	p, _ := strconv.Atoi(port)
+	n.Status.DaemonEndpoints.KubeletEndpoint.Port = int32(p)
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	config := KubeAgentConfig{ClusterHostURL: ts.URL}
+	nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir}
+
+	t.Run("Ensure a stalled response on every connection is returned", func(t *testing.T) {
+		err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, n)
+		if !errors.Is(err, raw.ErrResponseStalled) {
+			t.Errorf("expected the response to stall, got %v", err)
+		}
+		failed := map[string]error{"node0": fmt.Errorf("node metrics retrieval problem occurred: %w", err)}
+		if stalled := countStalledNodes(failed); stalled != 1 {
+			t.Errorf("expected the node to be reported as stalled, got %d", stalled)
+		}
+	})
+
+	t.Run("Ensure a stalled response is retried via the other connection", func(t *testing.T) {
+		nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+		if err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, n); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if proxyRequests != 1 {
+			t.Errorf("expected the summary to be fetched via the proxy, got %d proxy requests", proxyRequests)
+		}
+	})
+}
+
+func TestResourceMetricsSubstitute(t *testing.T) {
+	// the kubelet no longer serves its summary, only the resource metrics
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/metrics/resource") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "node_cpu_usage_seconds_total 1\n")
+	}))
+	defer ts.Close()
+
+	t.Run("Ensure a node serving only resource metrics is collectible", func(t *testing.T) {
+		ka := KubeAgentConfig{
+			Clientset:         NewTestClient(ts, nodeSampleLabels),
+			HTTPClient:        http.Client{},
+			ConcurrentPollers: 10,
+		}
+		nodes, err := ensureNodeSource(context.TODO(), ka, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !nodes.NodeMetrics.Unreachable(NodeStatsSummaryEndpoint) {
+			t.Errorf("expected the summary to be unreachable, got %s",
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint))
+		}
+		if !nodes.NodeMetrics.DirectAllowed(NodeResourceMetricsEndpoint) {
+			t.Errorf("expected direct resource metrics, got %s",
+				nodes.NodeMetrics.Options(NodeResourceMetricsEndpoint))
+		}
+	})
+
+	t.Run("Ensure resource metrics are fetched in place of a failed summary", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "TestResourceMetricsSubstitute")
+		if err != nil {
+			t.Fatalf("error creating temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		workDir := util.NewWorkDir(dir)
+
+		c := http.Client{Transport: &http.Transport{
+			// nolint gosec
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		rc := raw.NewClient(c, true, nil, 0, false)
+		nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+		nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+		nodes.NodeMetrics.SetAvailability(NodeResourceMetricsEndpoint, Direct, true)
+
+		host, port, _ := strings.Cut(ts.Listener.Addr().String(), ":")
+		n := addressedNode("node0", host)
+		p, _ := strconv.Atoi(port)
+		n.Status.DaemonEndpoints.KubeletEndpoint.Port = int32(p)
+		ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+		hashes := newNodeDataHashes()
+		nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir, hashes: hashes}
+
+		err = retrieveNodeData(context.TODO(), nd, KubeAgentConfig{ClusterHostURL: ts.URL}, pollCycle{}, nodes, ns, n)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "stats-resource_metrics-node0.txt")); err != nil {
+			t.Errorf("expected the resource metrics to be written: %v", err)
+		}
+		if hashes.all()["stats-resource_metrics-node0.txt"] == "" {
+			t.Error("expected the resource metrics to be hashed")
+		}
+
+		// the namespace profile keeps no pod level detail, so has nothing in place of the summary
+		config := KubeAgentConfig{ClusterHostURL: ts.URL, CollectionProfile: sample.ProfileNamespace}
+		if err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, n); err == nil {
+			t.Error("expected the failed summary to be returned with the namespace profile")
+		}
+	})
+}
+
+func TestProbeOptionalEndpointOnNodes(t *testing.T) {
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 0, false)
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	config := KubeAgentConfig{RetrieveProbeMetrics: true}
+
+	// each node is served by its own kubelet, only those serving probes succeed
+	kubelet := func(name string, servesProbes bool) v1.Node {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !servesProbes {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		t.Cleanup(ts.Close)
+		host, port, _ := strings.Cut(ts.Listener.Addr().String(), ":")
+		n := addressedNode(name, host)
+		p, _ := strconv.Atoi(port)
+		n.Status.DaemonEndpoints.KubeletEndpoint.Port = int32(p)
+		return n
+	}
+	newConnection := func() NodeConnection {
+		nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+		nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+		return nodes
+	}
+
+	t.Run("Ensure a failing first node falls through to the next", func(t *testing.T) {
+		nodes := newConnection()
+		candidates := []v1.Node{kubelet("node0", false), kubelet("node1", true), kubelet("node2", true)}
+		tried := probeOptionalEndpointOnNodes(config, nodes, ns, candidates, NodeProbeMetricsEndpoint,
+			nodeAPI.metricsProbes)
+		if tried != "node0, node1" {
+			t.Errorf("expected node0 and node1 to be probed, got %s", tried)
+		}
+		if !nodes.NodeMetrics.DirectAllowed(NodeProbeMetricsEndpoint) {
+			t.Errorf("expected direct probe metrics, got %s", nodes.NodeMetrics.Options(NodeProbeMetricsEndpoint))
+		}
+	})
+
+	t.Run("Ensure at most maxProbeNodes are probed", func(t *testing.T) {
+		nodes := newConnection()
+		candidates := []v1.Node{kubelet("node0", false), kubelet("node1", false), kubelet("node2", false),
+			kubelet("node3", true)}
+		tried := probeOptionalEndpointOnNodes(config, nodes, ns, candidates, NodeProbeMetricsEndpoint,
+			nodeAPI.metricsProbes)
+		if tried != "node0, node1, node2" {
+			t.Errorf("expected the first %d nodes to be probed, got %s", maxProbeNodes, tried)
+		}
+		if !nodes.NodeMetrics.Unreachable(NodeProbeMetricsEndpoint) {
+			t.Errorf("expected no probe metrics, got %s", nodes.NodeMetrics.Options(NodeProbeMetricsEndpoint))
+		}
+	})
+}
+
+func TestProbeMetrics(t *testing.T) {
+	var probesServed atomic.Bool
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/metrics/probes") && !probesServed.Load() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"node":{"nodeName":"node0"}}`)
+	}))
+	defer ts.Close()
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 0, false)
+	host, port, _ := strings.Cut(ts.Listener.Addr().String(), ":")
+	n := addressedNode("node0", host)
+	p, _ := strconv.Atoi(port)
+	n.Status.DaemonEndpoints.KubeletEndpoint.Port = int32(p)
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, RetrieveProbeMetrics: true}
+
+	newConnection := func() NodeConnection {
+		nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+		nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+		return nodes
+	}
+
+	t.Run("Ensure a kubelet without probe metrics leaves the endpoint unset", func(t *testing.T) {
+		nodes := newConnection()
+		probeOptionalEndpoint(config, nodes, ns, n, NodeProbeMetricsEndpoint, nodeAPI.metricsProbes)
+		if mask := nodes.NodeMetrics.String(); mask != "/stats/summary:direct" {
+			t.Errorf("expected no probe metrics availability, got %s", mask)
+		}
+	})
+
+	t.Run("Ensure probe metrics are collected with each sample", func(t *testing.T) {
+		probesServed.Store(true)
+		nodes := newConnection()
+		probeOptionalEndpoint(config, nodes, ns, n, NodeProbeMetricsEndpoint, nodeAPI.metricsProbes)
+		if !nodes.NodeMetrics.DirectAllowed(NodeProbeMetricsEndpoint) {
+			t.Fatalf("expected direct probe metrics, got %s", nodes.NodeMetrics.Options(NodeProbeMetricsEndpoint))
+		}
+
+		dir, err := os.MkdirTemp("", "TestProbeMetrics")
+		if err != nil {
+			t.Fatalf("error creating temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		workDir := util.NewWorkDir(dir)
+
+		for _, prefix := range []string{sample.StatsPrefix, sample.BaselinePrefix} {
+			nd := nodeFetchData{nodeName: "node0", prefix: prefix, workDir: workDir}
+			if err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, n); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, "stats-probes-node0.json")); err != nil {
+			t.Errorf("expected the probe metrics to be written: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "baseline-probes-node0.json")); !os.IsNotExist(err) {
+			t.Errorf("expected no probe metrics baseline, got %v", err)
+		}
+	})
+}
+
+func TestRetrieveKubeletPods(t *testing.T) {
+	pods := `{"kind":"PodList","items":[` + strings.Repeat(`{"metadata":{"name":"p"}},`, 1000) + `{}]}`
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/pods") {
+			fmt.Fprint(w, pods)
+			return
+		}
+		fmt.Fprint(w, `{"node":{"nodeName":"node0"}}`)
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestRetrieveKubeletPods")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 0, false)
+	nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	nodes.NodeMetrics.SetAvailability(NodePodsEndpoint, Proxy, true)
+	n := addressedNode("node0", "10.0.0.1")
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir}
+	podsFile := filepath.Join(dir, "stats-pods-node0.json")
+
+	t.Run("Ensure kubelet pods are written to per node files", func(t *testing.T) {
+		config := KubeAgentConfig{ClusterHostURL: ts.URL, ForceKubeProxy: true, RetrieveKubeletPods: true}
+		if err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, n); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, err := os.ReadFile(podsFile)
+		if err != nil || string(data) != pods {
+			t.Errorf("expected the kubelet pods to be written, got %d bytes %v", len(data), err)
+		}
+		if err := os.Remove(podsFile); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Ensure kubelet pods over the size limit are discarded", func(t *testing.T) {
+		config := KubeAgentConfig{ClusterHostURL: ts.URL, ForceKubeProxy: true, RetrieveKubeletPods: true,
+			KubeletPodsMaxBytes: 1024}
+		if err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, n); err != nil {
+			t.Fatalf("expected the summary to be collected regardless, got %v", err)
+		}
+		if _, err := os.Stat(podsFile); !os.IsNotExist(err) {
+			t.Errorf("expected oversized kubelet pods to be removed: %v", err)
+		}
+	})
+}
+
+func TestRetrieveNodeSpec(t *testing.T) {
+	spec := `{"num_cores":4,"memory_capacity":16777216}`
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/spec/") {
+			fmt.Fprint(w, spec)
+			return
+		}
+		fmt.Fprint(w, `{"node":{"nodeName":"node0"}}`)
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestRetrieveNodeSpec")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 0, false)
+	nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	nodes.NodeMetrics.SetAvailability(NodeSpecEndpoint, Proxy, true)
+	n := addressedNode("node0", "10.0.0.1")
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir}
+	specFile := filepath.Join(dir, "stats-spec-node0.json")
+
+	t.Run("Ensure the node spec is written when due", func(t *testing.T) {
+		config := KubeAgentConfig{ClusterHostURL: ts.URL, ForceKubeProxy: true, RetrieveNodeSpec: true}
+		cycle := pollCycle{nodeSpecDue: true}
+		if err := retrieveNodeData(context.TODO(), nd, config, cycle, nodes, ns, n); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, err := os.ReadFile(specFile)
+		if err != nil || string(data) != spec {
+			t.Errorf("expected the node spec to be written, got %q %v", data, err)
+		}
+		if err := os.Remove(specFile); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Ensure the node spec is not written between intervals", func(t *testing.T) {
+		config := KubeAgentConfig{ClusterHostURL: ts.URL, ForceKubeProxy: true, RetrieveNodeSpec: true}
+		if err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, n); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(specFile); !os.IsNotExist(err) {
+			t.Errorf("expected no node spec when not due: %v", err)
+		}
+	})
+}
+
+func TestRetrieveKubeletConfigz(t *testing.T) {
+	configz := `{"kubeletconfig":{"evictionHard":{"memory.available":"100Mi"}}}`
+	var configzStatus int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/configz") {
+			if configzStatus != http.StatusOK {
+				w.WriteHeader(configzStatus)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, configz)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"node":{"nodeName":"node0"}}`)
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestRetrieveKubeletConfigz")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 0, false)
+	nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	nodes.NodeMetrics.SetAvailability(NodeConfigzEndpoint, Proxy, true)
+	n := addressedNode("node0", "10.0.0.1")
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir}
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, ForceKubeProxy: true, RetrieveKubeletConfigz: true}
+	configzFile := filepath.Join(dir, "stats-configz-node0.json")
+
+	t.Run("Ensure the kubelet configz is written alongside the stats", func(t *testing.T) {
+		configzStatus = http.StatusOK
+		if err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, n); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, err := os.ReadFile(configzFile)
+		if err != nil || string(data) != configz {
+			t.Errorf("expected the kubelet configz to be written, got %q %v", data, err)
+		}
+		if err := os.Remove(configzFile); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Ensure a refused or missing configz does not fail the node", func(t *testing.T) {
+		for _, status := range []int{http.StatusForbidden, http.StatusNotFound, http.StatusInternalServerError} {
+			configzStatus = status
+			if err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, n); err != nil {
+				t.Errorf("expected the node to be collected with a %d configz, got %v", status, err)
+			}
+			if _, err := os.Stat(configzFile); !os.IsNotExist(err) {
+				t.Errorf("expected no kubelet configz with a %d response: %v", status, err)
+			}
+		}
+	})
+
+	t.Run("Ensure only refused or missing endpoints are expected to be unavailable", func(t *testing.T) {
+		tests := []struct {
+			err      error
+			expected bool
+		}{
+			{err: raw.StatusError{StatusCode: http.StatusForbidden}, expected: true},
+			{err: fmt.Errorf("wrapped: %w", raw.StatusError{StatusCode: http.StatusNotFound}), expected: true},
+			{err: raw.StatusError{StatusCode: http.StatusUnauthorized}, expected: false},
+			{err: errors.New("unable to connect"), expected: false},
+			{err: nil, expected: false},
+		}
+		for _, tc := range tests {
+			if forbiddenOrNotFound(tc.err) != tc.expected {
+				t.Errorf("expected %v for %v", tc.expected, tc.err)
+			}
+		}
+	})
+}
+
+func TestNodeSpecDue(t *testing.T) {
+	state := newAgentState(KubeAgentConfig{}, NodeConnection{})
+	tests := []struct {
+		config KubeAgentConfig
+		due    []bool
+	}{
+		{config: KubeAgentConfig{}, due: []bool{false, false, false}},
+		{config: KubeAgentConfig{RetrieveNodeSpec: true}, due: []bool{true, true, true}},
+		{config: KubeAgentConfig{RetrieveNodeSpec: true, NodeSpecInterval: 2}, due: []bool{true, false, true}},
+	}
+	for _, tc := range tests {
+		for i, due := range tc.due {
+			if nodeSpecDue(tc.config, i) != due {
+				t.Errorf("expected collection %d due %v for %+v", i, due, tc.config)
+			}
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if c := state.startCollection(); c != i {
+			t.Errorf("expected collection %d, got %d", i, c)
+		}
+	}
+}
+
+func TestDirectNodeEndpoints(t *testing.T) {
+	endpoints := map[string]func(nodeAPI) string{
+		"/stats/summary":     nodeAPI.statsSummary,
+		"/stats/container/":  nodeAPI.statsContainer,
+		"/metrics/cadvisor":  nodeAPI.mCAdvisor,
+		"/metrics/resource":  nodeAPI.metricsResource,
+		"/metrics/probes":    nodeAPI.metricsProbes,
+		"/pods":              nodeAPI.statsPods,
+		"/spec/":             nodeAPI.spec,
+		"/configz":           nodeAPI.configz,
+		"/metrics":           nodeAPI.kubeletMetrics,
+		"/stats/summary/foo": func(api nodeAPI) string { return api.path("/stats/summary/foo") },
+	}
+	hosts := map[string]string{
+		"ipv4":     "10.0.0.1",
+		"ipv6":     "fd00::1",
+		"hostname": "ip-10-0-0-1.ec2.internal",
+	}
+	for name, host := range hosts {
+		t.Run(name, func(t *testing.T) {
+			api := directNodeEndpoints(host, 10250)
+			for path, endpoint := range endpoints {
+				u, err := url.Parse(endpoint(api))
+				if err != nil {
+					t.Fatalf("invalid %s url %s: %v", path, endpoint(api), err)
+				}
+				if u.Scheme != "https" || u.Hostname() != host || u.Port() != "10250" || u.Path != path {
+					t.Errorf("unexpected %s url %s", path, endpoint(api))
+				}
+			}
+		})
+	}
+}
+
+func TestProxyAPINodeNameEscaping(t *testing.T) {
+	// requests are sent one at a time
+	var paths []string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{}`)
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestProxyAPINodeNameEscaping")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 0, false)
+	endpoints := map[string]func(nodeAPI) string{
+		"/stats/summary":    nodeAPI.statsSummary,
+		"/stats/container/": nodeAPI.statsContainer,
+		"/metrics/cadvisor": nodeAPI.mCAdvisor,
+		"/metrics/resource": nodeAPI.metricsResource,
+		"/metrics/probes":   nodeAPI.metricsProbes,
+		"/pods":             nodeAPI.statsPods,
+		"/spec/":            nodeAPI.spec,
+	}
+
+	for _, name := range []string{"node 0", "node:0", "nöde-ü", "ops@example.com", "node/0?x=1#y"} {
+		api := setupProxyAPI(ts.URL, name)
+		for kubeletPath, endpoint := range endpoints {
+			paths = nil
+			_, err := rc.GetRawEndPoint(context.TODO(), http.MethodGet, "escaping", workDir, endpoint(api), nil, false)
+			if err != nil {
+				t.Fatalf("unexpected error for node %q: %v", name, err)
+			}
+			expected := "/api/v1/nodes/" + name + "/proxy" + kubeletPath
+			if len(paths) != 1 || paths[0] != expected {
+				t.Errorf("expected the API server to receive %q for node %q, got %q", expected, name, paths)
+			}
+		}
+	}
+
+	relay := podProxyAPI{clusterHostURL: ts.URL, namespace: "cloudability", pod: "relay 0:10255"}
+	paths = nil
+	if _, err := rc.GetRawEndPoint(context.TODO(), http.MethodGet, "escaping", workDir, relay.statsSummary(), nil,
+		false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "/api/v1/namespaces/cloudability/pods/relay 0:10255/proxy/stats/summary"; len(paths) != 1 ||
+		paths[0] != expected {
+		t.Errorf("expected the API server to receive %q for the relay pod, got %q", expected, paths)
+	}
+}
+
+func TestRetrieveNodeDataTimeout(t *testing.T) {
+	// the kubelet sleeps far longer than the node fetch timeout on every connection
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(30 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestRetrieveNodeDataTimeout")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 3, false)
+
+	host, port, _ := strings.Cut(ts.Listener.Addr().String(), ":")
+	n := addressedNode("node0", host)
+	p, _ := strconv.Atoi(port)
+	n.Status.DaemonEndpoints.KubeletEndpoint.Port = int32(p)
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, NodeFetchTimeout: 1}
+	nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir}
+
+	for name, connection := range map[string]Connection{"direct": Direct, "proxy": Proxy} {
+		t.Run(fmt.Sprintf("Ensure the %s connection is abandoned once the node times out", name),
+			func(t *testing.T) {
+				nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+				nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, connection, true)
+
+				start := time.Now()
+				err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, n)
+				if !errors.Is(err, errNodeFetchTimeout) {
+					t.Errorf("expected the node fetch to time out, got %v", err)
+				}
+				if elapsed := time.Since(start); elapsed > 5*time.Second {
+					t.Errorf("expected the node to be abandoned at its timeout, took %v", elapsed)
+				}
+			})
+	}
+
+	t.Run("Ensure a cancelled collection is not reported as a node timeout", func(t *testing.T) {
+		nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+		nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err := retrieveNodeData(ctx, nd, config, pollCycle{}, nodes, ns, n)
+		if err == nil || errors.Is(err, errNodeFetchTimeout) {
+			t.Errorf("expected the collection deadline to be returned, got %v", err)
+		}
+	})
+}
+
+func TestDownloadNodeDataConcurrency(t *testing.T) {
+	const nodeCount = 300
+	const pollers = 10
+
+	var inFlight, maxInFlight int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(2 * time.Millisecond)
+		// /api/v1/nodes/<node>/proxy/stats/summary
+		name := strings.Split(r.URL.Path, "/")[4]
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"node":{"nodeName":%q},"pods":[]}`, name)
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestDownloadNodeDataConcurrency")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	ns := testNodeSource{}
+	for i := 0; i < nodeCount; i++ {
+		ns.Nodes = append(ns.Nodes, addressedNode(fmt.Sprintf("node%d", i), "10.0.0.1"))
+	}
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	nodes := NodeConnection{InClusterClient: raw.NewClient(c, true, nil, 0, false), NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, ConcurrentPollers: pollers, ForceKubeProxy: true}
+
+	failed, err := downloadNodeData(context.TODO(), sample.StatsPrefix, config, pollCycle{}, nodes, workDir, ns, nil,
+		nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(failed) != 0 {
+		t.Errorf("expected every node to be collected, got %d failures", len(failed))
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max > pollers || max < 2 {
+		t.Errorf("expected nodes to be collected concurrently by at most %d pollers, got %d", pollers, max)
+	}
+	for _, n := range ns.Nodes {
+		summary := filepath.Join(dir, sample.NodeSourceName(sample.StatsPrefix, sample.SummarySource, n.Name)+".json")
+		if name, err := summaryNodeName(summary); name != n.Name {
+			t.Errorf("expected the summary of %s, got %q: %v", n.Name, name, err)
+		}
+	}
+}
+
+func TestDownloadNodeDataCancelled(t *testing.T) {
+	// every kubelet hangs until its request is abandoned
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestDownloadNodeDataCancelled")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	ns := testNodeSource{}
+	for i := 0; i < 20; i++ {
+		ns.Nodes = append(ns.Nodes, addressedNode(fmt.Sprintf("node%d", i), "10.0.0.1"))
+	}
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	nodes := NodeConnection{InClusterClient: raw.NewClient(c, true, nil, 2, false), NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, ConcurrentPollers: 5, ForceKubeProxy: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	failed, err := downloadNodeData(ctx, sample.StatsPrefix, config, pollCycle{}, nodes, workDir, ns, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the remaining node fetches to be abandoned, took %v", elapsed)
+	}
+	if len(failed) != len(ns.Nodes) {
+		t.Fatalf("expected every node to be reported, got %d", len(failed))
+	}
+	for name, err := range failed {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected node %s to be reported as cancelled, got %v", name, err)
+		}
+	}
+}
+
+// TestDownloadNodeDataCleanupRace cleans up the sample while node data is still being written to it, run with
+// -race
+func TestDownloadNodeDataCleanupRace(t *testing.T) {
+	const nodeCount = 8
+
+	// every kubelet streams its summary until its request is abandoned
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"node":{"nodeName":"streaming"},"pods":[`)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+			fmt.Fprint(w, `{"podRef":{"name":"pod"}},`)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestDownloadNodeDataCleanupRace")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	ns := testNodeSource{}
+	for i := 0; i < nodeCount; i++ {
+		ns.Nodes = append(ns.Nodes, addressedNode(fmt.Sprintf("node%d", i), "10.0.0.1"))
+	}
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	nodes := NodeConnection{InClusterClient: raw.NewClient(c, true, nil, 0, false), NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, ConcurrentPollers: nodeCount, ForceKubeProxy: true, Dev: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		failed map[string]error
+		err    error
+	}
+	downloaded := make(chan result, 1)
+	go func() {
+		failed, err := downloadNodeData(ctx, sample.StatsPrefix, config, pollCycle{}, nodes, workDir, ns, nil, nil, nil)
+		downloaded <- result{failed, err}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for workDir.Outstanding() < nodeCount {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected every node to be writing, got %d", workDir.Outstanding())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the cleanup is refused while node data is being written, until the collection is cancelled
+	removed := make(chan error, 1)
+	go func() { removed <- workDir.RemoveAll(ctx) }()
+	select {
+	case err := <-removed:
+		t.Fatalf("expected the cleanup to wait for the node writes, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+
+	if err := <-removed; err != nil && !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected cleanup error: %v", err)
+	}
+	r := <-downloaded
+	if r.err != nil {
+		t.Fatalf("unexpected error: %v", r.err)
+	}
+	if len(r.failed) != nodeCount {
+		t.Errorf("expected every node to be reported, got %d", len(r.failed))
+	}
+	for name, err := range r.failed {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected node %s to be reported as cancelled, got %v", name, err)
+		}
+	}
+	if n := workDir.Outstanding(); n != 0 {
+		t.Errorf("expected no outstanding node files, got %d", n)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected the sample to be removed, got %v", err)
+	}
+}
+
+// pagedNodesClientset serves the nodes of a fake clientset a page at a time, sorted by name, as the fake
+// clientset ignores the page size and continue token of a list. The list numbered conflictAt conflicts.
+type pagedNodesClientset struct {
+	*fake.Clientset
+	conflictAt int
+	lists      []metav1.ListOptions
+}
+
+func (c *pagedNodesClientset) CoreV1() corev1.CoreV1Interface {
+	return pagedCoreV1{CoreV1Interface: c.Clientset.CoreV1(), c: c}
+}
+
+type pagedCoreV1 struct {
+	corev1.CoreV1Interface
+	c *pagedNodesClientset
+}
+
+func (p pagedCoreV1) Nodes() corev1.NodeInterface {
+	return pagedNodes{NodeInterface: p.CoreV1Interface.Nodes(), c: p.c}
+}
+
+type pagedNodes struct {
+	corev1.NodeInterface
+	c *pagedNodesClientset
+}
+
+func (p pagedNodes) List(ctx context.Context, opts metav1.ListOptions) (*v1.NodeList, error) {
+	p.c.lists = append(p.c.lists, opts)
+	if len(p.c.lists) == p.c.conflictAt {
+		return nil, apierrors.NewConflict(v1.Resource("nodes"), "", errors.New("the list changed"))
+	}
+	list, err := p.NodeInterface.List(ctx, metav1.ListOptions{LabelSelector: opts.LabelSelector})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	start, end := 0, len(list.Items)
+	if opts.Continue != "" {
+		start, _ = strconv.Atoi(opts.Continue)
+	}
+	if opts.Limit > 0 && start+int(opts.Limit) < end {
+		end = start + int(opts.Limit)
+		list.Continue = strconv.Itoa(end)
+	}
+	list.Items = list.Items[start:end]
+	return list, nil
+}
+
+func TestGetReadyNodesPaginated(t *testing.T) {
+	var objects []runtime.Object
+	var ready []string
+	for i := 0; i < 7; i++ {
+		name := fmt.Sprintf("node%d", i)
+		n := addressedNode(name, "10.0.0.1")
+		if i%3 == 2 {
+			n = notReadyNode(name, v1.ConditionFalse, time.Now())
+		} else {
+			ready = append(ready, name)
+		}
+		objects = append(objects, &n)
+	}
+
+	t.Run("Ensure every ready node is returned once across the pages", func(t *testing.T) {
+		cs := &pagedNodesClientset{Clientset: fake.NewSimpleClientset(objects...), conflictAt: 2}
+		ns := NewClientsetNodeSource(cs)
+		ns.pageSize = 2
+		nodes, err := ns.GetReadyNodes(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, n := range nodes {
+			names = append(names, n.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(ready, ",") {
+			t.Errorf("expected the ready nodes %v, got %v", ready, names)
+		}
+		// the conflicting second page is listed again with the same continue token
+		continues := make([]string, 0, len(cs.lists))
+		for _, opts := range cs.lists {
+			if opts.Limit != 2 {
+				t.Errorf("expected pages of 2 nodes, got %d", opts.Limit)
+			}
+			continues = append(continues, opts.Continue)
+		}
+		if strings.Join(continues, ",") != ",2,2,4,6" {
+			t.Errorf("unexpected continue tokens %v", continues)
+		}
+	})
+
+	t.Run("Ensure every node is listed with a single request without a page size", func(t *testing.T) {
+		cs := &pagedNodesClientset{Clientset: fake.NewSimpleClientset(objects...)}
+		nodes, err := NewClientsetNodeSource(cs).GetReadyNodes(context.TODO())
+		if err != nil || len(nodes) != len(ready) || len(cs.lists) != 1 {
+			t.Errorf("expected the ready nodes to be listed at once, got %d nodes %d lists %v", len(nodes),
+				len(cs.lists), err)
+		}
+	})
+
+	t.Run("Ensure a failed page fails the list", func(t *testing.T) {
+		cs := &pagedNodesClientset{Clientset: fake.NewSimpleClientset(objects...)}
+		cs.PrependReactor("list", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if len(cs.lists) > 1 {
+				return true, nil, apierrors.NewResourceExpired("the continue token expired")
+			}
+			return false, nil, nil
+		})
+		ns := NewClientsetNodeSource(cs)
+		ns.pageSize = 2
+		if _, err := ns.GetReadyNodes(context.TODO()); !apierrors.IsResourceExpired(err) {
+			t.Errorf("expected the expired page to fail the list, got %v", err)
+		}
+	})
+}
+
+func TestGetReadyNodesWithStats(t *testing.T) {
+	t.Run("Ensure the listed nodes are counted by their readiness", func(t *testing.T) {
+		ready := addressedNode("node0", "10.0.0.1")
+		recent := notReadyNode("node1", v1.ConditionUnknown, time.Now())
+		down := notReadyNode("node2", v1.ConditionFalse, time.Now().Add(-time.Hour))
+		ns := NewClientsetNodeSource(fake.NewSimpleClientset(&ready, &recent, &down))
+		ns.notReadyGrace = 5 * time.Minute
+		nodes, readiness, err := ns.GetReadyNodesWithStats(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) != 2 {
+			t.Errorf("expected the ready node and the node within the not ready grace, got %d nodes", len(nodes))
+		}
+		if readiness.Total != 3 || readiness.Ready != 1 || readiness.NotReady != 2 ||
+			strings.Join(readiness.NotReadyNodes, ",") != "node1,node2" {
+			t.Errorf("unexpected readiness %+v", readiness)
+		}
+	})
+
+	t.Run("Ensure the error without ready nodes names the not ready nodes", func(t *testing.T) {
+		var objects []runtime.Object
+		for i := 0; i < notReadyNodeLimit+2; i++ {
+			n := notReadyNode(fmt.Sprintf("node%02d", i), v1.ConditionFalse, time.Now())
+			n.Status.Conditions[0].Reason = "KubeletNotReady"
+			objects = append(objects, &n)
+		}
+		unknown := addressedNode("node99", "10.0.0.1")
+		unknown.Status.Conditions = nil
+		objects = append(objects, &unknown)
+		_, readiness, err := NewClientsetNodeSource(fake.NewSimpleClientset(objects...)).GetReadyNodesWithStats(
+			context.TODO())
+		if err == nil || !strings.HasPrefix(err.Error(), "there were 0 nodes in a ready state, not ready nodes: "+
+			"node00 (KubeletNotReady), node01 (KubeletNotReady)") || !strings.HasSuffix(err.Error(), " and 3 more") {
+			t.Errorf("unexpected error %v", err)
+		}
+		if readiness.NotReady != notReadyNodeLimit+3 || readiness.Ready != 0 {
+			t.Errorf("unexpected readiness %+v", readiness)
+		}
+		if reason := notReadyReason(unknown); reason != "no Ready condition" {
+			t.Errorf("unexpected reason %q", reason)
+		}
+	})
+
+	t.Run("Ensure node sources without stats report their ready nodes", func(t *testing.T) {
+		nodes, readiness, err := getReadyNodesWithStats(context.TODO(),
+			testNodeSource{Nodes: []v1.Node{addressedNode("node0", "10.0.0.1")}})
+		if err != nil || len(nodes) != 1 || readiness.Total != 1 || readiness.Ready != 1 {
+			t.Errorf("unexpected readiness %+v %v", readiness, err)
+		}
+	})
 }
@@ -0,0 +1,76 @@
+package kubernetes
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// NodeEventType is the change to a node reported by a NodeEvent
+type NodeEventType string
+
+// changes to a node reported by a node subscription
+const (
+	NodeAdded   NodeEventType = "added"
+	NodeUpdated NodeEventType = "updated"
+	NodeDeleted NodeEventType = "deleted"
+)
+
+// NodeEvent is a change to a node reported by a node subscription
+type NodeEvent struct {
+	Type NodeEventType
+	Node *v1.Node
+	// Initial is set on the additions of the nodes already in the cluster when the subscription started
+	Initial bool
+}
+
+// NodeSubscription delivers the changes to the nodes as they are watched, between collections. Events is nil
+// for a node source that does not watch the nodes, so it never delivers.
+type NodeSubscription struct {
+	Events <-chan NodeEvent
+	close  func()
+}
+
+// Close stops the subscription, Events is not closed
+func (s NodeSubscription) Close() {
+	if s.close != nil {
+		s.close()
+	}
+}
+
+// NodeSubscriber is implemented by the node sources that can report the changes to the nodes as they happen
+type NodeSubscriber interface {
+	Subscribe() NodeSubscription
+}
+
+// subscribeNodes subscribes to the changes to the nodes of the node source, a subscription that never
+// delivers if it does not report them
+func subscribeNodes(ns NodeSource) NodeSubscription {
+	if s, ok := ns.(NodeSubscriber); ok {
+		return s.Subscribe()
+	}
+	return NodeSubscription{}
+}
+
+// handleNodeEvent updates the per node state of the agent for a change to a node. A deleted node has its
+// endpoint mask and baselines in baselineDir removed at once, rather than left until the mask expires or the
+// baselines are archived with the next sample as a node no longer listed. A node added under the name of a
+// node that was removed starts from the cluster mask again.
+func handleNodeEvent(state *AgentState, baselineDir string, e NodeEvent) {
+	if e.Node == nil || e.Initial {
+		return
+	}
+	switch e.Type {
+	case NodeAdded:
+		state.Nodes().nodeMasks.forget(e.Node.Name)
+		log.Infof("Node %s joined the cluster", e.Node.Name)
+	case NodeDeleted:
+		state.Nodes().nodeMasks.forget(e.Node.Name)
+		removed, err := invalidateBaselines(baselineDir, []string{e.Node.Name}, true)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warnf("Warning: unable to remove the baselines of deleted node %s: %s", e.Node.Name, err)
+		}
+		log.Infof("Node %s was deleted from the cluster, %d baseline files removed", e.Node.Name, removed)
+	}
+}
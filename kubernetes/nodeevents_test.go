@@ -0,0 +1,117 @@
+package kubernetes
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// nextNodeEvent returns the next event of the subscription
+func nextNodeEvent(t *testing.T, sub NodeSubscription) NodeEvent {
+	select {
+	case e := <-sub.Events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a node event")
+	}
+	return NodeEvent{}
+}
+
+func TestNodeSubscription(t *testing.T) {
+	t.Run("Ensure node sources that list the nodes never deliver", func(t *testing.T) {
+		if sub := subscribeNodes(NewClientsetNodeSource(fake.NewSimpleClientset())); sub.Events != nil {
+			t.Error("expected the clientset node source to never deliver")
+		}
+		sub := subscribeNodes(testNodeSource{})
+		if sub.Events != nil {
+			t.Error("expected a node source without subscriptions to never deliver")
+		}
+		sub.Close()
+	})
+
+	t.Run("Ensure the changes to the watched nodes are delivered", func(t *testing.T) {
+		node0 := addressedNode("node0", "10.0.0.1")
+		cs := fake.NewSimpleClientset(&node0)
+		stopCh := make(chan struct{})
+		defer close(stopCh)
+		ns := NewInformerNodeSource(NewClientsetNodeSource(cs), 0, time.Minute, stopCh)
+		if !cache.WaitForCacheSync(stopCh, ns.synced) {
+			t.Fatal("expected the node informer to sync")
+		}
+		sub := subscribeNodes(ns)
+		defer sub.Close()
+
+		if e := nextNodeEvent(t, sub); e.Type != NodeAdded || !e.Initial || e.Node.Name != "node0" {
+			t.Errorf("expected the initial addition of node0, got %+v", e)
+		}
+		node1 := addressedNode("node1", "10.0.0.2")
+		if _, err := cs.CoreV1().Nodes().Create(context.TODO(), &node1, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if e := nextNodeEvent(t, sub); e.Type != NodeAdded || e.Initial || e.Node.Name != "node1" {
+			t.Errorf("expected the addition of node1, got %+v", e)
+		}
+		node1.ResourceVersion = "2"
+		node1.Labels = map[string]string{"pool": "b"}
+		if _, err := cs.CoreV1().Nodes().Update(context.TODO(), &node1, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if e := nextNodeEvent(t, sub); e.Type != NodeUpdated || e.Node.Labels["pool"] != "b" {
+			t.Errorf("expected the update of node1, got %+v", e)
+		}
+		if err := cs.CoreV1().Nodes().Delete(context.TODO(), "node0", metav1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if e := nextNodeEvent(t, sub); e.Type != NodeDeleted || e.Node.Name != "node0" {
+			t.Errorf("expected the deletion of node0, got %+v", e)
+		}
+		sub.Close()
+		sub.Close()
+	})
+}
+
+func TestHandleNodeEvent(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{"baseline-summary-node0.json", "baseline-container-node0.json",
+		"baseline-summary-node0.pool.json", "baseline-summary-node1.json"}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := KubeAgentConfig{PollInterval: 60}
+	nodes := NodeConnection{NodeMetrics: NewEndpointMask(), nodeMasks: newNodeEndpointMasks(config)}
+	state := newAgentState(config, nodes)
+	now := time.Now()
+	for _, name := range []string{"node0", "node1"} {
+		nodes.nodeMasks.forNode(name, nodes.NodeMetrics, func(*EndpointMask) {}, now)
+	}
+	node0, node1 := addressedNode("node0", "10.0.0.1"), addressedNode("node1", "10.0.0.2")
+
+	// the nodes already in the cluster are known from the collections
+	handleNodeEvent(state, dir, NodeEvent{Type: NodeAdded, Node: &node1, Initial: true})
+	handleNodeEvent(state, dir, NodeEvent{Type: NodeDeleted, Node: &node0})
+
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dir, f))
+		if removed := os.IsNotExist(err); removed != (f == files[0] || f == files[1]) {
+			t.Errorf("unexpected baseline %s removed: %v", f, removed)
+		}
+	}
+	if _, ok := nodes.nodeMasks.masks["node0"]; ok {
+		t.Error("expected the mask of the deleted node to be removed")
+	}
+	if _, ok := nodes.nodeMasks.masks["node1"]; !ok {
+		t.Error("expected the mask of an initial node to be kept")
+	}
+	handleNodeEvent(state, dir, NodeEvent{Type: NodeAdded, Node: &node1})
+	if _, ok := nodes.nodeMasks.masks["node1"]; ok {
+		t.Error("expected a node added under a known name to start from the cluster mask")
+	}
+}
@@ -0,0 +1,93 @@
+package kubernetes
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// nodeNameFilter restricts collection to the nodes whose name matches one of its patterns, exact names or
+// glob patterns as used by path.Match. An empty filter allows every node.
+type nodeNameFilter []string
+
+// parseNodeNameAllowlist parses a comma separated list of node names and glob patterns
+func parseNodeNameAllowlist(allowlist string) (nodeNameFilter, error) {
+	var f nodeNameFilter
+	for _, pattern := range strings.Split(allowlist, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid node name pattern %q: %v", pattern, err)
+		}
+		f = append(f, pattern)
+	}
+	return f, nil
+}
+
+// allows returns true if the node name matches the filter
+func (f nodeNameFilter) allows(name string) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, pattern := range f {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns the nodes allowed by the filter
+func (f nodeNameFilter) apply(nodes []v1.Node) []v1.Node {
+	if len(f) == 0 {
+		return nodes
+	}
+	var allowed []v1.Node
+	for _, n := range nodes {
+		if f.allows(n.Name) {
+			allowed = append(allowed, n)
+		}
+	}
+	return allowed
+}
+
+// parseNodeLabelSelector parses a label selector in the standard Kubernetes syntax, eg: team=payments,
+// returning nil if it is empty
+func parseNodeLabelSelector(selector string) (labels.Selector, error) {
+	if strings.TrimSpace(selector) == "" {
+		return nil, nil
+	}
+	s, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node label selector %q: %v", selector, err)
+	}
+	return s, nil
+}
+
+// selectNodes returns the nodes collected with the node name allowlist and node label selector of the config
+func (ka KubeAgentConfig) selectNodes(nodes []v1.Node) []v1.Node {
+	nodes = ka.nodeNames.apply(nodes)
+	if ka.nodeLabels == nil {
+		return nodes
+	}
+	var selected []v1.Node
+	for _, n := range nodes {
+		if ka.nodeLabels.Matches(labels.Set(n.Labels)) {
+			selected = append(selected, n)
+		}
+	}
+	return selected
+}
+
+// nodeLabelSelector returns the node label selector of the config in its canonical form, empty if there is none
+func (ka KubeAgentConfig) nodeLabelSelector() string {
+	if ka.nodeLabels == nil {
+		return ""
+	}
+	return ka.nodeLabels.String()
+}
@@ -0,0 +1,175 @@
+package kubernetes
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseNodeNameAllowlist(t *testing.T) {
+	f, err := parseNodeNameAllowlist(" node0, canary-* ,,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		name    string
+		allowed bool
+	}{
+		{name: "node0", allowed: true},
+		{name: "node01", allowed: false},
+		{name: "canary-a", allowed: true},
+		{name: "node1", allowed: false},
+	}
+	for _, tc := range tests {
+		if f.allows(tc.name) != tc.allowed {
+			t.Errorf("expected node %s allowed to be %v", tc.name, tc.allowed)
+		}
+	}
+
+	if f, err := parseNodeNameAllowlist(""); err != nil || len(f) != 0 || !f.allows("node0") {
+		t.Errorf("expected an empty allowlist to allow every node, got %v %v", f, err)
+	}
+	if _, err := parseNodeNameAllowlist("node[0"); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+}
+
+func TestGetReadyNodesAllowlist(t *testing.T) {
+	node0, node1, canary := addressedNode("node0", "10.0.0.1"), addressedNode("node1", "10.0.0.2"),
+		addressedNode("canary-a", "10.0.0.3")
+	clientset := fake.NewSimpleClientset(&node0, &node1, &canary)
+
+	t.Run("Ensure only allowed nodes are returned", func(t *testing.T) {
+		allowed, _ := parseNodeNameAllowlist("node0,canary-*")
+		ns := newConfiguredNodeSource(KubeAgentConfig{Clientset: clientset, nodeNames: allowed})
+		nodes, err := ns.GetReadyNodes(context.TODO())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(nodes) != 2 || nodes[0].Name == "node1" || nodes[1].Name == "node1" {
+			t.Errorf("expected node0 and canary-a, got %v", nodes)
+		}
+	})
+
+	t.Run("Ensure an allowlist matching no nodes is an error", func(t *testing.T) {
+		allowed, _ := parseNodeNameAllowlist("missing")
+		ns := newConfiguredNodeSource(KubeAgentConfig{Clientset: clientset, nodeNames: allowed})
+		if _, err := ns.GetReadyNodes(context.TODO()); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestNodeLabelSelector(t *testing.T) {
+	if s, err := parseNodeLabelSelector(" "); err != nil || s != nil {
+		t.Errorf("expected an empty selector to select every node, got %v %v", s, err)
+	}
+	if _, err := parseNodeLabelSelector("team in (payments"); err == nil {
+		t.Error("expected an invalid selector to be rejected")
+	}
+
+	payments, ledger, search := addressedNode("payments-0", "10.0.0.1"), addressedNode("ledger-0", "10.0.0.2"),
+		addressedNode("search-0", "10.0.0.3")
+	payments.Labels = map[string]string{"team": "payments"}
+	ledger.Labels = map[string]string{"team": "payments"}
+	ledger.Status.Conditions[0].Status = v1.ConditionFalse
+	ledger.Status.Conditions[0].Type = v1.NodeDiskPressure
+	search.Labels = map[string]string{"team": "search"}
+	clientset := fake.NewSimpleClientset(&payments, &ledger, &search)
+	config := func(selector string) KubeAgentConfig {
+		s, err := parseNodeLabelSelector(selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return KubeAgentConfig{Clientset: clientset, nodeLabels: s}
+	}
+
+	t.Run("Ensure only nodes matching the selector are returned", func(t *testing.T) {
+		nodes, err := newConfiguredNodeSource(config("team=payments")).GetReadyNodes(context.TODO())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(nodes) != 1 || nodes[0].Name != "payments-0" {
+			t.Errorf("expected only the ready payments node, got %v", nodes)
+		}
+		selected := config("team=payments").selectNodes([]v1.Node{payments, ledger, search})
+		if len(selected) != 2 {
+			t.Errorf("expected the payments nodes to be selected, got %v", selected)
+		}
+	})
+
+	t.Run("Ensure errors name the active selector", func(t *testing.T) {
+		_, err := newConfiguredNodeSource(config("team=billing")).GetReadyNodes(context.TODO())
+		if err == nil || !strings.Contains(err.Error(), `"team=billing"`) {
+			t.Errorf("expected the error to name the selector, got %v", err)
+		}
+		payments.Status.Conditions[0].Type = v1.NodeDiskPressure
+		clientset := fake.NewSimpleClientset(&payments, &ledger)
+		selector := config("team=payments").nodeLabels
+		ns := newConfiguredNodeSource(KubeAgentConfig{Clientset: clientset, nodeLabels: selector})
+		_, err = ns.GetReadyNodes(context.TODO())
+		if err == nil || !strings.Contains(err.Error(), `ready state matching the node label selector "team=payments"`) {
+			t.Errorf("expected the readiness error to name the selector, got %v", err)
+		}
+	})
+}
+
+func TestGetReadyNodesNotReady(t *testing.T) {
+	ready, notReady, unknown := addressedNode("ready", "10.0.0.1"), addressedNode("not-ready", "10.0.0.2"),
+		addressedNode("unknown", "10.0.0.3")
+	notReady.Status.Conditions[0].Status = v1.ConditionFalse
+	unknown.Status.Conditions[0].Status = v1.ConditionUnknown
+	clientset := fake.NewSimpleClientset(&ready, &notReady, &unknown)
+
+	nodes, err := newConfiguredNodeSource(KubeAgentConfig{Clientset: clientset}).GetReadyNodes(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "ready" {
+		t.Errorf("expected the nodes whose Ready condition is not True to be left out, got %v", nodes)
+	}
+}
+
+func TestSkipUnschedulableNodes(t *testing.T) {
+	node0, cordoned := addressedNode("node0", "10.0.0.1"), addressedNode("cordoned", "10.0.0.2")
+	cordoned.Spec.Unschedulable = true
+
+	t.Run("Ensure cordoned nodes are collected by default", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(&node0, &cordoned)
+		nodes, err := newConfiguredNodeSource(KubeAgentConfig{Clientset: clientset}).GetReadyNodes(context.TODO())
+		if err != nil || len(nodes) != 2 {
+			t.Errorf("expected both nodes, got %v %v", nodes, err)
+		}
+	})
+
+	t.Run("Ensure cordoned nodes are skipped and counted", func(t *testing.T) {
+		hook := test.NewGlobal()
+		defer hook.Reset()
+		clientset := fake.NewSimpleClientset(&node0, &cordoned)
+		config := KubeAgentConfig{Clientset: clientset, SkipUnschedulableNodes: true}
+		nodes, err := newConfiguredNodeSource(config).GetReadyNodes(context.TODO())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(nodes) != 1 || nodes[0].Name != "node0" {
+			t.Errorf("expected only node0, got %v", nodes)
+		}
+		if len(hook.Entries) != 1 ||
+			hook.LastEntry().Message != "1 ready nodes are unschedulable (cordoned) and not collected" {
+			t.Errorf("unexpected log entries %+v", hook.Entries)
+		}
+	})
+
+	t.Run("Ensure an error says every ready node is cordoned", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(&cordoned)
+		config := KubeAgentConfig{Clientset: clientset, SkipUnschedulableNodes: true}
+		_, err := newConfiguredNodeSource(config).GetReadyNodes(context.TODO())
+		if err == nil || !strings.Contains(err.Error(), "all 1 ready nodes are unschedulable (cordoned)") {
+			t.Errorf("expected the error to say every node is cordoned, got %v", err)
+		}
+	})
+}
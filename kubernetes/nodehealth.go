@@ -0,0 +1,133 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/cloudability/metrics-agent/sample"
+	v1 "k8s.io/api/core/v1"
+)
+
+// nodeHealthConditions are the node conditions reported with the collection outcome of each node
+var nodeHealthConditions = []v1.NodeConditionType{
+	v1.NodeReady,
+	v1.NodeMemoryPressure,
+	v1.NodeDiskPressure,
+	v1.NodePIDPressure,
+}
+
+// nodeHealthSnapshot holds the conditions of the nodes in the node list a collection fetched, so they
+// are reported as they were when the nodes were collected. It is safe for concurrent use.
+type nodeHealthSnapshot struct {
+	mu    sync.Mutex
+	nodes map[string][]sample.NodeCondition
+	// skipped are the reasons of the nodes intentionally left out of collection
+	skipped map[string]string
+	// listed is the readiness of the nodes listed, nil until recorded
+	listed *sample.NodeReadiness
+}
+
+func newNodeHealthSnapshot() *nodeHealthSnapshot {
+	return &nodeHealthSnapshot{nodes: map[string][]sample.NodeCondition{}, skipped: map[string]string{}}
+}
+
+// record keeps the conditions of the listed nodes, a nil snapshot records nothing
+func (s *nodeHealthSnapshot) record(nodes []v1.Node) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range nodes {
+		conditions := make([]sample.NodeCondition, 0, len(nodeHealthConditions))
+		for _, t := range nodeHealthConditions {
+			_, c := getNodeCondition(&nodes[i].Status, t)
+			if c == nil {
+				continue
+			}
+			conditions = append(conditions, sample.NodeCondition{
+				Type:               string(c.Type),
+				Status:             string(c.Status),
+				LastTransitionTime: c.LastTransitionTime.UTC(),
+			})
+		}
+		s.nodes[nodes[i].Name] = conditions
+	}
+}
+
+// recordReadiness keeps the readiness of the listed nodes, a nil snapshot records nothing
+func (s *nodeHealthSnapshot) recordReadiness(r sample.NodeReadiness) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listed = &r
+}
+
+// readiness returns the readiness of the listed nodes, nil if it was not recorded
+func (s *nodeHealthSnapshot) readiness() *sample.NodeReadiness {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listed
+}
+
+// skip records the listed nodes that are left out of collection for the reason
+func (s *nodeHealthSnapshot) skip(names []string, reason string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		s.skipped[name] = reason
+	}
+}
+
+// skippedNodes returns the reason each node left out of collection was skipped for
+func (s *nodeHealthSnapshot) skippedNodes() map[string]string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	skipped := make(map[string]string, len(s.skipped))
+	for name, reason := range s.skipped {
+		skipped[name] = reason
+	}
+	return skipped
+}
+
+// report joins the recorded conditions of each node with the outcome of its collection, sorted by node
+// name
+func (s *nodeHealthSnapshot) report(failed map[string]error) []sample.NodeHealth {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	health := make([]sample.NodeHealth, 0, len(s.nodes))
+	for name, conditions := range s.nodes {
+		h := sample.NodeHealth{Node: name, Conditions: conditions, Outcome: sample.NodeCollected}
+		if reason, ok := s.skipped[name]; ok {
+			h.Outcome = sample.NodeSkipped
+			h.Reason = reason
+		} else if err, ok := failed[name]; ok {
+			h.Outcome = sample.NodeFailed
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				h.Outcome = sample.NodeCancelled
+			}
+			h.ErrorClass = errorClass(err)
+		}
+		health = append(health, h)
+	}
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].Node < health[j].Node
+	})
+	return health
+}
@@ -0,0 +1,117 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pressureChangingNodeSource lists nodes under memory pressure the first time, and relieved of it after
+type pressureChangingNodeSource struct {
+	testNodeSource
+	lists *int
+}
+
+func (s pressureChangingNodeSource) GetReadyNodes(ctx context.Context) ([]v1.Node, error) {
+	*s.lists++
+	status := v1.ConditionTrue
+	if *s.lists > 1 {
+		status = v1.ConditionFalse
+	}
+	transition := metav1.NewTime(time.Date(2024, 1, *s.lists, 0, 0, 0, 0, time.UTC))
+	nodes := make([]v1.Node, len(s.Nodes))
+	for i, n := range s.Nodes {
+		n.Status.Conditions = append([]v1.NodeCondition{}, n.Status.Conditions...)
+		n.Status.Conditions = append(n.Status.Conditions, v1.NodeCondition{Type: v1.NodeMemoryPressure,
+			Status: status, LastTransitionTime: transition})
+		nodes[i] = n
+	}
+	return nodes, nil
+}
+
+func TestNodeHealthReport(t *testing.T) {
+	// node1 fails to serve its summary
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/nodes/"), "/")[0]
+		if name == "node1" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"node":{"nodeName":%q}}`, name)
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestNodeHealthReport")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	var lists int
+	ns := pressureChangingNodeSource{lists: &lists}
+	for _, name := range []string{"node1", "node0"} {
+		ns.Nodes = append(ns.Nodes, addressedNode(name, "10.0.0.1"))
+	}
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	nodes := NodeConnection{InClusterClient: raw.NewClient(c, true, nil, 0, false), NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, ConcurrentPollers: 2, ForceKubeProxy: true}
+
+	health := newNodeHealthSnapshot()
+	failed, err := downloadNodeData(context.TODO(), sample.StatsPrefix, config, pollCycle{}, nodes, workDir, ns, nil,
+		nil, health)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// a later list must not change the conditions reported for the collection
+	if _, err := ns.GetReadyNodes(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	report := health.report(failed)
+	if len(report) != 2 || report[0].Node != "node0" || report[1].Node != "node1" {
+		t.Fatalf("expected a report of both nodes sorted by name, got %+v", report)
+	}
+	if report[0].Outcome != sample.NodeCollected || report[0].ErrorClass != "" {
+		t.Errorf("expected node0 to be collected, got %+v", report[0])
+	}
+	if report[1].Outcome != sample.NodeFailed || report[1].ErrorClass == "" {
+		t.Errorf("expected node1 to have failed with its error class, got %+v", report[1])
+	}
+	for _, h := range report {
+		expected := []sample.NodeCondition{
+			{Type: string(v1.NodeReady), Status: string(v1.ConditionTrue)},
+			{Type: string(v1.NodeMemoryPressure), Status: string(v1.ConditionTrue),
+				LastTransitionTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		}
+		if fmt.Sprint(h.Conditions) != fmt.Sprint(expected) {
+			t.Errorf("expected the conditions of %s from the collected node list %+v, got %+v", h.Node, expected,
+				h.Conditions)
+		}
+	}
+
+	cancelled := map[string]error{"node0": fmt.Errorf("node metrics retrieval cancelled: %w", context.Canceled)}
+	if report := health.report(cancelled); report[0].Outcome != sample.NodeCancelled {
+		t.Errorf("expected node0 to be reported as cancelled, got %+v", report[0])
+	}
+	if (*nodeHealthSnapshot)(nil).report(failed) != nil {
+		t.Error("expected no report without a snapshot")
+	}
+}
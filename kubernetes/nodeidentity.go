@@ -0,0 +1,129 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// nodeIdentityError is returned when a kubelet summary is from a different node than the one requested,
+// as happens when requests are misrouted
+type nodeIdentityError struct {
+	requested string
+	answered  string
+}
+
+func (e nodeIdentityError) Error() string {
+	return fmt.Sprintf("node identity mismatch: requested node %s but received the summary of node %s",
+		e.requested, e.answered)
+}
+
+// summaryNodeCheck is a transform checking that a kubelet summary is from the requested node as it is
+// written, so the summary is not read back. Summaries without a readable node name are accepted.
+type summaryNodeCheck struct {
+	nodeName string
+	pw       *io.PipeWriter
+	answered chan summaryNodeResult
+}
+
+type summaryNodeResult struct {
+	name string
+	err  error
+}
+
+func newSummaryNodeCheck(nodeName string) *summaryNodeCheck {
+	return &summaryNodeCheck{nodeName: nodeName}
+}
+
+// Wrap implements raw.Transform, the node name is decoded from a copy of the summary as it is written
+func (c *summaryNodeCheck) Wrap(w io.Writer) io.Writer {
+	pr, pw := io.Pipe()
+	answered := make(chan summaryNodeResult, 1)
+	go func() {
+		name, err := readSummaryNodeName(pr)
+		answered <- summaryNodeResult{name: name, err: err}
+		// the rest of the summary is discarded so writing it is not blocked
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+	c.pw, c.answered = pw, answered
+	return io.MultiWriter(w, pw)
+}
+
+// Finish implements raw.Transform, rejecting a summary from another node
+func (c *summaryNodeCheck) Finish(writeErr error) error {
+	_ = c.pw.CloseWithError(writeErr)
+	answered := <-c.answered
+	if writeErr != nil {
+		return nil
+	}
+	if answered.err != nil {
+		log.Debugf("Unable to verify the node name of the summary of %s: %v", c.nodeName, answered.err)
+		return nil
+	}
+	if answered.name != c.nodeName {
+		return nodeIdentityError{requested: c.nodeName, answered: answered.name}
+	}
+	return nil
+}
+
+// removeMismatchedSummary removes the summary file if err is a node identity mismatch, returning err
+func removeMismatchedSummary(summaryFile string, err error) error {
+	var identityErr nodeIdentityError
+	if !errors.As(err, &identityErr) {
+		return err
+	}
+	if rmErr := os.Remove(summaryFile); rmErr != nil {
+		log.Warnf("Unable to remove the summary of node %s received for node %s: %v", identityErr.answered,
+			identityErr.requested, rmErr)
+	}
+	return err
+}
+
+// summaryNodeName returns the node name reported in the kubelet summary file
+func summaryNodeName(summaryFile string) (name string, rerr error) {
+	//nolint gosec
+	f, err := os.Open(summaryFile)
+	if err != nil {
+		return "", err
+	}
+	defer util.SafeClose(f.Close, &rerr)
+	return readSummaryNodeName(f)
+}
+
+// readSummaryNodeName returns the node name reported in a kubelet summary. Only the top level node object is
+// decoded, reading stops once it has been found.
+func readSummaryNodeName(r io.Reader) (string, error) {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return "", fmt.Errorf("summary is not a JSON object")
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return "", err
+		}
+		if key != "node" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return "", err
+			}
+			continue
+		}
+		var node struct {
+			NodeName string `json:"nodeName"`
+		}
+		if err := dec.Decode(&node); err != nil {
+			return "", err
+		}
+		if node.NodeName == "" {
+			return "", fmt.Errorf("summary has no node name")
+		}
+		return node.NodeName, nil
+	}
+	return "", fmt.Errorf("summary has no node object")
+}
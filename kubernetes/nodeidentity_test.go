@@ -0,0 +1,161 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSummaryNodeName(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestSummaryNodeName")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		summary  string
+		expected string
+	}{
+		{name: "node first", summary: `{"node":{"nodeName":"node0","cpu":{}},"pods":[{}]}`, expected: "node0"},
+		{name: "node after pods", summary: `{"pods":[{"podRef":{"name":"p"}}],"node":{"nodeName":"node0"}}`,
+			expected: "node0"},
+		{name: "no node", summary: `{"pods":[]}`},
+		{name: "no node name", summary: `{"node":{}}`},
+		{name: "not an object", summary: `[]`},
+	}
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := filepath.Join(dir, strconv.Itoa(i))
+			if err := os.WriteFile(f, []byte(tc.summary), 0644); err != nil {
+				t.Fatal(err)
+			}
+			name, err := summaryNodeName(f)
+			if name != tc.expected || (tc.expected == "") != (err != nil) {
+				t.Errorf("expected %q, got %q: %v", tc.expected, name, err)
+			}
+		})
+	}
+}
+
+func TestSummaryNodeCheck(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestSummaryNodeCheck")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "stats-summary-node0.json")
+
+	// write writes the summary through the check as the raw client does, returning the result of the check
+	write := func(summary string) error {
+		out, err := os.Create(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		check := newSummaryNodeCheck("node0")
+		_, err = io.Copy(check.Wrap(out), strings.NewReader(summary))
+		return removeMismatchedSummary(f, check.Finish(err))
+	}
+
+	if err := write(`{"node":{"nodeName":"node0"},"pods":[]}`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(f); string(data) != `{"node":{"nodeName":"node0"},"pods":[]}` {
+		t.Errorf("expected the whole summary to be written, got %q", data)
+	}
+
+	if err := write(`{"test":"data"}`); err != nil {
+		t.Errorf("expected a summary without a node name to be kept, got %v", err)
+	}
+
+	var identityErr nodeIdentityError
+	if err := write(`{"node":{"nodeName":"node1"}}`); !errors.As(err, &identityErr) || identityErr.answered != "node1" {
+		t.Errorf("expected an identity mismatch, got %v", err)
+	}
+	if _, err := os.Stat(f); !os.IsNotExist(err) {
+		t.Errorf("expected the mismatched summary to be removed: %v", err)
+	}
+}
+
+func TestRetrieveNodeDataIdentityMismatch(t *testing.T) {
+	// the direct connection is misrouted to another kubelet, the proxy reaches the requested node
+	var directRequests, proxyRequests int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(r.URL.Path, "/api/v1/nodes/") {
+			proxyRequests++
+			fmt.Fprint(w, `{"node":{"nodeName":"node0"}}`)
+			return
+		}
+		directRequests++
+		fmt.Fprint(w, `{"node":{"nodeName":"node1"}}`)
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestRetrieveNodeDataIdentityMismatch")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 0, false)
+	nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+
+	host, port, _ := strings.Cut(ts.Listener.Addr().String(), ":")
+	n := addressedNode("node0", host)
+	p, _ := strconv.Atoi(port)
+	n.Status.DaemonEndpoints.KubeletEndpoint.Port = int32(p)
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	config := KubeAgentConfig{ClusterHostURL: ts.URL}
+	nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir}
+	summary := filepath.Join(dir, sample.NodeSourceName(sample.StatsPrefix, sample.SummarySource, "node0")+".json")
+
+	t.Run("Ensure a mismatched summary is retried via the other connection", func(t *testing.T) {
+		if err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, ns, n); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if directRequests != 1 || proxyRequests != 1 {
+			t.Errorf("expected one direct and one proxy request, got %d and %d", directRequests, proxyRequests)
+		}
+		if name, err := summaryNodeName(summary); name != "node0" {
+			t.Errorf("expected the summary of node0 to be kept, got %q: %v", name, err)
+		}
+	})
+
+	t.Run("Ensure a mismatch on every connection is returned", func(t *testing.T) {
+		directOnly := nodes
+		directOnly.NodeMetrics = NewEndpointMask()
+		directOnly.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+		var identityErr nodeIdentityError
+		err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, directOnly, ns, n)
+		if !errors.As(err, &identityErr) {
+			t.Errorf("expected an identity mismatch, got %v", err)
+		}
+		if _, err := os.Stat(summary); !os.IsNotExist(err) {
+			t.Errorf("expected no summary to be kept: %v", err)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package kubernetes
+
+import (
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// nodeEndpointMaskCycles is the number of poll intervals a node's endpoint mask is kept before it is
+// derived again, so that a kubelet upgrade is picked up within a few collections
+const nodeEndpointMaskCycles = 5
+
+// nodeEndpointMasks are the endpoints available on each node. Endpoints are probed on a single node at
+// startup, but in mixed clusters, eg: of different kubelet versions or OS images, they differ per node.
+// Each node starts from the cluster mask, which is corrected as its endpoints are fetched. It is safe for
+// concurrent use.
+type nodeEndpointMasks struct {
+	mu        sync.Mutex
+	maxAge    time.Duration
+	masks     map[string]nodeEndpointMask
+	lastSweep time.Time
+}
+
+type nodeEndpointMask struct {
+	mask    *EndpointMask
+	created time.Time
+}
+
+func newNodeEndpointMasks(config KubeAgentConfig) *nodeEndpointMasks {
+	return &nodeEndpointMasks{
+		maxAge: nodeEndpointMaskCycles * time.Duration(config.PollInterval) * time.Second,
+		masks:  map[string]nodeEndpointMask{},
+	}
+}
+
+// forNode returns the endpoint mask of the node. A node without a current mask starts from a copy of the
+// cluster mask, which probe may extend with the endpoints the node serves. Without per node masks a
+// copy of the cluster mask is returned each time, so corrections made during a fetch do not leak to
+// other nodes.
+func (s *nodeEndpointMasks) forNode(nodeName string, cluster *EndpointMask, probe func(*EndpointMask),
+	now time.Time) *EndpointMask {
+	if s == nil {
+		return cluster.clone()
+	}
+	s.mu.Lock()
+	m, ok := s.masks[nodeName]
+	s.sweep(now)
+	s.mu.Unlock()
+	if ok && now.Sub(m.created) < s.maxAge {
+		return m.mask
+	}
+
+	// probing is done without holding the lock, if the node is fetched concurrently the last mask wins
+	mask := cluster.clone()
+	probe(mask)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.masks[nodeName] = nodeEndpointMask{mask: mask, created: now}
+	return mask
+}
+
+// reset removes the masks of every node, so they are derived again from the cluster mask
+func (s *nodeEndpointMasks) reset() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.masks = map[string]nodeEndpointMask{}
+}
+
+// forget removes the mask of the node, eg: once it was deleted from the cluster
+func (s *nodeEndpointMasks) forget(nodeName string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.masks, nodeName)
+}
+
+// sweep removes the expired masks, eg: of nodes removed from the cluster, at most once per mask lifetime.
+// It must be called with the lock held.
+func (s *nodeEndpointMasks) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.maxAge {
+		return
+	}
+	for name, m := range s.masks {
+		if now.Sub(m.created) >= s.maxAge {
+			delete(s.masks, name)
+		}
+	}
+	s.lastSweep = now
+}
+
+// optionalEndpoint is an optional kubelet endpoint and how it is addressed
+type optionalEndpoint struct {
+	endpoint Endpoint
+	url      func(nodeAPI) string
+}
+
+// optionalEndpoints returns the optional kubelet endpoints that are configured to be collected
+func (ka KubeAgentConfig) optionalEndpoints() []optionalEndpoint {
+	var endpoints []optionalEndpoint
+	if ka.RetrieveProbeMetrics {
+		endpoints = append(endpoints, optionalEndpoint{NodeProbeMetricsEndpoint, nodeAPI.metricsProbes})
+	}
+	if ka.RetrieveKubeletPods {
+		endpoints = append(endpoints, optionalEndpoint{NodePodsEndpoint, nodeAPI.statsPods})
+	}
+	if ka.RetrieveNodeSpec {
+		endpoints = append(endpoints, optionalEndpoint{NodeSpecEndpoint, nodeAPI.spec})
+	}
+	if ka.RetrieveKubeletConfigz {
+		endpoints = append(endpoints, optionalEndpoint{NodeConfigzEndpoint, nodeAPI.configz})
+	}
+	if ka.RetrieveKubeletMetrics {
+		endpoints = append(endpoints, optionalEndpoint{NodeKubeletMetricsEndpoint, nodeAPI.kubeletMetrics})
+	}
+	return endpoints
+}
+
+// probeNodeEndpoints probes the node for the optional endpoints that were not served by the node probed at
+// startup
+func probeNodeEndpoints(config KubeAgentConfig, conn NodeConnection, ns NodeSource, n v1.Node,
+	mask *EndpointMask) {
+	conn.NodeMetrics = mask
+	for _, e := range config.optionalEndpoints() {
+		if mask.Unreachable(e.endpoint) {
+			probeOptionalEndpoint(config, conn, ns, n, e.endpoint, e.url)
+		}
+	}
+}
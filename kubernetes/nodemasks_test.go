@@ -0,0 +1,121 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeEndpointMasks(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cluster := NewEndpointMask()
+	cluster.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+
+	t.Run("Ensure a copy of the cluster mask is used without per node masks", func(t *testing.T) {
+		var masks *nodeEndpointMasks
+		mask := masks.forNode("node0", cluster, func(*EndpointMask) { t.Error("unexpected probe") }, now)
+		mask.SetAvailability(NodeStatsSummaryEndpoint, Proxy, false)
+		if !cluster.ProxyAllowed(NodeStatsSummaryEndpoint) {
+			t.Error("expected the cluster mask to be unchanged")
+		}
+	})
+
+	t.Run("Ensure node masks are probed once and derived again once aged out", func(t *testing.T) {
+		masks := newNodeEndpointMasks(KubeAgentConfig{PollInterval: 60})
+		var probes int
+		probe := func(mask *EndpointMask) {
+			probes++
+			mask.SetAvailability(NodeSpecEndpoint, Proxy, true)
+		}
+		mask := masks.forNode("node0", cluster, probe, now)
+		if !mask.ProxyAllowed(NodeSpecEndpoint) || cluster.ProxyAllowed(NodeSpecEndpoint) {
+			t.Errorf("expected only the node mask to be probed, got %s and %s", mask, cluster)
+		}
+		mask.SetAvailability(NodeStatsSummaryEndpoint, Proxy, false)
+		if again := masks.forNode("node0", cluster, probe, now.Add(4*time.Minute)); again != mask || probes != 1 {
+			t.Errorf("expected the node mask to be kept, got %s after %d probes", again, probes)
+		}
+		aged := masks.forNode("node0", cluster, probe, now.Add(5*time.Minute))
+		if aged == mask || probes != 2 || !aged.ProxyAllowed(NodeStatsSummaryEndpoint) {
+			t.Errorf("expected the node mask to be derived again, got %s after %d probes", aged, probes)
+		}
+
+		masks.forNode("removed", cluster, probe, now.Add(5*time.Minute))
+		masks.forNode("node0", cluster, probe, now.Add(11*time.Minute))
+		if _, ok := masks.masks["removed"]; ok {
+			t.Error("expected the mask of a node no longer fetched to be removed")
+		}
+	})
+}
+
+func TestFetchNodeDataNodeMasks(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/nodes/"), "/")
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/spec/") && name == "upgraded":
+			fmt.Fprint(w, `{"num_cores":4}`)
+		case strings.HasSuffix(r.URL.Path, "/spec/"), strings.HasSuffix(r.URL.Path, "/configz") && name == "old":
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasSuffix(r.URL.Path, "/configz"):
+			fmt.Fprint(w, `{"kubeletconfig":{}}`)
+		default:
+			fmt.Fprintf(w, `{"node":{"nodeName":%q}}`, name)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestFetchNodeDataNodeMasks")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 0, false)
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, ForceKubeProxy: true, PollInterval: 60,
+		RetrieveNodeSpec: true, RetrieveKubeletConfigz: true}
+	// the node probed at startup served configz but not the machine spec
+	nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask(),
+		nodeMasks: newNodeEndpointMasks(config)}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	nodes.NodeMetrics.SetAvailability(NodeConfigzEndpoint, Proxy, true)
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+
+	for _, name := range []string{"upgraded", "old"} {
+		nd := nodeFetchData{nodeName: name, prefix: sample.StatsPrefix, workDir: workDir}
+		if err := retrieveNodeData(context.TODO(), nd, config, pollCycle{nodeSpecDue: true}, nodes, ns,
+			addressedNode(name, "10.0.0.1")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "stats-spec-upgraded.json")); err != nil {
+		t.Errorf("expected the machine spec of a node serving it to be collected: %v", err)
+	}
+	now := time.Now()
+	noProbe := func(*EndpointMask) { t.Error("unexpected probe") }
+	if mask := nodes.nodeMasks.forNode("old", nodes.NodeMetrics, noProbe, now); !mask.Unreachable(NodeConfigzEndpoint) ||
+		!mask.Unreachable(NodeSpecEndpoint) {
+		t.Errorf("expected the endpoints not served by the node to be unavailable, got %s", mask)
+	}
+	if !nodes.NodeMetrics.ProxyAllowed(NodeConfigzEndpoint) || !nodes.NodeMetrics.Unreachable(NodeSpecEndpoint) {
+		t.Errorf("expected the cluster mask to be unchanged, got %s", nodes.NodeMetrics)
+	}
+}
@@ -0,0 +1,133 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// CapacityType is the normalized purchase option of a node at collection time
+type CapacityType string
+
+const (
+	// CapacityTypeOnDemand nodes are regular, non-interruptible capacity
+	CapacityTypeOnDemand CapacityType = "on-demand"
+	// CapacityTypeSpot nodes are spot or preemptible capacity that the provider may reclaim
+	CapacityTypeSpot CapacityType = "spot"
+	// CapacityTypeUnknown nodes carry no recognized capacity type label
+	CapacityTypeUnknown CapacityType = "unknown"
+)
+
+// node labels used by each provider to describe the capacity type of a node
+const (
+	karpenterCapacityTypeLabel = "karpenter.sh/capacity-type"
+	eksCapacityTypeLabel       = "eks.amazonaws.com/capacityType"
+	gkeSpotLabel               = "cloud.google.com/gke-spot"
+	gkePreemptibleLabel        = "cloud.google.com/gke-preemptible"
+	aksScaleSetPriorityLabel   = "kubernetes.azure.com/scalesetpriority"
+)
+
+// nodeMetadata is the per node record written to the node metadata export
+type nodeMetadata struct {
+	Name         string       `json:"name"`
+	ProviderID   string       `json:"providerID,omitempty"`
+	CapacityType CapacityType `json:"capacityType"`
+	// MachineID and BootID identify the machine of the node, a node rejoining under a new name on the same
+	// machine keeps its machine ID
+	MachineID string `json:"machineID,omitempty"`
+	BootID    string `json:"bootID,omitempty"`
+}
+
+// getCapacityType normalizes the provider specific capacity type labels of a node
+func getCapacityType(n v1.Node) CapacityType {
+	// karpenter labels take precedence as they are set regardless of the underlying provider
+	switch strings.ToLower(n.Labels[karpenterCapacityTypeLabel]) {
+	case "spot":
+		return CapacityTypeSpot
+	case "on-demand":
+		return CapacityTypeOnDemand
+	}
+
+	switch strings.ToUpper(n.Labels[eksCapacityTypeLabel]) {
+	case "SPOT":
+		return CapacityTypeSpot
+	case "ON_DEMAND":
+		return CapacityTypeOnDemand
+	}
+
+	if strings.EqualFold(n.Labels[gkeSpotLabel], "true") || strings.EqualFold(n.Labels[gkePreemptibleLabel], "true") {
+		return CapacityTypeSpot
+	}
+
+	switch strings.ToLower(n.Labels[aksScaleSetPriorityLabel]) {
+	case "spot":
+		return CapacityTypeSpot
+	case "regular":
+		return CapacityTypeOnDemand
+	}
+
+	return CapacityTypeUnknown
+}
+
+// informerNodes returns the nodes currently held by the nodes informer, if one is running
+func informerNodes(informers map[string]*cache.SharedIndexInformer) []v1.Node {
+	informer, ok := informers["nodes"]
+	if !ok || informer == nil || *informer == nil {
+		return nil
+	}
+	var nodes []v1.Node
+	for _, obj := range (*informer).GetIndexer().List() {
+		if n, ok := obj.(*v1.Node); ok {
+			nodes = append(nodes, *n)
+		}
+	}
+	return nodes
+}
+
+// writeNodeMetadata writes the normalized node metadata export to the sample directory
+// and returns the number of nodes found for each capacity type
+func writeNodeMetadata(workDir *util.WorkDir, nodes []v1.Node) (map[CapacityType]int, error) {
+	counts := map[CapacityType]int{}
+	metadata := make([]nodeMetadata, 0, len(nodes))
+	for _, n := range nodes {
+		ct := getCapacityType(n)
+		counts[ct]++
+		metadata = append(metadata, nodeMetadata{
+			Name:         n.Name,
+			ProviderID:   n.Spec.ProviderID,
+			CapacityType: ct,
+			MachineID:    n.Status.NodeInfo.MachineID,
+			BootID:       n.Status.NodeInfo.BootID,
+		})
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return counts, err
+	}
+
+	log.Debugf("Node capacity types: %d spot, %d on-demand, %d unknown",
+		counts[CapacityTypeSpot], counts[CapacityTypeOnDemand], counts[CapacityTypeUnknown])
+
+	return counts, os.WriteFile(filepath.Join(workDir.Name(), sample.NodeMetadataFile), data, 0644)
+}
+
+// manifestCapacityTypes returns the node counts of each capacity type keyed as recorded in the sample
+// manifest, nil if no node was counted
+func manifestCapacityTypes(counts map[CapacityType]int) map[string]int {
+	if len(counts) == 0 {
+		return nil
+	}
+	types := make(map[string]int, len(counts))
+	for ct, count := range counts {
+		types[string(ct)] = count
+	}
+	return types
+}
@@ -0,0 +1,84 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetCapacityType(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected CapacityType
+	}{
+		{"karpenter spot", map[string]string{karpenterCapacityTypeLabel: "spot"}, CapacityTypeSpot},
+		{"karpenter on-demand", map[string]string{karpenterCapacityTypeLabel: "on-demand"}, CapacityTypeOnDemand},
+		{"eks managed node group spot", map[string]string{eksCapacityTypeLabel: "SPOT"}, CapacityTypeSpot},
+		{"eks managed node group on-demand", map[string]string{eksCapacityTypeLabel: "ON_DEMAND"},
+			CapacityTypeOnDemand},
+		{"gke spot", map[string]string{gkeSpotLabel: "true"}, CapacityTypeSpot},
+		{"gke preemptible", map[string]string{gkePreemptibleLabel: "true"}, CapacityTypeSpot},
+		{"aks spot", map[string]string{aksScaleSetPriorityLabel: "spot"}, CapacityTypeSpot},
+		{"aks regular", map[string]string{aksScaleSetPriorityLabel: "regular"}, CapacityTypeOnDemand},
+		{"karpenter takes precedence", map[string]string{
+			karpenterCapacityTypeLabel: "on-demand",
+			eksCapacityTypeLabel:       "SPOT",
+		}, CapacityTypeOnDemand},
+		{"unrecognized value", map[string]string{eksCapacityTypeLabel: "RESERVED"}, CapacityTypeUnknown},
+		{"no labels", nil, CapacityTypeUnknown},
+		{"generic node", nodeSampleLabels, CapacityTypeUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node0", Labels: tt.labels}}
+			if ct := getCapacityType(n); ct != tt.expected {
+				t.Errorf("expected capacity type %s but got %s", tt.expected, ct)
+			}
+		})
+	}
+}
+
+func TestWriteNodeMetadata(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestWriteNodeMetadata")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	nodes := []v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "spot", Labels: map[string]string{gkeSpotLabel: "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "regular"}, Spec: v1.NodeSpec{ProviderID: "aws:///us-west-2a/i-1"}},
+	}
+
+	counts, err := writeNodeMetadata(workDir, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if counts[CapacityTypeSpot] != 1 || counts[CapacityTypeUnknown] != 1 {
+		t.Errorf("unexpected capacity type counts: %+v", counts)
+	}
+	if types := manifestCapacityTypes(counts); len(types) != 2 || types["spot"] != 1 || types["unknown"] != 1 {
+		t.Errorf("unexpected manifest capacity type counts: %v", types)
+	}
+
+	data, err := os.ReadFile(dir + "/" + sample.NodeMetadataFile)
+	if err != nil {
+		t.Fatalf("unable to read node metadata: %v", err)
+	}
+	var metadata []nodeMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		t.Fatalf("unable to unmarshal node metadata: %v", err)
+	}
+	if len(metadata) != 2 || metadata[0].CapacityType != CapacityTypeSpot ||
+		metadata[1].ProviderID != "aws:///us-west-2a/i-1" {
+		t.Errorf("unexpected node metadata: %+v", metadata)
+	}
+}
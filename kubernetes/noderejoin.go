@@ -0,0 +1,183 @@
+package kubernetes
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// departedNodeRetention is how long the machine of a node no longer listed is remembered, a node listed on
+// the same machine within it is the departed node rejoining under a new name
+const departedNodeRetention = time.Hour
+
+// nodeMachine is the node a machine was last listed as
+type nodeMachine struct {
+	name     string
+	bootID   string
+	lastSeen time.Time
+}
+
+// nodeRejoin is a node listed on the machine of a departed node, whose baselines are yet to be relinked
+type nodeRejoin struct {
+	node      string
+	previous  string
+	machineID string
+	// sameBoot is set when the machine was not rebooted, so its counters continue from the baselines
+	sameBoot bool
+}
+
+// nodeMachines tracks the machine ID of the listed nodes, so a node reprovisioned under a new name on the
+// same machine is linked to its previous name instead of leaving the baselines of that name behind. It is
+// safe for concurrent use.
+type nodeMachines struct {
+	mu       sync.Mutex
+	machines map[string]nodeMachine
+	// collided are the machine IDs listed for more than one node at once, eg: by cloned VMs, which are
+	// never linked
+	collided map[string]bool
+	pending  []nodeRejoin
+	// relinked are the rejoins whose baselines were relinked since they were last taken
+	relinked []sample.NodeRejoin
+}
+
+func newNodeMachines() *nodeMachines {
+	return &nodeMachines{machines: map[string]nodeMachine{}, collided: map[string]bool{}}
+}
+
+// record records the machines of the ready nodes listed at now. A node listed on the machine of a node that
+// is no longer in the ready list, and was last seen within departedNodeRetention, is a rejoin.
+func (m *nodeMachines) record(nodes []v1.Node, now time.Time) {
+	if m == nil {
+		return
+	}
+	ready := make(map[string]bool, len(nodes))
+	listed := map[string]int{}
+	for _, n := range nodes {
+		ready[n.Name] = true
+		if id := n.Status.NodeInfo.MachineID; id != "" {
+			listed[id]++
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, count := range listed {
+		if count > 1 && !m.collided[id] {
+			log.Warnf("Machine ID %s is reported by %d nodes, nodes on it are not linked across names", id, count)
+			m.collided[id] = true
+		}
+	}
+	for _, n := range nodes {
+		id := n.Status.NodeInfo.MachineID
+		if id == "" || m.collided[id] {
+			continue
+		}
+		previous, ok := m.machines[id]
+		if ok && previous.name != n.Name && !ready[previous.name] &&
+			now.Sub(previous.lastSeen) <= departedNodeRetention {
+			log.Infof("Node %s rejoined the cluster as node %s on machine %s", previous.name, n.Name, id)
+			m.pending = append(m.pending, nodeRejoin{
+				node:      n.Name,
+				previous:  previous.name,
+				machineID: id,
+				sameBoot:  previous.bootID != "" && previous.bootID == n.Status.NodeInfo.BootID,
+			})
+		}
+		m.machines[id] = nodeMachine{name: n.Name, bootID: n.Status.NodeInfo.BootID, lastSeen: now}
+	}
+	for id, machine := range m.machines {
+		if now.Sub(machine.lastSeen) > departedNodeRetention {
+			delete(m.machines, id)
+		}
+	}
+}
+
+// relink relinks the baselines in dir of the nodes that rejoined under a new name since the last call
+func (m *nodeMachines) relink(dir string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.pending {
+		outcome, err := relinkNodeBaselines(dir, r)
+		if err != nil {
+			log.Warnf("Warning: unable to relink the baselines of node %s to node %s: %v", r.previous, r.node, err)
+		}
+		m.relinked = append(m.relinked, sample.NodeRejoin{
+			Node:         r.node,
+			PreviousNode: r.previous,
+			MachineID:    r.machineID,
+			Baseline:     outcome,
+		})
+	}
+	m.pending = nil
+}
+
+// take returns the rejoins relinked since the last call
+func (m *nodeMachines) take() []sample.NodeRejoin {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	relinked := m.relinked
+	m.relinked = nil
+	return relinked
+}
+
+// relinkNodeBaselines moves the baselines in dir of the previous name of a rejoined node to its new name if
+// the machine was not rebooted, otherwise its counters restarted and the baselines are removed. Baselines the
+// new name already has are kept. Returns how the baselines were handled.
+func relinkNodeBaselines(dir string, r nodeRejoin) (string, error) {
+	outcome := sample.BaselineInvalidated
+	if r.sameBoot {
+		outcome = sample.BaselineMigrated
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return outcome, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		source, ext, ok := nodeBaselineFile(e.Name(), r.previous)
+		if !ok {
+			continue
+		}
+		from := filepath.Join(dir, e.Name())
+		if r.sameBoot {
+			to := filepath.Join(dir, sample.NodeSourceName(sample.BaselinePrefix, source, r.node)+ext)
+			if _, err := os.Stat(to); os.IsNotExist(err) {
+				if err := os.Rename(from, to); err != nil {
+					return outcome, err
+				}
+				continue
+			}
+		}
+		if err := os.Remove(from); err != nil {
+			return outcome, err
+		}
+	}
+	return outcome, nil
+}
+
+// nodeBaselineFile returns the source and extension of a baseline file of the node. Node names may contain
+// dots, so the name must be followed by the extension alone.
+func nodeBaselineFile(fileName, nodeName string) (string, string, bool) {
+	for _, source := range reservedSourceNames {
+		rest := strings.TrimPrefix(fileName, sample.NodeSourceName(sample.BaselinePrefix, source, nodeName))
+		if rest != fileName && rest == path.Ext(rest) {
+			return source, rest, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,126 @@
+package kubernetes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func machineNode(name, machineID, bootID string) v1.Node {
+	return v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     v1.NodeStatus{NodeInfo: v1.NodeSystemInfo{MachineID: machineID, BootID: bootID}},
+	}
+}
+
+func TestNodeMachines(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 0, 0, time.UTC)
+
+	t.Run("Ensure a node rejoining on the same machine is linked", func(t *testing.T) {
+		m := newNodeMachines()
+		m.record([]v1.Node{machineNode("old", "m1", "b1"), machineNode("other", "m2", "b2")}, start)
+		m.record([]v1.Node{machineNode("new", "m1", "b1"), machineNode("other", "m2", "b2")},
+			start.Add(time.Minute))
+		if len(m.pending) != 1 || m.pending[0].previous != "old" || m.pending[0].node != "new" ||
+			!m.pending[0].sameBoot {
+			t.Errorf("expected the new node to be linked to the old one, got %+v", m.pending)
+		}
+	})
+
+	t.Run("Ensure a rebooted machine is not the same boot", func(t *testing.T) {
+		m := newNodeMachines()
+		m.record([]v1.Node{machineNode("old", "m1", "b1")}, start)
+		m.record([]v1.Node{machineNode("new", "m1", "b2")}, start.Add(time.Minute))
+		if len(m.pending) != 1 || m.pending[0].sameBoot {
+			t.Errorf("expected a rejoin after a reboot, got %+v", m.pending)
+		}
+	})
+
+	t.Run("Ensure a node still ready is not linked", func(t *testing.T) {
+		m := newNodeMachines()
+		m.record([]v1.Node{machineNode("old", "m1", "b1")}, start)
+		m.record([]v1.Node{machineNode("old", "m1", "b1"), machineNode("clone", "m1", "b1")},
+			start.Add(time.Minute))
+		// the clone is listed alone once the original leaves, its machine ID is still known to collide
+		m.record([]v1.Node{machineNode("clone", "m1", "b1")}, start.Add(2*time.Minute))
+		if len(m.pending) != 0 {
+			t.Errorf("expected cloned machines not to be linked, got %+v", m.pending)
+		}
+	})
+
+	t.Run("Ensure a machine departed long ago is not linked", func(t *testing.T) {
+		m := newNodeMachines()
+		m.record([]v1.Node{machineNode("old", "m1", "b1")}, start)
+		m.record([]v1.Node{machineNode("other", "m2", "b2")}, start.Add(time.Minute))
+		m.record([]v1.Node{machineNode("new", "m1", "b1")}, start.Add(2*departedNodeRetention))
+		if len(m.pending) != 0 {
+			t.Errorf("expected the departed machine to be forgotten, got %+v", m.pending)
+		}
+	})
+
+	t.Run("Ensure nodes without a machine ID are not linked", func(t *testing.T) {
+		m := newNodeMachines()
+		m.record([]v1.Node{machineNode("old", "", "")}, start)
+		m.record([]v1.Node{machineNode("new", "", "")}, start.Add(time.Minute))
+		if len(m.pending) != 0 {
+			t.Errorf("expected no rejoin without a machine ID, got %+v", m.pending)
+		}
+	})
+}
+
+func TestRelinkNodeBaselines(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestRelinkNodeBaselines")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(`{}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	write("baseline-summary-old.ec2.internal.json")
+	write("baseline-container-old.ec2.internal.json")
+	write("baseline-summary-old.ec2.internal.other.json")
+	write("baseline-container-new.json")
+	write("baseline-summary-rebooted.json")
+
+	m := newNodeMachines()
+	m.pending = []nodeRejoin{
+		{node: "new", previous: "old.ec2.internal", machineID: "m1", sameBoot: true},
+		{node: "again", previous: "rebooted", machineID: "m2"},
+	}
+	m.relink(dir)
+
+	if !exists("baseline-summary-new.json") || exists("baseline-summary-old.ec2.internal.json") {
+		t.Error("expected the baseline of the previous name to be moved to the new name")
+	}
+	if exists("baseline-container-old.ec2.internal.json") || !exists("baseline-container-new.json") {
+		t.Error("expected the baseline the new name already has to be kept")
+	}
+	if !exists("baseline-summary-old.ec2.internal.other.json") {
+		t.Error("expected the baseline of a node with a longer name to be left alone")
+	}
+	if exists("baseline-summary-rebooted.json") || exists("baseline-summary-again.json") {
+		t.Error("expected the baseline of a rebooted machine to be removed")
+	}
+
+	rejoins := m.take()
+	if len(rejoins) != 2 || rejoins[0].Baseline != sample.BaselineMigrated ||
+		rejoins[1].Baseline != sample.BaselineInvalidated || rejoins[1].PreviousNode != "rebooted" {
+		t.Errorf("unexpected rejoins %+v", rejoins)
+	}
+	if len(m.take()) != 0 {
+		t.Error("expected the rejoins to be taken once")
+	}
+}
@@ -0,0 +1,199 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultNodeSizeSpikeFactor is the default factor by which the data collected from a node source must
+// exceed its trailing average to be reported as a size spike
+const DefaultNodeSizeSpikeFactor = 4.0
+
+const (
+	// nodeSizeHistoryLength is the number of collections the trailing average of a node source covers
+	nodeSizeHistoryLength = 10
+	// minNodeSizeHistory is the number of collections of a node source needed before its size is compared
+	minNodeSizeHistory = 3
+	// minNodeSizeSpikeBytes avoids reporting the growth of node data too small to be a concern
+	minNodeSizeSpikeBytes = 1 << 20
+)
+
+// nodeSourceKey identifies the data collected from a source, such as the summary, of a node
+type nodeSourceKey struct {
+	source string
+	node   string
+}
+
+// nodeSizeSpike is node source data that grew well beyond its trailing average
+type nodeSizeSpike struct {
+	nodeSourceKey
+	size    int64
+	average int64
+}
+
+// nodeSizeHistory is the size of the data collected from each node source over recent collections, and
+// the number of size spikes reported for each source since the agent started. Each record replaces the
+// maps rather than modifying them, so a copy of the history is safe to share.
+type nodeSizeHistory struct {
+	sizes  map[nodeSourceKey][]int64
+	spikes map[string]uint64
+}
+
+// record adds the sizes collected in a collection to the history and returns the node sources that
+// exceeded their trailing average by more than factor. Node sources not collected are dropped from the
+// history, so nodes that leave the cluster are not retained. A factor of 0 or less disables detection.
+func (h nodeSizeHistory) record(collected map[nodeSourceKey]int64, factor float64) (nodeSizeHistory,
+	[]nodeSizeSpike) {
+	next := nodeSizeHistory{
+		sizes:  make(map[nodeSourceKey][]int64, len(collected)),
+		spikes: make(map[string]uint64, len(h.spikes)),
+	}
+	for source, count := range h.spikes {
+		next.spikes[source] = count
+	}
+
+	var spikes []nodeSizeSpike
+	for key, size := range collected {
+		previous := h.sizes[key]
+		if factor > 0 && len(previous) >= minNodeSizeHistory && size >= minNodeSizeSpikeBytes {
+			var total int64
+			for _, s := range previous {
+				total += s
+			}
+			average := total / int64(len(previous))
+			if float64(size) > float64(average)*factor {
+				spikes = append(spikes, nodeSizeSpike{nodeSourceKey: key, size: size, average: average})
+				next.spikes[key.source]++
+			}
+		}
+
+		sizes := append(append(make([]int64, 0, nodeSizeHistoryLength), previous...), size)
+		if len(sizes) > nodeSizeHistoryLength {
+			sizes = sizes[len(sizes)-nodeSizeHistoryLength:]
+		}
+		next.sizes[key] = sizes
+	}
+
+	sort.Slice(spikes, func(i, j int) bool {
+		if spikes[i].node != spikes[j].node {
+			return spikes[i].node < spikes[j].node
+		}
+		return spikes[i].source < spikes[j].source
+	})
+	return next, spikes
+}
+
+// latest returns the most recent size of each node source in the history
+func (h nodeSizeHistory) latest() map[nodeSourceKey]int64 {
+	sizes := make(map[nodeSourceKey]int64, len(h.sizes))
+	for key, s := range h.sizes {
+		if len(s) > 0 {
+			sizes[key] = s[len(s)-1]
+		}
+	}
+	return sizes
+}
+
+// nodeDataSizes returns the size of the data collected from each node source in the sample directory
+func nodeDataSizes(msd string) (map[nodeSourceKey]int64, error) {
+	return prefixedNodeDataSizes(msd, sample.StatsPrefix)
+}
+
+// prefixedNodeDataSizes returns the size of the node source files with the prefix in the directory
+func prefixedNodeDataSizes(dir, prefix string) (map[nodeSourceKey]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[nodeSourceKey]int64)
+	for _, e := range entries {
+		key, ok := parsePrefixedNodeSourceFile(prefix, e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		sizes[key] = info.Size()
+	}
+	return sizes, nil
+}
+
+// parseNodeSourceFile returns the source and node of a file collected from a node for the current sample.
+// Source names never contain '-' so the node name is everything after the source.
+func parseNodeSourceFile(name string) (nodeSourceKey, bool) {
+	return parsePrefixedNodeSourceFile(sample.StatsPrefix, name)
+}
+
+// parsePrefixedNodeSourceFile returns the source and node of a node source file with the prefix
+func parsePrefixedNodeSourceFile(prefix, name string) (nodeSourceKey, bool) {
+	if !strings.HasPrefix(name, prefix+"-") || strings.HasSuffix(name, sample.UnchangedSuffix) {
+		return nodeSourceKey{}, false
+	}
+	source, node, ok := strings.Cut(strings.TrimPrefix(name, prefix+"-"), "-")
+	if !ok {
+		return nodeSourceKey{}, false
+	}
+	for _, ext := range []string{".json", ".txt"} {
+		node = strings.TrimSuffix(node, ext)
+	}
+	return nodeSourceKey{source: source, node: node}, node != ""
+}
+
+// checkNodeDataSizes records the size of the node data in the sample directory and warns about each
+// node source whose data grew beyond the configured factor of its trailing average. Returns the updated
+// size history.
+func checkNodeDataSizes(msd string, config KubeAgentConfig, state *AgentState) nodeSizeHistory {
+	sizes, err := nodeDataSizes(msd)
+	if err != nil {
+		log.Warnf("Warning: unable to determine node data sizes: %s", err)
+		return nodeSizeHistory{}
+	}
+	history, spikes := state.recordNodeSizes(sizes, config.NodeSizeSpikeFactor)
+	for _, s := range spikes {
+		log.Warnf("Node %s %s data is %d bytes, more than %v times its trailing average of %d bytes",
+			s.node, s.source, s.size, config.NodeSizeSpikeFactor, s.average)
+	}
+	return history
+}
+
+// nodeSizeRecord is the size history of a node source written into the sample for diagnostics
+type nodeSizeRecord struct {
+	Node   string  `json:"node"`
+	Source string  `json:"source"`
+	Sizes  []int64 `json:"sizes"`
+}
+
+// writeNodeSizeHistory writes the size history of each node source into the sample directory, oldest
+// size first
+func writeNodeSizeHistory(workDir *util.WorkDir, history nodeSizeHistory) (rerr error) {
+	if len(history.sizes) == 0 {
+		return nil
+	}
+	records := make([]nodeSizeRecord, 0, len(history.sizes))
+	for key, sizes := range history.sizes {
+		records = append(records, nodeSizeRecord{Node: key.node, Source: key.source, Sizes: sizes})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Node != records[j].Node {
+			return records[i].Node < records[j].Node
+		}
+		return records[i].Source < records[j].Source
+	})
+
+	f, err := os.Create(filepath.Join(workDir.Name(), sample.NodeSizeHistoryFile))
+	if err != nil {
+		return err
+	}
+	defer util.SafeClose(f.Close, &rerr)
+
+	return json.NewEncoder(f).Encode(records)
+}
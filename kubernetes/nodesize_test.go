@@ -0,0 +1,134 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+)
+
+func TestParseNodeSourceFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected nodeSourceKey
+		ok       bool
+	}{
+		{name: "stats-summary-node0.json", expected: nodeSourceKey{source: "summary", node: "node0"}, ok: true},
+		{
+			name:     "stats-summary-ip-10-0-0-1.ec2.internal.json",
+			expected: nodeSourceKey{source: "summary", node: "ip-10-0-0-1.ec2.internal"},
+			ok:       true,
+		},
+		{name: "stats-pods-node0.txt", expected: nodeSourceKey{source: "pods", node: "node0"}, ok: true},
+		{name: "stats-pods-node0", expected: nodeSourceKey{source: "pods", node: "node0"}, ok: true},
+		{name: "stats-summary-node0.json" + sample.UnchangedSuffix},
+		{name: "baseline-summary-node0.json"},
+		{name: "pods.jsonl"},
+		{name: "stats-summary"},
+	}
+	for _, tc := range tests {
+		key, ok := parseNodeSourceFile(tc.name)
+		if ok != tc.ok || key != tc.expected {
+			t.Errorf("%s: expected %+v %v, got %+v %v", tc.name, tc.expected, tc.ok, key, ok)
+		}
+	}
+}
+
+func TestNodeSizeHistory(t *testing.T) {
+	node0 := nodeSourceKey{source: "summary", node: "node0"}
+	node1 := nodeSourceKey{source: "summary", node: "node1"}
+	const mb = int64(minNodeSizeSpikeBytes)
+
+	var h nodeSizeHistory
+	var spikes []nodeSizeSpike
+	for i := 0; i < minNodeSizeHistory; i++ {
+		h, spikes = h.record(map[nodeSourceKey]int64{node0: mb, node1: 100}, 4)
+		if len(spikes) != 0 {
+			t.Fatalf("expected no spikes before the history is established, got %+v", spikes)
+		}
+	}
+
+	t.Run("Ensure growth within the factor is not a spike", func(t *testing.T) {
+		_, spikes := h.record(map[nodeSourceKey]int64{node0: 4 * mb, node1: 100}, 4)
+		if len(spikes) != 0 {
+			t.Errorf("expected no spikes, got %+v", spikes)
+		}
+	})
+
+	t.Run("Ensure growth of small data is not a spike", func(t *testing.T) {
+		_, spikes := h.record(map[nodeSourceKey]int64{node0: mb, node1: 100 * 100}, 4)
+		if len(spikes) != 0 {
+			t.Errorf("expected no spikes, got %+v", spikes)
+		}
+	})
+
+	t.Run("Ensure growth beyond the factor is a spike counted for the source", func(t *testing.T) {
+		next, spikes := h.record(map[nodeSourceKey]int64{node0: 5 * mb, node1: 100}, 4)
+		if len(spikes) != 1 || spikes[0].nodeSourceKey != node0 || spikes[0].size != 5*mb || spikes[0].average != mb {
+			t.Errorf("unexpected spikes %+v", spikes)
+		}
+		if next.spikes["summary"] != 1 {
+			t.Errorf("expected a spike to be counted for the summary source, got %v", next.spikes)
+		}
+		if h.spikes["summary"] != 0 {
+			t.Error("expected the previous history not to be modified")
+		}
+	})
+
+	t.Run("Ensure a factor of 0 disables detection", func(t *testing.T) {
+		_, spikes := h.record(map[nodeSourceKey]int64{node0: 100 * mb}, 0)
+		if len(spikes) != 0 {
+			t.Errorf("expected no spikes, got %+v", spikes)
+		}
+	})
+
+	t.Run("Ensure the history is bounded and nodes not collected are dropped", func(t *testing.T) {
+		next := h
+		for i := 0; i < 2*nodeSizeHistoryLength; i++ {
+			next, _ = next.record(map[nodeSourceKey]int64{node0: mb}, 4)
+		}
+		if len(next.sizes[node0]) != nodeSizeHistoryLength {
+			t.Errorf("expected %d sizes, got %d", nodeSizeHistoryLength, len(next.sizes[node0]))
+		}
+		if _, ok := next.sizes[node1]; ok {
+			t.Error("expected the node no longer collected to be dropped")
+		}
+	})
+}
+
+func TestWriteNodeSizeHistory(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestWriteNodeSizeHistory")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	if err := os.WriteFile(filepath.Join(dir, "stats-summary-node0.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sizes, err := nodeDataSizes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := nodeSizeHistory{}.record(sizes, DefaultNodeSizeSpikeFactor)
+	if err := writeNodeSizeHistory(workDir, h); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, sample.NodeSizeHistoryFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []nodeSizeRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Node != "node0" || records[0].Source != "summary" ||
+		len(records[0].Sizes) != 1 || records[0].Sizes[0] != 2 {
+		t.Errorf("unexpected node size history %+v", records)
+	}
+}
@@ -0,0 +1,73 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// errNotReadyNode classifies the failures of nodes collected while NotReady within the not ready grace period
+var errNotReadyNode = errors.New("node became NotReady within the not ready grace period")
+
+// nodeReady returns true if the NodeReady condition of the node is True
+func nodeReady(n v1.Node) bool {
+	i, nc := getNodeCondition(&n.Status, v1.NodeReady)
+	return i >= 0 && nc.Status == v1.ConditionTrue
+}
+
+// nodeNotReady returns true if the node reports a NodeReady condition that is not True
+func nodeNotReady(n v1.Node) bool {
+	i, nc := getNodeCondition(&n.Status, v1.NodeReady)
+	return i >= 0 && nc.Status != v1.ConditionTrue
+}
+
+// recentlyNotReady returns true if the NodeReady condition of the node transitioned away from True no more
+// than grace before now, as nodes flapping between Ready and NotReady often still serve their stats. A grace
+// of 0 never collects NotReady nodes.
+func recentlyNotReady(n v1.Node, grace time.Duration, now time.Time) bool {
+	if grace <= 0 {
+		return false
+	}
+	i, nc := getNodeCondition(&n.Status, v1.NodeReady)
+	if i < 0 || nc.Status == v1.ConditionTrue || nc.LastTransitionTime.IsZero() {
+		return false
+	}
+	return now.Sub(nc.LastTransitionTime.Time) <= grace
+}
+
+// staleHeartbeat returns the age of the heartbeat of the NodeReady condition of a ready node and true if it is
+// older than maxAge, as the condition of a node whose kubelet died may be stuck True. A maxAge of 0 never
+// finds a heartbeat stale.
+func staleHeartbeat(n v1.Node, maxAge time.Duration, now time.Time) (time.Duration, bool) {
+	if maxAge <= 0 {
+		return 0, false
+	}
+	i, nc := getNodeCondition(&n.Status, v1.NodeReady)
+	if i < 0 || nc.LastHeartbeatTime.IsZero() {
+		return 0, false
+	}
+	age := now.Sub(nc.LastHeartbeatTime.Time)
+	return age, age > maxAge
+}
+
+// nodeFetchError returns the error recorded for a node that failed to be collected, classifying the
+// failures of NotReady nodes apart from those of ready nodes
+func nodeFetchError(n v1.Node, err error) error {
+	if !nodeNotReady(n) {
+		return fmt.Errorf("node metrics retrieval problem occurred: %w", err)
+	}
+	return fmt.Errorf("%w: node metrics retrieval problem occurred: %w", errNotReadyNode, err)
+}
+
+// countNotReadyNodes returns the number of failed nodes that were collected while NotReady
+func countNotReadyNodes(failed map[string]error) int {
+	count := 0
+	for _, err := range failed {
+		if errors.Is(err, errNotReadyNode) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,172 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func notReadyNode(name string, status v1.ConditionStatus, since time.Time) v1.Node {
+	n := addressedNode(name, "10.0.0.1")
+	n.Status.Conditions[0].Status = status
+	n.Status.Conditions[0].LastTransitionTime = metav1.NewTime(since)
+	return n
+}
+
+func TestRecentlyNotReady(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	grace := 5 * time.Minute
+	tests := []struct {
+		name string
+		node v1.Node
+		want bool
+	}{
+		{name: "ready", node: notReadyNode("n", v1.ConditionTrue, now.Add(-time.Minute)), want: false},
+		{name: "within grace", node: notReadyNode("n", v1.ConditionFalse, now.Add(-time.Minute)), want: true},
+		{name: "unknown within grace", node: notReadyNode("n", v1.ConditionUnknown, now.Add(-time.Minute)),
+			want: true},
+		{name: "at grace boundary", node: notReadyNode("n", v1.ConditionFalse, now.Add(-grace)), want: true},
+		{name: "just past grace", node: notReadyNode("n", v1.ConditionFalse, now.Add(-grace-time.Nanosecond)),
+			want: false},
+		{name: "no transition time", node: notReadyNode("n", v1.ConditionFalse, time.Time{}), want: false},
+		{name: "no ready condition", node: v1.Node{}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := recentlyNotReady(tt.node, grace, now); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+	if recentlyNotReady(notReadyNode("n", v1.ConditionFalse, now), 0, now) {
+		t.Error("expected no grace period to never include NotReady nodes")
+	}
+}
+
+func TestGetReadyNodesNotReadyGracePeriod(t *testing.T) {
+	ready := addressedNode("ready", "10.0.0.1")
+	flapping := notReadyNode("flapping", v1.ConditionFalse, time.Now().Add(-time.Minute))
+	down := notReadyNode("down", v1.ConditionFalse, time.Now().Add(-time.Hour))
+	clientset := fake.NewSimpleClientset(&ready, &flapping, &down)
+
+	t.Run("Ensure NotReady nodes are left out by default", func(t *testing.T) {
+		nodes, err := newConfiguredNodeSource(KubeAgentConfig{Clientset: clientset}).GetReadyNodes(context.TODO())
+		if err != nil || len(nodes) != 1 || nodes[0].Name != "ready" {
+			t.Errorf("expected only the ready node, got %v %v", nodes, err)
+		}
+	})
+
+	t.Run("Ensure recently NotReady nodes are returned within the grace period", func(t *testing.T) {
+		config := KubeAgentConfig{Clientset: clientset, IncludeNotReadyGracePeriod: 300}
+		nodes, err := newConfiguredNodeSource(config).GetReadyNodes(context.TODO())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var names []string
+		for _, n := range nodes {
+			names = append(names, n.Name)
+		}
+		if strings.Join(names, ",") != "flapping,ready" {
+			t.Errorf("expected the ready and flapping nodes, got %v", names)
+		}
+	})
+}
+
+// heartbeatNode returns a ready node whose NodeReady condition was last heartbeated at heartbeat
+func heartbeatNode(name string, heartbeat time.Time) v1.Node {
+	n := addressedNode(name, "10.0.0.1")
+	n.Status.Conditions[0].LastHeartbeatTime = metav1.NewTime(heartbeat)
+	return n
+}
+
+func TestStaleHeartbeat(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	maxAge := 10 * time.Minute
+	tests := []struct {
+		name string
+		node v1.Node
+		want bool
+	}{
+		{name: "recent", node: heartbeatNode("n", now.Add(-time.Minute)), want: false},
+		{name: "at max age", node: heartbeatNode("n", now.Add(-maxAge)), want: false},
+		{name: "just past max age", node: heartbeatNode("n", now.Add(-maxAge-time.Nanosecond)), want: true},
+		{name: "hours old", node: heartbeatNode("n", now.Add(-3*time.Hour)), want: true},
+		{name: "no heartbeat time", node: heartbeatNode("n", time.Time{}), want: false},
+		{name: "no ready condition", node: v1.Node{}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := staleHeartbeat(tt.node, maxAge, now); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+	if _, stale := staleHeartbeat(heartbeatNode("n", now.Add(-3*time.Hour)), 0, now); stale {
+		t.Error("expected no max heartbeat age to never find a heartbeat stale")
+	}
+}
+
+func TestGetReadyNodesMaxHeartbeatAge(t *testing.T) {
+	fresh := heartbeatNode("fresh", time.Now().Add(-time.Minute))
+	zombie := heartbeatNode("zombie", time.Now().Add(-3*time.Hour))
+
+	t.Run("Ensure ready nodes with stale heartbeats are left out and logged", func(t *testing.T) {
+		hook := test.NewGlobal()
+		defer hook.Reset()
+		config := KubeAgentConfig{Clientset: fake.NewSimpleClientset(&fresh, &zombie), MaxHeartbeatAge: 600}
+		nodes, err := newConfiguredNodeSource(config).GetReadyNodes(context.TODO())
+		if err != nil || len(nodes) != 1 || nodes[0].Name != "fresh" {
+			t.Fatalf("expected only the node with a fresh heartbeat, got %v %v", nodes, err)
+		}
+		logged := false
+		for _, e := range hook.AllEntries() {
+			if e.Level == log.InfoLevel && strings.Contains(e.Message, "Node zombie is ready but its last "+
+				"heartbeat was 3h0m0s ago") {
+				logged = true
+			}
+		}
+		if !logged {
+			t.Error("expected the stale node to be logged with the age of its heartbeat")
+		}
+	})
+
+	t.Run("Ensure stale heartbeats are ignored by default", func(t *testing.T) {
+		config := KubeAgentConfig{Clientset: fake.NewSimpleClientset(&fresh, &zombie)}
+		if nodes, err := newConfiguredNodeSource(config).GetReadyNodes(context.TODO()); err != nil || len(nodes) != 2 {
+			t.Errorf("expected both nodes, got %v %v", nodes, err)
+		}
+	})
+
+	t.Run("Ensure an error is returned when every ready node is stale", func(t *testing.T) {
+		config := KubeAgentConfig{Clientset: fake.NewSimpleClientset(&zombie), MaxHeartbeatAge: 600}
+		_, err := newConfiguredNodeSource(config).GetReadyNodes(context.TODO())
+		if err == nil || !strings.Contains(err.Error(), "older than the max heartbeat age") {
+			t.Errorf("expected the stale nodes to be reported, got %v", err)
+		}
+	})
+}
+
+func TestNodeFetchError(t *testing.T) {
+	err := errors.New("connection refused")
+	failed := map[string]error{
+		"ready":    nodeFetchError(addressedNode("ready", "10.0.0.1"), err),
+		"flapping": nodeFetchError(notReadyNode("flapping", v1.ConditionFalse, time.Now()), err),
+	}
+	if errors.Is(failed["ready"], errNotReadyNode) || !errors.Is(failed["flapping"], errNotReadyNode) {
+		t.Errorf("expected only the NotReady node failure to be classified as NotReady, got %v", failed)
+	}
+	if !errors.Is(failed["flapping"], err) {
+		t.Errorf("expected the NotReady node failure to wrap its cause, got %v", failed["flapping"])
+	}
+	if n := countNotReadyNodes(failed); n != 1 {
+		t.Errorf("expected 1 NotReady node failure, got %d", n)
+	}
+}
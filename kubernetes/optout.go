@@ -0,0 +1,48 @@
+package kubernetes
+
+import (
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// NodeCollectAnnotation is the annotation a node opts out of collection with, by setting it to "false", eg:
+// for nodes running workloads sensitive to the load of the kubelet stats scrape. Opted out nodes are
+// reported as skipped rather than failed.
+const NodeCollectAnnotation = "metrics-agent.cloudability.com/collect"
+
+// optedOut returns true if a node is annotated to opt out of collection
+func optedOut(n v1.Node) bool {
+	value, ok := n.Annotations[NodeCollectAnnotation]
+	if !ok {
+		return false
+	}
+	collect, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		log.Warnf("Warning: node %s has an invalid %s annotation %q, it is collected", n.Name,
+			NodeCollectAnnotation, value)
+		return false
+	}
+	return !collect
+}
+
+// withoutOptedOutNodes returns the nodes to collect and the names of the nodes annotated to opt out of
+// collection
+func withoutOptedOutNodes(nodes []v1.Node) ([]v1.Node, []string) {
+	var collected []v1.Node
+	var skipped []string
+	for _, n := range nodes {
+		if optedOut(n) {
+			skipped = append(skipped, n.Name)
+			continue
+		}
+		collected = append(collected, n)
+	}
+	if len(skipped) > 0 {
+		log.Debugf("Nodes [%s] opted out of collection with the %s annotation", strings.Join(skipped, ", "),
+			NodeCollectAnnotation)
+	}
+	return collected, skipped
+}
@@ -0,0 +1,110 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	"github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+)
+
+func optOutNode(name, value string) v1.Node {
+	n := addressedNode(name, "10.0.0.1")
+	n.Annotations = map[string]string{NodeCollectAnnotation: value}
+	return n
+}
+
+func TestNodeOptOut(t *testing.T) {
+	t.Run("Ensure only nodes annotated false opt out", func(t *testing.T) {
+		nodes := []v1.Node{
+			addressedNode("plain", "10.0.0.1"),
+			optOutNode("gpu", "false"),
+			optOutNode("gpu-upper", " FALSE "),
+			optOutNode("explicit", "true"),
+			optOutNode("invalid", "nope"),
+		}
+		collected, skipped := withoutOptedOutNodes(nodes)
+		var names []string
+		for _, n := range collected {
+			names = append(names, n.Name)
+		}
+		if strings.Join(names, ",") != "plain,explicit,invalid" {
+			t.Errorf("unexpected collected nodes %v", names)
+		}
+		if strings.Join(skipped, ",") != "gpu,gpu-upper" {
+			t.Errorf("unexpected opted out nodes %v", skipped)
+		}
+	})
+
+	t.Run("Ensure opted out nodes are skipped rather than failed", func(t *testing.T) {
+		var mu sync.Mutex
+		requested := map[string]bool{}
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/nodes/"), "/")[0]
+			mu.Lock()
+			requested[name] = true
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"node":{"nodeName":%q}}`, name)
+		}))
+		defer ts.Close()
+
+		dir, err := os.MkdirTemp("", "TestNodeOptOut")
+		if err != nil {
+			t.Fatalf("error creating temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		workDir := util.NewWorkDir(dir)
+
+		ns := testNodeSource{Nodes: []v1.Node{addressedNode("node0", "10.0.0.1"), optOutNode("gpu", "false")}}
+		c := http.Client{Transport: &http.Transport{
+			// nolint gosec
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		nodes := NodeConnection{InClusterClient: raw.NewClient(c, true, nil, 0, false), NodeMetrics: NewEndpointMask()}
+		nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+		config := KubeAgentConfig{ClusterHostURL: ts.URL, ConcurrentPollers: 2, ForceKubeProxy: true, Dev: true}
+
+		health := newNodeHealthSnapshot()
+		failed, err := downloadNodeData(context.TODO(), sample.StatsPrefix, config, pollCycle{}, nodes, workDir, ns, nil, nil,
+			health)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(failed) != 0 {
+			t.Errorf("expected no failed nodes, got %v", failed)
+		}
+		if requested["gpu"] || !requested["node0"] {
+			t.Errorf("expected only node0 to be scraped, scraped %v", requested)
+		}
+		report := health.report(failed)
+		if len(report) != 2 || report[0].Node != "gpu" || report[0].Outcome != sample.NodeSkipped ||
+			report[0].Reason != sample.SkipOptedOut {
+			t.Errorf("expected gpu to be reported as opted out, got %+v", report)
+		}
+	})
+
+	t.Run("Ensure skipped nodes are logged apart from failed nodes", func(t *testing.T) {
+		hook := test.NewGlobal()
+		defer hook.Reset()
+		logSkippedNodes("Nodes not collected", map[string]string{
+			"gpu0": sample.SkipOptedOut,
+			"gpu1": sample.SkipOptedOut,
+			"vk":   sample.SkipVirtualKubelet,
+		})
+		if len(hook.Entries) != 1 ||
+			hook.LastEntry().Message != "Nodes not collected: 3 nodes skipped (opted_out: 2, virtual_kubelet: 1)" {
+			t.Errorf("unexpected log entries %+v", hook.Entries)
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package kubernetes
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPollOverrunThreshold is the default number of consecutive polls that must take longer than
+// the poll interval before collection is degraded by one level
+const DefaultPollOverrunThreshold = 3
+
+// DefaultPollRecoveryThreshold is the default number of consecutive polls that must complete within
+// the poll interval before one level of degradation is reversed
+const DefaultPollRecoveryThreshold = 5
+
+// DegradationLevel is a step on the ladder of collection reductions applied when polls repeatedly
+// take longer than the poll interval. Each level includes the reductions of the levels below it.
+type DegradationLevel int
+
+const (
+	// DegradationNone collects everything that is configured
+	DegradationNone DegradationLevel = iota
+	// DegradationSkipExtraEndpoints stops collecting extra kubelet endpoints and the optional kubelet
+	// endpoints, eg: the kubelet pods, which are the largest payloads of a node
+	DegradationSkipExtraEndpoints
+	// DegradationCPUAndMemoryOnly requests node summaries with only cpu and memory stats
+	DegradationCPUAndMemoryOnly
+	// DegradationReducedConcurrency halves the number of concurrent node pollers
+	DegradationReducedConcurrency
+)
+
+const maxDegradationLevel = DegradationReducedConcurrency
+
+func (l DegradationLevel) String() string {
+	switch l {
+	case DegradationNone:
+		return "none"
+	case DegradationSkipExtraEndpoints:
+		return "skip_extra_endpoints"
+	case DegradationCPUAndMemoryOnly:
+		return "cpu_and_memory_only"
+	case DegradationReducedConcurrency:
+		return "reduced_concurrency"
+	}
+	return "unknown"
+}
+
+// apply returns a copy of the config with the reductions of the degradation level applied, and the cycle of
+// a poll collected at the level. Node fetches are not paced while collection is degraded, as polls are
+// already overrunning the interval.
+func (l DegradationLevel) apply(config KubeAgentConfig) (KubeAgentConfig, pollCycle) {
+	var cycle pollCycle
+	if l > DegradationNone {
+		config.NodeFetchPacing = 0
+	}
+	if l >= DegradationSkipExtraEndpoints {
+		config.extraEndpoints = nil
+		config.RetrieveProbeMetrics = false
+		config.RetrieveKubeletPods = false
+		config.RetrieveNodeSpec = false
+		config.RetrieveKubeletConfigz = false
+		config.RetrieveKubeletMetrics = false
+	}
+	if l >= DegradationCPUAndMemoryOnly {
+		cycle.summaryCPUAndMemoryOnly = true
+	}
+	if l >= DegradationReducedConcurrency && config.ConcurrentPollers > 1 {
+		config.ConcurrentPollers /= 2
+	}
+	return config, cycle
+}
+
+// pollOverrunTracker counts polls that take longer than the poll interval and moves up or down the
+// degradation ladder once the configured number of consecutive overruns or on time polls is reached
+type pollOverrunTracker struct {
+	overrunThreshold    int
+	recoveryThreshold   int
+	totalOverruns       int
+	consecutiveOverruns int
+	consecutiveOnTime   int
+	level               DegradationLevel
+}
+
+func newPollOverrunTracker(overrunThreshold, recoveryThreshold int) pollOverrunTracker {
+	return pollOverrunTracker{
+		overrunThreshold:  overrunThreshold,
+		recoveryThreshold: recoveryThreshold,
+	}
+}
+
+// record tracks the duration of a completed poll and returns true if the poll overran the interval
+func (t *pollOverrunTracker) record(duration, interval time.Duration) bool {
+	if duration <= interval {
+		t.consecutiveOverruns = 0
+		t.consecutiveOnTime++
+		if t.level > DegradationNone && t.recoveryThreshold > 0 && t.consecutiveOnTime >= t.recoveryThreshold {
+			t.consecutiveOnTime = 0
+			t.level--
+			log.Infof("%d consecutive polls completed within the poll interval, reducing collection "+
+				"degradation to level %d (%s)", t.recoveryThreshold, t.level, t.level)
+		}
+		return false
+	}
+
+	t.totalOverruns++
+	t.consecutiveOverruns++
+	t.consecutiveOnTime = 0
+	log.Warnf("Poll took %s which is longer than the poll interval of %s, skipping the next scheduled poll",
+		duration.Round(time.Millisecond), interval)
+
+	// a threshold of 0 disables degradation
+	if t.level < maxDegradationLevel && t.overrunThreshold > 0 && t.consecutiveOverruns >= t.overrunThreshold {
+		t.consecutiveOverruns = 0
+		t.level++
+		log.Warnf("%d consecutive polls overran the poll interval, degrading collection to level %d (%s)",
+			t.overrunThreshold, t.level, t.level)
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPollOverrunTracker(t *testing.T) {
+	interval := time.Minute
+	slow := 2 * time.Minute
+	fast := time.Second
+
+	t.Run("Ensure degradation steps up after consecutive overruns and back down on recovery", func(t *testing.T) {
+		tracker := newPollOverrunTracker(2, 3)
+
+		if !tracker.record(slow, interval) || tracker.level != DegradationNone {
+			t.Fatalf("expected overrun without degradation, got level %s", tracker.level)
+		}
+		tracker.record(slow, interval)
+		if tracker.level != DegradationSkipExtraEndpoints {
+			t.Fatalf("expected level %s, got %s", DegradationSkipExtraEndpoints, tracker.level)
+		}
+		for i := 0; i < 10; i++ {
+			tracker.record(slow, interval)
+		}
+		if tracker.level != DegradationReducedConcurrency || tracker.totalOverruns != 12 {
+			t.Fatalf("expected max level with 12 overruns, got %s with %d", tracker.level, tracker.totalOverruns)
+		}
+
+		for i := 0; i < 3; i++ {
+			if tracker.record(fast, interval) {
+				t.Fatal("expected poll within the interval to not be an overrun")
+			}
+		}
+		if tracker.level != DegradationCPUAndMemoryOnly {
+			t.Fatalf("expected level %s after recovery, got %s", DegradationCPUAndMemoryOnly, tracker.level)
+		}
+	})
+
+	t.Run("Ensure an on time poll resets the consecutive overrun count", func(t *testing.T) {
+		tracker := newPollOverrunTracker(2, 3)
+		tracker.record(slow, interval)
+		tracker.record(fast, interval)
+		tracker.record(slow, interval)
+		if tracker.level != DegradationNone {
+			t.Errorf("expected no degradation, got %s", tracker.level)
+		}
+	})
+
+	t.Run("Ensure a threshold of 0 disables degradation", func(t *testing.T) {
+		tracker := newPollOverrunTracker(0, 3)
+		for i := 0; i < 5; i++ {
+			tracker.record(slow, interval)
+		}
+		if tracker.level != DegradationNone || tracker.totalOverruns != 5 {
+			t.Errorf("expected 5 overruns without degradation, got %s with %d", tracker.level, tracker.totalOverruns)
+		}
+	})
+}
+
+func TestDegradationLevelApply(t *testing.T) {
+	config := KubeAgentConfig{
+		ConcurrentPollers:   10,
+		NodeFetchPacing:     0.5,
+		extraEndpoints:      []ExtraEndpoint{{Name: "pods", Path: "/pods"}},
+		RetrieveKubeletPods: true,
+	}
+
+	if c, cycle := DegradationNone.apply(config); len(c.extraEndpoints) != 1 || cycle.summaryCPUAndMemoryOnly ||
+		c.ConcurrentPollers != 10 || c.NodeFetchPacing != 0.5 {
+		t.Errorf("expected config to be unchanged, got %+v", c)
+	}
+	if c, cycle := DegradationCPUAndMemoryOnly.apply(config); len(c.extraEndpoints) != 0 ||
+		!cycle.summaryCPUAndMemoryOnly || c.ConcurrentPollers != 10 {
+		t.Errorf("expected extra endpoints skipped and cpu and memory only summaries, got %+v", c)
+	}
+	if c, _ := DegradationReducedConcurrency.apply(config); c.ConcurrentPollers != 5 {
+		t.Errorf("expected concurrent pollers to be halved, got %d", c.ConcurrentPollers)
+	}
+	if c, _ := DegradationSkipExtraEndpoints.apply(config); c.NodeFetchPacing != 0 || c.RetrieveKubeletPods {
+		t.Errorf("expected node fetches not to be paced and kubelet pods skipped while degraded, got %+v", c)
+	}
+	if len(config.extraEndpoints) != 1 {
+		t.Error("expected the original config to be unmodified")
+	}
+
+	api := setupProxyAPI("https://cluster", "node0")
+	if u := summaryURL(api, true); u != api.statsSummary()+"?only_cpu_and_memory=true" {
+		t.Errorf("unexpected cpu and memory only summary url %s", u)
+	}
+}
+
+func TestDegradedPollSkipsOptionalEndpoints(t *testing.T) {
+	var mu sync.Mutex
+	requested := map[string]bool{}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested[strings.TrimSuffix(r.URL.Path, "/")] = true
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"node":{"nodeName":"node0"}}`)
+	}))
+	defer ts.Close()
+
+	c := http.Client{Transport: &http.Transport{
+		// nolint gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	rc := raw.NewClient(c, true, nil, 0, false)
+	host, port, _ := strings.Cut(ts.Listener.Addr().String(), ":")
+	n := addressedNode("node0", host)
+	p, _ := strconv.Atoi(port)
+	n.Status.DaemonEndpoints.KubeletEndpoint.Port = int32(p)
+	ns := NewClientsetNodeSource(fake.NewSimpleClientset())
+	optional := []Endpoint{NodeProbeMetricsEndpoint, NodePodsEndpoint, NodeSpecEndpoint, NodeConfigzEndpoint,
+		NodeKubeletMetricsEndpoint}
+	nodes := NodeConnection{NodeClient: rc, InClusterClient: rc, NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+	for _, e := range optional {
+		nodes.NodeMetrics.SetAvailability(e, Direct, true)
+	}
+	config := KubeAgentConfig{ClusterHostURL: ts.URL, RetrieveProbeMetrics: true, RetrieveKubeletPods: true,
+		RetrieveNodeSpec: true, RetrieveKubeletConfigz: true, RetrieveKubeletMetrics: true}
+
+	for _, level := range []DegradationLevel{DegradationNone, DegradationSkipExtraEndpoints,
+		DegradationReducedConcurrency} {
+		mu.Lock()
+		requested = map[string]bool{}
+		mu.Unlock()
+		cycleConfig, cycle := level.apply(config)
+		cycle.nodeSpecDue = nodeSpecDue(cycleConfig, 0)
+		nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: util.NewWorkDir(t.TempDir())}
+		if err := retrieveNodeData(context.TODO(), nd, cycleConfig, cycle, nodes, ns, n); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, e := range optional {
+			if requested[string(e)] != (level == DegradationNone) {
+				t.Errorf("unexpected request of %s at degradation level %s: %v", e, level, requested[string(e)])
+			}
+		}
+	}
+}
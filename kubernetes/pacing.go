@@ -0,0 +1,81 @@
+package kubernetes
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultNodeFetchPacing is the default fraction of the poll interval node fetches are spread across,
+// node fetches are not paced by default
+const DefaultNodeFetchPacing = 0
+
+// maxNodeFetchPacing caps the fraction of the poll interval node fetches are spread across, so the fetches
+// started last still complete within the poll interval
+const maxNodeFetchPacing = 0.8
+
+// nodePacer spreads the start of node fetches evenly across a window of the poll interval, each fetch
+// starting at a random point within its own slot. As the window is fixed the pace compresses as the
+// number of nodes grows, so collection always completes within the poll interval.
+type nodePacer struct {
+	window time.Duration
+	start  time.Time
+	// pace is the time between the slots of consecutive node fetches
+	pace time.Duration
+	// jitter returns a random duration in [0, n)
+	jitter func(n int64) int64
+}
+
+// newNodePacer returns a pacer for the node fetches of a poll, or nil if pacing is disabled
+func newNodePacer(config KubeAgentConfig) *nodePacer {
+	fraction := config.NodeFetchPacing
+	if fraction <= 0 {
+		return nil
+	}
+	if fraction > maxNodeFetchPacing {
+		fraction = maxNodeFetchPacing
+	}
+	return &nodePacer{
+		window: time.Duration(fraction * float64(config.PollInterval) * float64(time.Second)),
+		// nolint gosec
+		jitter: rand.Int63n,
+	}
+}
+
+// schedule starts pacing the fetches of the given number of nodes from now
+func (p *nodePacer) schedule(nodes int) {
+	if p == nil || nodes == 0 {
+		return
+	}
+	p.start = time.Now()
+	p.pace = p.window / time.Duration(nodes)
+	log.Debugf("Pacing %d node fetches %v apart over %v", nodes, p.pace, p.window)
+}
+
+// wait blocks until the slot of the i-th node fetch is reached or ctx is done
+func (p *nodePacer) wait(ctx context.Context, i int) {
+	if p == nil || p.pace <= 0 {
+		return
+	}
+	at := p.start.Add(time.Duration(i)*p.pace + time.Duration(p.jitter(int64(p.pace))))
+	delay := time.Until(at)
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// effectivePace returns the time between node fetches of the poll, 0 if fetches were not paced
+func (p *nodePacer) effectivePace() time.Duration {
+	if p == nil {
+		return 0
+	}
+	return p.pace
+}
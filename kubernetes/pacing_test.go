@@ -0,0 +1,64 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNodePacer(t *testing.T) {
+	t.Run("Ensure node fetches are not paced by default", func(t *testing.T) {
+		p := newNodePacer(KubeAgentConfig{PollInterval: 180})
+		if p != nil {
+			t.Fatal("expected no pacer")
+		}
+		p.schedule(10)
+		p.wait(context.TODO(), 9)
+		if p.effectivePace() != 0 {
+			t.Error("expected no pace")
+		}
+	})
+
+	t.Run("Ensure the pace compresses as the number of nodes grows", func(t *testing.T) {
+		p := newNodePacer(KubeAgentConfig{PollInterval: 100, NodeFetchPacing: 0.5})
+		p.schedule(10)
+		if p.effectivePace() != 5*time.Second {
+			t.Errorf("expected a 5s pace, got %v", p.effectivePace())
+		}
+		p.schedule(1000)
+		if p.effectivePace() != 50*time.Millisecond {
+			t.Errorf("expected a 50ms pace, got %v", p.effectivePace())
+		}
+	})
+
+	t.Run("Ensure the pacing window leaves time for the last fetches", func(t *testing.T) {
+		p := newNodePacer(KubeAgentConfig{PollInterval: 100, NodeFetchPacing: 1})
+		p.schedule(1)
+		if p.effectivePace() != 80*time.Second {
+			t.Errorf("expected the window to be capped at 80s, got %v", p.effectivePace())
+		}
+	})
+
+	t.Run("Ensure each fetch waits for its slot", func(t *testing.T) {
+		p := newNodePacer(KubeAgentConfig{PollInterval: 1, NodeFetchPacing: 0.2})
+		p.jitter = func(n int64) int64 { return n - 1 }
+		p.schedule(2)
+		start := time.Now()
+		p.wait(context.TODO(), 1)
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Errorf("expected the second fetch to wait for the end of its slot, waited %v", elapsed)
+		}
+	})
+
+	t.Run("Ensure waiting stops when the collection is cancelled", func(t *testing.T) {
+		p := newNodePacer(KubeAgentConfig{PollInterval: 100, NodeFetchPacing: 0.5})
+		p.schedule(2)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		start := time.Now()
+		p.wait(ctx, 1)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("expected a cancelled wait to return, waited %v", elapsed)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package kubernetes
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cloudability/metrics-agent/credentials"
+	log "github.com/sirupsen/logrus"
+)
+
+// PathCredentials are the credentials used on one connection path to the kubelets. When any are set they
+// replace the cluster credentials on that path, so a token meant for one audience is never sent to another.
+type PathCredentials struct {
+	// TokenFile is a file holding a bearer token, re-read when it is rotated. It takes precedence over Token.
+	TokenFile string
+	Token     string
+	// CertFile and KeyFile are a client certificate presented on the path
+	CertFile string
+	KeyFile  string
+}
+
+// configured returns true if any credentials are set for the path
+func (c PathCredentials) configured() bool {
+	return c.TokenFile != "" || c.Token != "" || c.CertFile != "" || c.KeyFile != ""
+}
+
+// apply returns the http client and token provider for the path. The cluster client and credentials are
+// returned unchanged if no credentials are set for the path. A client certificate is preferred over a
+// token, so no token is returned with one as kubelets accepting only certificates may reject a token. A
+// token file is read again once its token is older than tokenFileTTL.
+func (c PathCredentials) apply(path string, client http.Client, clusterCreds credentials.Provider,
+	tokenFileTTL time.Duration) (http.Client, credentials.Provider, error) {
+	if !c.configured() {
+		return client, clusterCreds, nil
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return client, nil, fmt.Errorf("%s credentials require both a client certificate and key", path)
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return client, nil, fmt.Errorf("unable to load %s client certificate: %v", path, err)
+		}
+		transport, ok := client.Transport.(*http.Transport)
+		if ok && transport != nil {
+			transport = transport.Clone()
+		} else {
+			transport = http.DefaultTransport.(*http.Transport).Clone()
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		// the clone shares the session cache of the client, sessions established with another identity
+		// must not be resumed
+		if transport.TLSClientConfig.ClientSessionCache != nil {
+			transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(nodeTLSSessionCacheSize)
+		}
+		client.Transport = transport
+		if c.Token != "" || c.TokenFile != "" {
+			log.Infof("Both a client certificate and a token are set for %s connections, only the client "+
+				"certificate is used", path)
+		}
+		return client, nil, nil
+	}
+	return client, credentials.FromConfig(c.Token, c.TokenFile, tokenFileTTL, nil), nil
+}
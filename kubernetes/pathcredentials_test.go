@@ -0,0 +1,206 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/credentials"
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+)
+
+// writeClientCert writes a self signed client certificate and its key into dir
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "system:node:node0"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestPathCredentialsApply(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestPathCredentialsApply")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	clusterCreds := credentials.NewStaticProvider("cluster")
+
+	t.Run("Ensure the cluster credentials are used when none are set for the path", func(t *testing.T) {
+		_, creds, err := PathCredentials{}.apply(direct, http.Client{}, clusterCreds, 0)
+		if err != nil || creds != clusterCreds {
+			t.Errorf("expected the cluster credentials, got %v %v", creds, err)
+		}
+	})
+
+	t.Run("Ensure the path token replaces the cluster credentials", func(t *testing.T) {
+		tokenFile := filepath.Join(dir, "token")
+		if err := os.WriteFile(tokenFile, []byte("node-token"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, creds, err := PathCredentials{TokenFile: tokenFile, Token: "static"}.apply(direct, http.Client{},
+			clusterCreds, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if token, _ := creds.Token(); token != "node-token" {
+			t.Errorf("expected the token file to take precedence, got %q", token)
+		}
+	})
+
+	t.Run("Ensure a client certificate is presented without the cluster token", func(t *testing.T) {
+		certFile, keyFile := writeClientCert(t, dir)
+		transport := &http.Transport{}
+		client, creds, err := PathCredentials{CertFile: certFile, KeyFile: keyFile}.apply(direct,
+			http.Client{Transport: transport}, clusterCreds, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if creds != nil {
+			t.Errorf("expected no token to be sent, got %v", creds)
+		}
+		tlsConfig := client.Transport.(*http.Transport).TLSClientConfig
+		if tlsConfig == nil || len(tlsConfig.Certificates) != 1 {
+			t.Error("expected the client certificate to be presented")
+		}
+		if transport.TLSClientConfig != nil && len(transport.TLSClientConfig.Certificates) != 0 {
+			t.Error("expected the cluster transport not to be modified")
+		}
+	})
+
+	t.Run("Ensure a client certificate without a key is rejected", func(t *testing.T) {
+		if _, _, err := (PathCredentials{CertFile: "client.crt"}).apply(proxy, http.Client{}, clusterCreds,
+			0); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestCheckEndpointConnectionsPathCredentials(t *testing.T) {
+	var authorization string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer ts.Close()
+
+	_, creds, err := PathCredentials{Token: "node-token"}.apply(direct, http.Client{},
+		credentials.NewStaticProvider("cluster"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := raw.NewClient(http.Client{}, true, creds, 0, false)
+	if success, err := checkEndpointConnections(c, Direct, http.MethodGet, ts.URL+"/stats/summary"); !success {
+		t.Fatalf("expected the probe to succeed: %v", err)
+	}
+	if authorization != "Bearer node-token" {
+		t.Errorf("expected the probe to use the path token, got %q", authorization)
+	}
+}
+
+func TestEnsureNodeSourceClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeClientCert(t, dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("node-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := x509.NewCertPool()
+	trusted.AppendCertsFromPEM(data)
+
+	// launchKubelet returns a kubelet test server requiring client certificates signed by clientCAs
+	launchKubelet := func(clientCAs *x509.CertPool, authorization *string) *httptest.Server {
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*authorization = r.Header.Get("Authorization")
+		}))
+		ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+		ts.StartTLS()
+		return ts
+	}
+	config := func(ts *httptest.Server, clusterHostURL string) KubeAgentConfig {
+		return KubeAgentConfig{
+			Clientset:         NewTestClient(ts, nodeSampleLabels),
+			ConcurrentPollers: 10,
+			ClusterHostURL:    clusterHostURL,
+			// The proxy connection method uses the config http client
+			HTTPClient: http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				// nolint gosec
+				InsecureSkipVerify: true,
+			}}},
+			DirectCredentials: PathCredentials{CertFile: certFile, KeyFile: keyFile, TokenFile: tokenFile},
+		}
+	}
+
+	t.Run("Ensure the client certificate is presented instead of the token", func(t *testing.T) {
+		var authorization string
+		ts := launchKubelet(trusted, &authorization)
+		defer ts.Close()
+		nodes, err := ensureNodeSource(context.TODO(), config(ts, ts.URL), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !nodes.NodeMetrics.DirectAllowed(NodeStatsSummaryEndpoint) {
+			t.Errorf("expected direct node retrieval method but got %v",
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint))
+		}
+		if authorization != "" {
+			t.Errorf("expected no token to be sent with the client certificate, got %q", authorization)
+		}
+	})
+
+	t.Run("Ensure a rejected client certificate falls back to proxy", func(t *testing.T) {
+		var authorization string
+		ts := launchKubelet(x509.NewCertPool(), &authorization)
+		defer ts.Close()
+		apiServer := launchTLSTestServer(nil)
+		defer apiServer.Close()
+		nodes, err := ensureNodeSource(context.TODO(), config(ts, apiServer.URL), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !nodes.NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
+			t.Errorf("expected proxy node retrieval method but got %v",
+				nodes.NodeMetrics.Options(NodeStatsSummaryEndpoint))
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// permission is a cluster permission the agent uses to collect a resource
+type permission struct {
+	// name identifies the permission in logs and samples, the informer resource name or resource/subresource
+	name        string
+	group       string
+	resource    string
+	subresource string
+	verbs       []string
+	// required permissions are needed for any collection, so are never degraded
+	required bool
+}
+
+// agentPermissions are the cluster permissions checked at startup. Resources collected by informers are
+// named as their informer so they can be skipped when not permitted.
+var agentPermissions = []permission{
+	{name: "nodes", resource: "nodes", verbs: []string{"list", "watch"}, required: true},
+	{name: "nodes/proxy", resource: "nodes", subresource: "proxy", verbs: []string{"get"}},
+	{name: "pods", resource: "pods", verbs: []string{"list", "watch"}},
+	{name: "services", resource: "services", verbs: []string{"list", "watch"}},
+	{name: "replicationcontrollers", resource: "replicationcontrollers", verbs: []string{"list", "watch"}},
+	{name: "persistentvolumes", resource: "persistentvolumes", verbs: []string{"list", "watch"}},
+	{name: "persistentvolumeclaims", resource: "persistentvolumeclaims", verbs: []string{"list", "watch"}},
+	{name: "namespaces", resource: "namespaces", verbs: []string{"list", "watch"}},
+	{name: "replicasets", group: "apps", resource: "replicasets", verbs: []string{"list", "watch"}},
+	{name: "daemonsets", group: "apps", resource: "daemonsets", verbs: []string{"list", "watch"}},
+	{name: "deployments", group: "apps", resource: "deployments", verbs: []string{"list", "watch"}},
+	{name: "jobs", group: "batch", resource: "jobs", verbs: []string{"list", "watch"}},
+	{name: "cronjobs", group: "batch", resource: "cronjobs", verbs: []string{"list", "watch"}},
+	{
+		name: "priorityclasses", group: "scheduling.k8s.io", resource: "priorityclasses",
+		verbs: []string{"list", "watch"},
+	},
+	{name: "runtimeclasses", group: "node.k8s.io", resource: "runtimeclasses", verbs: []string{"list", "watch"}},
+}
+
+// statsRelayPermission is checked only when a stats relay is configured, as it is otherwise not used
+var statsRelayPermission = permission{
+	name: "pods/proxy", resource: "pods", subresource: "proxy", verbs: []string{"get"},
+}
+
+// checkPermissions asks the API server which of the permissions are granted to the agent, and returns the
+// names of those that are not, in the order checked. A permission is granted only if all its verbs are.
+func checkPermissions(ctx context.Context, clientset kubernetes.Interface, permissions []permission) ([]string,
+	error) {
+	var notPermitted []string
+	for _, p := range permissions {
+		for _, verb := range p.verbs {
+			review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx,
+				&authorizationv1.SelfSubjectAccessReview{
+					Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+						ResourceAttributes: &authorizationv1.ResourceAttributes{
+							Verb:        verb,
+							Group:       p.group,
+							Resource:    p.resource,
+							Subresource: p.subresource,
+						},
+					},
+				}, metav1.CreateOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("unable to review permission %s %s: %v", verb, p.name, err)
+			}
+			if !review.Status.Allowed {
+				notPermitted = append(notPermitted, p.name)
+				break
+			}
+		}
+	}
+	return notPermitted, nil
+}
+
+// ensurePermissions checks the permissions granted to the agent and returns those that are not. Collection
+// of a resource that is not permitted is skipped, unless strict is set in which case any missing permission
+// is fatal as are missing required permissions. If permissions can not be checked they are all assumed to
+// be granted.
+func ensurePermissions(ctx context.Context, config KubeAgentConfig) ([]string, error) {
+	permissions := agentPermissions
+	if config.StatsRelaySelector != "" {
+		permissions = append(permissions[:len(permissions):len(permissions)], statsRelayPermission)
+	}
+	notPermitted, err := checkPermissions(ctx, config.Clientset, permissions)
+	if err != nil {
+		log.Warnf("Warning: unable to check agent permissions, assuming all are granted: %v", err)
+		return nil, nil
+	}
+	if len(notPermitted) == 0 {
+		log.Info("Agent permissions check succeeded, all resources will be collected")
+		return nil, nil
+	}
+
+	if config.StrictPermissions {
+		return notPermitted, fmt.Errorf("agent is not permitted to collect %s and strict permissions are set",
+			strings.Join(notPermitted, ", "))
+	}
+	for _, p := range agentPermissions {
+		if p.required && !permitted(notPermitted, p.name) {
+			return notPermitted, fmt.Errorf("agent is not permitted to collect %s which is required", p.name)
+		}
+	}
+	log.Warnf("Agent is running with reduced permissions, %s will not be collected. %s",
+		strings.Join(notPermitted, ", "), rbacError)
+	return notPermitted, nil
+}
+
+// permitted returns true if the named permission is not among those not permitted
+func permitted(notPermitted []string, name string) bool {
+	for _, n := range notPermitted {
+		if n == name {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// reviewingClientset returns a fake clientset that denies access reviews of the denied resources, and fails
+// every review when err is set
+func reviewingClientset(denied map[string]bool, err error) *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "selfsubjectaccessreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if err != nil {
+				return true, nil, err
+			}
+			review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+			name := review.Spec.ResourceAttributes.Resource
+			if review.Spec.ResourceAttributes.Subresource != "" {
+				name += "/" + review.Spec.ResourceAttributes.Subresource
+			}
+			review.Status.Allowed = !denied[name]
+			return true, review, nil
+		})
+	return clientset
+}
+
+func TestEnsurePermissions(t *testing.T) {
+	t.Run("Ensure all resources are collected when all are permitted", func(t *testing.T) {
+		config := KubeAgentConfig{Clientset: reviewingClientset(nil, nil)}
+		notPermitted, err := ensurePermissions(context.TODO(), config)
+		if err != nil || len(notPermitted) != 0 {
+			t.Errorf("expected all resources to be permitted, got %v %v", notPermitted, err)
+		}
+	})
+
+	t.Run("Ensure resources that are not permitted are skipped", func(t *testing.T) {
+		config := KubeAgentConfig{
+			Clientset: reviewingClientset(map[string]bool{"cronjobs": true, "nodes/proxy": true}, nil),
+		}
+		notPermitted, err := ensurePermissions(context.TODO(), config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(notPermitted) != 2 || notPermitted[0] != "nodes/proxy" || notPermitted[1] != "cronjobs" {
+			t.Errorf("unexpected resources not permitted %v", notPermitted)
+		}
+		if permitted(notPermitted, "cronjobs") || !permitted(notPermitted, "jobs") {
+			t.Error("expected only cronjobs and nodes/proxy not to be permitted")
+		}
+	})
+
+	t.Run("Ensure strict permissions fail when any resource is not permitted", func(t *testing.T) {
+		config := KubeAgentConfig{
+			Clientset:         reviewingClientset(map[string]bool{"cronjobs": true}, nil),
+			StrictPermissions: true,
+		}
+		if _, err := ensurePermissions(context.TODO(), config); err == nil {
+			t.Error("expected strict permissions to fail")
+		}
+	})
+
+	t.Run("Ensure a required permission that is not granted fails", func(t *testing.T) {
+		config := KubeAgentConfig{Clientset: reviewingClientset(map[string]bool{"nodes": true}, nil)}
+		if _, err := ensurePermissions(context.TODO(), config); err == nil {
+			t.Error("expected missing node permissions to fail")
+		}
+	})
+
+	t.Run("Ensure all resources are assumed permitted when they can not be checked", func(t *testing.T) {
+		config := KubeAgentConfig{
+			Clientset:         reviewingClientset(nil, fmt.Errorf("access reviews unavailable")),
+			StrictPermissions: true,
+		}
+		notPermitted, err := ensurePermissions(context.TODO(), config)
+		if err != nil || len(notPermitted) != 0 {
+			t.Errorf("expected all resources to be assumed permitted, got %v %v", notPermitted, err)
+		}
+	})
+}
@@ -0,0 +1,23 @@
+package kubernetes
+
+// pollCycle holds the values of a single poll, passed next to the config to the functions collecting it.
+// The config holds only the settings and what is found at startup, so each poll starts from a new cycle
+// rather than from values a previous poll left on a copy of the config.
+type pollCycle struct {
+	// id is the cycle ID of the poll, which tags its logs, manifest and upload
+	id string
+	// collection is the index of the collection since startup
+	collection int
+	// warmUp is set for the warm-up collection, whose sample is discarded
+	warmUp bool
+	// summaryCPUAndMemoryOnly is set while collection is degraded to cpu and memory node summaries
+	summaryCPUAndMemoryOnly bool
+	// nodeSpecDue is set for a collection that retrieves the node specs
+	nodeSpecDue bool
+	// seriesTruncations records the metric families truncated to the series limit, nil records nothing
+	seriesTruncations *seriesTruncationLog
+	// disabledEndpoints records the node endpoints disabled, nil records nothing
+	disabledEndpoints *disabledEndpointLog
+	// debugCaptures captures the nodes listed for debug capture, nil captures none
+	debugCaptures *debugCaptures
+}
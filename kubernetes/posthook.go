@@ -0,0 +1,96 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPostCollectionHookTimeout is the default time (in seconds) the post-collection hook may run
+const DefaultPostCollectionHookTimeout = 30
+
+// postCollectionHookSampleDirEnv is the environment variable the sample directory is also passed to the hook in
+const postCollectionHookSampleDirEnv = "CLOUDABILITY_SAMPLE_DIR"
+
+// postCollectionHookWaitDelay bounds how long the output of a hook that was killed is waited for, as
+// processes it started may hold its output open
+const postCollectionHookWaitDelay = time.Second
+
+// maxPostCollectionHookOutput is the number of bytes of the output of a failed hook that are logged
+const maxPostCollectionHookOutput = 1024
+
+// errPostCollectionHook is returned when the post-collection hook fails and hook failures are fatal to the
+// collection, the sample is discarded
+var errPostCollectionHook = errors.New("post-collection hook failed")
+
+// postCollectionHookDeadline returns when the post-collection hook must complete, the earlier of the end of
+// the hook timeout and the end of the poll interval of a collection started at start
+func postCollectionHookDeadline(config KubeAgentConfig, start, now time.Time) time.Time {
+	deadline := now.Add(time.Duration(config.PostCollectionHookTimeout) * time.Second)
+	if cycleEnd := start.Add(time.Duration(config.PollInterval) * time.Second); cycleEnd.Before(deadline) {
+		return cycleEnd
+	}
+	return deadline
+}
+
+// runPostCollectionHook runs the configured post-collection hook on the sample directory of a collection
+// started at start, before the sample manifest is written. The hook is passed the sample directory as its
+// argument and must exit 0 by the hook deadline. A failure returns errPostCollectionHook if hook failures
+// are fatal, otherwise it is logged and the sample is kept as the hook left it.
+func runPostCollectionHook(ctx context.Context, config KubeAgentConfig, msd string, start time.Time) error {
+	if config.PostCollectionHook == "" {
+		return nil
+	}
+	hookStart := time.Now()
+	err := runHookCommand(ctx, config.PostCollectionHook, msd, config.ScratchDir,
+		postCollectionHookDeadline(config, start, hookStart))
+	if err == nil {
+		log.Debugf("Post-collection hook completed on %s in %v", msd, time.Since(hookStart))
+		return nil
+	}
+	if config.PostCollectionHookFatal {
+		return fmt.Errorf("%w: %v", errPostCollectionHook, err)
+	}
+	log.Warnf("Warning: post-collection hook failed, continuing with the sample as it was left: %v", err)
+	return nil
+}
+
+// runHookCommand runs the hook command on the sample directory, killing it at the deadline. The temporary
+// files of the hook are written to tmpDir, as the root filesystem may be read-only.
+func runHookCommand(ctx context.Context, command, msd, tmpDir string, deadline time.Time) error {
+	if !deadline.After(time.Now()) {
+		return fmt.Errorf("%s was not run as no time is left in the collection cycle", command)
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	//nolint gosec
+	cmd := exec.CommandContext(ctx, command, msd)
+	cmd.Env = append(os.Environ(), postCollectionHookSampleDirEnv+"="+msd)
+	if tmpDir != "" {
+		cmd.Env = append(cmd.Env, "TMPDIR="+tmpDir)
+	}
+	cmd.WaitDelay = postCollectionHookWaitDelay
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s did not complete by the end of its timeout or the collection cycle", command)
+	}
+	out := bytes.TrimSpace(output.Bytes())
+	if len(out) > maxPostCollectionHookOutput {
+		out = out[len(out)-maxPostCollectionHookOutput:]
+	}
+	return fmt.Errorf("running %s failed: %v: %s", command, err, out)
+}
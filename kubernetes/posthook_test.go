@@ -0,0 +1,100 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeHook writes an executable shell script hook into dir
+func writeHook(t *testing.T, dir, name, script string) string {
+	t.Helper()
+	hook := filepath.Join(dir, name)
+	//nolint gosec
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+func TestPostCollectionHookDeadline(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	config := KubeAgentConfig{PollInterval: 180, PostCollectionHookTimeout: 30}
+
+	if d := postCollectionHookDeadline(config, start, start.Add(time.Minute)); !d.Equal(start.Add(90 * time.Second)) {
+		t.Errorf("expected the hook timeout to bound the deadline, got %v", d)
+	}
+	if d := postCollectionHookDeadline(config, start, start.Add(170*time.Second)); !d.Equal(start.Add(180 *
+		time.Second)) {
+		t.Errorf("expected the poll interval to bound the deadline, got %v", d)
+	}
+}
+
+func TestRunPostCollectionHook(t *testing.T) {
+	hooks := t.TempDir()
+	newConfig := func(hook string, fatal bool) KubeAgentConfig {
+		return KubeAgentConfig{PollInterval: 180, PostCollectionHookTimeout: 30, PostCollectionHook: hook,
+			PostCollectionHookFatal: fatal}
+	}
+
+	t.Run("Ensure the hook processes the sample directory", func(t *testing.T) {
+		msd := t.TempDir()
+		hook := writeHook(t, hooks, "enrich.sh", `[ "$1" = "$CLOUDABILITY_SAMPLE_DIR" ] && touch "$1/enriched.json"`)
+		if err := runPostCollectionHook(context.TODO(), newConfig(hook, true), msd, time.Now()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(msd, "enriched.json")); err != nil {
+			t.Errorf("expected the hook to write to the sample: %v", err)
+		}
+	})
+
+	t.Run("Ensure no hook is run when none is configured", func(t *testing.T) {
+		if err := runPostCollectionHook(context.TODO(), newConfig("", true), t.TempDir(), time.Now()); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	failing := writeHook(t, hooks, "fail.sh", "echo redaction failed >&2; exit 3")
+	t.Run("Ensure a failing hook is fatal to the collection if configured", func(t *testing.T) {
+		err := runPostCollectionHook(context.TODO(), newConfig(failing, true), t.TempDir(), time.Now())
+		if !errors.Is(err, errPostCollectionHook) || !strings.Contains(err.Error(), "redaction failed") {
+			t.Errorf("expected the hook failure and its output, got %v", err)
+		}
+	})
+
+	t.Run("Ensure a failing hook only warns by default", func(t *testing.T) {
+		if err := runPostCollectionHook(context.TODO(), newConfig(failing, false), t.TempDir(),
+			time.Now()); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Ensure a hook is stopped at its timeout", func(t *testing.T) {
+		config := newConfig(writeHook(t, hooks, "slow.sh", "sleep 30"), true)
+		config.PostCollectionHookTimeout = 1
+		hookStart := time.Now()
+		err := runPostCollectionHook(context.TODO(), config, t.TempDir(), hookStart)
+		if !errors.Is(err, errPostCollectionHook) {
+			t.Errorf("expected the hook to time out, got %v", err)
+		}
+		if elapsed := time.Since(hookStart); elapsed > 10*time.Second {
+			t.Errorf("expected the hook to be stopped, it ran for %v", elapsed)
+		}
+	})
+
+	t.Run("Ensure a hook is not run once the collection cycle has ended", func(t *testing.T) {
+		msd := t.TempDir()
+		hook := writeHook(t, hooks, "late.sh", `touch "$1/late.json"`)
+		err := runPostCollectionHook(context.TODO(), newConfig(hook, true), msd, time.Now().Add(-time.Hour))
+		if !errors.Is(err, errPostCollectionHook) {
+			t.Errorf("expected the hook to fail, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(msd, "late.json")); !os.IsNotExist(err) {
+			t.Errorf("expected the hook not to be run, got %v", err)
+		}
+	})
+}
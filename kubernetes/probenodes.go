@@ -0,0 +1,89 @@
+package kubernetes
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// DefaultProbeNodeMinAge is the default minimum age (in seconds) a node should have before it is
+// preferred for startup probes
+const DefaultProbeNodeMinAge = 300
+
+// maxProbeNodes is the most candidate nodes an optional kubelet endpoint is probed on before it is
+// considered unavailable
+const maxProbeNodes = 3
+
+// control plane role labels, nodes carrying either are only probed when no worker nodes exist
+const (
+	controlPlaneRoleLabel = "node-role.kubernetes.io/control-plane"
+	masterRoleLabel       = "node-role.kubernetes.io/master"
+)
+
+// probe node preference penalties, a lower total is preferred
+const (
+	probePenaltyYoung     = 1
+	probePenaltyNonWorker = 2
+)
+
+// isSchedulableWorker returns true if the node is not a control plane node, is not cordoned and
+// has no taints preventing workloads from being scheduled on it
+func isSchedulableWorker(n v1.Node) bool {
+	if _, ok := n.Labels[controlPlaneRoleLabel]; ok {
+		return false
+	}
+	if _, ok := n.Labels[masterRoleLabel]; ok {
+		return false
+	}
+	if n.Spec.Unschedulable {
+		return false
+	}
+	for _, t := range n.Spec.Taints {
+		if t.Effect == v1.TaintEffectNoSchedule || t.Effect == v1.TaintEffectNoExecute {
+			return false
+		}
+	}
+	return true
+}
+
+// probePenalty scores how poorly a node represents the rest of the cluster for startup probes
+func probePenalty(n v1.Node, minAge time.Duration, now time.Time) int {
+	penalty := 0
+	if !isSchedulableWorker(n) {
+		penalty += probePenaltyNonWorker
+	}
+	if now.Sub(n.CreationTimestamp.Time) < minAge {
+		penalty += probePenaltyYoung
+	}
+	return penalty
+}
+
+// selectProbeNodes orders nodes by their suitability for startup probes, preferring schedulable
+// worker nodes older than minAge, and returns a description of why the first node was chosen.
+// Control plane, tainted and young nodes are only chosen when nothing better exists.
+func selectProbeNodes(nodes []v1.Node, minAge time.Duration, now time.Time) ([]v1.Node, string) {
+	if len(nodes) == 0 {
+		return nil, ""
+	}
+
+	candidates := make([]v1.Node, len(nodes))
+	copy(candidates, nodes)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return probePenalty(candidates[i], minAge, now) < probePenalty(candidates[j], minAge, now)
+	})
+
+	var reason string
+	switch probePenalty(candidates[0], minAge, now) {
+	case 0:
+		reason = fmt.Sprintf("schedulable worker node older than %s", minAge)
+	case probePenaltyYoung:
+		reason = fmt.Sprintf("schedulable worker node, no workers are older than %s", minAge)
+	case probePenaltyNonWorker:
+		reason = fmt.Sprintf("no schedulable worker nodes, node is older than %s", minAge)
+	default:
+		reason = fmt.Sprintf("no schedulable worker nodes and none older than %s", minAge)
+	}
+	return candidates, reason
+}
@@ -0,0 +1,81 @@
+package kubernetes
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSelectProbeNodes(t *testing.T) {
+	now := time.Now()
+	minAge := 5 * time.Minute
+	node := func(name string, age time.Duration, labels map[string]string, taints ...v1.Taint) v1.Node {
+		return v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Labels:            labels,
+				CreationTimestamp: metav1.NewTime(now.Add(-age)),
+			},
+			Spec: v1.NodeSpec{Taints: taints},
+		}
+	}
+	controlPlane := map[string]string{controlPlaneRoleLabel: ""}
+	noSchedule := v1.Taint{Key: "dedicated", Value: "infra", Effect: v1.TaintEffectNoSchedule}
+	preferNoSchedule := v1.Taint{Key: "spot", Effect: v1.TaintEffectPreferNoSchedule}
+
+	tests := []struct {
+		name     string
+		nodes    []v1.Node
+		expected string
+	}{
+		{"prefers aged worker over control plane", []v1.Node{
+			node("cp", time.Hour, controlPlane),
+			node("worker", time.Hour, nil),
+		}, "worker"},
+		{"prefers aged worker over tainted node", []v1.Node{
+			node("tainted", time.Hour, nil, noSchedule),
+			node("worker", time.Hour, nil, preferNoSchedule),
+		}, "worker"},
+		{"prefers aged worker over young worker", []v1.Node{
+			node("young", time.Minute, nil),
+			node("worker", time.Hour, nil),
+		}, "worker"},
+		{"prefers young worker over control plane", []v1.Node{
+			node("cp", time.Hour, map[string]string{masterRoleLabel: ""}),
+			node("young", time.Minute, nil),
+		}, "young"},
+		{"falls back to control plane when no workers exist", []v1.Node{
+			node("young-cp", time.Minute, controlPlane),
+			node("cp", time.Hour, controlPlane),
+		}, "cp"},
+		{"keeps api order between equivalent nodes", []v1.Node{
+			node("worker0", time.Hour, nil),
+			node("worker1", time.Hour, nil),
+		}, "worker0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates, reason := selectProbeNodes(tt.nodes, minAge, now)
+			if len(candidates) != len(tt.nodes) {
+				t.Fatalf("expected %d candidates but got %d", len(tt.nodes), len(candidates))
+			}
+			if candidates[0].Name != tt.expected {
+				t.Errorf("expected node %s to be chosen but got %s", tt.expected, candidates[0].Name)
+			}
+			if reason == "" {
+				t.Error("expected a reason for the chosen node")
+			}
+		})
+	}
+
+	t.Run("Ensure cordoned nodes are not treated as schedulable workers", func(t *testing.T) {
+		n := node("cordoned", time.Hour, nil)
+		n.Spec.Unschedulable = true
+		if isSchedulableWorker(n) {
+			t.Error("expected cordoned node to not be a schedulable worker")
+		}
+	})
+}
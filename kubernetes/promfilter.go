@@ -0,0 +1,250 @@
+package kubernetes
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// metricFamilySuffixes are appended to the family name in the names of its samples, eg: for histograms
+var metricFamilySuffixes = []string{"_bucket", "_sum", "_count", "_total"}
+
+// prometheusFilter is a transform filtering a prometheus text format body as it is written. It keeps only
+// the samples, and their HELP and TYPE lines, of the allowed families, drops the labels not kept by its
+// label filter from each sample, and truncates families to a maximum number of series.
+type prometheusFilter struct {
+	// families are the families kept, nil keeps every family
+	families map[string]bool
+	labels   labelFilter
+	// maxSeries is the maximum number of series kept of each family, 0 disables the limit
+	maxSeries int
+	// truncated is called on Finish with the number of series dropped of each truncated family
+	truncated func(dropped map[string]int)
+	w         *prometheusFilterWriter
+}
+
+// Wrap implements raw.Transform
+func (f *prometheusFilter) Wrap(w io.Writer) io.Writer {
+	f.w = &prometheusFilterWriter{filter: f, w: w, series: map[string]int{}, dropped: map[string]int{}}
+	return f.w
+}
+
+// Finish implements raw.Transform, writing the last line of a body without a trailing newline
+func (f *prometheusFilter) Finish(writeErr error) error {
+	if writeErr != nil {
+		return nil
+	}
+	if err := f.w.writeLine(); err != nil {
+		return err
+	}
+	if len(f.w.dropped) > 0 && f.truncated != nil {
+		f.truncated(f.w.dropped)
+	}
+	return nil
+}
+
+// prometheusFilterWriter buffers the body a line at a time, writing the filtered lines to w
+type prometheusFilterWriter struct {
+	filter *prometheusFilter
+	w      io.Writer
+	line   []byte
+	// family is the family of the last TYPE line, which the samples following it belong to
+	family  string
+	series  map[string]int
+	dropped map[string]int
+}
+
+func (fw *prometheusFilterWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			fw.line = append(fw.line, p...)
+			break
+		}
+		fw.line = append(fw.line, p[:i+1]...)
+		p = p[i+1:]
+		if err := fw.writeLine(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// writeLine writes the buffered line once filtered, and empties the buffer
+func (fw *prometheusFilterWriter) writeLine() error {
+	defer func() {
+		fw.line = fw.line[:0]
+	}()
+	if len(fw.line) == 0 {
+		return nil
+	}
+	line := string(fw.line)
+	name := metricLineName(line)
+	if name == "" || !fw.filter.allowed(name) {
+		return nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(line), "#") {
+		if fields := strings.Fields(line); fields[1] == "TYPE" {
+			fw.family = name
+		}
+		_, err := io.WriteString(fw.w, line)
+		return err
+	}
+
+	family := name
+	if fw.family != "" && metricFamily(name, fw.family) {
+		family = fw.family
+	}
+	fw.series[family]++
+	if fw.filter.maxSeries > 0 && fw.series[family] > fw.filter.maxSeries {
+		fw.dropped[family]++
+		return nil
+	}
+	_, err := io.WriteString(fw.w, fw.filter.labels.apply(line))
+	return err
+}
+
+// allowed returns true if the metric name is of an allowed family
+func (f *prometheusFilter) allowed(name string) bool {
+	if f.families == nil || f.families[name] {
+		return true
+	}
+	for _, suffix := range metricFamilySuffixes {
+		if family := strings.TrimSuffix(name, suffix); family != name && f.families[family] {
+			return true
+		}
+	}
+	return false
+}
+
+// metricFamily returns true if the metric name is a sample of the family
+func metricFamily(name, family string) bool {
+	if name == family {
+		return true
+	}
+	for _, suffix := range metricFamilySuffixes {
+		if name == family+suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// metricLineName returns the metric name of a sample, HELP or TYPE line, or an empty string for any other
+// line
+func metricLineName(line string) string {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "#") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || (fields[1] != "HELP" && fields[1] != "TYPE") {
+			return ""
+		}
+		return fields[2]
+	}
+	if i := strings.IndexAny(line, "{ \t"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// labelFilter selects the labels kept on each sample, the labels distinguishing the series of histograms
+// and summaries are always kept
+type labelFilter struct {
+	// allow are the labels kept, nil keeps every label not denied
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// newLabelFilter returns the label filter for comma separated allowed and denied label names
+func newLabelFilter(allow, deny string) labelFilter {
+	return labelFilter{allow: parseLabelNames(allow), deny: parseLabelNames(deny)}
+}
+
+// parseLabelNames returns the set of comma separated label names, or nil if there are none
+func parseLabelNames(names string) map[string]bool {
+	var set map[string]bool
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if set == nil {
+				set = map[string]bool{}
+			}
+			set[name] = true
+		}
+	}
+	return set
+}
+
+// empty returns true if the filter keeps every label
+func (f labelFilter) empty() bool {
+	return f.allow == nil && len(f.deny) == 0
+}
+
+func (f labelFilter) keeps(name string) bool {
+	if name == "le" || name == "quantile" {
+		return true
+	}
+	if f.deny[name] {
+		return false
+	}
+	return f.allow == nil || f.allow[name]
+}
+
+// apply returns the sample line without the labels that are not kept, or the line unchanged if its labels
+// can not be parsed
+func (f labelFilter) apply(line string) string {
+	open := strings.IndexByte(line, '{')
+	if f.empty() || open < 0 {
+		return line
+	}
+	var kept []string
+	pos := open + 1
+	for {
+		pos = skipSpaces(line, pos)
+		if pos < len(line) && line[pos] == '}' {
+			break
+		}
+		eq := strings.IndexByte(line[pos:], '=')
+		if eq < 0 {
+			return line
+		}
+		start := pos
+		name := strings.TrimSpace(line[pos : pos+eq])
+		pos = skipSpaces(line, pos+eq+1)
+		if pos >= len(line) || line[pos] != '"' {
+			return line
+		}
+		for pos++; pos < len(line) && line[pos] != '"'; pos++ {
+			if line[pos] == '\\' {
+				pos++
+			}
+		}
+		if pos >= len(line) {
+			return line
+		}
+		pos++
+		if f.keeps(name) {
+			kept = append(kept, strings.TrimSpace(line[start:pos]))
+		}
+		pos = skipSpaces(line, pos)
+		if pos < len(line) && line[pos] == ',' {
+			pos++
+			continue
+		}
+		if pos < len(line) && line[pos] == '}' {
+			break
+		}
+		return line
+	}
+	if len(kept) == 0 {
+		return line[:open] + line[pos+1:]
+	}
+	return line[:open] + "{" + strings.Join(kept, ",") + "}" + line[pos+1:]
+}
+
+func skipSpaces(s string, pos int) int {
+	for pos < len(s) && (s[pos] == ' ' || s[pos] == '\t') {
+		pos++
+	}
+	return pos
+}
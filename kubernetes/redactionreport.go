@@ -0,0 +1,132 @@
+package kubernetes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	k8s_stats "github.com/cloudability/metrics-agent/retrieval/k8s"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// redactPodDetail counts the pod records removed from the sample by the namespace profile
+const redactPodDetail = "pod_detail"
+
+// redactionReportsDir is the directory within the scratch dir the redaction reports of recent samples are
+// retained in, so what left the cluster can be audited locally
+const redactionReportsDir = "redaction-reports"
+
+// retainedRedactionReports is the number of recent redaction reports retained in the scratch dir
+const retainedRedactionReports = 24
+
+// redactionRules returns the redaction rules in effect with the configuration
+func redactionRules(config KubeAgentConfig) []string {
+	var rules []string
+	if config.ParseMetricData {
+		rules = append(rules, k8s_stats.SanitizeRules...)
+	}
+	if config.imageRewriter != nil {
+		rules = append(rules, k8s_stats.RewriteImages)
+	}
+	if config.namespaceRollup() {
+		rules = append(rules, redactPodDetail)
+	}
+	return rules
+}
+
+// newRedactionReport reports the rules in effect with the configuration and the number of values each
+// redacted. Every rule in effect is listed, even if it redacted nothing.
+func newRedactionReport(config KubeAgentConfig, redactions *k8s_stats.Redactions) (sample.RedactionReport, error) {
+	report := sample.RedactionReport{
+		Settings: map[string]string{
+			"parse_metric_data":  strconv.FormatBool(config.ParseMetricData),
+			"image_rewrite":      config.ImageRewrite,
+			"image_keep_digests": strconv.FormatBool(config.ImageKeepDigests),
+			"collection_profile": config.CollectionProfile,
+		},
+		Rules: []sample.RedactionRule{},
+	}
+	rules := redactionRules(config)
+	for _, rule := range rules {
+		description := k8s_stats.RuleDescriptions[rule]
+		if rule == redactPodDetail {
+			description = "pod records removed by the namespace collection profile"
+		}
+		report.Rules = append(report.Rules, sample.RedactionRule{
+			ID:          rule,
+			Description: description,
+			Count:       redactions.Count(rule),
+		})
+	}
+
+	// the map keys are marshalled sorted, so the hash is stable for the same configuration
+	effective, err := json.Marshal(struct {
+		Settings map[string]string `json:"settings"`
+		Rules    []string          `json:"rules"`
+	}{report.Settings, rules})
+	if err != nil {
+		return report, err
+	}
+	hash := sha256.Sum256(effective)
+	report.ConfigHash = hex.EncodeToString(hash[:])
+	return report, nil
+}
+
+// writeRedactionReport writes the redaction report to the sample and retains a copy in the scratch dir,
+// keeping the most recent retainedRedactionReports
+func writeRedactionReport(workDir *util.WorkDir, scratchDir string, report sample.RedactionReport,
+	sampleStartTime time.Time) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(workDir.Name(), sample.RedactionReportFile), data, 0644); err != nil {
+		return err
+	}
+	if scratchDir == "" {
+		return nil
+	}
+
+	dir := filepath.Join(scratchDir, redactionReportsDir)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to retain redaction report: %v", err)
+	}
+	name := filepath.Join(dir, fmt.Sprintf("redaction-report-%d.json", sampleStartTime.Unix()))
+	err = util.WriteFileAtomic(name, 0644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to retain redaction report: %v", err)
+	}
+	pruneRedactionReports(dir)
+	return nil
+}
+
+// pruneRedactionReports removes all but the most recent retained redaction reports
+func pruneRedactionReports(dir string) {
+	reports, err := filepath.Glob(filepath.Join(dir, "redaction-report-*.json"))
+	if err != nil || len(reports) <= retainedRedactionReports {
+		return
+	}
+	unix := func(name string) int64 {
+		var t int64
+		_, _ = fmt.Sscanf(filepath.Base(name), "redaction-report-%d.json", &t)
+		return t
+	}
+	sort.Slice(reports, func(i, j int) bool { return unix(reports[i]) < unix(reports[j]) })
+	for _, r := range reports[:len(reports)-retainedRedactionReports] {
+		if err := os.Remove(r); err != nil {
+			log.Warnf("Warning: unable to remove retained redaction report %s: %v", r, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	k8s_stats "github.com/cloudability/metrics-agent/retrieval/k8s"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+)
+
+func TestRedactionReport(t *testing.T) {
+	t.Run("Ensure every rule in effect is reported, even when nothing was redacted", func(t *testing.T) {
+		report, err := newRedactionReport(KubeAgentConfig{ParseMetricData: true,
+			CollectionProfile: sample.ProfileNamespace}, k8s_stats.NewRedactions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Rules) != len(k8s_stats.SanitizeRules)+1 {
+			t.Fatalf("expected the sanitize rules and pod detail to be reported, got %v", report.Rules)
+		}
+		for _, rule := range report.Rules {
+			if rule.Count != 0 || rule.Description == "" {
+				t.Errorf("expected rule %s to be described with nothing redacted, got %+v", rule.ID, rule)
+			}
+		}
+
+		none, err := newRedactionReport(KubeAgentConfig{CollectionProfile: sample.ProfileFull},
+			k8s_stats.NewRedactions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(none)
+		if !strings.Contains(string(data), `"rules":[]`) {
+			t.Errorf("expected an empty list of rules without redaction, got %s", data)
+		}
+		if none.ConfigHash == report.ConfigHash || len(none.ConfigHash) != 64 {
+			t.Errorf("expected the config hash to change with the rules in effect, got %s", none.ConfigHash)
+		}
+	})
+
+	t.Run("Ensure counts are reported and the config hash is stable", func(t *testing.T) {
+		config := KubeAgentConfig{ParseMetricData: true, CollectionProfile: sample.ProfileFull}
+		redactions := k8s_stats.NewRedactions()
+		redactions.Add(k8s_stats.RedactContainerEnv, 3)
+		first, _ := newRedactionReport(config, redactions)
+		second, _ := newRedactionReport(config, k8s_stats.NewRedactions())
+		if first.ConfigHash != second.ConfigHash {
+			t.Error("expected the config hash to depend only on the configuration")
+		}
+		if first.Rules[0].ID != k8s_stats.RedactContainerEnv || first.Rules[0].Count != 3 {
+			t.Errorf("expected 3 environment variables redacted, got %+v", first.Rules[0])
+		}
+	})
+
+	t.Run("Ensure the report is written to the sample and recent reports are retained", func(t *testing.T) {
+		scratch := t.TempDir()
+		msd := t.TempDir()
+		workDir := util.NewWorkDir(msd)
+		report, _ := newRedactionReport(KubeAgentConfig{ParseMetricData: true}, k8s_stats.NewRedactions())
+
+		start := time.Unix(1700000000, 0)
+		for i := 0; i < retainedRedactionReports+2; i++ {
+			err := writeRedactionReport(workDir, scratch, report, start.Add(time.Duration(i)*time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if sample.FileClass(sample.RedactionReportFile) != sample.RedactionReportClass {
+			t.Error("expected the redaction report to have its own file class")
+		}
+		if _, err := os.Stat(filepath.Join(msd, sample.RedactionReportFile)); err != nil {
+			t.Errorf("expected the report to be written to the sample: %v", err)
+		}
+		retained, _ := filepath.Glob(filepath.Join(scratch, redactionReportsDir, "*.json"))
+		if len(retained) != retainedRedactionReports {
+			t.Fatalf("expected %d reports to be retained, got %d", retainedRedactionReports, len(retained))
+		}
+		oldest := filepath.Join(scratch, redactionReportsDir, "redaction-report-1700000000.json")
+		if _, err := os.Stat(oldest); !os.IsNotExist(err) {
+			t.Errorf("expected the oldest report to be removed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package kubernetes
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultReprobeInterval is the default interval in minutes between probes of the kubelet endpoints
+const DefaultReprobeInterval = 30
+
+// reprobeEndpointsPeriodically probes the kubelet endpoints every reprobe interval until the context is
+// done, so an endpoint that was unavailable at startup, eg: as it was briefly failing, is collected once it
+// recovers
+func reprobeEndpointsPeriodically(ctx context.Context, config KubeAgentConfig, state *AgentState) {
+	ticker := time.NewTicker(time.Duration(config.ReprobeInterval) * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reprobeEndpoints(ctx, config, state)
+		}
+	}
+}
+
+// reprobeEndpoints probes the kubelet endpoints as at startup, and updates the endpoints available to the
+// following collections. The current endpoints are kept if the nodes can not be reached at all.
+func reprobeEndpoints(ctx context.Context, config KubeAgentConfig, state *AgentState) {
+	log.Debug("Probing kubelet endpoints")
+	conn, err := ensureNodeSource(ctx, config, state.apiLimiter)
+	// only the endpoints probed are kept, the clients created for probing are not
+	conn.NodeClient.HTTPClient.CloseIdleConnections()
+	if err != nil {
+		log.Warnf("Unable to probe kubelet endpoints, keeping the current connection methods: %v", err)
+		return
+	}
+	for _, t := range state.updateEndpoints(conn) {
+		log.Infof("Kubelet endpoint %s connection method changed from [%s] to [%s]", t.endpoint, t.from, t.to)
+	}
+}
+
+// endpointTransition is a change of the connection methods available for an endpoint
+type endpointTransition struct {
+	endpoint Endpoint
+	from, to string
+}
+
+// endpointTransitions returns the endpoints whose connection methods differ between the masks, in sorted order
+func endpointTransitions(from, to *EndpointMask) []endpointTransition {
+	seen := map[Endpoint]bool{}
+	var endpoints []Endpoint
+	for _, e := range append(from.Endpoints(), to.Endpoints()...) {
+		if !seen[e] {
+			seen[e] = true
+			endpoints = append(endpoints, e)
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i] < endpoints[j] })
+
+	var transitions []endpointTransition
+	for _, e := range endpoints {
+		if from.connection(e) != to.connection(e) {
+			transitions = append(transitions, endpointTransition{endpoint: e, from: from.Options(e), to: to.Options(e)})
+		}
+	}
+	return transitions
+}
@@ -0,0 +1,100 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEndpointTransitions(t *testing.T) {
+	from := NewEndpointMask()
+	from.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	from.SetAvailability(NodePodsEndpoint, Proxy, true)
+	to := NewEndpointMask()
+	to.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	to.SetAvailability(NodeStatsSummaryEndpoint, Direct, true)
+	to.SetAvailability(NodeSpecEndpoint, Direct, true)
+
+	expected := []endpointTransition{
+		{endpoint: NodePodsEndpoint, from: "proxy", to: unreachable},
+		{endpoint: NodeSpecEndpoint, from: unreachable, to: "direct"},
+		{endpoint: NodeStatsSummaryEndpoint, from: "proxy", to: "proxy,direct"},
+	}
+	transitions := endpointTransitions(from, to)
+	if len(transitions) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], transitions[i])
+		}
+	}
+	if transitions := endpointTransitions(to, to.clone()); len(transitions) != 0 {
+		t.Errorf("expected no transitions, got %+v", transitions)
+	}
+}
+
+func TestReprobeEndpoints(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"node":{"nodeName":"node0"}}`)
+	}))
+	defer ts.Close()
+
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node0"},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+	config := KubeAgentConfig{
+		Clientset:      fake.NewSimpleClientset(node),
+		ClusterHostURL: ts.URL,
+		ForceKubeProxy: true,
+		HTTPClient: http.Client{Transport: &http.Transport{
+			// nolint gosec
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}},
+		ConcurrentPollers: 1,
+		PollInterval:      60,
+	}
+
+	// as if the node summaries were briefly failing at startup
+	mask := NewEndpointMask()
+	nodeMasks := newNodeEndpointMasks(config)
+	nodeMasks.forNode("node0", mask, func(*EndpointMask) {}, time.Now())
+	state := newAgentState(config, NodeConnection{NodeMetrics: mask, NodeMetricsReasons: EndpointReasons{},
+		nodeMasks: nodeMasks})
+
+	t.Run("Ensure a recovered endpoint is collected", func(t *testing.T) {
+		reprobeEndpoints(context.TODO(), config, state)
+		nodes := state.Nodes()
+		if nodes.NodeMetrics != mask || !mask.ProxyAllowed(NodeStatsSummaryEndpoint) {
+			t.Errorf("expected the mask to be updated in place, got %s", nodes.NodeMetrics)
+		}
+		if nodes.NodeMetricsReasons.Reason(NodeStatsSummaryEndpoint, Direct) != reasonForceKubeProxy {
+			t.Errorf("expected the reasons of the probe, got %v", nodes.NodeMetricsReasons)
+		}
+		if len(nodeMasks.masks) != 0 {
+			t.Errorf("expected the node masks to be derived again, got %v", nodeMasks.masks)
+		}
+	})
+
+	t.Run("Ensure the endpoints are kept if the nodes can not be reached", func(t *testing.T) {
+		unreachableConfig := config
+		unreachableConfig.Clientset = fake.NewSimpleClientset()
+		reprobeEndpoints(context.TODO(), unreachableConfig, state)
+		if !state.Nodes().NodeMetrics.ProxyAllowed(NodeStatsSummaryEndpoint) {
+			t.Errorf("expected the endpoints to be kept, got %s", state.Nodes().NodeMetrics)
+		}
+	})
+}
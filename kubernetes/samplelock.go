@@ -0,0 +1,214 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// sampleLockFile is kept in the scratch directory so agent instances sharing it, eg: an evicted agent that is
+// still flushing and its replacement, do not both sample the same upload interval
+const sampleLockFile = "agent-sample-lock.json"
+
+// sampleLockTTLPolls is the number of poll intervals after which a holder that has not renewed the sample
+// lock is considered gone
+const sampleLockTTLPolls = 3
+
+// sampleLockRecord is the holder of the sample lock and the most recent upload interval it sampled
+type sampleLockRecord struct {
+	Holder string `json:"holder"`
+	// Interval is the start of the upload interval most recently sampled by the holder
+	Interval time.Time `json:"interval"`
+	// Heartbeat is when the holder last renewed the lock
+	Heartbeat time.Time `json:"heartbeat"`
+	// WorkDir is the working directory of the holder's samples that are not yet uploaded
+	WorkDir string `json:"workDir"`
+}
+
+// readSampleLock reads the sample lock record from the scratch directory
+func readSampleLock(scratchDir string) (sampleLockRecord, error) {
+	var r sampleLockRecord
+	data, err := os.ReadFile(filepath.Join(scratchDir, sampleLockFile))
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(data, &r)
+	return r, err
+}
+
+// writeSampleLock writes the sample lock record to the scratch directory
+func writeSampleLock(scratchDir string, r sampleLockRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filepath.Join(scratchDir, sampleLockFile), 0644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// sampleLock ensures only one agent instance samples a given upload interval. Upload intervals are aligned
+// to the wall clock so every instance agrees on them. Where the scratch directory is shared between
+// instances, the instance holding the lock samples while any other stands by until the holder has not
+// renewed it for the lock TTL, and the successor then skips the rest of the interval its predecessor was
+// sampling. The predecessor's partial samples are never adopted. Where the scratch directory is not shared
+// no predecessor is visible, so an instance does not sample the rest of the upload interval it started in
+// as a predecessor may have sampled part of it.
+type sampleLock struct {
+	mu         sync.Mutex
+	scratchDir string
+	holder     string
+	workDir    string
+	interval   time.Duration
+	ttl        time.Duration
+	// skipThrough is the last upload interval that must not be sampled as another instance sampled part of it
+	skipThrough time.Time
+	held        bool
+	// standby is the reason the current upload interval is not sampled, so it is only logged once
+	standby string
+}
+
+// newSampleLock creates the sample lock of an instance started at now, reading any lock record left by a
+// predecessor to decide whether the upload interval it started in may be sampled
+func newSampleLock(config KubeAgentConfig, workDir string, now time.Time) *sampleLock {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "metrics-agent"
+	}
+	l := &sampleLock{
+		scratchDir: config.ScratchDir,
+		holder:     fmt.Sprintf("%s@%d", host, now.UnixNano()),
+		workDir:    workDir,
+		interval:   uploadInterval * time.Minute,
+		ttl:        sampleLockTTLPolls * time.Duration(config.PollInterval) * time.Second,
+	}
+	start := now.UTC().Truncate(l.interval)
+
+	record, err := readSampleLock(l.scratchDir)
+	switch {
+	case os.IsNotExist(err):
+		l.skipThrough = start
+		log.Infof("No sample lock found in %s, the upload interval starting %s will not be sampled in case "+
+			"a previous agent sampled part of it", l.scratchDir, start.Format(time.RFC3339))
+	case err != nil:
+		l.skipThrough = start
+		log.Warnf("Warning: unable to read sample lock, the upload interval starting %s will not be sampled "+
+			"in case a previous agent sampled part of it: %s", start.Format(time.RFC3339), err)
+	case !record.Interval.Before(start):
+		l.skipThrough = start
+		log.Infof("Agent %s sampled part of the upload interval starting %s, it will not be sampled",
+			record.Holder, start.Format(time.RFC3339))
+	default:
+		log.Infof("Agent %s last sampled the upload interval starting %s, sampling will start immediately",
+			record.Holder, record.Interval.Format(time.RFC3339))
+	}
+	return l
+}
+
+// claim reports whether the poll at now may be sampled, renewing the lock if so. lost is true when this
+// instance held the lock but another instance has since taken it over, so its samples not yet uploaded
+// must be discarded.
+func (l *sampleLock) claim(now time.Time) (ok bool, lost bool) {
+	if l == nil {
+		return true, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	interval := now.UTC().Truncate(l.interval)
+
+	record, err := readSampleLock(l.scratchDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Warning: unable to read sample lock: %s", err)
+	}
+	if err == nil && record.Holder != l.holder {
+		if now.Sub(record.Heartbeat) < l.ttl {
+			lost = l.held
+			l.held = false
+			l.stand(fmt.Sprintf("the upload interval is being sampled by agent %s", record.Holder))
+			return false, lost
+		}
+		if !record.Interval.Before(interval) && record.Interval.After(l.skipThrough) {
+			l.skipThrough = record.Interval
+		}
+		log.Infof("Taking over the sample lock from agent %s which last renewed it at %s, its samples in %s "+
+			"that were not uploaded are discarded", record.Holder, record.Heartbeat.Format(time.RFC3339),
+			record.WorkDir)
+	}
+
+	// the lock is renewed while standing by so a predecessor that is still running does not take it back
+	held := sampleLockRecord{Holder: l.holder, Interval: interval, Heartbeat: now.UTC(), WorkDir: l.workDir}
+	if !interval.After(l.skipThrough) {
+		held.Interval = l.skipThrough
+	}
+	if err := writeSampleLock(l.scratchDir, held); err != nil {
+		log.Warnf("Warning: unable to write sample lock: %s", err)
+	}
+	// another instance taking the lock at the same time wins if its write was the last
+	if record, err := readSampleLock(l.scratchDir); err == nil && record.Holder != l.holder {
+		l.stand(fmt.Sprintf("the sample lock was taken by agent %s", record.Holder))
+		return false, false
+	}
+	l.held = true
+
+	if !interval.After(l.skipThrough) {
+		l.stand("another agent sampled part of the upload interval")
+		return false, false
+	}
+	if l.standby != "" {
+		log.Infof("Sampling resumed for the upload interval starting %s", interval.Format(time.RFC3339))
+		l.standby = ""
+	}
+	return true, false
+}
+
+// stand logs why polls are not sampled, once for each reason
+func (l *sampleLock) stand(reason string) {
+	if reason == l.standby {
+		return
+	}
+	l.standby = reason
+	log.Infof("Polls will not be sampled: %s", reason)
+}
+
+// sampleLockHolderStopped reports whether the agent holding the sample lock recorded in the scratch directory
+// at now has stopped, so the samples it left may be recovered: it ran on this host, as when the agent
+// container restarts in place, or it has not renewed the lock for the lock TTL. No lock recorded has no
+// holder to wait for.
+func sampleLockHolderStopped(config KubeAgentConfig, now time.Time) bool {
+	record, err := readSampleLock(config.ScratchDir)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		log.Warnf("Warning: unable to read sample lock: %s", err)
+		return false
+	}
+	host, err := os.Hostname()
+	if holder, _, _ := strings.Cut(record.Holder, "@"); err == nil && holder == host {
+		return true
+	}
+	return now.Sub(record.Heartbeat) >= sampleLockTTLPolls*time.Duration(config.PollInterval)*time.Second
+}
+
+// discardPendingSamples removes the samples in the export directory that were not yet uploaded
+func discardPendingSamples(exportDir string) error {
+	entries, err := os.ReadDir(exportDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(exportDir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package kubernetes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSampleLock(t *testing.T) {
+	// upload intervals are 10 minutes and the lock expires after 3 minutes without being renewed
+	start := time.Date(2024, 1, 1, 0, 2, 0, 0, time.UTC)
+	newConfig := func(t *testing.T) KubeAgentConfig {
+		return KubeAgentConfig{ScratchDir: t.TempDir(), PollInterval: 60}
+	}
+	expectClaim := func(t *testing.T, l *sampleLock, now time.Time, ok, lost bool) {
+		t.Helper()
+		if gotOK, gotLost := l.claim(now); gotOK != ok || gotLost != lost {
+			t.Errorf("claim at %s: expected %v, %v, got %v, %v", now.Format(time.RFC3339), ok, lost, gotOK, gotLost)
+		}
+	}
+
+	t.Run("Ensure the interval started in is skipped without a lock record", func(t *testing.T) {
+		config := newConfig(t)
+		l := newSampleLock(config, "", start)
+		expectClaim(t, l, start.Add(time.Minute), false, false)
+		expectClaim(t, l, start.Add(7*time.Minute), false, false)
+		expectClaim(t, l, start.Add(8*time.Minute), true, false)
+	})
+
+	t.Run("Ensure sampling starts immediately after a predecessor that finished earlier", func(t *testing.T) {
+		config := newConfig(t)
+		err := writeSampleLock(config.ScratchDir, sampleLockRecord{Holder: "old",
+			Interval: time.Date(2023, 12, 31, 23, 50, 0, 0, time.UTC), Heartbeat: start.Add(-5 * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := newSampleLock(config, "", start)
+		expectClaim(t, l, start.Add(time.Minute), true, false)
+	})
+
+	t.Run("Ensure a replacement stands by for a live predecessor and skips its interval", func(t *testing.T) {
+		config := newConfig(t)
+		old := newSampleLock(config, "old", start.Add(-time.Hour))
+		expectClaim(t, old, start, true, false)
+
+		l := newSampleLock(config, "new", start.Add(30*time.Second))
+		// the predecessor keeps sampling into the next interval until it is stopped
+		expectClaim(t, l, start.Add(time.Minute), false, false)
+		expectClaim(t, old, start.Add(8*time.Minute+30*time.Second), true, false)
+		expectClaim(t, l, start.Add(9*time.Minute), false, false)
+		expectClaim(t, l, start.Add(11*time.Minute), false, false)
+		// once its lock expires the rest of the interval it sampled is skipped
+		expectClaim(t, l, start.Add(12*time.Minute), false, false)
+		expectClaim(t, l, start.Add(17*time.Minute), false, false)
+		expectClaim(t, l, start.Add(18*time.Minute), true, false)
+
+		record, err := readSampleLock(config.ScratchDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Holder != l.holder || record.WorkDir != "new" {
+			t.Errorf("expected the replacement to hold the lock, got %+v", record)
+		}
+		// the predecessor discards its samples if it comes back
+		expectClaim(t, old, start.Add(18*time.Minute+30*time.Second), false, true)
+		expectClaim(t, old, start.Add(19*time.Minute), false, false)
+	})
+
+	t.Run("Ensure a nil lock samples every poll", func(t *testing.T) {
+		var l *sampleLock
+		expectClaim(t, l, start, true, false)
+	})
+}
+
+func TestDiscardPendingSamples(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "20240101", "1704067200"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "agent-diagnostics.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := discardPendingSamples(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no pending samples, got %v", entries)
+	}
+}
@@ -0,0 +1,251 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"errors"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// sampleRateFile is kept in the scratch directory so intervals missed across an agent restart are counted
+const sampleRateFile = "agent-sample-rate.json"
+
+// readinessFile is kept in the scratch directory while the agent produces samples, the readiness probe of
+// the agent container checks for it
+const readinessFile = "agent-ready"
+
+// DefaultMissedIntervalThreshold is the default number of consecutive poll intervals without a sample
+// after which the agent reports itself not ready
+const DefaultMissedIntervalThreshold = 3
+
+// intervalHistoryLength is the number of recent poll intervals kept in the interval history
+const intervalHistoryLength = 48
+
+// interval outcomes
+const (
+	// intervalProduced is an interval that produced a complete sample
+	intervalProduced = "produced"
+	// intervalDegraded is an interval that produced a sample with reduced collection or failed nodes
+	intervalDegraded = "degraded"
+	// intervalSkipped is an interval that produced no sample
+	intervalSkipped = "skipped"
+)
+
+// intervalRecord is the outcome of a poll interval
+type intervalRecord struct {
+	Time    time.Time `json:"time"`
+	Outcome string    `json:"outcome"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// sampleRate counts the poll intervals expected to produce a sample against those that did. The counts
+// only grow, across restarts as well, so the intervals missed over any period can be derived from them.
+type sampleRate struct {
+	// Expected is the number of poll intervals elapsed while the agent was expected to produce samples
+	Expected uint64 `json:"expected"`
+	// Produced is the number of poll intervals that produced a sample, degraded or not
+	Produced uint64 `json:"produced"`
+	// ConsecutiveMissed is the number of most recent poll intervals without a sample
+	ConsecutiveMissed uint64 `json:"consecutiveMissed"`
+	// Last is the time of the most recent poll interval accounted for
+	Last    time.Time        `json:"last"`
+	History []intervalRecord `json:"history"`
+}
+
+// missed returns the number of poll intervals that produced no sample
+func (r sampleRate) missed() uint64 {
+	return r.Expected - r.Produced
+}
+
+// record accounts for the poll interval at now. Intervals elapsed since the last one accounted for without a
+// poll, eg: while the agent was stopped or a poll overran, are recorded as skipped first. Returns the
+// records added.
+func (r *sampleRate) record(now time.Time, interval time.Duration, outcome, reason string) []intervalRecord {
+	var added []intervalRecord
+	if !r.Last.IsZero() && interval > 0 {
+		// ticks drift, so an interval counts as skipped once half of the next has also elapsed
+		gap := int64((now.Sub(r.Last) + interval/2) / interval)
+		for i := int64(1); i < gap; i++ {
+			added = append(added, intervalRecord{Time: r.Last.Add(time.Duration(i) * interval),
+				Outcome: intervalSkipped, Reason: "no poll ran in the interval"})
+		}
+	}
+	added = append(added, intervalRecord{Time: now, Outcome: outcome, Reason: reason})
+	for _, a := range added {
+		r.Expected++
+		if a.Outcome == intervalSkipped {
+			r.ConsecutiveMissed++
+		} else {
+			r.Produced++
+			r.ConsecutiveMissed = 0
+		}
+	}
+	r.Last = now
+	r.History = appendIntervalHistory(r.History, added)
+	return added
+}
+
+// pause accounts for a poll interval at now that is not expected to produce a sample, eg: a discarded
+// warm-up sample or an agent standing by for another to release the sample lock
+func (r *sampleRate) pause(now time.Time) {
+	r.Last = now
+}
+
+// appendIntervalHistory appends records to the history, keeping the most recent intervalHistoryLength
+func appendIntervalHistory(history, records []intervalRecord) []intervalRecord {
+	history = append(history, records...)
+	if len(history) > intervalHistoryLength {
+		history = append([]intervalRecord(nil), history[len(history)-intervalHistoryLength:]...)
+	}
+	return history
+}
+
+// readSampleRate reads the sample rate recorded in the scratch directory
+func readSampleRate(scratchDir string) (sampleRate, error) {
+	var r sampleRate
+	data, err := os.ReadFile(filepath.Join(scratchDir, sampleRateFile))
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(data, &r)
+	return r, err
+}
+
+// writeSampleRate records the sample rate in the scratch directory
+func writeSampleRate(scratchDir string, r sampleRate) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filepath.Join(scratchDir, sampleRateFile), 0644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// pollOutcome returns the outcome of a poll interval from the error of its collection, the degradation level
+// collection ran at and the nodes that failed to be collected
+func pollOutcome(err error, level DegradationLevel, failedNodes int) (string, string) {
+	switch {
+	case err != nil:
+		return intervalSkipped, err.Error()
+	case level > DegradationNone:
+		return intervalDegraded, fmt.Sprintf("collection degraded to %s", level)
+	case failedNodes > 0:
+		return intervalDegraded, fmt.Sprintf("%d nodes failed to be collected", failedNodes)
+	}
+	return intervalProduced, ""
+}
+
+// updateReadiness keeps the readiness file in the scratch directory while fewer than threshold consecutive
+// poll intervals have been missed, 0 never removes it
+func updateReadiness(scratchDir string, r sampleRate, threshold int) {
+	name := filepath.Join(scratchDir, readinessFile)
+	if threshold > 0 && r.ConsecutiveMissed >= uint64(threshold) {
+		reportNotReady(scratchDir, fmt.Sprintf("no sample was produced in the last %d poll intervals",
+			r.ConsecutiveMissed))
+		return
+	}
+	if _, err := os.Stat(name); err == nil {
+		return
+	}
+	if err := os.WriteFile(name, []byte("ready\n"), 0644); err != nil {
+		log.Warnf("Warning: unable to write readiness file: %s", err)
+	}
+}
+
+// reportNotReady removes the readiness file from the scratch directory, logging the reason
+func reportNotReady(scratchDir, reason string) {
+	if err := os.Remove(filepath.Join(scratchDir, readinessFile)); err == nil {
+		log.Errorf("Reporting not ready: %s", reason)
+	} else if !os.IsNotExist(err) {
+		log.Warnf("Warning: unable to remove readiness file: %s", err)
+	}
+}
+
+// appendIntervalDiagnostics appends poll interval records to the diagnostics file of the export directory
+func appendIntervalDiagnostics(exportDir string, title string, records []intervalRecord) (rerr error) {
+	if len(records) == 0 {
+		return nil
+	}
+	//nolint gosec
+	f, err := os.OpenFile(filepath.Join(exportDir, sample.DiagnosticsFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer util.SafeClose(f.Close, &rerr)
+
+	if _, err := fmt.Fprintf(f, "%s:\n", title); err != nil {
+		return err
+	}
+	for _, r := range records {
+		line := fmt.Sprintf(" %s %s", r.Time.UTC().Format(time.RFC3339), r.Outcome)
+		if r.Reason != "" {
+			line += ": " + r.Reason
+		}
+		if _, err := fmt.Fprintln(f, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreSampleRate restores the sample rate recorded before a restart, appending its recent interval history
+// to the diagnostics file
+func restoreSampleRate(config KubeAgentConfig, state *AgentState) {
+	r, err := readSampleRate(config.ScratchDir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Warnf("Warning: unable to read sample rate, missed intervals are counted from startup: %s", err)
+		return
+	}
+	state.restoreSampleRate(r)
+	log.Infof("Poll intervals since the sample rate was first recorded: %d expected, %d missed", r.Expected,
+		r.missed())
+	err = appendIntervalDiagnostics(config.msExportDirectory.Name(), "Poll intervals before restart", r.History)
+	if err != nil {
+		log.Warnf("Warning: unable to write interval history diagnostics: %s", err)
+	}
+}
+
+// recordPollInterval accounts for the poll interval at now from the error of its collection and the
+// degradation level it ran at, and persists the sample rate. Intervals without a complete sample are
+// appended to the diagnostics file, and readiness is reported from the consecutive intervals missed.
+func recordPollInterval(config KubeAgentConfig, state *AgentState, now time.Time, err error,
+	level DegradationLevel) {
+	outcome, reason := pollOutcome(err, level, len(state.status().failedNodeList))
+	r, added := state.recordInterval(now, time.Duration(config.PollInterval)*time.Second, outcome, reason)
+	if len(added) > 1 {
+		log.Warnf("No poll ran in the last %d poll intervals", len(added)-1)
+	}
+	if errors.Is(err, errExportVolumeUnwritable) {
+		// nothing can be written while the export volume is not writable, readiness was withdrawn as the
+		// outage started and the sample rate is persisted once it recovers
+		return
+	}
+	if err := writeSampleRate(config.ScratchDir, r); err != nil {
+		log.Warnf("Warning: unable to record sample rate: %s", err)
+	}
+	updateReadiness(config.ScratchDir, r, config.MissedIntervalThreshold)
+
+	var incomplete []intervalRecord
+	for _, a := range added {
+		if a.Outcome != intervalProduced {
+			incomplete = append(incomplete, a)
+		}
+	}
+	err = appendIntervalDiagnostics(config.msExportDirectory.Name(), "Poll intervals without a complete sample",
+		incomplete)
+	if err != nil {
+		log.Warnf("Warning: unable to write interval history diagnostics: %s", err)
+	}
+}
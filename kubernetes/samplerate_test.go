@@ -0,0 +1,111 @@
+package kubernetes
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSampleRate(t *testing.T) {
+	interval := time.Minute
+	start := time.Date(2020, 1, 2, 3, 4, 0, 0, time.UTC)
+
+	t.Run("Ensure intervals without a poll are counted as skipped", func(t *testing.T) {
+		var r sampleRate
+		r.record(start, interval, intervalProduced, "")
+		// ticks drift by a few seconds
+		r.record(start.Add(interval+2*time.Second), interval, intervalDegraded, "collection degraded")
+		added := r.record(start.Add(4*interval), interval, intervalProduced, "")
+		if len(added) != 3 || added[0].Outcome != intervalSkipped || added[1].Outcome != intervalSkipped {
+			t.Fatalf("expected two skipped intervals before the poll, got %+v", added)
+		}
+		if r.Expected != 5 || r.Produced != 3 || r.missed() != 2 || r.ConsecutiveMissed != 0 {
+			t.Errorf("unexpected counts %+v", r)
+		}
+		if len(r.History) != 5 {
+			t.Errorf("expected the history of every interval, got %d", len(r.History))
+		}
+	})
+
+	t.Run("Ensure paused intervals are not expected", func(t *testing.T) {
+		var r sampleRate
+		r.pause(start)
+		r.pause(start.Add(interval))
+		r.record(start.Add(2*interval), interval, intervalProduced, "")
+		if r.Expected != 1 || r.missed() != 0 {
+			t.Errorf("unexpected counts %+v", r)
+		}
+	})
+
+	t.Run("Ensure the history is bounded", func(t *testing.T) {
+		var r sampleRate
+		r.record(start, interval, intervalProduced, "")
+		r.record(start.Add(100*interval), interval, intervalSkipped, "sample too large")
+		if len(r.History) != intervalHistoryLength || r.ConsecutiveMissed != 100 || r.Expected != 101 {
+			t.Errorf("unexpected history of %d intervals and counts %+v", len(r.History), r)
+		}
+		if last := r.History[len(r.History)-1]; last.Reason != "sample too large" {
+			t.Errorf("expected the most recent interval last, got %+v", last)
+		}
+	})
+
+	t.Run("Ensure outcomes are derived from the collection", func(t *testing.T) {
+		if o, _ := pollOutcome(errors.New("discarded"), DegradationNone, 0); o != intervalSkipped {
+			t.Errorf("expected a failed collection to be skipped, got %s", o)
+		}
+		if o, _ := pollOutcome(nil, DegradationSkipExtraEndpoints, 0); o != intervalDegraded {
+			t.Errorf("expected a degraded collection to be degraded, got %s", o)
+		}
+		if o, _ := pollOutcome(nil, DegradationNone, 2); o != intervalDegraded {
+			t.Errorf("expected failed nodes to be degraded, got %s", o)
+		}
+		if o, _ := pollOutcome(nil, DegradationNone, 0); o != intervalProduced {
+			t.Errorf("expected a complete sample to be produced, got %s", o)
+		}
+	})
+}
+
+func TestSampleRatePersistence(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestSampleRatePersistence")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var r sampleRate
+	r.record(time.Now(), time.Minute, intervalSkipped, "discarded")
+	if err := writeSampleRate(dir, r); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readSampleRate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Expected != 1 || read.ConsecutiveMissed != 1 || len(read.History) != 1 {
+		t.Errorf("unexpected sample rate read %+v", read)
+	}
+
+	ready := filepath.Join(dir, readinessFile)
+	updateReadiness(dir, read, 2)
+	if _, err := os.Stat(ready); err != nil {
+		t.Errorf("expected the agent to be ready below the threshold: %v", err)
+	}
+	read.ConsecutiveMissed = 2
+	updateReadiness(dir, read, 2)
+	if _, err := os.Stat(ready); !os.IsNotExist(err) {
+		t.Errorf("expected the agent not to be ready at the threshold: %v", err)
+	}
+	updateReadiness(dir, read, 0)
+	if _, err := os.Stat(ready); err != nil {
+		t.Errorf("expected the agent to always be ready with no threshold: %v", err)
+	}
+
+	if err := appendIntervalDiagnostics(dir, "Poll intervals", read.History); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "agent.diag")); err != nil || len(data) == 0 {
+		t.Errorf("expected the interval history in the diagnostics file: %v", err)
+	}
+}
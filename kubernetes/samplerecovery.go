@@ -0,0 +1,135 @@
+package kubernetes
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// sampleRecoveryWindow is how long after it was started an archive interrupted by a restart, or after it was
+// collected a sample that was not archived, is recovered. Older samples belong to an upload interval that has
+// passed, so are discarded.
+const sampleRecoveryWindow = uploadInterval * time.Minute
+
+// recoverInterruptedSamples recovers the samples a previous agent left in the scratch directory without
+// uploading them. Archives whose build was interrupted are completed from their sample directories, which
+// are intact, and returned to be uploaded. Samples collected but not archived are moved into the current
+// export directory to be archived with the next upload. The working directories of the previous agent are
+// then removed. With the sample lock, nothing is recovered while the agent holding it may still be running,
+// as it may still upload its samples.
+func recoverInterruptedSamples(config KubeAgentConfig, now time.Time) []*os.File {
+	if config.SampleIntervalLock && !sampleLockHolderStopped(config, now) {
+		log.Info("The agent holding the sample lock may still be running, its samples are not recovered")
+		return nil
+	}
+	workDir := path.Dir(config.msExportDirectory.Name())
+
+	archives, err := util.InterruptedArchives(config.ScratchDir)
+	if err != nil {
+		log.Warnf("Warning: unable to list interrupted metric sample archives: %s", err)
+	}
+	var recovered []*os.File
+	for _, a := range archives {
+		if path.Dir(a.Source) == workDir {
+			continue
+		}
+		f, err := recoverArchive(a, now)
+		if err != nil {
+			log.Warnf("Warning: unable to recover metric sample archive %s, it is discarded: %s", a.Name, err)
+			discardArchive(a.Name)
+			continue
+		}
+		if f != nil {
+			log.Infof("Recovered metric sample archive %s interrupted by a restart", a.Name)
+			recovered = append(recovered, f)
+		}
+	}
+
+	previous, err := filepath.Glob(filepath.Join(config.ScratchDir, util.WorkingDirectoryPrefix+"*"))
+	if err != nil {
+		log.Warnf("Warning: unable to list previous working directories: %s", err)
+	}
+	for _, dir := range previous {
+		if dir == workDir {
+			continue
+		}
+		moved, err := adoptCollectedSamples(dir, config.msExportDirectory.Name(), now)
+		if err != nil {
+			log.Warnf("Warning: unable to recover samples collected in %s: %s", dir, err)
+		}
+		if moved > 0 {
+			log.Infof("Recovered %d metric samples collected but not archived before a restart", moved)
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnf("Warning: unable to remove previous working directory %s: %s", dir, err)
+		}
+	}
+	return recovered
+}
+
+// recoverArchive completes an interrupted archive, returning nil if it is too old to be recovered
+func recoverArchive(a util.InterruptedArchive, now time.Time) (*os.File, error) {
+	if now.Sub(a.Started) > sampleRecoveryWindow {
+		log.Infof("Metric sample archive %s interrupted by a restart was started %s ago, it is discarded",
+			a.Name, now.Sub(a.Started).Round(time.Second))
+		discardArchive(a.Name)
+		return nil, nil
+	}
+	if _, err := os.Stat(a.Source); os.IsNotExist(err) && a.Complete {
+		// only the progress record was left behind
+		if err := util.FinishArchive(a.Name); err != nil {
+			return nil, err
+		}
+		//nolint gosec
+		return os.Open(a.Name)
+	}
+	return util.CompleteMetricSample(a.Source, a.Name, true)
+}
+
+// discardArchive removes an archive and its progress record
+func discardArchive(name string) {
+	for _, n := range []string{name, name + util.ArchiveProgressSuffix} {
+		if err := os.Remove(n); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Warning: unable to remove %s: %s", n, err)
+		}
+	}
+}
+
+// adoptCollectedSamples moves the complete samples of a previous working directory collected within the
+// recovery window into the export directory, returning the number moved. Samples without a manifest were
+// interrupted during collection so are left behind.
+func adoptCollectedSamples(workDir, exportDir string, now time.Time) (int, error) {
+	// samples are <work dir>/<export dir>/<time>/<unix time>
+	manifests, err := filepath.Glob(filepath.Join(workDir, "*", "*", "*", sample.ManifestFile))
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, m := range manifests {
+		fi, err := os.Stat(m)
+		if err != nil {
+			return moved, err
+		}
+		if now.Sub(fi.ModTime()) > sampleRecoveryWindow {
+			continue
+		}
+		msd := filepath.Dir(m)
+		dest := filepath.Join(exportDir, filepath.Base(filepath.Dir(msd)), filepath.Base(msd))
+		if _, err := os.Stat(dest); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(msd, dest); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
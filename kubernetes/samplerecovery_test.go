@@ -0,0 +1,115 @@
+package kubernetes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+)
+
+func TestRecoverInterruptedSamples(t *testing.T) {
+	scratch, err := os.MkdirTemp("", "TestRecoverInterruptedSamples")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	now := time.Now()
+	writeSample := func(exportDir string, at time.Time, manifest bool) string {
+		msd := sample.Dir(exportDir, at)
+		if err := os.MkdirAll(msd, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(msd, "stats-summary-node0.json"), []byte(`{}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if manifest {
+			if err := sample.WriteManifest(msd, "test"); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(filepath.Join(msd, sample.ManifestFile), at, at); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return msd
+	}
+
+	// a previous agent restarted while archiving, with a sample collected since its last archive
+	archived := filepath.Join(scratch, util.WorkingDirectoryPrefix+"1", "cluster_1")
+	writeSample(archived, now.Add(-2*time.Minute), true)
+	archive := filepath.Join(scratch, "cluster_1.tgz")
+	if err := util.BuildArchive(archived, archive); err != nil {
+		t.Fatal(err)
+	}
+	collected := filepath.Join(scratch, util.WorkingDirectoryPrefix+"2", "cluster_2")
+	adopted := writeSample(collected, now.Add(-time.Minute), true)
+	writeSample(collected, now, false)
+	writeSample(collected, now.Add(-2*sampleRecoveryWindow), true)
+	// an archive interrupted too long ago to belong to this upload interval
+	stale := filepath.Join(scratch, util.WorkingDirectoryPrefix+"3", "cluster_3")
+	writeSample(stale, now.Add(-2*sampleRecoveryWindow), true)
+	staleArchive := filepath.Join(scratch, "cluster_3.tgz")
+	if err := util.BuildArchive(stale, staleArchive); err != nil {
+		t.Fatal(err)
+	}
+	staleProgress := []byte(`{"source":"` + stale + `","started":"` +
+		now.Add(-2*sampleRecoveryWindow).Format(time.RFC3339) + `","complete":true}`)
+	if err := os.WriteFile(staleArchive+util.ArchiveProgressSuffix, staleProgress, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := util.CreateMSWorkingDirectory("cluster", scratch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := KubeAgentConfig{ScratchDir: scratch, msExportDirectory: current}
+
+	// another agent holding the sample lock may still upload the samples
+	err = writeSampleLock(scratch, sampleLockRecord{Holder: "other-host@1", Heartbeat: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered := recoverInterruptedSamples(KubeAgentConfig{ScratchDir: scratch, msExportDirectory: current,
+		SampleIntervalLock: true, PollInterval: 60}, now); len(recovered) != 0 {
+		t.Errorf("expected nothing to be recovered while the sample lock is held, got %d archives", len(recovered))
+	}
+	host, _ := os.Hostname()
+	err = writeSampleLock(scratch, sampleLockRecord{Holder: host + "@1", Heartbeat: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SampleIntervalLock = true
+	config.PollInterval = 60
+
+	recovered := recoverInterruptedSamples(config, now)
+	if len(recovered) != 1 || recovered[0].Name() != archive {
+		t.Fatalf("expected the interrupted archive to be recovered, got %v", recovered)
+	}
+	_ = recovered[0].Close()
+	if _, err := os.Stat(archive + util.ArchiveProgressSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected the recovered archive to be finished: %v", err)
+	}
+	if _, err := os.Stat(staleArchive); !os.IsNotExist(err) {
+		t.Errorf("expected the stale archive to be discarded: %v", err)
+	}
+
+	rel, _ := filepath.Rel(collected, adopted)
+	if _, err := os.Stat(filepath.Join(current.Name(), rel, sample.ManifestFile)); err != nil {
+		t.Errorf("expected the collected sample to be moved into the export directory: %v", err)
+	}
+	samples, _ := filepath.Glob(filepath.Join(current.Name(), "*", "*"))
+	if len(samples) != 1 {
+		t.Errorf("expected only the complete recent sample to be recovered, got %v", samples)
+	}
+	for _, n := range []string{"1", "2", "3"} {
+		if _, err := os.Stat(filepath.Join(scratch, util.WorkingDirectoryPrefix+n)); !os.IsNotExist(err) {
+			t.Errorf("expected previous working directory %s to be removed: %v", n, err)
+		}
+	}
+	if _, err := os.Stat(current.Name()); err != nil {
+		t.Errorf("expected the current working directory to be kept: %v", err)
+	}
+}
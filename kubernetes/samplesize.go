@@ -0,0 +1,315 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMaxSampleBytes is the default cap (in bytes) on the total size of a sample, the size of samples is
+// not capped by default
+const DefaultMaxSampleBytes = 0
+
+// sampleSizeShedRatio is the fraction of the sample size cap at which data is shed, leaving room for the
+// files written after the cap is enforced
+const sampleSizeShedRatio = 0.9
+
+// errSampleTooLarge is returned when a sample exceeds its size cap after shedding, the sample is discarded
+// rather than producing an archive that can not be delivered
+var errSampleTooLarge = errors.New("sample exceeds the maximum sample size")
+
+// errSampleDataShed is returned writing data of a class shed once the sample approached its size cap
+var errSampleDataShed = fmt.Errorf("sample data shed approaching the maximum sample size: %w", util.ErrWriteLimited)
+
+// sampleSizeLimit enforces the size cap of a sample, recording the data shed to stay within it. It is the
+// write limit of the sample directory, so the size of the sample is tracked as its files are written.
+type sampleSizeLimit struct {
+	maxBytes int64
+	// sources are the shed classes of the node sources shed, including any extra kubelet endpoints
+	sources map[string]string
+
+	mu sync.Mutex
+	// written is the size of the sample tracked from the writes to its files, and measured by each enforce
+	written int64
+	// shedding is set once the sample reaches the size at which data is shed, the shed classes are refused
+	// from then on
+	shedding bool
+	// tooLarge is set once a write is refused as it would exceed the cap
+	tooLarge bool
+	// shed is the data shed from the sample so far, at most one action per class
+	shed []sample.ShedAction
+}
+
+func newSampleSizeLimit(config KubeAgentConfig) *sampleSizeLimit {
+	sources := map[string]string{
+		sample.KubeletPodsSource:     sample.ShedKubeletPods,
+		sample.CadvisorMetricsSource: sample.ShedCadvisor,
+		sample.ContainerSource:       sample.ShedContainer,
+	}
+	// extra endpoints collecting the kubelet path of a shed source are shed with it
+	kubeletPaths := map[string]string{
+		"/pods":             sample.ShedKubeletPods,
+		"/metrics/cadvisor": sample.ShedCadvisor,
+		"/stats/container":  sample.ShedContainer,
+	}
+	for _, e := range config.extraEndpoints {
+		for kubeletPath, class := range kubeletPaths {
+			if strings.HasPrefix(e.Path, kubeletPath) {
+				sources[e.Name] = class
+			}
+		}
+	}
+	return &sampleSizeLimit{maxBytes: config.MaxSampleBytes, sources: sources}
+}
+
+// target returns the size at which data is shed from the sample
+func (l *sampleSizeLimit) target() int64 {
+	return int64(float64(l.maxBytes) * sampleSizeShedRatio)
+}
+
+// shedClass returns the shed class of a file of the sample, empty if it is not shed
+func (l *sampleSizeLimit) shedClass(name string) string {
+	if strings.HasSuffix(name, sample.ResourceFileExtension) {
+		return sample.ShedResources
+	}
+	return l.sources[sampleFileSource(name)]
+}
+
+// Allow refuses the writes to the files of a shed class once the sample reaches the size at which data is
+// shed, and any write that would exceed the cap. The files of a class are not fetched or exported once it
+// is shed, so the sample does not grow past its cap before enforce sees it.
+func (l *sampleSizeLimit) Allow(name string, n int) error {
+	if l.maxBytes <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.written+int64(n) > l.target() && !l.shedding {
+		l.shedding = true
+		log.Warnf("Sample size %d bytes is approaching the maximum of %d bytes, shedding data as it is written",
+			l.written, l.maxBytes)
+	}
+	if class := l.shedClass(name); class != "" && l.shedding {
+		l.record(class, []string{name}, 0)
+		return errSampleDataShed
+	}
+	if l.written+int64(n) > l.maxBytes {
+		l.tooLarge = true
+		return fmt.Errorf("%w: writing %s: %w", errSampleTooLarge, name, util.ErrWriteLimited)
+	}
+	l.written += int64(n)
+	return nil
+}
+
+// Release removes data no longer in the sample from its tracked size, counting a partial file of a shed
+// class as shed
+func (l *sampleSizeLimit) Release(name string, n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.written -= n
+	if class := l.shedClass(name); class != "" && l.shedding {
+		l.record(class, nil, n)
+	}
+}
+
+// enforce sheds data from the sample directory once it approaches the size cap: kubelet pods first, then
+// cadvisor metrics, then container stats, then resource exports are trimmed. Returns errSampleTooLarge if
+// the sample still exceeds the cap, or a write was refused as it would have exceeded it. The data is shed as
+// it is written, so this is the final check of each phase of collection as it completes, eg: of the files
+// not written through the sample directory.
+func (l *sampleSizeLimit) enforce(msd string) error {
+	if l.maxBytes <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	target := l.target()
+	size, err := dirSize(msd)
+	if err != nil {
+		return fmt.Errorf("unable to determine sample size: %v", err)
+	}
+
+	steps := []struct {
+		class string
+		shed  func(msd string, excess int64) ([]string, int64, error)
+	}{
+		{sample.ShedKubeletPods, l.removeSources(sample.ShedKubeletPods)},
+		{sample.ShedCadvisor, l.removeSources(sample.ShedCadvisor)},
+		{sample.ShedContainer, l.removeSources(sample.ShedContainer)},
+		{sample.ShedResources, trimResourceFiles},
+	}
+	for _, step := range steps {
+		if size <= target {
+			break
+		}
+		files, shed, err := step.shed(msd, size-target)
+		if err != nil {
+			return fmt.Errorf("unable to shed %s data from sample: %v", step.class, err)
+		}
+		if len(files) == 0 {
+			continue
+		}
+		log.Warnf("Sample size %d bytes is approaching the maximum of %d bytes, shed %d bytes of %s data",
+			size, l.maxBytes, shed, step.class)
+		l.record(step.class, files, shed)
+		size -= shed
+	}
+	// the data of later phases is shed as it is written only once the sample approaches its cap again
+	l.written = size
+	l.shedding = size > target
+
+	if size > l.maxBytes {
+		return fmt.Errorf("%w: %d bytes after shedding exceeds the maximum of %d bytes", errSampleTooLarge,
+			size, l.maxBytes)
+	}
+	if l.tooLarge {
+		return fmt.Errorf("%w: data was refused as it would exceed the maximum of %d bytes", errSampleTooLarge,
+			l.maxBytes)
+	}
+	return nil
+}
+
+// record adds shed data to the action of its class, a file is listed once
+func (l *sampleSizeLimit) record(class string, files []string, shed int64) {
+	for i := range l.shed {
+		if l.shed[i].Class == class {
+			listed := map[string]bool{}
+			for _, f := range l.shed[i].Files {
+				listed[f] = true
+			}
+			for _, f := range files {
+				if !listed[f] {
+					l.shed[i].Files = append(l.shed[i].Files, f)
+					listed[f] = true
+				}
+			}
+			l.shed[i].Bytes += shed
+			return
+		}
+	}
+	l.shed = append(l.shed, sample.ShedAction{Class: class, Files: files, Bytes: shed})
+}
+
+// shedBytes returns the total size of the data shed
+func (l *sampleSizeLimit) shedBytes() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var total int64
+	for _, a := range l.shed {
+		total += a.Bytes
+	}
+	return total
+}
+
+// removeSources returns a shedding step removing the files of the node sources of the shed class, including
+// any extra kubelet endpoints collecting its kubelet path, from the sample
+func (l *sampleSizeLimit) removeSources(class string) func(string, int64) ([]string, int64, error) {
+	return func(msd string, _ int64) ([]string, int64, error) {
+		entries, err := os.ReadDir(msd)
+		if err != nil {
+			return nil, 0, err
+		}
+		var removed []string
+		var shed int64
+		for _, e := range entries {
+			if e.IsDir() || l.sources[sampleFileSource(e.Name())] != class {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				return removed, shed, err
+			}
+			if err := os.Remove(filepath.Join(msd, e.Name())); err != nil {
+				return removed, shed, err
+			}
+			removed = append(removed, e.Name())
+			shed += info.Size()
+		}
+		return removed, shed, nil
+	}
+}
+
+// sampleFileSource returns the node source of a node file in the sample, current or baseline
+func sampleFileSource(name string) string {
+	for _, prefix := range []string{sample.StatsPrefix, sample.BaselinePrefix} {
+		if rest, ok := strings.CutPrefix(name, prefix+"-"); ok {
+			source, _, _ := strings.Cut(rest, "-")
+			return source
+		}
+	}
+	return ""
+}
+
+// trimResourceFiles truncates the largest resource exports in the sample to whole records until excess
+// bytes are shed, returning the files truncated
+func trimResourceFiles(msd string, excess int64) ([]string, int64, error) {
+	entries, err := os.ReadDir(msd)
+	if err != nil {
+		return nil, 0, err
+	}
+	type resourceFile struct {
+		name string
+		size int64
+	}
+	var files []resourceFile
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), sample.ResourceFileExtension) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, 0, err
+		}
+		files = append(files, resourceFile{name: e.Name(), size: info.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].size > files[j].size })
+
+	var trimmed []string
+	var shed int64
+	for _, f := range files {
+		if shed >= excess {
+			break
+		}
+		keep := f.size - (excess - shed)
+		if keep < 0 {
+			keep = 0
+		}
+		size, err := util.TruncateRecords(filepath.Join(msd, f.name), keep)
+		if err != nil {
+			return trimmed, shed, err
+		}
+		if size < f.size {
+			trimmed = append(trimmed, f.name)
+			shed += f.size - size
+		}
+	}
+	return trimmed, shed, nil
+}
+
+// dirSize returns the combined size of the files in the directory
+func dirSize(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
@@ -0,0 +1,201 @@
+package kubernetes
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+)
+
+func writeSampleFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSampleSizeLimit(t *testing.T) {
+	record := strings.Repeat("x", 99) + "\n"
+	files := map[string]string{
+		"stats-summary-node0.json":            strings.Repeat("s", 100),
+		"stats-cadvisor_metrics-node0.txt":    strings.Repeat("c", 100),
+		"stats-prom-node0.txt":                strings.Repeat("p", 100),
+		"baseline-container-node0.json":       strings.Repeat("b", 100),
+		"stats-container-node0.json":          strings.Repeat("b", 100),
+		"pods" + sample.ResourceFileExtension: strings.Repeat(record, 10),
+	}
+	config := KubeAgentConfig{extraEndpoints: []ExtraEndpoint{{Name: "prom", Path: "/metrics/cadvisor"}}}
+
+	newSample := func(t *testing.T) string {
+		dir, err := os.MkdirTemp("", "TestSampleSizeLimit")
+		if err != nil {
+			t.Fatalf("error creating temp dir: %v", err)
+		}
+		writeSampleFiles(t, dir, files)
+		return dir
+	}
+
+	t.Run("Ensure nothing is shed within the cap", func(t *testing.T) {
+		dir := newSample(t)
+		defer os.RemoveAll(dir)
+		config := config
+		config.MaxSampleBytes = 2000
+		l := newSampleSizeLimit(config)
+		if err := l.enforce(dir); err != nil || len(l.shed) != 0 {
+			t.Errorf("expected nothing to be shed, got %+v %v", l.shed, err)
+		}
+	})
+
+	t.Run("Ensure cadvisor metrics are shed first", func(t *testing.T) {
+		dir := newSample(t)
+		defer os.RemoveAll(dir)
+		config := config
+		config.MaxSampleBytes = 1500
+		l := newSampleSizeLimit(config)
+		if err := l.enforce(dir); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(l.shed) != 1 || l.shed[0].Class != sample.ShedCadvisor || l.shed[0].Bytes != 200 ||
+			len(l.shed[0].Files) != 2 {
+			t.Errorf("expected only cadvisor metrics to be shed, got %+v", l.shed)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "stats-prom-node0.txt")); !os.IsNotExist(err) {
+			t.Error("expected the extra cadvisor endpoint to be removed")
+		}
+	})
+
+	t.Run("Ensure kubelet pods are shed before cadvisor metrics", func(t *testing.T) {
+		dir := newSample(t)
+		defer os.RemoveAll(dir)
+		writeSampleFiles(t, dir, map[string]string{"stats-pods-node0.json": strings.Repeat("k", 300)})
+		config := config
+		config.MaxSampleBytes = 1500
+		l := newSampleSizeLimit(config)
+		if err := l.enforce(dir); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(l.shed) != 2 || l.shed[0].Class != sample.ShedKubeletPods || l.shed[0].Bytes != 300 ||
+			l.shed[1].Class != sample.ShedCadvisor {
+			t.Errorf("expected kubelet pods then cadvisor metrics to be shed, got %+v", l.shed)
+		}
+	})
+
+	t.Run("Ensure resource exports are trimmed to whole records after container stats", func(t *testing.T) {
+		dir := newSample(t)
+		defer os.RemoveAll(dir)
+		config := config
+		config.MaxSampleBytes = 1000
+		l := newSampleSizeLimit(config)
+		if err := l.enforce(dir); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(l.shed) != 3 || l.shed[1].Class != sample.ShedContainer || l.shed[2].Class != sample.ShedResources {
+			t.Fatalf("expected cadvisor, container and resources to be shed, got %+v", l.shed)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "pods"+sample.ResourceFileExtension))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 800 || !strings.HasSuffix(string(data), "\n") {
+			t.Errorf("expected 8 whole records to remain, got %d bytes", len(data))
+		}
+		if size, _ := dirSize(dir); size > 900 {
+			t.Errorf("expected the sample to be shed below 90%% of the cap, got %d bytes", size)
+		}
+	})
+
+	t.Run("Ensure a sample over the cap after shedding fails", func(t *testing.T) {
+		dir := newSample(t)
+		defer os.RemoveAll(dir)
+		config := config
+		config.MaxSampleBytes = 50
+		l := newSampleSizeLimit(config)
+		if err := l.enforce(dir); !errors.Is(err, errSampleTooLarge) {
+			t.Errorf("expected the sample to be too large, got %v", err)
+		}
+	})
+}
+
+func TestSampleSizeLimitWrites(t *testing.T) {
+	dir := t.TempDir()
+	workDir := util.NewWorkDir(dir)
+	config := KubeAgentConfig{MaxSampleBytes: 1000,
+		extraEndpoints: []ExtraEndpoint{{Name: "prom", Path: "/metrics/cadvisor"}}}
+	l := newSampleSizeLimit(config)
+	workDir.SetWriteLimit(l)
+
+	write := func(name string, size int) error {
+		t.Helper()
+		f, err := workDir.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		_, err = f.WriteString(strings.Repeat("x", size))
+		return err
+	}
+
+	if err := write("stats-summary-node0.json", 800); err != nil {
+		t.Fatalf("unexpected error writing within the cap: %v", err)
+	}
+	// the shed classes are refused once the sample approaches the cap, whether fetched or extra endpoints
+	if err := write("stats-pods-node0.json", 200); !errors.Is(err, util.ErrWriteLimited) {
+		t.Errorf("expected kubelet pods to be shed as they are written, got %v", err)
+	}
+	if err := workDir.Allow("stats-prom-node0"); !errors.Is(err, util.ErrWriteLimited) {
+		t.Errorf("expected the extra cadvisor endpoint to be shed before it is fetched, got %v", err)
+	}
+	if len(l.shed) != 2 || l.shed[0].Class != sample.ShedKubeletPods || l.shed[1].Class != sample.ShedCadvisor {
+		t.Errorf("expected kubelet pods and cadvisor metrics to be recorded as shed, got %+v", l.shed)
+	}
+	// the data that is not shed is written up to the cap
+	if err := write("stats-summary-node1.json", 150); err != nil {
+		t.Errorf("unexpected error writing within the cap: %v", err)
+	}
+	if err := write("stats-summary-node2.json", 100); !errors.Is(err, errSampleTooLarge) {
+		t.Errorf("expected a write exceeding the cap to be refused, got %v", err)
+	}
+	if size, _ := dirSize(dir); size > config.MaxSampleBytes {
+		t.Errorf("expected the sample to stay within the cap as it is written, got %d bytes", size)
+	}
+	// the final check fails the sample that was refused data it needed
+	if err := l.enforce(dir); !errors.Is(err, errSampleTooLarge) {
+		t.Errorf("expected the sample refused data to be too large, got %v", err)
+	}
+}
+
+func TestSampleSizeLimitWritesAfterEnforce(t *testing.T) {
+	dir := t.TempDir()
+	workDir := util.NewWorkDir(dir)
+	l := newSampleSizeLimit(KubeAgentConfig{MaxSampleBytes: 1000})
+	workDir.SetWriteLimit(l)
+	writeSampleFiles(t, dir, map[string]string{
+		"stats-summary-node0.json":   strings.Repeat("s", 500),
+		"stats-container-node0.json": strings.Repeat("c", 450),
+	})
+	if err := workDir.Allow("pods" + sample.ResourceFileExtension); err != nil {
+		t.Fatalf("expected the files written outside of the work dir to be measured by enforce, got %v", err)
+	}
+
+	if err := l.enforce(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// resources are exported after the node data is shed back below the cap
+	if err := workDir.Allow("pods" + sample.ResourceFileExtension); err != nil {
+		t.Errorf("expected resources to be exported once the node data is shed, got %v", err)
+	}
+	f, err := workDir.Create("pods" + sample.ResourceFileExtension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(strings.Repeat("x", 450)); !errors.Is(err, util.ErrWriteLimited) {
+		t.Errorf("expected resources past the shedding size to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,472 @@
+package kubernetes
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudability/metrics-agent/client"
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// NodeConnection describes how the agent connects to the kubelets, as established by ensureNodeSource.
+// It is not modified once built so it may be shared between concurrent collections, a new
+// NodeConnection is built whenever connectivity is re-established.
+type NodeConnection struct {
+	// NodeClient connects directly to the kubelets
+	NodeClient raw.Client
+	// InClusterClient connects to the kubelets via the API server proxy
+	InClusterClient raw.Client
+	// NodeMetrics are the connection methods available for each kubelet endpoint
+	NodeMetrics *EndpointMask
+	// NodeMetricsReasons record why a connection method is unavailable for an endpoint
+	NodeMetricsReasons EndpointReasons
+	// relay finds the stats relay pods reached via the API server pod proxy, nil unless configured
+	relay *statsRelay
+	// handshakes counts the TLS handshakes of direct kubelet connections
+	handshakes *tlsHandshakeCounter
+	// nodeMasks are the endpoints available on each node, nil if only the cluster mask is used
+	nodeMasks *nodeEndpointMasks
+	// serverNames are the hostnames kubelet serving certificates are verified for, nil if they are not
+	// verified
+	serverNames *nodeServerNames
+	// machines are the machines the nodes were listed on, to link a node rejoining under a new name
+	machines *nodeMachines
+}
+
+// AgentState is the runtime state of the agent: how it connects to the nodes, the results of the most
+// recent collection, poll timing and the limits of the upload endpoint. KubeAgentConfig is an immutable
+// snapshot once the agent is initialized, everything that changes while the agent runs lives here.
+// AgentState is safe for concurrent use.
+type AgentState struct {
+	mu                sync.RWMutex
+	nodes             NodeConnection
+	failedNodeList    map[string]error
+	nodeCapacityTypes map[CapacityType]int
+	pollOverruns      pollOverrunTracker
+	uploadLimits      client.UploadLimits
+	// secondaryUploadLimits are the limits advertised by the secondary destination of a migration
+	secondaryUploadLimits client.UploadLimits
+	// uploads are the outcomes of the metric sample uploads to each destination
+	uploads map[string]destinationUploads
+	// migrationEnded is true once the secondary destination of a migration has been dropped
+	migrationEnded bool
+	// exportVolume is the condition of the export volume, collection is paused while it is not writable
+	exportVolume exportVolume
+	// debugCaptured are the nodes listed for debug capture that were captured since they were listed
+	debugCaptured  map[string]bool
+	lastCollection lastCollection
+	// lastSampleCycleID is the cycle ID of the latest poll that kept its sample
+	lastSampleCycleID string
+	// baselineHashes are the content hashes of the node baselines kept for the next collection
+	baselineHashes map[string]string
+	nodeSizes      nodeSizeHistory
+	loadEstimate   pollLoadEstimate
+	// collections is the number of collections started since startup
+	collections int
+	// warmUpPending is true until the warm-up collection is started, if enabled
+	warmUpPending bool
+	// warmUpCompleted is when the warm-up collection ended, zero if there was none
+	warmUpCompleted time.Time
+	// sampleRate counts the poll intervals that produced a sample against those expected to
+	sampleRate sampleRate
+	// scopeChange is the change of the collection scope since the previous run, found at startup, until it
+	// marks the first sample written
+	scopeChange *sample.ScopeChange
+	// notPermitted are the resources the agent is not permitted to collect, found at startup
+	notPermitted []string
+	// snapshot is the most recently published status snapshot, read without taking mu. snapshotMu serializes
+	// the publishers.
+	snapshot   atomic.Pointer[StatusSnapshot]
+	snapshotMu sync.Mutex
+	// apiLimiter is shared by every request to the API server, nil if they are not limited. It is set at
+	// startup before the state is shared, so is read without taking mu.
+	apiLimiter flowcontrol.RateLimiter
+}
+
+// agentStatus is a copy of the agent state reported in the agent status measurement
+type agentStatus struct {
+	nodes             NodeConnection
+	failedNodeList    map[string]error
+	nodeCapacityTypes map[CapacityType]int
+	pollOverruns      pollOverrunTracker
+	uploadLimits      client.UploadLimits
+	// uploads are the outcomes of the metric sample uploads to each destination since startup
+	uploads map[string]destinationUploads
+	// unchangedNodeFiles is the number of node files replaced by an unchanged marker this collection
+	unchangedNodeFiles int
+	// deferredNodes is the number of nodes deferred to a later collection by the node cap this collection
+	deferredNodes int
+	// nodeSizes is the node data size history including this collection
+	nodeSizes nodeSizeHistory
+	// lateAddedNodes are the nodes collected late this collection as they joined the cluster during it
+	lateAddedNodes []string
+	// sampleShedBytes is the size of the data shed to keep this collection within the sample size cap
+	sampleShedBytes int64
+	// nodeFetchPace is the time between node fetches this collection, 0 if they were not paced
+	nodeFetchPace time.Duration
+	// clusterSummary is computed from the resource exports of this collection
+	clusterSummary sample.ClusterSummary
+	// loadEstimate is the estimated load of a poll as of this collection
+	loadEstimate pollLoadEstimate
+	// freshnessSpread is the time between the earliest and latest data collected for this collection
+	freshnessSpread time.Duration
+	// seriesTruncations are the metric families truncated to the series limit this collection
+	seriesTruncations []sample.SeriesTruncation
+	// disabledEndpoints are the node endpoints disabled this collection
+	disabledEndpoints []sample.DisabledEndpoint
+	// debugCaptures are the nodes whose data was retained for debugging this collection
+	debugCaptures []sample.DebugCapture
+	// tlsHandshakes and tlsResumedHandshakes are the full and resumed TLS handshakes of direct kubelet
+	// connections this collection
+	tlsHandshakes        int64
+	tlsResumedHandshakes int64
+	// warmUpCompleted is when the warm-up collection ended, zero if there was none
+	warmUpCompleted time.Time
+	// exportVolume is the condition of the export volume as of the most recent probe
+	exportVolume exportVolume
+	// sampleRate is the sample rate as of the previous poll interval
+	sampleRate sampleRate
+	// notPermitted are the resources the agent is not permitted to collect
+	notPermitted []string
+	// cycleID is the cycle ID of the poll of this collection
+	cycleID string
+}
+
+func newAgentState(config KubeAgentConfig, nodes NodeConnection) *AgentState {
+	return &AgentState{
+		nodes:         nodes,
+		warmUpPending: config.WarmUp,
+		pollOverruns:  newPollOverrunTracker(config.PollOverrunThreshold, config.PollRecoveryThreshold),
+	}
+}
+
+// Nodes returns the current node connection
+func (s *AgentState) Nodes() NodeConnection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.nodes
+}
+
+// updateEndpoints updates the endpoints available on the nodes to those of the probed connection, and
+// returns the transitions. The mask is updated in place as it is shared with collections in progress.
+func (s *AgentState) updateEndpoints(probed NodeConnection) []endpointTransition {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transitions := endpointTransitions(s.nodes.NodeMetrics, probed.NodeMetrics)
+	if len(transitions) == 0 {
+		return nil
+	}
+	s.nodes.NodeMetrics.replace(probed.NodeMetrics)
+	// the reasons may be read by a collection in progress, so are replaced rather than updated
+	s.nodes.NodeMetricsReasons = probed.NodeMetricsReasons
+	// the node masks were derived from the previous endpoints
+	s.nodes.nodeMasks.reset()
+	return transitions
+}
+
+// DegradationLevel returns the current collection degradation level
+func (s *AgentState) DegradationLevel() DegradationLevel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pollOverruns.level
+}
+
+// UploadLimits returns the limits advertised by the upload endpoint
+func (s *AgentState) UploadLimits() client.UploadLimits {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.uploadLimits
+}
+
+func (s *AgentState) setUploadLimits(limits client.UploadLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploadLimits = limits
+}
+
+// destinationLimits returns the limits advertised by an upload destination
+func (s *AgentState) destinationLimits(destination string) client.UploadLimits {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if destination == SecondaryDestination {
+		return s.secondaryUploadLimits
+	}
+	return s.uploadLimits
+}
+
+func (s *AgentState) setDestinationLimits(destination string, limits client.UploadLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if destination == SecondaryDestination {
+		s.secondaryUploadLimits = limits
+		return
+	}
+	s.uploadLimits = limits
+}
+
+// destinationUploads counts the metric sample uploads to an upload destination
+type destinationUploads struct {
+	succeeded   int
+	failed      int
+	lastSuccess time.Time
+	lastError   string
+}
+
+// recordUpload records the outcome of a metric sample upload to a destination
+func (s *AgentState) recordUpload(destination string, err error, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uploads == nil {
+		s.uploads = map[string]destinationUploads{}
+	}
+	u := s.uploads[destination]
+	if err != nil {
+		u.failed++
+		u.lastError = err.Error()
+	} else {
+		u.succeeded++
+		u.lastSuccess = at
+	}
+	s.uploads[destination] = u
+}
+
+func copyDestinationUploads(uploads map[string]destinationUploads) map[string]destinationUploads {
+	copied := make(map[string]destinationUploads, len(uploads))
+	for d, u := range uploads {
+		copied[d] = u
+	}
+	return copied
+}
+
+// endMigration records that the secondary destination of a migration was dropped, and returns true the
+// first time it is called
+func (s *AgentState) endMigration() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ended := s.migrationEnded
+	s.migrationEnded = true
+	return !ended
+}
+
+// exportVolumeUnwritable records that the export volume can not be written to as err revealed, returning
+// its condition and true if the outage started with this call
+func (s *AgentState) exportVolumeUnwritable(condition string, err error, now time.Time) (exportVolume, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started := s.exportVolume.condition == ""
+	if started {
+		s.exportVolume.since = now
+	}
+	s.exportVolume.condition = condition
+	s.exportVolume.lastError = err.Error()
+	return s.exportVolume, started
+}
+
+// recoverExportVolume records that the export volume is writable, returning the outage it recovered from
+// and true if it was not writable
+func (s *AgentState) recoverExportVolume(now time.Time) (exportVolume, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exportVolume.condition == "" {
+		return exportVolume{}, false
+	}
+	outage := s.exportVolume
+	s.exportVolume = exportVolume{recovered: now, recoveredFrom: outage.condition}
+	return outage, true
+}
+
+// pendingDebugCaptures returns the listed nodes not captured since they were listed. The nodes no longer
+// listed are forgotten, so are captured again once listed anew.
+func (s *AgentState) pendingDebugCaptures(listed []string) map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	captured := map[string]bool{}
+	pending := map[string]bool{}
+	for _, nodeName := range listed {
+		if s.debugCaptured[nodeName] {
+			captured[nodeName] = true
+		} else {
+			pending[nodeName] = true
+		}
+	}
+	s.debugCaptured = captured
+	return pending
+}
+
+// recordDebugCapture records that a listed node was captured, so it is not captured again while listed
+func (s *AgentState) recordDebugCapture(nodeName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.debugCaptured == nil {
+		s.debugCaptured = map[string]bool{}
+	}
+	s.debugCaptured[nodeName] = true
+}
+
+// recordPoll tracks the duration of a completed poll and returns true if the poll overran the interval
+func (s *AgentState) recordPoll(duration, interval time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pollOverruns.record(duration, interval)
+}
+
+// recordFailedNodes replaces the nodes that failed to be collected with those of the latest collection
+func (s *AgentState) recordFailedNodes(failedNodeList map[string]error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failedNodeList = failedNodeList
+}
+
+// recordNodeCapacityTypes replaces the node capacity type counts with those of the latest collection
+func (s *AgentState) recordNodeCapacityTypes(nodeCapacityTypes map[CapacityType]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodeCapacityTypes = nodeCapacityTypes
+}
+
+// recordCollection replaces the most recent successful collection and returns the one it replaced
+func (s *AgentState) recordCollection(c lastCollection) lastCollection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.lastCollection
+	s.lastCollection = c
+	return previous
+}
+
+// recordSampleCycleID records the cycle ID of a poll that kept its sample
+func (s *AgentState) recordSampleCycleID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSampleCycleID = id
+}
+
+// recordScopeChange records the change of the collection scope found at startup, nil if there is none
+func (s *AgentState) recordScopeChange(change *sample.ScopeChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scopeChange = change
+}
+
+// takeScopeChange returns the scope change once, for the first sample written, nil after or if there is none
+func (s *AgentState) takeScopeChange() *sample.ScopeChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change := s.scopeChange
+	s.scopeChange = nil
+	return change
+}
+
+// recordNotPermitted records the resources the agent is not permitted to collect
+func (s *AgentState) recordNotPermitted(resources []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notPermitted = resources
+}
+
+// LastSampleCycleID returns the cycle ID of the latest poll that kept its sample, empty if none has
+func (s *AgentState) LastSampleCycleID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastSampleCycleID
+}
+
+// swapBaselineHashes replaces the content hashes of the node baselines and returns those it replaced
+func (s *AgentState) swapBaselineHashes(hashes map[string]string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.baselineHashes
+	s.baselineHashes = hashes
+	return previous
+}
+
+// recordNodeSizes adds the node data sizes of the latest collection to the history and returns the
+// updated history and the node sources whose size spiked
+func (s *AgentState) recordNodeSizes(sizes map[nodeSourceKey]int64, factor float64) (nodeSizeHistory,
+	[]nodeSizeSpike) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var spikes []nodeSizeSpike
+	s.nodeSizes, spikes = s.nodeSizes.record(sizes, factor)
+	return s.nodeSizes, spikes
+}
+
+// LoadEstimate returns the latest estimate of the load of a poll
+func (s *AgentState) LoadEstimate() pollLoadEstimate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.loadEstimate
+}
+
+func (s *AgentState) recordLoadEstimate(e pollLoadEstimate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loadEstimate = e
+}
+
+// startCollection records the start of a collection, returning its index since startup
+func (s *AgentState) startCollection() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collections++
+	return s.collections - 1
+}
+
+// startWarmUp returns true if the next collection is the warm-up collection, only once
+func (s *AgentState) startWarmUp() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.warmUpPending
+	s.warmUpPending = false
+	return pending
+}
+
+func (s *AgentState) recordWarmUp(completed time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.warmUpCompleted = completed
+}
+
+func (s *AgentState) restoreSampleRate(r sampleRate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sampleRate = r
+}
+
+// recordInterval accounts for a poll interval in the sample rate, returning the updated sample rate and the
+// intervals recorded
+func (s *AgentState) recordInterval(now time.Time, interval time.Duration, outcome, reason string) (sampleRate,
+	[]intervalRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	added := s.sampleRate.record(now, interval, outcome, reason)
+	return s.sampleRate, added
+}
+
+// pauseInterval accounts for a poll interval that is not expected to produce a sample
+func (s *AgentState) pauseInterval(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sampleRate.pause(now)
+}
+
+// status returns a copy of the state for the agent status measurement. The recorded maps are replaced
+// rather than modified so are safe to share.
+func (s *AgentState) status() agentStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return agentStatus{
+		nodes:             s.nodes,
+		failedNodeList:    s.failedNodeList,
+		nodeCapacityTypes: s.nodeCapacityTypes,
+		pollOverruns:      s.pollOverruns,
+		uploadLimits:      s.uploadLimits,
+		uploads:           copyDestinationUploads(s.uploads),
+		warmUpCompleted:   s.warmUpCompleted,
+		exportVolume:      s.exportVolume,
+		sampleRate:        s.sampleRate,
+		notPermitted:      s.notPermitted,
+	}
+}
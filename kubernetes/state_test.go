@@ -0,0 +1,128 @@
+package kubernetes
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/client"
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// TestAgentStateConcurrentCollections runs collections that share an AgentState at the same time as the
+// state is updated, run with -race to detect unsynchronized access
+func TestAgentStateConcurrentCollections(t *testing.T) {
+	ts := NewTestServer()
+	defer ts.Close()
+
+	ready := v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}}
+	cs := fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node0"}, Spec: v1.NodeSpec{ProviderID: "aws:///node0"},
+			Status: ready},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}, Status: ready},
+	)
+	sv, err := cs.Discovery().ServerVersion()
+	if err != nil {
+		t.Fatalf("Error getting server version: %v", err)
+	}
+
+	root, err := os.MkdirTemp("", "TestAgentStateConcurrentCollections")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informers, err := getMockInformers(1.22, stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := KubeAgentConfig{
+		ClusterVersion:        ClusterVersion{version: 1.22, versionInfo: sv},
+		Clientset:             cs,
+		HTTPClient:            http.Client{},
+		ClusterHostURL:        ts.URL,
+		Insecure:              true,
+		ConcurrentPollers:     2,
+		Informers:             informers,
+		PollOverrunThreshold:  1,
+		PollRecoveryThreshold: 1,
+	}
+	nodes := NodeConnection{
+		InClusterClient:    raw.NewClient(http.Client{}, true, nil, 0, false),
+		NodeMetrics:        NewEndpointMask(),
+		NodeMetricsReasons: EndpointReasons{},
+	}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	state := newAgentState(config, nodes)
+	fns := NewClientsetNodeSource(cs)
+
+	// each collection has its own export directory so only the agent state is shared
+	const cycles = 4
+	exportDirs := make([]string, cycles)
+	for i := range exportDirs {
+		exportDirs[i] = filepath.Join(root, strconv.Itoa(i), "export")
+		if err := os.MkdirAll(exportDirs[i], os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, cycles)
+	for i, dir := range exportDirs {
+		exportDir, err := os.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer exportDir.Close()
+		cycleConfig := config
+		cycleConfig.msExportDirectory = exportDir
+
+		wg.Add(2)
+		go func(c KubeAgentConfig) {
+			defer wg.Done()
+			levelConfig, cycle := state.DegradationLevel().apply(c)
+			errs <- c.collectMetrics(context.TODO(), levelConfig, cycle, state, cs, fns)
+		}(cycleConfig)
+		go func(i int) {
+			defer wg.Done()
+			state.recordPoll(time.Duration(i%2)*time.Minute, time.Second)
+			state.setUploadLimits(client.UploadLimits{MaxPayloadBytes: int64(i)})
+			_ = state.UploadLimits()
+			_ = state.Nodes()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected collection error: %v", err)
+		}
+	}
+
+	status := state.status()
+	if _, ok := status.failedNodeList["node1"]; !ok || len(status.failedNodeList) != 1 {
+		t.Errorf("expected node1 to be recorded as failed, got %v", status.failedNodeList)
+	}
+	if status.pollOverruns.totalOverruns != cycles/2 {
+		t.Errorf("expected %d poll overruns, got %d", cycles/2, status.pollOverruns.totalOverruns)
+	}
+	for _, dir := range exportDirs {
+		matches, err := filepath.Glob(filepath.Join(dir, "*", "*", sample.AgentMeasurementFile))
+		if err != nil || len(matches) != 1 {
+			t.Errorf("expected one agent measurement in %s, got %v: %v", dir, matches, err)
+		}
+	}
+}
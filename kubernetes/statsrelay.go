@@ -0,0 +1,177 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultStatsRelayPort is the default port of the stats relay pods, 0 lets the API server choose the port
+const DefaultStatsRelayPort = 0
+
+// statsRelay finds the pods of a stats relay DaemonSet, which serve the kubelet endpoints of the node they
+// run on, for clusters that forbid nodes/proxy but permit pods/proxy. statsRelay is safe for concurrent use.
+type statsRelay struct {
+	clientset kubernetes.Interface
+	namespace string
+	selector  string
+	port      int
+
+	mu sync.RWMutex
+	// pods maps each node name to the relay pod running on it
+	pods map[string]string
+}
+
+// newStatsRelay returns the stats relay configured, or nil if no stats relay is configured
+func newStatsRelay(config KubeAgentConfig) *statsRelay {
+	if config.StatsRelaySelector == "" {
+		return nil
+	}
+	namespace := config.StatsRelayNamespace
+	if namespace == "" {
+		namespace = config.Namespace
+	}
+	return &statsRelay{
+		clientset: config.Clientset,
+		namespace: namespace,
+		selector:  config.StatsRelaySelector,
+		port:      config.StatsRelayPort,
+	}
+}
+
+// refresh lists the relay pods and maps each node to the ready relay pod running on it. Relay pods are
+// replaced as the DaemonSet is updated, so the mapping is refreshed before each collection.
+func (r *statsRelay) refresh(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	pods, err := r.clientset.CoreV1().Pods(r.namespace).List(ctx, metav1.ListOptions{LabelSelector: r.selector})
+	if err != nil {
+		return fmt.Errorf("unable to list stats relay pods in namespace %s with selector %s: %v", r.namespace,
+			r.selector, err)
+	}
+	// pods are considered in name order so a node running several relay pods is mapped consistently
+	sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Name < pods.Items[j].Name })
+	mapped := make(map[string]string, len(pods.Items))
+	for _, p := range pods.Items {
+		if _, ok := mapped[p.Spec.NodeName]; ok || !relayPodReady(p) {
+			continue
+		}
+		mapped[p.Spec.NodeName] = p.Name
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pods = mapped
+	return nil
+}
+
+// refreshStatsRelay refreshes the relay pods of the node connection, keeping the previous mapping if the
+// relay pods can not be listed
+func refreshStatsRelay(ctx context.Context, nodes NodeConnection) {
+	if err := nodes.relay.refresh(ctx); err != nil {
+		log.Warnf("Warning: %s", err)
+	}
+}
+
+// podFor returns the relay pod running on the node
+func (r *statsRelay) podFor(nodeName string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	pod, ok := r.pods[nodeName]
+	return pod, ok
+}
+
+// api returns the pod proxy api of the relay pod running on the node
+func (r *statsRelay) api(clusterHostURL, nodeName string) (podProxyAPI, bool) {
+	pod, ok := r.podFor(nodeName)
+	if !ok {
+		return podProxyAPI{}, false
+	}
+	if r.port > 0 {
+		pod = fmt.Sprintf("%s:%d", pod, r.port)
+	}
+	return podProxyAPI{clusterHostURL: clusterHostURL, namespace: r.namespace, pod: pod}, true
+}
+
+// relayPodReady returns true if the relay pod is scheduled, running and ready
+func relayPodReady(p v1.Pod) bool {
+	if p.Spec.NodeName == "" || p.DeletionTimestamp != nil || p.Status.Phase != v1.PodRunning {
+		return false
+	}
+	for _, c := range p.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podProxyAPI reaches the kubelet endpoints served by a stats relay pod via the API server pod proxy
+type podProxyAPI struct {
+	clusterHostURL string
+	namespace      string
+	// pod is the relay pod name, with its port if configured
+	pod string
+}
+
+// statsSummary formats the pod proxy stats/summary endpoint of the relay pod
+func (p podProxyAPI) statsSummary() string {
+	return p.path("/stats/summary")
+}
+
+// statsContainer formats the pod proxy stats/container endpoint of the relay pod
+func (p podProxyAPI) statsContainer() string {
+	return p.path("/stats/container/")
+}
+
+// mCAdvisor formats the pod proxy metrics/cadvisor endpoint of the relay pod
+func (p podProxyAPI) mCAdvisor() string {
+	return p.path("/metrics/cadvisor")
+}
+
+// metricsResource formats the pod proxy metrics/resource endpoint of the relay pod
+func (p podProxyAPI) metricsResource() string {
+	return p.path("/metrics/resource")
+}
+
+// metricsProbes formats the pod proxy metrics/probes endpoint of the relay pod
+func (p podProxyAPI) metricsProbes() string {
+	return p.path("/metrics/probes")
+}
+
+// statsPods formats the pod proxy pods endpoint of the relay pod
+func (p podProxyAPI) statsPods() string {
+	return p.path("/pods")
+}
+
+// spec formats the pod proxy spec endpoint of the relay pod
+func (p podProxyAPI) spec() string {
+	return p.path("/spec/")
+}
+
+// configz formats the pod proxy configz endpoint of the relay pod
+func (p podProxyAPI) configz() string {
+	return p.path("/configz")
+}
+
+// kubeletMetrics formats the pod proxy metrics endpoint of the relay pod
+func (p podProxyAPI) kubeletMetrics() string {
+	return p.path("/metrics")
+}
+
+// path formats the pod proxy endpoint of the relay pod for an arbitrary kubelet path
+func (p podProxyAPI) path(kubeletPath string) string {
+	return fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/proxy%s", p.clusterHostURL, url.PathEscape(p.namespace),
+		url.PathEscape(p.pod), kubeletPath)
+}
@@ -0,0 +1,139 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func relayPod(name, nodeName string, ready bool) *v1.Pod {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "cloudability", Labels: map[string]string{"app": "relay"}},
+		Spec:       v1.PodSpec{NodeName: nodeName},
+		Status: v1.PodStatus{
+			Phase:      v1.PodRunning,
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestStatsRelayRefresh(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		relayPod("relay-b", "node0", true),
+		relayPod("relay-a", "node0", true),
+		relayPod("relay-c", "node1", false),
+		relayPod("relay-d", "", true),
+	)
+	unrelated := relayPod("other", "node2", true)
+	unrelated.Labels = nil
+	if _, err := clientset.CoreV1().Pods("cloudability").Create(context.TODO(), unrelated,
+		metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if newStatsRelay(KubeAgentConfig{Clientset: clientset}) != nil {
+		t.Fatal("expected no stats relay unless a selector is configured")
+	}
+	relay := newStatsRelay(KubeAgentConfig{
+		Clientset:          clientset,
+		Namespace:          "cloudability",
+		StatsRelaySelector: "app=relay",
+		StatsRelayPort:     8080,
+	})
+	if err := relay.refresh(context.TODO()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Run("Ensure each node is mapped to a single ready relay pod", func(t *testing.T) {
+		if pod, ok := relay.podFor("node0"); !ok || pod != "relay-a" {
+			t.Errorf("expected node0 to be mapped to relay-a, got %q", pod)
+		}
+		for _, node := range []string{"node1", "node2", ""} {
+			if pod, ok := relay.podFor(node); ok {
+				t.Errorf("expected %q not to be mapped, got %q", node, pod)
+			}
+		}
+	})
+
+	t.Run("Ensure the relay pod is reached via the pod proxy on its port", func(t *testing.T) {
+		api, ok := relay.api("https://apiserver", "node0")
+		if !ok {
+			t.Fatal("expected a relay api for node0")
+		}
+		expected := "https://apiserver/api/v1/namespaces/cloudability/pods/relay-a:8080/proxy/stats/summary"
+		if api.statsSummary() != expected {
+			t.Errorf("expected %s, got %s", expected, api.statsSummary())
+		}
+	})
+}
+
+func TestRetrieveNodeDataStatsRelay(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"node":{"nodeName":"node0"}}`)
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestRetrieveNodeDataStatsRelay")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	config := KubeAgentConfig{
+		ClusterHostURL:     ts.URL,
+		ForceKubeProxy:     true,
+		Clientset:          fake.NewSimpleClientset(relayPod("relay-a", "node0", true)),
+		Namespace:          "cloudability",
+		StatsRelaySelector: "app=relay",
+	}
+	nodes := NodeConnection{
+		InClusterClient: raw.NewClient(http.Client{}, true, nil, 0, false),
+		NodeMetrics:     NewEndpointMask(),
+		relay:           newStatsRelay(config),
+	}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, PodProxy, true)
+	refreshStatsRelay(context.TODO(), nodes)
+
+	n := v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node0"}}
+	nd := nodeFetchData{nodeName: "node0", prefix: sample.StatsPrefix, workDir: workDir}
+	if err := retrieveNodeData(context.TODO(), nd, config, pollCycle{}, nodes, testNodeSource{}, n); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(paths) != 1 || paths[0] != "/api/v1/namespaces/cloudability/pods/relay-a/proxy/stats/summary" {
+		t.Errorf("expected the summary to be requested from the relay pod, got %v", paths)
+	}
+	summary := sample.NodeSourceName(sample.StatsPrefix, sample.SummarySource, "node0") + ".json"
+	if _, err := os.Stat(filepath.Join(dir, summary)); err != nil {
+		t.Errorf("expected the summary to be written: %v", err)
+	}
+
+	t.Run("Ensure a node without a relay pod is not collected via the relay", func(t *testing.T) {
+		other := nd
+		other.nodeName = "node1"
+		n := v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+		for _, cm := range connectionOptions(config, nodes, n, other, testNodeSource{}) {
+			if cm.ConnType == PodProxy {
+				t.Error("expected no stats relay connection for node1")
+			}
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package kubernetes
+
+import (
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+)
+
+// points of a collection a status snapshot is published at
+const (
+	// SnapshotCycleStart is published as a collection starts, with the node outcomes of the previous one
+	SnapshotCycleStart = "cycle_start"
+	// SnapshotNodesCollected is published once the nodes of a collection were fetched
+	SnapshotNodesCollected = "nodes_collected"
+	// SnapshotUploaded is published once a metric sample was uploaded to every destination
+	SnapshotUploaded = "uploaded"
+)
+
+// StatusSnapshot is the status of the agent published at defined points of each collection, so the node
+// outcomes can be read while a collection is in progress without racing it. A published snapshot is never
+// modified, a later one replaces it.
+type StatusSnapshot struct {
+	// Generated is when the snapshot was published, so consumers can tell a stale snapshot apart
+	Generated time.Time
+	// Phase is the point of the collection the snapshot was published at
+	Phase string
+	// Collection is the index since startup of the most recent collection
+	Collection int
+	// SampleStart is the start time of the most recent collection
+	SampleStart time.Time
+	// Nodes are the conditions and collection outcome of the nodes listed by the most recent node phase
+	Nodes []sample.NodeHealth
+	// FailedNodes is the number of nodes that failed to be collected by the most recent node phase
+	FailedNodes int
+	// DegradationLevel is the degradation level of the most recent collection
+	DegradationLevel string
+	// Uploads are the outcomes of the metric sample uploads to each destination since startup
+	Uploads map[string]UploadOutcome
+}
+
+// UploadOutcome counts the metric sample uploads to a destination
+type UploadOutcome struct {
+	Succeeded   int
+	Failed      int
+	LastSuccess time.Time
+	LastError   string
+}
+
+// StatusSnapshot returns the most recently published status snapshot, nil until the first is published. It
+// does not take the lock of the state, so it never waits for a collection.
+func (s *AgentState) StatusSnapshot() *StatusSnapshot {
+	return s.snapshot.Load()
+}
+
+// publishSnapshot publishes a snapshot at now for the phase, derived from the current snapshot by update.
+// update must replace rather than modify the slices and maps of the snapshot, as they are shared with the
+// snapshot it replaces.
+func (s *AgentState) publishSnapshot(phase string, now time.Time, update func(*StatusSnapshot)) {
+	// publishers are serialized so no update is lost, readers never wait for them
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+	var next StatusSnapshot
+	if current := s.snapshot.Load(); current != nil {
+		next = *current
+	}
+	next.Generated, next.Phase = now.UTC(), phase
+	update(&next)
+	s.snapshot.Store(&next)
+}
+
+// publishCycleStart publishes the snapshot of a collection starting
+func (s *AgentState) publishCycleStart(cycle pollCycle, sampleStart time.Time) {
+	s.publishSnapshot(SnapshotCycleStart, time.Now(), func(snapshot *StatusSnapshot) {
+		snapshot.Collection = cycle.collection
+		snapshot.SampleStart = sampleStart
+		snapshot.DegradationLevel = s.DegradationLevel().String()
+	})
+}
+
+// publishNodesCollected publishes the snapshot of the node phase of a collection
+func (s *AgentState) publishNodesCollected(health *nodeHealthSnapshot, failed map[string]error) {
+	nodes := health.report(failed)
+	s.publishSnapshot(SnapshotNodesCollected, time.Now(), func(snapshot *StatusSnapshot) {
+		snapshot.Nodes = nodes
+		snapshot.FailedNodes = len(failed)
+	})
+}
+
+// publishUploaded publishes the snapshot of a metric sample uploaded
+func (s *AgentState) publishUploaded() {
+	status := s.status()
+	uploads := make(map[string]UploadOutcome, len(status.uploads))
+	for d, u := range status.uploads {
+		uploads[d] = UploadOutcome{Succeeded: u.succeeded, Failed: u.failed, LastSuccess: u.lastSuccess,
+			LastError: u.lastError}
+	}
+	s.publishSnapshot(SnapshotUploaded, time.Now(), func(snapshot *StatusSnapshot) {
+		snapshot.Uploads = uploads
+	})
+}
@@ -0,0 +1,112 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestStatusSnapshot(t *testing.T) {
+	t.Run("Ensure each phase publishes a new snapshot carried over from the previous one", func(t *testing.T) {
+		state := newAgentState(KubeAgentConfig{}, NodeConnection{})
+		if snapshot := state.StatusSnapshot(); snapshot != nil {
+			t.Fatalf("expected no snapshot before the first is published, got %+v", snapshot)
+		}
+		start := time.Now()
+		state.publishCycleStart(pollCycle{collection: 3}, start)
+		started := state.StatusSnapshot()
+		if started.Phase != SnapshotCycleStart || started.Collection != 3 || !started.SampleStart.Equal(start) ||
+			started.Generated.Before(start.UTC().Add(-time.Second)) {
+			t.Errorf("unexpected cycle start snapshot %+v", started)
+		}
+
+		health := newNodeHealthSnapshot()
+		health.record([]v1.Node{addressedNode("node0", "10.0.0.1"), addressedNode("node1", "10.0.0.2")})
+		state.publishNodesCollected(health, map[string]error{"node0": errors.New("refused")})
+		collected := state.StatusSnapshot()
+		if collected.Phase != SnapshotNodesCollected || collected.FailedNodes != 1 || len(collected.Nodes) != 2 ||
+			collected.Collection != 3 || collected.Generated.Before(started.Generated) {
+			t.Errorf("unexpected nodes collected snapshot %+v", collected)
+		}
+		if started.Phase != SnapshotCycleStart || started.Nodes != nil {
+			t.Errorf("expected the published snapshot to be left unchanged, got %+v", started)
+		}
+
+		state.recordUpload("cloudability", nil, time.Now())
+		state.publishUploaded()
+		uploaded := state.StatusSnapshot()
+		if uploaded.Phase != SnapshotUploaded || uploaded.Uploads["cloudability"].Succeeded != 1 ||
+			len(uploaded.Nodes) != 2 {
+			t.Errorf("unexpected uploaded snapshot %+v", uploaded)
+		}
+	})
+
+	t.Run("Ensure snapshots are read without racing the collections publishing them", func(t *testing.T) {
+		state := newAgentState(KubeAgentConfig{}, NodeConnection{})
+		done := make(chan struct{})
+		var readers sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				var last time.Time
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					snapshot := state.StatusSnapshot()
+					if snapshot == nil {
+						continue
+					}
+					if snapshot.Generated.Before(last) {
+						t.Errorf("expected snapshots to be published in order, got %v after %v", snapshot.Generated, last)
+					}
+					last = snapshot.Generated
+					var collected int
+					for _, n := range snapshot.Nodes {
+						if n.Outcome == sample.NodeCollected {
+							collected++
+						}
+					}
+					if collected+snapshot.FailedNodes != len(snapshot.Nodes) {
+						t.Errorf("expected a consistent snapshot, got %+v", snapshot)
+					}
+					for d, u := range snapshot.Uploads {
+						if u.Succeeded+u.Failed == 0 {
+							t.Errorf("expected only destinations uploaded to, got %s", d)
+						}
+					}
+				}
+			}()
+		}
+		for c := 0; c < 200; c++ {
+			state.publishCycleStart(pollCycle{collection: c}, time.Now())
+			health := newNodeHealthSnapshot()
+			nodes, failed := make([]v1.Node, 0, 5), map[string]error{}
+			for n := 0; n < 5; n++ {
+				name := fmt.Sprintf("node%d", n)
+				nodes = append(nodes, addressedNode(name, "10.0.0.1"))
+				if (c+n)%3 == 0 {
+					failed[name] = errors.New("refused")
+				}
+			}
+			health.record(nodes)
+			state.publishNodesCollected(health, failed)
+			state.recordUpload("cloudability", nil, time.Now())
+			state.publishUploaded()
+		}
+		close(done)
+		readers.Wait()
+		snapshot := state.StatusSnapshot()
+		if snapshot.Collection != 199 || snapshot.Uploads["cloudability"].Succeeded != 200 {
+			t.Errorf("unexpected final snapshot %+v", snapshot)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package kubernetes
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// nodeTLSSessionCacheSize is the number of kubelet TLS sessions cached for resumption, one per node of the
+// largest supported cluster
+const nodeTLSSessionCacheSize = 5000
+
+// nodeIdleConnMargin is how much longer than the poll interval idle kubelet connections are kept open by
+// default, so they survive until the next poll
+const nodeIdleConnMargin = 30 * time.Second
+
+// tlsHandshakeCounter counts the TLS handshakes made to the kubelets, and how many of them resumed a
+// cached session rather than performing a full handshake. It is safe for concurrent use.
+type tlsHandshakeCounter struct {
+	full    int64
+	resumed int64
+}
+
+// verify counts a completed handshake, it is used as the VerifyConnection callback of the node TLS config
+func (c *tlsHandshakeCounter) verify(cs tls.ConnectionState) error {
+	if cs.DidResume {
+		atomic.AddInt64(&c.resumed, 1)
+	} else {
+		atomic.AddInt64(&c.full, 1)
+	}
+	return nil
+}
+
+// take returns the full and resumed handshakes counted since it was last called
+func (c *tlsHandshakeCounter) take() (full, resumed int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.SwapInt64(&c.full, 0), atomic.SwapInt64(&c.resumed, 0)
+}
+
+// nodeIdleConnTimeout returns how long idle kubelet connections are kept open, by default long enough to
+// be reused by the next poll
+func nodeIdleConnTimeout(config KubeAgentConfig) time.Duration {
+	if config.NodeIdleConnTimeout > 0 {
+		return time.Duration(config.NodeIdleConnTimeout) * time.Second
+	}
+	return time.Duration(config.PollInterval)*time.Second + nodeIdleConnMargin
+}
+
+// newNodeTransport returns the transport of direct kubelet connections. TLS sessions are cached so that
+// connections closed between polls are resumed rather than renegotiated, and handshakes are counted. The
+// configured kubelet TLS settings are applied.
+func newNodeTransport(config KubeAgentConfig, handshakes *tlsHandshakeCounter) *http.Transport {
+	tlsConfig := &tls.Config{
+		// nolint gosec
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(nodeTLSSessionCacheSize),
+		VerifyConnection:   handshakes.verify,
+	}
+	config.nodeTLS.apply(tlsConfig)
+	return &http.Transport{
+		TLSClientConfig: tlsConfig,
+		// each node is a separate host, so without a cap an idle connection is kept open to every node
+		MaxIdleConns:    config.ConcurrentPollers,
+		IdleConnTimeout: nodeIdleConnTimeout(config),
+	}
+}
@@ -0,0 +1,70 @@
+package kubernetes
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNodeTransportSessionResumption(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "{}")
+	}))
+	defer ts.Close()
+
+	handshakes := &tlsHandshakeCounter{}
+	transport := newNodeTransport(KubeAgentConfig{ConcurrentPollers: 1, PollInterval: 180}, handshakes)
+	client := http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		// as if the connection was closed between polls
+		transport.CloseIdleConnections()
+	}
+	if full, resumed := handshakes.take(); full != 1 || resumed != 2 {
+		t.Errorf("expected 1 full and 2 resumed handshakes, got %d and %d", full, resumed)
+	}
+	if full, resumed := handshakes.take(); full != 0 || resumed != 0 {
+		t.Errorf("expected the counts to be reset once taken, got %d and %d", full, resumed)
+	}
+	if full, resumed := (*tlsHandshakeCounter)(nil).take(); full != 0 || resumed != 0 {
+		t.Errorf("expected no handshakes without a counter, got %d and %d", full, resumed)
+	}
+}
+
+func TestNodeIdleConnTimeout(t *testing.T) {
+	if d := nodeIdleConnTimeout(KubeAgentConfig{PollInterval: 180}); d != 210*time.Second {
+		t.Errorf("expected idle connections to outlast the poll interval, got %v", d)
+	}
+	if d := nodeIdleConnTimeout(KubeAgentConfig{PollInterval: 180, NodeIdleConnTimeout: 60}); d != time.Minute {
+		t.Errorf("expected the configured idle timeout, got %v", d)
+	}
+}
+
+func TestPathCredentialsSessionCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestPathCredentialsSessionCache")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeClientCert(t, dir)
+
+	transport := newNodeTransport(KubeAgentConfig{}, &tlsHandshakeCounter{})
+	client, _, err := PathCredentials{CertFile: certFile, KeyFile: keyFile}.apply(direct,
+		http.Client{Transport: transport}, nil, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	applied := client.Transport.(*http.Transport).TLSClientConfig
+	if applied.ClientSessionCache == nil || applied.ClientSessionCache == transport.TLSClientConfig.ClientSessionCache {
+		t.Error("expected sessions of the client certificate to be cached separately")
+	}
+}
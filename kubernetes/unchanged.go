@@ -0,0 +1,108 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cloudability/metrics-agent/sample"
+	log "github.com/sirupsen/logrus"
+)
+
+// nodeDataHashes are the content hashes of the node data downloaded in a collection keyed by file name,
+// it is safe for concurrent use
+type nodeDataHashes struct {
+	mu     sync.Mutex
+	hashes map[string]string
+	// written are the hashes of all node data written, including data with no baseline
+	written map[string]string
+}
+
+func newNodeDataHashes() *nodeDataHashes {
+	return &nodeDataHashes{hashes: make(map[string]string), written: make(map[string]string)}
+}
+
+// record records the hash of node data that has a baseline, so may be replaced when unchanged
+func (h *nodeDataHashes) record(filename, hash string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hashes[filepath.Base(filename)] = hash
+	h.written[filepath.Base(filename)] = hash
+}
+
+// recordWritten records the hash of node data that has no baseline, it is only listed in the manifest
+func (h *nodeDataHashes) recordWritten(filename, hash string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.written[filepath.Base(filename)] = hash
+}
+
+// all returns a copy of the recorded hashes of node data that has a baseline
+func (h *nodeDataHashes) all() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return copyHashes(h.hashes)
+}
+
+// allWritten returns a copy of the recorded hashes of all node data written
+func (h *nodeDataHashes) allWritten() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return copyHashes(h.written)
+}
+
+func copyHashes(hashes map[string]string) map[string]string {
+	c := make(map[string]string, len(hashes))
+	for name, hash := range hashes {
+		c[name] = hash
+	}
+	return c
+}
+
+// replaceUnchangedNodeData replaces the node data in the sample directory that is identical to its
+// baseline in the sample with a marker, and keeps the hashes of the data as the hashes of the baselines
+// for the next collection. Baselines are only trusted when updated, otherwise the next collection ships
+// full data. Returns the number of files replaced.
+func replaceUnchangedNodeData(msd string, state *AgentState, hashes *nodeDataHashes, baselinesUpdated bool) int {
+	current := hashes.all()
+	next := make(map[string]string, len(current))
+	if baselinesUpdated {
+		for name, hash := range current {
+			next[sample.BaselineName(name)] = hash
+		}
+	}
+	previous := state.swapBaselineHashes(next)
+
+	replaced := 0
+	for name, hash := range current {
+		baseline := sample.BaselineName(name)
+		if previous[baseline] != hash {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(msd, baseline)); err != nil {
+			continue
+		}
+		if err := writeUnchangedMarker(msd, name, baseline, hash); err != nil {
+			log.Warnf("Unable to replace unchanged node data %s, it will be sent in full: %v", name, err)
+			continue
+		}
+		replaced++
+	}
+	if replaced > 0 {
+		log.Debugf("Replaced %d node files unchanged from their baseline with a marker", replaced)
+	}
+	return replaced
+}
+
+// writeUnchangedMarker replaces the named node data with a marker referring to its baseline
+func writeUnchangedMarker(msd, name, baseline, hash string) error {
+	data, err := json.Marshal(sample.UnchangedMarker{Baseline: baseline, SHA256: hash})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(msd, name+sample.UnchangedSuffix), data, 0644); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(msd, name))
+}
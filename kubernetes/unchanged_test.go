@@ -0,0 +1,97 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/sample"
+)
+
+func TestReplaceUnchangedNodeData(t *testing.T) {
+	summary := func(node string) string {
+		return sample.NodeSourceName(sample.StatsPrefix, sample.SummarySource, node) + ".json"
+	}
+	baseline := func(node string) string {
+		return sample.NodeSourceName(sample.BaselinePrefix, sample.SummarySource, node) + ".json"
+	}
+
+	// collect writes the given summaries and their baselines into a new sample directory
+	collect := func(t *testing.T, files map[string]string) (string, *nodeDataHashes) {
+		msd, err := os.MkdirTemp("", "TestReplaceUnchangedNodeData")
+		if err != nil {
+			t.Fatalf("error creating temp dir: %v", err)
+		}
+		hashes := newNodeDataHashes()
+		for name, hash := range files {
+			if err := os.WriteFile(filepath.Join(msd, name), []byte(hash), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(msd, sample.BaselineName(name)), []byte("previous"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			hashes.record(filepath.Join(msd, name), hash)
+		}
+		return msd, hashes
+	}
+	exists := func(msd, name string) bool {
+		_, err := os.Stat(filepath.Join(msd, name))
+		return err == nil
+	}
+
+	state := newAgentState(KubeAgentConfig{}, NodeConnection{})
+
+	t.Run("Ensure nothing is replaced without baseline hashes", func(t *testing.T) {
+		msd, hashes := collect(t, map[string]string{summary("node0"): "a", summary("node1"): "b"})
+		defer os.RemoveAll(msd)
+		if n := replaceUnchangedNodeData(msd, state, hashes, true); n != 0 {
+			t.Errorf("expected no replacements, got %d", n)
+		}
+	})
+
+	t.Run("Ensure data unchanged from its baseline is replaced", func(t *testing.T) {
+		msd, hashes := collect(t, map[string]string{summary("node0"): "a", summary("node1"): "c"})
+		defer os.RemoveAll(msd)
+		if n := replaceUnchangedNodeData(msd, state, hashes, true); n != 1 {
+			t.Errorf("expected one replacement, got %d", n)
+		}
+		if exists(msd, summary("node0")) || !exists(msd, summary("node1")) {
+			t.Error("expected only the unchanged summary to be replaced")
+		}
+		data, err := os.ReadFile(filepath.Join(msd, summary("node0")+sample.UnchangedSuffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var marker sample.UnchangedMarker
+		if err := json.Unmarshal(data, &marker); err != nil {
+			t.Fatal(err)
+		}
+		if marker.Baseline != baseline("node0") || marker.SHA256 != "a" {
+			t.Errorf("unexpected marker %+v", marker)
+		}
+	})
+
+	t.Run("Ensure nothing is replaced after the baselines failed to update", func(t *testing.T) {
+		msd, hashes := collect(t, map[string]string{summary("node0"): "a"})
+		defer os.RemoveAll(msd)
+		replaceUnchangedNodeData(msd, state, hashes, false)
+
+		msd, hashes = collect(t, map[string]string{summary("node0"): "a"})
+		defer os.RemoveAll(msd)
+		if n := replaceUnchangedNodeData(msd, state, hashes, true); n != 0 {
+			t.Errorf("expected no replacements, got %d", n)
+		}
+	})
+
+	t.Run("Ensure data is not replaced without its baseline in the sample", func(t *testing.T) {
+		msd, hashes := collect(t, map[string]string{summary("node0"): "a"})
+		defer os.RemoveAll(msd)
+		if err := os.Remove(filepath.Join(msd, baseline("node0"))); err != nil {
+			t.Fatal(err)
+		}
+		if n := replaceUnchangedNodeData(msd, state, hashes, true); n != 0 || !exists(msd, summary("node0")) {
+			t.Errorf("expected no replacements, got %d", n)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package kubernetes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// DefaultMinKubernetesVersion is the default recommended minimum Kubernetes version, older clusters are
+// collected with a warning and without the features they do not support
+const DefaultMinKubernetesVersion = "1.21"
+
+// lowestKubernetesVersion is the hard floor of the supported Kubernetes versions, the agent refuses to run on
+// older clusters and the recommended minimum can not be set below it
+var lowestKubernetesVersion = kubeVersion{major: 1, minor: 16}
+
+// kubeVersion is the major and minor version of a Kubernetes release
+type kubeVersion struct {
+	major int
+	minor int
+}
+
+func (v kubeVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// less returns true if v is an older release than o
+func (v kubeVersion) less(o kubeVersion) bool {
+	if v.major != o.major {
+		return v.major < o.major
+	}
+	return v.minor < o.minor
+}
+
+// parseKubeVersion parses a version of the form 1.21, with an optional v prefix. Anything following the
+// digits of the minor version is ignored, eg: the + of managed clusters or the patch version.
+func parseKubeVersion(s string) (kubeVersion, error) {
+	parts := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(s), "v"), ".", 3)
+	if len(parts) < 2 {
+		return kubeVersion{}, fmt.Errorf("version %q is not of the form major.minor", s)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return kubeVersion{}, fmt.Errorf("version %q has an invalid major version", s)
+	}
+	digits := strings.IndexFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+	if digits < 0 {
+		digits = len(parts[1])
+	}
+	minor, err := strconv.Atoi(parts[1][:digits])
+	if err != nil {
+		return kubeVersion{}, fmt.Errorf("version %q has an invalid minor version", s)
+	}
+	return kubeVersion{major: major, minor: minor}, nil
+}
+
+// serverKubeVersion returns the release of the discovered server version, from its git version if the major
+// and minor version are not reported. Returns false if it is unknown.
+func serverKubeVersion(info *version.Info) (kubeVersion, bool) {
+	if info == nil {
+		return kubeVersion{}, false
+	}
+	if v, err := parseKubeVersion(info.Major + "." + info.Minor); err == nil {
+		return v, true
+	}
+	v, err := parseKubeVersion(info.GitVersion)
+	return v, err == nil
+}
+
+// versionGate is a feature that does not work on clusters older than a Kubernetes release
+type versionGate struct {
+	// feature identifies the feature in logs and samples
+	feature string
+	since   kubeVersion
+	reason  string
+	// informer is the informer of the resource collected by the feature, skipped when it is disabled
+	informer string
+	// enabled returns true if the feature is configured, nil if it always is
+	enabled func(KubeAgentConfig) bool
+	// disable turns the feature off, nil if it is disabled by skipping its informer alone
+	disable func(*KubeAgentConfig)
+}
+
+// versionGates are the features disabled on clusters older than the release they require. New gates are
+// added here, in the order of the release they require.
+var versionGates = []versionGate{
+	{
+		feature: "probe_metrics",
+		since:   kubeVersion{major: 1, minor: 18},
+		reason:  "kubelets do not serve /metrics/probes",
+		enabled: func(c KubeAgentConfig) bool { return c.RetrieveProbeMetrics },
+		disable: func(c *KubeAgentConfig) { c.RetrieveProbeMetrics = false },
+	},
+	{
+		feature:  "cronjobs",
+		since:    kubeVersion{major: 1, minor: 21},
+		reason:   "the API server does not serve batch/v1 cronjobs",
+		informer: "cronjobs",
+	},
+}
+
+// applyVersionGates checks the cluster version against the supported versions. An error is returned if the
+// cluster is older than the lowest supported version. Features that do not work on the cluster version are
+// disabled and recorded, and a warning is logged if it is older than the recommended minimum. Nothing is
+// gated if the cluster version is unknown. An empty minimum version is DefaultMinKubernetesVersion.
+func applyVersionGates(config KubeAgentConfig) (KubeAgentConfig, error) {
+	if config.MinKubernetesVersion == "" {
+		config.MinKubernetesVersion = DefaultMinKubernetesVersion
+	}
+	var err error
+	config.minKubeVersion, err = parseKubeVersion(config.MinKubernetesVersion)
+	if err != nil {
+		return config, fmt.Errorf("invalid minimum Kubernetes version: %v", err)
+	}
+	if config.minKubeVersion.less(lowestKubernetesVersion) {
+		return config, fmt.Errorf("minimum Kubernetes version %s is below the lowest supported version %s",
+			config.minKubeVersion, lowestKubernetesVersion)
+	}
+
+	v, ok := serverKubeVersion(config.ClusterVersion.versionInfo)
+	if !ok {
+		log.Warn("Warning: the cluster version is unknown, features are not checked against it")
+		return config, nil
+	}
+	if v.less(lowestKubernetesVersion) {
+		return config, fmt.Errorf("cluster version %s is not supported, the lowest supported version is %s", v,
+			lowestKubernetesVersion)
+	}
+
+	config.versionGated = nil
+	for _, g := range versionGates {
+		if !v.less(g.since) || (g.enabled != nil && !g.enabled(config)) {
+			continue
+		}
+		if g.disable != nil {
+			g.disable(&config)
+		}
+		config.versionGated = append(config.versionGated, g.feature)
+		log.Warnf("Collection of %s is disabled as it requires Kubernetes %s or later, %s on Kubernetes %s",
+			g.feature, g.since, g.reason, v)
+	}
+	warnUnsupportedVersion(config)
+	return config, nil
+}
+
+// warnUnsupportedVersion logs a warning if the cluster is older than the recommended minimum version. It is
+// logged with every sample, so it is not missed while the cluster is not upgraded.
+func warnUnsupportedVersion(config KubeAgentConfig) {
+	v, ok := serverKubeVersion(config.ClusterVersion.versionInfo)
+	if !ok || !v.less(config.minKubeVersion) {
+		return
+	}
+	log.Warnf("WARNING: Kubernetes %s is older than the minimum recommended version %s, upgrade the cluster "+
+		"for full support. Features disabled on this version: %v", v, config.minKubeVersion, config.versionGated)
+}
+
+// gatedInformers returns the informers of the features disabled by the cluster version
+func (ka KubeAgentConfig) gatedInformers() []string {
+	var informers []string
+	for _, g := range versionGates {
+		for _, feature := range ka.versionGated {
+			if feature == g.feature && g.informer != "" {
+				informers = append(informers, g.informer)
+			}
+		}
+	}
+	return informers
+}
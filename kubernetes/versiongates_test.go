@@ -0,0 +1,106 @@
+package kubernetes
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/version"
+)
+
+func TestParseKubeVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    kubeVersion
+		wantErr bool
+	}{
+		{in: "1.21", want: kubeVersion{1, 21}},
+		{in: "v1.9", want: kubeVersion{1, 9}},
+		{in: "1.18+", want: kubeVersion{1, 18}},
+		{in: "v1.24.3-eks-123", want: kubeVersion{1, 24}},
+		{in: "1", wantErr: true},
+		{in: "one.two", wantErr: true},
+		{in: "1.+", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseKubeVersion(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseKubeVersion(%q) = %v, %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if !(kubeVersion{1, 9}).less(kubeVersion{1, 16}) || (kubeVersion{2, 0}).less(kubeVersion{1, 30}) {
+		t.Error("expected releases to be ordered by major then minor version")
+	}
+}
+
+func TestApplyVersionGates(t *testing.T) {
+	tests := []struct {
+		name        string
+		min         string
+		info        *version.Info
+		probes      bool
+		wantErr     bool
+		wantGated   []string
+		wantProbes  bool
+		wantSkipped []string
+	}{
+		{
+			name: "below the lowest supported version", info: &version.Info{Major: "1", Minor: "15"},
+			wantErr: true,
+		},
+		{
+			name: "older than every gate", info: &version.Info{Major: "1", Minor: "17+"}, probes: true,
+			wantGated: []string{"probe_metrics", "cronjobs"}, wantSkipped: []string{"cronjobs"},
+		},
+		{
+			name: "gated features not configured", info: &version.Info{Major: "1", Minor: "17"},
+			wantGated: []string{"cronjobs"}, wantSkipped: []string{"cronjobs"},
+		},
+		{
+			name: "version from the git version", info: &version.Info{GitVersion: "v1.19.4-gke.1"}, probes: true,
+			wantGated: []string{"cronjobs"}, wantProbes: true, wantSkipped: []string{"cronjobs"},
+		},
+		{
+			name: "recommended version", info: &version.Info{Major: "1", Minor: "21"}, probes: true,
+			wantProbes: true,
+		},
+		{
+			name: "unknown version", info: &version.Info{}, probes: true, wantProbes: true,
+		},
+		{
+			name: "below the recommended minimum without gated features", min: "1.25",
+			info: &version.Info{Major: "1", Minor: "22"}, probes: true, wantProbes: true,
+		},
+		{
+			name: "invalid minimum", min: "latest", info: &version.Info{Major: "1", Minor: "21"}, wantErr: true,
+		},
+		{
+			name: "minimum below the lowest supported version", min: "1.14",
+			info: &version.Info{Major: "1", Minor: "21"}, wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := KubeAgentConfig{
+				MinKubernetesVersion: tt.min,
+				ClusterVersion:       ClusterVersion{versionInfo: tt.info},
+				RetrieveProbeMetrics: tt.probes,
+			}
+			config, err := applyVersionGates(config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(config.versionGated, tt.wantGated) {
+				t.Errorf("expected gated features %v, got %v", tt.wantGated, config.versionGated)
+			}
+			if config.RetrieveProbeMetrics != tt.wantProbes {
+				t.Errorf("expected probe metrics retrieval %v, got %v", tt.wantProbes, config.RetrieveProbeMetrics)
+			}
+			if skipped := config.gatedInformers(); !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("expected skipped informers %v, got %v", tt.wantSkipped, skipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package kubernetes
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// how nodes registered by a virtual kubelet, eg: for ACI or ECS, are collected
+const (
+	// VirtualKubeletSkip leaves virtual kubelet nodes out of collection, they are reported as skipped
+	VirtualKubeletSkip = "skip"
+	// VirtualKubeletProxy collects virtual kubelet nodes via the API server proxy only
+	VirtualKubeletProxy = "proxy"
+	// VirtualKubeletCollect collects virtual kubelet nodes like any other node
+	VirtualKubeletCollect = "collect"
+)
+
+// DefaultVirtualKubeletNodes is the default handling of virtual kubelet nodes, which have no kubelet
+// endpoints to collect
+const DefaultVirtualKubeletNodes = VirtualKubeletSkip
+
+const (
+	virtualKubeletTypeLabel          = "type"
+	virtualKubeletType               = "virtual-kubelet"
+	virtualKubeletProviderAnnotation = "virtual-kubelet.io/provider"
+)
+
+// parseVirtualKubeletNodes returns the handling of virtual kubelet nodes, the default if empty
+func parseVirtualKubeletNodes(mode string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(mode)); m {
+	case "":
+		return DefaultVirtualKubeletNodes, nil
+	case VirtualKubeletSkip, VirtualKubeletProxy, VirtualKubeletCollect:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown virtual kubelet node handling %q, must be one of %s, %s or %s", mode,
+			VirtualKubeletSkip, VirtualKubeletProxy, VirtualKubeletCollect)
+	}
+}
+
+// isVirtualKubeletNode detects whether a node is registered by a virtual kubelet, from its type label or
+// provider annotation
+func isVirtualKubeletNode(n v1.Node) bool {
+	if n.Labels[virtualKubeletTypeLabel] == virtualKubeletType {
+		return true
+	}
+	_, ok := n.Annotations[virtualKubeletProviderAnnotation]
+	return ok
+}
+
+// proxyOnlyNode returns true if the node is never connected to directly, as it is a Fargate node or a
+// virtual kubelet node collected via proxy
+func proxyOnlyNode(config KubeAgentConfig, n v1.Node) bool {
+	return isFargateNode(n) || (config.VirtualKubeletNodes == VirtualKubeletProxy && isVirtualKubeletNode(n))
+}
+
+// withoutVirtualNodes returns the nodes to collect and the names of the virtual kubelet nodes left out of
+// collection, which are only left out when they are configured to be skipped
+func withoutVirtualNodes(config KubeAgentConfig, nodes []v1.Node) ([]v1.Node, []string) {
+	if config.VirtualKubeletNodes != VirtualKubeletSkip {
+		return nodes, nil
+	}
+	var collected []v1.Node
+	var skipped []string
+	for _, n := range nodes {
+		if isVirtualKubeletNode(n) {
+			skipped = append(skipped, n.Name)
+			continue
+		}
+		collected = append(collected, n)
+	}
+	if len(skipped) > 0 {
+		log.Debugf("Virtual kubelet nodes [%s] are not collected", strings.Join(skipped, ", "))
+	}
+	return collected, skipped
+}
@@ -0,0 +1,74 @@
+package kubernetes
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/sample"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestVirtualKubeletNodes(t *testing.T) {
+	nodes := []v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "ec2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "vk-label", Labels: map[string]string{"type": "virtual-kubelet"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "vk-annotation",
+			Annotations: map[string]string{"virtual-kubelet.io/provider": "aws-ecs"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "fargate", Labels: fargateLabels}},
+	}
+
+	t.Run("Ensure the handling is parsed", func(t *testing.T) {
+		for in, want := range map[string]string{"": VirtualKubeletSkip, " Proxy ": VirtualKubeletProxy,
+			"collect": VirtualKubeletCollect} {
+			if got, err := parseVirtualKubeletNodes(in); err != nil || got != want {
+				t.Errorf("parseVirtualKubeletNodes(%q) = %q, %v, want %q", in, got, err, want)
+			}
+		}
+		if _, err := parseVirtualKubeletNodes("ignore"); err == nil {
+			t.Error("expected an unknown handling to be rejected")
+		}
+	})
+
+	t.Run("Ensure virtual kubelet nodes are skipped", func(t *testing.T) {
+		collected, skipped := withoutVirtualNodes(KubeAgentConfig{VirtualKubeletNodes: VirtualKubeletSkip}, nodes)
+		if len(collected) != 2 || collected[0].Name != "ec2" || collected[1].Name != "fargate" {
+			t.Errorf("unexpected collected nodes %v", collected)
+		}
+		if !reflect.DeepEqual(skipped, []string{"vk-label", "vk-annotation"}) {
+			t.Errorf("unexpected skipped nodes %v", skipped)
+		}
+		for _, mode := range []string{VirtualKubeletProxy, VirtualKubeletCollect} {
+			if collected, skipped := withoutVirtualNodes(KubeAgentConfig{VirtualKubeletNodes: mode},
+				nodes); len(collected) != len(nodes) || len(skipped) != 0 {
+				t.Errorf("expected every node to be collected with %s, skipped %v", mode, skipped)
+			}
+		}
+	})
+
+	t.Run("Ensure virtual kubelet nodes are only proxied when configured", func(t *testing.T) {
+		var proxied []string
+		for _, n := range nodes {
+			if proxyOnlyNode(KubeAgentConfig{VirtualKubeletNodes: VirtualKubeletProxy}, n) {
+				proxied = append(proxied, n.Name)
+			}
+		}
+		if !reflect.DeepEqual(proxied, []string{"vk-label", "vk-annotation", "fargate"}) {
+			t.Errorf("unexpected proxy only nodes %v", proxied)
+		}
+		if proxyOnlyNode(KubeAgentConfig{VirtualKubeletNodes: VirtualKubeletCollect}, nodes[1]) {
+			t.Error("expected a collected virtual kubelet node to be connected to directly")
+		}
+	})
+
+	t.Run("Ensure skipped nodes are reported", func(t *testing.T) {
+		health := newNodeHealthSnapshot()
+		health.record(nodes[:2])
+		health.skip([]string{"vk-label"}, sample.SkipVirtualKubelet)
+		report := health.report(nil)
+		if len(report) != 2 || report[0].Outcome != sample.NodeCollected ||
+			report[1].Outcome != sample.NodeSkipped || report[1].Reason != sample.SkipVirtualKubelet {
+			t.Errorf("unexpected node health %+v", report)
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package kubernetes
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+)
+
+// collectWarmUp performs the warm-up collection, the first collection after startup when warm-up is
+// enabled. It is a full collection that establishes the node baselines, so the first uploaded sample holds
+// deltas, but its sample is discarded rather than uploaded. It is bounded by the poll interval so it can not
+// delay the first uploaded sample, and a failure is not fatal as the next collection is a regular one.
+func (ka KubeAgentConfig) collectWarmUp(ctx context.Context, config KubeAgentConfig, cycle pollCycle,
+	state *AgentState, clientset kubernetes.Interface, nodeSource NodeSource) {
+	log.Info("Warm-up collection started, its sample establishes the node baselines and is not uploaded")
+	warmUpCtx, cancel := context.WithTimeout(ctx, time.Duration(config.PollInterval)*time.Second)
+	defer cancel()
+	cycle.warmUp = true
+
+	start := time.Now()
+	err := ka.collectMetrics(warmUpCtx, config, cycle, state, clientset, nodeSource)
+	state.recordWarmUp(time.Now())
+	if err != nil {
+		log.Warnf("Warm-up collection failed, the next collection will be uploaded regardless: %v", err)
+		return
+	}
+	log.Infof("Warm-up collection completed in %v, the next sample will be uploaded", time.Since(start))
+}
@@ -0,0 +1,102 @@
+package kubernetes
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/sample"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCollectWarmUp(t *testing.T) {
+	ts := NewTestServer()
+	defer ts.Close()
+
+	ready := v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}}
+	cs := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node0"},
+		Spec: v1.NodeSpec{ProviderID: "aws:///node0"}, Status: ready})
+	sv, err := cs.Discovery().ServerVersion()
+	if err != nil {
+		t.Fatalf("Error getting server version: %v", err)
+	}
+
+	// node baselines are kept alongside the export directory
+	parent, err := os.MkdirTemp("", "TestCollectWarmUp")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "export")
+	if err = os.Mkdir(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	exportDir, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exportDir.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informers, err := getMockInformers(1.22, stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := KubeAgentConfig{
+		ClusterVersion:    ClusterVersion{version: 1.22, versionInfo: sv},
+		Clientset:         cs,
+		HTTPClient:        http.Client{},
+		ClusterHostURL:    ts.URL,
+		Insecure:          true,
+		ConcurrentPollers: 1,
+		Informers:         informers,
+		PollInterval:      60,
+		WarmUp:            true,
+		msExportDirectory: exportDir,
+	}
+	nodes := NodeConnection{
+		InClusterClient:    raw.NewClient(http.Client{}, true, nil, 0, false),
+		NodeMetrics:        NewEndpointMask(),
+		NodeMetricsReasons: EndpointReasons{},
+	}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	state := newAgentState(config, nodes)
+	fns := NewClientsetNodeSource(cs)
+
+	if !state.startWarmUp() || state.startWarmUp() {
+		t.Fatal("expected a single warm-up collection")
+	}
+	config.collectWarmUp(context.TODO(), config, pollCycle{}, state, cs, fns)
+
+	measurements, err := filepath.Glob(filepath.Join(dir, "*", "*", sample.AgentMeasurementFile))
+	if err != nil || len(measurements) != 0 {
+		t.Errorf("expected the warm-up sample to be discarded, got %v: %v", measurements, err)
+	}
+	baselines, err := filepath.Glob(filepath.Join(parent, sample.BaselinePrefix+"-*"))
+	if err != nil || len(baselines) == 0 {
+		t.Errorf("expected the warm-up to establish the node baselines, got %v: %v", baselines, err)
+	}
+
+	if err := config.collectMetrics(context.TODO(), config, pollCycle{}, state, cs, fns); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	measurements, err = filepath.Glob(filepath.Join(dir, "*", "*", sample.AgentMeasurementFile))
+	if err != nil || len(measurements) != 1 {
+		t.Fatalf("expected the sample after the warm-up to be kept, got %v: %v", measurements, err)
+	}
+	data, err := os.ReadFile(measurements[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"warm_up_completed"`) {
+		t.Errorf("expected the agent status to report the warm-up, got %s", data)
+	}
+}
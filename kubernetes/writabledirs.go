@@ -0,0 +1,37 @@
+package kubernetes
+
+import (
+	"fmt"
+	"path"
+)
+
+// writableDir is a directory the agent writes to, named as it is reported when it can not be written
+type writableDir struct {
+	name string
+	dir  string
+}
+
+// writableDirs returns the directories the agent writes to, every one within the scratch directory so the
+// agent runs with a read-only root filesystem given a writable scratch volume: the scratch directory holds
+// the archives and agent state, the baseline directory the node baselines and the export directory the
+// samples being collected
+func writableDirs(config KubeAgentConfig) []writableDir {
+	dirs := []writableDir{{name: "scratch", dir: config.ScratchDir}}
+	if config.msExportDirectory != nil {
+		dirs = append(dirs,
+			writableDir{name: "baseline", dir: path.Dir(config.msExportDirectory.Name())},
+			writableDir{name: "export", dir: config.msExportDirectory.Name()})
+	}
+	return dirs
+}
+
+// checkWritableDirs writes a probe file in each directory the agent writes to, returning the first that can
+// not be written with the path and error, so the agent fails at startup rather than at its first collection
+func checkWritableDirs(config KubeAgentConfig) error {
+	for _, d := range writableDirs(config) {
+		if err := probeExportVolume(d.dir); err != nil {
+			return fmt.Errorf("the %s directory %s is not writable: %w", d.name, d.dir, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package kubernetes
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/credentials"
+	"github.com/cloudability/metrics-agent/retrieval/raw"
+	"github.com/cloudability/metrics-agent/util"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckWritableDirs(t *testing.T) {
+	t.Run("Ensure every directory written to is probed", func(t *testing.T) {
+		scratch := t.TempDir()
+		exportDir, err := util.CreateMSWorkingDirectory("cluster", scratch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer exportDir.Close()
+		config := KubeAgentConfig{ScratchDir: scratch, msExportDirectory: exportDir}
+		if err := checkWritableDirs(config); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, d := range writableDirs(config) {
+			if !strings.HasPrefix(d.dir, scratch) {
+				t.Errorf("expected the %s directory to be within the scratch directory, got %s", d.name, d.dir)
+			}
+			entries, err := os.ReadDir(d.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), exportVolumeProbeFile) {
+					t.Errorf("expected the probe of the %s directory to be removed, got %s", d.name, e.Name())
+				}
+			}
+		}
+	})
+
+	t.Run("Ensure the directory that can not be written is reported with its path", func(t *testing.T) {
+		missing := filepath.Join(t.TempDir(), "missing")
+		err := checkWritableDirs(KubeAgentConfig{ScratchDir: missing})
+		if err == nil || !strings.Contains(err.Error(), "the scratch directory "+missing+" is not writable") {
+			t.Errorf("expected the scratch directory to be reported, got %v", err)
+		}
+	})
+}
+
+func TestCollectionWritesOnlyConfiguredDirs(t *testing.T) {
+	ts := NewTestServer()
+	defer ts.Close()
+
+	scratch := t.TempDir()
+	// the temporary directory of the process is read-only, as with a read-only root filesystem
+	tmp := t.TempDir()
+	if err := os.Chmod(tmp, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chmod(tmp, 0755) }()
+	t.Setenv("TMPDIR", tmp)
+
+	exportDir, err := util.CreateMSWorkingDirectory("cluster", scratch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exportDir.Close()
+	node0, node1 := addressedNode("node0", "10.0.0.1"), addressedNode("node1", "10.0.0.2")
+	cs := fake.NewSimpleClientset(&node0, &node1)
+	sv, err := cs.Discovery().ServerVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informers, err := getMockInformers(1.22, stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ka := KubeAgentConfig{
+		ClusterVersion:    ClusterVersion{version: 1.22, versionInfo: sv},
+		Clientset:         cs,
+		HTTPClient:        http.Client{},
+		ScratchDir:        scratch,
+		msExportDirectory: exportDir,
+		ClusterHostURL:    ts.URL,
+		HeapsterURL:       ts.URL,
+		Insecure:          true,
+		ConcurrentPollers: 10,
+		Informers:         informers,
+		Credentials:       credentials.NewFileProvider(wd+"/testdata/mockToken", 0),
+	}
+	nodes := NodeConnection{NodeMetrics: NewEndpointMask()}
+	nodes.NodeMetrics.SetAvailability(NodeStatsSummaryEndpoint, Proxy, true)
+	nodes.InClusterClient = raw.NewClient(ka.HTTPClient, ka.Insecure, ka.Credentials, 0, false)
+	state := newAgentState(ka, nodes)
+	ns := NewClientsetNodeSource(cs)
+
+	if err := checkWritableDirs(ka); err != nil {
+		t.Fatal(err)
+	}
+	if err := downloadBaselineMetricExport(context.TODO(), ka, state, ns); err != nil {
+		t.Fatal(err)
+	}
+	if err := ka.collectMetrics(context.TODO(), ka, pollCycle{}, state, cs, ns); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := util.CreateMetricSample(*exportDir, "cluster", true, scratch, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if !strings.HasPrefix(archive.Name(), scratch) {
+		t.Errorf("expected the archive to be built in the scratch directory, got %s", archive.Name())
+	}
+
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("expected nothing to be written outside of the scratch directory, got %s", e.Name())
+	}
+}
@@ -0,0 +1,228 @@
+package k8s
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	v1apps "k8s.io/api/apps/v1"
+	v1batch "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// image reference rewrite modes
+const (
+	// ImageRewriteStripRegistry removes the registry host, keeping the repository path and tag
+	ImageRewriteStripRegistry = "strip_registry"
+	// ImageRewriteRepositoryTag keeps only the last component of the repository path and the tag
+	ImageRewriteRepositoryTag = "repository_tag"
+	// ImageRewriteHashRegistry replaces the registry host with a hash of it
+	ImageRewriteHashRegistry = "hash_registry"
+)
+
+// ImageRewriteModes are the supported image reference rewrite modes
+var ImageRewriteModes = []string{ImageRewriteStripRegistry, ImageRewriteRepositoryTag, ImageRewriteHashRegistry}
+
+// hashedRegistryPrefix prefixes the hash that replaces a registry host
+const hashedRegistryPrefix = "registry-"
+
+// hashedRegistryLength is the number of hex characters of a registry host hash that are kept
+const hashedRegistryLength = 12
+
+// dockerHubHosts are the hosts of Docker Hub, references to which are normalized to their short form
+var dockerHubHosts = map[string]bool{
+	"docker.io":            true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+// imageReference is an image reference split into its parts, eg:
+// docker-pullable://registry.example.com:5000/team/app:1.0@sha256:abc
+type imageReference struct {
+	// scheme prefixes the image IDs reported by some container runtimes, eg: docker-pullable://
+	scheme     string
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// parseImageReference splits an image reference into its parts. As with docker, the first component of
+// the repository path is only a registry host if it holds a "." or ":", or is localhost. Docker Hub
+// references are normalized to their short form, eg: docker.io/library/nginx is nginx.
+func parseImageReference(ref string) imageReference {
+	var r imageReference
+	if i := strings.Index(ref, "://"); i >= 0 {
+		r.scheme, ref = ref[:i+3], ref[i+3:]
+	}
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref, r.digest = ref[:i], ref[i+1:]
+	}
+	if i := strings.Index(ref, "/"); i >= 0 && isRegistryHost(ref[:i]) {
+		r.registry, ref = ref[:i], ref[i+1:]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref, r.tag = ref[:i], ref[i+1:]
+	}
+	r.repository = ref
+	if r.registry == "" || dockerHubHosts[r.registry] {
+		r.registry = ""
+		r.repository = strings.TrimPrefix(r.repository, "library/")
+	}
+	return r
+}
+
+func isRegistryHost(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+// String formats the image reference
+func (r imageReference) String() string {
+	var b strings.Builder
+	b.WriteString(r.scheme)
+	if r.registry != "" {
+		b.WriteString(r.registry + "/")
+	}
+	b.WriteString(r.repository)
+	if r.tag != "" {
+		b.WriteString(":" + r.tag)
+	}
+	if r.digest != "" {
+		b.WriteString("@" + r.digest)
+	}
+	return b.String()
+}
+
+// ImageRewriter rewrites the image references of collected resources so registry hosts are not exported.
+// Rewrites are deterministic, so an image maps to the same reference throughout a sample.
+type ImageRewriter struct {
+	mode       string
+	keepDigest bool
+	// redactions counts the references changed by a rewrite, if not nil
+	redactions *Redactions
+}
+
+// NewImageRewriter returns a rewriter for the mode, or nil if the mode is empty and references are kept
+// as they are. Digests are removed unless keepDigest is set.
+func NewImageRewriter(mode string, keepDigest bool) (*ImageRewriter, error) {
+	if mode == "" {
+		return nil, nil
+	}
+	for _, m := range ImageRewriteModes {
+		if mode == m {
+			return &ImageRewriter{mode: mode, keepDigest: keepDigest}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown image rewrite mode %q, expected one of %v", mode, ImageRewriteModes)
+}
+
+// Image returns the rewritten image reference
+func (ir *ImageRewriter) Image(ref string) string {
+	if ir == nil || ref == "" {
+		return ref
+	}
+	r := parseImageReference(ref)
+	switch ir.mode {
+	case ImageRewriteStripRegistry:
+		r.registry = ""
+	case ImageRewriteRepositoryTag:
+		r.registry = ""
+		r.repository = r.repository[strings.LastIndex(r.repository, "/")+1:]
+	case ImageRewriteHashRegistry:
+		if r.registry != "" {
+			sum := sha256.Sum256([]byte(r.registry))
+			r.registry = hashedRegistryPrefix + hex.EncodeToString(sum[:])[:hashedRegistryLength]
+		}
+	}
+	if !ir.keepDigest {
+		r.digest = ""
+	}
+	return r.String()
+}
+
+// Rewrite returns the resource with its image references rewritten. Resources holding images are copied
+// rather than modified, as they are the objects cached by the informers.
+func (ir *ImageRewriter) Rewrite(resource interface{}) interface{} {
+	return ir.rewrite(resource, nil)
+}
+
+// rewrite behaves like Rewrite, counting the references changed in redactions
+func (ir *ImageRewriter) rewrite(resource interface{}, redactions *Redactions) interface{} {
+	if ir == nil {
+		return resource
+	}
+	ir = &ImageRewriter{mode: ir.mode, keepDigest: ir.keepDigest, redactions: redactions}
+	switch cast := resource.(type) {
+	case *corev1.Pod:
+		pod := cast.DeepCopy()
+		ir.rewritePodSpec(&pod.Spec)
+		ir.rewriteStatuses(pod.Status.InitContainerStatuses)
+		ir.rewriteStatuses(pod.Status.ContainerStatuses)
+		ir.rewriteStatuses(pod.Status.EphemeralContainerStatuses)
+		return pod
+	case *v1apps.DaemonSet:
+		ds := cast.DeepCopy()
+		ir.rewritePodSpec(&ds.Spec.Template.Spec)
+		return ds
+	case *v1apps.ReplicaSet:
+		rs := cast.DeepCopy()
+		ir.rewritePodSpec(&rs.Spec.Template.Spec)
+		return rs
+	case *v1apps.Deployment:
+		d := cast.DeepCopy()
+		ir.rewritePodSpec(&d.Spec.Template.Spec)
+		return d
+	case *v1batch.Job:
+		j := cast.DeepCopy()
+		ir.rewritePodSpec(&j.Spec.Template.Spec)
+		return j
+	case *v1batch.CronJob:
+		cj := cast.DeepCopy()
+		ir.rewritePodSpec(&cj.Spec.JobTemplate.Spec.Template.Spec)
+		return cj
+	case *corev1.ReplicationController:
+		rc := cast.DeepCopy()
+		if rc.Spec.Template != nil {
+			ir.rewritePodSpec(&rc.Spec.Template.Spec)
+		}
+		return rc
+	case *corev1.Node:
+		n := cast.DeepCopy()
+		for i := range n.Status.Images {
+			for j, name := range n.Status.Images[i].Names {
+				n.Status.Images[i].Names[j] = ir.counted(name)
+			}
+		}
+		return n
+	}
+	return resource
+}
+
+func (ir *ImageRewriter) rewritePodSpec(spec *corev1.PodSpec) {
+	for i := range spec.InitContainers {
+		spec.InitContainers[i].Image = ir.counted(spec.InitContainers[i].Image)
+	}
+	for i := range spec.Containers {
+		spec.Containers[i].Image = ir.counted(spec.Containers[i].Image)
+	}
+	for i := range spec.EphemeralContainers {
+		spec.EphemeralContainers[i].Image = ir.counted(spec.EphemeralContainers[i].Image)
+	}
+}
+
+func (ir *ImageRewriter) rewriteStatuses(statuses []corev1.ContainerStatus) {
+	for i := range statuses {
+		statuses[i].Image = ir.counted(statuses[i].Image)
+		statuses[i].ImageID = ir.counted(statuses[i].ImageID)
+	}
+}
+
+// counted returns the rewritten image reference, counting it if it changed
+func (ir *ImageRewriter) counted(ref string) string {
+	rewritten := ir.Image(ref)
+	if rewritten != ref {
+		ir.redactions.Add(RewriteImages, 1)
+	}
+	return rewritten
+}
@@ -0,0 +1,126 @@
+package k8s
+
+import (
+	"strings"
+	"testing"
+
+	v1apps "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestImageRewriterImage(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	hashed := (&ImageRewriter{mode: ImageRewriteHashRegistry}).Image("registry.example.com:5000/team/app:1.0")
+	if !strings.HasPrefix(hashed, hashedRegistryPrefix) || !strings.HasSuffix(hashed, "/team/app:1.0") ||
+		strings.Contains(hashed, "example") {
+		t.Fatalf("expected the registry host to be hashed, got %s", hashed)
+	}
+
+	tests := []struct {
+		name       string
+		mode       string
+		keepDigest bool
+		ref        string
+		expected   string
+	}{
+		{name: "port-bearing registry", mode: ImageRewriteStripRegistry,
+			ref: "registry.example.com:5000/team/app:1.0", expected: "team/app:1.0"},
+		{name: "port-bearing registry without a tag", mode: ImageRewriteStripRegistry,
+			ref: "registry.example.com:5000/team/app", expected: "team/app"},
+		{name: "localhost registry", mode: ImageRewriteStripRegistry,
+			ref: "localhost/app:1.0", expected: "app:1.0"},
+		{name: "repository and tag", mode: ImageRewriteRepositoryTag,
+			ref: "registry.example.com:5000/team/app:1.0", expected: "app:1.0"},
+		{name: "hashed registry", mode: ImageRewriteHashRegistry,
+			ref: "registry.example.com:5000/team/app:1.0", expected: hashed},
+		{name: "digest pinned", mode: ImageRewriteStripRegistry, keepDigest: true,
+			ref: "registry.example.com/team/app:1.0@" + digest, expected: "team/app:1.0@" + digest},
+		{name: "digest pinned without a tag", mode: ImageRewriteStripRegistry, keepDigest: true,
+			ref: "registry.example.com/team/app@" + digest, expected: "team/app@" + digest},
+		{name: "digest removed", mode: ImageRewriteStripRegistry,
+			ref: "registry.example.com/team/app:1.0@" + digest, expected: "team/app:1.0"},
+		{name: "image ID", mode: ImageRewriteHashRegistry, keepDigest: true,
+			ref:      "docker-pullable://registry.example.com:5000/team/app@" + digest,
+			expected: "docker-pullable://" + strings.TrimSuffix(hashed, ":1.0") + "@" + digest},
+		{name: "bare image ID", mode: ImageRewriteRepositoryTag, keepDigest: true,
+			ref: digest, expected: digest},
+		{name: "short form", mode: ImageRewriteHashRegistry, ref: "nginx:1.25", expected: "nginx:1.25"},
+		{name: "library short form", mode: ImageRewriteHashRegistry,
+			ref: "library/nginx:1.25", expected: "nginx:1.25"},
+		{name: "docker hub library", mode: ImageRewriteHashRegistry,
+			ref: "docker.io/library/nginx:1.25", expected: "nginx:1.25"},
+		{name: "docker hub organization", mode: ImageRewriteRepositoryTag,
+			ref: "index.docker.io/bitnami/redis:7.0", expected: "redis:7.0"},
+		{name: "organization is not a registry", mode: ImageRewriteStripRegistry,
+			ref: "team/app:1.0", expected: "team/app:1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ir, err := NewImageRewriter(tt.mode, tt.keepDigest)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := ir.Image(tt.ref); got != tt.expected {
+				t.Errorf("expected %s to be rewritten as %s, got %s", tt.ref, tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestNewImageRewriter(t *testing.T) {
+	ir, err := NewImageRewriter("", true)
+	if ir != nil || err != nil {
+		t.Errorf("expected no rewriter without a mode, got %v: %v", ir, err)
+	}
+	if got := ir.Image("registry.example.com/app:1.0"); got != "registry.example.com/app:1.0" {
+		t.Errorf("expected a nil rewriter to keep references, got %s", got)
+	}
+	if _, err := NewImageRewriter("redact", true); err == nil {
+		t.Error("expected an unknown mode to be rejected")
+	}
+}
+
+func TestImageRewriterRewrite(t *testing.T) {
+	ir, err := NewImageRewriter(ImageRewriteStripRegistry, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const image = "registry.example.com/team/app:1.0"
+
+	t.Run("Ensure pod images are rewritten on a copy", func(t *testing.T) {
+		pod := &corev1.Pod{
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Image: image}},
+				Containers:     []corev1.Container{{Image: image}},
+			},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{Image: image, ImageID: "docker-pullable://registry.example.com/team/app@sha256:abc"},
+			}},
+		}
+		rewritten := ir.Rewrite(pod).(*corev1.Pod)
+		if pod.Spec.Containers[0].Image != image {
+			t.Errorf("expected the cached pod to be unchanged, got %s", pod.Spec.Containers[0].Image)
+		}
+		for _, got := range []string{rewritten.Spec.InitContainers[0].Image, rewritten.Spec.Containers[0].Image,
+			rewritten.Status.ContainerStatuses[0].Image} {
+			if got != "team/app:1.0" {
+				t.Errorf("expected the image to be rewritten, got %s", got)
+			}
+		}
+		if got := rewritten.Status.ContainerStatuses[0].ImageID; got != "docker-pullable://team/app@sha256:abc" {
+			t.Errorf("expected the image ID to be rewritten, got %s", got)
+		}
+	})
+
+	t.Run("Ensure workload templates and node images are rewritten", func(t *testing.T) {
+		d := &v1apps.Deployment{}
+		d.Spec.Template.Spec.Containers = []corev1.Container{{Image: image}}
+		if got := ir.Rewrite(d).(*v1apps.Deployment).Spec.Template.Spec.Containers[0].Image; got != "team/app:1.0" {
+			t.Errorf("expected the deployment image to be rewritten, got %s", got)
+		}
+		n := &corev1.Node{Status: corev1.NodeStatus{Images: []corev1.ContainerImage{{Names: []string{image}}}}}
+		if got := ir.Rewrite(n).(*corev1.Node).Status.Images[0].Names[0]; got != "team/app:1.0" {
+			t.Errorf("expected the node image to be rewritten, got %s", got)
+		}
+	})
+}
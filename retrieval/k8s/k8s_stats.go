@@ -4,13 +4,18 @@ import (
 	"bufio"
 	"encoding/json"
 	"errors"
-	"os"
 	"time"
 
+	"github.com/cloudability/metrics-agent/sample"
+	"github.com/cloudability/metrics-agent/util"
+
 	v1apps "k8s.io/api/apps/v1"
 	v1batch "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	v1node "k8s.io/api/node/v1"
+	v1scheduling "k8s.io/api/scheduling/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
@@ -20,28 +25,55 @@ const (
 	KubernetesLastAppliedConfig = "kubectl.kubernetes.io/last-applied-configuration"
 )
 
+// StartUpInformers starts an informer for each kubernetes resource collected, except those the agent is
+// not permitted to list and watch
 func StartUpInformers(clientset kubernetes.Interface, clusterVersion float64,
-	resyncInterval int, stopCh chan struct{}) (map[string]*cache.SharedIndexInformer, error) {
+	resyncInterval int, notPermitted []string, stopCh chan struct{}) (map[string]*cache.SharedIndexInformer, error) {
 	factory := informers.NewSharedInformerFactory(clientset, time.Duration(resyncInterval)*time.Hour)
 
+	skip := make(map[string]bool, len(notPermitted))
+	for _, name := range notPermitted {
+		skip[name] = true
+	}
+	// informers for resources that are not permitted are left nil so they are not collected, an informer
+	// that can not list would never sync
+	informer := func(name string, create func() cache.SharedIndexInformer) cache.SharedIndexInformer {
+		if skip[name] {
+			return nil
+		}
+		return create()
+	}
+
 	// v1Sources
-	replicationControllerInformer := factory.Core().V1().ReplicationControllers().Informer()
-	servicesInformer := factory.Core().V1().Services().Informer()
-	nodesInformer := factory.Core().V1().Nodes().Informer()
-	podsInformer := factory.Core().V1().Pods().Informer()
-	persistentVolumesInformer := factory.Core().V1().PersistentVolumes().Informer()
-	persistentVolumeClaimsInformer := factory.Core().V1().PersistentVolumeClaims().Informer()
-	namespacesInformer := factory.Core().V1().Namespaces().Informer()
+	replicationControllerInformer := informer("replicationcontrollers",
+		factory.Core().V1().ReplicationControllers().Informer)
+	servicesInformer := informer("services", factory.Core().V1().Services().Informer)
+	nodesInformer := informer("nodes", factory.Core().V1().Nodes().Informer)
+	podsInformer := informer("pods", factory.Core().V1().Pods().Informer)
+	persistentVolumesInformer := informer("persistentvolumes", factory.Core().V1().PersistentVolumes().Informer)
+	persistentVolumeClaimsInformer := informer("persistentvolumeclaims",
+		factory.Core().V1().PersistentVolumeClaims().Informer)
+	namespacesInformer := informer("namespaces", factory.Core().V1().Namespaces().Informer)
 	// AppSources
-	replicasetsInformer := factory.Apps().V1().ReplicaSets().Informer()
-	daemonsetsInformer := factory.Apps().V1().DaemonSets().Informer()
-	deploymentsInformer := factory.Apps().V1().Deployments().Informer()
+	replicasetsInformer := informer("replicasets", factory.Apps().V1().ReplicaSets().Informer)
+	daemonsetsInformer := informer("daemonsets", factory.Apps().V1().DaemonSets().Informer)
+	deploymentsInformer := informer("deployments", factory.Apps().V1().Deployments().Informer)
 	// Jobs
-	jobsInformer := factory.Batch().V1().Jobs().Informer()
+	jobsInformer := informer("jobs", factory.Batch().V1().Jobs().Informer)
 	// Cronjobs were introduced in k8s 1.21 so for older versions do not attempt to create an informer
 	var cronJobsInformer cache.SharedIndexInformer
 	if clusterVersion > 1.20 {
-		cronJobsInformer = factory.Batch().V1().CronJobs().Informer()
+		cronJobsInformer = informer("cronjobs", factory.Batch().V1().CronJobs().Informer)
+	}
+	// PriorityClasses and RuntimeClasses may not be served by older clusters, so only create informers
+	// for them when discovery reports the resource
+	var priorityClassesInformer cache.SharedIndexInformer
+	if resourceAvailable(clientset, v1scheduling.SchemeGroupVersion.String(), "priorityclasses") {
+		priorityClassesInformer = informer("priorityclasses", factory.Scheduling().V1().PriorityClasses().Informer)
+	}
+	var runtimeClassesInformer cache.SharedIndexInformer
+	if resourceAvailable(clientset, v1node.SchemeGroupVersion.String(), "runtimeclasses") {
+		runtimeClassesInformer = informer("runtimeclasses", factory.Node().V1().RuntimeClasses().Informer)
 	}
 
 	// runs in background, starts all informers that are a part of the factory
@@ -62,20 +94,40 @@ func StartUpInformers(clientset kubernetes.Interface, clusterVersion float64,
 		"namespaces":             &namespacesInformer,
 		"jobs":                   &jobsInformer,
 		"cronjobs":               &cronJobsInformer,
+		"priorityclasses":        &priorityClassesInformer,
+		"runtimeclasses":         &runtimeClassesInformer,
 	}
 	return clusterInformers, nil
 }
 
-// GetK8sMetricsFromInformer loops through all k8s resource informers in kubeAgentConfig writing each to the WSD
+// resourceAvailable uses discovery to check if the cluster serves the resource in the given group version
+func resourceAvailable(clientset kubernetes.Interface, groupVersion, resource string) bool {
+	resources, err := clientset.Discovery().ServerResourcesForGroupVersion(groupVersion)
+	if err != nil || resources == nil {
+		return false
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == resource {
+			return true
+		}
+	}
+	return false
+}
+
+// GetK8sMetricsFromInformer loops through all k8s resource informers in kubeAgentConfig writing each to the WSD.
+// Image references are rewritten by images and the agent's own pod and namespace are tagged by self if they
+// are not nil. The values redacted are counted in redactions if it is not nil.
 func GetK8sMetricsFromInformer(informers map[string]*cache.SharedIndexInformer,
-	workDir *os.File, parseMetricData bool) error {
+	workDir *util.WorkDir, parseMetricData bool, images *ImageRewriter, self *SelfTagger, redactions *Redactions) error {
 	for resourceName, informer := range informers {
-		// Cronjob informer will be nil if k8s version is less than 1.21, if so skip getting the list of cronjobs
+		// Cronjob informer will be nil if k8s version is less than 1.21, if so skip getting the list of cronjobs.
+		// The same applies to any other resource the cluster does not serve
 		if *informer == nil {
 			continue
 		}
 		resourceList := (*informer).GetIndexer().List()
-		err := writeK8sResourceFile(workDir, resourceName, resourceList, parseMetricData)
+		err := writeK8sResourceFile(workDir, resourceName, resourceList, parseMetricData, images, self,
+			redactions)
 
 		if err != nil {
 			return err
@@ -85,20 +137,33 @@ func GetK8sMetricsFromInformer(informers map[string]*cache.SharedIndexInformer,
 }
 
 // writeK8sResourceFile creates a new file in the upload sample directory for the resourceName passed in and writes data
-func writeK8sResourceFile(workDir *os.File, resourceName string,
-	resourceList []interface{}, parseMetricData bool) (rerr error) {
+func writeK8sResourceFile(workDir *util.WorkDir, resourceName string,
+	resourceList []interface{}, parseMetricData bool, images *ImageRewriter, self *SelfTagger,
+	redactions *Redactions) (rerr error) {
 
-	file, err := os.OpenFile(workDir.Name()+"/"+resourceName+".jsonl",
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	name := sample.ResourceFile(resourceName)
+	if workDir.Allow(name) != nil {
+		// the resources are shed as the sample is at its size limit
+		return nil
+	}
+	file, err := workDir.Append(name)
 	if err != nil {
 		return errors.New("error: unable to create kubernetes metric file")
 	}
+	defer util.SafeClose(file.Close, &rerr)
+
 	datawriter := bufio.NewWriter(file)
 
 	for _, k8Resource := range resourceList {
 
+		k8Resource = images.rewrite(k8Resource, redactions)
+		k8Resource = self.Tag(k8Resource)
 		if parseMetricData {
-			k8Resource = sanitizeData(k8Resource)
+			// resources are sanitized as copies, the cached objects keep the data for the next export
+			if o, ok := k8Resource.(runtime.Object); ok {
+				k8Resource = o.DeepCopyObject()
+			}
+			k8Resource = sanitizeData(k8Resource, redactions)
 		}
 
 		data, err := json.Marshal(k8Resource)
@@ -107,31 +172,41 @@ func writeK8sResourceFile(workDir *os.File, resourceName string,
 			return errors.New("error: unable to marshal resource: " + resourceName)
 		}
 		_, err = datawriter.WriteString(string(data) + "\n")
+		if errors.Is(err, util.ErrWriteLimited) {
+			return shedResourceFile(file)
+		}
 		if err != nil {
 			return errors.New("error: unable to write resource to file: " + resourceName)
 		}
 	}
 
 	err = datawriter.Flush()
-	if err != nil {
-		return err
+	if errors.Is(err, util.ErrWriteLimited) {
+		return shedResourceFile(file)
 	}
-	err = file.Close()
+	return err
+}
+
+// shedResourceFile truncates a resource export refused by the size limit of the sample part way through to
+// the whole records written, the rest of the resources are shed
+func shedResourceFile(file *util.WorkDirFile) error {
+	info, err := file.Stat()
 	if err != nil {
 		return err
 	}
-
+	_, err = util.TruncateRecords(file.Name(), info.Size())
 	return err
 }
 
 // nolint: gocyclo
-func sanitizeData(to interface{}) interface{} {
+func sanitizeData(to interface{}, r *Redactions) interface{} {
 	switch to.(type) {
 	case *corev1.Pod:
-		return sanitizePod(to)
+		return sanitizePod(to, r)
 	case *v1apps.DaemonSet:
 		cast := to.(*v1apps.DaemonSet)
-		sanitizeMeta(&cast.ObjectMeta)
+		sanitizeMeta(&cast.ObjectMeta, r)
+		r.Add(RedactWorkloadSpec, 1)
 		cast.Spec.Template = corev1.PodTemplateSpec{}
 		cast.Spec.RevisionHistoryLimit = nil
 		cast.Spec.UpdateStrategy = v1apps.DaemonSetUpdateStrategy{}
@@ -140,14 +215,16 @@ func sanitizeData(to interface{}) interface{} {
 		return cast
 	case *v1apps.ReplicaSet:
 		cast := to.(*v1apps.ReplicaSet)
-		sanitizeMeta(&cast.ObjectMeta)
+		sanitizeMeta(&cast.ObjectMeta, r)
 		cast.Spec.Replicas = nil
+		r.Add(RedactWorkloadSpec, 1)
 		cast.Spec.Template = corev1.PodTemplateSpec{}
 		cast.Spec.MinReadySeconds = 0
 		return cast
 	case *v1apps.Deployment:
 		cast := to.(*v1apps.Deployment)
-		sanitizeMeta(&cast.ObjectMeta)
+		sanitizeMeta(&cast.ObjectMeta, r)
+		r.Add(RedactWorkloadSpec, 1)
 		cast.Spec.Template = corev1.PodTemplateSpec{}
 		cast.Spec.Replicas = nil
 		cast.Spec.Strategy = v1apps.DeploymentStrategy{}
@@ -157,7 +234,8 @@ func sanitizeData(to interface{}) interface{} {
 		return cast
 	case *v1batch.Job:
 		cast := to.(*v1batch.Job)
-		sanitizeMeta(&cast.ObjectMeta)
+		sanitizeMeta(&cast.ObjectMeta, r)
+		r.Add(RedactWorkloadSpec, 1)
 		cast.Spec.Template = corev1.PodTemplateSpec{}
 		cast.Spec.Parallelism = nil
 		cast.Spec.Completions = nil
@@ -170,13 +248,15 @@ func sanitizeData(to interface{}) interface{} {
 		return cast
 	case *v1batch.CronJob:
 		cast := to.(*v1batch.CronJob)
-		sanitizeMeta(&cast.ObjectMeta)
+		sanitizeMeta(&cast.ObjectMeta, r)
 		// cronjobs have no Selector
+		r.Add(RedactWorkloadSpec, 1)
 		cast.Spec = v1batch.CronJobSpec{}
 		return cast
 	case *corev1.Service:
 		cast := to.(*corev1.Service)
-		sanitizeMeta(&cast.ObjectMeta)
+		sanitizeMeta(&cast.ObjectMeta, r)
+		r.Add(RedactWorkloadSpec, 1)
 		cast.Spec.Ports = nil
 		cast.Spec.ClusterIP = ""
 		cast.Spec.ClusterIPs = nil
@@ -197,52 +277,82 @@ func sanitizeData(to interface{}) interface{} {
 		return cast
 	case *corev1.ReplicationController:
 		cast := to.(*corev1.ReplicationController)
-		sanitizeMeta(&cast.ObjectMeta)
+		sanitizeMeta(&cast.ObjectMeta, r)
 		cast.Spec.Replicas = nil
+		r.Add(RedactWorkloadSpec, 1)
 		cast.Spec.Template = nil
 		cast.Spec.MinReadySeconds = 0
 		return cast
 	case *corev1.Namespace:
-		return sanitizeNamespace(to)
+		return sanitizeNamespace(to, r)
 	case *corev1.PersistentVolume:
 		cast := to.(*corev1.PersistentVolume)
-		sanitizeMeta(&cast.ObjectMeta)
+		sanitizeMeta(&cast.ObjectMeta, r)
 		return cast
 	case *corev1.PersistentVolumeClaim:
 		cast := to.(*corev1.PersistentVolumeClaim)
-		sanitizeMeta(&cast.ObjectMeta)
+		sanitizeMeta(&cast.ObjectMeta, r)
 		return cast
 	case *corev1.Node:
 		cast := to.(*corev1.Node)
-		sanitizeMeta(&cast.ObjectMeta)
+		sanitizeMeta(&cast.ObjectMeta, r)
+		return cast
+	case *v1scheduling.PriorityClass:
+		cast := to.(*v1scheduling.PriorityClass)
+		sanitizeMeta(&cast.ObjectMeta, r)
+		return cast
+	case *v1node.RuntimeClass:
+		cast := to.(*v1node.RuntimeClass)
+		sanitizeMeta(&cast.ObjectMeta, r)
 		return cast
 	}
 	return to
 }
 
-func sanitizeMeta(objectMeta *metav1.ObjectMeta) {
+func sanitizeMeta(objectMeta *metav1.ObjectMeta, r *Redactions) {
+	r.Add(RedactManagedFields, len(objectMeta.ManagedFields))
 	objectMeta.ManagedFields = nil
-	delete(objectMeta.Annotations, KubernetesLastAppliedConfig)
+	if _, ok := objectMeta.Annotations[KubernetesLastAppliedConfig]; ok {
+		r.Add(RedactLastAppliedConfiguration, 1)
+		delete(objectMeta.Annotations, KubernetesLastAppliedConfig)
+	}
+	r.Add(RedactFinalizers, len(objectMeta.Finalizers))
 	objectMeta.Finalizers = nil
 }
 
-func sanitizePod(to interface{}) interface{} {
+func sanitizePod(to interface{}, r *Redactions) interface{} {
 	cast := to.(*corev1.Pod)
 
 	// stripping env var and related data from the object
+	r.Add(RedactManagedFields, len(cast.ObjectMeta.ManagedFields))
 	(*cast).ObjectMeta.ManagedFields = nil
-	delete((*cast).ObjectMeta.Annotations, KubernetesLastAppliedConfig)
+	if _, ok := cast.ObjectMeta.Annotations[KubernetesLastAppliedConfig]; ok {
+		r.Add(RedactLastAppliedConfiguration, 1)
+		delete((*cast).ObjectMeta.Annotations, KubernetesLastAppliedConfig)
+	}
 
 	for j, container := range (*cast).Spec.Containers {
-		(*cast).Spec.Containers[j] = sanitizeContainer(container)
+		(*cast).Spec.Containers[j] = sanitizeContainer(container, r)
 	}
 	for j, container := range (*cast).Spec.InitContainers {
-		(*cast).Spec.InitContainers[j] = sanitizeContainer(container)
+		(*cast).Spec.InitContainers[j] = sanitizeContainer(container, r)
 	}
 	return cast
 }
 
-func sanitizeContainer(container corev1.Container) corev1.Container {
+// sanitizeContainer removes the configuration of a container that is not needed for allocation, counting
+// the values removed by each rule
+func sanitizeContainer(container corev1.Container, r *Redactions) corev1.Container {
+	r.Add(RedactContainerEnv, len(container.Env))
+	r.Add(RedactContainerCommand, len(container.Command)+len(container.Args))
+	for _, probe := range []*corev1.Probe{container.LivenessProbe, container.StartupProbe, container.ReadinessProbe} {
+		if probe != nil {
+			r.Add(RedactContainerProbes, 1)
+		}
+	}
+	if container.SecurityContext != nil {
+		r.Add(RedactContainerSecurityContext, 1)
+	}
 	container.Env = nil
 	container.Command = nil
 	container.Args = nil
@@ -256,8 +366,9 @@ func sanitizeContainer(container corev1.Container) corev1.Container {
 	return container
 }
 
-func sanitizeNamespace(to interface{}) interface{} {
+func sanitizeNamespace(to interface{}, r *Redactions) interface{} {
 	cast := to.(*corev1.Namespace)
+	r.Add(RedactManagedFields, len(cast.ObjectMeta.ManagedFields))
 	(*cast).ObjectMeta.ManagedFields = nil
 	return cast
 }
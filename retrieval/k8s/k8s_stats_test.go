@@ -0,0 +1,66 @@
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// sizeLimit is a write limit refusing the writes past max bytes
+type sizeLimit struct {
+	max     int64
+	written int64
+}
+
+func (l *sizeLimit) Allow(name string, n int) error {
+	if l.written+int64(n) > l.max {
+		return fmt.Errorf("%s: %w", name, util.ErrWriteLimited)
+	}
+	l.written += int64(n)
+	return nil
+}
+
+func (l *sizeLimit) Release(_ string, n int64) {
+	l.written -= n
+}
+
+func TestWriteK8sResourceFileLimited(t *testing.T) {
+	dir := t.TempDir()
+	workDir := util.NewWorkDir(dir)
+	workDir.SetWriteLimit(&sizeLimit{max: 6000})
+
+	var namespaces []interface{}
+	for i := 0; i < 200; i++ {
+		namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("ns%d", i)}})
+	}
+	if err := writeK8sResourceFile(workDir, "namespaces", namespaces, false, nil, nil, nil); err != nil {
+		t.Fatalf("expected the resources refused by the limit to be shed, got %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "namespaces.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 || len(data) > 6000 || !strings.HasSuffix(string(data), "\n") {
+		t.Fatalf("expected the export to be truncated to whole records within the limit, got %d bytes", len(data))
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("expected only whole records to remain, got %q", line)
+		}
+	}
+
+	// a resource refused from its first record holds no partial record
+	if err := writeK8sResourceFile(workDir, "pods", namespaces, false, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "pods.jsonl")); len(data) != 0 {
+		t.Errorf("expected the refused export to be empty, got %d bytes", len(data))
+	}
+}
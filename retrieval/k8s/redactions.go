@@ -0,0 +1,85 @@
+package k8s
+
+import (
+	"sync"
+)
+
+// redaction rules applied to exported resources, each counts the values it removed or transformed
+const (
+	// RedactContainerEnv removes the environment variables of containers
+	RedactContainerEnv = "container_env"
+	// RedactContainerCommand removes the command and arguments of containers
+	RedactContainerCommand = "container_command"
+	// RedactContainerProbes removes the liveness, readiness and startup probes of containers
+	RedactContainerProbes = "container_probes"
+	// RedactContainerSecurityContext removes the security context of containers
+	RedactContainerSecurityContext = "container_security_context"
+	// RedactLastAppliedConfiguration removes the last applied configuration annotation, which holds the
+	// full manifest of the resource
+	RedactLastAppliedConfiguration = "last_applied_configuration"
+	// RedactManagedFields removes the managed field entries of resources
+	RedactManagedFields = "managed_fields"
+	// RedactFinalizers removes the finalizers of resources
+	RedactFinalizers = "finalizers"
+	// RedactWorkloadSpec clears the pod templates and settings of workloads and the specs of services
+	RedactWorkloadSpec = "workload_spec"
+	// RewriteImages rewrites the image references of resources, see ImageRewriter
+	RewriteImages = "image_rewrite"
+)
+
+// SanitizeRules are the redaction rules applied when resources are parsed before export
+var SanitizeRules = []string{
+	RedactContainerEnv,
+	RedactContainerCommand,
+	RedactContainerProbes,
+	RedactContainerSecurityContext,
+	RedactLastAppliedConfiguration,
+	RedactManagedFields,
+	RedactFinalizers,
+	RedactWorkloadSpec,
+}
+
+// RuleDescriptions describes each redaction rule for reports
+var RuleDescriptions = map[string]string{
+	RedactContainerEnv:             "environment variables removed from containers",
+	RedactContainerCommand:         "commands and arguments removed from containers",
+	RedactContainerProbes:          "liveness, readiness and startup probes removed from containers",
+	RedactContainerSecurityContext: "security contexts removed from containers",
+	RedactLastAppliedConfiguration: "last applied configuration annotations removed from resources",
+	RedactManagedFields:            "managed field entries removed from resources",
+	RedactFinalizers:               "finalizers removed from resources",
+	RedactWorkloadSpec:             "workload pod templates and service specs cleared",
+	RewriteImages:                  "image references rewritten",
+}
+
+// Redactions counts the values removed or transformed by each redaction rule, never the values themselves.
+// It is safe for concurrent use, and a nil Redactions counts nothing.
+type Redactions struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewRedactions returns a Redactions counting nothing yet
+func NewRedactions() *Redactions {
+	return &Redactions{counts: map[string]int{}}
+}
+
+// Add counts n values redacted by the rule
+func (r *Redactions) Add(rule string, n int) {
+	if r == nil || n == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[rule] += n
+}
+
+// Count returns the number of values redacted by the rule
+func (r *Redactions) Count(rule string) int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts[rule]
+}
@@ -0,0 +1,97 @@
+package k8s
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/util"
+	v1apps "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRedactionCounts(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestRedactionCounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	probe := &corev1.Probe{}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:          "pod",
+			Annotations:   map[string]string{KubernetesLastAppliedConfig: "ReallySecretStuff"},
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}, {Manager: "kubelet"}},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Image: "registry.example.com/init:1.0", Command: []string{"init"}}},
+			Containers: []corev1.Container{{
+				Image:           "registry.example.com/app:1.0",
+				Env:             []corev1.EnvVar{{Name: "A", Value: "ReallySecretStuff"}, {Name: "B"}},
+				Command:         []string{"app"},
+				Args:            []string{"--secret", "ReallySecretStuff"},
+				LivenessProbe:   probe,
+				ReadinessProbe:  probe,
+				SecurityContext: &corev1.SecurityContext{},
+			}},
+		},
+	}
+	deployment := &v1apps.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "deployment", Finalizers: []string{"a"}}}
+	images, err := NewImageRewriter(ImageRewriteStripRegistry, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redactions := NewRedactions()
+	err = writeK8sResourceFile(workDir, "pods", []interface{}{pod}, true, images, nil, redactions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeK8sResourceFile(workDir, "deployments", []interface{}{deployment}, true, images, nil, redactions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		RedactContainerEnv:             2,
+		RedactContainerCommand:         4,
+		RedactContainerProbes:          2,
+		RedactContainerSecurityContext: 1,
+		RedactLastAppliedConfiguration: 1,
+		RedactManagedFields:            2,
+		RedactFinalizers:               1,
+		RedactWorkloadSpec:             1,
+		RewriteImages:                  2,
+	}
+	for rule, count := range expected {
+		if got := redactions.Count(rule); got != count {
+			t.Errorf("expected %d values redacted by %s, got %d", count, rule, got)
+		}
+	}
+	if len(pod.Spec.Containers[0].Env) != 2 || len(pod.ManagedFields) != 2 {
+		t.Error("expected the cached pod to keep its values so the next export redacts them again")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "pods.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "ReallySecretStuff") {
+		t.Errorf("expected redacted values to be removed from the export, got %s", data)
+	}
+
+	var nothing *Redactions
+	nothing.Add(RedactContainerEnv, 1)
+	if nothing.Count(RedactContainerEnv) != 0 {
+		t.Error("expected a nil Redactions to count nothing")
+	}
+	for _, rule := range append(SanitizeRules, RewriteImages) {
+		if RuleDescriptions[rule] == "" {
+			t.Errorf("expected rule %s to be described", rule)
+		}
+	}
+}
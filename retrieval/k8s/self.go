@@ -0,0 +1,57 @@
+package k8s
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SelfAnnotation is added to the agent's own pod and namespace in exported resources, so their usage can be
+// told apart from that of the workloads of the cluster downstream
+const SelfAnnotation = "cloudability.com/metrics-agent"
+
+// SelfTagger tags the agent's own pod and namespace in exported resources. They are tagged rather than
+// removed so the cluster totals stay complete.
+type SelfTagger struct {
+	podName   string
+	namespace string
+}
+
+// NewSelfTagger returns a tagger for the agent's pod in the namespace, or nil if the namespace is empty and
+// nothing is tagged. Only the namespace is tagged if the pod name is empty.
+func NewSelfTagger(podName, namespace string) *SelfTagger {
+	if namespace == "" {
+		return nil
+	}
+	return &SelfTagger{podName: podName, namespace: namespace}
+}
+
+// Tag returns the resource annotated with SelfAnnotation if it is the agent's pod or namespace. Tagged
+// resources are copied rather than modified, as they are the objects cached by the informers.
+func (st *SelfTagger) Tag(resource interface{}) interface{} {
+	if st == nil {
+		return resource
+	}
+	switch cast := resource.(type) {
+	case *corev1.Pod:
+		if st.podName == "" || cast.Name != st.podName || cast.Namespace != st.namespace {
+			return resource
+		}
+		pod := cast.DeepCopy()
+		tagSelf(&pod.Annotations, "pod")
+		return pod
+	case *corev1.Namespace:
+		if cast.Name != st.namespace {
+			return resource
+		}
+		ns := cast.DeepCopy()
+		tagSelf(&ns.Annotations, "namespace")
+		return ns
+	}
+	return resource
+}
+
+func tagSelf(annotations *map[string]string, kind string) {
+	if *annotations == nil {
+		*annotations = map[string]string{}
+	}
+	(*annotations)[SelfAnnotation] = kind
+}
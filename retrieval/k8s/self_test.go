@@ -0,0 +1,42 @@
+package k8s
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSelfTaggerTag(t *testing.T) {
+	agentPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "metrics-agent-0", Namespace: "cloudability"}}
+	otherPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "metrics-agent-0", Namespace: "default"}}
+	agentNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "cloudability",
+		Annotations: map[string]string{"owner": "platform"}}}
+	st := NewSelfTagger("metrics-agent-0", "cloudability")
+
+	pod := st.Tag(agentPod).(*corev1.Pod)
+	if pod.Annotations[SelfAnnotation] != "pod" {
+		t.Errorf("expected the agent pod to be tagged, got %v", pod.Annotations)
+	}
+	if agentPod.Annotations != nil {
+		t.Errorf("expected the cached pod not to be modified, got %v", agentPod.Annotations)
+	}
+	if st.Tag(otherPod) != otherPod {
+		t.Error("expected a pod of the same name in another namespace not to be tagged")
+	}
+
+	ns := st.Tag(agentNamespace).(*corev1.Namespace)
+	if ns.Annotations[SelfAnnotation] != "namespace" || ns.Annotations["owner"] != "platform" {
+		t.Errorf("expected the agent namespace to be tagged, got %v", ns.Annotations)
+	}
+	if _, ok := agentNamespace.Annotations[SelfAnnotation]; ok {
+		t.Error("expected the cached namespace not to be modified")
+	}
+
+	if NewSelfTagger("", "cloudability").Tag(agentPod) != agentPod {
+		t.Error("expected no pod to be tagged without a pod name")
+	}
+	if st := NewSelfTagger("metrics-agent-0", ""); st != nil || st.Tag(agentPod) != agentPod {
+		t.Error("expected nothing to be tagged without a namespace")
+	}
+}
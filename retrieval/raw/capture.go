@@ -0,0 +1,29 @@
+package raw
+
+import "io"
+
+// BodyCapture receives a copy of the response bodies of a client as they are received, before they are
+// parsed or transformed, eg: to retain the raw data of a node for a support escalation
+type BodyCapture interface {
+	// Capture returns the writer the body of the named file is copied to, nil to not copy it. It is called for
+	// each attempt of a request, so the copy of a later attempt replaces that of an earlier one.
+	Capture(filename string) io.WriteCloser
+}
+
+// captureReader copies the body read through it to a capture. A failed copy, eg: as the capture is full,
+// stops the copy but never fails the read.
+type captureReader struct {
+	r      io.Reader
+	w      io.Writer
+	failed bool
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 && !c.failed {
+		if _, werr := c.w.Write(p[:n]); werr != nil {
+			c.failed = true
+		}
+	}
+	return n, err
+}
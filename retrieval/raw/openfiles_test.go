@@ -0,0 +1,135 @@
+package raw
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/util"
+)
+
+// openDescriptors counts the descriptors open in the process, it is only available where /proc is
+func openDescriptors(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("unable to count open descriptors: %v", err)
+	}
+	return len(entries)
+}
+
+func TestOpenFileLimiter(t *testing.T) {
+	t.Run("Ensure a non positive limit is unlimited", func(t *testing.T) {
+		if l := NewOpenFileLimiter(0); l != nil {
+			t.Error("expected no limiter")
+		}
+		var l OpenFileLimiter
+		l.acquire()
+		l.release()
+	})
+
+	t.Run("Ensure the limit is enforced", func(t *testing.T) {
+		l := NewOpenFileLimiter(2)
+		var open, peak int32
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.acquire()
+				n := atomic.AddInt32(&open, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				atomic.AddInt32(&open, -1)
+				l.release()
+			}()
+		}
+		wg.Wait()
+		if peak > 2 {
+			t.Errorf("expected at most 2 open files, got %d", peak)
+		}
+	})
+}
+
+// TestOpenFilesStress collects a realistic worst case of nodes and endpoints with high concurrency and
+// checks that every descriptor is closed once the collection completes
+func TestOpenFilesStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping open file stress test in short mode")
+	}
+	const (
+		nodes       = 3000
+		endpoints   = 3
+		concurrency = 200
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"node":"` + r.URL.Path + `"}`))
+	}))
+	defer ts.Close()
+
+	dir, err := os.MkdirTemp("", "TestOpenFilesStress")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := util.NewWorkDir(dir)
+
+	transport := &http.Transport{MaxIdleConns: concurrency, MaxIdleConnsPerHost: concurrency}
+	client := NewClient(http.Client{Transport: transport}, true, nil, 0, false)
+	client.OpenFiles = NewOpenFileLimiter(64)
+
+	before := openDescriptors(t)
+
+	var failed int32
+	var wg sync.WaitGroup
+	limiter := make(chan struct{}, concurrency)
+	for n := 0; n < nodes; n++ {
+		limiter <- struct{}{}
+		wg.Add(1)
+		go func(n int) {
+			defer func() {
+				<-limiter
+				wg.Done()
+			}()
+			for e := 0; e < endpoints; e++ {
+				source := fmt.Sprintf("stats-endpoint%d-node%d", e, n)
+				if _, err := client.GetRawEndPoint(context.TODO(), http.MethodGet, source, workDir, ts.URL+"/"+source, nil,
+					false); err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+	// connections are not output files, close both ends so only leaked files remain open
+	transport.CloseIdleConnections()
+	ts.CloseClientConnections()
+
+	if failed > 0 {
+		t.Errorf("%d requests failed", failed)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil || len(files) != nodes*endpoints {
+		t.Errorf("expected %d files, got %d: %v", nodes*endpoints, len(files), err)
+	}
+	// closed connections are released asynchronously, allow for descriptors opened by the runtime meanwhile
+	after := openDescriptors(t)
+	for deadline := time.Now().Add(5 * time.Second); after > before+5 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		after = openDescriptors(t)
+	}
+	if after > before+5 {
+		t.Errorf("expected descriptors to be closed, %d open before and %d after", before, after)
+	}
+}
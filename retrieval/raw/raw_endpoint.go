@@ -2,111 +2,240 @@ package raw
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	v1 "k8s.io/api/core/v1"
 	"math"
 	"net/http"
-	"os"
 	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cloudability/metrics-agent/credentials"
 	"github.com/cloudability/metrics-agent/util"
 	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
 	KubernetesLastAppliedConfig = "kubectl.kubernetes.io/last-applied-configuration"
 )
 
+// ErrResponseTooLarge is returned when a response body exceeds the requested size limit
+var ErrResponseTooLarge = errors.New("response exceeded maximum size")
+
+// StatusError is returned when a response has a status code outside of the 2xx range
+type StatusError struct {
+	StatusCode int
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("invalid response %s", strconv.Itoa(e.StatusCode))
+}
+
 // Client defines an HTTP Client
 type Client struct {
 	HTTPClient      *http.Client
 	insecure        bool
-	BearerToken     string
-	BearerTokenPath string
+	Credentials     credentials.Provider
 	retries         uint
 	parseMetricData bool
+	// OpenFiles caps the output files open at once, it may be shared between clients. Nil means no limit.
+	OpenFiles OpenFileLimiter
+	// StallTimeout fails a response with ErrResponseStalled when no bytes of its body are received for the
+	// duration. 0 disables stall detection.
+	StallTimeout time.Duration
+	// Capture receives a copy of each response body as received, nil copies none
+	Capture BodyCapture
 }
 
-// NewClient creates a new raw.Client
-func NewClient(HTTPClient http.Client, insecure bool, bearerToken, bearerTokenPath string, retries uint,
+// OpenFileLimiter caps the number of output files open at once, independently of the number of
+// concurrent requests
+type OpenFileLimiter chan struct{}
+
+// NewOpenFileLimiter returns a limiter allowing up to n open files, or nil for no limit if n is not positive
+func NewOpenFileLimiter(n int) OpenFileLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(OpenFileLimiter, n)
+}
+
+// acquire blocks until a file may be opened
+func (l OpenFileLimiter) acquire() {
+	if l != nil {
+		l <- struct{}{}
+	}
+}
+
+// release marks an open file as closed
+func (l OpenFileLimiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// NewClient creates a new raw.Client. Requests are unauthenticated if creds is nil.
+func NewClient(HTTPClient http.Client, insecure bool, creds credentials.Provider, retries uint,
 	parseMetricData bool) Client {
 	return Client{
 		HTTPClient:      &HTTPClient,
 		insecure:        insecure,
-		BearerToken:     bearerToken,
-		BearerTokenPath: bearerTokenPath,
+		Credentials:     creds,
 		retries:         retries,
 		parseMetricData: parseMetricData,
 	}
 }
 
 // createRequest creates a HTTP request using a given client
-func (c *Client) createRequest(method, url string, body io.Reader) (*http.Request, error) {
+func (c *Client) createRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
 
-	request, err := http.NewRequest(method, url, body)
+	request, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
 
-	if c.BearerToken != "" {
-		request.Header.Add("Authorization", "bearer "+c.BearerToken)
+	if c.Credentials != nil {
+		token, err := c.Credentials.Token()
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			request.Header.Add("Authorization", "bearer "+token)
+		}
 	}
 
-	return request, err
+	return request, nil
+}
+
+// reauthenticate returns true if the request failed as its token was rejected and a fresh token should be
+// tried at once, the token may have been rotated since it was cached
+func (c *Client) reauthenticate(err error) bool {
+	var statusErr StatusError
+	if c.Credentials == nil || !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	c.Credentials.Invalidate()
+	return true
 }
 
 // GetRawEndPoint retrives the body of HTTP response from a given method ,
-// sourcename, working directory, URL, and request body
-func (c *Client) GetRawEndPoint(method, sourceName string,
-	workDir *os.File, URL string, body []byte, verbose bool) (filename string, err error) {
+// sourcename, working directory, URL, and request body. The request is abandoned when ctx is done, failing
+// with an error wrapping the error of ctx.
+func (c *Client) GetRawEndPoint(ctx context.Context, method, sourceName string,
+	workDir *util.WorkDir, URL string, body []byte, verbose bool) (filename string, err error) {
+	return c.GetRawEndPointLimited(ctx, method, sourceName, workDir, URL, body, verbose, 0)
+}
+
+// GetRawEndPointLimited behaves like GetRawEndPoint, but fails with ErrResponseTooLarge and removes
+// the partial file when the response body exceeds maxBytes. A maxBytes of 0 disables the limit.
+func (c *Client) GetRawEndPointLimited(ctx context.Context, method, sourceName string,
+	workDir *util.WorkDir, URL string, body []byte, verbose bool, maxBytes int64) (filename string, err error) {
+	return c.getRawEndPoint(ctx, method, sourceName, workDir, URL, body, verbose, maxBytes, nil)
+}
+
+// GetRawEndPointHashed behaves like GetRawEndPoint, also returning the hex encoded sha256 of the file
+// contents. The hash is computed as the file is written so the file is not read again.
+func (c *Client) GetRawEndPointHashed(ctx context.Context, method, sourceName string,
+	workDir *util.WorkDir, URL string, body []byte, verbose bool) (filename, hash string, err error) {
+	h := NewHashTransform(sha256.New())
+	filename, err = c.getRawEndPoint(ctx, method, sourceName, workDir, URL, body, verbose, 0, []Transform{h})
+	if err != nil {
+		return filename, "", err
+	}
+	return filename, h.Sum(), nil
+}
+
+// GetRawEndPointTransformed behaves like GetRawEndPointLimited, writing the response body through the
+// transforms in order. A body rejected by a transform is returned with the error of the transform and is
+// not retried, the file is left for the caller to keep or remove.
+func (c *Client) GetRawEndPointTransformed(ctx context.Context, method, sourceName string, workDir *util.WorkDir,
+	URL string, body []byte, verbose bool, maxBytes int64, transforms ...Transform) (filename string, err error) {
+	return c.getRawEndPoint(ctx, method, sourceName, workDir, URL, body, verbose, maxBytes, transforms)
+}
+
+func (c *Client) getRawEndPoint(ctx context.Context, method, sourceName string, workDir *util.WorkDir, URL string,
+	body []byte, verbose bool, maxBytes int64, transforms []Transform) (filename string, err error) {
 
 	attempts := c.retries + 1
-	b := bytes.NewBuffer(body)
 
 	for i := uint(0); i < attempts; i++ {
 		if i > 0 {
-			time.Sleep(time.Duration(int64(math.Pow(2, float64(i)))) * time.Second)
+			backoff := time.NewTimer(time.Duration(int64(math.Pow(2, float64(i)))) * time.Second)
+			select {
+			case <-backoff.C:
+			case <-ctx.Done():
+				backoff.Stop()
+				return filename, fmt.Errorf("request abandoned: %w", ctx.Err())
+			}
+		}
+		filename, err = downloadToFile(ctx, c, method, sourceName, workDir, URL, bytes.NewReader(body), maxBytes,
+			transforms)
+		if c.reauthenticate(err) {
+			filename, err = downloadToFile(ctx, c, method, sourceName, workDir, URL, bytes.NewReader(body),
+				maxBytes, transforms)
 		}
-		filename, err = downloadToFile(c, method, sourceName, workDir, URL, b)
 		if err == nil {
 			return filename, nil
 		}
 		if verbose {
 			log.Warnf("%v URL: %s -- retrying: %v", err, URL, i+1)
 		}
+		if err == ErrResponseTooLarge || err == ErrResponseStalled || isTransformError(err) || ctx.Err() != nil ||
+			errors.Is(err, util.ErrWriteLimited) {
+			return filename, err
+		}
 	}
 	return filename, err
 }
 
-func downloadToFile(c *Client, method, sourceName string, workDir *os.File, URL string,
-	body io.Reader) (filename string, rerr error) {
+// downloadToFile writes the response body to a file named for the source in workDir, through the transforms
+func downloadToFile(ctx context.Context, c *Client, method, sourceName string, workDir *util.WorkDir, URL string,
+	body io.Reader, maxBytes int64, transforms []Transform) (filename string, rerr error) {
 
 	var fileExt string
 
-	req, err := c.createRequest(method, URL, body)
+	req, err := c.createRequest(ctx, method, URL, body)
 	if err != nil {
-		return filename, fmt.Errorf("unable to create raw request for %s", sourceName)
+		return filename, fmt.Errorf("unable to create raw request for %s: %v", sourceName, err)
 	}
 
 	if method == http.MethodPost {
 		req.Header.Set("Content-Type", "application/json")
 	}
 
+	// a stalled response is cancelled with its request
+	cancel := func() {}
+	if c.StallTimeout > 0 {
+		var stallCtx context.Context
+		stallCtx, cancel = context.WithCancel(ctx)
+		req = req.WithContext(stallCtx)
+	}
+	defer cancel()
+
 	resp, err := c.HTTPClient.Do(req)
+	if err != nil && ctx.Err() != nil {
+		return filename, fmt.Errorf("request abandoned: %w", ctx.Err())
+	}
 	if err != nil {
-		return filename, errors.New("unable to connect")
+		return filename, fmt.Errorf("unable to connect: %w", err)
 	}
 
 	defer util.SafeClose(resp.Body.Close, &rerr)
+	var stall *stallReader
+	var respBody io.Reader = resp.Body
+	if c.StallTimeout > 0 {
+		stall = newStallReader(resp.Body, c.StallTimeout, cancel)
+		respBody = stall
+	}
 
 	if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
-		return filename, fmt.Errorf("invalid response %s", strconv.Itoa(resp.StatusCode))
+		return filename, StatusError{StatusCode: resp.StatusCode}
 	}
 
 	ct := resp.Header.Get("Content-Type")
@@ -119,44 +248,97 @@ func downloadToFile(c *Client, method, sourceName string, workDir *os.File, URL
 		fileExt = ""
 	}
 
-	rawRespFile, err := os.Create(workDir.Name() + "/" + sourceName + fileExt)
+	if c.Capture != nil {
+		if w := c.Capture.Capture(sourceName + fileExt); w != nil {
+			defer func() { _ = w.Close() }()
+			respBody = &captureReader{r: respBody, w: w}
+		}
+	}
+
+	c.OpenFiles.acquire()
+	defer c.OpenFiles.release()
+
+	rawRespFile, err := workDir.Create(sourceName + fileExt)
 	if err != nil {
-		return filename, errors.New("unable to create raw metric file")
+		return filename, fmt.Errorf("unable to create raw metric file: %w", err)
 	}
 	defer util.SafeClose(rawRespFile.Close, &rerr)
 	filename = rawRespFile.Name()
 
-	if _, ok := ParsableFileSet[sourceName]; c.parseMetricData && ok {
-		err = parseAndWriteData(sourceName, resp.Body, rawRespFile)
-		return filename, err
+	err = c.writeBody(sourceName, filename, respBody, wrapTransforms(rawRespFile, transforms), maxBytes)
+	if rejected := finishTransforms(transforms, err); err == nil {
+		err = rejected
+	}
+	if err != nil && stall.hasStalled() {
+		return filename, removeStalled(workDir, filename)
+	}
+	if err != nil && ctx.Err() != nil {
+		// the partial response of an abandoned request is not kept
+		_ = workDir.Remove(filename)
+		return filename, fmt.Errorf("request abandoned: %w", ctx.Err())
+	}
+	// nor is a response refused by the limit of the work directory part way through
+	if err == ErrResponseTooLarge || errors.Is(err, util.ErrWriteLimited) {
+		_ = workDir.Remove(filename)
 	}
-
-	_, err = io.Copy(rawRespFile, resp.Body)
 	if err != nil {
-		return filename, fmt.Errorf("error writing file: %s", rawRespFile.Name())
+		return filename, err
 	}
 
 	return filename, rerr
 }
 
-// TODO: investigate streamed json reading / writing
+// writeBody writes the response body to w, parsing it first if parsing is enabled for the source
+func (c *Client) writeBody(sourceName, filename string, body io.Reader, w io.Writer, maxBytes int64) error {
+	if _, ok := ParsableFileSet[sourceName]; c.parseMetricData && ok {
+		return parseAndWriteData(sourceName, body, w)
+	}
+
+	if maxBytes > 0 {
+		// read one byte past the limit to detect responses that exceed it
+		n, err := io.Copy(w, io.LimitReader(body, maxBytes+1))
+		if err != nil {
+			return fmt.Errorf("error writing file: %s: %w", filename, err)
+		}
+		if n > maxBytes {
+			return ErrResponseTooLarge
+		}
+		return nil
+	}
+
+	if _, err := io.Copy(w, body); err != nil {
+		return fmt.Errorf("error writing file: %s: %w", filename, err)
+	}
+	return nil
+}
+
+// removeStalled removes the partial file of a stalled response, returning ErrResponseStalled
+func removeStalled(workDir *util.WorkDir, filename string) error {
+	_ = workDir.Remove(filename)
+	return ErrResponseStalled
+}
+
+// parseAndWriteData decodes the response, removes the data not needed for allocation and writes it. List
+// responses are streamed, see parseAndWriteList.
 func parseAndWriteData(filename string, reader io.Reader, writer io.Writer) error {
 	var to = getType(filename)
+	if items, ok := reflect.TypeOf(to).FieldByName("Items"); ok {
+		return parseAndWriteList(filename, items.Type.Elem(), reader, writer)
+	}
 	out := reflect.New(reflect.TypeOf(to))
 	err := json.NewDecoder(reader).Decode(out.Interface())
 
 	if err != nil {
 		return fmt.Errorf("unable to decode data for file: %s", filename)
 	}
-	to = sanitizeData(out.Elem().Interface())
 
-	data, err := json.Marshal(to)
+	data, err := json.Marshal(out.Elem().Interface())
 	if err != nil {
 		return fmt.Errorf("unable to marshal data for file: %s", filename)
 	}
 	_, err = io.Copy(writer, bytes.NewReader(data))
 	if err != nil {
-		return fmt.Errorf("error writing file: %s", filename)
+		return fmt.Errorf("error writing file: %s: %w", filename, err)
 	}
 	return nil
 }
@@ -184,61 +366,35 @@ func getType(filename string) interface{} {
 	return to
 }
 
-func sanitizeData(to interface{}) interface{} {
-	switch to.(type) {
-	case LabelSelectorMatchedResourceList:
-		return sanitizeSelectorMatchedResourceList(to)
-	case PodList:
-		return sanitizePodList(to)
-	case LabelMapMatchedResourceList:
-		return sanitizeMapMatchedResourceList(to)
-	case NamespaceList:
-		return sanitizeNamespaceData(to)
-	}
-	return to
-}
-
-func sanitizeNamespaceData(to interface{}) interface{} {
-	cast := to.(NamespaceList)
-	for i := range cast.Items {
-		cast.Items[i].ObjectMeta.ManagedFields = nil
-	}
-	return cast
-}
-
-func sanitizeSelectorMatchedResourceList(to interface{}) interface{} {
-	cast := to.(LabelSelectorMatchedResourceList)
-	for i := range cast.Items {
-
+// sanitizeItem removes the data not needed for allocation from an item of a list response in place
+func sanitizeItem(item interface{}) {
+	switch cast := item.(type) {
+	case *LabelSelectorMatchedResource:
+		sanitizeMeta(&cast.ObjectMeta)
+	case *corev1.Pod:
 		// stripping env var and related data from the object
-		cast.Items[i].ObjectMeta.ManagedFields = nil
-		if _, ok := cast.Items[i].ObjectMeta.Annotations[KubernetesLastAppliedConfig]; ok {
-			delete(cast.Items[i].ObjectMeta.Annotations, KubernetesLastAppliedConfig)
+		sanitizeMeta(&cast.ObjectMeta)
+		for j, container := range cast.Spec.Containers {
+			cast.Spec.Containers[j] = sanitizeContainer(container)
+		}
+		for j, container := range cast.Spec.InitContainers {
+			cast.Spec.InitContainers[j] = sanitizeContainer(container)
 		}
+	case *LabelMapMatchedResource:
+		sanitizeMeta(&cast.ObjectMeta)
+		cast.Finalizers = nil
+	case *corev1.Namespace:
+		cast.ObjectMeta.ManagedFields = nil
 	}
-	return cast
 }
 
-func sanitizePodList(to interface{}) interface{} {
-	cast := to.(PodList)
-	for i := range cast.Items {
-
-		// stripping env var and related data from the object
-		cast.Items[i].ObjectMeta.ManagedFields = nil
-		if _, ok := cast.Items[i].ObjectMeta.Annotations[KubernetesLastAppliedConfig]; ok {
-			delete(cast.Items[i].ObjectMeta.Annotations, KubernetesLastAppliedConfig)
-		}
-		for j, container := range cast.Items[i].Spec.Containers {
-			cast.Items[i].Spec.Containers[j] = sanitizeContainer(container)
-		}
-		for j, container := range cast.Items[i].Spec.InitContainers {
-			cast.Items[i].Spec.InitContainers[j] = sanitizeContainer(container)
-		}
-	}
-	return cast
+// sanitizeMeta strips the managed fields and the last applied configuration of a resource
+func sanitizeMeta(objectMeta *metav1.ObjectMeta) {
+	objectMeta.ManagedFields = nil
+	delete(objectMeta.Annotations, KubernetesLastAppliedConfig)
 }
 
-func sanitizeContainer(container v1.Container) v1.Container {
+func sanitizeContainer(container corev1.Container) corev1.Container {
 	container.Env = nil
 	container.Command = nil
 	container.Args = nil
@@ -251,17 +407,3 @@ func sanitizeContainer(container v1.Container) v1.Container {
 	container.SecurityContext = nil
 	return container
 }
-
-func sanitizeMapMatchedResourceList(to interface{}) interface{} {
-	cast := to.(LabelMapMatchedResourceList)
-	for i := range cast.Items {
-
-		// stripping env var and related data from the object
-		cast.Items[i].ObjectMeta.ManagedFields = nil
-		if _, ok := cast.Items[i].ObjectMeta.Annotations[KubernetesLastAppliedConfig]; ok {
-			delete(cast.Items[i].ObjectMeta.Annotations, KubernetesLastAppliedConfig)
-		}
-		cast.Items[i].Finalizers = nil
-	}
-	return cast
-}
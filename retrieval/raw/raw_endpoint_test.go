@@ -1,12 +1,23 @@
 package raw
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/credentials"
+	"github.com/cloudability/metrics-agent/util"
+	"io"
 )
 
 func rawEndpointTests(t testing.TB) {
@@ -16,6 +27,7 @@ func rawEndpointTests(t testing.TB) {
 		ensureNetworkErrorsAreHandled,
 		ensureThatFileParsedAndCreatedForPodsData,
 		ensureThatFileCreatedForPodsData,
+		ensureThatFileHashIsReturned,
 	}
 	for _, v := range scenarios {
 		v(t)
@@ -49,26 +61,54 @@ func ensureThatErrorsAreHandled(t testing.TB) {
 	client := NewClient(
 		*httpClient,
 		true,
-		"",
-		"",
+		nil,
 		2,
 		false,
 	)
 
 	wd, _ := os.MkdirTemp("", "raw_endpoint_test")
-	workingDir, _ := os.Open(wd)
+	workingDir := util.NewWorkDir(wd)
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(404)
 	}))
 	defer ts.Close()
 
-	_, err := client.GetRawEndPoint(http.MethodGet, "heapster", workingDir, ts.URL, nil, true)
+	_, err := client.GetRawEndPoint(context.TODO(), http.MethodGet, "heapster", workingDir, ts.URL, nil, true)
 	if err == nil {
 		t.Error("Server returned invalid response code but function did not raise error")
 	}
 }
 
+func ensureThatFileHashIsReturned(t testing.TB) {
+	// parsed data is rewritten, the hash must be of the file contents rather than the response
+	client := NewClient(*http.DefaultClient, true, nil, 0, true)
+
+	wd, _ := os.MkdirTemp("", "raw_endpoint_test")
+	defer os.RemoveAll(wd)
+	workingDir := util.NewWorkDir(wd)
+
+	body, _ := os.ReadFile("../../testdata/pods.json")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	filename, hash, err := client.GetRawEndPointHashed(context.TODO(), http.MethodGet, "pods", workingDir, ts.URL, nil,
+		true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(contents)
+	if hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the hash of the file contents, got %s", hash)
+	}
+}
+
 func ensureThatFileCreatedForHeapsterData(t testing.TB) {
 	ensureThatFileCreated(t, "../../testdata/heapster-metric-export.json", "heapster", true, false)
 }
@@ -86,14 +126,13 @@ func ensureThatFileCreated(t testing.TB, testData string, source string, parseDa
 	client := NewClient(
 		*httpClient,
 		true,
-		"",
-		"",
+		nil,
 		2,
 		parseData,
 	)
 
 	wd, _ := os.MkdirTemp("", "raw_endpoint_test")
-	workingDir, _ := os.Open(wd)
+	workingDir := util.NewWorkDir(wd)
 
 	body, _ := os.ReadFile(testData)
 
@@ -102,7 +141,7 @@ func ensureThatFileCreated(t testing.TB, testData string, source string, parseDa
 	}))
 	defer ts.Close()
 
-	testFileName, err := client.GetRawEndPoint(http.MethodGet, source, workingDir, ts.URL, nil, true)
+	testFileName, err := client.GetRawEndPoint(context.TODO(), http.MethodGet, source, workingDir, ts.URL, nil, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -151,17 +190,287 @@ func ensureNetworkErrorsAreHandled(t testing.TB) {
 	client := NewClient(
 		*httpClient,
 		true,
-		"",
-		"",
+		nil,
 		2,
 		false,
 	)
 
 	wd, _ := os.MkdirTemp("", "raw_endpoint_test")
-	workingDir, _ := os.Open(wd)
+	workingDir := util.NewWorkDir(wd)
 
-	_, err := client.GetRawEndPoint(http.MethodGet, "heapster", workingDir, "http://localhost:1234", nil, true)
+	_, err := client.GetRawEndPoint(context.TODO(), http.MethodGet, "heapster", workingDir, "http://localhost:1234",
+		nil, true)
 	if err == nil {
 		t.Error("Unable to to connect to server but function did not raise error")
 	}
 }
+
+func TestStalledResponse(t *testing.T) {
+	wd, err := os.MkdirTemp("", "TestStalledResponse")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	workingDir := util.NewWorkDir(wd)
+
+	// trickle writes the chunks of the body gap apart, until the request is cancelled
+	trickle := func(chunks int, gap time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			for i := 0; i < chunks; i++ {
+				fmt.Fprint(w, "chunk\n")
+				w.(http.Flusher).Flush()
+				select {
+				case <-time.After(gap):
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}))
+	}
+	client := NewClient(*http.DefaultClient, true, nil, 2, false)
+	client.StallTimeout = 200 * time.Millisecond
+
+	t.Run("Ensure a response stalled mid-body fails without retrying", func(t *testing.T) {
+		ts := trickle(2, time.Minute)
+		defer ts.Close()
+		start := time.Now()
+		filename, err := client.GetRawEndPoint(context.TODO(), http.MethodGet, "stalled", workingDir, ts.URL, nil, true)
+		if err != ErrResponseStalled {
+			t.Fatalf("expected the response to stall, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected the stalled response to fail without retrying, took %v", elapsed)
+		}
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("expected the partial file to be removed: %v", err)
+		}
+	})
+
+	t.Run("Ensure a slow response receiving bytes within the stall timeout succeeds", func(t *testing.T) {
+		ts := trickle(5, 50*time.Millisecond)
+		defer ts.Close()
+		filename, err := client.GetRawEndPoint(context.TODO(), http.MethodGet, "slow", workingDir, ts.URL, nil, true)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if data, _ := os.ReadFile(filename); len(data) != 5*len("chunk\n") {
+			t.Errorf("expected the whole response, got %q", data)
+		}
+	})
+}
+
+func TestCancelledRequest(t *testing.T) {
+	wd, err := os.MkdirTemp("", "TestCancelledRequest")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	workingDir := util.NewWorkDir(wd)
+
+	// the server sends part of the body then hangs until the request is abandoned
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "partial")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	client := NewClient(*http.DefaultClient, true, nil, 2, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	filename, err := client.GetRawEndPoint(ctx, http.MethodGet, "hung", workingDir, ts.URL, nil, true)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request to be cancelled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the request to be abandoned without retrying, took %v", elapsed)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("expected the partial file to be removed: %v", err)
+	}
+}
+
+// refusingLimit is a write limit refusing every write past the first max bytes
+type refusingLimit struct {
+	max     int64
+	written int64
+}
+
+func (l *refusingLimit) Allow(name string, n int) error {
+	if l.written+int64(n) > l.max {
+		return fmt.Errorf("%s: %w", name, util.ErrWriteLimited)
+	}
+	l.written += int64(n)
+	return nil
+}
+
+func (l *refusingLimit) Release(_ string, n int64) {
+	l.written -= n
+}
+
+func TestWriteLimitedResponse(t *testing.T) {
+	workingDir := util.NewWorkDir(t.TempDir())
+	limit := &refusingLimit{max: 10}
+	workingDir.SetWriteLimit(limit)
+
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, strings.Repeat("chunk\n", 100))
+	}))
+	defer ts.Close()
+	client := NewClient(*http.DefaultClient, true, nil, 2, false)
+
+	filename, err := client.GetRawEndPoint(context.TODO(), http.MethodGet, "limited", workingDir, ts.URL, nil, true)
+	if !errors.Is(err, util.ErrWriteLimited) {
+		t.Fatalf("expected the response to be refused by the write limit, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("expected a refused response not to be retried, requested %d times", requests)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("expected the partial file to be removed: %v", err)
+	}
+	if limit.written != 0 {
+		t.Errorf("expected the partial file to be released, %d bytes still written", limit.written)
+	}
+}
+
+func TestRotatedToken(t *testing.T) {
+	wd, err := os.MkdirTemp("", "TestRotatedToken")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	workingDir := util.NewWorkDir(wd)
+
+	tokenFile := filepath.Join(wd, "token")
+	if err := os.WriteFile(tokenFile, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server only accepts the token currently in the file, as the API server does once a token expires
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current, _ := os.ReadFile(tokenFile)
+		received = append(received, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "bearer "+string(current) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+	client := NewClient(*http.DefaultClient, true, credentials.NewFileProvider(tokenFile, time.Hour), 0, false)
+
+	if _, err := client.GetRawEndPoint(context.TODO(), http.MethodGet, "first", workingDir, ts.URL, nil,
+		false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the token is rotated without changing the modification time of the file, so only the rejection of
+	// the cached token causes the file to be read again
+	if err := os.WriteFile(tokenFile, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(tokenFile, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range []string{"second", "third"} {
+		if _, err := client.GetRawEndPoint(context.TODO(), http.MethodGet, source, workingDir, ts.URL, nil,
+			false); err != nil {
+			t.Fatalf("expected the rotated token to be used, got %v", err)
+		}
+	}
+
+	expected := []string{"bearer first", "bearer first", "bearer second", "bearer second"}
+	if strings.Join(received, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected tokens %v, got %v", expected, received)
+	}
+}
+
+// bufferCapture captures response bodies into buffers, accepting up to limit bytes of each if limit is set
+type bufferCapture struct {
+	limit    int
+	captured map[string]*limitedBuffer
+}
+
+type limitedBuffer struct {
+	strings.Builder
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.limit > 0 && b.Len()+len(p) > b.limit {
+		return 0, errors.New("capture full")
+	}
+	return b.Builder.Write(p)
+}
+
+func (b *limitedBuffer) Close() error { return nil }
+
+func (c *bufferCapture) Capture(filename string) io.WriteCloser {
+	b := &limitedBuffer{limit: c.limit}
+	c.captured[filename] = b
+	return b
+}
+
+func TestBodyCapture(t *testing.T) {
+	wd, err := os.MkdirTemp("", "TestBodyCapture")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	workingDir := util.NewWorkDir(wd)
+
+	body, err := os.ReadFile("../../testdata/pods.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	t.Run("Ensure the body is captured before it is parsed", func(t *testing.T) {
+		capture := &bufferCapture{captured: map[string]*limitedBuffer{}}
+		client := NewClient(*http.DefaultClient, true, nil, 0, true)
+		client.Capture = capture
+		filename, err := client.GetRawEndPoint(context.TODO(), http.MethodGet, "pods", workingDir, ts.URL, nil, true)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		captured, ok := capture.captured[filepath.Base(filename)]
+		if !ok || captured.String() != string(body) {
+			t.Fatalf("expected the unparsed body to be captured as %s, got %v", filepath.Base(filename),
+				capture.captured)
+		}
+		written, _ := os.ReadFile(filename)
+		if strings.Contains(string(written), KubernetesLastAppliedConfig) {
+			t.Errorf("expected the written file to be parsed")
+		}
+	})
+
+	t.Run("Ensure a full capture does not fail the request", func(t *testing.T) {
+		capture := &bufferCapture{limit: 100, captured: map[string]*limitedBuffer{}}
+		client := NewClient(*http.DefaultClient, true, nil, 0, false)
+		client.Capture = capture
+		filename, err := client.GetRawEndPoint(context.TODO(), http.MethodGet, "pods", workingDir, ts.URL, nil, true)
+		if err != nil {
+			t.Fatalf("expected the request to succeed, got %v", err)
+		}
+		if written, _ := os.ReadFile(filename); len(written) != len(body) {
+			t.Errorf("expected the whole body to be written, got %d of %d bytes", len(written), len(body))
+		}
+		if captured := capture.captured[filepath.Base(filename)]; captured.Len() > 100 {
+			t.Errorf("expected the capture to stop at its limit, got %d bytes", captured.Len())
+		}
+	})
+}
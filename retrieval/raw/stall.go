@@ -0,0 +1,53 @@
+package raw
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ErrResponseStalled is returned when no bytes of a response body are received for the stall timeout of
+// the client
+var ErrResponseStalled = errors.New("response stalled")
+
+// stallReader reads a response body, cancelling the request when a read receives no bytes for the stall
+// timeout. Each read has its own deadline, so time spent writing the body out is not counted.
+type stallReader struct {
+	body    io.Reader
+	timeout time.Duration
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+func newStallReader(body io.Reader, timeout time.Duration, cancel context.CancelFunc) *stallReader {
+	return &stallReader{body: body, timeout: timeout, cancel: cancel}
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	if r.timer == nil {
+		r.timer = time.AfterFunc(r.timeout, r.stall)
+	} else {
+		r.timer.Reset(r.timeout)
+	}
+	n, err := r.body.Read(p)
+	r.timer.Stop()
+	if err != nil && r.stalled.Load() {
+		return n, ErrResponseStalled
+	}
+	return n, err
+}
+
+// stall cancels the request, failing the blocked read
+func (r *stallReader) stall() {
+	r.stalled.Store(true)
+	r.cancel()
+}
+
+// hasStalled returns true if the request was cancelled as the response stalled, false if stall detection
+// is disabled
+func (r *stallReader) hasStalled() bool {
+	return r != nil && r.stalled.Load()
+}
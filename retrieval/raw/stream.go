@@ -0,0 +1,138 @@
+package raw
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// listItemsKey is the key of the items of a list response
+const listItemsKey = "items"
+
+// parseAndWriteList decodes a list response one item at a time, sanitizing and writing each before the next
+// is decoded, so only a single item is held in memory however large the list. The output is that of the
+// whole list decoded at once: the fields of the ListResponse preceding the items, then the items. Fields
+// following the items are not written, the API server and kubelets write the items last.
+func parseAndWriteList(filename string, itemType reflect.Type, reader io.Reader, writer io.Writer) error {
+	dec := json.NewDecoder(reader)
+	if err := expectDelim(dec, '{'); err != nil {
+		return fmt.Errorf("unable to decode data for file: %s: %v", filename, err)
+	}
+
+	header := map[string]json.RawMessage{}
+	wroteItems := false
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("unable to decode data for file: %s: %v", filename, err)
+		}
+		key, _ := token.(string)
+		if key != listItemsKey || wroteItems {
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return fmt.Errorf("unable to decode data for file: %s: %v", filename, err)
+			}
+			if !wroteItems {
+				header[key] = value
+			}
+			continue
+		}
+		if err := writeListHeader(header, writer); err != nil {
+			return fmt.Errorf("error writing file: %s: %w", filename, err)
+		}
+		if err := writeListItems(dec, itemType, writer); err != nil {
+			return fmt.Errorf("unable to stream items for file: %s: %w", filename, err)
+		}
+		wroteItems = true
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return fmt.Errorf("unable to decode data for file: %s: %v", filename, err)
+	}
+
+	closing := "}"
+	if !wroteItems {
+		if err := writeListHeader(header, writer); err != nil {
+			return fmt.Errorf("error writing file: %s: %w", filename, err)
+		}
+		closing = "null}"
+	}
+	if _, err := io.WriteString(writer, closing); err != nil {
+		return fmt.Errorf("error writing file: %s: %w", filename, err)
+	}
+	return nil
+}
+
+// writeListHeader writes the opening of a list up to its items, the fields of the ListResponse decoded from
+// the fields of the response preceding the items
+func writeListHeader(fields map[string]json.RawMessage, writer io.Writer) error {
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	var header ListResponse
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return err
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	data = append(bytes.TrimSuffix(data, []byte("}")), []byte(`,"`+listItemsKey+`":`)...)
+	_, err = writer.Write(data)
+	return err
+}
+
+// writeListItems decodes the items array one item at a time, writing each sanitized item before the next is
+// decoded
+func writeListItems(dec *json.Decoder, itemType reflect.Type, writer io.Writer) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		_, err = io.WriteString(writer, "null")
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected an array of items, got %v", token)
+	}
+	if _, err := io.WriteString(writer, "["); err != nil {
+		return err
+	}
+	for i := 0; dec.More(); i++ {
+		item := reflect.New(itemType).Interface()
+		if err := dec.Decode(item); err != nil {
+			return err
+		}
+		sanitizeItem(item)
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			data = append([]byte(","), data...)
+		}
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return err
+	}
+	_, err = io.WriteString(writer, "]")
+	return err
+}
+
+// expectDelim reads the next token, which must be the delimiter
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := token.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %v, got %v", delim, token)
+	}
+	return nil
+}
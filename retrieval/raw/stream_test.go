@@ -0,0 +1,154 @@
+package raw
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseAndWriteList(t *testing.T) {
+	t.Run("Ensure streamed output matches the whole list decoded at once", func(t *testing.T) {
+		body, err := os.ReadFile("../../testdata/pods.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list PodList
+		if err := json.Unmarshal(body, &list); err != nil {
+			t.Fatal(err)
+		}
+		for i := range list.Items {
+			sanitizeItem(&list.Items[i])
+		}
+		expected, err := json.Marshal(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		if err := parseAndWriteData(Pods, bytes.NewReader(body), &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != string(expected) {
+			t.Errorf("expected the streamed list to match the decoded list\nexpected: %s\ngot: %s", expected,
+				out.String())
+		}
+		if strings.Contains(out.String(), "superSecret") {
+			t.Error("expected the streamed list to be sanitized")
+		}
+	})
+
+	tests := []struct {
+		name     string
+		in       string
+		expected string
+		wantErr  bool
+	}{
+		{name: "empty items", in: `{"kind":"NamespaceList","items":[]}`,
+			expected: `"kind":"NamespaceList","metadata":null,`},
+		{name: "null items", in: `{"items":null,"kind":"NamespaceList"}`, expected: `"items":null}`},
+		{name: "no items", in: `{"kind":"NamespaceList"}`, expected: `"kind":"NamespaceList"`},
+		{name: "fields following the items", in: `{"items":[{"metadata":{"name":"a"}}],"kind":"NamespaceList"}`,
+			expected: `"kind":"","metadata":null`},
+		{name: "not an object", in: `[]`, wantErr: true},
+		{name: "items not an array", in: `{"items":{}}`, wantErr: true},
+		{name: "truncated", in: `{"items":[{"metadata":{"name":"a"}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := parseAndWriteData(Namespaces, strings.NewReader(tt.in), &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !json.Valid(out.Bytes()) || !strings.Contains(out.String(), tt.expected) {
+				t.Errorf("expected valid JSON containing %s, got %s", tt.expected, out.String())
+			}
+			var decoded NamespaceList
+			if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+				t.Errorf("expected the output to decode as a list: %v", err)
+			}
+		})
+	}
+}
+
+// syntheticPodList generates a pod list response of at least size bytes without holding it in memory
+type syntheticPodList struct {
+	size    int64
+	written int64
+	pod     int
+	buf     bytes.Buffer
+	done    bool
+}
+
+func (l *syntheticPodList) Read(p []byte) (int, error) {
+	for l.buf.Len() < len(p) && !l.done {
+		switch {
+		case l.written == 0 && l.pod == 0:
+			l.buf.WriteString(`{"kind":"PodList","apiVersion":"v1","metadata":{"resourceVersion":"1"},"items":[`)
+		case l.written >= l.size:
+			l.buf.WriteString(`]}`)
+			l.done = true
+			continue
+		case l.pod > 0:
+			l.buf.WriteString(",")
+		}
+		fmt.Fprintf(&l.buf, `{"metadata":{"name":"pod-%d","namespace":"default","annotations":{%q:%q}},`+
+			`"spec":{"containers":[{"name":"app","image":"app:1.0","env":[{"name":"SECRET","value":%q}]}]}}`,
+			l.pod, KubernetesLastAppliedConfig, strings.Repeat("x", 8<<10), strings.Repeat("s", 4<<10))
+		l.pod++
+		l.written = int64(l.pod) * 13 << 10
+	}
+	n, _ := l.buf.Read(p)
+	if n == 0 && l.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// heapSampler records the peak heap in use while a response is read
+type heapSampler struct {
+	r     io.Reader
+	reads int
+	peak  uint64
+}
+
+func (s *heapSampler) Read(p []byte) (int, error) {
+	if s.reads%256 == 0 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapInuse > s.peak {
+			s.peak = m.HeapInuse
+		}
+	}
+	s.reads++
+	return s.r.Read(p)
+}
+
+// BenchmarkParseLargePodList streams a synthetic 200MB pod list page, the peak heap must stay near the size of
+// a single pod rather than the page
+func BenchmarkParseLargePodList(b *testing.B) {
+	const pageSize = 200 << 20
+	for n := 0; n < b.N; n++ {
+		runtime.GC()
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+		sampler := &heapSampler{r: &syntheticPodList{size: pageSize}}
+		if err := parseAndWriteData(Pods, sampler, io.Discard); err != nil {
+			b.Fatal(err)
+		}
+		growth := int64(sampler.peak) - int64(before.HeapInuse)
+		b.ReportMetric(float64(growth)/(1<<20), "peak-heap-MB")
+		if growth > 32<<20 {
+			b.Fatalf("expected the peak heap to stay near the size of a single pod, grew %d MB decoding a "+
+				"%d MB page", growth>>20, pageSize>>20)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package raw
+
+import (
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+)
+
+// Transform processes a response body as it is written to its file, so post-collection steps such as
+// validation and hashing do not read the file back
+type Transform interface {
+	// Wrap returns the writer the body is written through, writing its output to w. It is called for each
+	// attempt of a request, so must discard any state of an earlier attempt.
+	Wrap(w io.Writer) io.Writer
+	// Finish is called once the body has been written, or writing it failed with writeErr, and must release
+	// anything held by the attempt. It returns an error if the written body is rejected.
+	Finish(writeErr error) error
+}
+
+// transformError is returned when a transform rejects a body. The request is not retried as the same body
+// is expected in response.
+type transformError struct {
+	err error
+}
+
+func (e transformError) Error() string {
+	return e.err.Error()
+}
+
+func (e transformError) Unwrap() error {
+	return e.err
+}
+
+// isTransformError returns true if the error is the rejection of a body by a transform
+func isTransformError(err error) bool {
+	var te transformError
+	return errors.As(err, &te)
+}
+
+// wrapTransforms chains the transforms in front of w, the body is written through them in order
+func wrapTransforms(w io.Writer, transforms []Transform) io.Writer {
+	for i := len(transforms) - 1; i >= 0; i-- {
+		w = transforms[i].Wrap(w)
+	}
+	return w
+}
+
+// finishTransforms finishes every transform, returning the first rejection of the body
+func finishTransforms(transforms []Transform, writeErr error) error {
+	var rejected error
+	for _, t := range transforms {
+		if err := t.Finish(writeErr); err != nil && rejected == nil {
+			rejected = transformError{err: err}
+		}
+	}
+	return rejected
+}
+
+// HashTransform computes the hash of a body as it is written
+type HashTransform struct {
+	h hash.Hash
+}
+
+// NewHashTransform returns a transform computing the hash of a body with h
+func NewHashTransform(h hash.Hash) *HashTransform {
+	return &HashTransform{h: h}
+}
+
+// Wrap implements Transform
+func (t *HashTransform) Wrap(w io.Writer) io.Writer {
+	t.h.Reset()
+	return io.MultiWriter(w, t.h)
+}
+
+// Finish implements Transform
+func (t *HashTransform) Finish(error) error {
+	return nil
+}
+
+// Sum returns the hex encoded hash of the body
+func (t *HashTransform) Sum() string {
+	return hex.EncodeToString(t.h.Sum(nil))
+}
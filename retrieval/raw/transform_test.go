@@ -0,0 +1,160 @@
+package raw
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/util"
+)
+
+// lineCheck is a transform counting the lines of a body, rejecting a body not ending with a newline
+type lineCheck struct {
+	lines int
+	last  byte
+}
+
+func (c *lineCheck) Wrap(w io.Writer) io.Writer {
+	c.lines, c.last = 0, 0
+	return io.MultiWriter(w, c)
+}
+
+func (c *lineCheck) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		c.lines += bytes.Count(p, []byte("\n"))
+		c.last = p[len(p)-1]
+	}
+	return len(p), nil
+}
+
+func (c *lineCheck) Finish(writeErr error) error {
+	if writeErr == nil && c.last != '\n' {
+		return errors.New("body is truncated")
+	}
+	return nil
+}
+
+func TestGetRawEndPointTransformed(t *testing.T) {
+	wd, err := os.MkdirTemp("", "TestGetRawEndPointTransformed")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	workingDir := util.NewWorkDir(wd)
+
+	var requests int
+	body := "a 1\nb 2\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+	client := NewClient(*http.DefaultClient, true, nil, 2, false)
+
+	t.Run("Ensure the body is written through each transform", func(t *testing.T) {
+		lines, hash := &lineCheck{}, NewHashTransform(sha256.New())
+		filename, err := client.GetRawEndPointTransformed(context.TODO(), http.MethodGet, "metrics", workingDir, ts.URL, nil, true,
+			0, lines, hash)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, _ := os.ReadFile(filename)
+		sum := sha256.Sum256(data)
+		if string(data) != body || lines.lines != 2 || hash.Sum() != fmt.Sprintf("%x", sum) {
+			t.Errorf("unexpected transform results: %q %d %s", data, lines.lines, hash.Sum())
+		}
+	})
+
+	t.Run("Ensure a rejected body is not retried", func(t *testing.T) {
+		requests = 0
+		body = "a 1\nb"
+		_, err := client.GetRawEndPointTransformed(context.TODO(), http.MethodGet, "metrics", workingDir, ts.URL, nil, true,
+			0, &lineCheck{})
+		if err == nil || err.Error() != "body is truncated" || requests != 1 {
+			t.Errorf("expected the body to be rejected once, got %v after %d requests", err, requests)
+		}
+	})
+}
+
+// TestTransformMemoryBudget guards against post-collection steps holding node files in memory, a large
+// cadvisor response must be written and transformed within a fraction of its size
+func TestTransformMemoryBudget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping memory budget test in short mode")
+	}
+	const size = 200 << 20
+	const budget = 64 << 20
+
+	wd, err := os.MkdirTemp("", "TestTransformMemoryBudget")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(wd)
+	workingDir := util.NewWorkDir(wd)
+
+	// the synthetic cadvisor response is generated as it is sent
+	line := []byte(`container_cpu_usage_seconds_total{container="app",namespace="default",pod="app-0"} 1.5` + "\n")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for written := 0; written+len(line) <= size; written += len(line) {
+			if _, err := w.Write(line); err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(budget))
+	runtime.GC()
+
+	// sample the live heap while the response is processed
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		s := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		for {
+			metrics.Read(s)
+			if v := s[0].Value.Uint64(); v > peak.Load() {
+				peak.Store(v)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	client := NewClient(*http.DefaultClient, true, nil, 0, false)
+	lines := &lineCheck{}
+	filename, err := client.GetRawEndPointTransformed(context.TODO(), http.MethodGet, "stats-cadvisor_metrics-node0",
+		workingDir, ts.URL, nil, false, 0, lines, NewHashTransform(sha256.New()))
+	close(done)
+	<-sampled
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fi, err := os.Stat(filename); err != nil || fi.Size() < size-int64(len(line)) {
+		t.Fatalf("expected the whole response to be written: %v", err)
+	}
+	if lines.lines != size/len(line) {
+		t.Errorf("expected %d lines, got %d", size/len(line), lines.lines)
+	}
+	if peak.Load() > budget {
+		t.Errorf("expected processing within %d bytes of heap, peaked at %d bytes", budget, peak.Load())
+	}
+}
@@ -0,0 +1,160 @@
+package sample
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// HashFile returns the hex encoded sha256 of the contents of a file
+func HashFile(path string) (hash string, rerr error) {
+	//nolint gas
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := f.Close(); rerr == nil {
+			rerr = err
+		}
+	}()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReadManifest reads the manifest of the sample in dir
+func ReadManifest(dir string) (Manifest, error) {
+	var m Manifest
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(data, &m)
+}
+
+// VerifyHashes checks the hex encoded sha256 of the files found in a sample against the hashes in its
+// manifest. It returns a description of each file that is missing, not listed in the manifest or differs
+// from the file collected, none if the sample is intact.
+func VerifyHashes(m Manifest, found map[string]string) []string {
+	if len(m.FileHashes) == 0 {
+		return []string{"the manifest holds no file hashes, it was written by an agent that did not hash files"}
+	}
+	var problems []string
+	for _, name := range m.Files {
+		hash, ok := found[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s is listed in the manifest but missing", name))
+		case m.FileHashes[name] == "":
+			problems = append(problems, fmt.Sprintf("%s has no hash in the manifest", name))
+		case hash != m.FileHashes[name]:
+			problems = append(problems, fmt.Sprintf("%s has sha256 %s, the manifest records %s", name, hash,
+				m.FileHashes[name]))
+		}
+	}
+	listed := make(map[string]bool, len(m.Files))
+	for _, name := range m.Files {
+		listed[name] = true
+	}
+	var unlisted []string
+	for name := range found {
+		if !listed[name] && name != ManifestFile {
+			unlisted = append(unlisted, name)
+		}
+	}
+	sort.Strings(unlisted)
+	for _, name := range unlisted {
+		problems = append(problems, fmt.Sprintf("%s is not listed in the manifest", name))
+	}
+	return problems
+}
+
+// VerifyDir recomputes the hashes of the files in the sample directory and checks them against its
+// manifest, see VerifyHashes
+func VerifyDir(dir string) ([]string, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sample manifest: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list sample directory: %v", err)
+	}
+	found := make(map[string]string, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == ManifestFile {
+			continue
+		}
+		if found[e.Name()], err = HashFile(filepath.Join(dir, e.Name())); err != nil {
+			return nil, fmt.Errorf("unable to hash sample file: %v", err)
+		}
+	}
+	return VerifyHashes(m, found), nil
+}
+
+// VerifyArchive checks the samples in a gzipped tar archive of the export directory against their manifests,
+// hashing each file as it is read from the archive. It returns the problems found keyed by sample directory,
+// none if every sample is intact.
+func VerifyArchive(r io.Reader) (map[string][]string, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read archive: %v", err)
+	}
+	manifests := make(map[string]Manifest)
+	found := make(map[string]map[string]string)
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read archive: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		dir, name := path.Split(header.Name)
+		dir = path.Clean(dir)
+		if name == ManifestFile {
+			var m Manifest
+			if err := json.NewDecoder(tr).Decode(&m); err != nil {
+				return nil, fmt.Errorf("unable to read manifest of %s: %v", dir, err)
+			}
+			manifests[dir] = m
+			continue
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, fmt.Errorf("unable to read %s: %v", header.Name, err)
+		}
+		if found[dir] == nil {
+			found[dir] = make(map[string]string)
+		}
+		found[dir][name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	problems := make(map[string][]string)
+	for dir := range found {
+		if _, ok := manifests[dir]; !ok {
+			problems[dir] = []string{"the sample has no manifest"}
+		}
+	}
+	for dir, m := range manifests {
+		if p := VerifyHashes(m, found[dir]); len(p) > 0 {
+			problems[dir] = p
+		}
+	}
+	return problems, nil
+}
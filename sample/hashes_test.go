@@ -0,0 +1,138 @@
+package sample_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudability/metrics-agent/sample"
+)
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyDir(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestVerifyDir")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"stats-summary-node0.json": `{"node":{}}`,
+		"pods.jsonl":               "{}",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the summary hash is recorded as it is written, the pods export is hashed with the manifest
+	err = sample.WriteCollectionManifest(dir, "1.2.3", sample.CollectionDetails{
+		FileHashes: map[string]string{"stats-summary-node0.json": sha256Hex(files["stats-summary-node0.json"])},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m, err := sample.ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if m.FileHashes[name] != sha256Hex(data) {
+			t.Errorf("unexpected hash of %s: %s", name, m.FileHashes[name])
+		}
+	}
+
+	t.Run("intact", func(t *testing.T) {
+		problems, err := sample.VerifyDir(dir)
+		if err != nil || len(problems) != 0 {
+			t.Errorf("unexpected problems %v: %v", problems, err)
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(dir, "pods.jsonl"), []byte("{ }"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(dir, "stats-summary-node0.json")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "extra.json"), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		problems, err := sample.VerifyDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"pods.jsonl has sha256", "stats-summary-node0.json is listed", "extra.json is not listed"}
+		if len(problems) != len(want) {
+			t.Fatalf("unexpected problems %v", problems)
+		}
+		for _, w := range want {
+			if !strings.Contains(strings.Join(problems, "\n"), w) {
+				t.Errorf("expected a problem %q in %v", w, problems)
+			}
+		}
+	})
+}
+
+func TestVerifyArchive(t *testing.T) {
+	manifest := `{"files":["a.json","b.json"],"fileHashes":{"a.json":"` + sha256Hex("a") + `","b.json":"` +
+		sha256Hex("b") + `"}}`
+
+	archive := func(entries [][2]string) *bytes.Buffer {
+		var buf bytes.Buffer
+		gzw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gzw)
+		for _, e := range entries {
+			if err := tw.WriteHeader(&tar.Header{Name: e[0], Mode: 0644, Size: int64(len(e[1])),
+				Typeflag: tar.TypeReg}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(e[1])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := gzw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+
+	problems, err := sample.VerifyArchive(archive([][2]string{
+		{"export/20200102030405/1577934245/a.json", "a"},
+		{"export/20200102030405/1577934245/b.json", "b"},
+		{"export/20200102030405/1577934245/" + sample.ManifestFile, manifest},
+	}))
+	if err != nil || len(problems) != 0 {
+		t.Errorf("unexpected problems %v: %v", problems, err)
+	}
+
+	problems, err = sample.VerifyArchive(archive([][2]string{
+		{"export/20200102030405/1577934245/a.json", "a"},
+		{"export/20200102030405/1577934245/b.json", "c"},
+		{"export/20200102030405/1577934245/" + sample.ManifestFile, manifest},
+		{"export/20200102030805/1577934485/a.json", "a"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := problems["export/20200102030405/1577934245"]; len(p) != 1 || !strings.HasPrefix(p[0], "b.json") {
+		t.Errorf("expected the changed file to be reported, got %v", p)
+	}
+	if p := problems["export/20200102030805/1577934485"]; len(p) != 1 || p[0] != "the sample has no manifest" {
+		t.Errorf("expected the missing manifest to be reported, got %v", p)
+	}
+}
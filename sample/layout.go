@@ -0,0 +1,635 @@
+// Package sample defines the layout of a metric sample directory. Every file written into a sample is
+// named here so the layout is stable for downstream tooling within a format version.
+//
+// A sample directory is <export dir>/<YYYYMMDDhhmmss>/<unix seconds>/ and contains:
+//
+//	sample-manifest.json                      format version, agent version, the files in the sample and
+//	                                          the sha256 of each, any nodes collected late as they joined
+//	                                          during the sample, the nodes counted by capacity type and any
+//	                                          resources the agent was not permitted to collect, the total
+//	                                          size of the sample and any data shed to keep it within its
+//	                                          size cap, and any file classes left out as the destination
+//	                                          does not accept them
+//	agent-measurement.json                    agent status measurement
+//	node-metadata.json                        normalized node metadata
+//	cluster-summary.json                      node, pod and namespace counts and allocatable capacity
+//	                                          totals, computed from the resource exports in the sample
+//	redaction-report.json                     the redaction rules in effect, the hash of their
+//	                                          configuration and the number of values each redacted, never
+//	                                          the values themselves
+//	agent-log-tail.log                        recent agent log records, when enabled
+//	agent-node-sizes.json                     recent size history of each node source, when the log tail
+//	                                          is enabled
+//	<resource>.jsonl                          one kubernetes resource per line, eg: pods.jsonl
+//	stats-summary-<node>.json                 kubelet summary collected this sample, with the namespace
+//	                                          profile its pods are replaced by per-namespace totals
+//	baseline-summary-<node>.json              kubelet summary collected the previous sample
+//	stats-<extra endpoint>-<node>.<ext>       configured extra kubelet endpoints
+//	stats-<source>-<node>.<ext>.unchanged     marker replacing node data identical to its baseline, only
+//	                                          when the upload endpoint advertises support for it
+//
+// The collection profile of a sample is recorded in its manifest. The namespace profile omits pod and
+// container level detail: the pods of each summary are rolled up to a NamespaceSummary, and pods.jsonl and
+// extra kubelet endpoints are left out.
+//
+// Baselines for the next sample are kept in the export dir as baseline-<source>-<node>.<ext>.
+//
+// A backfilled sample reconstructs a missed poll from the history retained by the kubelets. It is written
+// to the sample directory of the missed poll, is marked backfilled in its manifest and contains only:
+//
+//	sample-manifest.json                      format version, agent version, backfill time, files and
+//	                                          their sha256
+//	stats-container-<node>.json               kubelet container stats retained for the missed poll
+package sample
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FormatVersion is the version of the sample directory layout. It must be incremented whenever a
+// file class is added to, renamed in or removed from the sample.
+const FormatVersion = 6
+
+// node source file prefixes
+const (
+	// StatsPrefix is the prefix of node source files collected for the current sample
+	StatsPrefix = "stats"
+	// BaselinePrefix is the prefix of node source files collected for the previous sample
+	BaselinePrefix = "baseline"
+)
+
+// node sources with a baseline maintained between samples
+const (
+	SummarySource         = "summary"
+	ContainerSource       = "container"
+	CadvisorMetricsSource = "cadvisor_metrics"
+	ResourceMetricsSource = "resource_metrics"
+)
+
+// node sources without a baseline, only collected with a sample
+const (
+	// ProbesSource is the node source of the kubelet probe metrics
+	ProbesSource = "probes"
+	// KubeletMetricsSource is the node source of the runtime metrics of the kubelet itself
+	KubeletMetricsSource = "kubelet_metrics"
+	// KubeletPodsSource is the node source of the pods bound to the node as seen by the kubelet
+	KubeletPodsSource = "pods"
+	// NodeSpecSource is the node source of the machine spec seen by the kubelet
+	NodeSpecSource = "spec"
+	// KubeletConfigzSource is the node source of the running configuration of the kubelet
+	KubeletConfigzSource = "configz"
+)
+
+// fixed file names within a sample
+const (
+	ManifestFile         = "sample-manifest.json"
+	AgentMeasurementFile = "agent-measurement.json"
+	NodeMetadataFile     = "node-metadata.json"
+	ClusterSummaryFile   = "cluster-summary.json"
+	RedactionReportFile  = "redaction-report.json"
+	LogTailFile          = "agent-log-tail.log"
+	NodeSizeHistoryFile  = "agent-node-sizes.json"
+	DiagnosticsFile      = "agent.diag"
+)
+
+// UnchangedSuffix is appended to the name of a node source file replaced by an UnchangedMarker
+const UnchangedSuffix = ".unchanged"
+
+// UnchangedMarker replaces node data that is identical to its baseline in the same sample
+type UnchangedMarker struct {
+	// Baseline is the name of the baseline file holding the data
+	Baseline string `json:"baseline"`
+	// SHA256 is the hex encoded sha256 of the data
+	SHA256 string `json:"sha256"`
+}
+
+// collection profiles, the granularity of the node data collected
+const (
+	// ProfileFull collects pod and container level detail
+	ProfileFull = "full"
+	// ProfileNamespace rolls the pod stats of each kubelet summary up to per-namespace totals within the
+	// agent, so no pod or container level detail leaves the cluster
+	ProfileNamespace = "namespace"
+)
+
+// NamespaceSummary replaces a kubelet summary collected with the namespace profile
+type NamespaceSummary struct {
+	// Node is the node stats of the kubelet summary, unchanged
+	Node       json.RawMessage  `json:"node"`
+	Namespaces []NamespaceUsage `json:"namespaces"`
+}
+
+// NamespaceUsage is the total usage of the pods of a namespace on a node
+type NamespaceUsage struct {
+	Namespace                 string `json:"namespace"`
+	Pods                      int    `json:"pods"`
+	CPUUsageNanoCores         uint64 `json:"cpuUsageNanoCores"`
+	CPUUsageCoreNanoSeconds   uint64 `json:"cpuUsageCoreNanoSeconds"`
+	MemoryWorkingSetBytes     uint64 `json:"memoryWorkingSetBytes"`
+	EphemeralStorageUsedBytes uint64 `json:"ephemeralStorageUsedBytes"`
+}
+
+// ClusterSummary is a small summary of the cluster computed from the resource exports of a sample, so
+// consumers need not parse the full sample
+type ClusterSummary struct {
+	Nodes int `json:"nodes"`
+	// AllocatableCPUMillicores is the total allocatable cpu of the nodes
+	AllocatableCPUMillicores int64 `json:"allocatableCpuMillicores"`
+	// AllocatableMemoryBytes is the total allocatable memory of the nodes
+	AllocatableMemoryBytes int64 `json:"allocatableMemoryBytes"`
+	Pods                   int   `json:"pods"`
+	Namespaces             int   `json:"namespaces"`
+}
+
+// ReadClusterSummary reads the cluster summary of the sample in dir
+func ReadClusterSummary(dir string) (ClusterSummary, error) {
+	var summary ClusterSummary
+	data, err := os.ReadFile(filepath.Join(dir, ClusterSummaryFile))
+	if err != nil {
+		return summary, err
+	}
+	return summary, json.Unmarshal(data, &summary)
+}
+
+// RedactionReport lists the redaction rules applied to a sample and the number of values each removed or
+// rewrote. It never holds the redacted values, so it can be shared to audit what leaves the cluster.
+type RedactionReport struct {
+	// ConfigHash is the hex encoded sha256 of the settings and rules in effect, it changes only when the
+	// redaction configuration does
+	ConfigHash string `json:"configHash"`
+	// Settings are the agent settings that determine the rules in effect
+	Settings map[string]string `json:"settings"`
+	// Rules are the rules in effect, including those that redacted nothing
+	Rules []RedactionRule `json:"rules"`
+}
+
+// RedactionRule is a redaction rule in effect for a sample
+type RedactionRule struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	// Count is the number of values the rule removed or rewrote, eg: environment variables
+	Count int `json:"count"`
+}
+
+// file classes, every file in a sample belongs to one. The files of a class the destination of a sample
+// does not accept are left out of it.
+const (
+	ManifestClass         = "manifest"
+	AgentMeasurementClass = "agent-measurement"
+	NodeMetadataClass     = "node-metadata"
+	ClusterSummaryClass   = "cluster-summary"
+	RedactionReportClass  = "redaction-report"
+	LogTailClass          = "log-tail"
+	NodeSizeHistoryClass  = "node-size-history"
+	ResourcesClass        = "resources"
+	// nodeClassPrefix is the prefix of the class of each node source, eg: node-summary
+	nodeClassPrefix = "node-"
+)
+
+// CoreFileClasses are accepted by every destination, the files of any other class are only included when
+// the destination accepts it
+var CoreFileClasses = []string{
+	ManifestClass,
+	AgentMeasurementClass,
+	NodeMetadataClass,
+	ClusterSummaryClass,
+	RedactionReportClass,
+	LogTailClass,
+	NodeSizeHistoryClass,
+	ResourcesClass,
+	NodeSourceClass(SummarySource),
+	NodeSourceClass(ContainerSource),
+	NodeSourceClass(CadvisorMetricsSource),
+	NodeSourceClass(ResourceMetricsSource),
+}
+
+// NodeSourceClass returns the file class of the files holding data from a node source
+func NodeSourceClass(source string) string {
+	return nodeClassPrefix + source
+}
+
+// FileClass returns the class of a file within a sample, an unchanged marker belongs to the class of the
+// data it replaces. It returns an empty string if the file is not part of the layout.
+func FileClass(name string) string {
+	switch name {
+	case ManifestFile:
+		return ManifestClass
+	case AgentMeasurementFile:
+		return AgentMeasurementClass
+	case NodeMetadataFile:
+		return NodeMetadataClass
+	case ClusterSummaryFile:
+		return ClusterSummaryClass
+	case RedactionReportFile:
+		return RedactionReportClass
+	case LogTailFile:
+		return LogTailClass
+	case NodeSizeHistoryFile:
+		return NodeSizeHistoryClass
+	}
+	if strings.HasSuffix(name, ResourceFileExtension) {
+		return ResourcesClass
+	}
+	for _, prefix := range []string{StatsPrefix, BaselinePrefix} {
+		if rest := strings.TrimPrefix(name, prefix+"-"); rest != name {
+			// source names never contain a '-', so the source ends at the first
+			if source, _, ok := strings.Cut(rest, "-"); ok && source != "" {
+				return NodeSourceClass(source)
+			}
+		}
+	}
+	return ""
+}
+
+// ResourceFileExtension is the extension of kubernetes resource files
+const ResourceFileExtension = ".jsonl"
+
+// sampleDirTimeFormat is the format of the timestamp directory a sample is written to
+const sampleDirTimeFormat = "20060102150405"
+
+// BaselineName returns the name of the baseline file for a file collected for the current sample
+func BaselineName(statsName string) string {
+	return BaselinePrefix + strings.TrimPrefix(statsName, StatsPrefix)
+}
+
+// NodeSourceName returns the name, without extension, of a file holding data from a node source
+func NodeSourceName(prefix, source, nodeName string) string {
+	return fmt.Sprintf("%s-%s-%s", prefix, source, nodeName)
+}
+
+// ResourceFile returns the name of the file holding kubernetes resources of the given type
+func ResourceFile(resourceName string) string {
+	return resourceName + ResourceFileExtension
+}
+
+// Dir returns the sample directory within the export directory for a sample started at the given time
+func Dir(exportDir string, sampleStartTime time.Time) string {
+	return filepath.Join(exportDir, sampleStartTime.Format(sampleDirTimeFormat),
+		strconv.FormatInt(sampleStartTime.Unix(), 10))
+}
+
+// Manifest describes the contents of a sample directory
+type Manifest struct {
+	FormatVersion int      `json:"formatVersion"`
+	AgentVersion  string   `json:"agentVersion"`
+	Files         []string `json:"files"`
+	// FileHashes is the hex encoded sha256 of each file in the sample, so the data received can be verified
+	// to be the data collected
+	FileHashes map[string]string `json:"fileHashes,omitempty"`
+	// Backfilled is set when the sample was reconstructed after the poll it belongs to was missed
+	Backfilled bool `json:"backfilled,omitempty"`
+	// BackfilledAt is when a backfilled sample was reconstructed
+	BackfilledAt *time.Time `json:"backfilledAt,omitempty"`
+	// LateAddedNodes are nodes that joined the cluster after the node list of the sample was taken, their
+	// data was collected at the end of the sample
+	LateAddedNodes []string `json:"lateAddedNodes,omitempty"`
+	// NotPermitted are the resources the agent was not permitted to collect, so are absent from the sample
+	NotPermitted []string `json:"notPermitted,omitempty"`
+	// NodeCapacityTypes counts the nodes of the cluster by their capacity type, eg: spot or on-demand, as
+	// exported in node-metadata.json
+	NodeCapacityTypes map[string]int `json:"nodeCapacityTypes,omitempty"`
+	// TotalBytes is the combined size of the files in the sample
+	TotalBytes int64 `json:"totalBytes"`
+	// MaxSampleBytes is the cap on the total size of the sample, if one is set
+	MaxSampleBytes int64 `json:"maxSampleBytes,omitempty"`
+	// Shed is the data removed from the sample to keep it within MaxSampleBytes, in the order removed
+	Shed []ShedAction `json:"shed,omitempty"`
+	// Partial is set when only a subset of the nodes was collected, eg: by a canary agent, so the sample
+	// must not be ingested as the primary sample of the cluster
+	Partial bool `json:"partial,omitempty"`
+	// NodeNames are the node names and patterns a partial sample was restricted to
+	NodeNames []string `json:"nodeNames,omitempty"`
+	// NodeLabelSelector is the label selector the collected nodes were restricted to
+	NodeLabelSelector string `json:"nodeLabelSelector,omitempty"`
+	// ExcludedFileClasses are the file classes left out of the sample as its destination does not accept
+	// them
+	ExcludedFileClasses []string `json:"excludedFileClasses,omitempty"`
+	// Profile is the collection profile of the sample
+	Profile string `json:"profile,omitempty"`
+	// NodeHealth is the condition of each node in the node list the sample was collected from, with the
+	// outcome of its collection
+	NodeHealth []NodeHealth `json:"nodeHealth,omitempty"`
+	// NodeReadiness counts the ready and not ready nodes of the node list the sample was collected from
+	NodeReadiness *NodeReadiness `json:"nodeReadiness,omitempty"`
+	// Freshness is when and where from the data of each file class in the sample was collected
+	Freshness []ClassFreshness `json:"freshness,omitempty"`
+	// FreshnessSpreadMs is the time between the earliest and latest data collected for the sample
+	FreshnessSpreadMs int64 `json:"freshnessSpreadMs,omitempty"`
+	// SeriesTruncations are the metric families truncated to the series limit on each node
+	SeriesTruncations []SeriesTruncation `json:"seriesTruncations,omitempty"`
+	// DisabledEndpoints are the endpoints of nodes not collected for the sample
+	DisabledEndpoints []DisabledEndpoint `json:"disabledEndpoints,omitempty"`
+	// NodeRejoins are the nodes that rejoined the cluster under a new name on the same machine
+	NodeRejoins []NodeRejoin `json:"nodeRejoins,omitempty"`
+	// VersionGated are the features disabled as the cluster version does not support them, so are absent from
+	// the sample
+	VersionGated []string `json:"versionGated,omitempty"`
+	// ScopeChanged is set on the first sample collected after the scope of the samples changed
+	ScopeChanged *ScopeChange `json:"scopeChanged,omitempty"`
+	// DebugCaptures are the nodes whose data was retained by the agent for debugging while collecting the
+	// sample
+	DebugCaptures []DebugCapture `json:"debugCaptures,omitempty"`
+	// CycleID is the ID of the poll that collected the sample, which also tags the agent logs of the poll and
+	// names the archive of the latest poll uploaded with it
+	CycleID string `json:"cycleId,omitempty"`
+}
+
+// classes of data shed from a sample approaching its size cap, in the order they are shed
+const (
+	// ShedKubeletPods is the pods collected from the kubelets, the files are removed
+	ShedKubeletPods = "kubelet_pods"
+	// ShedCadvisor is cadvisor metrics collected from the nodes, the files are removed
+	ShedCadvisor = "cadvisor"
+	// ShedContainer is container stats collected from the nodes, the files are removed
+	ShedContainer = "container"
+	// ShedResources is kubernetes resource exports, the largest files are truncated to whole records
+	ShedResources = "resources"
+)
+
+// ShedAction records data of a class shed from a sample to keep it within its size cap
+type ShedAction struct {
+	Class string `json:"class"`
+	// Files are the files removed or truncated, or refused as they were written
+	Files []string `json:"files"`
+	// Bytes is the size of the data shed
+	Bytes int64 `json:"bytes"`
+}
+
+// outcomes of the collection of a node
+const (
+	NodeCollected = "collected"
+	NodeFailed    = "failed"
+	NodeCancelled = "cancelled"
+	// NodeSkipped is a node intentionally left out of collection, for the reason of the node health
+	NodeSkipped = "skipped"
+)
+
+// reasons a node is skipped
+const (
+	// SkipVirtualKubelet is a node registered by a virtual kubelet, which has no kubelet endpoints
+	SkipVirtualKubelet = "virtual_kubelet"
+	// SkipOptedOut is a node annotated to opt out of collection
+	SkipOptedOut = "opted_out"
+	// SkipNodeCap is a node deferred to a later collection as the number of nodes collected each collection
+	// is capped
+	SkipNodeCap = "node_cap"
+)
+
+// NodeHealth is the condition of a node when it was listed for collection, so collection failures can be
+// correlated with node pressure
+type NodeHealth struct {
+	Node       string          `json:"node"`
+	Conditions []NodeCondition `json:"conditions"`
+	Outcome    string          `json:"outcome"`
+	// ErrorClass is the normalized error of a node that was not collected
+	ErrorClass string `json:"errorClass,omitempty"`
+	// Reason is why a skipped node was left out of collection
+	Reason string `json:"reason,omitempty"`
+}
+
+// NodeReadiness counts the nodes listed for collection by their readiness. Total is the nodes matching the
+// node name allowlist, of which NotReady are not ready, including those still collected within the not
+// ready grace period.
+type NodeReadiness struct {
+	Total         int      `json:"total"`
+	Ready         int      `json:"ready"`
+	NotReady      int      `json:"notReady"`
+	NotReadyNodes []string `json:"notReadyNodes,omitempty"`
+}
+
+// NodeCondition is the state of a node condition and when it last changed
+type NodeCondition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+// sources of the data of a file class
+const (
+	// FreshnessLiveList is data listed from the API server and kubelets during the collection
+	FreshnessLiveList = "live_list"
+	// FreshnessInformerCache is data exported from the informer caches, as of their last watch event
+	FreshnessInformerCache = "informer_cache"
+	// FreshnessCachedNodeList is data derived from the node list held by the nodes informer
+	FreshnessCachedNodeList = "cached_node_list"
+	// FreshnessPreviousSample is node baselines, collected with the node stats of the previous sample
+	FreshnessPreviousSample = "previous_sample"
+)
+
+// ClassFreshness is when and where from the data of a file class was collected
+type ClassFreshness struct {
+	Class string `json:"class"`
+	// Baseline is set for the node baselines of the class, which are collected separately from its stats
+	Baseline bool      `json:"baseline,omitempty"`
+	Source   string    `json:"source"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+}
+
+// SeriesTruncation records a metric family of a node source truncated to the series limit
+type SeriesTruncation struct {
+	Node   string `json:"node"`
+	Source string `json:"source"`
+	Family string `json:"family"`
+	// Dropped is the number of series of the family left out
+	Dropped int `json:"dropped"`
+}
+
+// EndpointDisabledByAnnotation is the reason of a node endpoint disabled by an annotation of the node
+const EndpointDisabledByAnnotation = "disabled by annotation"
+
+// DisabledEndpoint records an endpoint of a node not collected for the sample
+type DisabledEndpoint struct {
+	Node string `json:"node"`
+	// Endpoint is the node source of a built in endpoint, or the name of an extra kubelet endpoint
+	Endpoint string `json:"endpoint"`
+	Reason   string `json:"reason"`
+}
+
+// DebugCapture records the data of a node retained by the agent for a support escalation. The raw responses
+// of the node are retained in the raw directory of Dir, and the files written for it to the sample in its
+// filtered directory.
+type DebugCapture struct {
+	Node string    `json:"node"`
+	Time time.Time `json:"time"`
+	// Dir is the directory the data is retained in, relative to the debug captures directory
+	Dir string `json:"dir"`
+	// Files are the names of the captured files
+	Files []string `json:"files"`
+	Bytes int64    `json:"bytes"`
+	// Truncated is set if the data was cut short as the retained data reached its size cap
+	Truncated bool `json:"truncated,omitempty"`
+	// Expires is when the retained data is removed
+	Expires time.Time `json:"expires"`
+}
+
+// handling of the baselines of a node that rejoined the cluster under a new name
+const (
+	// BaselineMigrated baselines were renamed to the new node name, the machine was not rebooted so its
+	// counters continue from them
+	BaselineMigrated = "migrated"
+	// BaselineInvalidated baselines were removed, the machine was rebooted so its counters restarted
+	BaselineInvalidated = "invalidated"
+)
+
+// NodeRejoin links a node to the name the same machine was collected under before it rejoined the cluster
+type NodeRejoin struct {
+	Node         string `json:"node"`
+	PreviousNode string `json:"previousNode"`
+	MachineID    string `json:"machineID"`
+	// Baseline is how the baselines of the previous node name were handled
+	Baseline string `json:"baseline"`
+}
+
+// ScopeChangedBaselinesReset is the reason a sample is marked with a ScopeChange
+const ScopeChangedBaselinesReset = "scope changed, baselines reset"
+
+// ScopeChange marks the first sample collected after the settings defining the scope of the samples
+// changed. The affected node baselines were reset, so deltas against earlier samples are not comparable.
+type ScopeChange struct {
+	Reason string `json:"reason"`
+	// Settings are the names of the changed settings
+	Settings []string `json:"settings"`
+	// Nodes are the nodes whose baselines were reset as they entered or left the collection, empty if the
+	// baselines of every node were reset
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+// CollectionDetails describes how a sample was collected, beyond the files within it
+type CollectionDetails struct {
+	// LateAddedNodes are the nodes collected late because they joined the cluster after the node list was
+	// taken
+	LateAddedNodes []string
+	// NotPermitted are the resources the agent was not permitted to collect
+	NotPermitted []string
+	// NodeCapacityTypes counts the nodes of the cluster by their capacity type, nil if they were not counted
+	NodeCapacityTypes map[string]int
+	// MaxSampleBytes is the cap on the total size of the sample, 0 if none is set
+	MaxSampleBytes int64
+	// Shed is the data removed from the sample to keep it within MaxSampleBytes
+	Shed []ShedAction
+	// NodeNames are the node names and patterns collection was restricted to, the sample is partial if set
+	NodeNames []string
+	// NodeLabelSelector is the label selector the collected nodes were restricted to, if any
+	NodeLabelSelector string
+	// ExcludedFileClasses are the file classes left out of the sample as its destination does not accept
+	// them
+	ExcludedFileClasses []string
+	// Profile is the collection profile the sample was collected with
+	Profile string
+	// NodeHealth is the condition and collection outcome of each node listed for collection
+	NodeHealth []NodeHealth
+	// NodeReadiness counts the ready and not ready nodes listed for collection, nil if they were not counted
+	NodeReadiness *NodeReadiness
+	// Freshness is when and where from the data of each file class was collected
+	Freshness []ClassFreshness
+	// FreshnessSpread is the time between the earliest and latest data collected
+	FreshnessSpread time.Duration
+	// SeriesTruncations are the metric families truncated to the series limit
+	SeriesTruncations []SeriesTruncation
+	// DisabledEndpoints are the endpoints of nodes not collected
+	DisabledEndpoints []DisabledEndpoint
+	// NodeRejoins are the nodes that rejoined the cluster under a new name on the same machine
+	NodeRejoins []NodeRejoin
+	// VersionGated are the features disabled as the cluster version does not support them
+	VersionGated []string
+	// ScopeChanged is the change of the scope of the samples since the previous sample, if any
+	ScopeChanged *ScopeChange
+	// DebugCaptures are the nodes whose data was retained for debugging during the collection
+	DebugCaptures []DebugCapture
+	// CycleID is the ID of the poll that collected the sample
+	CycleID string
+	// FileHashes are the hex encoded sha256 of files hashed as they were written, keyed by file name. The
+	// other files are hashed when the manifest is written.
+	FileHashes map[string]string
+}
+
+// WriteManifest writes the manifest for the files currently in the sample directory. It should be
+// written after all other sample files.
+func WriteManifest(dir, agentVersion string) error {
+	return WriteCollectionManifest(dir, agentVersion, CollectionDetails{})
+}
+
+// WriteCollectionManifest behaves like WriteManifest, also recording the details of how the sample was
+// collected
+func WriteCollectionManifest(dir, agentVersion string, details CollectionDetails) error {
+	return writeManifest(dir, Manifest{
+		FormatVersion:       FormatVersion,
+		AgentVersion:        agentVersion,
+		LateAddedNodes:      details.LateAddedNodes,
+		NotPermitted:        details.NotPermitted,
+		NodeCapacityTypes:   details.NodeCapacityTypes,
+		MaxSampleBytes:      details.MaxSampleBytes,
+		Shed:                details.Shed,
+		Partial:             len(details.NodeNames) > 0,
+		NodeNames:           details.NodeNames,
+		NodeLabelSelector:   details.NodeLabelSelector,
+		ExcludedFileClasses: details.ExcludedFileClasses,
+		Profile:             details.Profile,
+		NodeHealth:          details.NodeHealth,
+		NodeReadiness:       details.NodeReadiness,
+		Freshness:           details.Freshness,
+		FreshnessSpreadMs:   details.FreshnessSpread.Milliseconds(),
+		SeriesTruncations:   details.SeriesTruncations,
+		DisabledEndpoints:   details.DisabledEndpoints,
+		NodeRejoins:         details.NodeRejoins,
+		VersionGated:        details.VersionGated,
+		ScopeChanged:        details.ScopeChanged,
+		DebugCaptures:       details.DebugCaptures,
+		CycleID:             details.CycleID,
+	}, details.FileHashes)
+}
+
+// WriteBackfillManifest writes the manifest for a sample reconstructed at backfilledAt for a missed poll
+func WriteBackfillManifest(dir, agentVersion string, backfilledAt time.Time) error {
+	backfilledAt = backfilledAt.UTC()
+	return writeManifest(dir, Manifest{
+		FormatVersion: FormatVersion,
+		AgentVersion:  agentVersion,
+		Backfilled:    true,
+		BackfilledAt:  &backfilledAt,
+	}, nil)
+}
+
+// writeManifest writes the manifest listing the files in dir, hashing those without a hash in known
+func writeManifest(dir string, m Manifest, known map[string]string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("unable to list sample directory: %v", err)
+	}
+
+	m.Files = []string{}
+	m.FileHashes = make(map[string]string)
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == ManifestFile {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return fmt.Errorf("unable to stat sample file: %v", err)
+		}
+		m.Files = append(m.Files, e.Name())
+		m.TotalBytes += info.Size()
+		hash, ok := known[e.Name()]
+		if !ok {
+			if hash, err = HashFile(filepath.Join(dir, e.Name())); err != nil {
+				return fmt.Errorf("unable to hash sample file: %v", err)
+			}
+		}
+		m.FileHashes[e.Name()] = hash
+	}
+	sort.Strings(m.Files)
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("unable to marshal sample manifest: %v", err)
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestFile), data, 0644)
+}
@@ -0,0 +1,159 @@
+package sample_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudability/metrics-agent/sample"
+)
+
+func TestNaming(t *testing.T) {
+	if n := sample.NodeSourceName(sample.StatsPrefix, sample.SummarySource, "node0"); n != "stats-summary-node0" {
+		t.Errorf("unexpected node source name %s", n)
+	}
+	if n := sample.BaselineName("stats-summary-node0.json"); n != "baseline-summary-node0.json" {
+		t.Errorf("unexpected baseline name %s", n)
+	}
+	if n := sample.ResourceFile("pods"); n != "pods.jsonl" {
+		t.Errorf("unexpected resource file name %s", n)
+	}
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if d := sample.Dir("/export", start); d != "/export/20200102030405/1577934245" {
+		t.Errorf("unexpected sample dir %s", d)
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestWriteManifest")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"pods.jsonl", sample.AgentMeasurementFile} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// writing twice must not list the manifest itself
+	for i := 0; i < 2; i++ {
+		if err := sample.WriteManifest(dir, "1.2.3"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, sample.ManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m sample.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.FormatVersion != sample.FormatVersion || m.AgentVersion != "1.2.3" || m.TotalBytes != 4 {
+		t.Errorf("unexpected manifest versions %+v", m)
+	}
+	if len(m.Files) != 2 || m.Files[0] != sample.AgentMeasurementFile || m.Files[1] != "pods.jsonl" {
+		t.Errorf("unexpected manifest files %v", m.Files)
+	}
+}
+
+func TestWriteCollectionManifest(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestWriteCollectionManifest")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	details := sample.CollectionDetails{
+		LateAddedNodes:      []string{"node1"},
+		NotPermitted:        []string{"jobs", "cronjobs"},
+		NodeCapacityTypes:   map[string]int{"spot": 2, "on-demand": 1},
+		MaxSampleBytes:      1000,
+		Shed:                []sample.ShedAction{{Class: sample.ShedCadvisor, Files: []string{"a"}, Bytes: 10}},
+		NodeNames:           []string{"canary-*"},
+		ExcludedFileClasses: []string{"node-probes"},
+		Profile:             sample.ProfileNamespace,
+		Freshness: []sample.ClassFreshness{{Class: sample.ResourcesClass, Source: sample.FreshnessInformerCache,
+			Start: time.Unix(100, 0).UTC(), End: time.Unix(101, 0).UTC()}},
+		FreshnessSpread: 1500 * time.Millisecond,
+	}
+	if err := sample.WriteCollectionManifest(dir, "1.2.3", details); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, sample.ManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m sample.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.LateAddedNodes) != 1 || m.LateAddedNodes[0] != "node1" || len(m.NotPermitted) != 2 || m.Backfilled ||
+		m.MaxSampleBytes != 1000 || len(m.Shed) != 1 || !m.Partial || len(m.NodeNames) != 1 ||
+		len(m.ExcludedFileClasses) != 1 || m.Profile != sample.ProfileNamespace || m.FreshnessSpreadMs != 1500 {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+	if len(m.Freshness) != 1 || m.Freshness[0] != details.Freshness[0] {
+		t.Errorf("expected the freshness of the resources class, got %+v", m.Freshness)
+	}
+	if len(m.NodeCapacityTypes) != 2 || m.NodeCapacityTypes["spot"] != 2 || m.NodeCapacityTypes["on-demand"] != 1 {
+		t.Errorf("expected the nodes counted by capacity type, got %v", m.NodeCapacityTypes)
+	}
+}
+
+func TestFileClass(t *testing.T) {
+	tests := []struct {
+		name  string
+		class string
+	}{
+		{name: sample.ManifestFile, class: sample.ManifestClass},
+		{name: sample.ClusterSummaryFile, class: sample.ClusterSummaryClass},
+		{name: "pods.jsonl", class: sample.ResourcesClass},
+		{name: "stats-summary-node-0.json", class: "node-summary"},
+		{name: "baseline-cadvisor_metrics-node0.txt", class: "node-cadvisor_metrics"},
+		{name: "stats-probes-node0.txt.unchanged", class: "node-probes"},
+		{name: "unknown.txt", class: ""},
+	}
+	for _, tc := range tests {
+		if class := sample.FileClass(tc.name); class != tc.class {
+			t.Errorf("expected %s to be of class %q, got %q", tc.name, tc.class, class)
+		}
+	}
+}
+
+func TestWriteBackfillManifest(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestWriteBackfillManifest")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := sample.NodeSourceName(sample.StatsPrefix, sample.ContainerSource, "node0") + ".json"
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backfilledAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := sample.WriteBackfillManifest(dir, "1.2.3", backfilledAt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, sample.ManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m sample.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Backfilled || m.BackfilledAt == nil || !m.BackfilledAt.Equal(backfilledAt) {
+		t.Errorf("expected manifest to be marked backfilled, got %+v", m)
+	}
+	if len(m.Files) != 1 || m.Files[0] != name {
+		t.Errorf("unexpected manifest files %v", m.Files)
+	}
+}
@@ -0,0 +1,258 @@
+package util
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ArchiveProgressSuffix is appended to the name of an archive to name the file recording the progress of its
+// build. It is kept until the directory the archive was built from has been cleaned up, so an agent restarted
+// meanwhile can tell an interrupted build from a complete archive.
+const ArchiveProgressSuffix = ".progress"
+
+// archiveChunkBytes is the uncompressed size of the files appended to an archive between progress records,
+// a restarted build continues after the last chunk recorded
+const archiveChunkBytes = 8 << 20
+
+// archiveProgress records how far the build of an archive got
+type archiveProgress struct {
+	// Source is the directory the archive is built from
+	Source string `json:"source"`
+	// Started is when the build of the archive started
+	Started time.Time `json:"started"`
+	// Appended is the number of files appended, in the order they are listed
+	Appended int `json:"appended"`
+	// Last is the name of the last file appended, to check the listing has not changed
+	Last string `json:"last,omitempty"`
+	// Offset is the size of the archive once the last chunk was appended
+	Offset int64 `json:"offset"`
+	// Complete is set once the end of the archive has been written
+	Complete bool `json:"complete"`
+}
+
+// InterruptedArchive is an archive whose build, or the clean up of the directory it was built from, was
+// interrupted
+type InterruptedArchive struct {
+	Name    string
+	Source  string
+	Started time.Time
+	// Complete is set if only the clean up of the source directory was interrupted
+	Complete bool
+}
+
+// BuildArchive writes the files of src to the gzipped tar archive dest, in lexical order. The files are
+// appended in chunks, each its own gzip member, which readers decompress as a single stream, and progress
+// is recorded after each chunk. A build of dest from src that was interrupted continues after the last
+// chunk recorded, provided the files of src are unchanged up to it, otherwise it starts over.
+func BuildArchive(src, dest string) (rerr error) {
+	files, err := archiveFiles(src)
+	if err != nil {
+		return err
+	}
+	progress, err := readArchiveProgress(dest)
+	if err != nil || !progress.resumes(src, files) {
+		progress = archiveProgress{Source: src, Started: time.Now().UTC()}
+	}
+	if progress.Complete {
+		return nil
+	}
+
+	//nolint gosec
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer SafeClose(f.Close, &rerr)
+	// anything written after the last chunk recorded is incomplete
+	if err = f.Truncate(progress.Offset); err != nil {
+		return err
+	}
+	if _, err = f.Seek(progress.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	if progress.Appended > 0 {
+		log.Infof("Resuming the build of archive %s after %d of %d files", dest, progress.Appended, len(files))
+	}
+
+	for progress.Appended < len(files) {
+		chunk, err := nextArchiveChunk(src, files[progress.Appended:])
+		if err != nil {
+			return err
+		}
+		if err = appendArchiveChunk(f, src, chunk); err != nil {
+			return err
+		}
+		progress.Appended += len(chunk)
+		progress.Last = chunk[len(chunk)-1]
+		if err = recordArchiveProgress(f, dest, &progress); err != nil {
+			return err
+		}
+	}
+
+	if err = appendArchiveEnd(f); err != nil {
+		return err
+	}
+	progress.Complete = true
+	return recordArchiveProgress(f, dest, &progress)
+}
+
+// FinishArchive removes the progress record of an archive, once the directory it was built from has been
+// cleaned up
+func FinishArchive(dest string) error {
+	err := os.Remove(dest + ArchiveProgressSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// InterruptedArchives returns the archives in dir whose progress record was not removed
+func InterruptedArchives(dir string) ([]InterruptedArchive, error) {
+	records, err := filepath.Glob(filepath.Join(dir, "*"+ArchiveProgressSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var archives []InterruptedArchive
+	for _, r := range records {
+		name := strings.TrimSuffix(r, ArchiveProgressSuffix)
+		progress, err := readArchiveProgress(name)
+		if err != nil {
+			log.Warnf("Warning: unable to read archive progress %s: %v", r, err)
+			continue
+		}
+		archives = append(archives, InterruptedArchive{Name: name, Source: progress.Source, Started: progress.Started,
+			Complete: progress.Complete})
+	}
+	return archives, nil
+}
+
+// archiveFiles returns the regular files below src relative to it, in lexical order
+func archiveFiles(src string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(src, func(file string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.Mode().IsRegular() {
+			files = append(files, strings.TrimPrefix(file, src))
+		}
+		return nil
+	})
+	return files, err
+}
+
+// nextArchiveChunk returns the files to append in the next chunk, at least one
+func nextArchiveChunk(src string, files []string) ([]string, error) {
+	var size int64
+	for i, name := range files {
+		fi, err := os.Stat(filepath.Join(src, name))
+		if err != nil {
+			return nil, err
+		}
+		size += fi.Size()
+		if size >= archiveChunkBytes {
+			return files[:i+1], nil
+		}
+	}
+	return files, nil
+}
+
+// appendArchiveChunk appends the files to the archive as a gzip member holding their tar entries, without
+// the end of archive marker
+func appendArchiveChunk(w io.Writer, src string, files []string) (rerr error) {
+	//nolint gas
+	gzw, _ := gzip.NewWriterLevel(w, 9)
+	defer SafeClose(gzw.Close, &rerr)
+	tw := tar.NewWriter(gzw)
+
+	for _, name := range files {
+		if err := appendArchiveFile(tw, src, name); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// appendArchiveFile writes the tar entry of a file, named for the directory it was archived from so it
+// extracts into it
+func appendArchiveFile(tw *tar.Writer, src, name string) (rerr error) {
+	//nolint gosec
+	f, err := os.Open(filepath.Join(src, name))
+	if err != nil {
+		return err
+	}
+	defer SafeClose(f.Close, &rerr)
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(fileInfo, fileInfo.Name())
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Join(filepath.Base(src), name)
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// appendArchiveEnd appends the end of archive marker as the last gzip member
+func appendArchiveEnd(w io.Writer) error {
+	//nolint gas
+	gzw, _ := gzip.NewWriterLevel(w, 9)
+	if err := tar.NewWriter(gzw).Close(); err != nil {
+		_ = gzw.Close()
+		return err
+	}
+	return gzw.Close()
+}
+
+// recordArchiveProgress syncs the archive and records its progress
+func recordArchiveProgress(f *os.File, dest string, progress *archiveProgress) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	progress.Offset = offset
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(dest+ArchiveProgressSuffix, 0644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// readArchiveProgress reads the progress recorded for an archive
+func readArchiveProgress(dest string) (archiveProgress, error) {
+	var p archiveProgress
+	data, err := os.ReadFile(dest + ArchiveProgressSuffix)
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(data, &p)
+	return p, err
+}
+
+// resumes reports whether the recorded progress can be continued for the files of src
+func (p archiveProgress) resumes(src string, files []string) bool {
+	if p.Source != src || p.Appended > len(files) {
+		return false
+	}
+	return p.Appended == 0 || files[p.Appended-1] == p.Last
+}
@@ -0,0 +1,152 @@
+package util
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readArchive returns the contents of each file in a gzipped tar archive, and the names in archive order
+func readArchive(t *testing.T, name string) (map[string]string, []string) {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gzr)
+	contents := map[string]string{}
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid archive: %v", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[h.Name] = string(data)
+		names = append(names, h.Name)
+	}
+	return contents, names
+}
+
+func TestBuildArchive(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestBuildArchive")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "export")
+	files := map[string]string{"a.json": "a", "b/c.json": "c", "b/d.json": "d", "e.json": "e"}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]string{"export/a.json": "a", "export/b/c.json": "c", "export/b/d.json": "d",
+		"export/e.json": "e"}
+	expectedOrder := []string{"export/a.json", "export/b/c.json", "export/b/d.json", "export/e.json"}
+
+	t.Run("Ensure the files are archived in lexical order", func(t *testing.T) {
+		dest := filepath.Join(dir, "complete.tgz")
+		if err := BuildArchive(src, dest); err != nil {
+			t.Fatal(err)
+		}
+		contents, names := readArchive(t, dest)
+		if !reflect.DeepEqual(contents, expected) || !reflect.DeepEqual(names, expectedOrder) {
+			t.Errorf("unexpected archive %v in order %v", contents, names)
+		}
+		interrupted, err := InterruptedArchives(dir)
+		if err != nil || len(interrupted) != 1 || !interrupted[0].Complete || interrupted[0].Source != src {
+			t.Errorf("expected the archive to be complete but not finished, got %+v: %v", interrupted, err)
+		}
+		if err := FinishArchive(dest); err != nil {
+			t.Fatal(err)
+		}
+		if interrupted, _ := InterruptedArchives(dir); len(interrupted) != 0 {
+			t.Errorf("expected no interrupted archive once finished, got %+v", interrupted)
+		}
+	})
+
+	t.Run("Ensure an interrupted build continues after the last chunk", func(t *testing.T) {
+		dest := filepath.Join(dir, "resumed.tgz")
+		f, err := os.Create(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := archiveFiles(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first two files were recorded, the next chunk was cut short by the restart
+		if err := appendArchiveChunk(f, src, all[:2]); err != nil {
+			t.Fatal(err)
+		}
+		progress := archiveProgress{Source: src, Appended: 2, Last: all[1]}
+		if err := recordArchiveProgress(f, dest, &progress); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("partial chunk")); err != nil {
+			t.Fatal(err)
+		}
+		_ = f.Close()
+		// a file appended before the restart is changed, the resumed build must not archive it again
+		if err := os.WriteFile(filepath.Join(src, "a.json"), []byte("changed"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.WriteFile(filepath.Join(src, "a.json"), []byte("a"), 0644) //nolint errcheck
+
+		if err := BuildArchive(src, dest); err != nil {
+			t.Fatal(err)
+		}
+		contents, names := readArchive(t, dest)
+		if !reflect.DeepEqual(contents, expected) || !reflect.DeepEqual(names, expectedOrder) {
+			t.Errorf("expected each file archived once, got %v in order %v", contents, names)
+		}
+	})
+
+	t.Run("Ensure a build of other files starts over", func(t *testing.T) {
+		dest := filepath.Join(dir, "restarted.tgz")
+		if err := os.WriteFile(dest, []byte("stale"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		progress := archiveProgress{Source: src, Appended: 2, Last: "/removed.json", Offset: 5}
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := recordArchiveProgress(f, dest, &progress); err != nil {
+			t.Fatal(err)
+		}
+		_ = f.Close()
+
+		ms, err := CompleteMetricSample(src, dest, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = ms.Close()
+		if contents, _ := readArchive(t, dest); !reflect.DeepEqual(contents, expected) {
+			t.Errorf("unexpected archive %v", contents)
+		}
+		if _, err := os.Stat(dest + ArchiveProgressSuffix); !os.IsNotExist(err) {
+			t.Errorf("expected the progress record to be removed once the sample is complete: %v", err)
+		}
+	})
+}
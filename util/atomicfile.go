@@ -0,0 +1,78 @@
+package util
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// atomicTempPrefix prefixes the temporary files written by WriteFileAtomic and ReplaceFile so they are never
+// mistaken for the file being replaced
+const atomicTempPrefix = ".tmp-"
+
+// WriteFileAtomic writes the named file so that after a crash or power loss it holds either its previous
+// contents or the new contents, never a partial write. The contents are written by write to a temporary
+// file in the same directory, which is synced, renamed over the named file and the directory synced.
+// It should be used for files the agent reads back after a restart, per sample scratch files do not need it.
+func WriteFileAtomic(name string, perm os.FileMode, write func(w io.Writer) error) error {
+	return replaceFile(name, perm, true, write)
+}
+
+// ReplaceFile writes the named file as WriteFileAtomic does without syncing it, so a reader never sees a
+// partial write but the file may be lost in a crash. It is the fast path for per sample scratch files that
+// are rewritten in place. The file is written outside of the WriteLimit of its directory, so the size the
+// limit tracked for the file no longer matches its size on disk until the directory is measured again.
+func ReplaceFile(name string, perm os.FileMode, write func(w io.Writer) error) error {
+	return replaceFile(name, perm, false, write)
+}
+
+// replaceFile writes the contents to a temporary file renamed over the named file, syncing the file and
+// directory if sync is set
+func replaceFile(name string, perm os.FileMode, sync bool, write func(w io.Writer) error) (rerr error) {
+	dir := filepath.Dir(name)
+	tmp, err := os.CreateTemp(dir, atomicTempPrefix+filepath.Base(name)+"-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr != nil {
+			// the file may already be closed, the write error is the one to report
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = write(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if sync {
+		if err = tmp.Sync(); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+	if !sync {
+		return nil
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory so that renames within it are durable
+func syncDir(dir string) (rerr error) {
+	//nolint gosec
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer SafeClose(d.Close, &rerr)
+
+	return d.Sync()
+}
@@ -0,0 +1,154 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingWriter accepts a limited number of bytes then fails, simulating a write interrupted part way
+type failingWriter struct {
+	w     io.Writer
+	limit int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.limit {
+		n, _ := f.w.Write(p[:f.limit])
+		f.limit -= n
+		return n, errors.New("device lost power")
+	}
+	n, err := f.w.Write(p)
+	f.limit -= n
+	return n, err
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestWriteFileAtomic")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "baseline-summary-node0.json")
+
+	write := func(contents string) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, contents)
+			return err
+		}
+	}
+
+	t.Run("Ensure the file is written", func(t *testing.T) {
+		if err := WriteFileAtomic(name, 0644, write(`{"first":true}`)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != `{"first":true}` {
+			t.Errorf("unexpected contents %q: %v", data, err)
+		}
+	})
+
+	t.Run("Ensure a partial write leaves the previous contents in place", func(t *testing.T) {
+		err := WriteFileAtomic(name, 0644, func(w io.Writer) error {
+			_, err := io.WriteString(&failingWriter{w: w, limit: 4}, `{"second":true}`)
+			return err
+		})
+		if err == nil {
+			t.Fatal("expected the failed write to be returned")
+		}
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != `{"first":true}` {
+			t.Errorf("expected previous contents to survive a failed write, got %q: %v", data, err)
+		}
+	})
+
+	t.Run("Ensure temporary files are removed", func(t *testing.T) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), atomicTempPrefix) {
+				t.Errorf("temporary file %s was left behind", e.Name())
+			}
+		}
+	})
+}
+
+func TestReplaceFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "stats-summary-node0.json")
+	if err := os.WriteFile(name, []byte(`{"pods":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Ensure a partial write leaves the previous contents in place", func(t *testing.T) {
+		err := ReplaceFile(name, 0644, func(w io.Writer) error {
+			_, err := io.WriteString(&failingWriter{w: w, limit: 4}, `{"namespaces":[]}`)
+			return err
+		})
+		if err == nil {
+			t.Fatal("expected the failed write to be returned")
+		}
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != `{"pods":[]}` {
+			t.Errorf("expected previous contents to survive a failed write, got %q: %v", data, err)
+		}
+	})
+
+	t.Run("Ensure the file is replaced and no temporary file is left", func(t *testing.T) {
+		err := ReplaceFile(name, 0644, func(w io.Writer) error {
+			_, err := io.WriteString(w, `{"namespaces":[]}`)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != `{"namespaces":[]}` {
+			t.Errorf("unexpected contents %q: %v", data, err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) != 1 {
+			t.Errorf("expected only the replaced file, got %v %v", entries, err)
+		}
+	})
+}
+
+func TestCopyFileContents(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestCopyFileContents")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "stats-summary-node0.json")
+	dst := filepath.Join(dir, "baseline-summary-node0.json")
+
+	if err := os.WriteFile(dst, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Ensure a missing source leaves the destination in place", func(t *testing.T) {
+		if err := CopyFileContents(dst, src); err == nil {
+			t.Error("expected an error for a missing source")
+		}
+		if data, _ := os.ReadFile(dst); string(data) != "previous" {
+			t.Errorf("expected destination to be unchanged, got %q", data)
+		}
+	})
+
+	t.Run("Ensure the destination is replaced", func(t *testing.T) {
+		if err := os.WriteFile(src, []byte("current"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := CopyFileContents(dst, src); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if data, _ := os.ReadFile(dst); string(data) != "current" {
+			t.Errorf("expected destination to be replaced, got %q", data)
+		}
+	})
+}
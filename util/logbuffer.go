@@ -0,0 +1,137 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultLogBufferSize is the default number of log records retained in memory
+const DefaultLogBufferSize = 5000
+
+// LogRingBuffer is a logrus hook that retains a bounded number of recent log records in memory
+// so they are still available after the container log has rotated. Records are formatted once
+// when fired and stored in a fixed-size ring, so the oldest record is overwritten once full.
+type LogRingBuffer struct {
+	mu      sync.Mutex
+	entries []string
+	next    int
+	full    bool
+}
+
+// NewLogRingBuffer returns a LogRingBuffer retaining at most size records
+func NewLogRingBuffer(size int) *LogRingBuffer {
+	if size <= 0 {
+		size = DefaultLogBufferSize
+	}
+	return &LogRingBuffer{
+		entries: make([]string, size),
+	}
+}
+
+// Levels returns the log levels captured by the buffer
+func (b *LogRingBuffer) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire formats the entry and stores it in the ring, overwriting the oldest record when full
+func (b *LogRingBuffer) Fire(entry *log.Entry) error {
+	line := formatLogEntry(entry)
+
+	b.mu.Lock()
+	b.entries[b.next] = line
+	b.next++
+	if b.next == len(b.entries) {
+		b.next = 0
+		b.full = true
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of records currently retained
+func (b *LogRingBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.full {
+		return len(b.entries)
+	}
+	return b.next
+}
+
+// Tail returns up to n of the most recent records, oldest first. A value of n <= 0 returns every record.
+func (b *LogRingBuffer) Tail(n int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	count := b.next
+	if b.full {
+		count = len(b.entries)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+
+	lines := make([]string, n)
+	start := b.next - n
+	if start < 0 {
+		start += len(b.entries)
+	}
+	for i := 0; i < n; i++ {
+		lines[i] = b.entries[(start+i)%len(b.entries)]
+	}
+	return lines
+}
+
+// WriteTail writes up to n of the most recent records to w, one per line
+func (b *LogRingBuffer) WriteTail(w io.Writer, n int) error {
+	for _, line := range b.Tail(n) {
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatLogEntry renders an entry as a single plain text line independent of the configured formatter
+func formatLogEntry(entry *log.Entry) string {
+	var sb strings.Builder
+	sb.Grow(len(entry.Message) + 64)
+	sb.WriteString(entry.Time.UTC().Format(time.RFC3339Nano))
+	sb.WriteByte(' ')
+	sb.WriteString(strings.ToUpper(entry.Level.String()))
+	sb.WriteByte(' ')
+	sb.WriteString(strings.TrimRight(entry.Message, "\n"))
+
+	if len(entry.Data) > 0 {
+		keys := make([]string, 0, len(entry.Data))
+		for k := range entry.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sb.WriteByte(' ')
+			sb.WriteString(k)
+			sb.WriteByte('=')
+			sb.WriteString(stringifyLogValue(entry.Data[k]))
+		}
+	}
+	sb.WriteByte('\n')
+	return sb.String()
+}
+
+func stringifyLogValue(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case error:
+		return val.Error()
+	default:
+		return strings.TrimSpace(strings.ReplaceAll(fmt.Sprint(val), "\n", " "))
+	}
+}
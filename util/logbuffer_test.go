@@ -0,0 +1,76 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLogRingBuffer(t *testing.T) {
+	fire := func(b *LogRingBuffer, msg string) {
+		_ = b.Fire(&log.Entry{
+			Time:    time.Unix(0, 0),
+			Level:   log.InfoLevel,
+			Message: msg,
+		})
+	}
+
+	t.Run("Ensure records are returned oldest first before the buffer wraps", func(t *testing.T) {
+		b := NewLogRingBuffer(3)
+		fire(b, "one")
+		fire(b, "two")
+
+		lines := b.Tail(0)
+		if len(lines) != 2 || b.Len() != 2 {
+			t.Fatalf("expected 2 records, got %d", len(lines))
+		}
+		if !strings.Contains(lines[0], "one") || !strings.Contains(lines[1], "two") {
+			t.Errorf("unexpected record order: %v", lines)
+		}
+	})
+
+	t.Run("Ensure the oldest records are overwritten once full", func(t *testing.T) {
+		b := NewLogRingBuffer(3)
+		for _, m := range []string{"one", "two", "three", "four", "five"} {
+			fire(b, m)
+		}
+
+		lines := b.Tail(0)
+		if len(lines) != 3 {
+			t.Fatalf("expected buffer to be capped at 3 records, got %d", len(lines))
+		}
+		for i, m := range []string{"three", "four", "five"} {
+			if !strings.Contains(lines[i], m) {
+				t.Errorf("expected record %d to contain %s, got %s", i, m, lines[i])
+			}
+		}
+
+		tail := b.Tail(2)
+		if len(tail) != 2 || !strings.Contains(tail[0], "four") || !strings.Contains(tail[1], "five") {
+			t.Errorf("unexpected tail: %v", tail)
+		}
+	})
+
+	t.Run("Ensure fields are rendered in a stable order", func(t *testing.T) {
+		b := NewLogRingBuffer(1)
+		_ = b.Fire(&log.Entry{
+			Time:    time.Unix(0, 0),
+			Level:   log.WarnLevel,
+			Message: "failed",
+			Data:    log.Fields{"node": "node0", "error": errors.New("boom")},
+		})
+
+		var buf bytes.Buffer
+		if err := b.WriteTail(&buf, 1); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := "1970-01-01T00:00:00Z WARNING failed error=boom node=node0\n"
+		if buf.String() != expected {
+			t.Errorf("expected %q, got %q", expected, buf.String())
+		}
+	})
+}
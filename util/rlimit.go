@@ -0,0 +1,14 @@
+//go:build !windows
+
+package util
+
+import "syscall"
+
+// OpenFileLimit returns the soft limit on open file descriptors for the process (RLIMIT_NOFILE)
+func OpenFileLimit() (uint64, error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, err
+	}
+	return uint64(rlimit.Cur), nil
+}
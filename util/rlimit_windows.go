@@ -0,0 +1,8 @@
+package util
+
+import "errors"
+
+// OpenFileLimit is not supported on windows, which has no RLIMIT_NOFILE
+func OpenFileLimit() (uint64, error) {
+	return 0, errors.New("open file limit is not available on windows")
+}
@@ -1,8 +1,7 @@
 package util
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -11,9 +10,11 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
+	"github.com/cloudability/metrics-agent/credentials"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/spf13/viper"
@@ -23,6 +24,8 @@ import (
 // ErrEmptyDataDir error to indicate the data directory is empty
 var ErrEmptyDataDir = errors.New("empty data directory")
 
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
 // IsValidURL returns true if string is a valid URL
 func IsValidURL(toTest string) bool {
 	_, err := url.ParseRequestURI(toTest)
@@ -30,10 +33,11 @@ func IsValidURL(toTest string) bool {
 }
 
 // TestHTTPConnection takes
-// a given client / URL(string) / bearerToken(string)/ retries count (int)
+// a given client / URL(string) / credentials provider / retries count (int)
 // and returns true if response code is 2xx.
 func TestHTTPConnection(testClient rest.HTTPClient,
-	URL, method, bearerToken string, retries uint, verbose bool) (successful bool, body *[]byte, err error) {
+	URL, method string, creds credentials.Provider, retries uint, verbose bool) (successful bool, body *[]byte,
+	err error) {
 	IsValidURL(URL)
 	attempts := retries + 1
 
@@ -42,11 +46,14 @@ func TestHTTPConnection(testClient rest.HTTPClient,
 		log.Fatalf("Unable to make new request: %v", err)
 	}
 
-	if bearerToken != "" {
-		req.Header.Add("Authorization", "Bearer "+bearerToken)
+	if err := authorize(req, creds); err != nil {
+		return false, &[]byte{}, err
 	}
+	reauthenticated := false
 	for i := uint(0); i < attempts; i++ {
-		resp, err := testClient.Do(req)
+		// the error of the last attempt is returned
+		var resp *http.Response
+		resp, err = testClient.Do(req)
 		if err != nil {
 			if verbose {
 				log.Warnf("Unable to connect to URL: %s retrying: %v", URL, i+1)
@@ -54,6 +61,17 @@ func TestHTTPConnection(testClient rest.HTTPClient,
 			time.Sleep(time.Duration(int64(math.Pow(2, float64(i)))) * time.Second)
 			continue
 		}
+		if resp.StatusCode == http.StatusUnauthorized && creds != nil && !reauthenticated {
+			// the token may have been rotated since it was cached, so a fresh token is tried once at once
+			_ = resp.Body.Close()
+			reauthenticated = true
+			creds.Invalidate()
+			if err := authorize(req, creds); err != nil {
+				return false, &[]byte{}, err
+			}
+			attempts++
+			continue
+		}
 		defer SafeClose(resp.Body.Close, &err)
 		body, rerr := io.ReadAll(resp.Body)
 		if rerr != nil {
@@ -68,6 +86,22 @@ func TestHTTPConnection(testClient rest.HTTPClient,
 
 }
 
+// authorize sets the bearer token of creds on the request, replacing any token already set
+func authorize(req *http.Request, creds credentials.Provider) error {
+	if creds == nil {
+		return nil
+	}
+	token, err := creds.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Del("Authorization")
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
 // CheckRequiredSettings checks for required min values / flags / environment variables
 func CheckRequiredSettings(requiredArgs []string) error {
 
@@ -88,8 +122,10 @@ func CheckRequiredSettings(requiredArgs []string) error {
 	return nil
 }
 
-// CreateMetricSample creates a metric sample from a given directory removing the source directory if cleanup is true
-func CreateMetricSample(exportDirectory os.File, uid string, cleanUp bool, scratchDir string) (*os.File, error) {
+// CreateMetricSample creates a metric sample from a given directory removing the source directory if cleanup is true.
+// The name of the archive ends in the cycle ID of the latest poll it holds, if one is given.
+func CreateMetricSample(exportDirectory os.File, uid string, cleanUp bool, scratchDir,
+	cycleID string) (*os.File, error) {
 
 	ed, err := exportDirectory.Stat()
 	if err != nil || !ed.IsDir() {
@@ -101,16 +137,15 @@ func CreateMetricSample(exportDirectory os.File, uid string, cleanUp bool, scrat
 		return nil, err
 	}
 
-	sampleFilename := getExportFilename(uid)
-	destFile, err := os.Create(scratchDir + "/" + sampleFilename + ".tgz")
-
-	if err != nil {
-		log.Errorf("Unable to create metric sample file: %v", err)
-		return nil, err
-	}
-
-	err = createTGZ(exportDirectory, destFile)
+	sampleFilename := getExportFilename(uid, cycleID)
+	return CompleteMetricSample(exportDirectory.Name(), scratchDir+"/"+sampleFilename+".tgz", cleanUp)
+}
 
+// CompleteMetricSample builds the metric sample archive dest from a directory, continuing an interrupted build
+// of it, and removes the contents of the directory if cleanup is true. The archive is only marked finished
+// once the directory has been cleaned up.
+func CompleteMetricSample(exportDirectory, dest string, cleanUp bool) (*os.File, error) {
+	err := BuildArchive(exportDirectory, dest)
 	if err != nil {
 		log.Errorf("Unable to tar metric sample directory: %v", err)
 		return nil, err
@@ -118,98 +153,47 @@ func CreateMetricSample(exportDirectory os.File, uid string, cleanUp bool, scrat
 
 	// cleanup directory after creating the sample
 	if cleanUp {
-		err = removeDirectoryContents(exportDirectory.Name() + "/")
+		err = removeDirectoryContents(exportDirectory + "/")
 	}
 
 	if err != nil {
 		log.Errorf("Unable to cleanup metric sample directory: %v", err)
 		return nil, err
 	}
+	if err = FinishArchive(dest); err != nil {
+		log.Errorf("Unable to finish metric sample archive: %v", err)
+		return nil, err
+	}
 
-	return destFile, err
+	//nolint gosec
+	return os.Open(dest)
 }
 
-// createTGZ takes a source and variable writers and walks 'source' writing each file
-// found to the tar writer; the purpose for accepting multiple writers is to allow
-// for multiple outputs
-func createTGZ(src os.File, writers ...io.Writer) (rerr error) {
-
-	// ensure the src actually exists before trying to tar it
-	if _, err := os.Stat(src.Name()); err != nil {
-		return fmt.Errorf("Unable to tar files - %v", err.Error())
+func getExportFilename(uid, cycleID string) string {
+	t := time.Now().UTC()
+	name := uid + "_" + t.Format("20060102150405")
+	if cycleID != "" {
+		name += "_" + cycleID
 	}
-
-	mw := io.MultiWriter(writers...)
-
-	//nolint gas
-	gzw, _ := gzip.NewWriterLevel(mw, 9)
-
-	defer SafeClose(gzw.Close, &rerr)
-
-	tw := tar.NewWriter(gzw)
-
-	defer func() {
-		err := tw.Close()
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
-
-	// walk path
-	return filepath.Walk(src.Name(), func(file string, fileInfo os.FileInfo, err error) (rerr error) {
-
-		// return on any error
-		if err != nil {
-			return err
-		}
-
-		// create a new dir/file header
-		header, err := tar.FileInfoHeader(fileInfo, fileInfo.Name())
-		if err != nil {
-			return err
-		}
-
-		// return on directories since there will be no content to tar
-		if fileInfo.Mode().IsDir() {
-			return nil
-		}
-
-		// if not a directory update the name to correctly reflect the desired destination when untaring
-		if !fileInfo.Mode().IsDir() {
-			header.Name = filepath.Join(filepath.Base(src.Name()), strings.TrimPrefix(file, src.Name()))
-		}
-		// write the header
-		if err := tw.WriteHeader(header); err != nil {
-			return err
-		}
-
-		// open files for taring
-		//nolint gosec
-		f, err := os.Open(file)
-		if err != nil {
-			return err
-		}
-
-		defer SafeClose(f.Close, &rerr)
-
-		// copy file data into tar writer
-		if _, err := io.Copy(tw, f); err != nil {
-			return err
-		}
-
-		return err
-	})
+	return name
 }
 
-func getExportFilename(uid string) string {
-	t := time.Now().UTC()
-	return uid + "_" + t.Format("20060102150405")
+// ArchiveCycleID returns the cycle ID the name of a metric sample archive ends in, empty if it has none
+func ArchiveCycleID(archive string) string {
+	parts := strings.Split(strings.TrimSuffix(filepath.Base(archive), ".tgz"), "_")
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[len(parts)-1]
 }
 
+// WorkingDirectoryPrefix prefixes the name of the metric sample working directories in the scratch directory
+const WorkingDirectoryPrefix = "cldy-metrics"
+
 // CreateMSWorkingDirectory takes a given prefix and returns a metric sample working directory
 func CreateMSWorkingDirectory(uid string, scratchDir string) (*os.File, error) {
 	// create metric sample directory
-	td, err := os.MkdirTemp(scratchDir, "cldy-metrics")
+	td, err := os.MkdirTemp(scratchDir, WorkingDirectoryPrefix)
 	if err != nil {
 		log.Errorf("Unable to create temporary directory: %v", err)
 		return nil, err
@@ -257,7 +241,8 @@ func removeDirectoryContents(dir string) (err error) {
 // CopyFileContents copies the contents of the file named src to the file named
 // by dst. The file will be created if it does not already exist. If the
 // destination file exists, all it's contents will be replaced by the contents
-// of the source file.
+// of the source file. The copy is written atomically as it is used for baselines,
+// which must survive a restart.
 func CopyFileContents(dst, src string) (rerr error) {
 	//nolint gosec
 	in, err := os.Open(src)
@@ -267,16 +252,41 @@ func CopyFileContents(dst, src string) (rerr error) {
 
 	defer SafeClose(in.Close, &rerr)
 
-	out, err := os.Create(dst)
-	if err != nil {
+	return WriteFileAtomic(dst, 0644, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
 		return err
-	}
-	defer SafeClose(out.Close, &rerr)
+	})
+}
 
-	if _, err = io.Copy(out, in); err != nil {
-		return err
+// TruncateRecords truncates a file of newline terminated records to the whole records within its first
+// max bytes, returning the new size
+func TruncateRecords(path string, max int64) (size int64, rerr error) {
+	//nolint gosec
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
 	}
-	return out.Sync()
+	defer SafeClose(f.Close, &rerr)
+
+	// search backwards from max for the end of the last whole record
+	buf := make([]byte, 64*1024)
+	end := max
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	return end, f.Truncate(end)
 }
 
 // SafeClose will close the given closer function, setting the err ONLY if it is currently nil. This
@@ -306,14 +316,29 @@ func MatchOneFile(directory string, pattern string) (fileName string, err error)
 	return "", fmt.Errorf("No matches found")
 }
 
+// recentLogs retains recent log records for inclusion in diagnostics
+var recentLogs *LogRingBuffer
+
+// RecentLogs returns the in-memory buffer of recent log records, or nil if it has not been set up
+func RecentLogs() *LogRingBuffer {
+	return recentLogs
+}
+
 // SetupLogger sets configuration for the default logger
 func SetupLogger() (err error) {
 
 	var (
 		ll = viper.GetString("log_level")
 		lf = strings.ToLower(viper.GetString("log_format"))
+		lb = viper.GetInt("log_buffer_size")
 	)
 
+	// Retain recent log records in memory so they outlive container log rotation
+	if recentLogs == nil && lb > 0 {
+		recentLogs = NewLogRingBuffer(lb)
+		log.AddHook(recentLogs)
+	}
+
 	// Set log level
 	l, err := log.ParseLevel(ll)
 	if err != nil {
@@ -344,6 +369,12 @@ func ValidateScratchDir(scratchDir string) error {
 	return nil
 }
 
+// SanitizeFileName replaces any character that is not safe to use in a metric sample file name with an
+// underscore
+func SanitizeFileName(name string) string {
+	return unsafeFileNameChars.ReplaceAllString(name, "_")
+}
+
 // CheckIfDirEmpty checks if a directory is empty, returning an ErrEmptyDataDir error if it is
 func CheckIfDirEmpty(dirname string) (rerr error) {
 	dir, err := os.Open(dirname)
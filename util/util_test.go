@@ -12,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cloudability/metrics-agent/credentials"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -59,7 +60,7 @@ func TestTestHTTPConnection(t *testing.T) {
 		}))
 		defer ts.Close()
 
-		b, _, _ := TestHTTPConnection(testClient, ts.URL, http.MethodGet, "", 10, true)
+		b, _, _ := TestHTTPConnection(testClient, ts.URL, http.MethodGet, nil, 10, true)
 		log.Print(strconv.FormatBool(b))
 		if !b {
 			t.Error("invalid connection")
@@ -75,13 +76,48 @@ func TestTestHTTPConnection(t *testing.T) {
 		}))
 		defer ts.Close()
 
-		b, _, err := TestHTTPConnection(testClient, ts.URL, http.MethodGet, "", 10, true)
+		b, _, err := TestHTTPConnection(testClient, ts.URL, http.MethodGet, nil, 10, true)
 		log.Print(strconv.FormatBool(b))
 		if b {
 			t.Errorf("Non 200 should return false : %v", err)
 		}
 	})
 
+	t.Run("ensure that a rejected token is read again from its file", func(t *testing.T) {
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		if err := os.WriteFile(tokenFile, []byte("first"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(tokenFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			current, _ := os.ReadFile(tokenFile)
+			if r.Header.Get("Authorization") != "Bearer "+string(current) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(200)
+		}))
+		defer ts.Close()
+		creds := credentials.NewFileProvider(tokenFile, time.Hour)
+
+		if b, _, err := TestHTTPConnection(testClient, ts.URL, http.MethodGet, creds, 0, false); !b {
+			t.Fatalf("expected the first token to be accepted: %v", err)
+		}
+		// the modification time is kept so only the rejection causes the file to be read again
+		if err := os.WriteFile(tokenFile, []byte("second"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(tokenFile, fi.ModTime(), fi.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+		if b, _, err := TestHTTPConnection(testClient, ts.URL, http.MethodGet, creds, 0, false); !b {
+			t.Errorf("expected the rotated token to be accepted: %v", err)
+		}
+	})
+
 }
 
 func TestCheckRequiredSettings(t *testing.T) {
@@ -196,10 +232,15 @@ func TestCreateMetricSample(t *testing.T) {
 
 		if _, err = os.Stat(testDataDirectory); err == nil {
 			sampleDirectory, err = os.Open(testDataDirectory)
-			ms, err := CreateMetricSample(*sampleDirectory, "cluster-id", false, os.TempDir())
+			ms, err := CreateMetricSample(*sampleDirectory, "cluster-id", false, os.TempDir(),
+				"01ARYZ6S41TSV4RRFFQ69G5FAV")
 			if err != nil {
 				t.Errorf("Error creating agent Status Metric: %v", err)
 			}
+			defer os.Remove(ms.Name())
+			if id := ArchiveCycleID(ms.Name()); id != "01ARYZ6S41TSV4RRFFQ69G5FAV" {
+				t.Errorf("expected the archive to be named by the cycle ID, got %s", ms.Name())
+			}
 
 			tgz, err = os.Open(ms.Name())
 			if err != nil {
@@ -231,7 +272,7 @@ func TestCreateMetricSample(t *testing.T) {
 		}
 
 		// First we expect no data
-		_, err = CreateMetricSample(*sampleDirectory, "cluster-id", false, os.TempDir())
+		_, err = CreateMetricSample(*sampleDirectory, "cluster-id", false, os.TempDir(), "")
 		if err != ErrEmptyDataDir {
 			t.Errorf("expected an ErrEmptyDataDir error but got: %v", err)
 		}
@@ -245,13 +286,24 @@ func TestCreateMetricSample(t *testing.T) {
 		_ = fp.Close()
 
 		// Then we expect data
-		_, err = CreateMetricSample(*sampleDirectory, "cluster-id", false, os.TempDir())
+		_, err = CreateMetricSample(*sampleDirectory, "cluster-id", false, os.TempDir(), "")
 		if err != nil {
 			t.Errorf("unexpected error but got: %v", err)
 		}
 	})
 }
 
+func TestArchiveCycleID(t *testing.T) {
+	for archive, want := range map[string]string{
+		"/tmp/cluster-id_20240102030405_01ARYZ6S41TSV4RRFFQ69G5FAV.tgz": "01ARYZ6S41TSV4RRFFQ69G5FAV",
+		"/tmp/cluster-id_20240102030405.tgz":                            "",
+	} {
+		if got := ArchiveCycleID(archive); got != want {
+			t.Errorf("expected the cycle ID of %s to be %q, got %q", archive, want, got)
+		}
+	}
+}
+
 func TestMatchOneFile(t *testing.T) {
 	dir := os.TempDir() + "/cldy-test" + strconv.FormatInt(
 		time.Now().Unix(), 10)
@@ -315,3 +367,49 @@ func TestValidateScratchDir(t *testing.T) {
 		}
 	})
 }
+
+func TestSanitizeFileName(t *testing.T) {
+	t.Run("Ensure that safe names are unchanged", func(t *testing.T) {
+		name := "stats-summary-ip-10-0-0-1.ec2.internal"
+		if SanitizeFileName(name) != name {
+			t.Errorf("expected %s to be unchanged, got %s", name, SanitizeFileName(name))
+		}
+	})
+
+	t.Run("Ensure that unsafe characters are replaced", func(t *testing.T) {
+		if s := SanitizeFileName("../etc/pass wd"); s != ".._etc_pass_wd" {
+			t.Errorf("expected unsafe characters to be replaced, got %s", s)
+		}
+	})
+}
+
+func TestTruncateRecords(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestTruncateRecords")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pods.jsonl")
+
+	tests := []struct {
+		max      int64
+		expected string
+	}{
+		{max: 8, expected: "{a}\n{b}\n"},
+		{max: 10, expected: "{a}\n{b}\n"},
+		{max: 3, expected: ""},
+	}
+	for _, tc := range tests {
+		if err := os.WriteFile(path, []byte("{a}\n{b}\n{c}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		size, err := TruncateRecords(path, tc.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(path)
+		if string(data) != tc.expected || size != int64(len(tc.expected)) {
+			t.Errorf("truncating to %d: expected %q, got %q (%d)", tc.max, tc.expected, data, size)
+		}
+	}
+}
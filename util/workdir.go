@@ -0,0 +1,259 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrWorkDirClosed is returned creating a file in a WorkDir that has been closed
+var ErrWorkDirClosed = errors.New("work directory is closed")
+
+// ErrWriteLimited is wrapped by the errors of the writes refused by the WriteLimit of a WorkDir
+var ErrWriteLimited = errors.New("write refused by the work directory limit")
+
+// WriteLimit is consulted before each write to the files of a WorkDir, eg: to cap the size of a sample as it
+// is written rather than once it is complete. It must be safe for concurrent use.
+type WriteLimit interface {
+	// Allow returns an error wrapping ErrWriteLimited if n more bytes may not be written to the named file,
+	// which is named relative to the WorkDir. It is called with n of 0 to check a file before creating it.
+	Allow(name string, n int) error
+	// Release is called with the bytes allowed that were not written, or that were truncated or removed
+	// through the WorkDir
+	Release(name string, n int64)
+}
+
+// WorkDir is a directory concurrent fetches write their files to, such as a metric sample directory. It
+// tracks the files it hands out so the directory is not cleaned up while they are still being written, and
+// refuses new files once closed. It is safe for concurrent use.
+type WorkDir struct {
+	name string
+
+	mu     sync.Mutex
+	files  map[*WorkDirFile]struct{}
+	closed bool
+	// idle is closed while no files are outstanding
+	idle  chan struct{}
+	limit WriteLimit
+}
+
+// NewWorkDir returns the WorkDir of the named directory, which must exist
+func NewWorkDir(name string) *WorkDir {
+	idle := make(chan struct{})
+	close(idle)
+	return &WorkDir{name: name, files: map[*WorkDirFile]struct{}{}, idle: idle}
+}
+
+// Name returns the path of the directory
+func (d *WorkDir) Name() string {
+	return d.name
+}
+
+// SetWriteLimit sets the limit consulted before each write to the files of the directory, nil removes it
+func (d *WorkDir) SetWriteLimit(limit WriteLimit) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.limit = limit
+}
+
+func (d *WorkDir) writeLimit() WriteLimit {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.limit
+}
+
+// Allow returns the error of the write limit of the directory if nothing more may be written to the named
+// file, so a file that would be refused is not fetched at all
+func (d *WorkDir) Allow(name string) error {
+	if l := d.writeLimit(); l != nil {
+		return l.Allow(name, 0)
+	}
+	return nil
+}
+
+// Create creates or truncates the named file in the directory. The file is outstanding until it is closed.
+func (d *WorkDir) Create(name string) (*WorkDirFile, error) {
+	return d.open(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+// Append opens the named file in the directory for appending, creating it if it does not exist. The file is
+// outstanding until it is closed.
+func (d *WorkDir) Append(name string) (*WorkDirFile, error) {
+	return d.open(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY)
+}
+
+// Remove removes the named file, which may be the path of the file within the directory, releasing its size
+// from the write limit
+func (d *WorkDir) Remove(name string) error {
+	name = d.relative(name)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	size := fileSize(filepath.Join(d.name, name))
+	if err := os.Remove(filepath.Join(d.name, name)); err != nil {
+		return err
+	}
+	if d.limit != nil && size > 0 {
+		d.limit.Release(name, size)
+	}
+	return nil
+}
+
+func (d *WorkDir) open(name string, flag int) (*WorkDirFile, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, ErrWorkDirClosed
+	}
+	path := filepath.Join(d.name, name)
+	// the size of a file truncated, eg: by a retried fetch, is no longer written
+	var truncated int64
+	if flag&os.O_TRUNC != 0 {
+		truncated = fileSize(path)
+	}
+	//nolint gosec
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if d.limit != nil && truncated > 0 {
+		d.limit.Release(name, truncated)
+	}
+	wf := &WorkDirFile{File: f, dir: d, name: name}
+	if len(d.files) == 0 {
+		d.idle = make(chan struct{})
+	}
+	d.files[wf] = struct{}{}
+	return wf, nil
+}
+
+// relative returns the name of a file within the directory given its path
+func (d *WorkDir) relative(name string) string {
+	if rel, ok := strings.CutPrefix(name, d.name+string(filepath.Separator)); ok {
+		return rel
+	}
+	return name
+}
+
+// fileSize returns the size of the file, 0 if it does not exist
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Outstanding returns the number of files created and not yet closed
+func (d *WorkDir) Outstanding() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.files)
+}
+
+// Close refuses new files and waits for the outstanding files to be closed by their writers. If ctx is done
+// first, the files still outstanding are closed so their writers fail instead of writing to a directory
+// being cleaned up, and an error is returned.
+func (d *WorkDir) Close(ctx context.Context) error {
+	d.mu.Lock()
+	d.closed = true
+	idle := d.idle
+	d.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+	}
+
+	d.mu.Lock()
+	outstanding := make([]*WorkDirFile, 0, len(d.files))
+	for f := range d.files {
+		outstanding = append(outstanding, f)
+	}
+	d.mu.Unlock()
+	if len(outstanding) == 0 {
+		return nil
+	}
+	for _, f := range outstanding {
+		_ = f.Close()
+	}
+	return fmt.Errorf("closed %d files of %s still being written: %w", len(outstanding), d.name, ctx.Err())
+}
+
+// RemoveAll closes the directory as Close does, then removes it and its contents
+func (d *WorkDir) RemoveAll(ctx context.Context) error {
+	closeErr := d.Close(ctx)
+	if err := os.RemoveAll(d.name); err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (d *WorkDir) release(f *WorkDirFile) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.files[f]; !ok {
+		return
+	}
+	delete(d.files, f)
+	if len(d.files) == 0 {
+		close(d.idle)
+	}
+}
+
+// WorkDirFile is a file created by a WorkDir, released by the WorkDir when closed. It may be closed more
+// than once, as it is closed by the WorkDir on shutdown while still held by its writer. Writes are refused
+// once the write limit of the WorkDir does not allow them.
+type WorkDirFile struct {
+	*os.File
+	dir  *WorkDir
+	name string
+
+	once sync.Once
+	err  error
+}
+
+// Close closes the file and releases it from its WorkDir, returning the error of the first close
+func (f *WorkDirFile) Close() error {
+	f.once.Do(func() {
+		f.err = f.File.Close()
+		f.dir.release(f)
+	})
+	return f.err
+}
+
+// Write writes to the file if the write limit of its WorkDir allows it, nothing is written otherwise
+func (f *WorkDirFile) Write(b []byte) (int, error) {
+	limit := f.dir.writeLimit()
+	if limit == nil {
+		return f.File.Write(b)
+	}
+	if err := limit.Allow(f.name, len(b)); err != nil {
+		return 0, err
+	}
+	n, err := f.File.Write(b)
+	if n < len(b) {
+		limit.Release(f.name, int64(len(b)-n))
+	}
+	return n, err
+}
+
+// WriteString writes the string as Write does
+func (f *WorkDirFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// ReadFrom copies from r via Write, rather than the file's own ReadFrom which bypasses the write limit
+func (f *WorkDirFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{f}, r)
+}
+
+// writerOnly hides the ReadFrom of a writer from io.Copy
+type writerOnly struct {
+	io.Writer
+}
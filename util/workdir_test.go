@@ -0,0 +1,195 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkDir(t *testing.T) {
+	t.Run("Ensure closing waits for outstanding files", func(t *testing.T) {
+		d := NewWorkDir(t.TempDir())
+		f, err := d.Create("stats-summary-node0.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		closed := make(chan error, 1)
+		go func() { closed <- d.Close(context.Background()) }()
+		select {
+		case err := <-closed:
+			t.Fatalf("expected close to wait for the outstanding file, returned %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if _, err := f.WriteString("{}"); err != nil {
+			t.Fatalf("expected the outstanding file to remain writable, got %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-closed; err != nil {
+			t.Errorf("unexpected error closing: %v", err)
+		}
+		if _, err := d.Create("stats-summary-node1.json"); !errors.Is(err, ErrWorkDirClosed) {
+			t.Errorf("expected a closed work dir to refuse new files, got %v", err)
+		}
+	})
+
+	t.Run("Ensure outstanding files are closed when the context is done", func(t *testing.T) {
+		d := NewWorkDir(t.TempDir())
+		f, err := d.Create("stats-summary-node0.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := d.Close(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the outstanding file to be closed on cancellation, got %v", err)
+		}
+		if _, err := f.WriteString("{}"); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("expected writes to a file closed on cancellation to fail, got %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Errorf("expected closing the file again to return the first close, got %v", err)
+		}
+		if n := d.Outstanding(); n != 0 {
+			t.Errorf("expected no outstanding files, got %d", n)
+		}
+	})
+}
+
+// TestWorkDirCleanupRace removes a work dir while node files are still being written to it, run with -race
+func TestWorkDirCleanupRace(t *testing.T) {
+	dir, err := os.MkdirTemp("", "TestWorkDirCleanupRace")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	d := NewWorkDir(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	const writers = 32
+	var wg sync.WaitGroup
+	started := make(chan struct{}, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := d.Create(fmt.Sprintf("stats-summary-node%d.json", i))
+			if err != nil {
+				started <- struct{}{}
+				return
+			}
+			defer f.Close()
+			started <- struct{}{}
+			// writes until the file is closed under the writer by the cleanup
+			for {
+				if _, err := f.WriteString(`{"node":{}}`); err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < writers; i++ {
+		<-started
+	}
+
+	removed := make(chan error, 1)
+	go func() { removed <- d.RemoveAll(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	if err := <-removed; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the in-flight files to be closed on cancellation, got %v", err)
+	}
+	wg.Wait()
+	if n := d.Outstanding(); n != 0 {
+		t.Errorf("expected no outstanding files, got %d", n)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected the work dir to be removed, got %v", err)
+	}
+	if _, err := d.Create("stats-summary-late.json"); !errors.Is(err, ErrWorkDirClosed) {
+		t.Errorf("expected a removed work dir to refuse new files, got %v", err)
+	}
+}
+
+// byteLimit is a write limit refusing the writes past max bytes
+type byteLimit struct {
+	mu      sync.Mutex
+	max     int64
+	written int64
+}
+
+func (l *byteLimit) Allow(name string, n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.written+int64(n) > l.max {
+		return fmt.Errorf("%s: %w", name, ErrWriteLimited)
+	}
+	l.written += int64(n)
+	return nil
+}
+
+func (l *byteLimit) Release(_ string, n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.written -= n
+}
+
+func TestWorkDirWriteLimit(t *testing.T) {
+	d := NewWorkDir(t.TempDir())
+	limit := &byteLimit{max: 10}
+	d.SetWriteLimit(limit)
+
+	f, err := d.Create("stats-summary-node0.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("123456"); err != nil {
+		t.Fatalf("unexpected error writing within the limit: %v", err)
+	}
+	// copies are written through the limit, not the file's own ReadFrom
+	if _, err := io.Copy(f, strings.NewReader("123456")); !errors.Is(err, ErrWriteLimited) {
+		t.Errorf("expected a copy past the limit to be refused, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(f.Name()); string(data) != "123456" {
+		t.Errorf("expected nothing of a refused write to be written, got %q", data)
+	}
+	if err := d.Allow("stats-summary-node1.json"); err != nil {
+		t.Errorf("expected a file within the limit to be allowed, got %v", err)
+	}
+
+	// the size of a file truncated or removed is released
+	if f, err = d.Create("stats-summary-node0.json"); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if limit.written != 0 {
+		t.Errorf("expected a truncated file to be released, %d bytes still written", limit.written)
+	}
+	if f, err = d.Append("pods.jsonl"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("{}\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if err := d.Remove(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if limit.written != 0 {
+		t.Errorf("expected a removed file to be released, %d bytes still written", limit.written)
+	}
+}